@@ -0,0 +1,113 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Absent contains the configuration of the response served
+// when the requested host doesn't have a record
+type Absent struct {
+	// Action is one of notfound, next or redirect. The requests
+	// get the global fallback when it's empty.
+	Action string
+	// Template is an HTML template served by the notfound action
+	Template string
+
+	tmpl *template.Template
+}
+
+const (
+	AbsentNotFound = "notfound"
+	AbsentNext     = "next"
+	AbsentRedirect = "redirect"
+)
+
+// serve responds to the request of a host without a record
+// using the configured action
+func (a *Absent) serve(w http.ResponseWriter, r *http.Request, c Config) error {
+	action := a.Action
+	if action == "" {
+		action = "fallback"
+	}
+	if c.Prometheus.Enable {
+		AbsentRecords.WithLabelValues(action).Add(1)
+	}
+
+	switch a.Action {
+	case AbsentNext:
+		// The request gets handled by the next middleware
+		return fmt.Errorf("option disabled")
+
+	case AbsentRedirect:
+		redirect := reachableTarget(splitTargets(c.Redirect), c)
+		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, redirect)
+		w.Header().Set("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
+		http.Redirect(w, r, redirect, http.StatusMovedPermanently)
+		return nil
+
+	case AbsentNotFound:
+		w.Header().Set("Status-Code", strconv.Itoa(http.StatusNotFound))
+		if a.tmpl == nil {
+			c.Templates.serveNotFound(w, r)
+			return nil
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		return a.tmpl.Execute(w, struct {
+			Host string
+			Path string
+		}{r.Host, r.URL.Path})
+	}
+
+	fallback(w, r, nil, "", "global", http.StatusFound, c)
+	return nil
+}
+
+// ParseAbsent parses the absent_action option's arguments
+func (a *Absent) ParseAbsent(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("absent_action needs one of %s, %s or %s", AbsentNotFound, AbsentNext, AbsentRedirect)
+	}
+	a.Action = args[0]
+	switch a.Action {
+	case AbsentNotFound:
+		if len(args) > 2 {
+			return fmt.Errorf("absent_action %s only takes a template", AbsentNotFound)
+		}
+		if len(args) == 2 {
+			a.Template = args[1]
+			data, err := ioutil.ReadFile(a.Template)
+			if err != nil {
+				return fmt.Errorf("couldn't read the absent_action template: %s", err.Error())
+			}
+			if a.tmpl, err = template.New("absent").Parse(string(data)); err != nil {
+				return fmt.Errorf("couldn't parse the absent_action template: %s", err.Error())
+			}
+		}
+	case AbsentNext, AbsentRedirect:
+		if len(args) > 1 {
+			return fmt.Errorf("absent_action %s doesn't take any arguments", a.Action)
+		}
+	default:
+		return fmt.Errorf("The given value for absent_action is not standard. It should be one of %s, %s or %s", AbsentNotFound, AbsentNext, AbsentRedirect)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestAbsentActions(t *testing.T) {
+	file, err := ioutil.TempFile("", "absent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("<html>{{.Host}} isn't configured</html>")
+	file.Close()
+
+	withTemplate := Absent{}
+	if err := withTemplate.ParseAbsent([]string{"notfound", file.Name()}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		absent   Absent
+		redirect string
+		status   int
+		location string
+		body     string
+		passed   bool
+	}{
+		// The implicit behavior falls back to the global redirect
+		{Absent{}, "https://fallback.example.com", 301, "https://fallback.example.com", "", false},
+		{Absent{}, "", 404, "", "", false},
+		{Absent{Action: "notfound"}, "https://fallback.example.com", 404, "", "", false},
+		{withTemplate, "https://fallback.example.com", 404, "", "<html>absent.test isn't configured</html>", false},
+		{Absent{Action: "redirect"}, "https://fallback.example.com", 301, "https://fallback.example.com", "", false},
+		{Absent{Action: "next"}, "https://fallback.example.com", 200, "", "", true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Redirect: test.redirect,
+			Absent:   test.absent,
+		}
+		w := httptest.NewRecorder()
+		err := Redirect(w, httptest.NewRequest("GET", "https://absent.test/path", nil), c)
+		if test.passed {
+			if err == nil || err.Error() != "option disabled" {
+				t.Errorf("Test %d: Expected the request to be passed to the next middleware, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestParseAbsent(t *testing.T) {
+	tests := []struct {
+		config    string
+		action    string
+		shouldErr bool
+	}{
+		{"absent_action notfound", "notfound", false},
+		{"absent_action next", "next", false},
+		{"redirect https://example.com\nabsent_action redirect", "redirect", false},
+		{"absent_action redirect", "", true},
+		{"absent_action notfound /nonexistent/404.html", "", true},
+		{"absent_action next now", "", true},
+		{"absent_action teapot", "", true},
+		{"absent_action", "", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			%s
+		}
+		`, test.config))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.Absent.Action != test.action {
+			t.Errorf("Test %d: Expected the %s action, got %s", i, test.action, conf.Absent.Action)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// AccessLog contains the structured access log's configuration
+type AccessLog struct {
+	Enable bool
+	Output string
+	Redact []string
+
+	logger *jsonLogger
+}
+
+// jsonLogger writes JSON lines to its output
+type jsonLogger struct {
+	sync.Mutex
+	encoder *json.Encoder
+}
+
+// newJSONLogger creates a jsonLogger writing to stdout, stderr or a rotated file
+func newJSONLogger(output string) *jsonLogger {
+	var out io.Writer
+	switch output {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		out = &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    100,
+			MaxAge:     14,
+			MaxBackups: 10,
+		}
+	}
+	return &jsonLogger{encoder: json.NewEncoder(out)}
+}
+
+// log writes the given entry as a single line
+func (l *jsonLogger) log(entry interface{}) {
+	l.Lock()
+	defer l.Unlock()
+	l.encoder.Encode(entry)
+}
+
+// accessLogFields are the fields written for every request
+var accessLogFields = []string{"time", "host", "method", "path", "zone", "type", "target", "status", "latency_ms", "client_ip"}
+
+// requestInfo collects details about how a request got handled
+type requestInfo struct {
+	Zone string
+	Type string
+	// RecordCached is set when the last TXT record lookup
+	// got served from the record cache
+	RecordCached bool
+	// Fallback is the kind of fallback used for the request
+	Fallback string
+	// Errors are the failures of the zones tried for the request
+	Errors lookupErrors
+	// Records are the TXT records used for the request, in order
+	Records []usedRecord
+	// inFlight is set while the request is counted in the in-flight gauge
+	inFlight bool
+
+	// preview is set when the request is previewed, so the records
+	// fetching from their upstreams only keep their target
+	preview bool
+	target  string
+
+	// geoip is the database used for the client's location
+	geoip *GeoIP
+	geo   *geoLocation
+
+	// clientCerts verifies the client certificate of the placeholders
+	clientCerts *ClientCerts
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo attaches an empty requestInfo to the request's context
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// getRequestInfo returns the requestInfo attached to the context. A detached
+// requestInfo gets returned if there is none, so callers don't need nil checks.
+func getRequestInfo(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// statusRecorder keeps track of the status code written to the response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered response to the client, so the
+// streamed responses keep flushing with the logs enabled
+func (s *statusRecorder) Flush() {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// SetDefaults sets the default values for access log config
+// if the fields are empty
+func (a *AccessLog) SetDefaults() {
+	if a.Output == "" {
+		a.Output = "stdout"
+	}
+	if a.logger == nil {
+		a.logger = newJSONLogger(a.Output)
+	}
+}
+
+// log writes a JSON line describing the handled request
+func (a *AccessLog) log(r *http.Request, info *requestInfo, target string, status int, latency time.Duration) {
+	if a.logger == nil {
+		return
+	}
+	entry := map[string]interface{}{
+		"time":       time.Now().UTC().Format(time.RFC3339Nano),
+		"host":       r.Host,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+		"zone":       info.Zone,
+		"type":       info.Type,
+		"target":     target,
+		"status":     status,
+		"latency_ms": float64(latency) / float64(time.Millisecond),
+		"client_ip":  clientIP(r),
+	}
+	for _, field := range a.Redact {
+		delete(entry, field)
+	}
+
+	a.logger.log(entry)
+}
+
+// clientIP returns the IP address of the request's client
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// clientError drops the error of the request if its client hung up,
+// there's nobody to serve the error page to
+func clientError(err error, r *http.Request) error {
+	if err != nil && clientGone(r) {
+		log.Printf("[txtdirect]: The client of %s hung up: %s", r.Host+r.URL.Path, err.Error())
+		return nil
+	}
+	return err
+}
+
+// serve handles the request and writes an access log entry
+// and the request's span if they are enabled
+func serve(w http.ResponseWriter, r *http.Request, c Config) error {
+	r, info := withRequestInfo(r)
+	if c.GeoIP.Enable {
+		info.geoip = &c.GeoIP
+	}
+	if c.ClientCerts.Enable {
+		info.clientCerts = &c.ClientCerts
+	}
+	if c.Preview.Enable && c.Preview.requested(r) {
+		return c.Preview.serve(w, r, info, c)
+	}
+	if c.Debug && wantsPlaintext(r) {
+		w = &explainWriter{ResponseWriter: w, r: r, info: info}
+	}
+	start := time.Now()
+	if c.Prometheus.Enable {
+		defer info.trackInFlight()()
+		defer func() {
+			recordType := info.Type
+			if recordType == "" {
+				recordType = "none"
+			}
+			HandlerDuration.WithLabelValues(recordType).Observe(time.Since(start).Seconds())
+		}()
+	}
+	var span *traceSpan
+	if c.Tracing.Enable {
+		r, span = c.Tracing.startRequest(r)
+	}
+	if !c.AccessLog.Enable && !c.DecisionLog.Enable && !c.Webhooks.Enable && span == nil {
+		return clientError(handle(w, r, c), r)
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+
+	err := clientError(handle(rec, r, c), r)
+	if err != nil && err.Error() == "option disabled" {
+		// The request gets handled by the next middleware
+		span.finish(nil)
+		return err
+	}
+	status := rec.status
+	if err != nil {
+		status = http.StatusInternalServerError
+	} else if status == 0 && clientGone(r) {
+		status = StatusClientClosedRequest
+	}
+	span.finishRequest(info, status, err)
+	if c.AccessLog.Enable {
+		c.AccessLog.log(r, info, w.Header().Get("Location"), status, time.Since(start))
+	}
+	if c.DecisionLog.Enable && status != StatusClientClosedRequest {
+		c.DecisionLog.log(r, info, w.Header().Get("Location"), status, err)
+	}
+	if c.Webhooks.Enable && status != StatusClientClosedRequest {
+		c.Webhooks.notifyRequest(r, info, w.Header().Get("Location"), status)
+	}
+	return err
+}
+
+// ParseAccessLog parses the txtdirect config for the access log
+func (a *AccessLog) ParseAccessLog(c Dispenser) error {
+	switch c.Val() {
+	case "output":
+		a.Output = c.RemainingArgs()[0]
+
+	case "redact":
+		fields := c.RemainingArgs()
+		if len(fields) == 0 {
+			return c.ArgErr()
+		}
+		for _, field := range fields {
+			if !contains(accessLogFields, field) {
+				return fmt.Errorf("unknown access log field %s", field)
+			}
+		}
+		a.Redact = append(a.Redact, fields...)
+
+	default:
+		return c.ArgErr() // unhandled option for accesslog
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		url      string
+		redact   []string
+		expected map[string]interface{}
+	}{
+		{
+			"https://healthy.health.test/path",
+			nil,
+			map[string]interface{}{
+				"host":      "healthy.health.test",
+				"method":    "GET",
+				"path":      "/path",
+				"zone":      "_redirect.healthy.health.test.",
+				"type":      "host",
+				"target":    "https://healthy.target.test/path",
+				"status":    float64(302),
+				"client_ip": "192.0.2.1",
+			},
+		},
+		{
+			"https://healthy.health.test/path",
+			[]string{"client_ip", "path"},
+			map[string]interface{}{
+				"host":   "healthy.health.test",
+				"method": "GET",
+				"zone":   "_redirect.healthy.health.test.",
+				"type":   "host",
+				"target": "https://healthy.target.test/path",
+				"status": float64(302),
+			},
+		},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			AccessLog: AccessLog{
+				Enable: true,
+				Redact: test.redact,
+				logger: &jsonLogger{encoder: json.NewEncoder(&buf)},
+			},
+		}
+
+		w := httptest.NewRecorder()
+		if err := serve(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Errorf("Test %d: Couldn't decode the access log entry %q: %s", i, buf.String(), err)
+			continue
+		}
+		for _, field := range []string{"time", "latency_ms"} {
+			if _, ok := entry[field]; !ok {
+				t.Errorf("Test %d: Expected the %s field to be logged", i, field)
+			}
+			delete(entry, field)
+		}
+		if len(entry) != len(test.expected) {
+			t.Errorf("Test %d: Expected %d fields, got %+v", i, len(test.expected), entry)
+		}
+		for field, value := range test.expected {
+			if entry[field] != value {
+				t.Errorf("Test %d: Expected %s to be %v, got %v", i, field, value, entry[field])
+			}
+		}
+	}
+}
+
+func TestAccessLogClientGone(t *testing.T) {
+	silent, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {})
+	defer stop()
+
+	var buf bytes.Buffer
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: silent,
+		Redirect: "https://fallback.test",
+		AccessLog: AccessLog{
+			Enable: true,
+			logger: &jsonLogger{encoder: json.NewEncoder(&buf)},
+		},
+	}
+	// The cache makes the lookups go through the DNS client
+	c.RecordCache.Enable = true
+	c.RecordCache.SetDefaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	r := httptest.NewRequest("GET", "https://gone.test/", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	if err := serve(w, r, c); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to stop when the client hung up, took %s", elapsed)
+	}
+	if w.Header().Get("Location") != "" || w.Body.Len() != 0 {
+		t.Errorf("Expected nothing to be served to the client, got %q to %s", w.Body.String(), w.Header().Get("Location"))
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Couldn't decode the access log entry %q: %s", buf.String(), err)
+	}
+	if entry["status"] != float64(StatusClientClosedRequest) {
+		t.Errorf("Expected the status to be %d, got %v", StatusClientClosedRequest, entry["status"])
+	}
+}
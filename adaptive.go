@@ -0,0 +1,219 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Adaptive contains the configuration of the adaptive concurrency limiter
+// on the upstream calls of the proxy and gomods types. The limit grows by
+// one for every window of successful calls and gets multiplied by the
+// decrease factor when the upstream fails or gets slower than the latency
+// threshold (AIMD).
+type Adaptive struct {
+	Enable           bool
+	MinLimit         int
+	MaxLimit         int
+	InitialLimit     int
+	LatencyThreshold time.Duration
+	DecreaseFactor   float64
+	QueueTimeout     time.Duration
+
+	limiters *adaptiveLimiters
+}
+
+type adaptiveLimiters struct {
+	sync.Mutex
+	upstreams map[string]*aimdLimiter
+}
+
+// aimdLimiter limits the concurrent calls to a single upstream
+type aimdLimiter struct {
+	sync.Mutex
+	limit    float64
+	inflight int
+	// wake is closed and replaced whenever a call finishes
+	wake chan struct{}
+	// lastDecrease ignores the failures of the calls started before the
+	// last decrease, they were made under the previous limit
+	lastDecrease time.Time
+}
+
+const (
+	DefaultAdaptiveMinLimit         = 1
+	DefaultAdaptiveMaxLimit         = 256
+	DefaultAdaptiveInitialLimit     = 32
+	DefaultAdaptiveLatencyThreshold = 5 * time.Second
+	DefaultAdaptiveDecreaseFactor   = 0.5
+	DefaultAdaptiveQueueTimeout     = 2 * time.Second
+)
+
+// SetDefaults sets the default values for adaptive config
+// if the fields are empty
+func (a *Adaptive) SetDefaults() {
+	if a.MinLimit == 0 {
+		a.MinLimit = DefaultAdaptiveMinLimit
+	}
+	if a.MaxLimit == 0 {
+		a.MaxLimit = DefaultAdaptiveMaxLimit
+	}
+	if a.InitialLimit == 0 {
+		a.InitialLimit = DefaultAdaptiveInitialLimit
+	}
+	if a.InitialLimit > a.MaxLimit {
+		a.InitialLimit = a.MaxLimit
+	}
+	if a.InitialLimit < a.MinLimit {
+		a.InitialLimit = a.MinLimit
+	}
+	if a.LatencyThreshold == 0 {
+		a.LatencyThreshold = DefaultAdaptiveLatencyThreshold
+	}
+	if a.DecreaseFactor == 0 {
+		a.DecreaseFactor = DefaultAdaptiveDecreaseFactor
+	}
+	if a.QueueTimeout == 0 {
+		a.QueueTimeout = DefaultAdaptiveQueueTimeout
+	}
+	if a.limiters == nil {
+		a.limiters = &adaptiveLimiters{upstreams: make(map[string]*aimdLimiter)}
+	}
+}
+
+// limiter returns the given upstream's limiter
+func (a *Adaptive) limiter(upstream string) *aimdLimiter {
+	a.limiters.Lock()
+	defer a.limiters.Unlock()
+	l, ok := a.limiters.upstreams[upstream]
+	if !ok {
+		l = &aimdLimiter{limit: float64(a.InitialLimit), wake: make(chan struct{})}
+		a.limiters.upstreams[upstream] = l
+	}
+	return l
+}
+
+// acquire waits until the given upstream is under its concurrency limit and
+// returns the function which reports the call's outcome. The returned
+// function must be called exactly once with the call's error.
+func (a *Adaptive) acquire(ctx context.Context, upstream string, c Config) (func(error), error) {
+	if !a.Enable || a.limiters == nil {
+		return func(error) {}, nil
+	}
+	l := a.limiter(upstream)
+
+	timer := time.NewTimer(a.QueueTimeout)
+	defer timer.Stop()
+	for {
+		l.Lock()
+		if l.inflight < int(l.limit) {
+			l.inflight++
+			l.Unlock()
+			break
+		}
+		wake := l.wake
+		l.Unlock()
+
+		select {
+		case <-wake:
+		case <-timer.C:
+			if c.Prometheus.Enable {
+				AdaptiveRejected.WithLabelValues(upstream).Add(1)
+			}
+			return nil, fmt.Errorf("%s upstream is over its concurrency limit", upstream)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	return func(err error) {
+		limit := a.release(l, start, err != nil || time.Since(start) > a.LatencyThreshold)
+		if c.Prometheus.Enable {
+			AdaptiveLimit.WithLabelValues(upstream).Set(limit)
+		}
+	}, nil
+}
+
+// release frees the call's slot and adjusts the limit based on
+// the call's outcome. It returns the new limit.
+func (a *Adaptive) release(l *aimdLimiter, start time.Time, overloaded bool) float64 {
+	l.Lock()
+	defer l.Unlock()
+
+	l.inflight--
+	close(l.wake)
+	l.wake = make(chan struct{})
+
+	switch {
+	case overloaded && start.After(l.lastDecrease):
+		l.limit *= a.DecreaseFactor
+		if l.limit < float64(a.MinLimit) {
+			l.limit = float64(a.MinLimit)
+		}
+		l.lastDecrease = time.Now()
+	case !overloaded:
+		l.limit += 1 / l.limit
+		if l.limit > float64(a.MaxLimit) {
+			l.limit = float64(a.MaxLimit)
+		}
+	}
+	return l.limit
+}
+
+// ParseAdaptive parses the txtdirect config for the adaptive concurrency limiter
+func (a *Adaptive) ParseAdaptive(c Dispenser) error {
+	key := c.Val()
+	switch key {
+	case "min_limit", "max_limit", "initial_limit":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for %s field is not standard. It should be a positive integer", key)
+		}
+		switch key {
+		case "min_limit":
+			a.MinLimit = value
+		case "max_limit":
+			a.MaxLimit = value
+		case "initial_limit":
+			a.InitialLimit = value
+		}
+
+	case "latency_threshold", "queue_timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for %s field is not standard. It should be a positive duration", key)
+		}
+		if key == "latency_threshold" {
+			a.LatencyThreshold = value
+		} else {
+			a.QueueTimeout = value
+		}
+
+	case "decrease_factor":
+		value, err := strconv.ParseFloat(c.RemainingArgs()[0], 64)
+		if err != nil || value <= 0 || value >= 1 {
+			return fmt.Errorf("The given value for decrease_factor field is not standard. It should be a number between 0 and 1")
+		}
+		a.DecreaseFactor = value
+
+	default:
+		return c.ArgErr() // unhandled option for adaptive
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAdaptive_acquire(t *testing.T) {
+	a := Adaptive{
+		Enable:       true,
+		MinLimit:     1,
+		MaxLimit:     4,
+		InitialLimit: 2,
+		QueueTimeout: 10 * time.Millisecond,
+	}
+	a.SetDefaults()
+
+	first, err := a.acquire(context.Background(), "proxy", Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	second, err := a.acquire(context.Background(), "proxy", Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := a.acquire(context.Background(), "proxy", Config{}); err == nil {
+		t.Errorf("Expected the third call to be rejected")
+	}
+	// Each upstream has its own limit
+	other, err := a.acquire(context.Background(), "gomods", Config{})
+	if err != nil {
+		t.Errorf("Unexpected error for another upstream: %s", err)
+	} else {
+		other(nil)
+	}
+
+	// The waiting call gets the slot once a call finishes
+	go func() {
+		time.Sleep(time.Millisecond)
+		first(nil)
+	}()
+	a.QueueTimeout = time.Second
+	third, err := a.acquire(context.Background(), "proxy", Config{})
+	if err != nil {
+		t.Fatalf("Expected the waiting call to get a slot, got %s", err)
+	}
+	second(nil)
+	third(nil)
+}
+
+func TestAdaptive_release(t *testing.T) {
+	a := Adaptive{
+		Enable:           true,
+		MinLimit:         2,
+		MaxLimit:         10,
+		InitialLimit:     8,
+		LatencyThreshold: time.Second,
+	}
+	a.SetDefaults()
+	l := a.limiter("proxy")
+
+	// Successful calls grow the limit by one per window
+	for i := 0; i < 8; i++ {
+		l.inflight++
+		a.release(l, time.Now(), false)
+	}
+	if l.limit < 8.9 || l.limit > 9 {
+		t.Errorf("Expected the limit to grow to about 9, got %f", l.limit)
+	}
+
+	// A failure halves the limit, but the calls started before
+	// the decrease don't decrease it again
+	start := time.Now()
+	l.inflight += 2
+	if limit := a.release(l, start, true); limit < 4.4 || limit > 4.5 {
+		t.Errorf("Expected the limit to be halved, got %f", limit)
+	}
+	if limit := a.release(l, start, true); limit < 4.4 || limit > 4.5 {
+		t.Errorf("Expected the earlier call not to decrease the limit, got %f", limit)
+	}
+
+	// The limit never gets lower than the minimum
+	for i := 0; i < 5; i++ {
+		l.inflight++
+		a.release(l, time.Now().Add(time.Second), true)
+	}
+	if l.limit != 2 {
+		t.Errorf("Expected the limit to stop at the minimum, got %f", l.limit)
+	}
+	if l.inflight != 0 {
+		t.Errorf("Expected no calls in flight, got %d", l.inflight)
+	}
+}
+
+func TestAdaptive_disabled(t *testing.T) {
+	a := Adaptive{}
+	for i := 0; i < 100; i++ {
+		done, err := a.acquire(context.Background(), "proxy", Config{})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		done(fmt.Errorf("upstream failed"))
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admin contains the configuration of the admin API. It shows the parsed
+// config, the recent lookup errors and the onion services, flushes the
+// record cache, purges the proxy cache, toggles the enabled record types
+// without reloading Caddy and moves the records between environments,
+// exporting the file backend's or the snapshot's records and importing
+// them into the file backend.
+type Admin struct {
+	Enable bool
+	Path   string
+	// Token authenticates the requests as a bearer token
+	Token string
+	// SigningKey signs the exports of the record store and
+	// verifies the imported ones
+	SigningKey string
+
+	state *adminState
+}
+
+// adminState is the runtime state changed and shown by the admin API
+type adminState struct {
+	sync.RWMutex
+	// enable replaces the configured record types when it isn't nil
+	enable []string
+	// errors holds the recent lookup and parse errors, the oldest first
+	errors []lookupError
+}
+
+// lookupError is a failed record lookup or an invalid
+// record shown by the admin API
+type lookupError struct {
+	Time  time.Time `json:"time"`
+	Zone  string    `json:"zone"`
+	Error string    `json:"error"`
+}
+
+// torStatus is the Tor instance's status shown by the admin API
+type torStatus struct {
+	Running bool `json:"running"`
+	// Port is the socks port of the Tor instance
+	Port     int           `json:"port"`
+	Error    string        `json:"error,omitempty"`
+	Services []onionStatus `json:"services"`
+}
+
+// onionStatus is an onion service's status shown by the admin API,
+// the address of the services without a key is known once published
+type onionStatus struct {
+	Zone      string `json:"zone,omitempty"`
+	Address   string `json:"address,omitempty"`
+	Port      int    `json:"port"`
+	Published bool   `json:"published"`
+	Error     string `json:"error,omitempty"`
+}
+
+const (
+	DefaultAdminPath = "/_txtdirect/admin"
+	// maxLookupErrors is the number of recent lookup errors kept
+	maxLookupErrors = 100
+)
+
+// recordTypeRegex matches the record type names which can be enabled
+var recordTypeRegex = regexp.MustCompile("^[a-z0-9]+$")
+
+// SetDefaults sets the default values for admin config
+// if the fields are empty
+func (a *Admin) SetDefaults() {
+	if a.Path == "" {
+		a.Path = DefaultAdminPath
+	}
+	a.Path = strings.TrimSuffix(a.Path, "/")
+	if a.state == nil {
+		a.state = &adminState{}
+	}
+}
+
+// enabled returns the record types enabled at runtime,
+// or the configured ones if they haven't been changed
+func (a *Admin) enabled(configured []string) []string {
+	if a.state == nil {
+		return configured
+	}
+	a.state.RLock()
+	defer a.state.RUnlock()
+	if a.state.enable == nil {
+		return configured
+	}
+	return a.state.enable
+}
+
+// recordError keeps the lookup error for the admin API
+func (a *Admin) recordError(zone string, err error) {
+	if a.state == nil {
+		return
+	}
+	a.state.Lock()
+	defer a.state.Unlock()
+	if len(a.state.errors) >= maxLookupErrors {
+		a.state.errors = a.state.errors[1:]
+	}
+	a.state.errors = append(a.state.errors, lookupError{Time: time.Now(), Zone: zone, Error: err.Error()})
+}
+
+// handles checks if the request is sent to the admin API
+func (a *Admin) handles(r *http.Request) bool {
+	return r.URL.Path == a.Path || strings.HasPrefix(r.URL.Path, a.Path+"/")
+}
+
+// authorized checks the request's bearer token
+func (a *Admin) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return a.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// ServeHTTP serves the admin API's endpoints, the given
+// config holds the record types enabled by the Caddyfile
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request, c Config) error {
+	w.Header().Set("Cache-Control", "no-store")
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="txtdirect admin"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil
+	}
+
+	switch endpoint := strings.TrimPrefix(r.URL.Path, a.Path); {
+	case endpoint == "/config" && r.Method == http.MethodGet:
+		config := c
+		config.Admin.Token = "REDACTED"
+		if config.Admin.SigningKey != "" {
+			config.Admin.SigningKey = "REDACTED"
+		}
+		if config.Backend.Password != "" {
+			config.Backend.Password = "REDACTED"
+		}
+		if config.DecisionLog.Sink.Password != "" {
+			config.DecisionLog.Sink.Password = "REDACTED"
+		}
+		if config.Preview.Token != "" {
+			config.Preview.Token = "REDACTED"
+		}
+		// The credentials are shared with the running config
+		config.Proxy.Credentials = make([]ProxyCredential, len(c.Proxy.Credentials))
+		for i, credential := range c.Proxy.Credentials {
+			credential.Value = "REDACTED"
+			config.Proxy.Credentials[i] = credential
+		}
+		config.Webhooks.Endpoints = make([]WebhookEndpoint, len(c.Webhooks.Endpoints))
+		for i, endpoint := range c.Webhooks.Endpoints {
+			if endpoint.Secret != "" {
+				endpoint.Secret = "REDACTED"
+			}
+			config.Webhooks.Endpoints[i] = endpoint
+		}
+		return writeJSON(w, http.StatusOK, config)
+
+	case endpoint == "/cache/flush" && r.Method == http.MethodPost:
+		flushed := c.RecordCache.Flush()
+		return writeJSON(w, http.StatusOK, map[string]int{"flushed": flushed})
+
+	case endpoint == "/proxy/purge" && r.Method == http.MethodPost:
+		return a.servePurge(w, r, c)
+
+	case endpoint == "/errors" && r.Method == http.MethodGet:
+		a.state.RLock()
+		errors := append([]lookupError{}, a.state.errors...)
+		a.state.RUnlock()
+		return writeJSON(w, http.StatusOK, errors)
+
+	case endpoint == "/enable" && r.Method == http.MethodGet:
+		return writeJSON(w, http.StatusOK, a.enabled(c.Enable))
+
+	case endpoint == "/enable" && r.Method == http.MethodPut:
+		var enable []string
+		if err := json.NewDecoder(r.Body).Decode(&enable); err != nil {
+			http.Error(w, "The body should be a JSON list of record types", http.StatusBadRequest)
+			return nil
+		}
+		for _, recordType := range enable {
+			if !recordTypeRegex.MatchString(recordType) {
+				http.Error(w, fmt.Sprintf("Invalid record type %q", recordType), http.StatusBadRequest)
+				return nil
+			}
+		}
+		a.state.Lock()
+		a.state.enable = append([]string{}, enable...)
+		a.state.Unlock()
+		return writeJSON(w, http.StatusOK, enable)
+
+	case endpoint == "/enable" && r.Method == http.MethodDelete:
+		// The configured record types are enabled again
+		a.state.Lock()
+		a.state.enable = nil
+		a.state.Unlock()
+		return writeJSON(w, http.StatusOK, c.Enable)
+
+	case endpoint == "/records/export" && r.Method == http.MethodGet:
+		return a.serveExport(w, c)
+
+	case endpoint == "/records/import" && r.Method == http.MethodPost:
+		return a.serveImport(w, r, c)
+
+	case endpoint == "/status" && r.Method == http.MethodGet:
+		if !c.Status.Enable {
+			http.Error(w, "The status page isn't enabled", http.StatusNotFound)
+			return nil
+		}
+		return c.Status.ServeHTTP(w, r)
+
+	case endpoint == "/tor" && r.Method == http.MethodGet:
+		if !c.Tor.Enable {
+			http.Error(w, "Tor isn't enabled", http.StatusNotFound)
+			return nil
+		}
+		return writeJSON(w, http.StatusOK, c.Tor.status())
+
+	case endpoint == "/config" || endpoint == "/cache/flush" || endpoint == "/errors" || endpoint == "/enable" ||
+		endpoint == "/records/export" || endpoint == "/records/import" || endpoint == "/proxy/purge" || endpoint == "/status" || endpoint == "/tor":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return nil
+	}
+	http.NotFound(w, r)
+	return nil
+}
+
+// servePurge removes the proxy cache's responses of the URL or the
+// host given in the query, or all of them when neither is given
+func (a *Admin) servePurge(w http.ResponseWriter, r *http.Request, c Config) error {
+	if !c.Proxy.Cache.Enable {
+		http.Error(w, "The proxy cache isn't enabled", http.StatusNotFound)
+		return nil
+	}
+	target, host := r.URL.Query().Get("url"), strings.ToLower(r.URL.Query().Get("host"))
+	purged := c.Proxy.Cache.purge(func(entry *cachedResponse) bool {
+		return (target == "" || entry.url == target) && (host == "" || entry.host == host)
+	})
+	if c.Prometheus.Enable {
+		ProxyCacheSize.Set(float64(c.Proxy.Cache.Size()))
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
+
+// writeJSON writes the value as the JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(append(body, '\n'))
+	return err
+}
+
+// ParseAdmin parses the txtdirect config for the admin API
+func (a *Admin) ParseAdmin(c Dispenser) error {
+	switch c.Val() {
+	case "path":
+		args := c.RemainingArgs()
+		if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+			return fmt.Errorf("The given value for path field is not standard. It should be a path starting with /")
+		}
+		a.Path = args[0]
+
+	case "token":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		a.Token = args[0]
+
+	case "signing_key":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		a.SigningKey = args[0]
+
+	default:
+		return c.ArgErr() // unhandled option for admin
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestAdmin(t *testing.T) {
+	c := Config{
+		Enable:      []string{"host"},
+		Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+		RecordCache: RecordCache{Enable: true},
+		Admin:       Admin{Enable: true, Token: "secret"},
+		Proxy: Proxy{Credentials: []ProxyCredential{
+			{Host: "api.internal", Type: "bearer", Header: "Authorization", Value: "Bearer upstream"},
+		}},
+		Backend:     Backend{Type: "redis", Password: "redis"},
+		DecisionLog: DecisionLog{Sink: DecisionSink{User: "txtdirect", Password: "warehouse"}},
+		Webhooks:    Webhooks{Endpoints: []WebhookEndpoint{{URL: "https://hooks.example.com", Secret: "signing"}}},
+		Preview:     Preview{Enable: true, Header: "X-Preview", Token: "staging"},
+	}
+	c.RecordCache.SetDefaults()
+	c.Admin.SetDefaults()
+
+	admin := func(method, endpoint, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://example.com"+DefaultAdminPath+endpoint, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Fatalf("Unexpected error for %s %s: %s", method, endpoint, err)
+		}
+		return w
+	}
+
+	if w := admin("GET", "/config", "", ""); w.Code != 401 {
+		t.Errorf("Expected the requests without a token to be unauthorized, got %d", w.Code)
+	}
+	if w := admin("GET", "/config", "wrong", ""); w.Code != 401 {
+		t.Errorf("Expected the requests with a wrong token to be unauthorized, got %d", w.Code)
+	}
+
+	w := admin("GET", "/config", "secret", "")
+	var config Config
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil || w.Code != 200 {
+		t.Fatalf("Expected the config as JSON, got %d: %s", w.Code, w.Body.String())
+	}
+	if !identical(config.Enable, c.Enable) || config.Admin.Token == "secret" {
+		t.Errorf("Expected the config with the redacted token, got %+v", config)
+	}
+	if config.Proxy.Credentials[0].Value != "REDACTED" || c.Proxy.Credentials[0].Value != "Bearer upstream" {
+		t.Errorf("Expected the proxy credentials to be redacted, got %+v", config.Proxy.Credentials)
+	}
+	if config.Webhooks.Endpoints[0].Secret != "REDACTED" || c.Webhooks.Endpoints[0].Secret != "signing" {
+		t.Errorf("Expected the webhook secrets to be redacted, got %+v", config.Webhooks.Endpoints)
+	}
+	if config.Backend.Password != "REDACTED" {
+		t.Errorf("Expected the backend password to be redacted, got %s", config.Backend.Password)
+	}
+	if config.DecisionLog.Sink.Password != "REDACTED" {
+		t.Errorf("Expected the decision sink password to be redacted, got %s", config.DecisionLog.Sink.Password)
+	}
+	if config.Preview.Token != "REDACTED" {
+		t.Errorf("Expected the preview token to be redacted, got %s", config.Preview.Token)
+	}
+
+	// The lookups fill the cache and the failed ones are kept as errors
+	Redirect(httptest.NewRecorder(), httptest.NewRequest("GET", "https://headers.test/", nil), c)
+	Redirect(httptest.NewRecorder(), httptest.NewRequest("GET", "https://invalid.headers.test/", nil), c)
+	var errors []lookupError
+	json.Unmarshal(admin("GET", "/errors", "secret", "").Body.Bytes(), &errors)
+	if len(errors) == 0 || errors[len(errors)-1].Zone != "_redirect.invalid.headers.test." {
+		t.Errorf("Expected the failed lookup in the recent errors, got %+v", errors)
+	}
+	if w := admin("GET", "/cache/flush", "secret", ""); w.Code != 405 {
+		t.Errorf("Expected the cache flush to need a POST request, got %d", w.Code)
+	}
+	if w := admin("POST", "/cache/flush", "secret", ""); w.Code != 200 || c.RecordCache.Len() != 0 {
+		t.Errorf("Expected the cache to be flushed, got %d with %d zones", w.Code, c.RecordCache.Len())
+	}
+
+	// The records of the disabled types aren't served
+	if w := admin("PUT", "/enable", "secret", `["path"]`); w.Code != 200 {
+		t.Fatalf("Expected the record types to be changed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	Redirect(w, httptest.NewRequest("GET", "https://headers.test/", nil), c)
+	if w.Code == 301 {
+		t.Errorf("Expected the host records to be disabled")
+	}
+	if w := admin("PUT", "/enable", "secret", `["Host;"]`); w.Code != 400 {
+		t.Errorf("Expected invalid record types to be rejected, got %d", w.Code)
+	}
+	if w := admin("DELETE", "/enable", "secret", ""); w.Code != 200 {
+		t.Errorf("Expected the configured record types to be enabled, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://headers.test/", nil), c); err != nil || w.Code != 301 {
+		t.Errorf("Expected the host records to be enabled again, got %d: %v", w.Code, err)
+	}
+
+	if w := admin("GET", "/tor", "secret", ""); w.Code != 404 {
+		t.Errorf("Expected the Tor status to be not found without Tor, got %d", w.Code)
+	}
+	if w := admin("GET", "/unknown", "secret", ""); w.Code != 404 {
+		t.Errorf("Expected unknown endpoints to be not found, got %d", w.Code)
+	}
+}
+
+func TestParseAdmin(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		admin {
+			path /admin/
+			token secret
+			signing_key promotion
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.Admin.Path != "/admin" || conf.Admin.Token != "secret" || conf.Admin.SigningKey != "promotion" {
+		t.Errorf("Expected the admin API to be configured, got %+v", conf.Admin)
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		admin
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for the admin API without a token")
+	}
+}
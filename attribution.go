@@ -0,0 +1,75 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// queryPrefix starts the record fields which add query parameters
+// to the redirect targets, e.g. query-utm_source={host}
+const queryPrefix = "query-"
+
+// referrerPolicies are the values of the Referrer-Policy header
+var referrerPolicies = []string{
+	"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+	"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+}
+
+// parseQueryParam parses a query-<name>=<value> field of a record,
+// the placeholders in the value are filled from the request
+func parseQueryParam(field string, r *http.Request) (string, string, error) {
+	nameValue := strings.SplitN(strings.TrimPrefix(field, queryPrefix), "=", 2)
+	if len(nameValue) != 2 || nameValue[0] == "" {
+		return "", "", fmt.Errorf("could not parse query field: %s", field)
+	}
+	value, err := parsePlaceholders(nameValue[1], r, []string{})
+	if err != nil {
+		return "", "", err
+	}
+	return nameValue[0], value, nil
+}
+
+// parseReferrerPolicy parses the referrer= field of a record
+func parseReferrerPolicy(policy string) (string, error) {
+	policy = strings.ToLower(policy)
+	if !contains(referrerPolicies, policy) {
+		return "", fmt.Errorf("could not parse referrer: %s, it should be one of %s", policy, strings.Join(referrerPolicies, ", "))
+	}
+	return policy, nil
+}
+
+// addQuery adds the record's query parameters to the target. The
+// target's own parameters are kept unless the record overrides them.
+func addQuery(target string, rec record) string {
+	if len(rec.Query) == 0 {
+		return target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	query := u.Query()
+	for name, values := range rec.Query {
+		if _, ok := query[name]; ok && !rec.QueryOverride {
+			continue
+		}
+		query[name] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
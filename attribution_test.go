@@ -0,0 +1,92 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestAttributionE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		location string
+		referrer string
+	}{
+		{
+			"https://utm.attribution.test/",
+			"https://example.com/landing?ref=ad&utm_source=utm.attribution.test",
+			"origin",
+		},
+		{
+			"https://override.attribution.test/",
+			"https://example.com/landing?ref=short",
+			"",
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if referrer := w.Header().Get("Referrer-Policy"); referrer != test.referrer {
+			t.Errorf("Test %d: Expected Referrer-Policy %q, got %q", i, test.referrer, referrer)
+		}
+	}
+}
+
+func TestParseAttributionFields(t *testing.T) {
+	c := Config{Enable: []string{"host"}}
+	tests := []struct {
+		txt       string
+		shouldErr bool
+	}{
+		{"v=txtv0;to=https://example.com;query-utm_campaign=launch", false},
+		{"v=txtv0;to=https://example.com;query-=empty", true},
+		{"v=txtv0;to=https://example.com;query-utm_source", true},
+		{"v=txtv0;to=https://example.com;query_override=maybe", true},
+		{"v=txtv0;to=https://example.com;referrer=no-referrer", false},
+		{"v=txtv0;to=https://example.com;referrer=everyone", true},
+	}
+	for i, test := range tests {
+		var rec record
+		err := rec.Parse(test.txt, httptest.NewRequest("GET", "https://example.test/", nil), c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: Expected error %t for %q, got %v", i, test.shouldErr, test.txt, err)
+		}
+	}
+}
+
+func TestAddQuery(t *testing.T) {
+	rec := record{Query: map[string][]string{"utm_source": {"a b"}, "ref": {"new"}}}
+	if target := addQuery("https://example.com/?ref=old", rec); target != "https://example.com/?ref=old&utm_source=a+b" {
+		t.Errorf("Unexpected target %s", target)
+	}
+	rec.QueryOverride = true
+	if target := addQuery("https://example.com/?ref=old", rec); target != "https://example.com/?ref=new&utm_source=a+b" {
+		t.Errorf("Unexpected target %s", target)
+	}
+	if target := addQuery("https://example.com/?ref=old", record{}); target != "https://example.com/?ref=old" {
+		t.Errorf("Expected the target without the record's parameters to be kept, got %s", target)
+	}
+}
@@ -0,0 +1,693 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RecordResolver finds the TXT records of the absolute zones. The
+// returned TTL is zero when the resolver doesn't expose it, and the
+// zones without any records return a noRecordsError.
+type RecordResolver interface {
+	LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error)
+}
+
+// Backend contains the configuration of the record backend used instead
+// of DNS, for the environments which can't publish TXT records. The
+// backends hold the records with the same syntax under the same zones,
+// e.g. _redirect.example.com.
+type Backend struct {
+	Enable bool
+	// Type is one of file, redis and etcd
+	Type string
+	// File is the zone file read by the file backend
+	File string
+	// Address is the host:port of the Redis server
+	Address  string
+	Password string
+	DB       int
+	// Endpoint is the URL of the etcd v3 gRPC gateway
+	Endpoint string
+	// Prefix is prepended to the zones to get the Redis and etcd keys
+	Prefix  string
+	Timeout time.Duration
+
+	store *backendStore
+}
+
+// backendStore holds the opened resolver, which is shared
+// by the copies of the config
+type backendStore struct {
+	sync.RWMutex
+	resolver RecordResolver
+}
+
+// DefaultBackendTimeout limits the lookups of the Redis and etcd backends
+const DefaultBackendTimeout = 2 * time.Second
+
+// SetDefaults sets the default values for the backend config
+// if the fields are empty
+func (b *Backend) SetDefaults() {
+	if b.Timeout == 0 {
+		b.Timeout = DefaultBackendTimeout
+	}
+	if b.Type == "redis" && b.Address == "" {
+		b.Address = "127.0.0.1:6379"
+	}
+	if b.Type == "etcd" && b.Endpoint == "" {
+		b.Endpoint = "http://127.0.0.1:2379"
+	}
+	if b.store == nil {
+		b.store = &backendStore{}
+	}
+}
+
+// validate checks the backend config without opening the backend
+func (b *Backend) validate() error {
+	switch b.Type {
+	case "file":
+		if b.File == "" {
+			return fmt.Errorf("the file backend needs a zone file")
+		}
+		if _, err := os.Stat(b.File); err != nil {
+			return fmt.Errorf("couldn't read the zone file: %s", err.Error())
+		}
+	case "redis", "etcd":
+	default:
+		return fmt.Errorf("The given value for backend field is not standard. It should be file, redis or etcd")
+	}
+	return nil
+}
+
+// Open creates the resolver of the configured backend
+func (b *Backend) Open() error {
+	if err := b.validate(); err != nil {
+		return err
+	}
+	var resolver RecordResolver
+	switch b.Type {
+	case "file":
+		file, err := loadFileResolver(b.File)
+		if err != nil {
+			return err
+		}
+		resolver = file
+	case "redis":
+		resolver = &redisResolver{address: b.Address, password: b.Password, db: b.DB, prefix: b.Prefix, timeout: b.Timeout,
+			idle: make(chan *redisConn, redisPoolSize)}
+	case "etcd":
+		resolver = &etcdResolver{endpoint: strings.TrimSuffix(b.Endpoint, "/"), prefix: b.Prefix, timeout: b.Timeout,
+			client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}}
+	}
+	if b.store == nil {
+		b.store = &backendStore{}
+	}
+	b.store.Lock()
+	b.store.resolver = resolver
+	b.store.Unlock()
+	return nil
+}
+
+// Close closes the idle connections of the Redis and etcd backends.
+// The resolver is kept for the requests still being served, which
+// close their connections rather than keeping them idle.
+func (b *Backend) Close() error {
+	switch resolver := b.resolver().(type) {
+	case *redisResolver:
+		resolver.close()
+	case *etcdResolver:
+		resolver.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// resolver returns the opened resolver, or nil
+// when the backend isn't opened yet
+func (b *Backend) resolver() RecordResolver {
+	if b.store == nil {
+		return nil
+	}
+	b.store.RLock()
+	defer b.store.RUnlock()
+	return b.store.resolver
+}
+
+// ParseBackend parses the txtdirect config for the record backend
+func (b *Backend) ParseBackend(c Dispenser) error {
+	switch c.Val() {
+	case "file":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		b.File = args[0]
+
+	case "address":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		b.Address = args[0]
+
+	case "password":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		b.Password = args[0]
+
+	case "db":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 0 {
+			return fmt.Errorf("The given value for db field is not standard. It should be a non-negative integer")
+		}
+		b.DB = value
+
+	case "endpoint":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if !strings.HasPrefix(args[0], "http://") && !strings.HasPrefix(args[0], "https://") {
+			return fmt.Errorf("The given value for endpoint field is not standard. It should be an http or https URL")
+		}
+		b.Endpoint = args[0]
+
+	case "prefix":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		b.Prefix = args[0]
+
+	case "timeout":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := time.ParseDuration(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a positive duration")
+		}
+		b.Timeout = value
+
+	default:
+		return c.ArgErr() // unhandled option for backend
+	}
+	return nil
+}
+
+// recordResolver returns the configured backend's resolver, or DNS
+func (c Config) recordResolver() RecordResolver {
+	if resolver := c.Backend.resolver(); resolver != nil {
+		return resolver
+	}
+	return dnsResolver{c: c}
+}
+
+// dnsResolver finds the records using the configured DNS resolvers
+type dnsResolver struct {
+	c Config
+}
+
+func (d dnsResolver) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	if d.c.resolvers != nil {
+		return lookupTXTPool(ctx, zone, d.c)
+	}
+	return lookupTXTWith(ctx, zone, d.c.Resolver, d.c)
+}
+
+// backendKey returns the key of the zone's records in Redis and etcd
+func backendKey(prefix, zone string) string {
+	return prefix + strings.TrimSuffix(zone, ".")
+}
+
+// splitRecords splits the value of a Redis or etcd key into its
+// records, the keys hold one record per line
+func splitRecords(value, zone string) ([]string, error) {
+	var txts []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			txts = append(txts, line)
+		}
+	}
+	if len(txts) == 0 {
+		return nil, &noRecordsError{Zone: zone}
+	}
+	return txts, nil
+}
+
+// fileResolver serves the TXT records of a zone file, e.g. the snippets
+// written by the importer. The admin API imports the records into it.
+type fileResolver struct {
+	sync.RWMutex
+	path  string
+	zones map[string][]string
+	ttls  map[string]time.Duration
+	// updated is when the zones were imported, or the
+	// file's modification time for the other zones
+	updated map[string]time.Time
+}
+
+// importedRecordTTL is the TTL of the new zones imported into the zone file
+const importedRecordTTL = 5 * time.Minute
+
+// loadFileResolver reads the TXT records of the given zone file
+func loadFileResolver(path string) (*fileResolver, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the backend file: %s", err.Error())
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the backend file: %s", err.Error())
+	}
+
+	resolver := &fileResolver{
+		path:    path,
+		zones:   make(map[string][]string),
+		ttls:    make(map[string]time.Duration),
+		updated: make(map[string]time.Time),
+	}
+	parser := dns.NewZoneParser(file, ".", path)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		txt, isTXT := rr.(*dns.TXT)
+		if !isTXT {
+			continue
+		}
+		zone := strings.ToLower(txt.Hdr.Name)
+		resolver.zones[zone] = append(resolver.zones[zone], strings.Join(txt.Txt, ""))
+		ttl := time.Duration(txt.Hdr.Ttl) * time.Second
+		if current, ok := resolver.ttls[zone]; !ok || ttl < current {
+			resolver.ttls[zone] = ttl
+		}
+		resolver.updated[zone] = info.ModTime()
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't parse the backend file: %s", err.Error())
+	}
+	return resolver, nil
+}
+
+func (f *fileResolver) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	zone = strings.ToLower(zone)
+	f.RLock()
+	defer f.RUnlock()
+	txts, ok := f.zones[zone]
+	if !ok {
+		return nil, 0, &noRecordsError{Zone: zone}
+	}
+	return txts, f.ttls[zone], nil
+}
+
+// entries returns the zone file's records for the exports
+func (f *fileResolver) entries() map[string]snapshotEntry {
+	f.RLock()
+	defer f.RUnlock()
+	entries := make(map[string]snapshotEntry, len(f.zones))
+	for zone, txts := range f.zones {
+		entries[zone] = snapshotEntry{Txts: txts, Resolved: f.updated[zone]}
+	}
+	return entries
+}
+
+// update merges the records into the zone file's ones using the given
+// func, which returns the changed zones. The changed zones are served
+// once the zone file is rewritten, the file's other entries than the
+// TXT records and its comments aren't kept.
+func (f *fileResolver) update(merge func(entries map[string]snapshotEntry) []string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	entries := make(map[string]snapshotEntry, len(f.zones))
+	for zone, txts := range f.zones {
+		entries[zone] = snapshotEntry{Txts: txts, Resolved: f.updated[zone]}
+	}
+	changed := merge(entries)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	ttls := make(map[string]time.Duration, len(entries))
+	for zone := range entries {
+		ttl, ok := f.ttls[zone]
+		if !ok {
+			ttl = importedRecordTTL
+		}
+		ttls[zone] = ttl
+	}
+	if err := writeZoneFile(f.path, entries, ttls); err != nil {
+		return err
+	}
+
+	for _, zone := range changed {
+		f.zones[zone] = entries[zone].Txts
+		f.ttls[zone] = ttls[zone]
+		f.updated[zone] = entries[zone].Resolved
+	}
+	return nil
+}
+
+// writeZoneFile replaces the zone file with the given TXT records
+func writeZoneFile(path string, entries map[string]snapshotEntry, ttls map[string]time.Duration) error {
+	zones := make([]string, 0, len(entries))
+	for zone := range entries {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	var buf bytes.Buffer
+	for _, zone := range zones {
+		for _, txt := range entries[zone].Txts {
+			rr := &dns.TXT{
+				Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(ttls[zone].Seconds())},
+				Txt: splitTXT(txt),
+			}
+			buf.WriteString(rr.String() + "\n")
+		}
+	}
+
+	// The file is replaced at once, so it's never read half written
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return fmt.Errorf("couldn't write the backend file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write the backend file: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write the backend file: %s", err.Error())
+	}
+	if info, err := os.Stat(path); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("couldn't write the backend file: %s", err.Error())
+	}
+	return nil
+}
+
+// redisResolver reads the records from the Redis keys
+// named after the zones, one record per line
+type redisResolver struct {
+	address  string
+	password string
+	db       int
+	prefix   string
+	timeout  time.Duration
+	// idle keeps the authenticated connections between the lookups
+	idle chan *redisConn
+
+	mu sync.Mutex
+	// closed is set when the backend is closed, the
+	// released connections get closed afterwards
+	closed bool
+}
+
+// redisConn is a connection to the Redis server and its reader
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+const (
+	// redisPoolSize is the max number of idle Redis connections
+	redisPoolSize = 8
+	// maxRedisValueSize limits the bulk replies like the etcd responses
+	maxRedisValueSize = 1 << 20
+)
+
+func (r *redisResolver) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	conn, pooled, err := r.conn(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	value, err := r.get(ctx, conn, zone)
+	if err != nil && pooled && ctx.Err() == nil {
+		// The server might have closed the idle connection
+		conn.Close()
+		if conn, err = r.dial(ctx); err != nil {
+			return nil, 0, err
+		}
+		value, err = r.get(ctx, conn, zone)
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() == context.Canceled {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	r.release(conn)
+
+	if value == nil {
+		return nil, 0, &noRecordsError{Zone: zone}
+	}
+	txts, err := splitRecords(string(value), zone)
+	return txts, 0, err
+}
+
+// conn returns an idle connection or dials a new one
+func (r *redisResolver) conn(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case conn := <-r.idle:
+		return conn, true, nil
+	default:
+	}
+	conn, err := r.dial(ctx)
+	return conn, false, err
+}
+
+// dial connects to the Redis server and selects the database
+func (r *redisResolver) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{}
+	c, err := dialer.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: c, reader: bufio.NewReader(c)}
+	stop := watchContext(ctx, conn)
+	defer stop()
+	if r.password != "" {
+		if _, err := redisCommand(conn, conn.reader, "AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err := redisCommand(conn, conn.reader, "SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// get reads the key of the given zone
+func (r *redisResolver) get(ctx context.Context, conn *redisConn, zone string) ([]byte, error) {
+	stop := watchContext(ctx, conn)
+	defer stop()
+	return redisCommand(conn, conn.reader, "GET", backendKey(r.prefix, zone))
+}
+
+// release puts the connection back in the pool, the
+// connections over the pool size get closed
+func (r *redisResolver) release(conn *redisConn) {
+	conn.SetDeadline(time.Time{})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		conn.Close()
+		return
+	}
+	select {
+	case r.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// close closes the idle connections
+func (r *redisResolver) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for {
+		select {
+		case conn := <-r.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// watchContext applies the context's deadline to the connection and
+// interrupts its pending reads when the context gets canceled. The
+// returned func stops watching the context before the connection
+// can be reused.
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// redisCommand sends the command to the Redis server and reads its
+// reply. The nil bulk string replies return a nil value.
+func redisCommand(w io.Writer, reader *bufio.Reader, args ...string) ([]byte, error) {
+	var command bytes.Buffer
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := w.Write(command.Bytes()); err != nil {
+		return nil, err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply from redis")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk string length from redis: %s", line[1:])
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		if size > maxRedisValueSize {
+			return nil, fmt.Errorf("redis value of %d bytes is too large", size)
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	}
+	return nil, fmt.Errorf("unexpected reply from redis: %q", line)
+}
+
+// etcdResolver reads the records from the etcd keys named after
+// the zones, one record per line, using the v3 gRPC gateway
+type etcdResolver struct {
+	endpoint string
+	prefix   string
+	timeout  time.Duration
+	client   *http.Client
+}
+
+// etcdRange is the response of the etcd gateway's range requests
+type etcdRange struct {
+	Kvs []struct {
+		Value string `json:"value"`
+	} `json:"kvs"`
+}
+
+func (e *etcdResolver) LookupTXT(ctx context.Context, zone string) ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(backendKey(e.prefix, zone))),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest("POST", e.endpoint+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+
+	var result etcdRange
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, 0, fmt.Errorf("couldn't parse the etcd response: %s", err.Error())
+	}
+	if len(result.Kvs) == 0 {
+		return nil, 0, &noRecordsError{Zone: zone}
+	}
+	value, err := base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't decode the etcd value: %s", err.Error())
+	}
+	txts, err := splitRecords(string(value), zone)
+	return txts, 0, err
+}
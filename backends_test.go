@@ -0,0 +1,344 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// backendRecords are the records served by the fake backends
+var backendRecords = map[string]string{
+	"_redirect.backend.test":       "v=txtv0;to=https://example.com/backend;type=host;code=302",
+	"_redirect.multi.backend.test": "v=txtv0;to=https://example.com/first;type=host\nv=txtv0;to=https://example.com/second;type=host",
+}
+
+// startFakeRedis serves GET, AUTH and SELECT from the given keys
+func startFakeRedis(t *testing.T, keys map[string]string, password string) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start the fake redis: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authorized := password == ""
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, count)
+					for i := range args {
+						reader.ReadString('\n')
+						arg, _ := reader.ReadString('\n')
+						args[i] = strings.TrimSuffix(arg, "\r\n")
+					}
+					switch {
+					case args[0] == "AUTH" && args[1] == password:
+						authorized = true
+						io.WriteString(conn, "+OK\r\n")
+					case !authorized:
+						io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+					case args[0] == "SELECT":
+						io.WriteString(conn, "+OK\r\n")
+					case args[0] == "GET":
+						value, ok := keys[args[1]]
+						if !ok {
+							io.WriteString(conn, "$-1\r\n")
+							continue
+						}
+						fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+					default:
+						io.WriteString(conn, "-ERR unknown command\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// startFakeEtcd serves the range requests of the etcd gateway from the given keys
+func startFakeEtcd(keys map[string]string) (string, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/kv/range" {
+			http.NotFound(w, r)
+			return
+		}
+		var body struct {
+			Key string `json:"key"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		key, _ := base64.StdEncoding.DecodeString(body.Key)
+		var result etcdRange
+		if value, ok := keys[string(key)]; ok {
+			result.Kvs = append(result.Kvs, struct {
+				Value string `json:"value"`
+			}{base64.StdEncoding.EncodeToString([]byte(value))})
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+	return server.URL, server.Close
+}
+
+// prefixed returns the backend records under the given key prefix
+func prefixed(prefix string) map[string]string {
+	keys := make(map[string]string)
+	for key, value := range backendRecords {
+		keys[prefix+key] = value
+	}
+	return keys
+}
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  Backend
+		shouldErr bool
+	}{
+		{
+			"backend redis",
+			Backend{Enable: true, Type: "redis", Address: "127.0.0.1:6379", Timeout: DefaultBackendTimeout},
+			false,
+		},
+		{
+			`backend redis {
+				address 10.0.0.1:6380
+				password secret
+				db 2
+				prefix txtdirect:
+				timeout 1s
+			}`,
+			Backend{Enable: true, Type: "redis", Address: "10.0.0.1:6380", Password: "secret", DB: 2, Prefix: "txtdirect:", Timeout: time.Second},
+			false,
+		},
+		{
+			`backend etcd {
+				endpoint https://etcd.example.com:2379
+				prefix /txtdirect/
+			}`,
+			Backend{Enable: true, Type: "etcd", Endpoint: "https://etcd.example.com:2379", Prefix: "/txtdirect/", Timeout: DefaultBackendTimeout},
+			false,
+		},
+		{"backend consul", Backend{}, true},
+		{"backend file", Backend{}, true},
+		{"backend file /nonexistent/records.zone", Backend{}, true},
+		{"backend redis { db -1 }", Backend{}, true},
+		{"backend etcd { endpoint etcd.example.com }", Backend{}, true},
+		{"backend redis { timeout 0s }", Backend{}, true},
+		{"backend redis { cluster }", Backend{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		// The backend gets opened by the startup hook
+		if conf.Backend.resolver() != nil {
+			t.Errorf("Test %d: Expected the backend to be opened at startup", i)
+		}
+		conf.Backend.store = nil
+		if !reflect.DeepEqual(conf.Backend, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.Backend)
+		}
+	}
+}
+
+func TestBackendResolvers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "records.zone")
+	err = ioutil.WriteFile(file, []byte(`
+_redirect.backend.test. 300 IN TXT "v=txtv0;to=https://example.com/backend;type=host;code=302"
+_redirect.multi.backend.test. 60 IN TXT "v=txtv0;to=https://example.com/first;type=host"
+_redirect.multi.backend.test. 30 IN TXT "v=txtv0;to=https://example.com/second;type=host"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redis, stopRedis := startFakeRedis(t, prefixed("txtdirect:"), "secret")
+	defer stopRedis()
+	etcd, stopEtcd := startFakeEtcd(prefixed("/txtdirect/"))
+	defer stopEtcd()
+
+	backends := map[string]Backend{
+		"file":  {Type: "file", File: file},
+		"redis": {Type: "redis", Address: redis, Password: "secret", DB: 1, Prefix: "txtdirect:"},
+		"etcd":  {Type: "etcd", Endpoint: etcd, Prefix: "/txtdirect/"},
+	}
+	for name, backend := range backends {
+		backend.SetDefaults()
+		if err := backend.Open(); err != nil {
+			t.Fatalf("%s: Couldn't open the backend: %s", name, err)
+		}
+		c := Config{Backend: backend}
+
+		txts, _, err := lookupTXT(context.Background(), "_redirect.multi.backend.test.", c)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", name, err)
+		}
+		expected := strings.Split(backendRecords["_redirect.multi.backend.test"], "\n")
+		if !reflect.DeepEqual(txts, expected) {
+			t.Errorf("%s: Expected %q, got %q", name, expected, txts)
+		}
+
+		_, _, err = lookupTXT(context.Background(), "_redirect.missing.backend.test.", c)
+		if !isNotFound(err) {
+			t.Errorf("%s: Expected a not found error, got %v", name, err)
+		}
+	}
+
+	resolver, _ := loadFileResolver(file)
+	if _, ttl, _ := resolver.LookupTXT(context.Background(), "_REDIRECT.multi.backend.test."); ttl != 30*time.Second {
+		t.Errorf("Expected the lowest TTL of the zone's records, got %s", ttl)
+	}
+}
+
+func TestRedisWrongPassword(t *testing.T) {
+	redis, stop := startFakeRedis(t, prefixed(""), "secret")
+	defer stop()
+	backend := Backend{Type: "redis", Address: redis, Password: "wrong"}
+	backend.SetDefaults()
+	backend.Open()
+	_, _, err := lookupTXT(context.Background(), "_redirect.backend.test.", Config{Backend: backend})
+	if err == nil || isNotFound(err) {
+		t.Errorf("Expected the authentication error, got %v", err)
+	}
+}
+
+func TestRedisPool(t *testing.T) {
+	redis, stop := startFakeRedis(t, prefixed(""), "secret")
+	defer stop()
+	backend := Backend{Type: "redis", Address: redis, Password: "secret"}
+	backend.SetDefaults()
+	backend.Open()
+	resolver := backend.resolver().(*redisResolver)
+
+	var conns []*redisConn
+	for i := 0; i < 2; i++ {
+		if _, _, err := resolver.LookupTXT(context.Background(), "_redirect.backend.test."); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if len(resolver.idle) != 1 {
+			t.Fatalf("Expected a single idle connection, got %d", len(resolver.idle))
+		}
+		conn := <-resolver.idle
+		conns = append(conns, conn)
+		resolver.idle <- conn
+	}
+	if conns[0] != conns[1] {
+		t.Errorf("Expected the lookups to reuse the connection")
+	}
+
+	// The closed idle connections get replaced
+	conns[0].Close()
+	if _, _, err := resolver.LookupTXT(context.Background(), "_redirect.backend.test."); err != nil {
+		t.Errorf("Unexpected error after the idle connection was closed: %s", err)
+	}
+}
+
+func TestRedisClose(t *testing.T) {
+	redis, stop := startFakeRedis(t, prefixed(""), "")
+	defer stop()
+	backend := Backend{Type: "redis", Address: redis}
+	backend.SetDefaults()
+	backend.Open()
+	resolver := backend.resolver().(*redisResolver)
+	if _, _, err := resolver.LookupTXT(context.Background(), "_redirect.backend.test."); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	backend.Close()
+	if len(resolver.idle) != 0 {
+		t.Errorf("Expected the idle connections to be closed, got %d", len(resolver.idle))
+	}
+	// The lookups still being served don't keep their connections
+	if _, _, err := resolver.LookupTXT(context.Background(), "_redirect.backend.test."); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(resolver.idle) != 0 {
+		t.Errorf("Expected the released connection to be closed, got %d idle", len(resolver.idle))
+	}
+}
+
+func TestRedisCommandMaxSize(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader(fmt.Sprintf("$%d\r\n", maxRedisValueSize+1)))
+	if _, err := redisCommand(ioutil.Discard, reader, "GET", "key"); err == nil {
+		t.Errorf("Expected the oversized value to be rejected")
+	}
+}
+
+func TestBackendE2e(t *testing.T) {
+	redis, stop := startFakeRedis(t, prefixed(""), "")
+	defer stop()
+	backend := Backend{Type: "redis", Address: redis}
+	backend.SetDefaults()
+	backend.Open()
+	c := Config{
+		Enable:  []string{"host"},
+		Backend: backend,
+	}
+	w := httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://backend.test/", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 302 {
+		t.Errorf("Expected status 302, got %d", w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "https://example.com/backend" {
+		t.Errorf("Expected location https://example.com/backend, got %q", location)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RecordCache contains the TXT record cache's configuration
+type RecordCache struct {
+	Enable     bool
+	MinTTL     time.Duration
+	MaxTTL     time.Duration
+	MaxEntries int
+	// ServeStale is how long expired records can still be served
+	// when the resolver fails to answer
+	ServeStale time.Duration
+	// NegativeTTL is how long the zones without TXT records are
+	// remembered, zero disables the negative caching
+	NegativeTTL time.Duration
+	// Persist is the file the cached records are saved to on shutdown
+	// and loaded from on startup, so restarts start with a warm cache
+	Persist string
+	// PersistEntries is the max number of records saved to the file
+	PersistEntries int
+	// MaxWaiters bounds the requests waiting for another request's
+	// lookup of the same zone and WaitTimeout is how long they wait
+	// before they're shed
+	MaxWaiters  int
+	WaitTimeout time.Duration
+
+	store   *recordStore
+	flights *lookupGroup
+}
+
+// recordStore keeps the cached TXT records in LRU order
+type recordStore struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	// negative holds the expiry of the zones without TXT records
+	negative map[string]time.Time
+}
+
+type cacheEntry struct {
+	zone    string
+	txts    []string
+	expires time.Time
+}
+
+const (
+	DefaultCacheMinTTL     = 30 * time.Second
+	DefaultCacheMaxTTL     = time.Hour
+	DefaultCacheMaxEntries = 10000
+	// DefaultCachePersistEntries keeps the most recently used records
+	DefaultCachePersistEntries = 1000
+)
+
+// SetDefaults sets the default values for the record cache config
+// if the fields are empty
+func (rc *RecordCache) SetDefaults() {
+	if rc.MinTTL == 0 {
+		rc.MinTTL = DefaultCacheMinTTL
+	}
+	if rc.MaxTTL == 0 {
+		rc.MaxTTL = DefaultCacheMaxTTL
+	}
+	if rc.MaxEntries == 0 {
+		rc.MaxEntries = DefaultCacheMaxEntries
+	}
+	if rc.Persist != "" && rc.PersistEntries == 0 {
+		rc.PersistEntries = DefaultCachePersistEntries
+	}
+	if rc.MaxWaiters == 0 {
+		rc.MaxWaiters = DefaultCacheMaxWaiters
+	}
+	if rc.WaitTimeout == 0 {
+		rc.WaitTimeout = DefaultCacheWaitTimeout
+	}
+	if rc.flights == nil {
+		rc.flights = &lookupGroup{calls: make(map[string]*lookupCall)}
+	}
+	if rc.store == nil {
+		rc.store = &recordStore{
+			entries:  make(map[string]*list.Element),
+			order:    list.New(),
+			negative: make(map[string]time.Time),
+		}
+	}
+}
+
+// Get returns the cached TXT records for the given zone if
+// they exist and haven't expired yet
+func (rc *RecordCache) Get(zone string) ([]string, bool) {
+	if rc.store == nil {
+		return nil, false
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+
+	elem, ok := rc.store.entries[zone]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		// Keep the expired records around while they can be served stale
+		if time.Now().After(entry.expires.Add(rc.ServeStale)) {
+			rc.store.order.Remove(elem)
+			delete(rc.store.entries, zone)
+		}
+		return nil, false
+	}
+	rc.store.order.MoveToFront(elem)
+	return entry.txts, true
+}
+
+// GetStale returns the cached TXT records for the given zone even if
+// they have expired, as long as they're within the serve stale window
+func (rc *RecordCache) GetStale(zone string) ([]string, bool) {
+	if rc.store == nil || rc.ServeStale == 0 {
+		return nil, false
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+
+	elem, ok := rc.store.entries[zone]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(rc.ServeStale)) {
+		return nil, false
+	}
+	return entry.txts, true
+}
+
+// Set caches the TXT records for the given zone. The given TTL gets
+// clamped between the configured min and max TTLs.
+func (rc *RecordCache) Set(zone string, txts []string, ttl time.Duration) {
+	if rc.store == nil {
+		return
+	}
+	if ttl < rc.MinTTL {
+		ttl = rc.MinTTL
+	}
+	if ttl > rc.MaxTTL {
+		ttl = rc.MaxTTL
+	}
+
+	rc.store.Lock()
+	defer rc.store.Unlock()
+
+	delete(rc.store.negative, zone)
+	if elem, ok := rc.store.entries[zone]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.txts, entry.expires = txts, time.Now().Add(ttl)
+		rc.store.order.MoveToFront(elem)
+		return
+	}
+
+	for rc.store.order.Len() >= rc.MaxEntries && rc.store.order.Len() > 0 {
+		oldest := rc.store.order.Back()
+		rc.store.order.Remove(oldest)
+		delete(rc.store.entries, oldest.Value.(*cacheEntry).zone)
+	}
+
+	rc.store.entries[zone] = rc.store.order.PushFront(&cacheEntry{
+		zone:    zone,
+		txts:    txts,
+		expires: time.Now().Add(ttl),
+	})
+}
+
+// Flush removes all of the cached zones, including the negative
+// cache, and returns the number of removed zones
+func (rc *RecordCache) Flush() int {
+	if rc.store == nil {
+		return 0
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+	flushed := rc.store.order.Len() + len(rc.store.negative)
+	rc.store.entries = make(map[string]*list.Element)
+	rc.store.order.Init()
+	rc.store.negative = make(map[string]time.Time)
+	return flushed
+}
+
+// Len returns the number of cached zones
+func (rc *RecordCache) Len() int {
+	if rc.store == nil {
+		return 0
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+	return rc.store.order.Len()
+}
+
+// GetNegative checks if the given zone is known to have no TXT records
+func (rc *RecordCache) GetNegative(zone string) bool {
+	if rc.store == nil || rc.NegativeTTL == 0 {
+		return false
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+
+	expires, ok := rc.store.negative[zone]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(rc.store.negative, zone)
+		return false
+	}
+	return true
+}
+
+// SetNegative remembers that the given zone has no TXT records
+// for the negative TTL
+func (rc *RecordCache) SetNegative(zone string) {
+	if rc.store == nil || rc.NegativeTTL == 0 {
+		return
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+
+	if _, ok := rc.store.negative[zone]; !ok && len(rc.store.negative) >= rc.MaxEntries {
+		now := time.Now()
+		for cached, expires := range rc.store.negative {
+			if now.After(expires) {
+				delete(rc.store.negative, cached)
+			}
+		}
+		if len(rc.store.negative) >= rc.MaxEntries {
+			return
+		}
+	}
+	rc.store.negative[zone] = time.Now().Add(rc.NegativeTTL)
+}
+
+// NegativeLen returns the number of zones in the negative cache
+func (rc *RecordCache) NegativeLen() int {
+	if rc.store == nil {
+		return 0
+	}
+	rc.store.Lock()
+	defer rc.store.Unlock()
+	return len(rc.store.negative)
+}
+
+// ParseRecordCache parses the txtdirect config for the record cache
+func (rc *RecordCache) ParseRecordCache(c Dispenser) error {
+	switch c.Val() {
+	case "min_ttl":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for min_ttl field is not standard. It should be a duration")
+		}
+		rc.MinTTL = value
+
+	case "max_ttl":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for max_ttl field is not standard. It should be a duration")
+		}
+		rc.MaxTTL = value
+
+	case "max_entries":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for max_entries field is not standard. It should be a positive integer")
+		}
+		rc.MaxEntries = value
+
+	case "serve_stale":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for serve_stale field is not standard. It should be a duration")
+		}
+		rc.ServeStale = value
+
+	case "persist":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		rc.Persist = args[0]
+
+	case "persist_entries":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for persist_entries field is not standard. It should be a positive integer")
+		}
+		rc.PersistEntries = value
+
+	case "negative_ttl":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value < 0 {
+			return fmt.Errorf("The given value for negative_ttl field is not standard. It should be a duration")
+		}
+		rc.NegativeTTL = value
+
+	case "max_waiters":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for max_waiters field is not standard. It should be a positive integer")
+		}
+		rc.MaxWaiters = value
+
+	case "wait_timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for wait_timeout field is not standard. It should be a positive duration")
+		}
+		rc.WaitTimeout = value
+
+	default:
+		return c.ArgErr() // unhandled option for cache
+	}
+	return nil
+}
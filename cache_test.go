@@ -0,0 +1,207 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordCache(t *testing.T) {
+	rc := RecordCache{Enable: true}
+	rc.SetDefaults()
+
+	if _, ok := rc.Get("_redirect.example.com."); ok {
+		t.Errorf("Expected an empty cache")
+	}
+
+	rc.Set("_redirect.example.com.", []string{"v=txtv0;to=https://example.com"}, time.Minute)
+	txts, ok := rc.Get("_redirect.example.com.")
+	if !ok {
+		t.Fatalf("Expected the zone to be cached")
+	}
+	if txts[0] != "v=txtv0;to=https://example.com" {
+		t.Errorf("Expected the cached record to be returned, got %s", txts[0])
+	}
+}
+
+func TestRecordCacheTTLBounds(t *testing.T) {
+	rc := RecordCache{
+		Enable: true,
+		MinTTL: time.Millisecond,
+		MaxTTL: 50 * time.Millisecond,
+	}
+	rc.SetDefaults()
+
+	// TTL gets clamped to the max TTL
+	rc.Set("_redirect.max.test.", []string{"record"}, time.Hour)
+	// TTL gets raised to the min TTL
+	rc.Set("_redirect.min.test.", []string{"record"}, 0)
+
+	time.Sleep(100 * time.Millisecond)
+
+	for _, zone := range []string{"_redirect.max.test.", "_redirect.min.test."} {
+		if _, ok := rc.Get(zone); ok {
+			t.Errorf("Expected %s to be expired", zone)
+		}
+	}
+	if rc.Len() != 0 {
+		t.Errorf("Expected expired entries to be removed, got %d entries", rc.Len())
+	}
+}
+
+func TestRecordCacheMaxEntries(t *testing.T) {
+	rc := RecordCache{
+		Enable:     true,
+		MaxEntries: 2,
+	}
+	rc.SetDefaults()
+
+	rc.Set("_redirect.first.test.", []string{"first"}, time.Minute)
+	rc.Set("_redirect.second.test.", []string{"second"}, time.Minute)
+	// Access the first zone to make the second one the least recently used
+	rc.Get("_redirect.first.test.")
+	rc.Set("_redirect.third.test.", []string{"third"}, time.Minute)
+
+	if rc.Len() != 2 {
+		t.Errorf("Expected the cache to have 2 entries, got %d", rc.Len())
+	}
+	if _, ok := rc.Get("_redirect.second.test."); ok {
+		t.Errorf("Expected the least recently used zone to be evicted")
+	}
+	for _, zone := range []string{"_redirect.first.test.", "_redirect.third.test."} {
+		if _, ok := rc.Get(zone); !ok {
+			t.Errorf("Expected %s to be cached", zone)
+		}
+	}
+}
+
+func TestQueryCacheCanonicalHost(t *testing.T) {
+	c := Config{
+		Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+		RecordCache: RecordCache{Enable: true},
+	}
+	c.RecordCache.SetDefaults()
+
+	if _, err := query("About.TEST.", context.Background(), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// All the forms of the host share the cache entry
+	for _, host := range []string{"about.test", "ABOUT.test:443", "about.test."} {
+		ctx := context.WithValue(context.Background(), requestInfoKey{}, &requestInfo{})
+		if _, err := query(host, ctx, c); err != nil {
+			t.Errorf("Unexpected error for %s: %s", host, err)
+		}
+		if !getRequestInfo(ctx).RecordCached {
+			t.Errorf("Expected %s to be served from the cache", host)
+		}
+	}
+	if c.RecordCache.Len() != 1 {
+		t.Errorf("Expected a single cache entry, got %d", c.RecordCache.Len())
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	c := Config{
+		Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+		RecordCache: RecordCache{Enable: true},
+	}
+	c.RecordCache.SetDefaults()
+
+	resp, err := query("about.test", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp[0] != txts["_redirect.about.test."] {
+		t.Errorf("Expected %s, got %s", txts["_redirect.about.test."], resp[0])
+	}
+
+	cached, ok := c.RecordCache.Get("_redirect.about.test.")
+	if !ok {
+		t.Fatalf("Expected the zone to be cached after the query")
+	}
+	if cached[0] != resp[0] {
+		t.Errorf("Expected the cached record to match the queried record")
+	}
+}
+
+func TestRecordCacheNegative(t *testing.T) {
+	rc := RecordCache{
+		Enable:      true,
+		NegativeTTL: 50 * time.Millisecond,
+	}
+	rc.SetDefaults()
+
+	rc.SetNegative("_redirect.missing.test.")
+	if !rc.GetNegative("_redirect.missing.test.") {
+		t.Errorf("Expected the zone to be negatively cached")
+	}
+
+	// A positive answer replaces the negative one
+	rc.SetNegative("_redirect.added.test.")
+	rc.Set("_redirect.added.test.", []string{"record"}, time.Minute)
+	if rc.GetNegative("_redirect.added.test.") {
+		t.Errorf("Expected the positive answer to remove the negative entry")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if rc.GetNegative("_redirect.missing.test.") {
+		t.Errorf("Expected the negative entry to be expired")
+	}
+	if rc.NegativeLen() != 0 {
+		t.Errorf("Expected expired negative entries to be removed, got %d entries", rc.NegativeLen())
+	}
+
+	// Negative caching is disabled without a negative TTL
+	rc.NegativeTTL = 0
+	rc.SetNegative("_redirect.missing.test.")
+	if rc.GetNegative("_redirect.missing.test.") {
+		t.Errorf("Expected negative caching to be disabled")
+	}
+}
+
+func TestQueryNegativeCache(t *testing.T) {
+	var queries int32
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		atomic.StoreInt32(&queries, n)
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Rcode = dns.RcodeNameError
+		w.WriteMsg(r)
+	})
+	defer stop()
+
+	c := Config{
+		Resolver: addr,
+		RecordCache: RecordCache{
+			Enable:      true,
+			NegativeTTL: time.Minute,
+		},
+	}
+	c.RecordCache.SetDefaults()
+
+	for i := 0; i < 3; i++ {
+		if _, err := query("missing.test", context.Background(), c); err == nil {
+			t.Fatalf("Query %d: Expected an error for a missing record", i)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected the resolver to be queried once, got %d queries", n)
+	}
+}
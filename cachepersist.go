@@ -0,0 +1,129 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistedCache is the format of the record cache's file
+type persistedCache struct {
+	Version int              `json:"version"`
+	Entries []persistedEntry `json:"entries"`
+}
+
+type persistedEntry struct {
+	Zone    string    `json:"zone"`
+	Txts    []string  `json:"txts"`
+	Expires time.Time `json:"expires"`
+}
+
+// persistedCacheVersion is changed when the file's format changes,
+// the files of the other versions are ignored
+const persistedCacheVersion = 1
+
+// Save writes the most recently used records to the persist file
+func (rc *RecordCache) Save() error {
+	if rc.store == nil || rc.Persist == "" {
+		return nil
+	}
+	rc.store.Lock()
+	file := persistedCache{Version: persistedCacheVersion}
+	for elem := rc.store.order.Front(); elem != nil && len(file.Entries) < rc.PersistEntries; elem = elem.Next() {
+		entry := elem.Value.(*cacheEntry)
+		file.Entries = append(file.Entries, persistedEntry{Zone: entry.zone, Txts: entry.txts, Expires: entry.expires})
+	}
+	rc.store.Unlock()
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	// The file is replaced at once, so a crash can't leave half of it
+	tmp, err := ioutil.TempFile(filepath.Dir(rc.Persist), ".txtdirect-cache")
+	if err != nil {
+		return fmt.Errorf("couldn't save the record cache: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't save the record cache: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't save the record cache: %s", err.Error())
+	}
+	return os.Rename(tmp.Name(), rc.Persist)
+}
+
+// Load fills the cache with the records of the persist file. The records
+// which expired while TXTDirect was stopped are still served for a random
+// part of the min TTL, so their lookups are spread out instead of all of
+// them hitting the resolver right after the start. The records expired
+// for longer than the max TTL are skipped.
+func (rc *RecordCache) Load() error {
+	if rc.store == nil || rc.Persist == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(rc.Persist)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't load the record cache: %s", err.Error())
+	}
+	var file persistedCache
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("couldn't load the record cache: %s", err.Error())
+	}
+	if file.Version != persistedCacheVersion {
+		log.Printf("[txtdirect]: Ignoring the record cache file of version %d", file.Version)
+		return nil
+	}
+
+	now := time.Now()
+	rc.store.Lock()
+	defer rc.store.Unlock()
+	// The least recently used records are loaded first,
+	// so they're evicted first if the cache is smaller
+	for i := len(file.Entries) - 1; i >= 0; i-- {
+		entry := file.Entries[i]
+		if entry.Zone == "" || len(entry.Txts) == 0 || now.After(entry.Expires.Add(rc.MaxTTL)) {
+			continue
+		}
+		if _, ok := rc.store.entries[entry.Zone]; ok {
+			continue
+		}
+		if warm := now.Add(time.Duration(rand.Int63n(int64(rc.MinTTL) + 1))); entry.Expires.Before(warm) {
+			entry.Expires = warm
+		}
+		for rc.store.order.Len() >= rc.MaxEntries && rc.store.order.Len() > 0 {
+			oldest := rc.store.order.Back()
+			rc.store.order.Remove(oldest)
+			delete(rc.store.entries, oldest.Value.(*cacheEntry).zone)
+		}
+		rc.store.entries[entry.Zone] = rc.store.order.PushFront(&cacheEntry{
+			zone:    entry.Zone,
+			txts:    entry.Txts,
+			expires: entry.Expires,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestRecordCachePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache-persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cache.json")
+
+	cache := RecordCache{Enable: true, Persist: file, PersistEntries: 2}
+	cache.SetDefaults()
+	cache.Set("_redirect.old.test.", []string{"v=txtv0;to=https://old.example.com"}, time.Minute)
+	cache.Set("_redirect.expired.test.", []string{"v=txtv0;to=https://expired.example.com"}, time.Minute)
+	cache.Set("_redirect.new.test.", []string{"v=txtv0;to=https://new.example.com"}, time.Minute)
+	// The records expired for longer than the max TTL aren't loaded
+	cache.store.entries["_redirect.expired.test."].Value.(*cacheEntry).expires = time.Now().Add(-2 * time.Hour)
+	if err := cache.Save(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	loaded := RecordCache{Enable: true, Persist: file}
+	loaded.SetDefaults()
+	if err := loaded.Load(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if loaded.Len() != 1 {
+		t.Errorf("Expected only the most recent usable record to be loaded, got %d records", loaded.Len())
+	}
+	if txts, ok := loaded.Get("_redirect.new.test."); !ok || txts[0] != "v=txtv0;to=https://new.example.com" {
+		t.Errorf("Expected the persisted record to be served, got %v", txts)
+	}
+	if _, ok := loaded.Get("_redirect.old.test."); ok {
+		t.Errorf("Expected the records over persist_entries not to be saved")
+	}
+
+	// The records expired while stopped are served for a part of the min TTL
+	cache.store.entries["_redirect.new.test."].Value.(*cacheEntry).expires = time.Now().Add(-time.Minute)
+	cache.Save()
+	loaded = RecordCache{Enable: true, Persist: file}
+	loaded.SetDefaults()
+	loaded.Load()
+	expires := loaded.store.entries["_redirect.new.test."].Value.(*cacheEntry).expires
+	if expires.Before(time.Now().Add(-time.Second)) || expires.After(time.Now().Add(loaded.MinTTL)) {
+		t.Errorf("Expected the stale record to expire within the min TTL, got %s", expires)
+	}
+
+	missing := RecordCache{Enable: true, Persist: filepath.Join(dir, "missing.json")}
+	missing.SetDefaults()
+	if err := missing.Load(); err != nil || missing.Len() != 0 {
+		t.Errorf("Expected a missing file to leave the cache empty, got %d records: %v", missing.Len(), err)
+	}
+	ioutil.WriteFile(file, []byte("not json"), 0644)
+	missing.Persist = file
+	if err := missing.Load(); err == nil {
+		t.Errorf("Expected an error for an invalid file")
+	}
+}
+
+func TestParseRecordCachePersist(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		cache {
+			persist /var/lib/txtdirect/cache.json
+			persist_entries 50
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.RecordCache.Persist != "/var/lib/txtdirect/cache.json" || conf.RecordCache.PersistEntries != 50 {
+		t.Errorf("Expected the persisted cache to be configured, got %+v", conf.RecordCache)
+	}
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cacheStatusHeader tells the clients if the response was served from
+// the cache, so CI owners can verify the cache is absorbing the load
+const cacheStatusHeader = "X-Cache"
+
+// cacheStatus records the cache result of a gomods or dockerv2 response
+// and sets the X-Cache header when the type has it enabled
+func cacheStatus(w http.ResponseWriter, recType string, hit, header bool, c Config) {
+	result := "MISS"
+	if hit {
+		result = "HIT"
+	}
+	if header {
+		w.Header().Set(cacheStatusHeader, result)
+	}
+	if c.Prometheus.Enable {
+		ResponseCache.WithLabelValues(recType, strings.ToLower(result)).Add(1)
+	}
+}
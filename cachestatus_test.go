@@ -0,0 +1,113 @@
+//go:build !notor && !nogomods && !nodocker
+// +build !notor,!nogomods,!nodocker
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/gomods/athens/pkg/storage/fs"
+	"github.com/spf13/afero"
+)
+
+func TestGomodsCacheStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomods-cache-status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.NewStorage(dir, afero.NewOsFs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(context.Background(), "example.com/mod", "v1.0.0", []byte("module example.com/mod"), bytes.NewReader([]byte("zip")), []byte(`{"Version":"v1.0.0"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := Config{
+		Gomods: Gomods{
+			Enable:      true,
+			Workers:     1,
+			Fs:          afero.NewOsFs(),
+			Cache:       Cache{Enable: true, Type: "local", Path: dir},
+			Routes:      []GomodsRoute{{Pattern: "*", Upstreams: []string{"off"}}},
+			CacheHeader: true,
+		},
+	}
+	tests := []struct {
+		path   string
+		status string
+	}{
+		{"/example.com/mod/@v/v1.0.0.info", "HIT"},
+		{"/example.com/mod/@v/v1.0.0.mod", "HIT"},
+		{"/example.com/missing/@v/v1.0.0.info", "MISS"},
+		{"/example.com/mod/@v/list", ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://gomods.test"+test.path, nil)
+		w := httptest.NewRecorder()
+		gomods(w, req, test.path, c)
+		if status := w.Header().Get(cacheStatusHeader); status != test.status {
+			t.Errorf("Test %d: Expected %q cache status for %s, got %q", i, test.status, test.path, status)
+		}
+	}
+
+	// The header is opt-in
+	c.Gomods.CacheHeader = false
+	w := httptest.NewRecorder()
+	gomods(w, httptest.NewRequest("GET", "https://gomods.test/example.com/mod/@v/v1.0.0.info", nil), "/example.com/mod/@v/v1.0.0.info", c)
+	if status := w.Header().Get(cacheStatusHeader); status != "" {
+		t.Errorf("Expected no cache status without the header enabled, got %q", status)
+	}
+}
+
+func TestDockerv2CacheStatus(t *testing.T) {
+	c := Config{
+		Enable:      []string{"dockerv2"},
+		Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+		RecordCache: RecordCache{Enable: true},
+		Dockerv2:    Dockerv2{CacheHeader: true},
+	}
+	c.RecordCache.SetDefaults()
+
+	tests := []struct {
+		path   string
+		status string
+	}{
+		{"/v2/container/blobs/sha256:abc", "MISS"},
+		{"/v2/container/blobs/sha256:abc", "HIT"},
+		{"/v2/container/manifests/latest", ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://container.dockerv2.test"+test.path, nil)
+		req.Header.Set("User-Agent", "Docker-Client/19.03.5 (linux)")
+		w := httptest.NewRecorder()
+		if err := serve(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if status := w.Header().Get(cacheStatusHeader); status != test.status {
+			t.Errorf("Test %d: Expected %q cache status for %s, got %q", i, test.status, test.path, status)
+		}
+	}
+}
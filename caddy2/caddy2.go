@@ -0,0 +1,179 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package caddy2 registers TXTDirect as the http.handlers.txtdirect
+// module and the txtdirect directive of Caddy v2.
+package caddy2
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/txtdirect/txtdirect"
+)
+
+func init() {
+	caddy.RegisterModule(Handler{})
+	httpcaddyfile.RegisterHandlerDirective("txtdirect", parseCaddyfile)
+}
+
+// Handler redirects the requests based on TXT records. Its options are
+// the lines of the txtdirect block, the nested blocks keep their braces.
+// They're validated by the same parser as the Caddyfile, so the options
+// aren't mapped onto separate JSON fields:
+//
+//	{
+//		"handler": "txtdirect",
+//		"options": [
+//			["enable", "host", "path"],
+//			["status", "{"],
+//			["host", "status.example.com"],
+//			["}"]
+//		]
+//	}
+type Handler struct {
+	Options [][]string `json:"options,omitempty"`
+
+	config txtdirect.Config
+	stop   func() error
+}
+
+// CaddyModule returns the Caddy module information
+func (Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.txtdirect",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// UnmarshalCaddyfile sets the options to the lines of the txtdirect block
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // skip directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	file, line := "", 0
+	for d.Next() {
+		if len(h.Options) == 0 || d.File() != file || d.Line() != line {
+			h.Options = append(h.Options, nil)
+			file, line = d.File(), d.Line()
+		}
+		h.Options[len(h.Options)-1] = append(h.Options[len(h.Options)-1], d.Val())
+	}
+	if len(h.Options) == 0 {
+		return nil
+	}
+	// Drop the braces of the txtdirect block
+	if first := h.Options[0]; first[0] == "{" {
+		h.Options[0] = first[1:]
+	}
+	if last := h.Options[len(h.Options)-1]; last[len(last)-1] == "}" {
+		h.Options[len(h.Options)-1] = last[:len(last)-1]
+	}
+	options := h.Options[:0]
+	for _, line := range h.Options {
+		if len(line) > 0 {
+			options = append(options, line)
+		}
+	}
+	h.Options = options
+	return nil
+}
+
+// tokens returns the options as the tokens of the txtdirect block
+func (h *Handler) tokens() []caddyfile.Token {
+	tokens := []caddyfile.Token{{Line: 1, Text: "txtdirect"}, {Line: 1, Text: "{"}}
+	for i, line := range h.Options {
+		for _, text := range line {
+			tokens = append(tokens, caddyfile.Token{Line: i + 2, Text: text})
+		}
+	}
+	return append(tokens, caddyfile.Token{Line: len(h.Options) + 2, Text: "}"})
+}
+
+// dispenser loads the block openings as arguments like the Caddy v1
+// dispenser, which the txtdirect parser expects
+type dispenser struct {
+	*caddyfile.Dispenser
+}
+
+func (d dispenser) NextArg() bool {
+	if d.Dispenser.NextArg() {
+		return true
+	}
+	file, line := d.File(), d.Line()
+	if !d.Next() {
+		return false
+	}
+	if d.Val() == "{" && d.File() == file && d.Line() == line {
+		return true
+	}
+	d.Prev()
+	return false
+}
+
+// Provision parses the options and starts the background work of the config
+func (h *Handler) Provision(ctx caddy.Context) error {
+	d := dispenser{caddyfile.NewDispenser(h.tokens())}
+	if err := h.config.UnmarshalCaddyfile(d); err != nil {
+		return err
+	}
+	// Like the standalone server, Tor is left out since its instances
+	// share the socks port, which only the Caddy v1 restart hooks hand over
+	if h.config.Tor.Enable {
+		return fmt.Errorf("The tor option isn't supported by the Caddy v2 module")
+	}
+	stop, err := h.config.Start()
+	if err != nil {
+		return err
+	}
+	h.stop = stop
+	return nil
+}
+
+// Cleanup stops the background work of the config
+func (h *Handler) Cleanup() error {
+	if h.stop == nil {
+		return nil
+	}
+	return h.stop()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	handled, err := h.config.Handle(w, r)
+	if !handled {
+		return next.ServeHTTP(w, r)
+	}
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var handler Handler
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return &handler, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
+	_ caddyfile.Unmarshaler       = (*Handler)(nil)
+)
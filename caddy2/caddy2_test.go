@@ -0,0 +1,147 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package caddy2
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  [][]string
+		shouldErr bool
+	}{
+		{"txtdirect", nil, false},
+		{
+			`txtdirect {
+				enable host path
+				status {
+					host status.example.com
+				}
+				redirect "https://example.com/a b"
+			}`,
+			[][]string{
+				{"enable", "host", "path"},
+				{"status", "{"},
+				{"host", "status.example.com"},
+				{"}"},
+				{"redirect", "https://example.com/a b"},
+			},
+			false,
+		},
+		{"txtdirect example.com", nil, true},
+	}
+	for i, test := range tests {
+		var h Handler
+		err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(h.Options, test.expected) {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, h.Options)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-caddy2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zone := filepath.Join(dir, "records.zone")
+	err = ioutil.WriteFile(zone, []byte(`
+_redirect.host.test. 300 IN TXT "v=txtv0;to=https://example.com/host;type=host;code=302"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := Handler{Options: [][]string{
+		{"enable", "host"},
+		{"backend", "file", zone, "{"},
+		{"timeout", "1s"},
+		{"}"},
+		{"absent_action", "next"},
+		{"logfile", "stderr"},
+	}}
+	if err := h.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Cleanup()
+
+	tests := []struct {
+		host     string
+		status   int
+		location string
+	}{
+		{"host.test", http.StatusFound, "https://example.com/host"},
+		// The hosts without a record are passed to the next handler
+		{"absent.test", http.StatusTeapot, ""},
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusTeapot)
+		return nil
+	})
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "http://"+test.host+"/", nil)
+		w := httptest.NewRecorder()
+		if err := h.ServeHTTP(w, req, next); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %s, got %s", i, test.location, location)
+		}
+	}
+}
+
+func TestProvisionTor(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	h := Handler{Options: [][]string{
+		{"enable", "host"},
+		{"tor"},
+	}}
+	if err := h.Provision(ctx); err == nil || !strings.Contains(err.Error(), "Caddy v2") {
+		t.Errorf("Expected an error for the tor option, got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package clientv3 keeps the etcd client's import path used by the
+// gomods dependencies. Their etcd client doesn't build with the gRPC
+// version of Caddy v2, so its types alias the current etcd client.
+package clientv3
+
+import clientv3 "go.etcd.io/etcd/client/v3"
+
+type (
+	Client = clientv3.Client
+	Config = clientv3.Config
+)
+
+var New = clientv3.New
@@ -0,0 +1,58 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"sort"
+)
+
+// capabilityTags are the build tags leaving the optional features
+// with heavy dependencies out of the binary
+var capabilityTags = map[string]string{
+	"gomods":   "nogomods",
+	"dockerv2": "nodocker",
+	"tor":      "notor",
+}
+
+// capabilities are the optional features compiled into the binary,
+// the feature's files register it when their build tag isn't set
+var capabilities = make(map[string]bool)
+
+// Capabilities returns the optional features compiled into the binary
+func Capabilities() []string {
+	var compiled []string
+	for feature := range capabilities {
+		compiled = append(compiled, feature)
+	}
+	sort.Strings(compiled)
+	return compiled
+}
+
+// errNotCompiled is returned when the config uses a feature
+// which was left out of the binary by its build tag
+func errNotCompiled(feature string) error {
+	return fmt.Errorf("%s isn't supported by this binary, it was built with the %s tag", feature, capabilityTags[feature])
+}
+
+// requireCapabilities checks if the features used by the config, either
+// as enabled record types or by their config blocks, are compiled in
+func requireCapabilities(enable []string, blocks map[string]bool) error {
+	for _, feature := range []string{"dockerv2", "gomods", "tor"} {
+		if (contains(enable, feature) || blocks[feature]) && !capabilities[feature] {
+			return errNotCompiled(feature)
+		}
+	}
+	return nil
+}
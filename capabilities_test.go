@@ -0,0 +1,71 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestRequireCapabilities(t *testing.T) {
+	compiled := capabilities
+	defer func() { capabilities = compiled }()
+	capabilities = map[string]bool{"tor": true}
+
+	tests := []struct {
+		enable    []string
+		blocks    map[string]bool
+		shouldErr bool
+	}{
+		{[]string{"host", "path"}, nil, false},
+		{[]string{"host", "tor"}, map[string]bool{"tor": true}, false},
+		{[]string{"host", "gomods"}, nil, true},
+		{[]string{"host"}, map[string]bool{"dockerv2": true}, true},
+		{[]string{"host"}, map[string]bool{"gomods": false}, false},
+	}
+	for i, test := range tests {
+		err := requireCapabilities(test.enable, test.blocks)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %d: Expected an error: %t, got %v", i, test.shouldErr, err)
+		}
+	}
+	if !identical(Capabilities(), []string{"tor"}) {
+		t.Errorf("Expected only tor to be compiled in, got %v", Capabilities())
+	}
+}
+
+func TestParseMissingCapability(t *testing.T) {
+	compiled := capabilities
+	defer func() { capabilities = compiled }()
+	capabilities = map[string]bool{}
+
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host gomods
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for a feature which isn't compiled in")
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable host path
+	}
+	`)
+	if _, err := parse(c); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
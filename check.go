@@ -0,0 +1,184 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkRecordTypes are the record types the checked records may have
+var checkRecordTypes = []string{"host", "path", "gometa", "proxy", "dockerv2", "gomods", "tor", "mirror", "qr", "dns", "sinkhole", "honeypot"}
+
+// checkURLKeys are the fields holding the URLs the records redirect to
+var checkURLKeys = []string{"to", "fallback", "website", "docs", "root"}
+
+// CheckResult is the outcome of checking a domain's record
+type CheckResult struct {
+	Zone string
+	TXT  string
+	// Fields are the record's fields in their order
+	Fields []CheckField
+	// Errors make the record unusable, Warnings are
+	// the risky parts of a usable record
+	Errors   []string
+	Warnings []string
+	Targets  []TargetCheck
+}
+
+// CheckField is a key=value field of the checked record
+type CheckField struct {
+	Key   string
+	Value string
+}
+
+// TargetCheck is the outcome of checking a target's reachability
+type TargetCheck struct {
+	Field string
+	URL   string
+	Err   error
+}
+
+// Failed checks if the record has errors or unreachable targets
+func (r CheckResult) Failed() bool {
+	if len(r.Errors) > 0 {
+		return true
+	}
+	for _, target := range r.Targets {
+		if target.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRecord looks up the domain's record using the given resolver,
+// the system's one when it's empty, and checks its syntax, its targets'
+// reachability and the risks of open redirects
+func CheckRecord(domain, resolver string, timeout time.Duration) (CheckResult, error) {
+	c := Config{Resolver: resolver, Enable: checkRecordTypes}
+	zone := recordZone(domain)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	txts, _, err := lookupTXT(ctx, zone, c)
+	if err != nil {
+		return CheckResult{Zone: zone}, fmt.Errorf("couldn't find the record of %s: %s", zone, err.Error())
+	}
+	if len(txts) == 0 || txts[0] == "" {
+		return CheckResult{Zone: zone}, fmt.Errorf("%s has an empty TXT record", zone)
+	}
+	txt, err := joinParts(zone, txts[0], ctx, c)
+	if err != nil {
+		return CheckResult{Zone: zone, TXT: txts[0], Errors: []string{err.Error()}}, nil
+	}
+	result := checkTXT(domain, txt, c, timeout)
+	result.Zone = zone
+	if len(txts) > 1 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("%s has %d TXT records, only the first one is used", zone, len(txts)))
+	}
+	return result, nil
+}
+
+// checkTXT checks the domain's TXT record
+func checkTXT(domain, txt string, c Config, timeout time.Duration) CheckResult {
+	result := CheckResult{TXT: txt}
+	fields, err := splitRecordFields(txt)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	for _, field := range fields {
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) != 2 {
+			result.Fields = append(result.Fields, CheckField{Value: field})
+			continue
+		}
+		result.Fields = append(result.Fields, CheckField{Key: keyValue[0], Value: keyValue[1]})
+	}
+
+	req, err := http.NewRequest("GET", "http://"+domain+"/", nil)
+	if err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+	rec := record{}
+	if err := rec.Parse(txt, req, c); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result
+	}
+
+	for _, field := range result.Fields {
+		if !contains(checkURLKeys, field.Key) || field.Value == "" {
+			continue
+		}
+		// The dns records delegate to a host instead of a URL
+		if rec.Type == "dns" && field.Key == "to" {
+			continue
+		}
+		warnings, checkable := targetRisks(field.Key, field.Value)
+		result.Warnings = append(result.Warnings, warnings...)
+		if checkable {
+			result.Targets = append(result.Targets, TargetCheck{
+				Field: field.Key,
+				URL:   field.Value,
+				Err:   checkTarget(field.Value, timeout),
+			})
+		}
+	}
+	return result
+}
+
+// targetRisks returns the risks of the field's target and checks if
+// its reachability can be checked, the targets using the request's
+// placeholders can't be
+func targetRisks(key, target string) ([]string, bool) {
+	if strings.HasPrefix(target, "{") {
+		return []string{fmt.Sprintf("%s= is taken from the request, which makes the record an open redirect", key)}, false
+	}
+	// The placeholders aren't valid URL parts, so the URL isn't parsed
+	separator := strings.Index(target, "://")
+	if separator < 0 {
+		if colon := strings.Index(target, ":"); colon > 0 && !strings.ContainsAny(target[:colon], "{/.") {
+			return []string{fmt.Sprintf("%s= uses the unsafe %s scheme", key, target[:colon])}, false
+		}
+		return []string{fmt.Sprintf("%s= isn't an absolute URL: %s", key, target)}, false
+	}
+
+	var warnings []string
+	switch strings.ToLower(target[:separator]) {
+	case "https":
+	case "http":
+		warnings = append(warnings, fmt.Sprintf("%s= doesn't use HTTPS: %s", key, target))
+	default:
+		return []string{fmt.Sprintf("%s= uses the unsafe %s scheme", key, target[:separator])}, false
+	}
+	authority := target[separator+len("://"):]
+	if end := strings.IndexAny(authority, "/?#"); end >= 0 {
+		authority = authority[:end]
+	}
+	// The placeholders starting with / end the host
+	for _, placeholder := range []string{"{uri}", "{path}", "{dir}"} {
+		if end := strings.Index(authority, placeholder); end >= 0 {
+			authority = authority[:end]
+		}
+	}
+	if strings.Contains(authority, "{") {
+		warnings = append(warnings, fmt.Sprintf("%s= takes its host from the request, which makes the record an open redirect", key))
+	}
+	return warnings, !strings.Contains(target, "{")
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckTXT(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	c := Config{Enable: checkRecordTypes}
+	tests := []struct {
+		txt         string
+		errors      int
+		warnings    int
+		targets     int
+		unreachable int
+	}{
+		{"v=txtv0;to=" + healthy.URL + ";type=host", 0, 1, 1, 0},
+		{"v=txtv0;to=" + broken.URL + ";type=host", 0, 1, 1, 1},
+		{"v=txtv0;to=" + healthy.URL + "{uri};fallback=" + broken.URL + ";type=host", 0, 2, 1, 1},
+		{"v=txtv0;to=https://example.com{remote};type=host", 0, 1, 0, 0},
+		{"v=txtv0;to=https://{host}.example.com;type=host", 0, 1, 0, 0},
+		{"v=txtv0;to={query};type=host", 0, 1, 0, 0},
+		{"v=txtv0;to=javascript:alert(1);type=host", 0, 1, 0, 0},
+		{"v=txtv0;to=example.com;type=host", 0, 1, 0, 0},
+		{"v=txtv0;to=dns.example.com;type=dns", 0, 0, 0, 0},
+		{"v=txtv0;to=https://example.com;code=200;type=host", 1, 0, 0, 0},
+		{"v=txtv1;to=https://example.com/?a=b", 1, 0, 0, 0},
+	}
+	for i, test := range tests {
+		result := checkTXT("example.com", test.txt, c, time.Second)
+		unreachable := 0
+		for _, target := range result.Targets {
+			if target.Err != nil {
+				unreachable++
+			}
+		}
+		if len(result.Errors) != test.errors || len(result.Warnings) != test.warnings ||
+			len(result.Targets) != test.targets || unreachable != test.unreachable {
+			t.Errorf("Test %d: Expected %d errors, %d warnings and %d targets with %d unreachable, got %+v",
+				i, test.errors, test.warnings, test.targets, test.unreachable, result)
+		}
+		if result.Failed() != (test.errors > 0 || test.unreachable > 0) {
+			t.Errorf("Test %d: Unexpected failed result %+v", i, result)
+		}
+	}
+}
+
+func TestCheckRecord(t *testing.T) {
+	resolver := "127.0.0.1:" + strconv.Itoa(port)
+	result, err := CheckRecord("healthy.health.test", resolver, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CheckField{
+		{Key: "v", Value: "txtv0"},
+		{Key: "to", Value: "https://healthy.target.test{uri}"},
+		{Key: "type", Value: "host"},
+	}
+	if result.Zone != "_redirect.healthy.health.test." || !reflect.DeepEqual(result.Fields, expected) {
+		t.Errorf("Expected the fields %+v of the zone, got %+v", expected, result)
+	}
+	if result.Failed() || len(result.Warnings) != 0 || len(result.Targets) != 0 {
+		t.Errorf("Expected the record to pass the check, got %+v", result)
+	}
+
+	if _, err := CheckRecord("missing.health.test", resolver, time.Second); err == nil {
+		t.Errorf("Expected an error for a domain without a record")
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// uriListType is the media type the clients ask for
+// to get all of the record's targets instead of one
+const uriListType = "text/uri-list"
+
+var choicesTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Multiple Choices</title>
+</head>
+<body>
+<h1>Multiple Choices</h1>
+<ul>
+{{range .}}<li><a href="{{.}}">{{.}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+// wantsChoices checks if the client should get the list of the targets,
+// either because it accepts text/uri-list or the config enables it for all
+func wantsChoices(r *http.Request, c Config) bool {
+	if c.MultipleChoices {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == uriListType {
+			return true
+		}
+	}
+	return false
+}
+
+// targetChoices returns the record's targets which can be used,
+// in the order of the record's to= field
+func targetChoices(rec record, r *http.Request, c Config) []string {
+	var choices []string
+	for _, target := range rec.Targets {
+		rec.To = target
+		to, _, err := getBaseTarget(rec, r)
+		if err != nil {
+			log.Printf("[txtdirect]: Skipping the %s target: %s", target, err.Error())
+			continue
+		}
+		if c.HealthCheck.Enable && !c.HealthCheck.Healthy(to) {
+			continue
+		}
+		choices = append(choices, to)
+	}
+	return choices
+}
+
+// serveChoices responds with 300 Multiple Choices listing the targets as
+// Link headers and in the body. The first target is the preferred one.
+func serveChoices(w http.ResponseWriter, r *http.Request, choices []string) {
+	for _, choice := range choices {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"alternate\"", choice))
+	}
+	w.Header().Set("Location", choices[0])
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusMultipleChoices))
+	w.Header().Set("Vary", "Accept")
+
+	if strings.Contains(r.Header.Get("Accept"), uriListType) {
+		w.Header().Set("Content-Type", uriListType+"; charset=utf-8")
+		w.WriteHeader(http.StatusMultipleChoices)
+		if r.Method != http.MethodHead {
+			fmt.Fprint(w, strings.Join(choices, "\r\n")+"\r\n")
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusMultipleChoices)
+	if r.Method != http.MethodHead {
+		choicesTmpl.Execute(w, choices)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestMultipleChoices(t *testing.T) {
+	tests := []struct {
+		accept          string
+		multipleChoices bool
+		status          int
+		contentType     string
+		body            string
+	}{
+		{"text/uri-list", false, 300, "text/uri-list; charset=utf-8", "https://unhealthy.target.test/docs\r\nhttps://healthy.target.test/docs\r\n"},
+		{"text/html", true, 300, "text/html; charset=utf-8", `<li><a href="https://healthy.target.test/docs">`},
+		{"text/html", false, 302, "", ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:          []string{"host"},
+			Resolver:        "127.0.0.1:" + strconv.Itoa(port),
+			MultipleChoices: test.multipleChoices,
+		}
+		req := httptest.NewRequest("GET", "https://chain.health.test/docs", nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		// The first target is always the preferred one
+		if location := w.Header().Get("Location"); location != "https://unhealthy.target.test/docs" {
+			t.Errorf("Test %d: Expected the first target as the location, got %s", i, location)
+		}
+		if test.status != 300 {
+			continue
+		}
+		links := w.Header()["Link"]
+		if !identical(links, []string{`<https://unhealthy.target.test/docs>; rel="alternate"`, `<https://healthy.target.test/docs>; rel="alternate"`}) {
+			t.Errorf("Test %d: Unexpected Link headers %v", i, links)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Test %d: Expected the %s content type, got %s", i, test.contentType, contentType)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("Test %d: Expected the body to contain %q, got %q", i, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestParseMultipleChoices(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		multiple_choices
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !conf.MultipleChoices {
+		t.Errorf("Expected multiple choices to be enabled")
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		multiple_choices always
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for an argument to multiple_choices")
+	}
+}
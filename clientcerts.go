@@ -0,0 +1,214 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ClientCerts requires the TLS client certificates for the configured
+// hosts and record types, e.g. for the internal proxy endpoints. The
+// certificates verified by the TLS server are accepted, the ones only
+// requested by it are verified against the CA when it's set.
+type ClientCerts struct {
+	Enable bool
+	// Hosts are the host patterns requiring a client certificate,
+	// * matches every host and *. matches the subdomains
+	Hosts []string
+	// Types are the record types requiring a client certificate
+	Types []string
+	// CA is the PEM file of the certificate authorities
+	CA string
+
+	store *clientCertStore
+}
+
+// clientCertStore holds the loaded certificate authorities,
+// which are shared by the copies of the config
+type clientCertStore struct {
+	sync.RWMutex
+	pool *x509.CertPool
+}
+
+// SetDefaults sets the default values for the client certs config
+func (cc *ClientCerts) SetDefaults() {
+	if cc.store == nil {
+		cc.store = &clientCertStore{}
+	}
+}
+
+// Load reads the certificate authorities
+func (cc *ClientCerts) Load() error {
+	if cc.CA == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cc.CA)
+	if err != nil {
+		return fmt.Errorf("couldn't read the client CA file: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("couldn't find any certificates in the client CA file %s", cc.CA)
+	}
+	if cc.store == nil {
+		cc.store = &clientCertStore{}
+	}
+	cc.store.Lock()
+	cc.store.pool = pool
+	cc.store.Unlock()
+	return nil
+}
+
+// required checks if the request needs a client certificate
+// for its host or, when it's known, its record type
+func (cc *ClientCerts) required(r *http.Request, recordType string) bool {
+	host := canonicalHost(r.Host)
+	for _, pattern := range cc.Hosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return recordType != "" && contains(cc.Types, recordType)
+}
+
+// verified checks if the client presented a valid certificate
+func (cc *ClientCerts) verified(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	if len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	pool := cc.roots()
+	if pool == nil {
+		return false
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := r.TLS.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err == nil
+}
+
+// roots returns the loaded certificate authorities, or nil
+func (cc *ClientCerts) roots() *x509.CertPool {
+	if cc.store == nil {
+		return nil
+	}
+	cc.store.RLock()
+	defer cc.store.RUnlock()
+	return cc.store.pool
+}
+
+// deny answers the requests needing a client certificate without
+// a valid one with 403 Forbidden. The record type is empty
+// when the request's record isn't looked up yet.
+func (cc *ClientCerts) deny(w http.ResponseWriter, r *http.Request, recordType string, c Config) bool {
+	if !cc.required(r, recordType) || cc.verified(r) {
+		return false
+	}
+	log.Printf("[txtdirect]: %s needs a valid client certificate", r.Host+r.URL.Path)
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusForbidden))
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	if c.Prometheus.Enable {
+		RequestsByStatus.WithLabelValues(r.Host, strconv.Itoa(http.StatusForbidden)).Add(1)
+	}
+	return true
+}
+
+// verifiedClientCert returns the client certificate if it was verified
+// by the TLS server or against the client certificates' CA, the
+// unverified certificates can claim any name
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	if len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.PeerCertificates[0]
+	}
+	if cc := getRequestInfo(r.Context()).clientCerts; cc != nil && cc.verified(r) {
+		return r.TLS.PeerCertificates[0]
+	}
+	return nil
+}
+
+// clientCertCN returns the common name of the verified client certificate
+func clientCertCN(r *http.Request) string {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return ""
+	}
+	return cert.Subject.CommonName
+}
+
+// clientCertFingerprint returns the hex SHA-256 fingerprint
+// of the verified client certificate
+func clientCertFingerprint(r *http.Request) string {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseClientCerts parses the txtdirect config for the client certificates
+func (cc *ClientCerts) ParseClientCerts(c Dispenser) error {
+	switch c.Val() {
+	case "hosts":
+		hosts := c.RemainingArgs()
+		if len(hosts) == 0 {
+			return c.ArgErr()
+		}
+		for _, host := range hosts {
+			cc.Hosts = append(cc.Hosts, strings.ToLower(strings.TrimSuffix(host, ".")))
+		}
+
+	case "types":
+		types := c.RemainingArgs()
+		if len(types) == 0 {
+			return c.ArgErr()
+		}
+		cc.Types = append(cc.Types, types...)
+
+	case "ca":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if _, err := os.Stat(args[0]); err != nil {
+			return fmt.Errorf("The given value for ca field is not standard. It should be a PEM file: %s", err.Error())
+		}
+		cc.CA = args[0]
+
+	default:
+		return c.ArgErr() // unhandled option for client_certs
+	}
+	return nil
+}
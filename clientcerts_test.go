@@ -0,0 +1,292 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// testClientCert creates a client certificate signed by a
+// new CA and returns the certificate and the CA's PEM file
+func testClientCert(t *testing.T, cn string) (*x509.Certificate, string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.TempFile("", "txtdirect-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := pem.Encode(file, &pem.Block{Type: "CERTIFICATE", Bytes: caDER}); err != nil {
+		t.Fatal(err)
+	}
+	return cert, file.Name()
+}
+
+func TestClientCertPlaceholders(t *testing.T) {
+	cert, ca := testClientCert(t, "client.example.com")
+	defer os.Remove(ca)
+	sum := sha256.Sum256(cert.Raw)
+
+	cc := ClientCerts{Enable: true, CA: ca}
+	if err := cc.Load(); err != nil {
+		t.Fatal(err)
+	}
+	verified := "https://example.com/client.example.com/" + hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		state       *tls.ConnectionState
+		clientCerts *ClientCerts
+		expected    string
+	}{
+		{nil, nil, "https://example.com//"},
+		// Anyone can present an unverified certificate
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, nil, "https://example.com//"},
+		{&tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}, nil, verified},
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, &cc, verified},
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, &ClientCerts{Enable: true}, "https://example.com//"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.TLS = test.state
+		req, info := withRequestInfo(req)
+		info.clientCerts = test.clientCerts
+		result, err := parsePlaceholders("https://example.com/{tls_client_cn}/{tls_client_fingerprint}", req, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, result)
+		}
+	}
+}
+
+func TestClientCertsDeny(t *testing.T) {
+	cert, ca := testClientCert(t, "client.example.com")
+	defer os.Remove(ca)
+	other, otherCA := testClientCert(t, "other.example.com")
+	defer os.Remove(otherCA)
+
+	tests := []struct {
+		hosts      []string
+		types      []string
+		host       string
+		recordType string
+		state      *tls.ConnectionState
+		denied     bool
+	}{
+		{[]string{"*.example.com"}, nil, "internal.example.com", "", nil, true},
+		{[]string{"*.example.com"}, nil, "example.com", "", nil, false},
+		{[]string{"*"}, nil, "example.org", "", nil, true},
+		{nil, []string{"proxy"}, "example.com", "", nil, false},
+		{nil, []string{"proxy"}, "example.com", "host", nil, false},
+		{nil, []string{"proxy"}, "example.com", "proxy", nil, true},
+		// Verified by the TLS server
+		{nil, []string{"proxy"}, "example.com", "proxy", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{other},
+			VerifiedChains:   [][]*x509.Certificate{{other}},
+		}, false},
+		// Verified against the CA
+		{[]string{"example.com"}, nil, "example.com", "", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+		}, false},
+		{[]string{"example.com"}, nil, "Example.com.:443", "", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{other},
+		}, true},
+		{[]string{"example.com"}, nil, "example.com", "", &tls.ConnectionState{}, true},
+	}
+	for i, test := range tests {
+		cc := ClientCerts{Enable: true, Hosts: test.hosts, Types: test.types, CA: ca}
+		if err := cc.Load(); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.Host = test.host
+		req.TLS = test.state
+		w := httptest.NewRecorder()
+		if denied := cc.deny(w, req, test.recordType, Config{}); denied != test.denied {
+			t.Errorf("Test %d: Expected denied to be %t, got %t", i, test.denied, denied)
+			continue
+		}
+		if test.denied && w.Code != 403 {
+			t.Errorf("Test %d: Expected 403, got %d", i, w.Code)
+		}
+	}
+}
+
+func TestClientCertsE2e(t *testing.T) {
+	cert, ca := testClientCert(t, "client.example.com")
+	defer os.Remove(ca)
+
+	tests := []struct {
+		clientCerts ClientCerts
+		cert        *x509.Certificate
+		status      int
+	}{
+		{ClientCerts{Enable: true, Types: []string{"host"}}, nil, 403},
+		{ClientCerts{Enable: true, Types: []string{"host"}, CA: ca}, cert, 302},
+		{ClientCerts{Enable: true, Types: []string{"path"}}, nil, 302},
+		{ClientCerts{Enable: true, Hosts: []string{"*.health.test"}}, nil, 403},
+		{ClientCerts{Enable: true, Hosts: []string{"*.health.test"}, CA: ca}, cert, 302},
+	}
+	for i, test := range tests {
+		if err := test.clientCerts.Load(); err != nil {
+			t.Fatal(err)
+		}
+		c := Config{
+			Enable:      []string{"host"},
+			Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+			ClientCerts: test.clientCerts,
+		}
+		req := httptest.NewRequest("GET", "https://healthy.health.test/", nil)
+		if test.cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+		w := httptest.NewRecorder()
+		if err := serve(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected %d, got %d", i, test.status, w.Code)
+		}
+	}
+}
+
+func TestParseClientCerts(t *testing.T) {
+	_, ca := testClientCert(t, "client.example.com")
+	defer os.Remove(ca)
+
+	tests := []struct {
+		input     string
+		expected  ClientCerts
+		shouldErr bool
+	}{
+		{
+			`client_certs {
+				hosts *.Internal.example.com example.org.
+				types proxy gomods
+			}`,
+			ClientCerts{
+				Enable: true,
+				Hosts:  []string{"*.internal.example.com", "example.org"},
+				Types:  []string{"proxy", "gomods"},
+			},
+			false,
+		},
+		{
+			fmt.Sprintf(`client_certs {
+				types proxy
+				ca %s
+			}`, ca),
+			ClientCerts{Enable: true, Types: []string{"proxy"}, CA: ca},
+			false,
+		},
+		{"client_certs {\n}", ClientCerts{}, true},
+		{"client_certs {\nhosts\n}", ClientCerts{}, true},
+		{"client_certs {\ntypes proxy\nca\n}", ClientCerts{}, true},
+		{"client_certs {\ntypes proxy\nca testdata/missing.pem\n}", ClientCerts{}, true},
+		{"client_certs {\ntypes proxy\nca testdata/GeoIP2-City-Test.mmdb\n}", ClientCerts{}, true},
+		{"client_certs {\ntypes proxy\nrequire yes\n}", ClientCerts{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host proxy
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if err == nil {
+			// The CA file gets loaded by the startup hook
+			err = conf.ClientCerts.Load()
+		}
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		conf.ClientCerts.store = nil
+		if !reflect.DeepEqual(conf.ClientCerts, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.ClientCerts)
+		}
+	}
+}
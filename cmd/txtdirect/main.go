@@ -14,15 +14,253 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
 	"github.com/mholt/caddy/caddy/caddymain"
 
 	_ "github.com/SchumacherFM/mailout"
 	_ "github.com/captncraig/caddy-realip"
 	_ "github.com/miekg/caddy-prometheus"
-	_ "github.com/txtdirect/txtdirect"
+	"github.com/txtdirect/txtdirect"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		if err := runCheck(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "controller" {
+		if err := runController(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		if err := runValidate(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	caddymain.EnableTelemetry = false
 	caddymain.Run()
-}
\ No newline at end of file
+}
+
+// runImport converts the links exported from another link
+// shortener into TXT records and prints them as a zone snippet
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	from := flags.String("from", "", "Export format: "+strings.Join(txtdirect.ImportFormats, ", "))
+	domain := flags.String("domain", "", "Domain serving the short links")
+	code := flags.Int("code", 301, "Status code of the redirects")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: txtdirect import --from <format> --domain <domain> <file>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *from == "" || *domain == "" || flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	links, warnings, err := txtdirect.ImportLinks(file, *from)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", warning)
+	}
+	return txtdirect.WriteZoneSnippet(os.Stdout, links, *domain, *code)
+}
+
+// runValidate runs a path record against the sample paths and
+// prints the zone, captures and substituted target of each path
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	host := flags.String("host", "example.com", "Host serving the path record")
+	rec := flags.String("record", "", "Path record, e.g. v=txtv0;type=path;re=...")
+	target := flags.String("target", "", "Record on the paths' zones using the {$N} captures")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: txtdirect validate --record <record> [--target <record>] [--host <host>] <path>...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *rec == "" || flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	results, err := txtdirect.ValidateRecord(*host, *rec, *target, flags.Args())
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, result := range results {
+		if result.Err != nil {
+			failed = true
+			fmt.Printf("%s: error: %s\n", result.Path, result.Err.Error())
+			continue
+		}
+		fmt.Printf("%s: zone=%s captures=%q", result.Path, result.Zone, result.Captures)
+		if result.Target != "" {
+			fmt.Printf(" target=%s", result.Target)
+		}
+		fmt.Println()
+	}
+	if failed {
+		return fmt.Errorf("some of the paths failed the validation")
+	}
+	return nil
+}
+
+// runCheck looks up the domain's record and prints its fields,
+// the reachability of its targets and the problems found
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	resolver := flags.String("resolver", "", "DNS resolver address or DoH endpoint, the system's one by default")
+	timeout := flags.Duration("timeout", 5*time.Second, "Timeout of the lookup and each target's check")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: txtdirect check [--resolver <address>] [--timeout <duration>] <domain>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	result, err := txtdirect.CheckRecord(flags.Arg(0), *resolver, *timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n\n", result.Zone)
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "KEY\tVALUE")
+	for _, field := range result.Fields {
+		fmt.Fprintf(table, "%s\t%s\n", field.Key, field.Value)
+	}
+	table.Flush()
+
+	if len(result.Targets) > 0 {
+		fmt.Println()
+	}
+	for _, target := range result.Targets {
+		if target.Err != nil {
+			fmt.Printf("unreachable: %s= %s: %s\n", target.Field, target.URL, target.Err.Error())
+			continue
+		}
+		fmt.Printf("reachable: %s= %s\n", target.Field, target.URL)
+	}
+	if len(result.Warnings)+len(result.Errors) > 0 {
+		fmt.Println()
+	}
+	for _, warning := range result.Warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+	for _, problem := range result.Errors {
+		fmt.Printf("error: %s\n", problem)
+	}
+	if result.Failed() {
+		return fmt.Errorf("the record of %s has problems", flags.Arg(0))
+	}
+	return nil
+}
+
+// runController publishes the records of the cluster's TXTRedirect
+// resources and annotated Ingresses until it's stopped
+func runController(args []string) error {
+	flags := flag.NewFlagSet("controller", flag.ExitOnError)
+	api := flags.String("kube-api", "", "Kubernetes API server's URL, the in-cluster one by default")
+	tokenFile := flags.String("kube-token-file", "", "File holding the bearer token of the API server")
+	caFile := flags.String("kube-ca", "", "CA certificate of the API server")
+	namespace := flags.String("namespace", "", "Namespace of the watched resources, all of them by default")
+	ingresses := flags.Bool("ingresses", false, "Publish the records of the Ingresses annotated with "+txtdirect.IngressAnnotation)
+	interval := flags.Duration("interval", txtdirect.DefaultControllerInterval, "Interval between the syncs")
+	owner := flags.String("owner", txtdirect.DefaultControllerOwner, "Owner of the published records, unique for each controller of the zone")
+	server := flags.String("dns-server", "", "Address of the DNS server accepting RFC 2136 updates")
+	zone := flags.String("zone", "", "Zone holding the records")
+	ttl := flags.Uint("ttl", txtdirect.DefaultRFC2136TTL, "TTL of the published records")
+	keyName := flags.String("tsig-key", "", "Name of the TSIG key signing the updates")
+	keyAlgorithm := flags.String("tsig-algorithm", "hmac-sha256", "Algorithm of the TSIG key")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: txtdirect controller --dns-server <address> --zone <zone> [options]\n")
+		fmt.Fprintf(os.Stderr, "The TSIG key's base64 secret is read from TXTDIRECT_TSIG_SECRET\n")
+		fmt.Fprintf(os.Stderr, "The DNS server should allow the key to transfer the zone\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *server == "" || *zone == "" || flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	provider := &txtdirect.RFC2136{
+		Server:       *server,
+		Zone:         *zone,
+		TTL:          uint32(*ttl),
+		KeyName:      *keyName,
+		KeyAlgorithm: *keyAlgorithm,
+		Secret:       os.Getenv("TXTDIRECT_TSIG_SECRET"),
+	}
+	if provider.KeyName != "" && provider.Secret == "" {
+		return fmt.Errorf("the TSIG key's secret should be set in TXTDIRECT_TSIG_SECRET")
+	}
+
+	var controller *txtdirect.Controller
+	if *api == "" {
+		var err error
+		if controller, err = txtdirect.InClusterController(provider); err != nil {
+			return err
+		}
+	} else {
+		controller = &txtdirect.Controller{API: *api, CAFile: *caFile, Provider: provider}
+		if *tokenFile != "" {
+			token, err := ioutil.ReadFile(*tokenFile)
+			if err != nil {
+				return err
+			}
+			controller.Token = strings.TrimSpace(string(token))
+		}
+	}
+	controller.Namespace = *namespace
+	controller.Ingresses = *ingresses
+	controller.Interval = *interval
+	controller.Owner = *owner
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	return controller.Run(ctx)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// txtdirectd serves TXTDirect as a standalone HTTP(S) server without Caddy
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/txtdirect/txtdirect"
+)
+
+func main() {
+	configFile := flag.String("config", "", "Path to the YAML config file")
+	listen := flag.String("listen", "", "Address to listen on (default \""+txtdirect.DefaultStandaloneListen+"\")")
+	tlsCert := flag.String("tls-cert", "", "Path to the TLS certificate")
+	tlsKey := flag.String("tls-key", "", "Path to the TLS certificate's key")
+	resolver := flag.String("resolver", "", "Custom DNS resolver address or DoH endpoint")
+	enable := flag.String("enable", "", "Comma separated list of enabled record types")
+	redirect := flag.String("redirect", "", "Global fallback redirect address")
+	logfile := flag.String("logfile", "", "Log output: stdout, stderr or a file path")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Read the client addresses from the PROXY protocol headers")
+	flag.Parse()
+
+	var s txtdirect.Standalone
+	if *configFile != "" {
+		var err error
+		if s, err = txtdirect.LoadStandalone(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// The environment takes precedence over the config file
+	if err := s.LoadEnv(os.Environ()); err != nil {
+		fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	// Flags take precedence over the environment
+	setString(&s.Listen, *listen)
+	setString(&s.TLSCert, *tlsCert)
+	setString(&s.TLSKey, *tlsKey)
+	setString(&s.Resolver, *resolver)
+	setString(&s.Redirect, *redirect)
+	setString(&s.Logfile, *logfile)
+	if *enable != "" {
+		s.Enable = strings.Split(*enable, ",")
+	}
+	if *proxyProtocol {
+		s.ProxyProtocol = true
+	}
+	s.SetDefaults()
+
+	fmt.Fprintf(os.Stderr, "[txtdirect]: Listening on %s\n", s.Listen)
+	if err := s.ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, "[txtdirect]: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func setString(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// conditionOperators are the comparisons allowed in the if= and unless=
+// fields. The two character operators are matched first.
+var conditionOperators = []string{"==", "!=", "!~", "~"}
+
+// condition compares a request attribute, given as a placeholder, to a
+// value. The value is a regular expression for the ~ and !~ operators.
+type condition struct {
+	Attribute string
+	Operator  string
+	Value     string
+
+	regex *regexp.Regexp
+}
+
+// parseCondition parses the expression of an if= or unless= field,
+// e.g. {>User-Agent}~(?i)mobile or {method}==POST
+func parseCondition(expr string) (condition, error) {
+	for _, operator := range conditionOperators {
+		index := strings.Index(expr, operator)
+		if index == -1 {
+			continue
+		}
+		cond := condition{
+			Attribute: expr[:index],
+			Operator:  operator,
+			Value:     expr[index+len(operator):],
+		}
+		if !PlaceholderRegex.MatchString(cond.Attribute) {
+			return condition{}, fmt.Errorf("the condition %s should compare a placeholder", expr)
+		}
+		if operator == "~" || operator == "!~" {
+			regex, err := compileRegex(cond.Value)
+			if err != nil {
+				return condition{}, err
+			}
+			cond.regex = regex
+		}
+		return cond, nil
+	}
+	return condition{}, fmt.Errorf("the condition %s should use one of the %s operators", expr, strings.Join(conditionOperators, " "))
+}
+
+// match checks the condition against the request. The placeholders
+// which can't be filled, like missing headers, are compared as empty.
+func (cond condition) match(r *http.Request) (bool, error) {
+	attribute, err := parsePlaceholders(cond.Attribute, r, []string{})
+	if err != nil {
+		return false, err
+	}
+	attribute = PlaceholderRegex.ReplaceAllString(attribute, "")
+
+	switch cond.Operator {
+	case "==":
+		return attribute == cond.Value, nil
+	case "!=":
+		return attribute != cond.Value, nil
+	case "~":
+		return cond.regex.MatchString(attribute), nil
+	default:
+		return !cond.regex.MatchString(attribute), nil
+	}
+}
+
+// conditionsMet checks if all of the record's if= conditions
+// and none of its unless= conditions match the request
+func (r *record) conditionsMet(req *http.Request) (bool, error) {
+	for _, cond := range r.If {
+		matched, err := cond.match(req)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	for _, cond := range r.Unless {
+		matched, err := cond.match(req)
+		if err != nil || matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseCondition(t *testing.T) {
+	tests := []struct {
+		expr      string
+		expected  condition
+		shouldErr bool
+	}{
+		{"{method}==POST", condition{Attribute: "{method}", Operator: "==", Value: "POST"}, false},
+		{"{?lang}!=en", condition{Attribute: "{?lang}", Operator: "!=", Value: "en"}, false},
+		{"{~session}!~^$", condition{Attribute: "{~session}", Operator: "!~", Value: "^$"}, false},
+		{"{>User-Agent}~(?i)mobile", condition{Attribute: "{>User-Agent}", Operator: "~", Value: "(?i)mobile"}, false},
+		{"{>User-Agent}~(mobile", condition{}, true},
+		{"method==POST", condition{}, true},
+		{"{method}", condition{}, true},
+	}
+	for i, test := range tests {
+		cond, err := parseCondition(test.expr)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		cond.regex = nil
+		if cond != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, cond)
+		}
+	}
+}
+
+func TestConditionalRedirects(t *testing.T) {
+	tests := []struct {
+		url       string
+		userAgent string
+		location  string
+	}{
+		{"https://conditions.test/", "Mozilla/5.0 (iPhone) Mobile/15E148", "https://m.example.com"},
+		{"https://conditions.test/?desktop=1", "Mozilla/5.0 (iPhone) Mobile/15E148", "https://www.example.com"},
+		{"https://conditions.test/", "Mozilla/5.0 (X11; Linux x86_64)", "https://www.example.com"},
+		{"https://conditions.test/", "", "https://www.example.com"},
+		{"https://conditions.path.test/app", "Mozilla/5.0 (Android) Mobile", "https://m.example.com/app"},
+		{"https://conditions.path.test/app", "curl/7.64.0", "https://www.example.com/app"},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "path"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.userAgent != "" {
+			req.Header.Set("User-Agent", test.userAgent)
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.location, location)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxRecordParts limits the number of TXT records a record can be
+// split into using the parts= field
+const maxRecordParts = 10
+
+// maxFieldLength limits the length of a record's fields. The fields
+// can span several strings of a TXT record, which are joined together.
+const maxFieldLength = 2048
+
+// parseParts parses the parts= field of a record
+func parseParts(value string) (int, error) {
+	parts, err := strconv.Atoi(value)
+	if err != nil || parts < 1 || parts > maxRecordParts {
+		return 0, fmt.Errorf("could not parse parts: %s, it should be between 1 and %d", value, maxRecordParts)
+	}
+	return parts, nil
+}
+
+// recordParts returns the number of parts the given TXT record
+// is split into, records without the parts= field have one part
+func recordParts(txt string) (int, error) {
+	for _, field := range strings.Split(txt, ";") {
+		if strings.HasPrefix(field, "parts=") {
+			return parseParts(strings.TrimPrefix(field, "parts="))
+		}
+	}
+	return 1, nil
+}
+
+// partZone returns the zone of the given part of a record split into
+// several TXT records. The second part of _redirect.example.com lives
+// at _redirect._1.example.com, the third one at _redirect._2.example.com.
+func partZone(zone string, part int) string {
+	zone = strings.TrimPrefix(recordZone(zone), basezone+".")
+	return strings.Join([]string{basezone, "_" + strconv.Itoa(part), zone}, ".")
+}
+
+// joinParts looks up the rest of the parts of a record split with the
+// parts= field and appends their fields to the record's own ones
+func joinParts(zone, txt string, ctx context.Context, c Config) (string, error) {
+	parts, err := recordParts(txt)
+	if err != nil || parts == 1 {
+		return txt, err
+	}
+	fields := []string{strings.TrimSuffix(txt, ";")}
+	for part := 1; part < parts; part++ {
+		txts, err := query(partZone(zone, part), ctx, c)
+		if err != nil {
+			return "", fmt.Errorf("could not get part %d of the record: %s", part+1, err)
+		}
+		if len(txts) != 1 || strings.Trim(txts[0], ";") == "" {
+			return "", fmt.Errorf("could not parse part %d of the record with %d records", part+1, len(txts))
+		}
+		fields = append(fields, strings.Trim(txts[0], ";"))
+	}
+	return strings.Join(fields, ";"), nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRecordPartsE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		location string
+		status   int
+	}{
+		{"https://parts.test/", "https://root.parts.test", 302},
+		{"https://parts.test/long", "https://long.parts.test/" + strings.Repeat("a", 300), 302},
+		{"https://host.parts.test/", "https://example.com/split", 302},
+		{"https://missing.host.parts.test/", "", 404},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "path"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+	}
+}
+
+func TestPartZone(t *testing.T) {
+	tests := []struct {
+		zone     string
+		part     int
+		expected string
+	}{
+		{"example.com", 1, "_redirect._1.example.com."},
+		{"_redirect.example.com", 2, "_redirect._2.example.com."},
+		{"_redirect.path.example.com.", 3, "_redirect._3.path.example.com."},
+	}
+	for i, test := range tests {
+		if zone := partZone(test.zone, test.part); zone != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, zone)
+		}
+	}
+}
+
+func TestRecordParts(t *testing.T) {
+	tests := []struct {
+		txt       string
+		parts     int
+		shouldErr bool
+	}{
+		{"v=txtv0;to=https://example.com", 1, false},
+		{"v=txtv0;type=path;parts=3", 3, false},
+		{"v=txtv0;type=path;parts=0", 0, true},
+		{"v=txtv0;type=path;parts=" + strconv.Itoa(maxRecordParts+1), 0, true},
+		{"v=txtv0;type=path;parts=many", 0, true},
+	}
+	for i, test := range tests {
+		parts, err := recordParts(test.txt)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("Test %d: Expected error %t, got %v", i, test.shouldErr, err)
+		}
+		if parts != test.parts {
+			t.Errorf("Test %d: Expected %d parts, got %d", i, test.parts, parts)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	txtrecord "github.com/txtdirect/txtdirect/record"
+)
+
+const (
+	// ControllerGroup is the API group of the TXTRedirect resources
+	ControllerGroup = "txtdirect.org"
+	// ControllerVersion is the API version of the TXTRedirect resources
+	ControllerVersion = "v1alpha1"
+	// IngressAnnotation holds the TXT record of the annotated
+	// Ingresses, which is published for each of their hosts
+	IngressAnnotation = "txtdirect.org/record"
+	// DefaultControllerInterval is the default interval between the syncs
+	DefaultControllerInterval = 30 * time.Second
+	// DefaultControllerOwner is the default owner of the published records
+	DefaultControllerOwner = "default"
+	// ownerPrefix starts the names of the owner markers, the TXT records
+	// next to the published ones telling which controller owns them
+	ownerPrefix = "_txtdirect-owner."
+)
+
+// serviceAccountDir holds the credentials of the pods' service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Controller publishes the _redirect TXT records of the TXTRedirect
+// resources and the annotated Ingresses of a Kubernetes cluster. The
+// resources are listed every interval and only the changed records are
+// written. Like external-dns, an owner marker is published next to each
+// record, so the records of the resources removed while the controller
+// was down are deleted too and the other TXT records are never touched.
+type Controller struct {
+	// API is the Kubernetes API server's URL, Token and CAFile are
+	// the credentials used to reach it
+	API    string
+	Token  string
+	CAFile string
+	// Namespace limits the watched resources, all of the
+	// namespaces are watched when it's empty
+	Namespace string
+	// Ingresses publishes the records of the annotated Ingresses too
+	Ingresses bool
+	Interval  time.Duration
+	// Owner tells the controllers publishing to the same zone apart
+	Owner    string
+	Provider RecordProvider
+
+	client *http.Client
+}
+
+// RecordProvider reads and writes the TXT records of a DNS provider
+type RecordProvider interface {
+	// ListTXT returns the TXT records of the provider's zone by their names
+	ListTXT() (map[string][]string, error)
+	SetTXT(name, txt string) error
+	DeleteTXT(name string) error
+}
+
+// TXTRedirect is the custom resource describing a host's record
+type TXTRedirect struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec TXTRedirectSpec `json:"spec"`
+}
+
+// TXTRedirectSpec is the host and the fields of its record
+type TXTRedirectSpec struct {
+	Host string `json:"host"`
+	txtrecord.Record
+}
+
+// ingress is the part of the Ingresses the controller uses
+type ingress struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Rules []struct {
+			Host string `json:"host"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// InClusterController returns a controller using the credentials
+// of the pod's service account
+func InClusterController(provider RecordProvider) (*Controller, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, the API server's address is required")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the service account's token: %s", err.Error())
+	}
+	return &Controller{
+		API:      "https://" + net.JoinHostPort(host, port),
+		Token:    strings.TrimSpace(string(token)),
+		CAFile:   serviceAccountDir + "/ca.crt",
+		Provider: provider,
+	}, nil
+}
+
+// SetDefaults sets the default values for the controller
+// and loads the API server's CA
+func (c *Controller) SetDefaults() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("the interval should be positive, got %s", c.Interval)
+	}
+	if c.Interval == 0 {
+		c.Interval = DefaultControllerInterval
+	}
+	if c.Owner == "" {
+		c.Owner = DefaultControllerOwner
+	}
+	if c.client != nil {
+		return nil
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read the API server's CA: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("couldn't find a certificate in %s", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	c.client = &http.Client{Transport: transport, Timeout: c.Interval}
+	return nil
+}
+
+// Run syncs the records every interval until the context is done
+func (c *Controller) Run(ctx context.Context) error {
+	if err := c.SetDefaults(); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		if err := c.Sync(ctx); err != nil {
+			log.Printf("[txtdirect]: Couldn't sync the records: %s", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync writes the changed records of the resources and deletes the
+// records of the removed ones. The published records are kept when the
+// resources can't be listed, and the records the controller doesn't own
+// are never replaced or deleted.
+func (c *Controller) Sync(ctx context.Context) error {
+	if err := c.SetDefaults(); err != nil {
+		return err
+	}
+	current, err := c.Provider.ListTXT()
+	if err != nil {
+		return fmt.Errorf("couldn't list the published records: %s", err.Error())
+	}
+	published := c.owned(current)
+	desired, err := c.desiredRecords(ctx, published)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, name := range sortedNames(desired) {
+		txt := desired[name]
+		previous, owned := published[name]
+		if owned && previous == txt {
+			continue
+		}
+		if _, exists := current[name]; exists && !owned {
+			log.Printf("[txtdirect]: Skipping %s, its records aren't owned by the %s controller", name, c.Owner)
+			continue
+		}
+		// The marker is published first, so the record
+		// is never published without its owner
+		if !owned {
+			if err := c.Provider.SetTXT(ownerPrefix+name, c.ownerMarker()); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+				continue
+			}
+		}
+		if err := c.Provider.SetTXT(name, txt); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+		log.Printf("[txtdirect]: Published %s: %s", name, txt)
+	}
+	for _, name := range sortedNames(published) {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		if err := c.Provider.DeleteTXT(name); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+		if err := c.Provider.DeleteTXT(ownerPrefix + name); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+			continue
+		}
+		log.Printf("[txtdirect]: Deleted %s", name)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("couldn't update %s", strings.Join(failures, ", "))
+	}
+	return nil
+}
+
+// ownerMarker returns the value of the controller's owner markers
+func (c *Controller) ownerMarker() string {
+	return "heritage=txtdirect,owner=" + c.Owner
+}
+
+// owned returns the records owned by the controller by their names, the
+// names with an owner marker of the controller. The markers of the failed
+// syncs are kept until the records get published.
+func (c *Controller) owned(current map[string][]string) map[string]string {
+	owned := make(map[string]string)
+	for name, txts := range current {
+		if !strings.HasPrefix(name, ownerPrefix) || len(txts) != 1 || txts[0] != c.ownerMarker() {
+			continue
+		}
+		name = strings.TrimPrefix(name, ownerPrefix)
+		owned[name] = strings.Join(current[name], "")
+	}
+	return owned
+}
+
+// desiredRecords returns the records of the resources by their names. The
+// invalid resources keep their published records, the first resource by
+// namespace and name wins when several of them describe the same host.
+func (c *Controller) desiredRecords(ctx context.Context, published map[string]string) (map[string]string, error) {
+	desired := make(map[string]string)
+	owners := make(map[string]string)
+	add := func(owner, host, txt string, err error) {
+		name := txtrecord.Zone(host)
+		if err != nil {
+			log.Printf("[txtdirect]: Skipping the record of %s from %s: %s", host, owner, err.Error())
+			if txt, ok := published[name]; ok && owners[name] == "" {
+				desired[name] = txt
+			}
+			return
+		}
+		if previous, ok := owners[name]; ok && previous != owner {
+			log.Printf("[txtdirect]: Skipping the record of %s from %s, it's already set by %s", host, owner, previous)
+			return
+		}
+		desired[name], owners[name] = txt, owner
+	}
+
+	var redirects struct {
+		Items []TXTRedirect `json:"items"`
+	}
+	if err := c.list(ctx, "/apis/"+ControllerGroup+"/"+ControllerVersion, "txtredirects", &redirects); err != nil {
+		return nil, err
+	}
+	sort.Slice(redirects.Items, func(i, j int) bool {
+		return redirects.Items[i].Metadata.Namespace+"/"+redirects.Items[i].Metadata.Name <
+			redirects.Items[j].Metadata.Namespace+"/"+redirects.Items[j].Metadata.Name
+	})
+	for _, redirect := range redirects.Items {
+		owner := "txtredirect " + redirect.Metadata.Namespace + "/" + redirect.Metadata.Name
+		if redirect.Spec.Host == "" {
+			log.Printf("[txtdirect]: Skipping %s without a host", owner)
+			continue
+		}
+		add(owner, redirect.Spec.Host, redirect.Spec.String(), redirect.Spec.Validate())
+	}
+
+	if !c.Ingresses {
+		return desired, nil
+	}
+	var ingresses struct {
+		Items []ingress `json:"items"`
+	}
+	if err := c.list(ctx, "/apis/networking.k8s.io/v1", "ingresses", &ingresses); err != nil {
+		return nil, err
+	}
+	sort.Slice(ingresses.Items, func(i, j int) bool {
+		return ingresses.Items[i].Metadata.Namespace+"/"+ingresses.Items[i].Metadata.Name <
+			ingresses.Items[j].Metadata.Namespace+"/"+ingresses.Items[j].Metadata.Name
+	})
+	for _, ing := range ingresses.Items {
+		txt, ok := ing.Metadata.Annotations[IngressAnnotation]
+		if !ok {
+			continue
+		}
+		owner := "ingress " + ing.Metadata.Namespace + "/" + ing.Metadata.Name
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" || strings.HasPrefix(rule.Host, "*") {
+				continue
+			}
+			add(owner, rule.Host, txt, validateTXT(rule.Host, txt))
+		}
+	}
+	return desired, nil
+}
+
+// validateTXT makes sure the server can parse the annotated record
+func validateTXT(host, txt string) error {
+	req, err := http.NewRequest("GET", "http://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	rec := record{}
+	return rec.Parse(txt, req, Config{Enable: checkRecordTypes})
+}
+
+// list gets the resources of the API group in the controller's namespace
+func (c *Controller) list(ctx context.Context, group, resource string, v interface{}) error {
+	path := group + "/" + resource
+	if c.Namespace != "" {
+		path = group + "/namespaces/" + c.Namespace + "/" + resource
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.API, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't list the %s: %s", resource, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("couldn't list the %s: %s", resource, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("couldn't decode the %s: %s", resource, err.Error())
+	}
+	return nil
+}
+
+func sortedNames(records map[string]string) []string {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RFC2136 writes the records to a DNS server accepting
+// RFC 2136 dynamic updates, optionally signed with TSIG
+type RFC2136 struct {
+	// Server is the address of the zone's primary server
+	Server string
+	Zone   string
+	TTL    uint32
+	// KeyName, KeyAlgorithm and Secret are the TSIG key,
+	// the secret is base64 encoded
+	KeyName      string
+	KeyAlgorithm string
+	Secret       string
+	Timeout      time.Duration
+}
+
+// DefaultRFC2136TTL is the default TTL of the published records
+const DefaultRFC2136TTL = 300
+
+// SetTXT replaces the TXT records of the name with the given record
+func (p *RFC2136) SetTXT(name, txt string) error {
+	m, err := p.update(name)
+	if err != nil {
+		return err
+	}
+	m.RemoveRRset([]dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}}})
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = DefaultRFC2136TTL
+	}
+	m.Insert([]dns.RR{&dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: splitTXT(txt),
+	}})
+	return p.exchange(m)
+}
+
+// ListTXT transfers the zone and returns its TXT records
+func (p *RFC2136) ListTXT() (map[string][]string, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(p.Zone))
+	transfer := &dns.Transfer{DialTimeout: p.Timeout, ReadTimeout: p.Timeout}
+	if p.KeyName != "" {
+		transfer.TsigSecret = map[string]string{dns.Fqdn(p.KeyName): p.Secret}
+		p.sign(m)
+	}
+	envelopes, err := transfer.In(m, p.address())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[string][]string)
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, fmt.Errorf("couldn't transfer the zone: %s", envelope.Error.Error())
+		}
+		for _, rr := range envelope.RR {
+			if txt, ok := rr.(*dns.TXT); ok {
+				name := strings.ToLower(txt.Hdr.Name)
+				records[name] = append(records[name], strings.Join(txt.Txt, ""))
+			}
+		}
+	}
+	return records, nil
+}
+
+// DeleteTXT deletes the TXT records of the name
+func (p *RFC2136) DeleteTXT(name string) error {
+	m, err := p.update(name)
+	if err != nil {
+		return err
+	}
+	m.RemoveRRset([]dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET}}})
+	return p.exchange(m)
+}
+
+// update returns an update message of the zone holding the name
+func (p *RFC2136) update(name string) (*dns.Msg, error) {
+	zone := dns.Fqdn(p.Zone)
+	if !dns.IsSubDomain(zone, name) {
+		return nil, fmt.Errorf("%s isn't in the %s zone", name, zone)
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	return m, nil
+}
+
+func (p *RFC2136) exchange(m *dns.Msg) error {
+	client := &dns.Client{Net: "tcp", Timeout: p.Timeout}
+	if client.Timeout == 0 {
+		client.Timeout = dnsExchangeTimeout
+	}
+	if p.KeyName != "" {
+		client.TsigSecret = map[string]string{dns.Fqdn(p.KeyName): p.Secret}
+		p.sign(m)
+	}
+	resp, _, err := client.Exchange(m, p.address())
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("the update got refused: %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// sign adds the TSIG key's record to the message
+func (p *RFC2136) sign(m *dns.Msg) {
+	algorithm := p.KeyAlgorithm
+	if algorithm == "" {
+		algorithm = dns.HmacSHA256
+	}
+	m.SetTsig(dns.Fqdn(p.KeyName), dns.Fqdn(algorithm), 300, time.Now().Unix())
+}
+
+// address returns the server's address with the default DNS port
+func (p *RFC2136) address() string {
+	if _, _, err := net.SplitHostPort(p.Server); err != nil {
+		return net.JoinHostPort(p.Server, "53")
+	}
+	return p.Server
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testProvider keeps the records written by the controller
+type testProvider struct {
+	records map[string]string
+	fail    string
+	writes  int
+}
+
+func (p *testProvider) ListTXT() (map[string][]string, error) {
+	records := make(map[string][]string)
+	for name, txt := range p.records {
+		records[name] = []string{txt}
+	}
+	return records, nil
+}
+
+// published returns the provider's records without the owner markers
+func (p *testProvider) published() map[string]string {
+	records := make(map[string]string)
+	for name, txt := range p.records {
+		if !strings.HasPrefix(name, ownerPrefix) {
+			records[name] = txt
+		}
+	}
+	return records
+}
+
+func (p *testProvider) SetTXT(name, txt string) error {
+	if name == p.fail {
+		return fmt.Errorf("refused")
+	}
+	p.writes++
+	p.records[name] = txt
+	return nil
+}
+
+func (p *testProvider) DeleteTXT(name string) error {
+	if name == p.fail {
+		return fmt.Errorf("refused")
+	}
+	p.writes++
+	delete(p.records, name)
+	return nil
+}
+
+// testKubernetesAPI serves the given resources
+func testKubernetesAPI(resources map[string]*string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		items, ok := resources[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"items": %s}`, *items)
+	}))
+}
+
+func TestControllerSync(t *testing.T) {
+	redirects := `[
+		{"metadata": {"name": "pkg", "namespace": "default"},
+		 "spec": {"host": "go.example.com", "type": "gometa", "to": ["https://github.com/example/pkg"], "vcs": "git"}},
+		{"metadata": {"name": "www", "namespace": "default"},
+		 "spec": {"host": "www.example.com", "to": ["https://example.com/?a=b;c"], "code": 301}},
+		{"metadata": {"name": "www-copy", "namespace": "other"},
+		 "spec": {"host": "www.example.com", "to": ["https://example.org"]}},
+		{"metadata": {"name": "invalid", "namespace": "default"},
+		 "spec": {"host": "invalid.example.com", "type": "unknown"}},
+		{"metadata": {"name": "hostless", "namespace": "default"}, "spec": {"to": ["https://example.com"]}}
+	]`
+	ingresses := `[
+		{"metadata": {"name": "app", "namespace": "default", "annotations": {"txtdirect.org/record": "v=txtv0;to=https://app.example.com;type=host"}},
+		 "spec": {"rules": [{"host": "app.example.org"}, {"host": "*.example.org"}, {}]}},
+		{"metadata": {"name": "plain", "namespace": "default"}, "spec": {"rules": [{"host": "plain.example.org"}]}}
+	]`
+	empty := `[]`
+	api := testKubernetesAPI(map[string]*string{
+		"/apis/txtdirect.org/v1alpha1/txtredirects":               &redirects,
+		"/apis/networking.k8s.io/v1/ingresses":                    &ingresses,
+		"/apis/txtdirect.org/v1alpha1/namespaces/ns/txtredirects": &empty,
+	})
+	defer api.Close()
+
+	provider := &testProvider{records: make(map[string]string)}
+	controller := &Controller{API: api.URL, Token: "token", Ingresses: true, Provider: provider}
+	if err := controller.Sync(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"_redirect.go.example.com.":  "v=txtv1;type=gometa;to=https://github.com/example/pkg;vcs=git",
+		"_redirect.www.example.com.": "v=txtv1;to=https://example.com/?a%3Db%3Bc;code=301",
+		"_redirect.app.example.org.": "v=txtv0;to=https://app.example.com;type=host",
+	}
+	if !reflect.DeepEqual(provider.published(), expected) {
+		t.Fatalf("Expected the records %v, got %v", expected, provider.published())
+	}
+	for name := range expected {
+		if marker := provider.records[ownerPrefix+name]; marker != "heritage=txtdirect,owner=default" {
+			t.Errorf("Expected the owner marker of %s, got %q", name, marker)
+		}
+	}
+
+	// Only the changed records are written
+	writes := provider.writes
+	if err := controller.Sync(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if provider.writes != writes {
+		t.Errorf("Expected the unchanged records not to be written again, got %d writes", provider.writes-writes)
+	}
+
+	// The removed resources' records are deleted and the invalid
+	// resources keep their published records
+	redirects = `[
+		{"metadata": {"name": "pkg", "namespace": "default"},
+		 "spec": {"host": "go.example.com", "type": "gometa", "vcs": "cvs"}}
+	]`
+	ingresses = `[]`
+	if err := controller.Sync(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected = map[string]string{
+		"_redirect.go.example.com.": "v=txtv1;type=gometa;to=https://github.com/example/pkg;vcs=git",
+	}
+	if !reflect.DeepEqual(provider.published(), expected) {
+		t.Fatalf("Expected the records %v, got %v", expected, provider.published())
+	}
+
+	// The failed updates are retried on the next sync
+	redirects = `[]`
+	provider.fail = "_redirect.go.example.com."
+	if err := controller.Sync(context.Background()); err == nil {
+		t.Errorf("Expected the failed update to be returned")
+	}
+	provider.fail = ""
+	if err := controller.Sync(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(provider.records) != 0 {
+		t.Errorf("Expected the records and their markers to be deleted, got %v", provider.records)
+	}
+
+	// The records are kept when the resources can't be listed
+	provider.records["_redirect.kept.example.com."] = "v=txtv1;to=https://example.com"
+	provider.records[ownerPrefix+"_redirect.kept.example.com."] = "heritage=txtdirect,owner=default"
+	controller.Token = "wrong"
+	if err := controller.Sync(context.Background()); err == nil {
+		t.Errorf("Expected an error for the unauthorized controller")
+	}
+	if len(provider.records) != 2 {
+		t.Errorf("Expected the published records to be kept, got %v", provider.records)
+	}
+
+	namespaced := &Controller{API: api.URL, Token: "token", Namespace: "ns", Provider: provider}
+	if err := namespaced.Sync(context.Background()); err != nil {
+		t.Errorf("Expected the namespace's resources to be listed, got %s", err)
+	}
+}
+
+func TestControllerOwnership(t *testing.T) {
+	redirects := `[
+		{"metadata": {"name": "www", "namespace": "default"}, "spec": {"host": "www.example.com", "to": ["https://example.com"]}},
+		{"metadata": {"name": "manual", "namespace": "default"}, "spec": {"host": "manual.example.com", "to": ["https://example.com"]}}
+	]`
+	api := testKubernetesAPI(map[string]*string{"/apis/txtdirect.org/v1alpha1/txtredirects": &redirects})
+	defer api.Close()
+
+	provider := &testProvider{records: map[string]string{
+		// Managed by hand
+		"_redirect.manual.example.com.": "v=txtv0;to=https://manual.example.com;type=host",
+		"_redirect.other.example.com.":  "v=txtv0;to=https://other.example.com;type=host",
+		// Published by another controller
+		"_redirect.team.example.com.":               "v=txtv0;to=https://team.example.com;type=host",
+		ownerPrefix + "_redirect.team.example.com.": "heritage=txtdirect,owner=team",
+	}}
+	before := make(map[string]string)
+	for name, txt := range provider.records {
+		before[name] = txt
+	}
+	controller := &Controller{API: api.URL, Token: "token", Provider: provider}
+	if err := controller.Sync(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for name, txt := range before {
+		if provider.records[name] != txt {
+			t.Errorf("Expected %s not to be touched, got %q", name, provider.records[name])
+		}
+	}
+	if txt := provider.records["_redirect.www.example.com."]; txt == "" {
+		t.Errorf("Expected the record of www.example.com to be published")
+	}
+
+	// The records of the resources removed while the controller was
+	// down are deleted by the next controller using the same owner
+	redirects = `[]`
+	restarted := &Controller{API: api.URL, Token: "token", Provider: provider}
+	if err := restarted.Sync(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(provider.records, before) {
+		t.Errorf("Expected only the owned records to be deleted, got %v", provider.records)
+	}
+}
+
+func TestControllerInterval(t *testing.T) {
+	c := Controller{Provider: &testProvider{}, Interval: -time.Minute}
+	if err := c.Run(context.Background()); err == nil {
+		t.Error("Expected an error for the negative interval")
+	}
+}
+
+func TestTXTRedirectSpec(t *testing.T) {
+	var redirect TXTRedirect
+	spec := `{"metadata": {"name": "pkg"}, "spec": {"host": "go.example.com", "to": ["https://a.example.com weight=2"],
+		"headers": {"X-Served-By": ["txtdirect"]}, "preserve_method": false, "mirror": ["https://m.example.com"]}}`
+	if err := json.Unmarshal([]byte(spec), &redirect); err != nil {
+		t.Fatal(err)
+	}
+	if redirect.Spec.Host != "go.example.com" || redirect.Spec.PreserveMethod == nil || len(redirect.Spec.Mirrors) != 1 {
+		t.Fatalf("Expected the record's fields in the spec, got %+v", redirect.Spec)
+	}
+	expected := "v=txtv1;to=https://a.example.com weight%3D2;mirror=https://m.example.com;header-X-Served-By=txtdirect;preserve_method=false"
+	if txt := redirect.Spec.String(); txt != expected {
+		t.Errorf("Expected %s, got %s", expected, txt)
+	}
+}
+
+func TestRFC2136(t *testing.T) {
+	var mu sync.Mutex
+	var updates []*dns.Msg
+	secret := "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		Listener:   listener,
+		TsigSecret: map[string]string{"update.": secret},
+		// The default accept function refuses the updates
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(m)
+			if m.IsTsig() == nil || w.TsigStatus() != nil {
+				resp.Rcode = dns.RcodeRefused
+			} else if m.Question[0].Qtype == dns.TypeAXFR {
+				soa, _ := dns.NewRR("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60")
+				txt, _ := dns.NewRR(`_redirect.WWW.example.com. 300 IN TXT "v=txtv1;" "to=https://example.com"`)
+				a, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+				resp.Answer = []dns.RR{soa, txt, a, soa}
+				resp.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+			} else {
+				mu.Lock()
+				updates = append(updates, m)
+				mu.Unlock()
+				resp.SetTsig("update.", dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			w.WriteMsg(resp)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	provider := &RFC2136{Server: listener.Addr().String(), Zone: "example.com", KeyName: "update", Secret: secret}
+	txt := "v=txtv1;to=https://example.com/" + strings.Repeat("a", 300)
+	if err := provider.SetTXT("_redirect.www.example.com.", txt); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := provider.DeleteTXT("_redirect.www.example.com."); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := provider.SetTXT("_redirect.www.example.org.", txt); err == nil {
+		t.Errorf("Expected an error for the name outside of the zone")
+	}
+	unsigned := &RFC2136{Server: listener.Addr().String(), Zone: "example.com"}
+	if err := unsigned.DeleteTXT("_redirect.www.example.com."); err == nil {
+		t.Errorf("Expected the unsigned update to be refused")
+	}
+
+	records, err := provider.ListTXT()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := map[string][]string{"_redirect.www.example.com.": {"v=txtv1;to=https://example.com"}}; !reflect.DeepEqual(records, expected) {
+		t.Errorf("Expected the zone's TXT records %v, got %v", expected, records)
+	}
+	if _, err := unsigned.ListTXT(); err == nil {
+		t.Errorf("Expected the unsigned transfer to be refused")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(updates) != 2 {
+		t.Fatalf("Expected 2 updates, got %d", len(updates))
+	}
+	if updates[0].Question[0].Name != "example.com." || updates[0].Opcode != dns.OpcodeUpdate {
+		t.Errorf("Expected an update of the example.com. zone, got %s", updates[0].Question[0].Name)
+	}
+	inserted, ok := updates[0].Ns[1].(*dns.TXT)
+	if !ok || strings.Join(inserted.Txt, "") != txt || len(inserted.Txt) != 2 || inserted.Hdr.Ttl != DefaultRFC2136TTL {
+		t.Errorf("Expected the record to be inserted as 2 strings, got %v", updates[0].Ns)
+	}
+	if removed := updates[1].Ns[0]; removed.Header().Class != dns.ClassANY || removed.Header().Name != "_redirect.www.example.com." {
+		t.Errorf("Expected the record to be removed, got %v", removed)
+	}
+}
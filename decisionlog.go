@@ -0,0 +1,214 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DecisionLog contains the configuration of the decision log. It writes a
+// JSON line with a fixed schema for every sampled redirect decision, apart
+// from the access log, so the decisions can be loaded into the analytics
+// databases cheaply.
+type DecisionLog struct {
+	Enable bool
+	Output string
+	// SampleRatio is the ratio of the decisions written
+	SampleRatio float64
+	// SampleBy is request, host or client. The decisions get sampled
+	// per request or all of the decisions of the sampled hosts or
+	// clients get written.
+	SampleBy string
+	// Keep lists the decisions written regardless of the sampling,
+	// fallbacks and errors
+	Keep []string
+	// Sink batches the decisions into a data warehouse
+	Sink DecisionSink
+
+	logger *jsonLogger
+}
+
+// decision is a line of the decision log
+type decision struct {
+	Time     string `json:"time"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Zone     string `json:"zone"`
+	Type     string `json:"type"`
+	Record   string `json:"record"`
+	Target   string `json:"target"`
+	Status   int    `json:"status"`
+	Fallback string `json:"fallback"`
+	Cached   bool   `json:"cached"`
+	Error    string `json:"error"`
+	// SampleRatio is the ratio the decision got sampled with, the
+	// decisions kept regardless of the sampling have 1. Weighting the
+	// decisions by its inverse estimates the totals.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+const (
+	DefaultDecisionLogSampleRatio = 1.0
+	DefaultDecisionLogSampleBy    = "request"
+)
+
+// SetDefaults sets the default values for decision log config
+// if the fields are empty
+func (d *DecisionLog) SetDefaults() {
+	// The decisions are only written to stdout by default without a sink
+	if d.Output == "" && !d.Sink.Enable {
+		d.Output = "stdout"
+	}
+	if d.SampleRatio == 0 {
+		d.SampleRatio = DefaultDecisionLogSampleRatio
+	}
+	if d.SampleBy == "" {
+		d.SampleBy = DefaultDecisionLogSampleBy
+	}
+	if d.logger == nil && d.Output != "" {
+		d.logger = newJSONLogger(d.Output)
+	}
+	if d.Sink.Enable {
+		d.Sink.SetDefaults()
+	}
+}
+
+// sampled checks if the request's decision falls in the sample
+func (d *DecisionLog) sampled(r *http.Request) bool {
+	if d.SampleRatio >= 1 {
+		return true
+	}
+	var key string
+	switch d.SampleBy {
+	case "host":
+		key = canonicalHost(r.Host)
+	case "client":
+		key = clientIP(r)
+	default:
+		return rand.Float64() < d.SampleRatio
+	}
+	// Hashing the key keeps the same hosts or clients in the sample
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return float64(hash.Sum64()>>11) < d.SampleRatio*(1<<53)
+}
+
+// log writes the request's decision if it's sampled or kept
+func (d *DecisionLog) log(r *http.Request, info *requestInfo, target string, status int, err error) {
+	if d.logger == nil && d.Sink.queue == nil {
+		return
+	}
+	ratio := d.SampleRatio
+	if (info.Fallback != "" && contains(d.Keep, "fallbacks")) || (err != nil && contains(d.Keep, "errors")) {
+		ratio = 1
+	} else if !d.sampled(r) {
+		return
+	}
+
+	entry := decision{
+		Time:        time.Now().UTC().Format(time.RFC3339Nano),
+		Host:        r.Host,
+		Path:        r.URL.Path,
+		Zone:        info.Zone,
+		Type:        info.Type,
+		Target:      target,
+		Status:      status,
+		Fallback:    info.Fallback,
+		Cached:      info.RecordCached,
+		SampleRatio: ratio,
+	}
+	if len(info.Records) > 0 {
+		entry.Record = info.Records[len(info.Records)-1].TXT
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if d.logger != nil {
+		d.logger.log(entry)
+	}
+	if d.Sink.queue != nil {
+		d.Sink.enqueue(entry)
+	}
+}
+
+// ParseDecisionLog parses the txtdirect config for the decision log
+func (d *DecisionLog) ParseDecisionLog(c Dispenser) error {
+	switch c.Val() {
+	case "output":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		d.Output = args[0]
+
+	case "sample_ratio":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.ParseFloat(args[0], 64)
+		if err != nil || value <= 0 || value > 1 {
+			return fmt.Errorf("The given value for sample_ratio field is not standard. It should be a number between 0 and 1")
+		}
+		d.SampleRatio = value
+
+	case "sample_by":
+		args := c.RemainingArgs()
+		if len(args) != 1 || !contains([]string{"request", "host", "client"}, args[0]) {
+			return fmt.Errorf("The given value for sample_by field is not standard. It should be request, host or client")
+		}
+		d.SampleBy = args[0]
+
+	case "keep":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, kind := range args {
+			if kind != "fallbacks" && kind != "errors" {
+				return fmt.Errorf("The given value for keep field is not standard. It should be fallbacks or errors")
+			}
+		}
+		d.Keep = append(d.Keep, args...)
+
+	case "sink":
+		args := c.RemainingArgs()
+		if len(args) != 1 || (args[0] != "clickhouse" && args[0] != "bigquery") {
+			return fmt.Errorf("The given value for sink field is not standard. It should be clickhouse or bigquery")
+		}
+		d.Sink.Enable = true
+		d.Sink.Type = args[0]
+		c.NextArg()
+		if c.Val() != "{" {
+			break
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			if err := d.Sink.ParseDecisionSink(c); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for decisionlog
+	}
+	return nil
+}
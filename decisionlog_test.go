@@ -0,0 +1,182 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestDecisionLog(t *testing.T) {
+	tests := []struct {
+		url      string
+		ratio    float64
+		keep     []string
+		expected *decision
+	}{
+		{
+			"https://healthy.health.test/path",
+			1,
+			nil,
+			&decision{
+				Host:        "healthy.health.test",
+				Path:        "/path",
+				Zone:        "_redirect.healthy.health.test.",
+				Type:        "host",
+				Record:      txts["_redirect.healthy.health.test."],
+				Target:      "https://healthy.target.test/path",
+				Status:      302,
+				SampleRatio: 1,
+			},
+		},
+		{"https://healthy.health.test/path", 0.000001, nil, nil},
+		{"https://nonexistent.decisions.test/", 0.000001, nil, nil},
+		{
+			"https://nonexistent.decisions.test/",
+			0.000001,
+			[]string{"fallbacks"},
+			&decision{
+				Host:        "nonexistent.decisions.test",
+				Path:        "/",
+				Target:      "https://fallback.example.com",
+				Status:      301,
+				Fallback:    "redirect",
+				SampleRatio: 1,
+			},
+		},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Redirect: "https://fallback.example.com",
+			DecisionLog: DecisionLog{
+				Enable:      true,
+				SampleRatio: test.ratio,
+				SampleBy:    "host",
+				Keep:        test.keep,
+				logger:      &jsonLogger{encoder: json.NewEncoder(&buf)},
+			},
+		}
+
+		w := httptest.NewRecorder()
+		if err := serve(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if test.expected == nil {
+			if buf.Len() != 0 {
+				t.Errorf("Test %d: Expected the decision to be left out of the sample, got %s", i, buf.String())
+			}
+			continue
+		}
+
+		var entry decision
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Errorf("Test %d: Couldn't decode the decision %q: %s", i, buf.String(), err)
+			continue
+		}
+		if entry.Time == "" {
+			t.Errorf("Test %d: Expected the time to be logged", i)
+		}
+		entry.Time = ""
+		if !reflect.DeepEqual(entry, *test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, *test.expected, entry)
+		}
+	}
+}
+
+func TestDecisionLogSampleBy(t *testing.T) {
+	d := DecisionLog{SampleRatio: 0.5, SampleBy: "host"}
+	hosts := 0
+	for n := 0; n < 1000; n++ {
+		host := fmt.Sprintf("host%d.example.com", n)
+		sampled := d.sampled(httptest.NewRequest("GET", "https://"+host+"/", nil))
+		// The same host stays in or out of the sample
+		for _, path := range []string{"/a", "/b"} {
+			if d.sampled(httptest.NewRequest("GET", "https://"+strings.ToUpper(host)+path, nil)) != sampled {
+				t.Fatalf("Expected the sampling of %s to be consistent", host)
+			}
+		}
+		if sampled {
+			hosts++
+		}
+	}
+	if hosts < 400 || hosts > 600 {
+		t.Errorf("Expected about half of the hosts to be sampled, got %d", hosts)
+	}
+}
+
+func TestParseDecisionLog(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  DecisionLog
+		shouldErr bool
+	}{
+		{
+			"decisionlog",
+			DecisionLog{Enable: true, Output: "stdout", SampleRatio: 1, SampleBy: "request"},
+			false,
+		},
+		{
+			`decisionlog /var/log/txtdirect/decisions.log {
+				sample_ratio 0.01
+				sample_by client
+				keep fallbacks errors
+			}`,
+			DecisionLog{Enable: true, Output: "/var/log/txtdirect/decisions.log", SampleRatio: 0.01, SampleBy: "client", Keep: []string{"fallbacks", "errors"}},
+			false,
+		},
+		{"decisionlog { sample_ratio 0 }", DecisionLog{}, true},
+		{"decisionlog { sample_ratio 2 }", DecisionLog{}, true},
+		{"decisionlog { sample_by zone }", DecisionLog{}, true},
+		{"decisionlog { keep redirects }", DecisionLog{}, true},
+		{"decisionlog { format csv }", DecisionLog{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.DecisionLog.logger == nil {
+			t.Errorf("Test %d: Expected the logger to be created", i)
+		}
+		conf.DecisionLog.logger = nil
+		if !reflect.DeepEqual(conf.DecisionLog, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.DecisionLog)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DecisionSink batches the decision log's lines into ClickHouse or
+// BigQuery. The table is created on the first flush if it's missing.
+// The decisions are dropped when the queue is full, so a slow warehouse
+// can't hold up the requests.
+type DecisionSink struct {
+	Enable bool
+	// Type is clickhouse or bigquery
+	Type string
+	// Endpoint is the ClickHouse HTTP interface or the BigQuery API
+	Endpoint string
+	// Project is the BigQuery project
+	Project string
+	// Database is the ClickHouse database or the BigQuery dataset
+	Database string
+	Table    string
+	User     string
+	Password string
+	// TokenFile holds the BigQuery OAuth access token, it's read on
+	// every flush so it can be refreshed by other tools. The token
+	// of the instance's service account is used if it's empty.
+	TokenFile     string
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	Retries       int
+
+	queue *decisionQueue
+}
+
+// decisionQueue holds the decisions waiting for the next batch
+type decisionQueue struct {
+	sync.Mutex
+	decisions chan decision
+	stop      chan struct{}
+	done      chan struct{}
+	schema    bool
+	metrics   bool
+	client    *http.Client
+
+	// token is the cached BigQuery access token
+	token        string
+	tokenExpires time.Time
+}
+
+const (
+	DefaultDecisionSinkBatchSize     = 500
+	DefaultDecisionSinkFlushInterval = 5 * time.Second
+	DefaultDecisionSinkQueueSize     = 10000
+	DefaultDecisionSinkRetries       = 3
+	DefaultDecisionSinkTable         = "txtdirect_decisions"
+	DefaultClickHouseEndpoint        = "http://127.0.0.1:8123"
+	DefaultBigQueryEndpoint          = "https://bigquery.googleapis.com/bigquery/v2"
+)
+
+// decisionSinkBackoff is the delay before the first retry of a batch
+var decisionSinkBackoff = 500 * time.Millisecond
+
+// metadataTokenURL returns the access token of the instance's service account
+var metadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// decisionColumns are the columns of the decisions
+// table with their ClickHouse and BigQuery types
+var decisionColumns = []struct {
+	Name       string
+	ClickHouse string
+	BigQuery   string
+}{
+	{"time", "DateTime64(3)", "TIMESTAMP"},
+	{"host", "LowCardinality(String)", "STRING"},
+	{"path", "String", "STRING"},
+	{"zone", "String", "STRING"},
+	{"type", "LowCardinality(String)", "STRING"},
+	{"record", "String", "STRING"},
+	{"target", "String", "STRING"},
+	{"status", "UInt16", "INTEGER"},
+	{"fallback", "LowCardinality(String)", "STRING"},
+	{"cached", "Bool", "BOOLEAN"},
+	{"error", "String", "STRING"},
+	{"sample_ratio", "Float64", "FLOAT"},
+}
+
+// SetDefaults sets the default values for decision sink config
+// if the fields are empty
+func (s *DecisionSink) SetDefaults() {
+	if s.Endpoint == "" {
+		if s.Type == "bigquery" {
+			s.Endpoint = DefaultBigQueryEndpoint
+		} else {
+			s.Endpoint = DefaultClickHouseEndpoint
+		}
+	}
+	s.Endpoint = strings.TrimSuffix(s.Endpoint, "/")
+	if s.Database == "" && s.Type == "clickhouse" {
+		s.Database = "default"
+	}
+	if s.Table == "" {
+		s.Table = DefaultDecisionSinkTable
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = DefaultDecisionSinkBatchSize
+	}
+	if s.FlushInterval == 0 {
+		s.FlushInterval = DefaultDecisionSinkFlushInterval
+	}
+	if s.QueueSize == 0 {
+		s.QueueSize = DefaultDecisionSinkQueueSize
+	}
+	if s.Retries == 0 {
+		s.Retries = DefaultDecisionSinkRetries
+	}
+	if s.queue == nil {
+		s.queue = &decisionQueue{
+			decisions: make(chan decision, s.QueueSize),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}
+	}
+}
+
+// enqueue adds the decision to the next batch,
+// the decision is dropped if the queue is full
+func (s *DecisionSink) enqueue(entry decision) {
+	select {
+	case s.queue.decisions <- entry:
+	default:
+		if s.queue.metrics {
+			DecisionSinkRows.WithLabelValues(s.Type, "dropped").Add(1)
+		}
+	}
+}
+
+// Start sends the queued decisions in batches
+func (s *DecisionSink) Start() error {
+	s.queue.Lock()
+	defer s.queue.Unlock()
+	if s.queue.stop != nil {
+		return nil
+	}
+	s.queue.stop = make(chan struct{})
+	s.queue.done = make(chan struct{})
+	go s.run(s.queue.stop, s.queue.done)
+	return nil
+}
+
+// Stop sends the queued decisions and stops the batching
+func (s *DecisionSink) Stop() error {
+	s.queue.Lock()
+	stop, done := s.queue.stop, s.queue.done
+	s.queue.stop = nil
+	s.queue.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-done
+	return nil
+}
+
+func (s *DecisionSink) run(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]decision, 0, s.BatchSize)
+	for {
+		select {
+		case entry := <-s.queue.decisions:
+			batch = append(batch, entry)
+			if len(batch) < s.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-stop:
+			// Drain the queue before stopping
+			for {
+				select {
+				case entry := <-s.queue.decisions:
+					batch = append(batch, entry)
+					if len(batch) == s.BatchSize {
+						s.flush(batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			s.flush(batch)
+			return
+		}
+		s.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush inserts the batch, retrying the failures with a backoff
+func (s *DecisionSink) flush(batch []decision) {
+	if len(batch) == 0 {
+		return
+	}
+	// The retries reuse the insert IDs so BigQuery can
+	// drop the rows of the inserts which did go through
+	var ids []string
+	if s.Type == "bigquery" {
+		ids = insertIDs(len(batch))
+	}
+	var err error
+	backoff := decisionSinkBackoff
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = s.insert(batch, ids); err == nil || !retryableSinkError(err) {
+			break
+		}
+		log.Printf("[txtdirect]: Couldn't insert %d decisions into %s, retrying: %s", len(batch), s.Type, err.Error())
+	}
+
+	result := "inserted"
+	if err != nil {
+		result = "failed"
+		log.Printf("[txtdirect]: Dropped %d decisions, couldn't insert them into %s: %s", len(batch), s.Type, err.Error())
+	}
+	if s.queue.metrics {
+		DecisionSinkRows.WithLabelValues(s.Type, result).Add(float64(len(batch)))
+	}
+}
+
+// sinkError is returned when the warehouse rejects a request
+type sinkError struct {
+	Status int
+	Body   string
+}
+
+func (e *sinkError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Body)
+}
+
+// retryableSinkError checks if the insert is worth retrying, the
+// rejected rows and schemas would be rejected again
+func retryableSinkError(err error) bool {
+	if e, ok := err.(*sinkError); ok {
+		return e.Status == http.StatusTooManyRequests || e.Status >= 500
+	}
+	return true
+}
+
+// insertIDs returns n random insert IDs for the BigQuery rows
+func insertIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = strconv.FormatUint(rand.Uint64(), 36)
+	}
+	return ids
+}
+
+// insert creates the table if needed and inserts the batch, the
+// BigQuery rows get the given insert IDs
+func (s *DecisionSink) insert(batch []decision, ids []string) error {
+	if !s.queue.schema {
+		if err := s.createTable(); err != nil {
+			return fmt.Errorf("couldn't create the table: %s", err.Error())
+		}
+		s.queue.schema = true
+	}
+	if s.Type == "bigquery" {
+		return s.insertBigQuery(batch, ids)
+	}
+	return s.insertClickHouse(batch)
+}
+
+// createTable creates the decisions table if it doesn't exist
+func (s *DecisionSink) createTable() error {
+	if s.Type == "bigquery" {
+		fields := make([]map[string]string, 0, len(decisionColumns))
+		for _, column := range decisionColumns {
+			fields = append(fields, map[string]string{"name": column.Name, "type": column.BigQuery})
+		}
+		table := map[string]interface{}{
+			"tableReference":   map[string]string{"projectId": s.Project, "datasetId": s.Database, "tableId": s.Table},
+			"schema":           map[string]interface{}{"fields": fields},
+			"timePartitioning": map[string]string{"type": "DAY", "field": "time"},
+		}
+		err := s.postBigQuery(fmt.Sprintf("/projects/%s/datasets/%s/tables", s.Project, s.Database), table, nil)
+		if e, ok := err.(*sinkError); ok && e.Status == http.StatusConflict {
+			// The table already exists
+			return nil
+		}
+		return err
+	}
+
+	columns := make([]string, 0, len(decisionColumns))
+	for _, column := range decisionColumns {
+		columns = append(columns, column.Name+" "+column.ClickHouse)
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s.%s (%s) ENGINE = MergeTree PARTITION BY toDate(time) ORDER BY (host, time)",
+		s.Database, s.Table, strings.Join(columns, ", "))
+	return s.postClickHouse(url.Values{"query": {query}}, strings.NewReader(""))
+}
+
+// insertClickHouse inserts the batch as JSON lines
+func (s *DecisionSink) insertClickHouse(batch []decision) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, entry := range batch {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	params := url.Values{
+		"query":                  {fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", s.Database, s.Table)},
+		"date_time_input_format": {"best_effort"},
+	}
+	return s.postClickHouse(params, &body)
+}
+
+func (s *DecisionSink) postClickHouse(params url.Values, body io.Reader) error {
+	req, err := http.NewRequest("POST", s.Endpoint+"/?"+params.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if s.User != "" {
+		req.Header.Set("X-ClickHouse-User", s.User)
+		req.Header.Set("X-ClickHouse-Key", s.Password)
+	}
+	resp, err := s.queue.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return &sinkError{Status: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	return nil
+}
+
+// bigQueryRow is a row of the BigQuery streaming inserts
+type bigQueryRow struct {
+	// InsertID lets BigQuery drop the rows of the retried inserts
+	InsertID string   `json:"insertId"`
+	JSON     decision `json:"json"`
+}
+
+// insertBigQuery streams the batch into the table
+func (s *DecisionSink) insertBigQuery(batch []decision, ids []string) error {
+	rows := make([]bigQueryRow, 0, len(batch))
+	for i, entry := range batch {
+		rows = append(rows, bigQueryRow{InsertID: ids[i], JSON: entry})
+	}
+	var result struct {
+		InsertErrors []struct {
+			Index  int `json:"index"`
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	err := s.postBigQuery(fmt.Sprintf("/projects/%s/datasets/%s/tables/%s/insertAll", s.Project, s.Database, s.Table),
+		map[string]interface{}{"rows": rows}, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.InsertErrors) > 0 {
+		failure := result.InsertErrors[0]
+		message := "unknown error"
+		if len(failure.Errors) > 0 {
+			message = failure.Errors[0].Message
+		}
+		return &sinkError{Status: http.StatusBadRequest, Body: fmt.Sprintf("%d rows rejected, row %d: %s", len(result.InsertErrors), failure.Index, message)}
+	}
+	return nil
+}
+
+func (s *DecisionSink) postBigQuery(path string, body, result interface{}) error {
+	token, err := s.bigQueryToken()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.queue.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &sinkError{Status: resp.StatusCode, Body: strings.TrimSpace(string(data))}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// bigQueryToken returns the access token from the token file
+// or the instance's service account
+func (s *DecisionSink) bigQueryToken() (string, error) {
+	if s.TokenFile != "" {
+		token, err := ioutil.ReadFile(s.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("couldn't read the token file: %s", err.Error())
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	if s.queue.token != "" && time.Now().Before(s.queue.tokenExpires) {
+		return s.queue.token, nil
+	}
+
+	req, err := http.NewRequest("GET", metadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := s.queue.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get the service account's token: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("couldn't get the service account's token: status %d", resp.StatusCode)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("couldn't parse the service account's token: %s", err.Error())
+	}
+	// Refresh the token a minute before it expires
+	s.queue.token = token.AccessToken
+	s.queue.tokenExpires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return s.queue.token, nil
+}
+
+// ParseDecisionSink parses the txtdirect config for the decision sink
+func (s *DecisionSink) ParseDecisionSink(c Dispenser) error {
+	switch c.Val() {
+	case "endpoint":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.Endpoint = args[0]
+
+	case "project":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.Project = args[0]
+
+	case "database", "dataset":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.Database = args[0]
+
+	case "table":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.Table = args[0]
+
+	case "user":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.User = args[0]
+
+	case "password":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.Password = args[0]
+
+	case "token_file":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.TokenFile = args[0]
+
+	case "batch_size":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for batch_size field is not standard. It should be a positive integer")
+		}
+		s.BatchSize = value
+
+	case "queue_size":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for queue_size field is not standard. It should be a positive integer")
+		}
+		s.QueueSize = value
+
+	case "retries":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for retries field is not standard. It should be a positive integer")
+		}
+		s.Retries = value
+
+	case "flush_interval":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := time.ParseDuration(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for flush_interval field is not standard. It should be a positive duration")
+		}
+		s.FlushInterval = value
+
+	default:
+		return c.ArgErr() // unhandled option for sink
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// fakeWarehouse records the requests of the decision sinks
+type fakeWarehouse struct {
+	sync.Mutex
+	queries []string
+	rows    int
+	// failures is the number of inserts answered with failStatus
+	failures   int
+	failStatus int
+	// insertIDs holds the insert IDs of each BigQuery insert
+	insertIDs [][]string
+}
+
+func (f *fakeWarehouse) clickhouse(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	query := r.URL.Query().Get("query")
+	f.queries = append(f.queries, strings.Fields(query)[0])
+	if strings.HasPrefix(query, "INSERT") {
+		if f.failures > 0 {
+			f.failures--
+			http.Error(w, "Code: 202. DB::Exception: Too many simultaneous queries", f.failStatus)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var entry decision
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Host == "" {
+				http.Error(w, "Cannot parse input", http.StatusBadRequest)
+				return
+			}
+			f.rows++
+		}
+	}
+}
+
+func (f *fakeWarehouse) bigquery(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.queries = append(f.queries, r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/tables") {
+		http.Error(w, "Already Exists: Table", http.StatusConflict)
+		return
+	}
+	var body struct {
+		Rows []bigQueryRow `json:"rows"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	var ids []string
+	for _, row := range body.Rows {
+		ids = append(ids, row.InsertID)
+	}
+	f.insertIDs = append(f.insertIDs, ids)
+	if f.failures > 0 && f.failStatus != 0 {
+		f.failures--
+		http.Error(w, "Backend Error", f.failStatus)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		fmt.Fprint(w, `{"insertErrors":[{"index":0,"errors":[{"message":"no such field"}]}]}`)
+		return
+	}
+	f.rows += len(body.Rows)
+	fmt.Fprint(w, `{}`)
+}
+
+// sinkDecisions returns n decisions to send to the sinks
+func sinkDecisions(n int) []decision {
+	decisions := make([]decision, n)
+	for i := range decisions {
+		decisions[i] = decision{
+			Time:        time.Now().UTC().Format(time.RFC3339Nano),
+			Host:        fmt.Sprintf("host%d.example.com", i),
+			Status:      302,
+			SampleRatio: 1,
+		}
+	}
+	return decisions
+}
+
+func TestDecisionSinkClickHouse(t *testing.T) {
+	decisionSinkBackoff = time.Millisecond
+	tests := []struct {
+		failures   int
+		failStatus int
+		rows       int
+		queries    []string
+	}{
+		{0, 0, 5, []string{"CREATE", "INSERT", "INSERT", "INSERT"}},
+		{2, http.StatusServiceUnavailable, 5, []string{"CREATE", "INSERT", "INSERT", "INSERT", "INSERT", "INSERT"}},
+		// The rejected rows aren't retried
+		{1, http.StatusBadRequest, 3, []string{"CREATE", "INSERT", "INSERT", "INSERT"}},
+	}
+	for i, test := range tests {
+		warehouse := &fakeWarehouse{failures: test.failures, failStatus: test.failStatus}
+		server := httptest.NewServer(http.HandlerFunc(warehouse.clickhouse))
+
+		sink := DecisionSink{Enable: true, Type: "clickhouse", Endpoint: server.URL, BatchSize: 2, FlushInterval: time.Hour}
+		sink.SetDefaults()
+		for _, entry := range sinkDecisions(5) {
+			sink.enqueue(entry)
+		}
+		sink.Start()
+		sink.Stop()
+		server.Close()
+
+		if warehouse.rows != test.rows {
+			t.Errorf("Test %d: Expected %d rows to be inserted, got %d", i, test.rows, warehouse.rows)
+		}
+		if !reflect.DeepEqual(warehouse.queries, test.queries) {
+			t.Errorf("Test %d: Expected the queries %v, got %v", i, test.queries, warehouse.queries)
+		}
+	}
+}
+
+func TestDecisionSinkBigQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	warehouse := &fakeWarehouse{}
+	server := httptest.NewServer(http.HandlerFunc(warehouse.bigquery))
+	defer server.Close()
+
+	sink := DecisionSink{
+		Enable:        true,
+		Type:          "bigquery",
+		Endpoint:      server.URL,
+		Project:       "project",
+		Database:      "analytics",
+		TokenFile:     tokenFile,
+		FlushInterval: 10 * time.Millisecond,
+	}
+	sink.SetDefaults()
+	sink.Start()
+	for _, entry := range sinkDecisions(3) {
+		sink.enqueue(entry)
+	}
+	time.Sleep(50 * time.Millisecond)
+	sink.Stop()
+
+	expected := []string{
+		"/projects/project/datasets/analytics/tables",
+		"/projects/project/datasets/analytics/tables/txtdirect_decisions/insertAll",
+	}
+	if warehouse.rows != 3 {
+		t.Errorf("Expected 3 rows to be inserted, got %d", warehouse.rows)
+	}
+	if len(warehouse.queries) < 2 || !reflect.DeepEqual(warehouse.queries[:2], expected) {
+		t.Errorf("Expected the requests %v, got %v", expected, warehouse.queries)
+	}
+
+	// The rows rejected by BigQuery are dropped
+	warehouse.failures = 1
+	if err := sink.insert(sinkDecisions(1), insertIDs(1)); err == nil || retryableSinkError(err) {
+		t.Errorf("Expected the rejected rows to fail without retries, got %v", err)
+	}
+}
+
+func TestDecisionSinkBigQueryRetry(t *testing.T) {
+	decisionSinkBackoff = time.Millisecond
+	dir, err := ioutil.TempDir("", "txtdirect-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	warehouse := &fakeWarehouse{failures: 1, failStatus: http.StatusServiceUnavailable}
+	server := httptest.NewServer(http.HandlerFunc(warehouse.bigquery))
+	defer server.Close()
+
+	sink := DecisionSink{Enable: true, Type: "bigquery", Endpoint: server.URL, Project: "project", Database: "analytics", TokenFile: tokenFile}
+	sink.SetDefaults()
+	sink.flush(sinkDecisions(3))
+
+	if len(warehouse.insertIDs) != 2 {
+		t.Fatalf("Expected the insert to be retried once, got %d inserts", len(warehouse.insertIDs))
+	}
+	// The retried rows keep their insert IDs so BigQuery drops the duplicates
+	if !reflect.DeepEqual(warehouse.insertIDs[0], warehouse.insertIDs[1]) || len(warehouse.insertIDs[0]) != 3 {
+		t.Errorf("Expected the retry to reuse the insert IDs, got %v", warehouse.insertIDs)
+	}
+}
+
+func TestDecisionSinkBackpressure(t *testing.T) {
+	sink := DecisionSink{Enable: true, Type: "clickhouse", QueueSize: 2}
+	sink.SetDefaults()
+	for _, entry := range sinkDecisions(5) {
+		sink.enqueue(entry)
+	}
+	if len(sink.queue.decisions) != 2 {
+		t.Errorf("Expected the decisions over the queue size to be dropped, got %d queued", len(sink.queue.decisions))
+	}
+}
+
+func TestParseDecisionSink(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  DecisionSink
+		shouldErr bool
+	}{
+		{
+			"sink clickhouse",
+			DecisionSink{
+				Enable: true, Type: "clickhouse", Endpoint: DefaultClickHouseEndpoint, Database: "default",
+				Table: DefaultDecisionSinkTable, BatchSize: DefaultDecisionSinkBatchSize, FlushInterval: DefaultDecisionSinkFlushInterval,
+				QueueSize: DefaultDecisionSinkQueueSize, Retries: DefaultDecisionSinkRetries,
+			},
+			false,
+		},
+		{
+			`sink clickhouse {
+				endpoint https://clickhouse.example.com:8443/
+				database analytics
+				table decisions
+				user txtdirect
+				password secret
+				batch_size 1000
+				flush_interval 10s
+				queue_size 50000
+				retries 5
+			}`,
+			DecisionSink{
+				Enable: true, Type: "clickhouse", Endpoint: "https://clickhouse.example.com:8443", Database: "analytics",
+				Table: "decisions", User: "txtdirect", Password: "secret", BatchSize: 1000, FlushInterval: 10 * time.Second,
+				QueueSize: 50000, Retries: 5,
+			},
+			false,
+		},
+		{
+			`sink bigquery {
+				project example
+				dataset analytics
+				token_file /run/secrets/bigquery-token
+			}`,
+			DecisionSink{
+				Enable: true, Type: "bigquery", Endpoint: DefaultBigQueryEndpoint, Project: "example", Database: "analytics",
+				Table: DefaultDecisionSinkTable, TokenFile: "/run/secrets/bigquery-token", BatchSize: DefaultDecisionSinkBatchSize,
+				FlushInterval: DefaultDecisionSinkFlushInterval, QueueSize: DefaultDecisionSinkQueueSize, Retries: DefaultDecisionSinkRetries,
+			},
+			false,
+		},
+		{"sink bigquery { project example }", DecisionSink{}, true},
+		{"sink kafka", DecisionSink{}, true},
+		{"sink clickhouse { batch_size 0 }", DecisionSink{}, true},
+		{"sink clickhouse { flush_interval soon }", DecisionSink{}, true},
+		{"sink clickhouse { compression gzip }", DecisionSink{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			decisionlog {
+				%s
+			}
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.DecisionLog.Output != "" || conf.DecisionLog.logger != nil {
+			t.Errorf("Test %d: Expected the decisions to only go to the sink, got the output %q", i, conf.DecisionLog.Output)
+		}
+		if conf.DecisionLog.Sink.queue == nil {
+			t.Errorf("Test %d: Expected the queue to be created", i)
+		}
+		conf.DecisionLog.Sink.queue = nil
+		if !reflect.DeepEqual(conf.DecisionLog.Sink, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.DecisionLog.Sink)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Defaults holds the record fields merged into the records under the
+// configured zones, so the records can leave out the shared fields
+type Defaults struct {
+	// Zones maps the domains to their default record fields
+	Zones map[string][]string
+}
+
+// ParseDefaults parses a token of a defaults block, the fields can be
+// separated by spaces, semicolons or newlines
+func (d *Defaults) ParseDefaults(zone string, c Dispenser) error {
+	zone = canonicalHost(zone)
+	for _, field := range strings.Split(c.Val(), ";") {
+		if field == "" {
+			continue
+		}
+		key := fieldKey(field)
+		if key == "" || key == field || key == "parts" {
+			return fmt.Errorf("The given value for defaults field is not standard. It should be a key=value record field other than parts")
+		}
+		if d.Zones == nil {
+			d.Zones = make(map[string][]string)
+		}
+		d.Zones[zone] = append(d.Zones[zone], field)
+	}
+	return nil
+}
+
+// fieldKey returns the key of the given record field
+func fieldKey(field string) string {
+	return strings.SplitN(field, "=", 2)[0]
+}
+
+// merge appends the default fields of the zones covering the given host
+// or zone to the record. The fields of the record win over the defaults,
+// and the defaults of the more specific zones win over the others. The
+// fields with the given keys are skipped.
+func (d Defaults) merge(host, txt string, skip ...string) string {
+	if len(d.Zones) == 0 {
+		return txt
+	}
+	host = strings.TrimPrefix(canonicalHost(host), basezone+".")
+	var zones []string
+	for zone := range d.Zones {
+		if host == zone || strings.HasSuffix(host, "."+zone) {
+			zones = append(zones, zone)
+		}
+	}
+	if len(zones) == 0 {
+		return txt
+	}
+	sort.Slice(zones, func(i, j int) bool { return len(zones[i]) > len(zones[j]) })
+
+	keys := map[string]bool{}
+	for _, key := range skip {
+		keys[key] = true
+	}
+	fields := []string{strings.TrimSuffix(txt, ";")}
+	for _, field := range strings.Split(txt, ";") {
+		keys[fieldKey(field)] = true
+	}
+	for _, zone := range zones {
+		var merged []string
+		for _, field := range d.Zones[zone] {
+			if !keys[fieldKey(field)] {
+				fields = append(fields, field)
+				merged = append(merged, fieldKey(field))
+			}
+		}
+		// A zone can have several fields with the same key
+		for _, key := range merged {
+			keys[key] = true
+		}
+	}
+	return strings.Join(fields, ";")
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestParseDefaults(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  map[string][]string
+		shouldErr bool
+	}{
+		{
+			"defaults example.com { code=302; type=path }",
+			map[string][]string{"example.com": {"code=302", "type=path"}},
+			false,
+		},
+		{
+			`defaults Example.com {
+				code=302
+				header-X-Frame-Options=DENY;noindex=true
+			}
+			defaults sub.example.com {
+				code=301
+			}`,
+			map[string][]string{
+				"example.com":     {"code=302", "header-X-Frame-Options=DENY", "noindex=true"},
+				"sub.example.com": {"code=301"},
+			},
+			false,
+		},
+		{"defaults example.com { code }", nil, true},
+		{"defaults example.com { parts=2 }", nil, true},
+		{"defaults { code=302 }", nil, true},
+		{"defaults example.com code=302", nil, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host path
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf.Defaults.Zones, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, conf.Defaults.Zones)
+		}
+	}
+}
+
+func TestDefaultsMerge(t *testing.T) {
+	d := Defaults{Zones: map[string][]string{
+		"example.com":     {"code=302", "type=path", "header-X-A=1"},
+		"sub.example.com": {"code=301", "to=https://a.example.com", "to=https://b.example.com"},
+	}}
+	tests := []struct {
+		host     string
+		txt      string
+		skip     []string
+		expected string
+	}{
+		{"example.com", "v=txtv0;to=https://example.net", nil, "v=txtv0;to=https://example.net;code=302;type=path;header-X-A=1"},
+		{"example.com", "v=txtv0;code=308;", nil, "v=txtv0;code=308;type=path;header-X-A=1"},
+		{"a.sub.example.com", "v=txtv0", nil, "v=txtv0;code=301;to=https://a.example.com;to=https://b.example.com;type=path;header-X-A=1"},
+		{"_redirect.docs.example.com.", "v=txtv0;to=https://docs.example.net", []string{"type"}, "v=txtv0;to=https://docs.example.net;code=302;header-X-A=1"},
+		{"example.net", "v=txtv0", nil, "v=txtv0"},
+		{"notexample.com", "v=txtv0", nil, "v=txtv0"},
+	}
+	for i, test := range tests {
+		if txt := d.merge(test.host, test.txt, test.skip...); txt != test.expected {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, txt)
+		}
+	}
+}
+
+func TestDefaultsE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		location string
+		status   int
+	}{
+		{"https://defaults.test/", "https://example.com/defaults", 302},
+		{"https://own.defaults.test/", "https://example.com/own", 301},
+		{"https://paths.defaults.test/docs", "https://docs.example.com", 307},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "path"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Defaults: Defaults{Zones: map[string][]string{
+				"defaults.test":       {"code=302"},
+				"paths.defaults.test": {"type=path", "code=307"},
+			}},
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+	}
+}
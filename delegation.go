@@ -0,0 +1,65 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxDelegationDepth limits the number of dns records followed for a host
+const maxDelegationDepth = 5
+
+// delegate follows the dns records to the zones they delegate the host's
+// record to, e.g. _redirect.a.com pointing to _redirect.b.net, so the
+// records of many vanity domains can be managed in a single zone. It
+// returns the first record which isn't a dns record and its zone.
+func delegate(rec record, zone string, ctx context.Context, c Config, r *http.Request) (record, string, error) {
+	info := getRequestInfo(ctx)
+	visited := map[string]bool{recordZone(zone): true}
+	for depth := 0; rec.Type == "dns"; depth++ {
+		if depth >= maxDelegationDepth {
+			return record{}, zone, fmt.Errorf("more than %d dns records were followed", maxDelegationDepth)
+		}
+		next := recordZone(rec.To)
+		if visited[next] {
+			return record{}, zone, fmt.Errorf("the dns record delegates back to %s", next)
+		}
+		visited[next] = true
+
+		txts, err := query(next, ctx, c)
+		if err != nil {
+			return record{}, next, fmt.Errorf("could not get the delegated record: %s", err.Error())
+		}
+		if len(txts) != 1 || txts[0] == "" {
+			return record{}, next, fmt.Errorf("could not parse the delegated record with %d records", len(txts))
+		}
+		if txts[0], err = joinParts(next, txts[0], ctx, c); err != nil {
+			return record{}, next, fmt.Errorf("could not get the delegated record: %s", err.Error())
+		}
+		info.Records = append(info.Records, usedRecord{Zone: next, TXT: txts[0]})
+
+		delegated := record{}
+		if err := delegated.Parse(txts[0], r, c); err != nil {
+			return record{}, next, fmt.Errorf("could not parse the delegated record: %s", err.Error())
+		}
+		// The path records look up their paths under the zone they were
+		// delegated to, the original host only has the dns record
+		delegated.delegatedHost = strings.TrimSuffix(strings.TrimPrefix(next, basezone+"."), ".")
+		rec, zone = delegated, next
+	}
+	return rec, zone, nil
+}
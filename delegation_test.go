@@ -0,0 +1,72 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestDelegation(t *testing.T) {
+	tests := []struct {
+		url       string
+		enable    []string
+		location  string
+		zone      string
+		shouldErr bool
+	}{
+		{"https://a.delegation.test/x?y=1", []string{"dns", "host"}, "https://central.example.com/x?y=1", "_redirect.links.delegation.test.", false},
+		{"https://twice.delegation.test/", []string{"dns", "host"}, "https://central.example.com/", "_redirect.links.delegation.test.", false},
+		// The paths are looked up under the zone the record got delegated to
+		{"https://path.delegation.test/docs", []string{"dns", "host", "path"}, "https://docs.example.com", "_redirect.docs.paths.delegation.test.", false},
+		{"https://a.delegation.test/", []string{"host"}, "", "", true},
+		{"https://a.delegation.test/", []string{"dns"}, "", "", true},
+		{"https://loop1.delegation.test/", []string{"dns", "host"}, "", "", true},
+		{"https://deep1.delegation.test/", []string{"dns", "host"}, "", "", true},
+		{"https://missing.delegation.test/", []string{"dns", "host"}, "", "", true},
+		{"https://noto.delegation.test/", []string{"dns", "host"}, "", "", true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   test.enable,
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		_, err := getRecord(req.Host, req.Context(), c, req)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+
+		w := httptest.NewRecorder()
+		req, info := withRequestInfo(req)
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if info.Zone != test.zone {
+			t.Errorf("Test %d: Expected the zone %s, got %s", i, test.zone, info.Zone)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNS contains the timeout and retry policy of the TXT record lookups
+type DNS struct {
+	Enable  bool
+	Timeout time.Duration
+	Retries int
+	Backoff time.Duration
+	// Zones overrides the policy for the hosts under the given domains
+	Zones map[string]dnsPolicy
+	// RateLimitBackoff is the initial backoff of the zones which the
+	// resolver refuses to answer, it doubles up to RateLimitMaxBackoff
+	RateLimitBackoff    time.Duration
+	RateLimitMaxBackoff time.Duration
+	// Family binds the queries to either ipv4 or ipv6 and Source
+	// sets the local address which the resolvers are dialed from
+	Family string
+	Source net.IP
+
+	backoff *zoneBackoff
+}
+
+// dnsPolicy is the timeout and retry policy for a single zone
+type dnsPolicy struct {
+	Timeout time.Duration
+	Retries int
+}
+
+// rcodeError is returned when the resolver answers with a failure rcode
+type rcodeError struct {
+	Rcode int
+	Zone  string
+}
+
+func (e *rcodeError) Error() string {
+	return fmt.Sprintf("resolver returned %s for %s", dns.RcodeToString[e.Rcode], e.Zone)
+}
+
+const (
+	DefaultDNSTimeout = 5 * time.Second
+	DefaultDNSBackoff = 100 * time.Millisecond
+)
+
+// SetDefaults sets the default values for DNS config
+// if the fields are empty
+func (d *DNS) SetDefaults() {
+	if d.Timeout == 0 {
+		d.Timeout = DefaultDNSTimeout
+	}
+	if d.Backoff == 0 {
+		d.Backoff = DefaultDNSBackoff
+	}
+	if d.RateLimitBackoff == 0 {
+		d.RateLimitBackoff = DefaultRateLimitBackoff
+	}
+	if d.RateLimitMaxBackoff == 0 {
+		d.RateLimitMaxBackoff = DefaultRateLimitMaxBackoff
+	}
+	if d.Family == "" {
+		d.Family = ipFamily(d.Source)
+	}
+	if d.backoff == nil {
+		d.backoff = &zoneBackoff{zones: make(map[string]*backoffState)}
+	}
+}
+
+// policy returns the timeout and retry policy for the given absolute
+// zone. The most specific zone override wins.
+func (d *DNS) policy(zone string) dnsPolicy {
+	policy := dnsPolicy{Timeout: d.Timeout, Retries: d.Retries}
+	host := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(zone, basezone+"."), "."))
+	matched := ""
+	for domain, override := range d.Zones {
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > len(matched) {
+			matched = domain
+			policy.Timeout = override.Timeout
+			policy.Retries = d.Retries
+			// Negative retries inherit the global value
+			if override.Retries >= 0 {
+				policy.Retries = override.Retries
+			}
+		}
+	}
+	return policy
+}
+
+// lookup finds the TXT records of the given absolute zone and retries
+// transient failures with an exponential backoff between the attempts.
+// Zones which the resolver refuses to answer aren't queried again
+// until their backoff is over.
+func (d *DNS) lookup(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	if remaining := d.backoff.remaining(zone); remaining > 0 {
+		if c.Prometheus.Enable {
+			DNSBackoffSkipped.Add(1)
+		}
+		return nil, 0, &backoffError{Zone: zone, Remaining: remaining}
+	}
+	policy := d.policy(zone)
+
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, policy.Timeout)
+		txts, ttl, err := lookupTXT(attemptCtx, zone, c)
+		timedOut := attemptCtx.Err() == context.DeadlineExceeded || isTimeout(err)
+		cancel()
+		if err == nil {
+			d.backoff.reset(zone)
+			return txts, ttl, nil
+		}
+
+		if timedOut {
+			if c.Prometheus.Enable {
+				DNSTimeouts.Add(1)
+			}
+			err = &timeoutError{Timeout: policy.Timeout, Err: err}
+		} else if !isTransient(err) {
+			return nil, 0, d.failed(zone, err, c)
+		}
+		if attempt >= policy.Retries || ctx.Err() != nil {
+			return nil, 0, d.failed(zone, err, c)
+		}
+
+		backoff := d.Backoff << uint(attempt)
+		log.Printf("[txtdirect]: DNS lookup for %s failed, retrying in %s: %s", zone, backoff, err.Error())
+		if c.Prometheus.Enable {
+			DNSRetries.Add(1)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, 0, err
+		}
+	}
+}
+
+// failed puts the zone in backoff if the given lookup error
+// shows that the resolver is rate limiting the queries
+func (d *DNS) failed(zone string, err error, c Config) error {
+	reason, ok := rateLimitReason(err)
+	if !ok || d.backoff == nil {
+		return err
+	}
+	backoff := d.backoff.fail(zone, d.RateLimitBackoff, d.RateLimitMaxBackoff)
+	log.Printf("[txtdirect]: Resolver seems to be rate limiting %s (%s), backing off for %s", zone, reason, backoff.Round(time.Millisecond))
+	if c.Prometheus.Enable {
+		DNSRateLimited.WithLabelValues(reason).Add(1)
+	}
+	return err
+}
+
+// timeoutError is returned when a lookup attempt times out
+type timeoutError struct {
+	Timeout time.Duration
+	Err     error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("lookup timed out after %s: %s", e.Timeout, e.Err.Error())
+}
+
+// isTimeout checks if the given error was caused by a timeout
+func isTimeout(err error) bool {
+	if _, ok := err.(*timeoutError); ok || err == context.DeadlineExceeded {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// isTransient checks if the given lookup error is worth retrying
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *rcodeError:
+		return e.Rcode == dns.RcodeServerFailure
+	case *net.DNSError:
+		return e.IsTemporary || e.IsTimeout
+	case net.Error:
+		return e.Timeout()
+	}
+	return false
+}
+
+// ParseDNS parses the txtdirect config for the DNS lookups
+func (d *DNS) ParseDNS(c Dispenser) error {
+	switch c.Val() {
+	case "timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a positive duration")
+		}
+		d.Timeout = value
+
+	case "retries":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 0 {
+			return fmt.Errorf("The given value for retries field is not standard. It should be a positive integer")
+		}
+		d.Retries = value
+
+	case "backoff":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for backoff field is not standard. It should be a positive duration")
+		}
+		d.Backoff = value
+
+	case "family":
+		value := c.RemainingArgs()[0]
+		if value != FamilyIPv4 && value != FamilyIPv6 {
+			return fmt.Errorf("The given value for family field is not standard. It should be ipv4 or ipv6")
+		}
+		d.Family = value
+
+	case "source":
+		value := net.ParseIP(c.RemainingArgs()[0])
+		if value == nil {
+			return fmt.Errorf("The given value for source field is not standard. It should be an IP address")
+		}
+		d.Source = value
+
+	case "zone":
+		// zone <domain> <timeout> [retries]
+		args := c.RemainingArgs()
+		if len(args) < 2 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		timeout, err := time.ParseDuration(args[1])
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("The given timeout for zone %s is not standard. It should be a positive duration", args[0])
+		}
+		policy := dnsPolicy{Timeout: timeout, Retries: -1}
+		if len(args) == 3 {
+			retries, err := strconv.Atoi(args[2])
+			if err != nil || retries < 0 {
+				return fmt.Errorf("The given retries for zone %s is not standard. It should be a positive integer", args[0])
+			}
+			policy.Retries = retries
+		}
+		if d.Zones == nil {
+			d.Zones = make(map[string]dnsPolicy)
+		}
+		d.Zones[strings.ToLower(strings.TrimSuffix(args[0], "."))] = policy
+
+	case "ratelimit_backoff":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for ratelimit_backoff field is not standard. It should be a positive duration")
+		}
+		d.RateLimitBackoff = value
+
+	case "ratelimit_max_backoff":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for ratelimit_max_backoff field is not standard. It should be a positive duration")
+		}
+		d.RateLimitMaxBackoff = value
+
+	default:
+		return c.ArgErr() // unhandled option for dns
+	}
+	return nil
+}
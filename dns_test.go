@@ -0,0 +1,134 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startFlakyDNS starts a DNS server which calls the given handler with the
+// number of the received query and returns the server's address
+func startFlakyDNS(t *testing.T, handler func(n int32, w dns.ResponseWriter, m *dns.Msg)) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queries int32
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			handler(atomic.AddInt32(&queries, 1), w, m)
+		}),
+	}
+	go server.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { server.Shutdown() }
+}
+
+func TestDNSLookup(t *testing.T) {
+	tests := []struct {
+		failures  int32
+		rcode     int
+		silent    bool
+		retries   int
+		shouldErr bool
+	}{
+		{0, dns.RcodeSuccess, false, 0, false},
+		{2, dns.RcodeServerFailure, false, 2, false},
+		{2, dns.RcodeServerFailure, false, 1, true},
+		{2, dns.RcodeServerFailure, true, 2, false},
+		// NXDOMAIN isn't transient so it doesn't get retried
+		{1, dns.RcodeNameError, false, 2, true},
+	}
+	for i, test := range tests {
+		addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+			r := new(dns.Msg)
+			r.SetReply(m)
+			if n <= test.failures {
+				if test.silent {
+					return
+				}
+				r.Rcode = test.rcode
+				w.WriteMsg(r)
+				return
+			}
+			r.Answer = append(r.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{"v=txtv0;to=https://example.com"},
+			})
+			w.WriteMsg(r)
+		})
+
+		c := Config{
+			Resolver: addr,
+			DNS: DNS{
+				Enable:  true,
+				Timeout: 100 * time.Millisecond,
+				Retries: test.retries,
+				Backoff: time.Millisecond,
+			},
+		}
+		// The cache makes the lookups go through the DNS client
+		// which exposes the rcodes
+		c.RecordCache.Enable = true
+		c.RecordCache.SetDefaults()
+
+		txts, _, err := c.DNS.lookup(context.Background(), "_redirect.flaky.test.", c)
+		stop()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if len(txts) != 1 || txts[0] != "v=txtv0;to=https://example.com" {
+			t.Errorf("Test %d: Unexpected TXT records %v", i, txts)
+		}
+	}
+}
+
+func TestDNS_policy(t *testing.T) {
+	d := DNS{
+		Timeout: time.Second,
+		Retries: 2,
+		Zones: map[string]dnsPolicy{
+			"example.com":      {Timeout: 500 * time.Millisecond, Retries: -1},
+			"slow.example.com": {Timeout: 3 * time.Second, Retries: 0},
+		},
+	}
+	tests := []struct {
+		zone     string
+		expected dnsPolicy
+	}{
+		{"_redirect.example.org.", dnsPolicy{time.Second, 2}},
+		{"_redirect.example.com.", dnsPolicy{500 * time.Millisecond, 2}},
+		{"_redirect.www.Example.com.", dnsPolicy{500 * time.Millisecond, 2}},
+		{"_redirect.a.slow.example.com.", dnsPolicy{3 * time.Second, 0}},
+		{"_redirect.notexample.com.", dnsPolicy{time.Second, 2}},
+	}
+	for i, test := range tests {
+		if policy := d.policy(test.zone); policy != test.expected {
+			t.Errorf("Test %d: Expected %+v for %s, got %+v", i, test.expected, test.zone, policy)
+		}
+	}
+}
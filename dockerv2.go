@@ -1,3 +1,6 @@
+//go:build !nodocker
+// +build !nodocker
+
 /*
 Copyright 2019 - The TXTDirect Authors
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -14,47 +17,110 @@ limitations under the License.
 package txtdirect
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Dockerv2 contains the configuration of the dockerv2 type
+type Dockerv2 struct {
+	// NotFoundPage is an HTML file served to the browsers when
+	// the requested container can't be mapped
+	NotFoundPage string
+	// CacheHeader adds the X-Cache header to the blob responses, it
+	// tells if the record mapping the container came from the cache
+	CacheHeader bool
+
+	page []byte
+}
+
+func init() {
+	capabilities["dockerv2"] = true
+}
+
+// registryError is an error in the format of the registry API
+type registryError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// dockerv2TokenPath is the token endpoint which passes the docker
+// clients' token requests through to the upstream registry
+const dockerv2TokenPath = "/v2/_token"
+
+// dockerv2Client is used for the requests to the upstream registries
+var dockerv2Client = &http.Client{Timeout: 10 * time.Second}
+
 var dockerRegexes = map[string]*regexp.Regexp{
 	"v2":        regexp.MustCompile("^\\/?v2\\/?$"),
 	"container": regexp.MustCompile("v2\\/(([\\w\\d-]+\\/?)+)\\/(tags|manifests|_catalog|blobs)"),
 }
 
+// serveDockerv2 redirects the docker clients' requests to the registry
+// and falls back for the other clients
+func serveDockerv2(w http.ResponseWriter, r *http.Request, rec record, c Config, fallbackURL []string, code int) error {
+	path := r.URL.Path
+	if !strings.Contains(r.Header.Get("User-Agent"), "Docker-Client") {
+		if c.Dockerv2.page != nil && wantsHTML(r) && strings.HasPrefix(path, "/v2/") {
+			if _, err := createDockerv2URI(rec.To, path); err != nil {
+				c.Dockerv2.notFound(w, r, err)
+				return nil
+			}
+		}
+		log.Println("[txtdirect]: The request is not from docker client, fallback triggered.")
+		fallback(w, r, fallbackURL, rec.Type, "to", code, c)
+		return nil
+	}
+
+	if strings.Contains(path, "/blobs/") {
+		cacheStatus(w, "dockerv2", getRequestInfo(r.Context()).RecordCached, c.Dockerv2.CacheHeader, c)
+	}
+	err := redirectDockerv2(w, r, rec)
+	if err != nil {
+		c.Dockerv2.notFound(w, r, err)
+		return nil
+	}
+	return nil
+}
+
 func redirectDockerv2(w http.ResponseWriter, r *http.Request, rec record) error {
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/v2") {
 		log.Printf("[txtdirect]: unrecognized path for dockerv2: %s", path)
 		if path == "" || path == "/" {
-			fallback(w, r, rec.Root, rec.Type, "root", http.StatusPermanentRedirect, Config{})
+			fallback(w, r, []string{rec.Root}, rec.Type, "root", http.StatusPermanentRedirect, Config{})
 			return nil
 		}
-		fallback(w, r, rec.Website, rec.Type, "website", http.StatusPermanentRedirect, Config{})
+		fallback(w, r, []string{rec.Website}, rec.Type, "website", http.StatusPermanentRedirect, Config{})
 		return nil
 	}
+	if path == dockerv2TokenPath {
+		return proxyDockerv2Token(w, r, rec)
+	}
 	if dockerRegexes["v2"].MatchString(path) {
-		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
-		_, err := w.Write([]byte(http.StatusText(http.StatusOK)))
-		return err
+		return pingDockerv2(w, r, rec)
 	}
 	if path != "/" {
 		uri, err := createDockerv2URI(rec.To, path)
 		if err != nil {
 			return err
 		}
-		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+		setCacheControl(w, http.StatusMovedPermanently)
 		w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
 		http.Redirect(w, r, uri, http.StatusMovedPermanently)
 		return nil
 	}
-	w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+	setCacheControl(w, http.StatusMovedPermanently)
 	w.Header().Add("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
 	http.Redirect(w, r, rec.To, http.StatusMovedPermanently)
 	return nil
@@ -71,13 +137,20 @@ func createDockerv2URI(to string, path string) (string, error) {
 		return uri.String(), nil
 	}
 
+	matches := dockerRegexes["container"].FindAllStringSubmatch(path, -1)
+	if len(matches) == 0 {
+		return "", fmt.Errorf("couldn't find the container in %s", path)
+	}
 	// Replace container's path in docker's request with what's inside rec.To
-	containerPath := dockerRegexes["container"].FindAllStringSubmatch(path, -1)[0][1] // [0][1]: The second item in first group is always container path
-	containerAndVersion := strings.Split(uri.Path, ":")                               // First item in slice is container and second item is version
+	containerPath := matches[0][1]                      // [0][1]: The second item in first group is always container path
+	containerAndVersion := strings.Split(uri.Path, ":") // First item in slice is container and second item is version
 	uri.Path = strings.Replace(path, containerPath, containerAndVersion[0][1:], -1)
 
-	// Replace the version number in docker's request with what's inside rec.To
-	if len(containerAndVersion) == 2 {
+	// Replace the version number in docker's request with what's inside rec.To.
+	// Blobs, digests and tag lists don't refer to a version.
+	reference := path[strings.LastIndex(path, "/")+1:]
+	if len(containerAndVersion) == 2 && !strings.Contains(path, "/blobs/") &&
+		!strings.Contains(reference, ":") && !strings.HasSuffix(path, "/tags/list") {
 		pathSlice := strings.Split(uri.Path, "/")
 		pathSlice[len(pathSlice)-1] = containerAndVersion[1]
 		uri.Path = strings.Join(pathSlice, "/")
@@ -85,3 +158,225 @@ func createDockerv2URI(to string, path string) (string, error) {
 
 	return uri.String(), nil
 }
+
+// pingDockerv2 answers the docker clients' /v2/ ping with the upstream
+// registry's answer, so the clients get the upstream's auth challenge.
+// Bearer challenges point to the local token endpoint which maps the
+// requested repositories to the upstream ones.
+func pingDockerv2(w http.ResponseWriter, r *http.Request, rec record) error {
+	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+
+	resp, err := pingUpstreamRegistry(r, rec.To)
+	if err != nil {
+		log.Printf("[txtdirect]: couldn't ping the upstream registry: %s", err.Error())
+		_, err = w.Write([]byte(http.StatusText(http.StatusOK)))
+		return err
+	}
+	defer resp.Body.Close()
+
+	if challenge := resp.Header.Get("Www-Authenticate"); challenge != "" {
+		if params, ok := parseBearerChallenge(challenge); ok {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			params["realm"] = scheme + "://" + r.Host + dockerv2TokenPath
+			challenge = formatBearerChallenge(params)
+		}
+		w.Header().Set("Www-Authenticate", challenge)
+	}
+	w.Header().Set("Status-Code", strconv.Itoa(resp.StatusCode))
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// pingUpstreamRegistry sends a /v2/ ping to the registry of the given target
+func pingUpstreamRegistry(r *http.Request, to string) (*http.Response, error) {
+	uri, err := url.Parse(to)
+	if err != nil {
+		return nil, err
+	}
+	uri.Path, uri.RawQuery = "/v2/", ""
+	req, err := http.NewRequest("GET", uri.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return dockerv2Client.Do(req.WithContext(r.Context()))
+}
+
+// proxyDockerv2Token passes the docker client's token request through
+// to the upstream registry's token service. The requested scopes are
+// rewritten to refer to the upstream repositories.
+func proxyDockerv2Token(w http.ResponseWriter, r *http.Request, rec record) error {
+	resp, err := pingUpstreamRegistry(r, rec.To)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	params, ok := parseBearerChallenge(resp.Header.Get("Www-Authenticate"))
+	if !ok || params["realm"] == "" {
+		return fmt.Errorf("the upstream registry doesn't use token auth")
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	query := r.URL.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scopes := query["scope"]
+	for i, scope := range scopes {
+		if scopes[i], err = upstreamScope(rec.To, scope); err != nil {
+			return err
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	// Private repositories need the client's credentials
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	tokenResp, err := dockerv2Client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		return err
+	}
+	defer tokenResp.Body.Close()
+
+	w.Header().Set("Content-Type", tokenResp.Header.Get("Content-Type"))
+	w.Header().Set("Status-Code", strconv.Itoa(tokenResp.StatusCode))
+	w.WriteHeader(tokenResp.StatusCode)
+	_, err = io.Copy(w, tokenResp.Body)
+	return err
+}
+
+// upstreamScope maps the repository in the given token scope
+// (repository:<name>:<actions>) to the upstream repository
+func upstreamScope(to, scope string) (string, error) {
+	parts := strings.Split(scope, ":")
+	if len(parts) != 3 || parts[0] != "repository" {
+		return scope, nil
+	}
+	uri, err := createDockerv2URI(to, "/v2/"+parts[1]+"/tags/list")
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	parts[1] = strings.TrimSuffix(strings.TrimPrefix(u.Path, "/v2/"), "/tags/list")
+	return strings.Join(parts, ":"), nil
+}
+
+// parseBearerChallenge parses the parameters of a Bearer WWW-Authenticate challenge
+func parseBearerChallenge(challenge string) (map[string]string, bool) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return nil, false
+	}
+	params := make(map[string]string)
+	rest := strings.TrimSpace(challenge[len("bearer "):])
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				return nil, false
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return params, true
+}
+
+// formatBearerChallenge formats the given parameters as a Bearer challenge
+func formatBearerChallenge(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		if key != "realm" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// The realm comes first like in the registries' challenges
+	fields := []string{fmt.Sprintf("realm=%q", params["realm"])}
+	for _, key := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%q", key, params[key]))
+	}
+	return "Bearer " + strings.Join(fields, ",")
+}
+
+// notFound responds to the requests which can't be mapped to a container.
+// Browsers get the configured HTML page and the other clients get an error
+// in the registry API's format.
+func (d *Dockerv2) notFound(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[txtdirect]: couldn't map the request to a container: %s", err.Error())
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusNotFound))
+
+	if d.page != nil && wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(d.page)
+		return
+	}
+
+	body, _ := json.Marshal(map[string][]registryError{
+		"errors": {{
+			Code:    "NAME_UNKNOWN",
+			Message: "repository name not known to registry",
+			Detail:  map[string]string{"path": r.URL.Path},
+		}},
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write(body)
+}
+
+// wantsHTML checks if the request is coming from a browser
+// instead of a docker client
+func wantsHTML(r *http.Request) bool {
+	return !strings.Contains(r.UserAgent(), "Docker-Client") &&
+		strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// ParseDockerv2 parses the txtdirect config for the dockerv2 type
+func (d *Dockerv2) ParseDockerv2(c Dispenser) error {
+	switch c.Val() {
+	case "not_found_page":
+		d.NotFoundPage = c.RemainingArgs()[0]
+		page, err := ioutil.ReadFile(d.NotFoundPage)
+		if err != nil {
+			return fmt.Errorf("couldn't read the dockerv2 not_found_page: %s", err.Error())
+		}
+		d.page = page
+
+	case "cache_header":
+		d.CacheHeader = true
+
+	default:
+		return c.ArgErr() // unhandled option for dockerv2
+	}
+	return nil
+}
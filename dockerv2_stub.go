@@ -0,0 +1,34 @@
+//go:build nodocker
+// +build nodocker
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+)
+
+// Dockerv2 is the config of the docker registry redirects,
+// which aren't compiled into the binaries built with nodocker
+type Dockerv2 struct{}
+
+// ParseDockerv2 fails since the docker registry redirects aren't compiled in
+func (d *Dockerv2) ParseDockerv2(c Dispenser) error {
+	return errNotCompiled("dockerv2")
+}
+
+func serveDockerv2(w http.ResponseWriter, r *http.Request, rec record, c Config, fallbackURL []string, code int) error {
+	return errNotCompiled("dockerv2")
+}
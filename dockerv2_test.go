@@ -1,3 +1,6 @@
+//go:build !nodocker
+// +build !nodocker
+
 /*
 Copyright 2019 - The TXTDirect Authors
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -14,10 +17,17 @@ limitations under the License.
 package txtdirect
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/mholt/caddy"
 )
 
 func Test_generateDockerv2URI(t *testing.T) {
@@ -83,6 +93,31 @@ func Test_generateDockerv2URI(t *testing.T) {
 			},
 			"https://gcr.io/v2/testing/container/tags/v2.0.0",
 		},
+		{
+			// Blob digests aren't replaced with the record's version
+			"/v2/random/container/blobs/sha256:4c5e",
+			record{
+				To:   "https://gcr.io/testing/container:v2.0.0",
+				Code: 302,
+			},
+			"https://gcr.io/v2/testing/container/blobs/sha256:4c5e",
+		},
+		{
+			"/v2/random/container/manifests/sha256:4c5e",
+			record{
+				To:   "https://gcr.io/testing/container:v2.0.0",
+				Code: 302,
+			},
+			"https://gcr.io/v2/testing/container/manifests/sha256:4c5e",
+		},
+		{
+			"/v2/random/container/tags/list",
+			record{
+				To:   "https://gcr.io/testing/container:v2.0.0",
+				Code: 302,
+			},
+			"https://gcr.io/v2/testing/container/tags/list",
+		},
 		{
 			"/v2/random/container/_catalog",
 			record{
@@ -122,3 +157,232 @@ func Test_generateDockerv2URI(t *testing.T) {
 		}
 	}
 }
+
+func TestDockerv2NotFound(t *testing.T) {
+	page := []byte("<html><body>This container doesn't exist</body></html>")
+	tests := []struct {
+		url         string
+		userAgent   string
+		accept      string
+		page        []byte
+		status      int
+		contentType string
+		location    string
+	}{
+		{
+			"https://container.dockerv2.test/v2/unknown",
+			"Docker-Client/19.03.5 (linux)",
+			"",
+			nil,
+			404,
+			"application/json; charset=utf-8",
+			"",
+		},
+		{
+			// Docker clients always get the registry API error
+			"https://container.dockerv2.test/v2/unknown",
+			"Docker-Client/19.03.5 (linux)",
+			"text/html",
+			page,
+			404,
+			"application/json; charset=utf-8",
+			"",
+		},
+		{
+			"https://container.dockerv2.test/v2/unknown",
+			"Mozilla/5.0",
+			"text/html,application/xhtml+xml",
+			page,
+			404,
+			"text/html; charset=utf-8",
+			"",
+		},
+		{
+			// Browsers get the usual fallback without a page
+			"https://container.dockerv2.test/v2/unknown",
+			"Mozilla/5.0",
+			"text/html,application/xhtml+xml",
+			nil,
+			302,
+			"",
+			"https://gcr.io/testing/container",
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"dockerv2"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Dockerv2: Dockerv2{page: test.page},
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if test.contentType == "" {
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Test %d: Expected content type %s, got %s", i, test.contentType, contentType)
+		}
+		if test.contentType == "text/html; charset=utf-8" {
+			if w.Body.String() != string(page) {
+				t.Errorf("Test %d: Expected the not found page, got %s", i, w.Body.String())
+			}
+			continue
+		}
+		var body struct {
+			Errors []registryError `json:"errors"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("Test %d: Couldn't decode the registry error: %s", i, err)
+			continue
+		}
+		if len(body.Errors) != 1 || body.Errors[0].Code != "NAME_UNKNOWN" {
+			t.Errorf("Test %d: Expected a NAME_UNKNOWN error, got %+v", i, body.Errors)
+		}
+	}
+}
+
+func TestParseDockerv2(t *testing.T) {
+	file, err := ioutil.TempFile("", "notfound")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("<html>Not found</html>")
+	file.Close()
+
+	c := caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		enable dockerv2
+		dockerv2 {
+			not_found_page %s
+		}
+	}
+	`, file.Name()))
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.Dockerv2.NotFoundPage != file.Name() || string(conf.Dockerv2.page) != "<html>Not found</html>" {
+		t.Errorf("Expected the not found page to be loaded, got %+v", conf.Dockerv2)
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable dockerv2
+		dockerv2 {
+			not_found_page /nonexistent/page.html
+		}
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for a missing not found page")
+	}
+}
+
+func TestDockerv2TokenAuth(t *testing.T) {
+	var registry *httptest.Server
+	registry = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test"`, registry.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"scope":   r.URL.Query().Get("scope"),
+				"service": r.URL.Query().Get("service"),
+				"auth":    r.Header.Get("Authorization"),
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+	rec := record{To: registry.URL + "/upstream/image", Type: "dockerv2"}
+
+	// The ping returns the upstream's challenge pointing to the local token endpoint
+	w := httptest.NewRecorder()
+	if err := redirectDockerv2(w, httptest.NewRequest("GET", "https://vanity.test/v2/", nil), rec); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the upstream's status code 401, got %d", w.Code)
+	}
+	expected := `Bearer realm="https://vanity.test/v2/_token",service="registry.test"`
+	if challenge := w.Header().Get("Www-Authenticate"); challenge != expected {
+		t.Errorf("Expected the challenge %s, got %s", expected, challenge)
+	}
+
+	// The token request gets passed through with the upstream's repository
+	r := httptest.NewRequest("GET", "https://vanity.test/v2/_token?scope=repository:image:pull&service=vanity.test", nil)
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	w = httptest.NewRecorder()
+	if err := redirectDockerv2(w, r, rec); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var token map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("Couldn't decode the token response: %s", err)
+	}
+	if token["scope"] != "repository:upstream/image:pull" {
+		t.Errorf("Expected the scope to refer to the upstream repository, got %s", token["scope"])
+	}
+	if token["service"] != "registry.test" {
+		t.Errorf("Expected the upstream's service, got %s", token["service"])
+	}
+	if token["auth"] != "Basic dXNlcjpwYXNz" {
+		t.Errorf("Expected the client's credentials to be passed through, got %s", token["auth"])
+	}
+}
+
+func TestParseBearerChallenge(t *testing.T) {
+	tests := []struct {
+		challenge string
+		expected  map[string]string
+		ok        bool
+	}{
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`,
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io"},
+			true,
+		},
+		{
+			`Bearer realm="https://gcr.io/v2/token", service="gcr.io", scope="repository:a/b:pull,push"`,
+			map[string]string{"realm": "https://gcr.io/v2/token", "service": "gcr.io", "scope": "repository:a/b:pull,push"},
+			true,
+		},
+		{
+			`Basic realm="Registry"`,
+			nil,
+			false,
+		},
+	}
+	for i, test := range tests {
+		params, ok := parseBearerChallenge(test.challenge)
+		if ok != test.ok {
+			t.Errorf("Test %d: Expected ok to be %t", i, test.ok)
+			continue
+		}
+		if len(params) != len(test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, params)
+			continue
+		}
+		for key, value := range test.expected {
+			if params[key] != value {
+				t.Errorf("Test %d: Expected %s to be %q, got %q", i, key, value, params[key])
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoH contains the DNS-over-HTTPS resolver's configuration
+type DoH struct {
+	Timeout  time.Duration
+	Fallback bool
+
+	// client reaches the endpoints over the DNS config's address family
+	client *http.Client
+}
+
+const (
+	// DefaultDoHTimeout is the default timeout for a single DoH query
+	DefaultDoHTimeout = 5 * time.Second
+	dohMediaType      = "application/dns-message"
+	// maxDoHResponseSize is the largest DNS message allowed by RFC 8484
+	maxDoHResponseSize = 65535
+)
+
+// isDoH checks if the given resolver address is a DNS-over-HTTPS endpoint
+func isDoH(resolver string) bool {
+	return strings.HasPrefix(resolver, "https://")
+}
+
+// SetDefaults sets the default values for DoH config
+// if the fields are empty
+func (d *DoH) SetDefaults() {
+	if d.Timeout == 0 {
+		d.Timeout = DefaultDoHTimeout
+	}
+}
+
+// LookupTXT sends a TXT query for the given zone to the DoH endpoint
+// using the RFC 8484 wire format and returns the found TXT records
+// alongside their TTL
+func (d *DoH) LookupTXT(ctx context.Context, endpoint, zone string) ([]string, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeTXT)
+	answer, err := d.exchange(ctx, endpoint, m)
+	if err != nil {
+		return nil, 0, err
+	}
+	return txtsFromMsg(answer, zone)
+}
+
+// exchange sends the given DNS message to the DoH endpoint and returns the answer
+func (d *DoH) exchange(ctx context.Context, endpoint string, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends using 0 as the ID to make responses cache friendly
+	m.Id = 0
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't pack the DNS query: %s", err.Error())
+	}
+
+	if d.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			noteFamily(ctx, info.Conn.RemoteAddr())
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	client := d.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH endpoint returned status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDoHResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, fmt.Errorf("couldn't unpack the DoH response: %s", err.Error())
+	}
+	return answer, nil
+}
+
+// ParseDoH parses the txtdirect config for the DoH resolver
+func (d *DoH) ParseDoH(c Dispenser) error {
+	switch c.Val() {
+	case "timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a duration")
+		}
+		d.Timeout = value
+
+	case "fallback":
+		value, err := strconv.ParseBool(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for fallback field is not standard. It should be a boolean")
+		}
+		d.Fallback = value
+
+	default:
+		return c.ArgErr() // unhandled option for doh
+	}
+	return nil
+}
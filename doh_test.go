@@ -0,0 +1,131 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohHandler answers DoH queries using the testing TXT records
+func dohHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != dohMediaType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	if _, ok := txts[m.Question[0].Name]; ok {
+		parseDNSQuery(reply)
+	} else {
+		reply.Rcode = dns.RcodeNameError
+	}
+	packed, err := reply.Pack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	w.Write(packed)
+}
+
+func TestDoHLookupTXT(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(dohHandler))
+	defer server.Close()
+
+	tests := []struct {
+		zone      string
+		expected  string
+		shouldErr bool
+	}{
+		{
+			"_redirect.about.test.",
+			txts["_redirect.about.test."],
+			false,
+		},
+		{
+			"_redirect.pkg.test",
+			txts["_redirect.pkg.test."],
+			false,
+		},
+		{
+			"_redirect.nonexistent.test.",
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		d := DoH{}
+		d.SetDefaults()
+		resp, _, err := d.LookupTXT(context.Background(), server.URL, test.zone)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp[0] != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, resp[0])
+		}
+	}
+}
+
+func TestDoHTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		dohHandler(w, r)
+	}))
+	defer server.Close()
+
+	d := DoH{Timeout: 50 * time.Millisecond}
+	if _, _, err := d.LookupTXT(context.Background(), server.URL, "_redirect.about.test."); err == nil {
+		t.Errorf("Expected the DoH query to time out")
+	}
+}
+
+func Test_isDoH(t *testing.T) {
+	tests := []struct {
+		resolver string
+		expected bool
+	}{
+		{"https://cloudflare-dns.com/dns-query", true},
+		{"127.0.0.1:53", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if result := isDoH(test.resolver); result != test.expected {
+			t.Errorf("Expected %t for %s, got %t", test.expected, test.resolver, result)
+		}
+	}
+}
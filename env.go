@@ -0,0 +1,239 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// EnvPrefix is the prefix of the environment variables configuring the
+// standalone server. TXTDIRECT_<OPTION> sets a top level option of the
+// txtdirect block and TXTDIRECT_<BLOCK>_<OPTION> an option inside one
+// of its blocks, e.g. TXTDIRECT_CACHE_MAX_TTL=1h.
+const EnvPrefix = "TXTDIRECT_"
+
+// envBlocks are the options of the txtdirect block
+// which can have a block of their own options
+var envBlocks = []string{
+	"accesslog", "adaptive", "admin", "backend", "cache", "decisionlog", "dns",
+	"dockerv2", "geoip", "gomods", "healthcheck", "honeypot", "maintenance",
+	"overrides", "policy", "preview", "priority", "probes", "prometheus", "proxy",
+	"qr", "ratelimit", "resolver", "sinkhole", "snapshot", "status", "templates",
+	"tls_ask", "tor", "tracing", "webhooks",
+}
+
+// envNestedBlocks are the blocks nested in the other blocks
+var envNestedBlocks = map[string][]string{
+	"decisionlog": {"sink"},
+	"gomods":      {"cache"},
+	"proxy":       {"cache"},
+}
+
+// envFlags are the options without arguments, they're set by true
+// and left out by false instead of getting the value as arguments
+var envFlags = []string{
+	"debug", "preserve_method", "https_only", "multiple_choices", "dockerv2_cache_header",
+	"gomods_cache_header", "overrides_shadow", "policy_deny_private", "port_zones", "proxy_stream",
+	"status_check_targets", "tracing_insecure",
+}
+
+// envOption is an option of the txtdirect block set by the
+// environment, along with the options of its block
+type envOption struct {
+	value   string
+	options map[string]*envOption
+}
+
+// LoadEnv reads the TXTDIRECT_* environment variables from the given
+// environment. The variables with a matching standalone field override
+// it, the rest of them are added to the txtdirect block of the config.
+func (s *Standalone) LoadEnv(environ []string) error {
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(variable, EnvPrefix), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key, value := strings.ToLower(parts[0]), strings.TrimSpace(parts[1])
+
+		switch key {
+		case "listen":
+			s.Listen = value
+		case "tls_cert":
+			s.TLSCert = value
+		case "tls_key":
+			s.TLSKey = value
+		case "tls_client_ca":
+			s.TLSClientCA = value
+		case "enable":
+			s.Enable = strings.Fields(value)
+		case "redirect":
+			s.Redirect = strings.Join(strings.Fields(value), ",")
+		case "resolver":
+			s.Resolvers = strings.Fields(value)
+		case "logfile":
+			s.Logfile = value
+		case "profile":
+			s.Profile = value
+		case "probes":
+			s.Probes = value != "false"
+		case "proxy_protocol":
+			s.ProxyProtocol = value != "false"
+		case "proxy_protocol_trusted":
+			s.ProxyProtocolTrusted = strings.Fields(value)
+		default:
+			if err := s.setEnvOption(key, value); err != nil {
+				return fmt.Errorf("%s%s: %s", EnvPrefix, parts[0], err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// setEnvOption finds the option and the blocks it's nested in by
+// the name of the variable and stores the variable's value
+func (s *Standalone) setEnvOption(key, value string) error {
+	if s.env == nil {
+		s.env = make(map[string]*envOption)
+	}
+	block := longestPrefix(envBlocks, key)
+	if block == "" || block == key {
+		if !contains(envFlags, key) && !contains(envBlocks, key) && !isTopLevelOption(key) {
+			return fmt.Errorf("unknown option %s", key)
+		}
+		envOptionFor(s.env, key).value = value
+		return nil
+	}
+
+	parent := envOptionFor(s.env, block)
+	option := strings.TrimPrefix(key, block+"_")
+	if nested := longestPrefix(envNestedBlocks[block], option); nested != "" && nested != option && !contains(envFlags, key) {
+		parent = envOptionFor(parent.options, nested)
+		option = strings.TrimPrefix(option, nested+"_")
+	}
+	envOptionFor(parent.options, option).value = value
+	return nil
+}
+
+// isTopLevelOption checks if the option is one of the top level
+// options of the txtdirect block which don't have a block
+func isTopLevelOption(option string) bool {
+	return contains([]string{"disable", "import", "absent_action", "max_request_age", "ip_hosts", "apex_fallback", "flatten"}, option)
+}
+
+func envOptionFor(options map[string]*envOption, name string) *envOption {
+	if options[name] == nil {
+		options[name] = &envOption{options: make(map[string]*envOption)}
+	}
+	return options[name]
+}
+
+// longestPrefix returns the longest of the names which is the key
+// or one of the key's underscore separated prefixes
+func longestPrefix(names []string, key string) string {
+	var longest string
+	for _, name := range names {
+		if (key == name || strings.HasPrefix(key, name+"_")) && len(name) > len(longest) {
+			longest = name
+		}
+	}
+	return longest
+}
+
+// caddyfile renders the standalone config as a txtdirect directive
+func (s *Standalone) caddyfile() string {
+	var b strings.Builder
+	b.WriteString("txtdirect {\n")
+	if s.Profile != "" {
+		fmt.Fprintf(&b, "profile %s\n", s.Profile)
+	}
+	if len(s.Enable) > 0 {
+		fmt.Fprintf(&b, "enable %s\n", strings.Join(s.Enable, " "))
+	}
+	if s.Redirect != "" {
+		fmt.Fprintf(&b, "redirect %s\n", s.Redirect)
+	}
+	if s.Logfile != "" {
+		fmt.Fprintf(&b, "logfile %s\n", s.Logfile)
+	}
+
+	env := make(map[string]*envOption, len(s.env))
+	for name, option := range s.env {
+		env[name] = option
+	}
+	resolvers := s.Resolvers
+	if len(resolvers) == 0 && s.Resolver != "" {
+		resolvers = []string{s.Resolver}
+	}
+	if len(resolvers) > 0 {
+		resolver := &envOption{value: strings.Join(resolvers, " "), options: make(map[string]*envOption)}
+		if env["resolver"] != nil {
+			resolver.options = env["resolver"].options
+		}
+		env["resolver"] = resolver
+	}
+	if s.Probes {
+		envOptionFor(env, "probes")
+	}
+	writeEnvOptions(&b, env, "")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeEnvOptions writes the options in a stable order, every line
+// of an option's value is written as a separate option
+func writeEnvOptions(b *strings.Builder, options map[string]*envOption, parent string) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		option := options[name]
+		key := strings.TrimPrefix(parent+"_"+name, "_")
+		value := option.value
+		if value == "false" && (contains(envFlags, key) || contains(envBlocks, key)) {
+			continue
+		}
+		if value == "true" && (contains(envFlags, key) || len(option.options) > 0 || contains(envBlocks, key)) {
+			value = ""
+		}
+		if len(option.options) == 0 {
+			for _, line := range strings.Split(value, "\n") {
+				b.WriteString(strings.TrimSpace(name+" "+strings.TrimSpace(line)) + "\n")
+			}
+			continue
+		}
+		b.WriteString(strings.TrimSpace(name+" "+value) + " {\n")
+		writeEnvOptions(b, option.options, key)
+		b.WriteString("}\n")
+	}
+}
+
+// envConfig parses the standalone config rendered as a Caddyfile
+func (s *Standalone) envConfig() (Config, error) {
+	var c Config
+	d := caddyfile.NewDispenser("environment", strings.NewReader(s.caddyfile()))
+	if err := c.UnmarshalCaddyfile(&d); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStandaloneLoadEnv(t *testing.T) {
+	s := Standalone{Listen: ":8080", Redirect: "https://file.example.com"}
+	err := s.LoadEnv([]string{
+		"PATH=/usr/bin",
+		"TXTDIRECT_LISTEN=:9090",
+		"TXTDIRECT_ENABLE=host path",
+		"TXTDIRECT_REDIRECT=https://a.example.com https://b.example.com",
+		"TXTDIRECT_DEBUG=true",
+		"TXTDIRECT_PRESERVE_METHOD=false",
+		"TXTDIRECT_CACHE_MIN_TTL=1m",
+		"TXTDIRECT_CACHE_MAX_TTL=2h",
+		"TXTDIRECT_POLICY_DENY_PRIVATE=true",
+		"TXTDIRECT_POLICY_ALLOW_DOMAINS=example.com *.example.org",
+		"TXTDIRECT_HONEYPOT_PATHS=/.env\n/.git/",
+		"TXTDIRECT_PROXY_PROTOCOL=true",
+		"TXTDIRECT_IP_HOSTS=host default.example.com",
+		"TXTDIRECT_BACKEND=redis",
+		"TXTDIRECT_BACKEND_PREFIX=txtdirect:",
+		"TXTDIRECT_PROXY_PROTOCOL_TRUSTED=10.0.0.0/8 192.0.2.1",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if s.Listen != ":9090" || s.Redirect != "https://a.example.com,https://b.example.com" || !identical(s.Enable, []string{"host", "path"}) {
+		t.Errorf("Expected the environment to override the standalone fields, got %+v", s)
+	}
+	if !s.ProxyProtocol || !identical(s.ProxyProtocolTrusted, []string{"10.0.0.0/8", "192.0.2.1"}) {
+		t.Errorf("Expected the PROXY protocol to be enabled, got %t and %v", s.ProxyProtocol, s.ProxyProtocolTrusted)
+	}
+
+	c, err := s.Config()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n%s", err, s.caddyfile())
+	}
+	if !c.Debug || c.PreserveMethod {
+		t.Errorf("Expected debug to be set and preserve_method to be left out, got %t and %t", c.Debug, c.PreserveMethod)
+	}
+	if !c.RecordCache.Enable || c.RecordCache.MinTTL != time.Minute || c.RecordCache.MaxTTL != 2*time.Hour {
+		t.Errorf("Unexpected cache config %+v", c.RecordCache)
+	}
+	if !c.Policy.DenyPrivate || !identical(c.Policy.Domains, []string{"example.com", "*.example.org"}) {
+		t.Errorf("Unexpected policy config %+v", c.Policy)
+	}
+	if c.IPHosts.Action != IPHostsHost || c.IPHosts.Host != "default.example.com" {
+		t.Errorf("Unexpected ip_hosts config %+v", c.IPHosts)
+	}
+	if c.Backend.Type != "redis" || c.Backend.Prefix != "txtdirect:" || c.Backend.store == nil {
+		t.Errorf("Unexpected backend config %+v", c.Backend)
+	}
+	if !c.Honeypot.Enable || !identical(c.Honeypot.Paths, []string{"/.env", "/.git/"}) {
+		t.Errorf("Unexpected honeypot config %+v", c.Honeypot)
+	}
+	if c.Redirect != "https://a.example.com,https://b.example.com" || !identical(c.Enable, []string{"host", "path"}) {
+		t.Errorf("Expected the standalone fields in the config, got %s and %v", c.Redirect, c.Enable)
+	}
+}
+
+func TestStandaloneEnvCaddyfile(t *testing.T) {
+	s := Standalone{}
+	err := s.LoadEnv([]string{
+		"TXTDIRECT_RESOLVER=https://dns.example.com/dns-query",
+		"TXTDIRECT_RESOLVER_TIMEOUT=5s",
+		"TXTDIRECT_GOMODS_CACHE_TYPE=local",
+		"TXTDIRECT_GOMODS_CACHE_HEADER=true",
+		"TXTDIRECT_PROMETHEUS=false",
+		"TXTDIRECT_PROMETHEUS_ADDRESS=localhost:9183",
+		"TXTDIRECT_PROXY_CACHE_MAX_SIZE=1024",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []string{
+		"txtdirect {",
+		"gomods {",
+		"cache {",
+		"type local",
+		"}",
+		"cache_header",
+		"}",
+		"proxy {",
+		"cache {",
+		"max_size 1024",
+		"}",
+		"}",
+		"resolver https://dns.example.com/dns-query {",
+		"timeout 5s",
+		"}",
+		"}",
+	}
+	if lines := strings.Split(strings.TrimSpace(s.caddyfile()), "\n"); !identical(lines, expected) {
+		t.Errorf("Expected the Caddyfile:\n%s\ngot:\n%s", strings.Join(expected, "\n"), s.caddyfile())
+	}
+
+	if err := s.LoadEnv([]string{"TXTDIRECT_UNKNOWN=value"}); err == nil {
+		t.Errorf("Expected an error for an unknown option")
+	}
+}
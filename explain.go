@@ -0,0 +1,113 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// explainWriter replaces the body of the redirects and errors with a
+// plaintext explanation of the decision, for the clients like curl
+// asking for text/plain while the debug option is enabled
+type explainWriter struct {
+	http.ResponseWriter
+	r    *http.Request
+	info *requestInfo
+
+	wroteHeader bool
+	explained   bool
+}
+
+// wantsPlaintext checks if the request's Accept header asks for text/plain.
+// Wildcard media ranges aren't matched, so browsers get the usual body.
+func wantsPlaintext(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "text/plain" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *explainWriter) WriteHeader(status int) {
+	if e.wroteHeader {
+		return
+	}
+	e.wroteHeader = true
+	if status < 300 {
+		e.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	e.explained = true
+	e.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	e.Header().Del("Content-Length")
+	e.ResponseWriter.WriteHeader(status)
+	if e.r.Method != http.MethodHead {
+		fmt.Fprint(e.ResponseWriter, e.explain(status))
+	}
+}
+
+func (e *explainWriter) Write(b []byte) (int, error) {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusOK)
+	}
+	// The original body of the explained responses is dropped
+	if e.explained {
+		return len(b), nil
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered response to the client
+func (e *explainWriter) Flush() {
+	if !e.wroteHeader {
+		e.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// explain describes the decision made for the request
+func (e *explainWriter) explain(status int) string {
+	lines := [][2]string{
+		{"host", e.r.Host},
+		{"path", e.r.URL.Path},
+		{"status", fmt.Sprintf("%d %s", status, http.StatusText(status))},
+		{"location", e.Header().Get("Location")},
+		{"zone", e.info.Zone},
+		{"type", e.info.Type},
+		{"fallback", e.info.Fallback},
+	}
+	if e.info.Zone != "" {
+		lines = append(lines, [2]string{"cached", fmt.Sprint(e.info.RecordCached)})
+	}
+
+	for _, failure := range e.info.Errors.lines() {
+		lines = append(lines, [2]string{"error", failure})
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		if line[1] != "" {
+			fmt.Fprintf(&b, "%s: %s\n", line[0], line[1])
+		}
+	}
+	return b.String()
+}
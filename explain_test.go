@@ -0,0 +1,99 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestExplainDecision(t *testing.T) {
+	tests := []struct {
+		url    string
+		accept string
+		debug  bool
+		body   string
+	}{
+		{
+			"https://headers.test/",
+			"text/plain",
+			true,
+			"host: headers.test\npath: /\nstatus: 301 Moved Permanently\nlocation: https://example.com\nzone: _redirect.headers.test.\ntype: host\ncached: false\n",
+		},
+		{
+			"https://absent.test/path",
+			"text/plain;q=0.9, text/html",
+			true,
+			"host: absent.test\npath: /path\nstatus: 301 Moved Permanently\nlocation: https://fallback.example.com\nfallback: redirect\n" +
+				"error: _redirect.absent.test.: empty TXT record\nerror: _redirect._.test.: empty TXT record\n",
+		},
+		{"https://headers.test/", "*/*", true, ""},
+		{"https://headers.test/", "text/plain", false, ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Redirect: "https://fallback.example.com",
+			Debug:    test.debug,
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		if err := serve(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if test.body == "" {
+			if w.Header().Get("Content-Type") == "text/plain; charset=utf-8" {
+				t.Errorf("Test %d: Expected the decision not to be explained, got %q", i, w.Body.String())
+			}
+			continue
+		}
+		if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+			t.Errorf("Test %d: Expected a plaintext response, got %s", i, w.Header().Get("Content-Type"))
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected the body %q, got %q", i, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestParseDebug(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		debug
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !conf.Debug {
+		t.Errorf("Expected debug to be enabled")
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		debug yes
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for an argument to debug")
+	}
+}
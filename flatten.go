@@ -0,0 +1,81 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// Flatten contains the redirect chain flattening's configuration
+type Flatten struct {
+	Enable   bool
+	MaxDepth int
+}
+
+// DefaultFlattenDepth is the default number of hops followed when flattening
+const DefaultFlattenDepth = 3
+
+// SetDefaults sets the default values for flatten config
+// if the fields are empty
+func (f *Flatten) SetDefaults() {
+	if f.MaxDepth == 0 {
+		f.MaxDepth = DefaultFlattenDepth
+	}
+}
+
+// flattenTarget looks ahead for host records on the given target's host
+// and follows them to return the final destination of the redirect chain.
+// The returned status code is only permanent if every hop is permanent.
+func flattenTarget(to string, code int, r *http.Request, c Config) (string, int) {
+	visited := map[string]bool{canonicalHost(r.Host): true}
+
+	for i := 0; i < c.Flatten.MaxDepth; i++ {
+		u, err := url.Parse(to)
+		if err != nil || u.Host == "" || visited[canonicalHost(u.Host)] {
+			break
+		}
+		visited[canonicalHost(u.Host)] = true
+
+		req, err := http.NewRequest("GET", to, nil)
+		if err != nil {
+			break
+		}
+		req = req.WithContext(r.Context())
+		req.Header = r.Header
+
+		rec, err := getRecord(u.Host, r.Context(), c, req)
+		if err != nil || rec.Type != "host" || rec.To == "" {
+			break
+		}
+		next, nextCode, err := getBaseTarget(rec, req)
+		if err != nil {
+			break
+		}
+
+		log.Printf("[txtdirect]: flattened %s > %s", to, next)
+		to = next
+		if isPermanentRedirect(code) && !isPermanentRedirect(nextCode) {
+			code = nextCode
+		}
+	}
+
+	return to, code
+}
+
+// isPermanentRedirect checks if the given status code is a permanent redirect
+func isPermanentRedirect(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
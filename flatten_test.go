@@ -0,0 +1,90 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func Test_flattenTarget(t *testing.T) {
+	tests := []struct {
+		url          string
+		to           string
+		code         int
+		maxDepth     int
+		expected     string
+		expectedCode int
+	}{
+		{
+			"https://start.chain.test/docs",
+			"https://middle.chain.test/docs",
+			301,
+			3,
+			"https://end.chain.test/docs",
+			302,
+		},
+		{
+			"https://start.chain.test/docs",
+			"https://middle.chain.test/docs",
+			301,
+			1,
+			"https://end.chain.test/docs",
+			302,
+		},
+		{
+			"https://loop.chain.test/",
+			"https://pool.chain.test",
+			301,
+			5,
+			"https://loop.chain.test",
+			301,
+		},
+		{
+			"https://loop.chain.test:443/",
+			"https://pool.chain.test",
+			301,
+			5,
+			"https://loop.chain.test",
+			301,
+		},
+		{
+			"https://middle.chain.test/",
+			"https://end.chain.test/",
+			302,
+			3,
+			"https://end.chain.test/",
+			302,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Flatten: Flatten{
+				Enable:   true,
+				MaxDepth: test.maxDepth,
+			},
+		}
+		to, code := flattenTarget(test.to, test.code, req, c)
+		if to != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, to)
+		}
+		if code != test.expectedCode {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.expectedCode, code)
+		}
+	}
+}
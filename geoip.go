@@ -0,0 +1,208 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// GeoIP contains the configuration of the MaxMind database
+// used by the {geo_country} and {geo_city} placeholders
+type GeoIP struct {
+	Enable   bool
+	Database string
+	Language string
+	// ASNDatabase is the MaxMind ASN database used by the geo policies
+	ASNDatabase string
+
+	store *geoStore
+}
+
+// geoStore holds the opened databases, which are shared
+// by the copies of the config
+type geoStore struct {
+	sync.RWMutex
+	db  *geoip2.Reader
+	asn *geoip2.Reader
+}
+
+// geoLocation is the client's location found in the GeoIP database
+type geoLocation struct {
+	Country   string
+	City      string
+	Continent string
+	// InEU is set for the member states of the European Union
+	InEU bool
+	ASN  uint
+}
+
+// DefaultGeoIPLanguage is the language of the city names
+const DefaultGeoIPLanguage = "en"
+
+// SetDefaults sets the default values for the GeoIP config
+func (g *GeoIP) SetDefaults() {
+	if g.Language == "" {
+		g.Language = DefaultGeoIPLanguage
+	}
+	if g.store == nil {
+		g.store = &geoStore{}
+	}
+}
+
+// ParseGeoIP parses the txtdirect config for the GeoIP database
+func (g *GeoIP) ParseGeoIP(c Dispenser) error {
+	switch c.Val() {
+	case "database":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		database, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(database); err != nil {
+			return fmt.Errorf("The given value for database field is not standard. It should be a MaxMind database file: %s", err.Error())
+		}
+		g.Database = database
+
+	case "language":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		g.Language = args[0]
+
+	case "asn_database":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		database, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(database); err != nil {
+			return fmt.Errorf("The given value for asn_database field is not standard. It should be a MaxMind ASN database file: %s", err.Error())
+		}
+		g.ASNDatabase = database
+
+	default:
+		return c.ArgErr() // unhandled option for geoip
+	}
+	return nil
+}
+
+// Open opens the MaxMind database
+func (g *GeoIP) Open() error {
+	db, err := geoip2.Open(g.Database)
+	if err != nil {
+		return fmt.Errorf("couldn't open the GeoIP database %s: %s", g.Database, err.Error())
+	}
+	var asn *geoip2.Reader
+	if g.ASNDatabase != "" {
+		asn, err = geoip2.Open(g.ASNDatabase)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("couldn't open the ASN database %s: %s", g.ASNDatabase, err.Error())
+		}
+	}
+	if g.store == nil {
+		g.store = &geoStore{}
+	}
+	g.store.Lock()
+	g.store.db, g.store.asn = db, asn
+	g.store.Unlock()
+	return nil
+}
+
+// Close closes the MaxMind database
+func (g *GeoIP) Close() error {
+	if g.store == nil {
+		return nil
+	}
+	g.store.Lock()
+	defer g.store.Unlock()
+	if g.store.asn != nil {
+		g.store.asn.Close()
+		g.store.asn = nil
+	}
+	if g.store.db == nil {
+		return nil
+	}
+	err := g.store.db.Close()
+	g.store.db = nil
+	return err
+}
+
+// lookup finds the given IP address' location. The country databases
+// don't have the cities, so only the country gets looked up in them.
+func (g *GeoIP) lookup(ip string) geoLocation {
+	addr := net.ParseIP(ip)
+	if g.store == nil || addr == nil {
+		return geoLocation{}
+	}
+	g.store.RLock()
+	defer g.store.RUnlock()
+	db, asnDB := g.store.db, g.store.asn
+	if db == nil {
+		return geoLocation{}
+	}
+	var location geoLocation
+	if asnDB != nil {
+		if asn, err := asnDB.ASN(addr); err == nil {
+			location.ASN = asn.AutonomousSystemNumber
+		}
+	}
+	if !strings.Contains(db.Metadata().DatabaseType, "City") {
+		country, err := db.Country(addr)
+		if err != nil {
+			return location
+		}
+		location.Country = country.Country.IsoCode
+		location.Continent = country.Continent.Code
+		location.InEU = country.Country.IsInEuropeanUnion
+		return location
+	}
+	city, err := db.City(addr)
+	if err != nil {
+		return location
+	}
+	location.Country = city.Country.IsoCode
+	location.City = city.City.Names[g.Language]
+	location.Continent = city.Continent.Code
+	location.InEU = city.Country.IsInEuropeanUnion
+	return location
+}
+
+// location returns the client's location, which
+// only gets looked up once for every request
+func (info *requestInfo) location(r *http.Request) geoLocation {
+	if info.geoip == nil {
+		return geoLocation{}
+	}
+	if info.geo == nil {
+		geo := info.geoip.lookup(clientIP(r))
+		info.geo = &geo
+	}
+	return *info.geo
+}
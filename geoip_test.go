@@ -0,0 +1,102 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestGeoIPPlaceholders(t *testing.T) {
+	geoip := GeoIP{Database: "testdata/GeoIP2-City-Test.mmdb"}
+	geoip.SetDefaults()
+	if err := geoip.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer geoip.Close()
+
+	tests := []struct {
+		remote   string
+		expected string
+	}{
+		{"81.2.69.160:5000", "https://GB.example.com/London"},
+		{"[2a02:cf40::1]:5000", "https://DE.example.com/"},
+		{"192.0.2.1:5000", "https://.example.com/"},
+		{"invalid", "https://.example.com/"},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.RemoteAddr = test.remote
+		req, info := withRequestInfo(req)
+		info.geoip = &geoip
+
+		result, err := parsePlaceholders("https://{geo_country}.example.com/{geo_city}", req, []string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, result)
+		}
+	}
+}
+
+func TestParseGeoIP(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		geoip {
+			database testdata/GeoIP2-City-Test.mmdb
+			language de
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	database, _ := filepath.Abs("testdata/GeoIP2-City-Test.mmdb")
+	if !conf.GeoIP.Enable || conf.GeoIP.Database != database || conf.GeoIP.Language != "de" {
+		t.Errorf("Expected the GeoIP database to be configured, got %+v", conf.GeoIP)
+	}
+
+	invalid := []string{
+		`txtdirect {
+			geoip
+		}`,
+		`txtdirect {
+			geoip {
+				database testdata/nonexistent.mmdb
+			}
+		}`,
+		`txtdirect {
+			geoip {
+				database geoip.go
+			}
+		}`,
+	}
+	for i, input := range invalid {
+		conf, err := parse(caddy.NewTestController("http", input))
+		if err == nil {
+			// The database gets opened by the startup hook
+			if err = conf.GeoIP.Open(); err == nil {
+				conf.GeoIP.Close()
+			}
+		}
+		if err == nil {
+			t.Errorf("Test %d: Expected an error for %s", i, input)
+		}
+	}
+}
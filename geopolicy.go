@@ -0,0 +1,217 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GeoPolicy holds the rules blocking or rerouting the clients by their
+// location per host, for the deployments which have to keep some of the
+// regions out. The rules of the * host apply to the hosts without rules.
+type GeoPolicy struct {
+	Hosts map[string][]GeoRule
+}
+
+// GeoRule is a rule of the geo policy, the first matching rule is used
+type GeoRule struct {
+	// Action is block or reroute
+	Action string
+	// Matchers are the country codes, EU for the European Union's
+	// member states, continent:<code> for the continents, AS<number>
+	// for the autonomous systems or * for all of the clients
+	Matchers []string
+	// To is the reroute target, it can have placeholders
+	To string
+}
+
+const (
+	GeoBlock   = "block"
+	GeoReroute = "reroute"
+)
+
+// matches checks if the location matches one of the rule's matchers
+func (rule GeoRule) matches(location geoLocation) bool {
+	for _, matcher := range rule.Matchers {
+		switch {
+		case matcher == "*":
+			return true
+		case matcher == "EU":
+			if location.InEU {
+				return true
+			}
+		case strings.HasPrefix(matcher, "continent:"):
+			if location.Continent != "" && location.Continent == strings.TrimPrefix(matcher, "continent:") {
+				return true
+			}
+		case strings.HasPrefix(matcher, "AS"):
+			if location.ASN != 0 && matcher == "AS"+strconv.FormatUint(uint64(location.ASN), 10) {
+				return true
+			}
+		case location.Country != "" && matcher == location.Country:
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the host's first rule matching the client's location
+func (g *GeoPolicy) rule(r *http.Request, c Config) (GeoRule, bool) {
+	rules, ok := g.Hosts[canonicalHost(r.Host)]
+	if !ok {
+		rules = g.Hosts["*"]
+	}
+	if len(rules) == 0 {
+		return GeoRule{}, false
+	}
+	info := getRequestInfo(r.Context())
+	if info.geoip == nil {
+		info.geoip = &c.GeoIP
+	}
+	location := info.location(r)
+	for _, rule := range rules {
+		if rule.matches(location) {
+			return rule, true
+		}
+	}
+	return GeoRule{}, false
+}
+
+// serve blocks or reroutes the request if one of
+// its host's rules matches the client's location
+func (g *GeoPolicy) serve(w http.ResponseWriter, r *http.Request, c Config) bool {
+	rule, ok := g.rule(r, c)
+	if !ok {
+		return false
+	}
+	getRequestInfo(r.Context()).Type = "geo_policy"
+	if c.Prometheus.Enable {
+		GeoPolicyActions.WithLabelValues(r.Host, rule.Action).Add(1)
+	}
+
+	if rule.Action == GeoBlock {
+		log.Printf("[txtdirect]: %s is blocked for %s by the geo policy", r.Host+r.URL.Path, clientIP(r))
+		status := http.StatusUnavailableForLegalReasons
+		w.Header().Set("Status-Code", strconv.Itoa(status))
+		http.Error(w, http.StatusText(status), status)
+		return true
+	}
+
+	to, err := parsePlaceholders(rule.To, r, []string{})
+	if err != nil {
+		log.Print("Fallback is triggered because an error has occurred: ", err)
+		fallback(w, r, nil, "", "global", 0, c)
+		return true
+	}
+	log.Printf("[txtdirect]: %s > %s (geo policy)", r.Host+r.URL.Path, to)
+	setCacheControl(w, http.StatusFound)
+	w.Header().Add("Status-Code", strconv.Itoa(http.StatusFound))
+	http.Redirect(w, r, to, http.StatusFound)
+	return true
+}
+
+// ParseGeoPolicy parses the tokens of the host's geo_policy block. Every
+// action starts a new rule, the rules can also be separated by semicolons,
+// e.g. block CN,RU ; reroute EU https://eu.example.com{uri}
+func (g *GeoPolicy) ParseGeoPolicy(host string, tokens []string) error {
+	if g.Hosts == nil {
+		g.Hosts = make(map[string][]GeoRule)
+	}
+	var fields []string
+	for _, token := range tokens {
+		for i, part := range strings.Split(token, ";") {
+			if i > 0 || part == GeoBlock || part == GeoReroute {
+				if err := g.addRule(host, fields); err != nil {
+					return err
+				}
+				fields = nil
+			}
+			if part != "" {
+				fields = append(fields, part)
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("the geo policy of %s needs a rule", host)
+	}
+	return g.addRule(host, fields)
+}
+
+// addRule parses a rule's fields and adds it to the host's rules
+func (g *GeoPolicy) addRule(host string, fields []string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	rule := GeoRule{Action: fields[0]}
+	args := fields[1:]
+	switch rule.Action {
+	case GeoBlock:
+	case GeoReroute:
+		if len(args) < 2 {
+			return fmt.Errorf("The given value for reroute field is not standard. It should be the regions followed by a target")
+		}
+		rule.To = args[len(args)-1]
+		args = args[:len(args)-1]
+		if !strings.HasPrefix(rule.To, "http://") && !strings.HasPrefix(rule.To, "https://") {
+			return fmt.Errorf("The given value for reroute field is not standard. The target should be an http or https URL")
+		}
+	default:
+		return fmt.Errorf("unknown geo policy action %s, it should be block or reroute", rule.Action)
+	}
+
+	for _, arg := range args {
+		for _, matcher := range strings.Split(arg, ",") {
+			if matcher == "" {
+				continue
+			}
+			normalized, ok := normalizeGeoMatcher(matcher)
+			if !ok {
+				return fmt.Errorf("The given value for %s field is not standard. %s should be a country code, EU, continent:<code>, AS<number> or *", rule.Action, matcher)
+			}
+			rule.Matchers = append(rule.Matchers, normalized)
+		}
+	}
+	if len(rule.Matchers) == 0 {
+		return fmt.Errorf("the %s rule needs a region", rule.Action)
+	}
+	host = canonicalHost(host)
+	g.Hosts[host] = append(g.Hosts[host], rule)
+	return nil
+}
+
+// normalizeGeoMatcher checks the matcher of a geo policy
+// rule and returns it with its codes in upper case
+func normalizeGeoMatcher(matcher string) (string, bool) {
+	if matcher == "*" {
+		return matcher, true
+	}
+	if code := strings.TrimPrefix(strings.ToLower(matcher), "continent:"); code != strings.ToLower(matcher) {
+		return "continent:" + strings.ToUpper(code), len(code) == 2 && isLetters(code)
+	}
+	matcher = strings.ToUpper(matcher)
+	if len(matcher) > 2 && strings.HasPrefix(matcher, "AS") {
+		_, err := strconv.ParseUint(matcher[2:], 10, 32)
+		return matcher, err == nil
+	}
+	return matcher, len(matcher) == 2 && isLetters(matcher)
+}
+
+// isLetters checks if the value only has ASCII letters
+func isLetters(value string) bool {
+	return strings.Trim(strings.ToUpper(value), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == ""
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestGeoRuleMatches(t *testing.T) {
+	tests := []struct {
+		matchers []string
+		location geoLocation
+		expected bool
+	}{
+		{[]string{"CN", "RU"}, geoLocation{Country: "RU", Continent: "EU"}, true},
+		{[]string{"CN", "RU"}, geoLocation{Country: "DE", Continent: "EU", InEU: true}, false},
+		{[]string{"EU"}, geoLocation{Country: "DE", Continent: "EU", InEU: true}, true},
+		{[]string{"EU"}, geoLocation{Country: "NO", Continent: "EU"}, false},
+		{[]string{"continent:EU"}, geoLocation{Country: "NO", Continent: "EU"}, true},
+		{[]string{"continent:NA"}, geoLocation{Country: "NA", Continent: "AF"}, false},
+		{[]string{"NA"}, geoLocation{Country: "NA", Continent: "AF"}, true},
+		{[]string{"AS64496"}, geoLocation{Country: "US", ASN: 64496}, true},
+		{[]string{"AS64496"}, geoLocation{Country: "US", ASN: 64497}, false},
+		{[]string{"*"}, geoLocation{}, true},
+		{[]string{"US", "EU", "continent:AS", "AS0"}, geoLocation{}, false},
+	}
+	for i, test := range tests {
+		if matches := (GeoRule{Matchers: test.matchers}).matches(test.location); matches != test.expected {
+			t.Errorf("Test %d: Expected %v to match %+v: %t, got %t", i, test.matchers, test.location, test.expected, matches)
+		}
+	}
+}
+
+func TestParseGeoPolicy(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  map[string][]GeoRule
+		shouldErr bool
+	}{
+		{
+			"geo_policy example.com { block CN,RU ; reroute EU https://eu.example.com{uri} }",
+			map[string][]GeoRule{"example.com": {
+				{Action: "block", Matchers: []string{"CN", "RU"}},
+				{Action: "reroute", Matchers: []string{"EU"}, To: "https://eu.example.com{uri}"},
+			}},
+			false,
+		},
+		{
+			`geo_policy Example.com {
+				block cn ru AS64496
+				reroute continent:sa,continent:na https://latam.example.com{uri}
+			}
+			geo_policy * {
+				block KP;
+			}`,
+			map[string][]GeoRule{
+				"example.com": {
+					{Action: "block", Matchers: []string{"CN", "RU", "AS64496"}},
+					{Action: "reroute", Matchers: []string{"continent:SA", "continent:NA"}, To: "https://latam.example.com{uri}"},
+				},
+				"*": {{Action: "block", Matchers: []string{"KP"}}},
+			},
+			false,
+		},
+		{"geo_policy example.com { }", nil, true},
+		{"geo_policy example.com { block }", nil, true},
+		{"geo_policy example.com { block CHN }", nil, true},
+		{"geo_policy example.com { block continent:Europe }", nil, true},
+		{"geo_policy example.com { block ASN1 }", nil, true},
+		{"geo_policy example.com { reroute EU }", nil, true},
+		{"geo_policy example.com { reroute EU eu.example.com }", nil, true},
+		{"geo_policy example.com { allow US }", nil, true},
+		{"geo_policy { block CN }", nil, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			geoip {
+				database testdata/GeoIP2-City-Test.mmdb
+			}
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		conf.GeoIP.Close()
+		if !reflect.DeepEqual(conf.GeoPolicy.Hosts, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.GeoPolicy.Hosts)
+		}
+	}
+
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		geo_policy example.com {
+			block CN
+		}
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for the geo policy without the geoip database")
+	}
+}
+
+func TestGeoPolicyE2e(t *testing.T) {
+	geoip := GeoIP{Enable: true, Database: "testdata/GeoIP2-City-Test.mmdb"}
+	geoip.SetDefaults()
+	if err := geoip.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer geoip.Close()
+
+	tests := []struct {
+		host     string
+		remote   string
+		status   int
+		location string
+	}{
+		// GB
+		{"healthy.health.test", "81.2.69.160:5000", 451, ""},
+		// DE
+		{"healthy.health.test", "[2a02:cf40::1]:5000", 302, "https://eu.example.com/path?q=1"},
+		{"healthy.health.test", "192.0.2.1:5000", 302, "https://healthy.target.test/path?q=1"},
+		// The hosts without rules use the * rules, SE
+		{"healthy.health.test.", "89.160.20.112:5000", 302, "https://healthy.target.test/path?q=1"},
+		{"unhealthy.health.test", "89.160.20.112:5000", 451, ""},
+	}
+	for i, test := range tests {
+		var geoPolicy GeoPolicy
+		geoPolicy.ParseGeoPolicy("healthy.health.test", []string{"block", "GB;", "reroute", "DE,FR", "https://eu.example.com{uri}"})
+		geoPolicy.ParseGeoPolicy("*", []string{"block", "SE"})
+		c := Config{
+			Enable:    []string{"host"},
+			Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+			GeoIP:     geoip,
+			GeoPolicy: geoPolicy,
+		}
+		req := httptest.NewRequest("GET", "https://"+test.host+"/path?q=1", nil)
+		req.RemoteAddr = test.remote
+		w := httptest.NewRecorder()
+		if err := serve(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("Test %d: Expected %d %q, got %d %q", i, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/SchumacherFM/mailout v1.2.0
 	github.com/captncraig/caddy-realip v0.0.0-20170918004412-5dd1f4047d0f
 	github.com/cretz/bine v0.1.0
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/gomods/athens v0.3.1
 	github.com/juju/ratelimit v1.0.1 // indirect
@@ -14,7 +15,9 @@ require (
 	github.com/mholt/caddy v1.0.0-beta2.0.20190420233410-0c3d90ed21a4
 	github.com/miekg/caddy-prometheus v0.0.0-20190322143946-eb0f4d1615b0
 	github.com/miekg/dns v1.1.3
+	github.com/oschwald/geoip2-golang v1.4.0
 	github.com/prometheus/client_golang v0.9.2
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
 	github.com/quasoft/memstore v0.0.0-20180925164028-84a050167438 // indirect
 	github.com/russross/blackfriday v1.5.3-0.20190417191706-f3ccc8fc06d5 // indirect
 	github.com/spf13/afero v1.2.2
@@ -24,4 +27,5 @@ require (
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.2.2
 )
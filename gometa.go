@@ -14,17 +14,24 @@ limitations under the License.
 package txtdirect
 
 import (
+	"encoding/json"
 	"html/template"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
+// gometaVCS are the version control systems the go command supports
+var gometaVCS = []string{"git", "hg", "svn", "bzr", "fossil"}
+
+// gometaDocsURL is the prefix of the modules' documentation links
+const gometaDocsURL = "https://pkg.go.dev/"
+
 var tmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 <html>
 <head>
 <meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.NewURL}}">
-{{if .HasGoSource}}<meta name="go-source" content="{{.Host}}{{.Path}} _ {{.NewURL}}/tree/master{/dir} {{.NewURL}}/blob/master{/dir}/{file}#L{line}">{{end}}
+{{if .HasGoSource}}<meta name="go-source" content="{{.Host}}{{.Path}} {{.Source}} {{.SourceDir}} {{.SourceFile}}">{{end}}
 </head>
 </html>`))
 
@@ -38,7 +45,7 @@ func gometa(w http.ResponseWriter, r record, host, path string) error {
 		path = ""
 	}
 
-	gosource := strings.Contains(r.To, "github.com")
+	source, sourceDir, sourceFile := goSource(r)
 
 	RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusFound)).Add(1)
 	return tmpl.Execute(w, struct {
@@ -47,11 +54,100 @@ func gometa(w http.ResponseWriter, r record, host, path string) error {
 		Vcs         string
 		NewURL      string
 		HasGoSource bool
+		Source      string
+		SourceDir   string
+		SourceFile  string
 	}{
 		host,
 		path,
 		r.Vcs,
 		r.To,
-		gosource,
+		sourceDir != "" && sourceFile != "",
+		source,
+		sourceDir,
+		sourceFile,
 	})
 }
+
+var gometaInfoTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="go-import" content="{{.Module}} {{.VCS}} {{.Repository}}">
+<title>{{.Module}}</title>
+</head>
+<body>
+<h1>{{.Module}}</h1>
+<pre>go get {{.Module}}</pre>
+<ul>
+<li>Documentation: <a href="{{.Docs}}">{{.Docs}}</a></li>
+<li>Repository ({{.VCS}}): <a href="{{.Repository}}">{{.Repository}}</a></li>
+{{- if .Website}}
+<li>Website: <a href="{{.Website}}">{{.Website}}</a></li>
+{{- end}}
+</ul>
+</body>
+</html>`))
+
+// gometaInfo is the module's info shown to the
+// visitors, which aren't the go command
+type gometaInfo struct {
+	Module     string `json:"module"`
+	VCS        string `json:"vcs"`
+	Repository string `json:"repository"`
+	Docs       string `json:"docs"`
+	Website    string `json:"website,omitempty"`
+	SourceDir  string `json:"source_dir,omitempty"`
+	SourceFile string `json:"source_file,omitempty"`
+}
+
+// gometaPage serves the module's info as JSON for the requests
+// accepting application/json and as an HTML page otherwise
+func gometaPage(w http.ResponseWriter, r *http.Request, rec record, host, path string) error {
+	if rec.Vcs == "" {
+		rec.Vcs = "git"
+	}
+	if path == "/" {
+		path = ""
+	}
+	if rec.Docs == "" {
+		rec.Docs = gometaDocsURL + host + path
+	}
+	_, sourceDir, sourceFile := goSource(rec)
+	info := gometaInfo{
+		Module:     host + path,
+		VCS:        rec.Vcs,
+		Repository: rec.To,
+		Docs:       rec.Docs,
+		Website:    rec.Website,
+		SourceDir:  sourceDir,
+		SourceFile: sourceFile,
+	}
+
+	RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusOK)).Add(1)
+	w.Header().Set("Vary", "Accept")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(info)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return gometaInfoTmpl.Execute(w, info)
+}
+
+// goSource returns the go-source meta tag's fields. The record's
+// sourcedir= and sourcefile= templates are used when they're set,
+// otherwise the GitHub templates are used for the git repositories
+// on GitHub. The home defaults to _, it can be set using source=.
+func goSource(r record) (string, string, string) {
+	source := r.Source
+	if source == "" {
+		source = "_"
+	}
+	if r.SourceDir != "" && r.SourceFile != "" {
+		return source, r.SourceDir, r.SourceFile
+	}
+	if r.Vcs == "git" && strings.Contains(r.To, "github.com") {
+		return source, r.To + "/tree/master{/dir}", r.To + "/blob/master{/dir}/{file}#L{line}"
+	}
+	return source, "", ""
+}
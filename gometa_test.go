@@ -14,8 +14,12 @@ limitations under the License.
 package txtdirect
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -80,6 +84,40 @@ func TestGometa(t *testing.T) {
 <head>
 <meta name="go-import" content="root.com/testing git github.com/txtdirect/txtdirect">
 <meta name="go-source" content="root.com/testing _ github.com/txtdirect/txtdirect/tree/master{/dir} github.com/txtdirect/txtdirect/blob/master{/dir}/{file}#L{line}">
+</head>
+</html>`,
+		},
+		{
+			host: "hg.com",
+			path: "/testing",
+			record: record{
+				Vcs:        "hg",
+				To:         "https://hg.example.com/repo",
+				Source:     "https://hg.example.com/repo",
+				SourceDir:  "https://hg.example.com/repo/file/default{/dir}",
+				SourceFile: "https://hg.example.com/repo/file/default{/dir}/{file}#{line}",
+			},
+			expected: `<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="hg.com/testing hg https://hg.example.com/repo">
+<meta name="go-source" content="hg.com/testing https://hg.example.com/repo https://hg.example.com/repo/file/default{/dir} https://hg.example.com/repo/file/default{/dir}/{file}#{line}">
+</head>
+</html>`,
+		},
+		{
+			// GitHub's templates only work for git repositories
+			host: "svn.com",
+			path: "/testing",
+			record: record{
+				Vcs: "svn",
+				To:  "https://github.com/txtdirect/txtdirect",
+			},
+			expected: `<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="svn.com/testing svn https://github.com/txtdirect/txtdirect">
+
 </head>
 </html>`,
 		},
@@ -102,3 +140,141 @@ func TestGometa(t *testing.T) {
 		}
 	}
 }
+
+func TestGometaPage(t *testing.T) {
+	c := Config{
+		Enable:   []string{"path", "gometa"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+
+	tests := []struct {
+		url      string
+		accept   string
+		status   int
+		location string
+		json     *gometaInfo
+		html     string
+	}{
+		{
+			url:    "https://metapath.e2e.test/pkg",
+			status: 200,
+			html:   `<pre>go get metapath.e2e.test/pkg</pre>`,
+		},
+		{
+			url:    "https://metapath.e2e.test/pkg",
+			accept: "application/json",
+			status: 200,
+			json: &gometaInfo{
+				Module:     "metapath.e2e.test/pkg",
+				VCS:        "git",
+				Repository: "https://github.com/okkur/reposeed-server",
+				Docs:       "https://pkg.go.dev/metapath.e2e.test/pkg",
+				SourceDir:  "https://github.com/okkur/reposeed-server/tree/master{/dir}",
+				SourceFile: "https://github.com/okkur/reposeed-server/blob/master{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			url:      "https://metapath.e2e.test/pkgweb",
+			accept:   "text/html",
+			status:   302,
+			location: "https://godoc.org/go.txtdirect.org/txtdirect",
+		},
+		{
+			url:    "https://metapath.e2e.test/pkgweb",
+			accept: "text/html;q=0.9, application/json",
+			status: 200,
+			json: &gometaInfo{
+				Module:     "metapath.e2e.test/pkgweb",
+				VCS:        "git",
+				Repository: "https://github.com/txtdirect/txtdirect",
+				Docs:       "https://pkg.go.dev/metapath.e2e.test/pkgweb",
+				Website:    "https://godoc.org/go.txtdirect.org/txtdirect",
+				SourceDir:  "https://github.com/txtdirect/txtdirect/tree/master{/dir}",
+				SourceFile: "https://github.com/txtdirect/txtdirect/blob/master{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			url:      "https://metapath.e2e.test/pkgdocs",
+			status:   302,
+			location: "https://docs.internal.test/metapath.e2e.test/pkgdocs",
+		},
+		{
+			url:    "https://metapath.e2e.test/pkgdocs",
+			accept: "application/json",
+			status: 200,
+			json: &gometaInfo{
+				Module:     "metapath.e2e.test/pkgdocs",
+				VCS:        "git",
+				Repository: "https://github.com/txtdirect/txtdirect",
+				Docs:       "https://docs.internal.test/metapath.e2e.test/pkgdocs",
+				Website:    "https://txtdirect.org",
+				SourceDir:  "https://github.com/txtdirect/txtdirect/tree/master{/dir}",
+				SourceFile: "https://github.com/txtdirect/txtdirect/blob/master{/dir}/{file}#L{line}",
+			},
+		},
+		{
+			url:    "https://metapath.e2e.test/pkgdocs?go-get=1",
+			status: 200,
+			html:   `<meta name="go-import" content="metapath.e2e.test/pkgdocs git https://github.com/txtdirect/txtdirect">`,
+		},
+		{
+			url:    "https://metapath.e2e.test/pkg?go-get=1",
+			accept: "application/json",
+			status: 200,
+			html:   `<meta name="go-import" content="metapath.e2e.test/pkg git https://github.com/okkur/reposeed-server">`,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("Test %d: Expected %d %q, got %d %q", i, test.status, test.location, w.Code, w.Header().Get("Location"))
+			continue
+		}
+		if test.json != nil {
+			var info gometaInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+				t.Errorf("Test %d: Expected the module's info as JSON, got %s", i, w.Body.String())
+				continue
+			}
+			if !reflect.DeepEqual(info, *test.json) {
+				t.Errorf("Test %d: Expected %+v, got %+v", i, *test.json, info)
+			}
+		}
+		if test.html != "" && !strings.Contains(w.Body.String(), test.html) {
+			t.Errorf("Test %d: Expected the page to contain %s, got %s", i, test.html, w.Body.String())
+		}
+	}
+}
+
+func TestParseGometaRecord(t *testing.T) {
+	c := Config{Enable: []string{"gometa"}}
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+
+	rec := record{}
+	err := rec.Parse("v=txtv0;to=https://fossil.example.com;type=gometa;vcs=fossil;sourcedir=https://fossil.example.com/dir{/dir};sourcefile=https://fossil.example.com/file{/dir}/{file}", req, c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if rec.Vcs != "fossil" || rec.SourceDir != "https://fossil.example.com/dir{/dir}" || rec.SourceFile != "https://fossil.example.com/file{/dir}/{file}" {
+		t.Errorf("Unexpected record %+v", rec)
+	}
+
+	rec = record{}
+	if err := rec.Parse("v=txtv0;to=https://example.com;type=gometa;docs=https://pkg.go.dev/{host}{path}", httptest.NewRequest("GET", "https://example.com/pkg", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if rec.Docs != "https://pkg.go.dev/example.com/pkg" {
+		t.Errorf("Expected the docs with the placeholders replaced, got %s", rec.Docs)
+	}
+
+	rec = record{}
+	if err := rec.Parse("v=txtv0;to=https://example.com;type=gometa;vcs=cvs", req, c); err == nil {
+		t.Errorf("Expected an error for an unsupported vcs")
+	}
+}
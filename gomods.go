@@ -1,3 +1,6 @@
+//go:build !nogomods
+// +build !nogomods
+
 /*
 Copyright 2019 - The TXTDirect Authors
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -18,34 +21,58 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gomods/athens/pkg/download"
 	"github.com/gomods/athens/pkg/download/addons"
+	"github.com/gomods/athens/pkg/errors"
 	"github.com/gomods/athens/pkg/module"
 	"github.com/gomods/athens/pkg/paths"
 	"github.com/gomods/athens/pkg/stash"
 	"github.com/gomods/athens/pkg/storage"
 	"github.com/gomods/athens/pkg/storage/fs"
-	"github.com/mholt/caddy"
 	"github.com/spf13/afero"
 )
 
+func init() {
+	capabilities["gomods"] = true
+}
+
 type Gomods struct {
 	Enable   bool
 	GoBinary string
 	Workers  int
 	Cache    Cache
 	Fs       afero.Fs
+	// Routes selects the upstreams per module pattern
+	Routes []GomodsRoute
+	// CacheHeader adds the X-Cache header to the module responses
+	CacheHeader bool
+	// Private modules are fetched from their VCS with the
+	// credentials in the netrc file and skip the checksum database
+	Private []string
+	Netrc   string
+
+	home *privateHome
 }
 
 type Cache struct {
 	Enable bool
 	Type   string
 	Path   string
+	// MaxSize is the cache's size limit in bytes, the least recently
+	// used module versions get evicted once the cache grows over it
+	MaxSize         int64
+	JanitorInterval time.Duration
+
+	janitor *cacheJanitor
 }
 
 type Module struct {
@@ -61,7 +88,7 @@ type ModuleHandler interface {
 }
 
 var gomodsRegex = regexp.MustCompile("(list|info|mod|zip)")
-var modVersionRegex = regexp.MustCompile("(.*)\\.(info|mod|zip)")
+var modVersionRegex = regexp.MustCompile("(.*)\\.(info|mod|zip|vendor)")
 var DefaultGoBinaryPath = os.Getenv("GOROOT") + "/bin/go"
 
 const (
@@ -83,26 +110,82 @@ func (gomods *Gomods) SetDefaults() {
 		if gomods.Cache.Path == "" {
 			gomods.Cache.Path = afero.GetTempDir(gomods.Fs, "")
 		}
+		if gomods.Cache.MaxSize > 0 {
+			if gomods.Cache.JanitorInterval == 0 {
+				gomods.Cache.JanitorInterval = DefaultGomodsJanitorInterval
+			}
+			if gomods.Cache.janitor == nil {
+				gomods.Cache.janitor = &cacheJanitor{}
+			}
+		}
 	}
 	if gomods.Workers == 0 {
 		gomods.Workers = DefaultGomodsWorkers
 	}
+	if gomods.home == nil {
+		gomods.home = &privateHome{}
+	}
 }
 
-func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error {
+func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) (err error) {
 	m := Module{}
 	if err := m.ParseImportPath(path); err != nil {
 		return fmt.Errorf("module url is empty")
 	}
+	if c.Prometheus.Enable {
+		counter := &gomodsWriter{ResponseWriter: w}
+		w = counter
+		defer func() { observeGomods(m, counter.written, err) }()
+	}
+	// Keep the module version at the end of the eviction order
+	defer c.Gomods.Cache.touch(m)
+
+	// Vendor zips are only built from the cache
+	if m.FileExt == "vendor" {
+		return serveVendor(w, r, m, c)
+	}
+
+	if c.Policy.Enable && c.Gomods.fetchesDirect(m.Name) {
+		host := strings.SplitN(m.Name, "/", 2)[0]
+		if err := c.Policy.checkHost(r.Context(), m.Name, host); err != nil {
+			c.Policy.deny(w, r, err, c)
+			return nil
+		}
+	}
 
 	dp, err := m.fetch(r, c)
 	if err != nil {
 		return err
 	}
 
+	if m.FileExt == "info" || m.FileExt == "mod" || m.FileExt == "zip" {
+		if c.Gomods.CacheHeader || c.Prometheus.Enable {
+			cacheStatus(w, "gomods", m.cached(r, c), c.Gomods.CacheHeader, c)
+		}
+	}
+
+	release, err := c.Adaptive.acquire(r.Context(), "gomods", c)
+	if err != nil {
+		return err
+	}
+	ctx, span := startSpan(r.Context(), "txtdirect.gomods.fetch", spanKindClient)
+	span.setAttribute("gomods.module", m.Name)
+	span.setAttribute("gomods.file", m.FileExt)
+	r = r.WithContext(ctx)
+	// done reports the outcome of the upstream call to the adaptive
+	// limiter, missing modules aren't counted as upstream failures
+	done := func(err error) {
+		span.finish(err)
+		if errors.IsNotFoundErr(err) {
+			err = nil
+		}
+		release(err)
+	}
+
 	switch m.FileExt {
 	case "list":
 		list, err := dp.List(r.Context(), m.Name)
+		done(err)
 		if err != nil {
 			return err
 		}
@@ -113,6 +196,7 @@ func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error
 		return nil
 	case "info":
 		info, err := dp.Info(r.Context(), m.Name, m.Version)
+		done(err)
 		if err != nil {
 			return err
 		}
@@ -123,6 +207,7 @@ func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error
 		return nil
 	case "mod":
 		mod, err := dp.GoMod(r.Context(), m.Name, m.Version)
+		done(err)
 		if err != nil {
 			return err
 		}
@@ -133,6 +218,7 @@ func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error
 		return nil
 	case "zip":
 		zip, err := dp.Zip(r.Context(), m.Name, m.Version)
+		done(err)
 		if err != nil {
 			return err
 		}
@@ -145,6 +231,7 @@ func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error
 		return nil
 	case "latest":
 		info, err := dp.Latest(r.Context(), m.Name)
+		done(err)
 		if err != nil {
 			return err
 		}
@@ -158,14 +245,26 @@ func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error
 		}
 		return nil
 	default:
+		done(nil)
 		return fmt.Errorf("the requested file's extension is not supported")
 	}
 }
 
 func (m Module) fetch(r *http.Request, c Config) (download.Protocol, error) {
-	fetcher, err := module.NewGoGetFetcher(c.Gomods.GoBinary, c.Gomods.Fs)
-	if err != nil {
-		return nil, err
+	var fetcher module.Fetcher
+	switch {
+	case c.Gomods.isPrivate(m.Name):
+		fetcher = &privateFetcher{gomods: &c.Gomods}
+	case len(c.Gomods.Routes) > 0:
+		fetcher = &routeFetcher{gomods: &c.Gomods}
+	default:
+		var err error
+		if fetcher, err = module.NewGoGetFetcher(c.Gomods.GoBinary, c.Gomods.Fs); err != nil {
+			return nil, err
+		}
+	}
+	if c.Prometheus.Enable {
+		fetcher = timedFetcher{fetcher}
 	}
 	s, err := m.storage(c)
 	if err != nil {
@@ -175,6 +274,16 @@ func (m Module) fetch(r *http.Request, c Config) (download.Protocol, error) {
 	return dp, nil
 }
 
+// cached checks if the module version is already in the cache storage
+func (m Module) cached(r *http.Request, c Config) bool {
+	s, err := m.storage(c)
+	if err != nil {
+		return false
+	}
+	exists, err := s.Exists(r.Context(), m.Name, m.Version)
+	return err == nil && exists
+}
+
 func (m Module) storage(c Config) (storage.Backend, error) {
 	switch c.Gomods.Cache.Type {
 	case "local":
@@ -200,7 +309,18 @@ func (m Module) storage(c Config) (storage.Backend, error) {
 }
 
 func (m Module) dp(fetcher module.Fetcher, s storage.Backend, c Config) download.Protocol {
-	lister := download.NewVCSLister(c.Gomods.GoBinary, c.Gomods.Fs)
+	var lister download.UpstreamLister
+	switch {
+	case c.Gomods.isPrivate(m.Name):
+		lister = &privateLister{gomods: &c.Gomods}
+	case len(c.Gomods.Routes) > 0:
+		lister = &routeLister{gomods: &c.Gomods}
+	default:
+		lister = download.NewVCSLister(c.Gomods.GoBinary, c.Gomods.Fs)
+	}
+	if c.Prometheus.Enable {
+		lister = timedLister{lister}
+	}
 	st := stash.New(fetcher, s, stash.WithPool(c.Gomods.Workers), stash.WithSingleflight)
 	dpOpts := &download.Opts{
 		Storage: s,
@@ -254,7 +374,7 @@ func (m *Module) DecodeImportPath() error {
 }
 
 // ParseGomods parses the txtdirect config for gomods
-func (gomods *Gomods) ParseGomods(c *caddy.Controller) error {
+func (gomods *Gomods) ParseGomods(c Dispenser) error {
 	switch c.Val() {
 	case "gobinary":
 		gomods.GoBinary = c.RemainingArgs()[0]
@@ -266,6 +386,50 @@ func (gomods *Gomods) ParseGomods(c *caddy.Controller) error {
 		}
 		gomods.Workers = value
 
+	case "route":
+		// route <pattern> <upstream> [upstreams...]
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		if _, err := path.Match(args[0], ""); err != nil {
+			return fmt.Errorf("The given pattern for route is not standard. It should be a glob pattern")
+		}
+		for _, upstream := range args[1:] {
+			if upstream == upstreamDirect || upstream == upstreamOff {
+				continue
+			}
+			if u, err := url.Parse(upstream); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("The given upstream %s for route is not standard. It should be direct, off or a proxy URL", upstream)
+			}
+		}
+		gomods.Routes = append(gomods.Routes, GomodsRoute{Pattern: args[0], Upstreams: args[1:]})
+
+	case "cache_header":
+		gomods.CacheHeader = true
+
+	case "private":
+		patterns := c.RemainingArgs()
+		if len(patterns) == 0 {
+			return c.ArgErr()
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("The given pattern for private is not standard. It should be a glob pattern")
+			}
+		}
+		gomods.Private = append(gomods.Private, patterns...)
+
+	case "netrc":
+		netrc, err := filepath.Abs(c.RemainingArgs()[0])
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(netrc); err != nil {
+			return fmt.Errorf("couldn't read the gomods netrc file: %s", err.Error())
+		}
+		gomods.Netrc = netrc
+
 	case "cache":
 		gomods.Cache.Enable = true
 		c.NextArg()
@@ -288,14 +452,46 @@ func (gomods *Gomods) ParseGomods(c *caddy.Controller) error {
 }
 
 // ParseCache parses the txtdirect config for gomods cache
-func (cache *Cache) ParseCache(c *caddy.Controller) error {
+func (cache *Cache) ParseCache(c Dispenser) error {
 	switch c.Val() {
 	case "type":
 		cache.Type = c.RemainingArgs()[0]
 	case "path":
 		cache.Path = c.RemainingArgs()[0]
+	case "max_size":
+		value, err := strconv.ParseInt(c.RemainingArgs()[0], 10, 64)
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for max_size field is not standard. It should be a positive integer")
+		}
+		cache.MaxSize = value
+	case "janitor_interval":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for janitor_interval field is not standard. It should be a positive duration")
+		}
+		cache.JanitorInterval = value
 	default:
 		return c.ArgErr() // unhandled option for gomods cache
 	}
 	return nil
 }
+
+// probeGomods checks if the go binary and the module cache are available
+func probeGomods(g Gomods) error {
+	if _, err := os.Stat(g.GoBinary); err != nil {
+		return fmt.Errorf("go binary isn't available: %s", err.Error())
+	}
+	if g.Cache.Enable {
+		if g.Fs == nil {
+			return fmt.Errorf("module cache isn't initialized")
+		}
+		info, err := g.Fs.Stat(g.Cache.Path)
+		if err != nil {
+			return fmt.Errorf("module cache isn't available: %s", err.Error())
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("module cache path %s isn't a directory", g.Cache.Path)
+		}
+	}
+	return nil
+}
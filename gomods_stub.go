@@ -0,0 +1,58 @@
+//go:build nogomods
+// +build nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+)
+
+// Gomods is the config of the Go modules proxy, which
+// isn't compiled into the binaries built with nogomods
+type Gomods struct {
+	Enable bool
+	Cache  Cache
+}
+
+// Cache is the config of the Go modules proxy's cache
+type Cache struct {
+	Enable  bool
+	Type    string
+	MaxSize int64
+}
+
+func (gomods *Gomods) SetDefaults() {}
+
+// ParseGomods fails since the Go modules proxy isn't compiled in
+func (gomods *Gomods) ParseGomods(c Dispenser) error {
+	return errNotCompiled("gomods")
+}
+
+func (cache *Cache) Start() error {
+	return nil
+}
+
+func (cache *Cache) Stop() error {
+	return nil
+}
+
+func gomods(w http.ResponseWriter, r *http.Request, path string, c Config) error {
+	return errNotCompiled("gomods")
+}
+
+func probeGomods(g Gomods) error {
+	return errNotCompiled("gomods")
+}
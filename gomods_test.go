@@ -1,3 +1,6 @@
+//go:build !nogomods
+// +build !nogomods
+
 /*
 Copyright 2019 - The TXTDirect Authors
 Licensed under the Apache License, Version 2.0 (the "License");
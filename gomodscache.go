@@ -0,0 +1,167 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cacheJanitor evicts the least recently used module versions from
+// the gomods cache once it grows over the configured max size
+type cacheJanitor struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// cachedVersion is a module version's directory in the cache storage
+type cachedVersion struct {
+	dir        string
+	size       int64
+	lastAccess time.Time
+}
+
+const DefaultGomodsJanitorInterval = 10 * time.Minute
+
+// touch marks the given module version as recently used. The access
+// time is kept in the go.mod file's mtime, so it survives restarts.
+func (cache *Cache) touch(m Module) {
+	if cache.janitor == nil || m.Version == "" {
+		return
+	}
+	now := time.Now()
+	os.Chtimes(filepath.Join(cache.Path, m.Name, m.Version, "go.mod"), now, now)
+}
+
+// Start evicts the module versions over the max size and
+// starts the janitor which keeps the cache under it
+func (cache *Cache) Start() error {
+	if cache.janitor == nil || cache.janitor.stop != nil {
+		return nil
+	}
+	cache.janitor.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		cache.clean()
+		ticker := time.NewTicker(cache.JanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cache.clean()
+			case <-stop:
+				return
+			}
+		}
+	}(cache.janitor.stop)
+	return nil
+}
+
+// Stop stops the cache janitor
+func (cache *Cache) Stop() error {
+	if cache.janitor == nil || cache.janitor.stop == nil {
+		return nil
+	}
+	close(cache.janitor.stop)
+	cache.janitor.stop = nil
+	return nil
+}
+
+// clean runs a single eviction and logs its errors
+func (cache *Cache) clean() {
+	if _, err := cache.evict(); err != nil {
+		log.Printf("[txtdirect]: Couldn't evict the gomods cache: %s", err.Error())
+	}
+}
+
+// evict removes the least recently used module versions until the cache
+// fits in its max size. It returns the size of the cache after eviction.
+func (cache *Cache) evict() (int64, error) {
+	cache.janitor.Lock()
+	defer cache.janitor.Unlock()
+
+	versions, total, err := cache.versions()
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].lastAccess.Before(versions[j].lastAccess)
+	})
+
+	var evicted int
+	for _, v := range versions {
+		if total <= cache.MaxSize {
+			break
+		}
+		if err := os.RemoveAll(v.dir); err != nil {
+			return total, err
+		}
+		cache.removeEmptyParents(filepath.Dir(v.dir))
+		total -= v.size
+		evicted++
+	}
+
+	if evicted > 0 {
+		log.Printf("[txtdirect]: Evicted %d module versions from the gomods cache", evicted)
+	}
+	return total, nil
+}
+
+// versions lists the module versions in the cache storage
+// with their sizes and returns the cache's total size
+func (cache *Cache) versions() ([]cachedVersion, int64, error) {
+	var versions []cachedVersion
+	var total int64
+	sizes := make(map[string]int64)
+	err := filepath.Walk(cache.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		dir := filepath.Dir(path)
+		sizes[dir] += info.Size()
+		total += info.Size()
+		if info.Name() == "go.mod" {
+			versions = append(versions, cachedVersion{dir: dir, lastAccess: info.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range versions {
+		versions[i].size = sizes[versions[i].dir]
+	}
+	return versions, total, nil
+}
+
+// removeEmptyParents removes the module directories
+// left empty after evicting their last version
+func (cache *Cache) removeEmptyParents(dir string) {
+	root := filepath.Clean(cache.Path)
+	for dir != root && len(dir) > len(root) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,98 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gomods/athens/pkg/storage/fs"
+	"github.com/spf13/afero"
+)
+
+func TestCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomods-eviction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := fs.NewStorage(dir, afero.NewOsFs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := Cache{Enable: true, Type: "local", Path: dir, janitor: &cacheJanitor{}}
+
+	// Every version takes 100 bytes on the disk
+	modules := []Module{
+		{Name: "example.com/old", Version: "v1.0.0"},
+		{Name: "example.com/used", Version: "v1.0.0"},
+		{Name: "example.com/new", Version: "v1.0.0"},
+	}
+	for i, m := range modules {
+		zip := bytes.Repeat([]byte("z"), 100-len("module x")-len("{}"))
+		if err := s.Save(context.Background(), m.Name, m.Version, []byte("module x"), bytes.NewReader(zip), []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		accessed := time.Now().Add(time.Duration(i-len(modules)) * time.Hour)
+		os.Chtimes(filepath.Join(dir, m.Name, m.Version, "go.mod"), accessed, accessed)
+	}
+	// Using the oldest version moves it to the end of the eviction order
+	cache.touch(modules[1])
+	cache.touch(Module{Name: "example.com/old", Version: ""})
+
+	cache.MaxSize = 300
+	if size, err := cache.evict(); err != nil || size != 300 {
+		t.Fatalf("Expected nothing to be evicted under the max size, got %d: %v", size, err)
+	}
+
+	cache.MaxSize = 250
+	size, err := cache.evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 200 {
+		t.Errorf("Expected the cache size to be 200 after eviction, got %d", size)
+	}
+	if exists, _ := s.Exists(context.Background(), "example.com/old", "v1.0.0"); exists {
+		t.Errorf("Expected the least recently used version to be evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com/old")); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty module directory to be removed")
+	}
+	for _, m := range modules[1:] {
+		if exists, _ := s.Exists(context.Background(), m.Name, m.Version); !exists {
+			t.Errorf("Expected %s to be kept in the cache", m.Name)
+		}
+	}
+
+	cache.MaxSize = 150
+	if _, err := cache.evict(); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := s.Exists(context.Background(), "example.com/new", "v1.0.0"); exists {
+		t.Errorf("Expected example.com/new to be evicted before the recently used version")
+	}
+	if exists, _ := s.Exists(context.Background(), "example.com/used", "v1.0.0"); !exists {
+		t.Errorf("Expected the recently used version to be kept in the cache")
+	}
+}
@@ -0,0 +1,125 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gomods/athens/pkg/download"
+	"github.com/gomods/athens/pkg/errors"
+	"github.com/gomods/athens/pkg/module"
+	"github.com/gomods/athens/pkg/storage"
+)
+
+// gomodsWriter counts the bytes of the module responses
+type gomodsWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (g *gomodsWriter) Write(b []byte) (int, error) {
+	n, err := g.ResponseWriter.Write(b)
+	g.written += int64(n)
+	return n, err
+}
+
+// Flush sends the buffered response to the client
+func (g *gomodsWriter) Flush() {
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// gomodsResult classifies the outcome of a module request
+// for the metrics, e.g. ok, not_found or timeout
+func gomodsResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if errors.IsNotFoundErr(err) {
+		return "not_found"
+	}
+	switch errors.Kind(err) {
+	case errors.KindRateLimit:
+		return "rate_limited"
+	case errors.KindBadRequest:
+		return "bad_request"
+	}
+	// The Athens errors wrap the errors of the upstreams
+	for {
+		e, ok := err.(errors.Error)
+		if !ok || e.Err == nil {
+			break
+		}
+		err = e.Err
+	}
+	switch {
+	case err == context.Canceled:
+		return "canceled"
+	case isTimeout(err):
+		return "timeout"
+	}
+	return "error"
+}
+
+// gomodsMetricFiles are the module files labeled in the metrics
+var gomodsMetricFiles = []string{"info", "mod", "zip", "vendor", "list", "latest"}
+
+// observeGomods records the metrics of the handled module request. The
+// module paths and files come from the requests, so only the served
+// modules and the known files are labeled and the rest are counted as
+// other, the clients can't create unbounded series.
+func observeGomods(m Module, written int64, err error) {
+	name, file, result := "other", "other", gomodsResult(err)
+	if result == "ok" {
+		name = m.Name
+	}
+	if contains(gomodsMetricFiles, m.FileExt) {
+		file = m.FileExt
+	}
+	GomodsRequests.WithLabelValues(name, file, result).Add(1)
+	if written > 0 {
+		GomodsBytesServed.WithLabelValues(file).Add(float64(written))
+	}
+}
+
+// timedFetcher records the latency of the module downloads
+// from the upstreams, the cached versions aren't fetched
+type timedFetcher struct {
+	module.Fetcher
+}
+
+func (f timedFetcher) Fetch(ctx context.Context, mod, ver string) (*storage.Version, error) {
+	start := time.Now()
+	v, err := f.Fetcher.Fetch(ctx, mod, ver)
+	GomodsUpstreamDuration.WithLabelValues("fetch", gomodsResult(err)).Observe(time.Since(start).Seconds())
+	return v, err
+}
+
+// timedLister records the latency of the version lists from the upstreams
+type timedLister struct {
+	download.UpstreamLister
+}
+
+func (l timedLister) List(ctx context.Context, mod string) (*storage.RevInfo, []string, error) {
+	start := time.Now()
+	latest, versions, err := l.UpstreamLister.List(ctx, mod)
+	GomodsUpstreamDuration.WithLabelValues("list", gomodsResult(err)).Observe(time.Since(start).Seconds())
+	return latest, versions, err
+}
@@ -0,0 +1,121 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gomods/athens/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestGomodsResult(t *testing.T) {
+	const op errors.Op = "test"
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{nil, "ok"},
+		{errors.E(op, errors.KindNotFound, "missing"), "not_found"},
+		{errors.E(op, errors.KindRateLimit, "slow down"), "rate_limited"},
+		{errors.E(op, errors.KindBadRequest, "invalid version"), "bad_request"},
+		{errors.E(op, context.DeadlineExceeded), "timeout"},
+		{errors.E(op, errors.E(op, context.Canceled)), "canceled"},
+		{context.DeadlineExceeded, "timeout"},
+		{errors.E(op, "disk full"), "error"},
+	}
+	for i, test := range tests {
+		if result := gomodsResult(test.err); result != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, result)
+		}
+	}
+}
+
+// histogramCount returns the number of observations of the histogram
+func histogramCount(t *testing.T, observer prometheus.Observer) uint64 {
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestGomodsMetrics(t *testing.T) {
+	proxy := moduleProxy(t, "example.com/!metrics/lib")
+	defer proxy.Close()
+	dir, err := ioutil.TempDir("", "txtdirect-gomods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		Prometheus: Prometheus{Enable: true},
+		Gomods: Gomods{
+			Enable: true,
+			Routes: []GomodsRoute{{Pattern: "*", Upstreams: []string{proxy.URL}}},
+			Cache:  Cache{Enable: true, Type: "local", Path: dir},
+		},
+	}
+	c.Gomods.SetDefaults()
+
+	ok := GomodsRequests.WithLabelValues("example.com/Metrics/lib", "mod", "ok")
+	// The failed requests' module paths aren't labeled
+	missing := GomodsRequests.WithLabelValues("other", "mod", "not_found")
+	served := GomodsBytesServed.WithLabelValues("mod")
+	fetches := GomodsUpstreamDuration.WithLabelValues("fetch", "ok")
+	before := []float64{testutil.ToFloat64(ok), testutil.ToFloat64(missing), testutil.ToFloat64(served)}
+	fetchesBefore := histogramCount(t, fetches)
+
+	unlabeled := GomodsRequests.WithLabelValues("example.com/Metrics/lib", "mod", "not_found")
+	for _, path := range []string{"/example.com/!metrics/lib/@v/v1.1.0.mod", "/example.com/!metrics/lib/@v/v1.1.0.mod", "/example.com/!metrics/lib/@v/v9.9.9.mod"} {
+		gomods(httptest.NewRecorder(), httptest.NewRequest("GET", "https://example.com"+path, nil), path, c)
+	}
+
+	if count := testutil.ToFloat64(ok) - before[0]; count != 2 {
+		t.Errorf("Expected 2 successful requests, got %v", count)
+	}
+	if count := testutil.ToFloat64(missing) - before[1]; count != 1 {
+		t.Errorf("Expected 1 missing version, got %v", count)
+	}
+	if count := testutil.ToFloat64(unlabeled); count != 0 {
+		t.Errorf("Expected the missing module's path not to be labeled, got %v", count)
+	}
+	if bytes := testutil.ToFloat64(served) - before[2]; bytes != float64(2*len("module example.com/!metrics/lib\n")) {
+		t.Errorf("Expected the bytes of both go.mod files to be counted, got %v", bytes)
+	}
+	// The second request is served from the cache
+	if count := histogramCount(t, fetches) - fetchesBefore; count != 1 {
+		t.Errorf("Expected 1 upstream fetch, got %d", count)
+	}
+}
+
+func TestGomodsWriterFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	g := &gomodsWriter{ResponseWriter: w}
+	g.Write([]byte("module"))
+	g.Flush()
+	if !w.Flushed || g.written != 6 {
+		t.Errorf("Expected the module response to be flushed through, got %d bytes", g.written)
+	}
+}
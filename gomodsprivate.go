@@ -0,0 +1,185 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomods/athens/pkg/errors"
+	"github.com/gomods/athens/pkg/module"
+	"github.com/gomods/athens/pkg/storage"
+	"github.com/spf13/afero"
+)
+
+// privateHome is the HOME directory of the go commands fetching the
+// private modules. It only holds a link to the netrc file, since git
+// only reads the credentials from $HOME/.netrc.
+type privateHome struct {
+	sync.Once
+	dir string
+	err error
+}
+
+// goModule is the output of go mod download -json
+type goModule struct {
+	Version string
+	Error   string
+	Info    string
+	GoMod   string
+	Zip     string
+}
+
+// goModuleList is the output of go list -m -versions -json
+type goModuleList struct {
+	Version  string
+	Versions []string
+	Time     time.Time
+}
+
+// isPrivate checks if the given module matches any of the private patterns
+func (gomods *Gomods) isPrivate(mod string) bool {
+	for _, pattern := range gomods.Private {
+		if matchModulePattern(pattern, mod) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateEnv returns the environment of the go commands fetching the
+// private modules. The modules are always fetched from their VCS and
+// skip the checksum database, so their paths don't leak to the public
+// proxy and sumdb.
+func (gomods *Gomods) privateEnv(gopath string) ([]string, error) {
+	env := append(module.PrepareEnv(gopath),
+		"GOPRIVATE="+strings.Join(gomods.Private, ","),
+		"GONOSUMDB="+strings.Join(gomods.Private, ","),
+		"GOPROXY=direct",
+		"GIT_TERMINAL_PROMPT=0",
+	)
+	if gomods.Netrc == "" {
+		return env, nil
+	}
+
+	gomods.home.Do(func() {
+		gomods.home.dir, gomods.home.err = ioutil.TempDir("", "txtdirect-gomods-home")
+		if gomods.home.err != nil {
+			return
+		}
+		gomods.home.err = os.Symlink(gomods.Netrc, filepath.Join(gomods.home.dir, ".netrc"))
+	})
+	if gomods.home.err != nil {
+		return nil, fmt.Errorf("couldn't link the netrc file for the private modules: %s", gomods.home.err.Error())
+	}
+	// exec uses the last value of the duplicate variables
+	return append(env, "NETRC="+gomods.Netrc, "HOME="+gomods.home.dir), nil
+}
+
+// runGo runs the go command with the private modules' environment in
+// a temporary module and decodes its JSON output into the given value
+func (gomods *Gomods) runGo(ctx context.Context, gopath string, v interface{}, args ...string) error {
+	dir, err := afero.TempDir(gomods.Fs, "", "txtdirect-private")
+	if err != nil {
+		return err
+	}
+	defer gomods.Fs.RemoveAll(dir)
+	if err := module.Dummy(gomods.Fs, dir); err != nil {
+		return err
+	}
+
+	env, err := gomods.privateEnv(gopath)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, gomods.GoBinary, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), stderr.String())
+	}
+	return json.NewDecoder(&stdout).Decode(v)
+}
+
+// privateFetcher fetches the private modules from their VCS
+type privateFetcher struct {
+	gomods *Gomods
+}
+
+// privateLister lists the private modules' versions from their VCS
+type privateLister struct {
+	gomods *Gomods
+}
+
+func (f *privateFetcher) Fetch(ctx context.Context, mod, ver string) (*storage.Version, error) {
+	const op errors.Op = "privateFetcher.Fetch"
+	gopath, err := afero.TempDir(f.gomods.Fs, "", "txtdirect-gopath")
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	defer module.ClearFiles(f.gomods.Fs, gopath)
+
+	var m goModule
+	if err := f.gomods.runGo(ctx, gopath, &m, "mod", "download", "-json", mod+"@"+ver); err != nil {
+		return nil, errors.E(op, errors.M(mod), errors.V(ver), err)
+	}
+	if m.Error != "" {
+		return nil, errors.E(op, errors.M(mod), errors.V(ver), m.Error)
+	}
+
+	v := &storage.Version{Semver: m.Version}
+	if v.Info, err = afero.ReadFile(f.gomods.Fs, m.Info); err != nil {
+		return nil, errors.E(op, err)
+	}
+	if v.Mod, err = afero.ReadFile(f.gomods.Fs, m.GoMod); err != nil {
+		return nil, errors.E(op, err)
+	}
+	// The zip is read before the GOPATH gets removed
+	zip, err := afero.ReadFile(f.gomods.Fs, m.Zip)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	v.Zip = ioutil.NopCloser(bytes.NewReader(zip))
+	return v, nil
+}
+
+func (l *privateLister) List(ctx context.Context, mod string) (*storage.RevInfo, []string, error) {
+	const op errors.Op = "privateLister.List"
+	gopath, err := afero.TempDir(l.gomods.Fs, "", "txtdirect-gopath")
+	if err != nil {
+		return nil, nil, errors.E(op, err)
+	}
+	defer module.ClearFiles(l.gomods.Fs, gopath)
+
+	var list goModuleList
+	if err := l.gomods.runGo(ctx, gopath, &list, "list", "-m", "-versions", "-json", mod+"@latest"); err != nil {
+		return nil, nil, errors.E(op, errors.M(mod), err)
+	}
+	return &storage.RevInfo{Version: list.Version, Time: list.Time}, list.Versions, nil
+}
@@ -0,0 +1,128 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/spf13/afero"
+)
+
+func TestGomodsPrivate(t *testing.T) {
+	gomods := Gomods{Private: []string{"github.com/corp/*", "*.corp.example.com"}}
+	tests := []struct {
+		mod     string
+		private bool
+	}{
+		{"github.com/corp/lib", true},
+		{"git.corp.example.com/team/lib", true},
+		{"github.com/public/lib", false},
+		{"golang.org/x/text", false},
+	}
+	for i, test := range tests {
+		if private := gomods.isPrivate(test.mod); private != test.private {
+			t.Errorf("Test %d: Expected %s to be private: %t, got %t", i, test.mod, test.private, private)
+		}
+	}
+}
+
+func TestPrivateLister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomods-private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	netrc := filepath.Join(dir, "netrc")
+	ioutil.WriteFile(netrc, []byte("machine git.corp.example.com login bot password secret\n"), 0600)
+
+	// The fake go binary only lists the versions when the
+	// private module's environment is set up correctly
+	goBinary := filepath.Join(dir, "go")
+	script := fmt.Sprintf(`#!/bin/sh
+[ "$GOPRIVATE" = "git.corp.example.com" ] || exit 1
+[ "$GONOSUMDB" = "git.corp.example.com" ] || exit 1
+[ "$GOPROXY" = "direct" ] || exit 1
+[ "$NETRC" = "%s" ] || exit 1
+grep -q secret "$HOME/.netrc" || exit 1
+[ "$*" = "list -m -versions -json git.corp.example.com/lib@latest" ] || exit 1
+echo '{"Version":"v1.1.0","Versions":["v1.0.0","v1.1.0"]}'
+`, netrc)
+	if err := ioutil.WriteFile(goBinary, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	gomods := &Gomods{
+		GoBinary: goBinary,
+		Fs:       afero.NewOsFs(),
+		Private:  []string{"git.corp.example.com"},
+		Netrc:    netrc,
+		home:     &privateHome{},
+	}
+	latest, versions, err := (&privateLister{gomods: gomods}).List(context.Background(), "git.corp.example.com/lib")
+	if err != nil {
+		t.Fatalf("Expected the versions to be listed, got %s", err.Error())
+	}
+	if latest.Version != "v1.1.0" || !identical(versions, []string{"v1.0.0", "v1.1.0"}) {
+		t.Errorf("Unexpected versions %v and latest %+v", versions, latest)
+	}
+	defer os.RemoveAll(gomods.home.dir)
+}
+
+func TestParseGomodsPrivate(t *testing.T) {
+	file, err := ioutil.TempFile("", "netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	c := caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		enable gomods
+		gomods {
+			private github.com/corp/* *.corp.example.com
+			netrc %s
+		}
+	}
+	`, file.Name()))
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !identical(conf.Gomods.Private, []string{"github.com/corp/*", "*.corp.example.com"}) || conf.Gomods.Netrc != file.Name() {
+		t.Errorf("Expected the private modules to be configured, got %+v", conf.Gomods)
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable gomods
+		gomods {
+			netrc /nonexistent/netrc
+		}
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for a missing netrc file")
+	}
+}
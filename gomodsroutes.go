@@ -0,0 +1,230 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gomods/athens/pkg/download"
+	"github.com/gomods/athens/pkg/errors"
+	"github.com/gomods/athens/pkg/module"
+	"github.com/gomods/athens/pkg/storage"
+)
+
+// GomodsRoute selects the upstreams of the modules matching the pattern.
+// The upstreams are tried in order like the GOPROXY list: "direct" fetches
+// the module from its VCS, "off" refuses to fetch it and the other values
+// are module proxy URLs. The next upstream is only tried when the previous
+// one doesn't have the module.
+type GomodsRoute struct {
+	Pattern   string
+	Upstreams []string
+}
+
+const (
+	upstreamDirect = "direct"
+	upstreamOff    = "off"
+)
+
+// gomodsProxyClient is used for the requests to the upstream module proxies
+var gomodsProxyClient = &http.Client{Timeout: 5 * time.Minute}
+
+// route returns the upstreams of the given module. The
+// first route with a matching pattern wins.
+func (gomods *Gomods) route(mod string) []string {
+	for _, route := range gomods.Routes {
+		if matchModulePattern(route.Pattern, mod) {
+			return route.Upstreams
+		}
+	}
+	return []string{upstreamDirect}
+}
+
+// fetchesDirect checks if the module can be fetched from its VCS
+// based on its path, the private modules are trusted by the config
+func (gomods *Gomods) fetchesDirect(mod string) bool {
+	return !gomods.isPrivate(mod) && contains(gomods.route(mod), upstreamDirect)
+}
+
+// matchModulePattern checks if the given glob pattern matches the module
+// path or one of its prefixes, the same way as GOPRIVATE patterns do
+func matchModulePattern(pattern, mod string) bool {
+	patternElems := strings.Count(pattern, "/") + 1
+	elems := strings.Split(mod, "/")
+	if len(elems) < patternElems {
+		return false
+	}
+	matched, err := path.Match(pattern, strings.Join(elems[:patternElems], "/"))
+	return err == nil && matched
+}
+
+// routeFetcher fetches the modules from the upstreams of their routes
+type routeFetcher struct {
+	gomods *Gomods
+}
+
+// routeLister lists the module versions from the upstreams of their routes
+type routeLister struct {
+	gomods *Gomods
+}
+
+func (f *routeFetcher) Fetch(ctx context.Context, mod, ver string) (*storage.Version, error) {
+	const op errors.Op = "routeFetcher.Fetch"
+	var err error
+	for _, upstream := range f.gomods.route(mod) {
+		var v *storage.Version
+		switch upstream {
+		case upstreamOff:
+			return nil, errors.E(op, errors.M(mod), errors.V(ver), errors.KindNotFound, "module fetching is turned off for this module")
+		case upstreamDirect:
+			var fetcher module.Fetcher
+			if fetcher, err = module.NewGoGetFetcher(f.gomods.GoBinary, f.gomods.Fs); err != nil {
+				return nil, err
+			}
+			v, err = fetcher.Fetch(ctx, mod, ver)
+		default:
+			v, err = proxyFetch(ctx, upstream, mod, ver)
+		}
+		if err == nil || !errors.IsNotFoundErr(err) {
+			return v, err
+		}
+	}
+	return nil, err
+}
+
+func (l *routeLister) List(ctx context.Context, mod string) (*storage.RevInfo, []string, error) {
+	const op errors.Op = "routeLister.List"
+	var err error
+	for _, upstream := range l.gomods.route(mod) {
+		var latest *storage.RevInfo
+		var versions []string
+		switch upstream {
+		case upstreamOff:
+			return nil, nil, errors.E(op, errors.M(mod), errors.KindNotFound, "module fetching is turned off for this module")
+		case upstreamDirect:
+			latest, versions, err = download.NewVCSLister(l.gomods.GoBinary, l.gomods.Fs).List(ctx, mod)
+		default:
+			latest, versions, err = proxyList(ctx, upstream, mod)
+		}
+		if err == nil || !errors.IsNotFoundErr(err) {
+			return latest, versions, err
+		}
+	}
+	return nil, nil, err
+}
+
+// proxyFetch downloads the given module version from the module proxy
+func proxyFetch(ctx context.Context, proxy, mod, ver string) (*storage.Version, error) {
+	base := fmt.Sprintf("%s/%s/@v/%s", strings.TrimSuffix(proxy, "/"), encodeModulePath(mod), encodeModulePath(ver))
+	info, err := proxyGet(ctx, base+".info")
+	if err != nil {
+		return nil, err
+	}
+	gomod, err := proxyGet(ctx, base+".mod")
+	if err != nil {
+		return nil, err
+	}
+	zip, err := proxyGet(ctx, base+".zip")
+	if err != nil {
+		return nil, err
+	}
+
+	var rev storage.RevInfo
+	if err := json.Unmarshal(info, &rev); err != nil {
+		return nil, fmt.Errorf("couldn't decode the version info from %s: %s", proxy, err.Error())
+	}
+	return &storage.Version{
+		Semver: rev.Version,
+		Info:   info,
+		Mod:    gomod,
+		Zip:    ioutil.NopCloser(bytes.NewReader(zip)),
+	}, nil
+}
+
+// proxyList lists the versions of the given module from the module proxy
+func proxyList(ctx context.Context, proxy, mod string) (*storage.RevInfo, []string, error) {
+	base := fmt.Sprintf("%s/%s/@", strings.TrimSuffix(proxy, "/"), encodeModulePath(mod))
+	list, err := proxyGet(ctx, base+"v/list")
+	if err != nil {
+		return nil, nil, err
+	}
+	versions := strings.Fields(string(list))
+
+	// Modules without tagged versions only have a latest pseudo-version
+	var latest *storage.RevInfo
+	if info, err := proxyGet(ctx, base+"latest"); err == nil {
+		latest = &storage.RevInfo{}
+		if err := json.Unmarshal(info, latest); err != nil {
+			latest = nil
+		}
+	}
+	return latest, versions, nil
+}
+
+// proxyGet fetches the given URL from a module proxy. Missing
+// modules result in not found errors like in the proxy protocol.
+func proxyGet(ctx context.Context, url string) (body []byte, err error) {
+	const op errors.Op = "gomods.proxyGet"
+	ctx, span := startSpan(ctx, "txtdirect.gomods.proxy_get", spanKindClient)
+	span.setAttribute("http.url", url)
+	defer func() { span.finish(err) }()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	injectTrace(ctx, req.Header)
+	resp, err := gomodsProxyClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, errors.E(op, errors.KindNotFound, fmt.Sprintf("%s responded with %d", url, resp.StatusCode))
+	default:
+		return nil, errors.E(op, fmt.Sprintf("%s responded with %d", url, resp.StatusCode))
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	return body, nil
+}
+
+// encodeModulePath escapes the upper case letters of the given module
+// path or version the way the module proxy protocol expects them
+func encodeModulePath(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
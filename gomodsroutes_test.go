@@ -0,0 +1,147 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gomods/athens/pkg/errors"
+)
+
+func TestMatchModulePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		mod     string
+		matches bool
+	}{
+		{"github.com/corp/*", "github.com/corp/lib", true},
+		{"github.com/corp/*", "github.com/corp/lib/v2", true},
+		{"github.com/corp/*", "github.com/other/lib", false},
+		{"github.com/corp/*", "github.com/corp", false},
+		{"*.corp.example.com", "git.corp.example.com/team/lib", true},
+		{"*", "golang.org/x/text", true},
+		{"golang.org/x/text", "golang.org/x/text", true},
+		{"golang.org/x/text", "golang.org/x/textual", false},
+	}
+	for i, test := range tests {
+		if got := matchModulePattern(test.pattern, test.mod); got != test.matches {
+			t.Errorf("Test %d: Expected %s matching %s to be %t, got %t", i, test.pattern, test.mod, test.matches, got)
+		}
+	}
+}
+
+func TestGomodsRoute(t *testing.T) {
+	gomods := Gomods{
+		Routes: []GomodsRoute{
+			{Pattern: "github.com/corp/*", Upstreams: []string{"direct"}},
+			{Pattern: "*", Upstreams: []string{"https://proxy.golang.org", "direct"}},
+		},
+	}
+	if got := gomods.route("github.com/corp/lib"); !identical(got, []string{"direct"}) {
+		t.Errorf("Expected the corp module to be fetched directly, got %v", got)
+	}
+	if got := gomods.route("golang.org/x/text"); !identical(got, []string{"https://proxy.golang.org", "direct"}) {
+		t.Errorf("Expected the module to be fetched from the proxy first, got %v", got)
+	}
+	if got := (&Gomods{}).route("golang.org/x/text"); !identical(got, []string{"direct"}) {
+		t.Errorf("Expected the modules to be fetched directly without routes, got %v", got)
+	}
+}
+
+// moduleProxy serves a single module version like a module proxy
+func moduleProxy(t *testing.T, mod string) *httptest.Server {
+	files := map[string]string{
+		"/" + mod + "/@v/list":        "v1.0.0\nv1.1.0\n",
+		"/" + mod + "/@latest":        `{"Version":"v1.1.0"}`,
+		"/" + mod + "/@v/v1.1.0.info": `{"Version":"v1.1.0"}`,
+		"/" + mod + "/@v/v1.1.0.mod":  "module " + mod + "\n",
+		"/" + mod + "/@v/v1.1.0.zip":  "zip",
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestRouteFetcher(t *testing.T) {
+	empty := moduleProxy(t, "example.com/other")
+	defer empty.Close()
+	proxy := moduleProxy(t, "example.com/!corp/lib")
+	defer proxy.Close()
+
+	gomods := &Gomods{
+		Routes: []GomodsRoute{
+			{Pattern: "example.com/off", Upstreams: []string{"off"}},
+			{Pattern: "*", Upstreams: []string{empty.URL, proxy.URL}},
+		},
+	}
+
+	v, err := (&routeFetcher{gomods: gomods}).Fetch(context.Background(), "example.com/Corp/lib", "v1.1.0")
+	if err != nil {
+		t.Fatalf("Expected the module to be fetched from the second proxy, got %s", err.Error())
+	}
+	zip, _ := ioutil.ReadAll(v.Zip)
+	if v.Semver != "v1.1.0" || string(v.Mod) != "module example.com/!corp/lib\n" || string(zip) != "zip" {
+		t.Errorf("Unexpected module version %+v", v)
+	}
+
+	latest, versions, err := (&routeLister{gomods: gomods}).List(context.Background(), "example.com/Corp/lib")
+	if err != nil {
+		t.Fatalf("Expected the versions to be listed from the second proxy, got %s", err.Error())
+	}
+	if latest == nil || latest.Version != "v1.1.0" || !identical(versions, []string{"v1.0.0", "v1.1.0"}) {
+		t.Errorf("Unexpected versions %v and latest %+v", versions, latest)
+	}
+
+	if _, err := (&routeFetcher{gomods: gomods}).Fetch(context.Background(), "example.com/missing", "v1.0.0"); !errors.IsNotFoundErr(err) {
+		t.Errorf("Expected a not found error for a module missing from all the proxies, got %v", err)
+	}
+	if _, err := (&routeFetcher{gomods: gomods}).Fetch(context.Background(), "example.com/off", "v1.0.0"); !errors.IsNotFoundErr(err) {
+		t.Errorf("Expected a not found error for a turned off module, got %v", err)
+	}
+}
+
+func TestProxyGetTracing(t *testing.T) {
+	var traceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	tracing := Tracing{Enable: true}
+	tracing.SetDefaults()
+	req, span := tracing.startRequest(httptest.NewRequest("GET", "https://example.com/", nil))
+	if span == nil {
+		t.Fatalf("Expected the request to be sampled")
+	}
+	if _, err := proxyGet(req.Context(), upstream.URL); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(traceparent)
+	if !ok || !sampled || traceID != span.traceID || parentID == span.spanID {
+		t.Errorf("Expected the upstream request to carry the trace, got %q", traceparent)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// headerPrefix starts the record fields which add response headers,
+// e.g. header-Cache-Control=no-store
+const headerPrefix = "header-"
+
+// headerNameRegex matches the valid HTTP header names
+var headerNameRegex = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// reservedHeaders can't be set by the records, they're
+// managed by TXTDirect or by the HTTP server itself
+var reservedHeaders = []string{"Location", "Status-Code", "Content-Length", "Transfer-Encoding", "Connection"}
+
+// redirectCodes are the status codes the records may redirect with
+var redirectCodes = []int{
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// parseHeader parses a header-<name>=<value> field of a record
+func parseHeader(field string) (string, string, error) {
+	nameValue := strings.SplitN(strings.TrimPrefix(field, headerPrefix), "=", 2)
+	if len(nameValue) != 2 || !headerNameRegex.MatchString(nameValue[0]) {
+		return "", "", fmt.Errorf("could not parse header field: %s", field)
+	}
+	name := http.CanonicalHeaderKey(nameValue[0])
+	if contains(reservedHeaders, name) {
+		return "", "", fmt.Errorf("%s header can't be set by the record", name)
+	}
+	if strings.ContainsAny(nameValue[1], "\r\n") {
+		return "", "", fmt.Errorf("invalid value for %s header", name)
+	}
+	return name, nameValue[1], nil
+}
+
+// validRedirectCode checks if the records may redirect with the given code
+func validRedirectCode(code int) bool {
+	for _, redirectCode := range redirectCodes {
+		if code == redirectCode {
+			return true
+		}
+	}
+	return false
+}
+
+// methodPreservingCode returns the status code of the record's redirect
+// for the request. Clients may change the method of the other requests
+// to GET when following a 301, so they're redirected with a 308 instead
+// if the option or the record asks for it.
+func methodPreservingCode(r *http.Request, rec record, c Config) int {
+	preserve := c.PreserveMethod
+	if rec.PreserveMethod != nil {
+		preserve = *rec.PreserveMethod
+	}
+	if !preserve || rec.Code != http.StatusMovedPermanently ||
+		r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return rec.Code
+	}
+	return http.StatusPermanentRedirect
+}
+
+// setHeaders attaches the record's headers to the response
+func setHeaders(w http.ResponseWriter, rec record) {
+	for name, values := range rec.Headers {
+		w.Header()[name] = values
+	}
+	if rec.NoIndex && !hasRobotsDirective(w.Header(), "noindex") {
+		w.Header().Add("X-Robots-Tag", "noindex")
+	}
+}
+
+// hasRobotsDirective checks if the X-Robots-Tag headers hold the directive
+func hasRobotsDirective(header http.Header, directive string) bool {
+	for _, value := range header["X-Robots-Tag"] {
+		for _, d := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setCacheControl adds the cache lifetime of the permanent redirects,
+// unless the record already controls the caching of the response
+func setCacheControl(w http.ResponseWriter, code int) {
+	if code == http.StatusMovedPermanently && w.Header().Get("Cache-Control") == "" {
+		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		field     string
+		name      string
+		value     string
+		shouldErr bool
+	}{
+		{"header-Cache-Control=no-store", "Cache-Control", "no-store", false},
+		{"header-x-frame-options=DENY", "X-Frame-Options", "DENY", false},
+		{"header-Link=<https://example.com>; rel=preload", "Link", "<https://example.com>; rel=preload", false},
+		{"header-Location=https://example.com", "", "", true},
+		{"header-Bad Name=value", "", "", true},
+		{"header-Cache-Control", "", "", true},
+	}
+	for i, test := range tests {
+		name, value, err := parseHeader(test.field)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if name != test.name || value != test.value {
+			t.Errorf("Test %d: Expected %s: %s, got %s: %s", i, test.name, test.value, name, value)
+		}
+	}
+}
+
+func TestRecordCodes(t *testing.T) {
+	c := Config{Enable: []string{"host", "sinkhole"}}
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	for _, code := range []int{300, 301, 302, 303, 307, 308} {
+		rec := record{}
+		if err := rec.Parse("v=txtv0;to=https://example.com;code="+strconv.Itoa(code), req, c); err != nil {
+			t.Errorf("Unexpected error for %d: %s", code, err)
+		}
+	}
+	for _, code := range []int{200, 304, 404} {
+		rec := record{}
+		if err := rec.Parse("v=txtv0;to=https://example.com;code="+strconv.Itoa(code), req, c); err == nil {
+			t.Errorf("Expected an error for %d", code)
+		}
+	}
+	rec := record{}
+	if err := rec.Parse("v=txtv0;type=sinkhole;code=410", req, c); err != nil {
+		t.Errorf("Expected sinkhole records to keep their codes, got %s", err)
+	}
+}
+
+func TestHeadersE2e(t *testing.T) {
+	tests := []struct {
+		url          string
+		status       int
+		cacheControl string
+		frameOptions string
+		robots       []string
+	}{
+		// The record's Cache-Control replaces the 301 cache lifetime
+		{"https://headers.test", 301, "no-store", "DENY", nil},
+		{"https://temporary.headers.test", 307, "", "", nil},
+		// Records setting the reserved headers trigger the fallback
+		{"https://invalid.headers.test", 404, "", "", nil},
+		{"https://noindex.headers.test", 302, "", "", []string{"nofollow", "noindex"}},
+		{"https://badindex.headers.test", 404, "", "", nil},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("POST", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if got := w.Header()["Cache-Control"]; test.cacheControl != "" && (len(got) != 1 || got[0] != test.cacheControl) {
+			t.Errorf("Test %d: Expected Cache-Control %q, got %v", i, test.cacheControl, got)
+		}
+		if got := w.Header().Get("X-Frame-Options"); got != test.frameOptions {
+			t.Errorf("Test %d: Expected X-Frame-Options %q, got %q", i, test.frameOptions, got)
+		}
+		if got := w.Header()["X-Robots-Tag"]; !identical(got, test.robots) {
+			t.Errorf("Test %d: Expected X-Robots-Tag %v, got %v", i, test.robots, got)
+		}
+	}
+}
+
+func TestPreserveMethod(t *testing.T) {
+	tests := []struct {
+		method   string
+		record   string
+		preserve bool
+		code     int
+	}{
+		{"POST", "v=txtv0;to=https://example.com;code=301", true, 308},
+		{"PUT", "v=txtv0;to=https://example.com;code=301", true, 308},
+		{"GET", "v=txtv0;to=https://example.com;code=301", true, 301},
+		{"HEAD", "v=txtv0;to=https://example.com;code=301", true, 301},
+		{"POST", "v=txtv0;to=https://example.com;code=301", false, 301},
+		{"POST", "v=txtv0;to=https://example.com;code=302", true, 302},
+		// The records override the option
+		{"POST", "v=txtv0;to=https://example.com;code=301;preserve_method=false", true, 301},
+		{"DELETE", "v=txtv0;to=https://example.com;code=301;preserve_method=true", false, 308},
+	}
+	for i, test := range tests {
+		c := Config{Enable: []string{"host"}, PreserveMethod: test.preserve}
+		req := httptest.NewRequest(test.method, "https://example.com/", nil)
+		rec := record{}
+		if err := rec.Parse(test.record, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if code := methodPreservingCode(req, rec, c); code != test.code {
+			t.Errorf("Test %d: Expected %d for %s, got %d", i, test.code, test.method, code)
+		}
+	}
+
+	rec := record{}
+	if err := rec.Parse("v=txtv0;to=https://example.com;preserve_method=sometimes", nil, Config{}); err == nil {
+		t.Errorf("Expected an error for an invalid preserve_method field")
+	}
+
+	c := Config{
+		Enable:         []string{"host"},
+		Resolver:       "127.0.0.1:" + strconv.Itoa(port),
+		PreserveMethod: true,
+	}
+	w := httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("POST", "https://headers.test/api", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 308 || w.Header().Get("Status-Code") != "308" {
+		t.Errorf("Expected the POST request to be redirected with 308, got %d", w.Code)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthCheck contains the active target health checking's configuration
+type HealthCheck struct {
+	Enable   bool
+	Interval time.Duration
+	Timeout  time.Duration
+
+	store *healthStore
+}
+
+type healthStore struct {
+	sync.RWMutex
+	targets map[string]*targetHealth
+	stop    chan struct{}
+}
+
+type targetHealth struct {
+	healthy  bool
+	checked  time.Time
+	lastSeen time.Time
+}
+
+const (
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+	// maxCheckedTargets limits the number of targets which get checked
+	maxCheckedTargets = 1000
+	// staleTargetIntervals is the number of intervals after which
+	// a target that isn't redirected to anymore stops getting checked
+	staleTargetIntervals = 10
+	// maxHealthChecks limits the number of targets checked at once
+	maxHealthChecks = 10
+)
+
+// SetDefaults sets the default values for health check config
+// if the fields are empty
+func (h *HealthCheck) SetDefaults() {
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthCheckInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthCheckTimeout
+	}
+	if h.store == nil {
+		h.store = &healthStore{targets: make(map[string]*targetHealth)}
+	}
+}
+
+// Start starts checking the registered targets periodically
+func (h *HealthCheck) Start() error {
+	if h.store == nil || h.store.stop != nil {
+		return nil
+	}
+	h.store.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(h.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				h.checkAll()
+			case <-stop:
+				return
+			}
+		}
+	}(h.store.stop)
+	return nil
+}
+
+// Stop stops the periodic health checks
+func (h *HealthCheck) Stop() error {
+	if h.store == nil || h.store.stop == nil {
+		return nil
+	}
+	close(h.store.stop)
+	h.store.stop = nil
+	return nil
+}
+
+// Healthy registers the given target to get checked periodically and
+// returns its last known health. Targets that haven't been checked
+// yet are considered healthy.
+func (h *HealthCheck) Healthy(target string) bool {
+	if h.store == nil {
+		return true
+	}
+	origin, err := targetOrigin(target)
+	if err != nil {
+		return true
+	}
+
+	h.store.Lock()
+	defer h.store.Unlock()
+
+	health, ok := h.store.targets[origin]
+	if !ok {
+		if len(h.store.targets) < maxCheckedTargets {
+			h.store.targets[origin] = &targetHealth{healthy: true, lastSeen: time.Now()}
+		}
+		return true
+	}
+	health.lastSeen = time.Now()
+	return health.healthy
+}
+
+// checkAll checks the health of every registered target and
+// forgets the targets that haven't been used for a while
+func (h *HealthCheck) checkAll() {
+	h.store.Lock()
+	var origins []string
+	for origin, health := range h.store.targets {
+		if time.Since(health.lastSeen) > staleTargetIntervals*h.Interval {
+			delete(h.store.targets, origin)
+			continue
+		}
+		origins = append(origins, origin)
+	}
+	h.store.Unlock()
+
+	var wg sync.WaitGroup
+	checks := make(chan struct{}, maxHealthChecks)
+	for _, origin := range origins {
+		wg.Add(1)
+		checks <- struct{}{}
+		go func(origin string) {
+			defer func() {
+				<-checks
+				wg.Done()
+			}()
+			err := checkTarget(origin, h.Timeout)
+			if err != nil {
+				log.Printf("[txtdirect]: Health check failed for %s: %s", origin, err.Error())
+			}
+			h.store.Lock()
+			if health, ok := h.store.targets[origin]; ok {
+				health.healthy, health.checked = err == nil, time.Now()
+			}
+			h.store.Unlock()
+		}(origin)
+	}
+	wg.Wait()
+}
+
+// targetOrigin returns the scheme and host of the given target, since the
+// health checks are done per origin instead of per redirect target
+func targetOrigin(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("target %s isn't an absolute URL", target)
+	}
+	return u.Scheme + "://" + u.Host + "/", nil
+}
+
+// ParseHealthCheck parses the txtdirect config for health checks
+func (h *HealthCheck) ParseHealthCheck(c Dispenser) error {
+	switch c.Val() {
+	case "interval":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for interval field is not standard. It should be a duration")
+		}
+		h.Interval = value
+
+	case "timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a duration")
+		}
+		h.Timeout = value
+
+	default:
+		return c.ArgErr() // unhandled option for healthcheck
+	}
+	return nil
+}
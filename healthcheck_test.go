@@ -0,0 +1,136 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer unhealthy.Close()
+
+	h := HealthCheck{Enable: true, Interval: 20 * time.Millisecond}
+	h.SetDefaults()
+
+	// Targets are healthy until they get checked
+	if !h.Healthy(healthy.URL+"/some/path") || !h.Healthy(unhealthy.URL+"/some/path") {
+		t.Fatalf("Expected unchecked targets to be healthy")
+	}
+
+	if err := h.Start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	h.Stop()
+
+	if !h.Healthy(healthy.URL + "/other/path") {
+		t.Errorf("Expected %s to be healthy", healthy.URL)
+	}
+	if h.Healthy(unhealthy.URL + "/other/path") {
+		t.Errorf("Expected %s to be unhealthy", unhealthy.URL)
+	}
+}
+
+func TestHealthCheckE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		status   int
+		location string
+	}{
+		{
+			"https://fallback.health.test/path",
+			302,
+			"https://fallback.target.test",
+		},
+		{
+			"https://maintenance.health.test/path",
+			503,
+			"",
+		},
+		{
+			"https://healthy.health.test/path",
+			302,
+			"https://healthy.target.test/path",
+		},
+		{
+			"https://chain.health.test/path",
+			302,
+			"https://healthy.target.test/path",
+		},
+		{
+			"https://fallbacks.health.test/path",
+			302,
+			"https://fallback.target.test",
+		},
+		{
+			"https://error.health.test/path",
+			302,
+			"https://healthy.target.test",
+		},
+	}
+	c := Config{
+		Enable:      []string{"host"},
+		Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+		HealthCheck: HealthCheck{Enable: true},
+	}
+	c.HealthCheck.SetDefaults()
+	c.HealthCheck.store.targets["https://unhealthy.target.test/"] = &targetHealth{healthy: false, lastSeen: time.Now()}
+
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+	}
+}
+
+func Test_targetOrigin(t *testing.T) {
+	tests := []struct {
+		target    string
+		expected  string
+		shouldErr bool
+	}{
+		{"https://example.com/path?query=1", "https://example.com/", false},
+		{"http://example.com:8080", "http://example.com:8080/", false},
+		{"/relative/path", "", true},
+	}
+	for i, test := range tests {
+		origin, err := targetOrigin(test.target)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil || origin != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s (%v)", i, test.expected, origin, err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Honeypot contains the configuration of the honeypot which serves
+// fake responses to suspected scanners instead of redirecting them
+type Honeypot struct {
+	Enable     bool
+	UserAgents []string
+	Paths      []string
+	Delay      time.Duration
+	LogOutput  string
+
+	store *honeypotStore
+}
+
+type honeypotStore struct {
+	logger *jsonLogger
+	// tarpit limits the number of responses being delayed at once
+	tarpit chan struct{}
+}
+
+// fingerprint describes a client caught by the honeypot
+type fingerprint struct {
+	Time        string   `json:"time"`
+	Reason      string   `json:"reason"`
+	Host        string   `json:"host"`
+	Method      string   `json:"method"`
+	Path        string   `json:"path"`
+	Proto       string   `json:"proto"`
+	ClientIP    string   `json:"client_ip"`
+	UserAgent   string   `json:"user_agent"`
+	Headers     []string `json:"headers"`
+	TLSVersion  string   `json:"tls_version,omitempty"`
+	CipherSuite string   `json:"cipher_suite,omitempty"`
+	ServerName  string   `json:"server_name,omitempty"`
+	Hash        string   `json:"hash"`
+}
+
+const (
+	DefaultHoneypotDelay = 10 * time.Second
+	// maxTarpitted is the maximum number of delayed responses,
+	// further requests get the fake response right away
+	maxTarpitted = 100
+)
+
+var (
+	// DefaultHoneypotUserAgents are user agents of common scanners
+	DefaultHoneypotUserAgents = []string{"sqlmap", "nikto", "nmap", "masscan", "zgrab", "gobuster", "dirbuster", "wpscan", "nuclei"}
+	// DefaultHoneypotPaths are paths commonly probed by scanners
+	DefaultHoneypotPaths = []string{"/.env", "/.git/", "/wp-login.php", "/wp-admin", "/xmlrpc.php", "/phpmyadmin", "/admin.php"}
+)
+
+var honeypotPage = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<title>Login</title>
+</head>
+<body>
+<form method="post">
+<input type="text" name="username">
+<input type="password" name="password">
+<input type="submit" value="Login">
+</form>
+</body>
+</html>`)
+
+// SetDefaults sets the default values for honeypot config
+// if the fields are empty
+func (h *Honeypot) SetDefaults() {
+	if len(h.UserAgents) == 0 {
+		h.UserAgents = DefaultHoneypotUserAgents
+	}
+	if len(h.Paths) == 0 {
+		h.Paths = DefaultHoneypotPaths
+	}
+	if h.Delay == 0 {
+		h.Delay = DefaultHoneypotDelay
+	}
+	if h.LogOutput == "" {
+		h.LogOutput = "stdout"
+	}
+	if h.store == nil {
+		h.store = &honeypotStore{
+			logger: newJSONLogger(h.LogOutput),
+			tarpit: make(chan struct{}, maxTarpitted),
+		}
+	}
+}
+
+// suspicious checks the request against the user agent and path heuristics
+// and returns the reason if the request looks like it's coming from a scanner
+func (h *Honeypot) suspicious(r *http.Request) (string, bool) {
+	ua := strings.ToLower(r.UserAgent())
+	for _, agent := range h.UserAgents {
+		if strings.Contains(ua, strings.ToLower(agent)) {
+			return "user_agent", true
+		}
+	}
+	for _, path := range h.Paths {
+		if strings.HasPrefix(r.URL.Path, path) {
+			return "path", true
+		}
+	}
+	return "", false
+}
+
+// serve logs the client's fingerprint and responds with a fake
+// login page after the configured delay
+func (h *Honeypot) serve(w http.ResponseWriter, r *http.Request, reason string) {
+	if h.store != nil {
+		h.store.logger.log(newFingerprint(r, reason))
+
+		select {
+		case h.store.tarpit <- struct{}{}:
+			timer := time.NewTimer(h.Delay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+			}
+			<-h.store.tarpit
+		default:
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	w.Write(honeypotPage)
+}
+
+// newFingerprint collects the details which identify the request's client
+func newFingerprint(r *http.Request, reason string) fingerprint {
+	headers := make([]string, 0, len(r.Header))
+	for name := range r.Header {
+		headers = append(headers, strings.ToLower(name))
+	}
+	sort.Strings(headers)
+
+	f := fingerprint{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Reason:    reason,
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Proto:     r.Proto,
+		ClientIP:  clientIP(r),
+		UserAgent: r.UserAgent(),
+		Headers:   headers,
+	}
+	if r.TLS != nil {
+		f.TLSVersion = tlsVersionName(r.TLS.Version)
+		f.CipherSuite = fmt.Sprintf("0x%04x", r.TLS.CipherSuite)
+		f.ServerName = r.TLS.ServerName
+	}
+
+	// The hash only covers the client's traits so it stays
+	// the same across hosts, paths and addresses
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		f.UserAgent,
+		strings.Join(headers, ","),
+		f.Proto,
+		f.TLSVersion,
+		f.CipherSuite,
+	}, "|")))
+	f.Hash = hex.EncodeToString(sum[:8])
+	return f
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// ParseHoneypot parses the txtdirect config for the honeypot
+func (h *Honeypot) ParseHoneypot(c Dispenser) error {
+	switch c.Val() {
+	case "user_agents":
+		agents := c.RemainingArgs()
+		if len(agents) == 0 {
+			return c.ArgErr()
+		}
+		h.UserAgents = append(h.UserAgents, agents...)
+
+	case "paths":
+		paths := c.RemainingArgs()
+		if len(paths) == 0 {
+			return c.ArgErr()
+		}
+		h.Paths = append(h.Paths, paths...)
+
+	case "delay":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for delay field is not standard. It should be a duration")
+		}
+		h.Delay = value
+
+	case "logfile":
+		h.LogOutput = c.RemainingArgs()[0]
+
+	default:
+		return c.ArgErr() // unhandled option for honeypot
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHoneypot_suspicious(t *testing.T) {
+	tests := []struct {
+		path      string
+		userAgent string
+		reason    string
+	}{
+		{"/", "Mozilla/5.0", ""},
+		{"/", "sqlmap/1.3.11#stable (http://sqlmap.org)", "user_agent"},
+		{"/", "Mozilla/5.0 zgrab/0.x", "user_agent"},
+		{"/.env", "Mozilla/5.0", "path"},
+		{"/wp-login.php?redirect_to=/", "curl/7.64.0", "path"},
+		{"/blog/wp-login.php", "Mozilla/5.0", ""},
+	}
+	h := Honeypot{Enable: true}
+	h.SetDefaults()
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.test"+test.path, nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		reason, ok := h.suspicious(req)
+		if ok != (test.reason != "") || reason != test.reason {
+			t.Errorf("Test %d: Expected reason %q, got %q", i, test.reason, reason)
+		}
+	}
+}
+
+func TestHoneypotE2e(t *testing.T) {
+	tests := []struct {
+		url       string
+		userAgent string
+		reason    string
+		location  string
+	}{
+		{"https://real.honeypot.test/", "Mozilla/5.0", "", "https://real.target.test"},
+		{"https://real.honeypot.test/", "Nikto/2.1.6", "user_agent", ""},
+		{"https://real.honeypot.test/.git/config", "Mozilla/5.0", "path", ""},
+		{"https://trap.honeypot.test/", "Mozilla/5.0", "record", ""},
+	}
+	for i, test := range tests {
+		var buf bytes.Buffer
+		c := Config{
+			Enable:   []string{"host", "honeypot"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Honeypot: Honeypot{Enable: true, Delay: 10 * time.Millisecond},
+		}
+		c.Honeypot.SetDefaults()
+		c.Honeypot.store.logger = &jsonLogger{encoder: json.NewEncoder(&buf)}
+
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+
+		if test.reason == "" {
+			if buf.Len() != 0 {
+				t.Errorf("Test %d: Expected no fingerprint to be logged, got %s", i, buf.String())
+			}
+			continue
+		}
+		if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), honeypotPage) {
+			t.Errorf("Test %d: Expected the fake page, got %d %s", i, w.Code, w.Body.String())
+		}
+		var f fingerprint
+		if err := json.Unmarshal(buf.Bytes(), &f); err != nil {
+			t.Errorf("Test %d: Couldn't decode the fingerprint %q: %s", i, buf.String(), err)
+			continue
+		}
+		if f.Reason != test.reason || f.UserAgent != test.userAgent || f.Hash == "" {
+			t.Errorf("Test %d: Unexpected fingerprint %+v", i, f)
+		}
+	}
+}
+
+func Test_newFingerprint(t *testing.T) {
+	first := httptest.NewRequest("GET", "https://a.example.test/.env", nil)
+	first.Header.Set("User-Agent", "scanner")
+	first.Header.Set("Accept", "*/*")
+	second := httptest.NewRequest("POST", "https://b.example.test/wp-admin", nil)
+	second.RemoteAddr = "198.51.100.1:4242"
+	second.Header.Set("Accept", "text/html")
+	second.Header.Set("User-Agent", "scanner")
+	third := httptest.NewRequest("GET", "https://a.example.test/.env", nil)
+	third.Header.Set("User-Agent", "scanner")
+
+	if newFingerprint(first, "path").Hash != newFingerprint(second, "path").Hash {
+		t.Errorf("Expected the same client to have the same fingerprint hash")
+	}
+	if newFingerprint(first, "path").Hash == newFingerprint(third, "path").Hash {
+		t.Errorf("Expected clients with different headers to have different fingerprint hashes")
+	}
+}
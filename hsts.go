@@ -0,0 +1,112 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hstsPreloadMinAge is the lowest max-age accepted by the HSTS preload list
+const hstsPreloadMinAge = 31536000
+
+// DefaultHSTS is the HSTS policy of the records
+// upgraded by https_only without an hsts= field
+const DefaultHSTS = "max-age=31536000"
+
+// parseHSTS parses the hsts= field of a record and returns the
+// Strict-Transport-Security header value. The field holds the
+// max-age in seconds followed by the optional comma separated
+// includesubdomains and preload flags, e.g.
+// hsts=31536000,includesubdomains,preload
+func parseHSTS(value string) (string, error) {
+	fields := strings.Split(value, ",")
+	maxAge, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil || maxAge < 0 {
+		return "", fmt.Errorf("could not parse hsts max-age: %s", fields[0])
+	}
+
+	var subdomains, preload bool
+	for _, flag := range fields[1:] {
+		switch strings.ToLower(strings.TrimSpace(flag)) {
+		case "includesubdomains":
+			subdomains = true
+		case "preload":
+			preload = true
+		default:
+			return "", fmt.Errorf("unknown hsts flag: %s", flag)
+		}
+	}
+	// The preload list only accepts policies covering
+	// the subdomains for at least a year
+	if preload && (!subdomains || maxAge < hstsPreloadMinAge) {
+		return "", fmt.Errorf("hsts preload requires includesubdomains and a max-age of at least %d", hstsPreloadMinAge)
+	}
+
+	header := fmt.Sprintf("max-age=%d", maxAge)
+	if subdomains {
+		header += "; includeSubDomains"
+	}
+	if preload {
+		header += "; preload"
+	}
+	return header, nil
+}
+
+// upgradeHTTPS rewrites the record's plain http targets to https if the
+// https_only option or the record's https_only= field asks for it. The
+// upgraded records without an hsts= field get the default HSTS policy.
+// It returns false for the records which aren't upgraded.
+func upgradeHTTPS(rec *record, c Config) bool {
+	upgrade := c.HTTPSOnly
+	if rec.HTTPSOnly != nil {
+		upgrade = *rec.HTTPSOnly
+	}
+	if !upgrade {
+		return false
+	}
+
+	rec.To = httpsTarget(rec.To)
+	for i, target := range rec.Targets {
+		rec.Targets[i] = httpsTarget(target)
+	}
+	rec.Root = httpsTarget(rec.Root)
+	rec.Website = httpsTarget(rec.Website)
+	for i, target := range rec.Fallback {
+		rec.Fallback[i] = httpsTarget(target)
+	}
+	if rec.HSTS == "" {
+		rec.HSTS = DefaultHSTS
+	}
+	return true
+}
+
+// httpsTarget replaces the http scheme of the target with https
+func httpsTarget(target string) string {
+	if len(target) < len("http://") || !strings.EqualFold(target[:len("http://")], "http://") {
+		return target
+	}
+	return "https://" + target[len("http://"):]
+}
+
+// setHSTS attaches the record's HSTS policy to the responses served over
+// HTTPS. Browsers ignore the header on plain HTTP responses.
+func setHSTS(w http.ResponseWriter, r *http.Request, rec record) {
+	if rec.HSTS == "" || r.TLS == nil {
+		return
+	}
+	w.Header().Set("Strict-Transport-Security", rec.HSTS)
+}
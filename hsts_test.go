@@ -0,0 +1,146 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseHSTS(t *testing.T) {
+	tests := []struct {
+		value     string
+		expected  string
+		shouldErr bool
+	}{
+		{"300", "max-age=300", false},
+		{"86400,includesubdomains", "max-age=86400; includeSubDomains", false},
+		{"31536000,includeSubDomains,preload", "max-age=31536000; includeSubDomains; preload", false},
+		{"0", "max-age=0", false},
+		{"forever", "", true},
+		{"-1", "", true},
+		{"300,secure", "", true},
+		// Preload needs the subdomains and at least a year
+		{"31536000,preload", "", true},
+		{"86400,includesubdomains,preload", "", true},
+	}
+	for i, test := range tests {
+		header, err := parseHSTS(test.value)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if header != test.expected {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, header)
+		}
+	}
+}
+
+func TestHSTSE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://hsts.test", "max-age=31536000; includeSubDomains; preload"},
+		// Browsers ignore the header over plain HTTP
+		{"http://hsts.test", ""},
+		{"https://invalid.hsts.test", ""},
+		{"https://127.0.0.1", ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if hsts := w.Header().Get("Strict-Transport-Security"); hsts != test.expected {
+			t.Errorf("Test %d: Expected HSTS header %q, got %q", i, test.expected, hsts)
+		}
+	}
+}
+
+func TestUpgradeHTTPS(t *testing.T) {
+	rec := record{
+		To:       "http://example.com/a",
+		Targets:  []string{"http://example.com/a", "HTTP://example.org", "ftp://example.net"},
+		Root:     "http://root.example.com",
+		Fallback: []string{"http://fallback.example.com", "https://secure.example.com"},
+	}
+	if !upgradeHTTPS(&rec, Config{HTTPSOnly: true}) {
+		t.Fatalf("Expected the record to be upgraded")
+	}
+	expected := record{
+		To:       "https://example.com/a",
+		Targets:  []string{"https://example.com/a", "https://example.org", "ftp://example.net"},
+		Root:     "https://root.example.com",
+		Fallback: []string{"https://fallback.example.com", "https://secure.example.com"},
+		HSTS:     DefaultHSTS,
+	}
+	if !reflect.DeepEqual(rec, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rec)
+	}
+
+	// The records can opt out of the option
+	off := false
+	rec = record{To: "http://example.com", HTTPSOnly: &off}
+	if upgradeHTTPS(&rec, Config{HTTPSOnly: true}) || rec.To != "http://example.com" || rec.HSTS != "" {
+		t.Errorf("Expected the record to be kept, got %+v", rec)
+	}
+}
+
+func TestHTTPSOnlyE2e(t *testing.T) {
+	tests := []struct {
+		url       string
+		httpsOnly bool
+		location  string
+		hsts      string
+	}{
+		{"https://plain.hsts.test", true, "https://plain.example.com/docs", DefaultHSTS},
+		{"https://plain.hsts.test", false, "http://plain.example.com/docs", ""},
+		{"https://kept.hsts.test", true, "http://kept.example.com", ""},
+		{"https://forced.hsts.test", false, "https://forced.example.com", "max-age=300"},
+		// Browsers ignore the header over plain HTTP
+		{"http://plain.hsts.test", true, "https://plain.example.com/docs", ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:    []string{"host"},
+			Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+			HTTPSOnly: test.httpsOnly,
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if hsts := w.Header().Get("Strict-Transport-Security"); hsts != test.hsts {
+			t.Errorf("Test %d: Expected HSTS header %q, got %q", i, test.hsts, hsts)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ImportedLink is a short link exported from another link shortener
+type ImportedLink struct {
+	Keyword string
+	Target  string
+}
+
+// ImportFormats are the link shorteners' export formats which can be imported
+var ImportFormats = []string{"yourls", "kutt", "bitly-export"}
+
+// keywordRegex matches the keywords which fit in a single DNS label
+var keywordRegex = regexp.MustCompile("^[A-Za-z0-9_-]{1,63}$")
+
+// maxTXTString is the max length of a single string in a TXT record
+const maxTXTString = 255
+
+// ImportLinks reads the short links from the given export. The links which
+// can't be served by path records are skipped and returned as warnings.
+func ImportLinks(r io.Reader, from string) ([]ImportedLink, []string, error) {
+	var links []ImportedLink
+	var err error
+	switch from {
+	case "yourls":
+		links, err = importCSV(r, []string{"keyword"}, []string{"url"})
+	case "kutt":
+		links, err = importKutt(r)
+	case "bitly-export":
+		links, err = importCSV(r, []string{"bitlink", "link", "short link", "short_url"}, []string{"long_url", "long url", "destination"})
+	default:
+		return nil, nil, fmt.Errorf("unknown import format %s, it should be one of %s", from, strings.Join(ImportFormats, ", "))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return filterLinks(links)
+}
+
+// importCSV reads the links from a CSV export with a header
+// row, the columns are found by their possible names
+func importCSV(r io.Reader, keywordColumns, targetColumns []string) ([]ImportedLink, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the CSV export: %s", err.Error())
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	keyword, target := -1, -1
+	for i, column := range rows[0] {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if keyword == -1 && contains(keywordColumns, column) {
+			keyword = i
+		}
+		if target == -1 && contains(targetColumns, column) {
+			target = i
+		}
+	}
+	if keyword == -1 || target == -1 {
+		return nil, fmt.Errorf("the CSV export should have one of the %s columns and one of the %s columns",
+			strings.Join(keywordColumns, ", "), strings.Join(targetColumns, ", "))
+	}
+
+	var links []ImportedLink
+	for _, row := range rows[1:] {
+		if keyword >= len(row) || target >= len(row) {
+			continue
+		}
+		links = append(links, ImportedLink{
+			// Bitly exports the whole short link
+			Keyword: strings.TrimSpace(row[keyword][strings.LastIndex(row[keyword], "/")+1:]),
+			Target:  strings.TrimSpace(row[target]),
+		})
+	}
+	return links, nil
+}
+
+// importKutt reads the links from Kutt's API response,
+// either the paginated object or the bare list of links
+func importKutt(r io.Reader) ([]ImportedLink, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	type kuttLink struct {
+		Address string `json:"address"`
+		Target  string `json:"target"`
+	}
+	var list []kuttLink
+	if err := json.Unmarshal(data, &list); err != nil {
+		var page struct {
+			Data []kuttLink `json:"data"`
+		}
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("couldn't read the Kutt export: %s", err.Error())
+		}
+		list = page.Data
+	}
+
+	links := make([]ImportedLink, 0, len(list))
+	for _, link := range list {
+		links = append(links, ImportedLink{Keyword: link.Address, Target: link.Target})
+	}
+	return links, nil
+}
+
+// filterLinks skips the links which can't be served by path records
+func filterLinks(links []ImportedLink) ([]ImportedLink, []string, error) {
+	var filtered []ImportedLink
+	var warnings []string
+	seen := make(map[string]string)
+	for _, link := range links {
+		// Dots in the paths are looked up as dashes
+		keyword := strings.Replace(link.Keyword, ".", "-", -1)
+		switch {
+		case !keywordRegex.MatchString(keyword):
+			warnings = append(warnings, fmt.Sprintf("skipped %q: the keyword doesn't fit in a DNS label", link.Keyword))
+			continue
+		case !strings.HasPrefix(link.Target, "http://") && !strings.HasPrefix(link.Target, "https://"):
+			warnings = append(warnings, fmt.Sprintf("skipped %q: the target %q isn't an HTTP URL", link.Keyword, link.Target))
+			continue
+		case strings.ContainsAny(link.Target, "; \""):
+			warnings = append(warnings, fmt.Sprintf("skipped %q: the target %q can't be used in a record", link.Keyword, link.Target))
+			continue
+		}
+
+		// DNS names are case insensitive
+		lower := strings.ToLower(keyword)
+		if previous, ok := seen[lower]; ok {
+			warnings = append(warnings, fmt.Sprintf("skipped %q: it collides with %q", link.Keyword, previous))
+			continue
+		}
+		seen[lower] = link.Keyword
+		filtered = append(filtered, ImportedLink{Keyword: lower, Target: link.Target})
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Keyword < filtered[j].Keyword
+	})
+	return filtered, warnings, nil
+}
+
+// WriteZoneSnippet writes the TXT records serving the links under the
+// given domain as a zone file snippet. The domain gets a path record and
+// every link gets a host record under it.
+func WriteZoneSnippet(w io.Writer, links []ImportedLink, domain string, code int) error {
+	domain = strings.TrimSuffix(domain, ".")
+	if code == 0 {
+		code = http.StatusMovedPermanently
+	}
+	if _, err := fmt.Fprintf(w, "%s.%s. IN TXT %s\n", basezone, domain, quoteTXT("v=txtv0;type=path")); err != nil {
+		return err
+	}
+	for _, link := range links {
+		value := fmt.Sprintf("v=txtv0;to=%s;type=host;code=%d", link.Target, code)
+		if _, err := fmt.Fprintf(w, "%s.%s.%s. IN TXT %s\n", basezone, link.Keyword, domain, quoteTXT(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quoteTXT quotes the given record value, splitting it
+// into multiple strings when it's too long for one
+func quoteTXT(value string) string {
+	parts := splitTXT(value)
+	for i, part := range parts {
+		parts[i] = `"` + part + `"`
+	}
+	return strings.Join(parts, " ")
+}
+
+// splitTXT splits the value of a TXT record into the strings
+// of at most 255 characters a TXT record is made of
+func splitTXT(value string) []string {
+	var parts []string
+	for len(value) > maxTXTString {
+		parts = append(parts, value[:maxTXTString])
+		value = value[maxTXTString:]
+	}
+	return append(parts, value)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestImportLinks(t *testing.T) {
+	tests := []struct {
+		from      string
+		export    string
+		links     []ImportedLink
+		warnings  int
+		shouldErr bool
+	}{
+		{
+			"yourls",
+			"keyword,url,title,timestamp,ip,clicks\n" +
+				"docs,https://docs.example.com,Docs,2019-01-01 10:00:00,127.0.0.1,5\n" +
+				"Docs,https://other.example.com,Duplicate,2019-01-01 10:00:00,127.0.0.1,1\n" +
+				"v1.2,https://releases.example.com/v1.2,Release,2019-01-01 10:00:00,127.0.0.1,0\n",
+			[]ImportedLink{
+				{Keyword: "docs", Target: "https://docs.example.com"},
+				{Keyword: "v1-2", Target: "https://releases.example.com/v1.2"},
+			},
+			1,
+			false,
+		},
+		{
+			"kutt",
+			`{"limit":10,"skip":0,"total":2,"data":[
+				{"address":"blog","target":"https://blog.example.com","domain":null},
+				{"address":"ftp","target":"ftp://files.example.com","domain":null}
+			]}`,
+			[]ImportedLink{{Keyword: "blog", Target: "https://blog.example.com"}},
+			1,
+			false,
+		},
+		{
+			"kutt",
+			`[{"address":"blog","target":"https://blog.example.com"}]`,
+			[]ImportedLink{{Keyword: "blog", Target: "https://blog.example.com"}},
+			0,
+			false,
+		},
+		{
+			"bitly-export",
+			"Title,Bitlink,Long URL,Created\n" +
+				"Shop,bit.ly/2shop,https://shop.example.com/?a=1,2019-01-01\n" +
+				"Bad,bit.ly/has space,https://bad.example.com,2019-01-01\n",
+			[]ImportedLink{{Keyword: "2shop", Target: "https://shop.example.com/?a=1"}},
+			1,
+			false,
+		},
+		{"bitly-export", "Title,Created\nShop,2019-01-01\n", nil, 0, true},
+		{"kutt", "not json", nil, 0, true},
+		{"unknown", "", nil, 0, true},
+	}
+	for i, test := range tests {
+		links, warnings, err := ImportLinks(strings.NewReader(test.export), test.from)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(links, test.links) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.links, links)
+		}
+		if len(warnings) != test.warnings {
+			t.Errorf("Test %d: Expected %d warnings, got %v", i, test.warnings, warnings)
+		}
+	}
+}
+
+func TestWriteZoneSnippet(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", 300)
+	links := []ImportedLink{
+		{Keyword: "docs", Target: "https://docs.example.com"},
+		{Keyword: "long", Target: long},
+	}
+	var buf bytes.Buffer
+	if err := WriteZoneSnippet(&buf, links, "s.example.com.", 302); err != nil {
+		t.Fatal(err)
+	}
+
+	value := "v=txtv0;to=" + long + ";type=host;code=302"
+	expected := `_redirect.s.example.com. IN TXT "v=txtv0;type=path"
+_redirect.docs.s.example.com. IN TXT "v=txtv0;to=https://docs.example.com;type=host;code=302"
+_redirect.long.s.example.com. IN TXT "` + value[:255] + `" "` + value[255:] + `"
+`
+	if buf.String() != expected {
+		t.Errorf("Expected the zone snippet:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
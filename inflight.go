@@ -0,0 +1,216 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// trackInFlight counts the request in the in-flight gauge until
+// its record's type is known, it returns the function untracking it
+func (info *requestInfo) trackInFlight() func() {
+	info.inFlight = true
+	RequestsInFlight.WithLabelValues(inFlightType(info.Type)).Inc()
+	return func() {
+		RequestsInFlight.WithLabelValues(inFlightType(info.Type)).Dec()
+		info.inFlight = false
+	}
+}
+
+// setRecord sets the zone and type of the record used for the request,
+// a tracked request is moved to the in-flight gauge of the record's type
+func (info *requestInfo) setRecord(zone, recordType string) {
+	if info.inFlight && recordType != info.Type {
+		RequestsInFlight.WithLabelValues(inFlightType(info.Type)).Dec()
+		RequestsInFlight.WithLabelValues(inFlightType(recordType)).Inc()
+	}
+	info.Zone, info.Type = zone, recordType
+}
+
+func inFlightType(recordType string) string {
+	if recordType == "" {
+		return "none"
+	}
+	return recordType
+}
+
+// limitRequestAge handles the request with a deadline of the max_request_age
+// option. The requests going over it are answered with 504 if their response
+// hasn't started yet, and the rest of their response is dropped otherwise,
+// so slow upstreams and clients can't pin the server's resources.
+func limitRequestAge(w http.ResponseWriter, r *http.Request, c Config, next func(http.ResponseWriter, *http.Request, Config) error) error {
+	ctx, cancel := context.WithTimeout(r.Context(), c.MaxRequestAge)
+	defer cancel()
+	aw := &ageWriter{ResponseWriter: w, ctx: ctx, header: make(http.Header)}
+
+	done := make(chan error, 1)
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				panicked <- p
+			}
+		}()
+		done <- next(aw, r.WithContext(ctx), c)
+	}()
+
+	var err error
+	var expired bool
+	select {
+	case err = <-done:
+		// The handler can return after its writes were dropped at the deadline
+		expired = aw.dropped()
+	case p := <-panicked:
+		panic(p)
+	case <-ctx.Done():
+		// The handler stops soon after the context is done, the
+		// request's info can be used once it returns
+		select {
+		case err = <-done:
+		case p := <-panicked:
+			panic(p)
+		}
+		// The client hanging up isn't the request going over its age
+		expired = ctx.Err() == context.DeadlineExceeded
+	}
+	if !expired {
+		aw.finish()
+		return err
+	}
+
+	served := aw.expire()
+	log.Printf("[txtdirect]: %s went over the max request age of %s", r.Host+r.URL.Path, c.MaxRequestAge)
+	if err != nil && err.Error() != "option disabled" {
+		log.Printf("[txtdirect]: %s", err.Error())
+	}
+	if c.Prometheus.Enable {
+		RequestsExpired.WithLabelValues(inFlightType(getRequestInfo(r.Context()).Type), strconv.FormatBool(served)).Add(1)
+	}
+	return nil
+}
+
+// ageWriter passes the handler's response on until the request
+// goes over its age. The handler's headers are kept apart until
+// the response starts, so the 504 response can't race with them.
+type ageWriter struct {
+	http.ResponseWriter
+
+	ctx         context.Context
+	mu          sync.Mutex
+	header      http.Header
+	wroteHeader bool
+	expired     bool
+	// refused is set when a write is dropped for the request's age
+	refused bool
+}
+
+func (a *ageWriter) Header() http.Header {
+	return a.header
+}
+
+func (a *ageWriter) WriteHeader(status int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped() || a.wroteHeader {
+		return
+	}
+	a.writeHeader(status)
+}
+
+// writeHeader starts the handler's response, a.mu has to be held
+func (a *ageWriter) writeHeader(status int) {
+	a.wroteHeader = true
+	for name, values := range a.header {
+		a.ResponseWriter.Header()[name] = values
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+// stopped reports whether the request went over its age and marks the
+// write as refused, the deadline is checked as well since the handler
+// can write before the expiry catches up with it. a.mu has to be held.
+func (a *ageWriter) stopped() bool {
+	if a.expired || a.ctx.Err() == context.DeadlineExceeded {
+		a.refused = true
+		return true
+	}
+	return false
+}
+
+// dropped reports whether a write of the handler was dropped
+func (a *ageWriter) dropped() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.refused
+}
+
+func (a *ageWriter) Write(b []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !a.wroteHeader {
+		a.writeHeader(http.StatusOK)
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered response to the client
+func (a *ageWriter) Flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped() {
+		return
+	}
+	if !a.wroteHeader {
+		a.writeHeader(http.StatusOK)
+	}
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish passes the headers of the handler, which didn't
+// write a response, on to the middleware handling the request
+func (a *ageWriter) finish() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.wroteHeader {
+		return
+	}
+	for name, values := range a.header {
+		a.ResponseWriter.Header()[name] = values
+	}
+}
+
+// expire stops the handler's response and answers the request with
+// 504 if its response hasn't started, it reports whether it did
+func (a *ageWriter) expire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expired = true
+	if a.wroteHeader {
+		return false
+	}
+	a.wroteHeader = true
+	a.ResponseWriter.Header().Set("Server", "TXTDirect")
+	a.ResponseWriter.Header().Set("Status-Code", strconv.Itoa(http.StatusGatewayTimeout))
+	http.Error(a.ResponseWriter, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+	return true
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseMaxRequestAge(t *testing.T) {
+	tests := []struct {
+		config    string
+		expected  time.Duration
+		shouldErr bool
+	}{
+		{"max_request_age 30s", 30 * time.Second, false},
+		{"", 0, false},
+		{"max_request_age", 0, true},
+		{"max_request_age 1s 2s", 0, true},
+		{"max_request_age -1s", 0, true},
+		{"max_request_age forever", 0, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable host\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.MaxRequestAge != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, conf.MaxRequestAge)
+		}
+	}
+}
+
+func TestLimitRequestAge(t *testing.T) {
+	var lateWrite error
+	tests := []struct {
+		name   string
+		next   func(http.ResponseWriter, *http.Request, Config) error
+		status int
+		body   string
+		header string
+		err    bool
+	}{
+		{
+			name: "fast",
+			next: func(w http.ResponseWriter, r *http.Request, c Config) error {
+				w.Header().Set("X-Handler", "1")
+				w.WriteHeader(http.StatusFound)
+				return nil
+			},
+			status: http.StatusFound,
+			header: "1",
+		},
+		{
+			name: "slow",
+			next: func(w http.ResponseWriter, r *http.Request, c Config) error {
+				w.Header().Set("X-Handler", "1")
+				<-r.Context().Done()
+				return r.Context().Err()
+			},
+			status: http.StatusGatewayTimeout,
+			body:   "Gateway Timeout\n",
+		},
+		{
+			name: "streaming",
+			next: func(w http.ResponseWriter, r *http.Request, c Config) error {
+				w.Write([]byte("partial"))
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				_, lateWrite = w.Write([]byte("rest"))
+				return nil
+			},
+			status: http.StatusOK,
+			body:   "partial",
+		},
+		{
+			// The writes at the deadline are dropped even when the
+			// handler returns before the request is expired
+			name: "late",
+			next: func(w http.ResponseWriter, r *http.Request, c Config) error {
+				<-r.Context().Done()
+				w.WriteHeader(http.StatusFound)
+				w.Write([]byte("late"))
+				return nil
+			},
+			status: http.StatusGatewayTimeout,
+			body:   "Gateway Timeout\n",
+		},
+		{
+			name: "failing",
+			next: func(w http.ResponseWriter, r *http.Request, c Config) error {
+				w.Header().Set("X-Handler", "1")
+				return errors.New("failed")
+			},
+			status: http.StatusOK,
+			header: "1",
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		c := Config{MaxRequestAge: 50 * time.Millisecond}
+		err := limitRequestAge(w, httptest.NewRequest("GET", "https://age.test/", nil), c, test.next)
+		if (err != nil) != test.err {
+			t.Errorf("%s: Unexpected error: %v", test.name, err)
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: Expected status %d, got %d", test.name, test.status, w.Code)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s: Expected body %q, got %q", test.name, test.body, w.Body.String())
+		}
+		if got := w.Header().Get("X-Handler"); got != test.header {
+			t.Errorf("%s: Expected the handler's header %q, got %q", test.name, test.header, got)
+		}
+	}
+	if lateWrite != http.ErrHandlerTimeout {
+		t.Errorf("Expected the writes after the max request age to fail, got %v", lateWrite)
+	}
+}
+
+func TestRequestsInFlight(t *testing.T) {
+	none, host := RequestsInFlight.WithLabelValues("none"), RequestsInFlight.WithLabelValues("host")
+	before := []float64{testutil.ToFloat64(none), testutil.ToFloat64(host)}
+	inFlight := func(expectedNone, expectedHost float64) {
+		t.Helper()
+		if got := testutil.ToFloat64(none) - before[0]; got != expectedNone {
+			t.Errorf("Expected %v requests without a type in flight, got %v", expectedNone, got)
+		}
+		if got := testutil.ToFloat64(host) - before[1]; got != expectedHost {
+			t.Errorf("Expected %v host requests in flight, got %v", expectedHost, got)
+		}
+	}
+
+	info := &requestInfo{}
+	done := info.trackInFlight()
+	inFlight(1, 0)
+	info.setRecord("_redirect.inflight.test.", "host")
+	inFlight(0, 1)
+	done()
+	inFlight(0, 0)
+
+	// The untracked requests don't change the gauges
+	(&requestInfo{}).setRecord("_redirect.inflight.test.", "host")
+	inFlight(0, 0)
+
+	c := Config{
+		Enable:        []string{"host"},
+		Resolver:      "127.0.0.1:" + strconv.Itoa(port),
+		Prometheus:    Prometheus{Enable: true},
+		MaxRequestAge: time.Second,
+	}
+	w := httptest.NewRecorder()
+	if err := serve(w, httptest.NewRequest("GET", "https://healthy.health.test/", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != http.StatusFound {
+		t.Errorf("Expected the request to be redirected within its age, got %d", w.Code)
+	}
+	inFlight(0, 0)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// IPHosts contains the configuration of the requests addressed to
+// IP literals or localhost, which can't have records of their own
+type IPHosts struct {
+	// Action is one of fallback, reject, next or host. The requests
+	// get the global fallback when it's empty.
+	Action string
+	// Host is the host whose record is used by the host action
+	Host string
+}
+
+const (
+	IPHostsFallback = "fallback"
+	IPHostsReject   = "reject"
+	IPHostsNext     = "next"
+	IPHostsHost     = "host"
+)
+
+// literalHost checks if the given host is an IP literal or
+// localhost, with or without a port
+func literalHost(host string) bool {
+	if isIP(host) {
+		return true
+	}
+	host, _ = splitHostPort(host)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	return host == "localhost" || strings.HasSuffix(host, ".localhost")
+}
+
+// serve responds to the request of an IP literal or
+// localhost using the configured action
+func (i *IPHosts) serve(w http.ResponseWriter, r *http.Request, c Config) error {
+	action := i.Action
+	if action == "" {
+		action = IPHostsFallback
+	}
+	if c.Prometheus.Enable {
+		IPHostRequests.WithLabelValues(action).Add(1)
+	}
+
+	switch action {
+	case IPHostsNext:
+		// The request gets handled by the next middleware
+		return fmt.Errorf("option disabled")
+
+	case IPHostsReject:
+		log.Printf("[txtdirect]: Rejected the request addressed to %s", r.Host)
+		w.Header().Set("Status-Code", strconv.Itoa(http.StatusMisdirectedRequest))
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return nil
+	}
+
+	log.Printf("[txtdirect]: Request addressed to %s, fallback triggered.", r.Host)
+	fallback(w, r, nil, "", "global", 0, c)
+	return nil
+}
+
+// ParseIPHosts parses the ip_hosts option's arguments
+func (i *IPHosts) ParseIPHosts(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("ip_hosts needs one of %s, %s, %s or %s", IPHostsFallback, IPHostsReject, IPHostsNext, IPHostsHost)
+	}
+	i.Action = args[0]
+	switch i.Action {
+	case IPHostsHost:
+		if len(args) != 2 {
+			return fmt.Errorf("ip_hosts %s needs the host to use", IPHostsHost)
+		}
+		i.Host = canonicalHost(args[1])
+		if literalHost(i.Host) {
+			return fmt.Errorf("The given value for ip_hosts host is not standard. It should be a domain")
+		}
+	case IPHostsFallback, IPHostsReject, IPHostsNext:
+		if len(args) > 1 {
+			return fmt.Errorf("ip_hosts %s doesn't take any arguments", i.Action)
+		}
+	default:
+		return fmt.Errorf("The given value for ip_hosts is not standard. It should be one of %s, %s, %s or %s", IPHostsFallback, IPHostsReject, IPHostsNext, IPHostsHost)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestLiteralHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"example.test", false},
+		{"localhost.example.test", false},
+		{"192.168.1.1", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:443", true},
+		{"::1", true},
+		{"localhost", true},
+		{"LOCALHOST:8080", true},
+		{"app.localhost", true},
+		{"localhost.", true},
+	}
+	for i, test := range tests {
+		if result := literalHost(test.host); result != test.expected {
+			t.Errorf("Test %d: Expected %t for %s, got %t", i, test.expected, test.host, result)
+		}
+	}
+}
+
+func TestParseIPHosts(t *testing.T) {
+	tests := []struct {
+		args      []string
+		expected  IPHosts
+		shouldErr bool
+	}{
+		{[]string{"reject"}, IPHosts{Action: IPHostsReject}, false},
+		{[]string{"next"}, IPHosts{Action: IPHostsNext}, false},
+		{[]string{"fallback"}, IPHosts{Action: IPHostsFallback}, false},
+		{[]string{"host", "Example.com."}, IPHosts{Action: IPHostsHost, Host: "example.com"}, false},
+		{[]string{"host"}, IPHosts{}, true},
+		{[]string{"host", "127.0.0.1"}, IPHosts{}, true},
+		{[]string{"reject", "now"}, IPHosts{}, true},
+		{[]string{"lookup"}, IPHosts{}, true},
+		{nil, IPHosts{}, true},
+	}
+	for i, test := range tests {
+		var ipHosts IPHosts
+		err := ipHosts.ParseIPHosts(test.args)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if ipHosts != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, ipHosts)
+		}
+	}
+}
+
+func TestIPHostsE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		ipHosts  IPHosts
+		status   int
+		location string
+		err      bool
+	}{
+		{"http://127.0.0.1:8080/", IPHosts{}, http.StatusMovedPermanently, "https://fallback.test", false},
+		{"http://localhost/", IPHosts{Action: IPHostsReject}, http.StatusMisdirectedRequest, "", false},
+		{"http://[::1]/", IPHosts{Action: IPHostsNext}, http.StatusOK, "", true},
+		{"http://192.168.1.2/", IPHosts{Action: IPHostsHost, Host: "default.iphosts.test"}, http.StatusFound, "https://example.com/default.iphosts.test", false},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Redirect: "https://fallback.test",
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			IPHosts:  test.ipHosts,
+		}
+		w := httptest.NewRecorder()
+		err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c)
+		if (err != nil) != test.err {
+			t.Errorf("Test %d: Expected error %t, got %v", i, test.err, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func Test_iriToURI(t *testing.T) {
+	tests := []struct {
+		target    string
+		expected  string
+		shouldErr bool
+	}{
+		{
+			"https://example.com/path?query=value",
+			"https://example.com/path?query=value",
+			false,
+		},
+		{
+			"https://bücher.example/",
+			"https://xn--bcher-kva.example/",
+			false,
+		},
+		{
+			"https://bücher.example:8080/",
+			"https://xn--bcher-kva.example:8080/",
+			false,
+		},
+		{
+			"https://example.com/straße",
+			"https://example.com/stra%C3%9Fe",
+			false,
+		},
+		{
+			"https://例え.jp/パス?キー=値#ö",
+			"https://xn--r8jz45g.jp/%E3%83%91%E3%82%B9?%E3%82%AD%E3%83%BC=%E5%80%A4#%C3%B6",
+			false,
+		},
+		{
+			"https://example.com/already%20encoded/ü",
+			"https://example.com/already%20encoded/%C3%BC",
+			false,
+		},
+		{
+			"https://exa mple.ü/",
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		result, err := iriToURI(test.target)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.target)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, result)
+		}
+	}
+}
+
+func TestRedirectIRI(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	rec := record{
+		To:   "https://bücher.example/straße",
+		Code: 302,
+		Type: "host",
+	}
+	to, _, err := getBaseTarget(rec, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if to != "https://xn--bcher-kva.example/stra%C3%9Fe" {
+		t.Errorf("Expected the target to be converted to a valid URI, got %s", to)
+	}
+}
+
+func TestCanonicalHostIDN(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"Example.COM", "example.com"},
+		{"example.com.:443", "example.com"},
+		{"münchen.example", "xn--mnchen-3ya.example"},
+		{"MÜNCHEN.Example:8080", "xn--mnchen-3ya.example"},
+		{"xn--mnchen-3ya.example", "xn--mnchen-3ya.example"},
+		{"bücher。example", "xn--bcher-kva.example"},
+	}
+	for i, test := range tests {
+		if host := canonicalHost(test.host); host != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, host)
+		}
+	}
+}
+
+func TestRedirectIDNHost(t *testing.T) {
+	hosts := []string{"münchen.idn.test", "MÜNCHEN.idn.test", "xn--mnchen-3ya.idn.test", "XN--MNCHEN-3YA.IDN.TEST"}
+	for i, host := range hosts {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		req := httptest.NewRequest("GET", "https://example.test/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != "https://example.com/xn--mnchen-3ya" {
+			t.Errorf("Test %d: Expected the record of the punycode host for %s, got %q", i, host, location)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// candidateError is the failure of one of the zones tried for a request
+type candidateError struct {
+	Zone string
+	Err  error
+}
+
+// lookupErrors aggregates the failures of all of the zones tried for a
+// request, e.g. the host's zone, the apex fallbacks and the wildcards, so
+// the logs and the debug explanation show why each of them was skipped
+type lookupErrors []candidateError
+
+// add keeps the failure of the given zone
+func (l *lookupErrors) add(zone string, err error) {
+	*l = append(*l, candidateError{Zone: recordZone(zone), Err: err})
+}
+
+func (l lookupErrors) Error() string {
+	if len(l) == 1 {
+		return l.lines()[0]
+	}
+	return fmt.Sprintf("%d zones failed: %s", len(l), strings.Join(l.lines(), "; "))
+}
+
+// lines returns the failures one per line, for the debug explanation
+func (l lookupErrors) lines() []string {
+	lines := make([]string, 0, len(l))
+	for _, failure := range l {
+		lines = append(lines, fmt.Sprintf("%s: %s", failure.Zone, failure.Err.Error()))
+	}
+	return lines
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestLookupErrors(t *testing.T) {
+	var failures lookupErrors
+	failures.add("example.com", fmt.Errorf("timeout"))
+	if failures.Error() != "_redirect.example.com.: timeout" {
+		t.Errorf("Unexpected error %q", failures.Error())
+	}
+	failures.add("_.com", fmt.Errorf("empty TXT record"))
+	expected := "2 zones failed: _redirect.example.com.: timeout; _redirect._.com.: empty TXT record"
+	if failures.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, failures.Error())
+	}
+
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+	tests := []struct {
+		host  string
+		zones []string
+	}{
+		{"missing.sub.test", []string{"_redirect.missing.sub.test.", "_redirect._.sub.test."}},
+		// The used zone's parse error is reported after the skipped zones
+		{"invalid.headers.test", []string{"_redirect.invalid.headers.test."}},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		req, info := withRequestInfo(req)
+		_, err := getRecord(test.host, req.Context(), c, req)
+		failures, ok := err.(lookupErrors)
+		if !ok {
+			t.Errorf("Test %d: Expected the lookup errors, got %v", i, err)
+			continue
+		}
+		var zones []string
+		for _, failure := range failures {
+			zones = append(zones, failure.Zone)
+		}
+		if !identical(zones, test.zones) || len(info.Errors) != len(failures) {
+			t.Errorf("Test %d: Expected the failures of %v, got %v", i, test.zones, failures)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Maintenance contains the page served for the records under maintenance,
+// the records having status=maintenance or code=503 fields
+type Maintenance struct {
+	// Page is an HTML file served instead of the default page
+	Page       string
+	RetryAfter time.Duration
+
+	page []byte
+}
+
+const DefaultMaintenanceRetryAfter = 5 * time.Minute
+
+var maintenancePage = []byte(`<!DOCTYPE html>
+<html>
+<head>
+<title>Service Unavailable</title>
+</head>
+<body>
+<h1>Service Unavailable</h1>
+<p>The requested service is under maintenance. Please try again later.</p>
+</body>
+</html>`)
+
+// SetDefaults sets the default values for maintenance config
+// if the fields are empty
+func (m *Maintenance) SetDefaults() {
+	if m.RetryAfter == 0 {
+		m.RetryAfter = DefaultMaintenanceRetryAfter
+	}
+}
+
+// serve responds with the maintenance page, asking the
+// clients to retry after the given duration
+func (m *Maintenance) serve(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = DefaultMaintenanceRetryAfter
+	}
+	page := m.page
+	if page == nil {
+		page = maintenancePage
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusServiceUnavailable))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+}
+
+// ParseMaintenance parses the txtdirect config for the maintenance page
+func (m *Maintenance) ParseMaintenance(c Dispenser) error {
+	switch c.Val() {
+	case "page":
+		m.Page = c.RemainingArgs()[0]
+		page, err := ioutil.ReadFile(m.Page)
+		if err != nil {
+			return fmt.Errorf("couldn't read the maintenance page: %s", err.Error())
+		}
+		m.page = page
+
+	case "retry_after":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value < time.Second {
+			return fmt.Errorf("The given value for retry_after field is not standard. It should be a duration of at least a second")
+		}
+		m.RetryAfter = value
+
+	default:
+		return c.ArgErr() // unhandled option for maintenance
+	}
+	return nil
+}
+
+// serveMaintenance serves the maintenance page for
+// the records under maintenance
+func serveMaintenance(w http.ResponseWriter, host string, c Config) {
+	RequestsCountBasedOnType.WithLabelValues(host, "maintenance").Add(1)
+	c.Maintenance.serve(w, c.Maintenance.RetryAfter)
+	if c.Prometheus.Enable {
+		RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusServiceUnavailable)).Add(1)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestMaintenanceE2e(t *testing.T) {
+	tests := []struct {
+		url         string
+		maintenance Maintenance
+		status      int
+		location    string
+		retryAfter  string
+		body        string
+	}{
+		{
+			"https://status.maintenance.test/",
+			Maintenance{},
+			503,
+			"",
+			"300",
+			string(maintenancePage),
+		},
+		{
+			"https://code.maintenance.test/",
+			Maintenance{RetryAfter: time.Minute, page: []byte("<html>Back soon</html>")},
+			503,
+			"",
+			"60",
+			"<html>Back soon</html>",
+		},
+		{
+			"https://path.maintenance.test/down",
+			Maintenance{},
+			503,
+			"",
+			"300",
+			string(maintenancePage),
+		},
+		{
+			"https://path.maintenance.test/up",
+			Maintenance{},
+			302,
+			"https://example.com/up",
+			"",
+			"",
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:      []string{"host", "path"},
+			Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+			Maintenance: test.maintenance,
+		}
+		c.Maintenance.SetDefaults()
+
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != test.retryAfter {
+			t.Errorf("Test %d: Expected Retry-After %q, got %q", i, test.retryAfter, retryAfter)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, w.Body.String())
+		}
+	}
+}
+
+func TestParseMaintenanceRecord(t *testing.T) {
+	c := Config{Enable: []string{"host"}}
+	tests := []struct {
+		txt         string
+		maintenance bool
+		shouldErr   bool
+	}{
+		{"v=txtv0;to=https://example.com;status=maintenance", true, false},
+		{"v=txtv0;to=https://example.com;code=503", true, false},
+		{"v=txtv0;to=https://example.com;code=301", false, false},
+		{"v=txtv0;to=https://example.com;status=down", false, true},
+		{"v=txtv0;to=https://example.com;code=500", false, true},
+	}
+	for i, test := range tests {
+		var rec record
+		err := rec.Parse(test.txt, httptest.NewRequest("GET", "https://example.test/", nil), c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.txt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.Maintenance != test.maintenance {
+			t.Errorf("Test %d: Expected maintenance to be %t, got %t", i, test.maintenance, rec.Maintenance)
+		}
+	}
+}
+
+func TestParseMaintenance(t *testing.T) {
+	file, err := ioutil.TempFile("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("<html>Back soon</html>")
+	file.Close()
+
+	c := caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		maintenance {
+			page %s
+			retry_after 10m
+		}
+	}
+	`, file.Name()))
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.Maintenance.Page != file.Name() || string(conf.Maintenance.page) != "<html>Back soon</html>" || conf.Maintenance.RetryAfter != 10*time.Minute {
+		t.Errorf("Expected the maintenance page to be configured, got %+v", conf.Maintenance)
+	}
+
+	for _, config := range []string{"page /nonexistent/page.html", "retry_after soon", "retry_after 10ms", "unknown"} {
+		c := caddy.NewTestController("http", `
+		txtdirect {
+			maintenance {
+				`+config+`
+			}
+		}
+		`)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected an error for %q", strings.TrimSpace(config))
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// metalinkType is the media type of the Metalink 4 documents (RFC 5854)
+const metalinkType = "application/metalink4+xml"
+
+// fileHash is the hash of the file served by a mirror record
+type fileHash struct {
+	Type  string
+	Value string
+}
+
+// hashLengths are the hash types supported in the hash= field
+// with the length of their hex encoded values
+var hashLengths = map[string]int{
+	"md5":     32,
+	"sha-1":   40,
+	"sha-256": 64,
+	"sha-512": 128,
+}
+
+// parseHash parses a hash= field, e.g. hash=sha-256:<hex value>
+func parseHash(field string) (fileHash, error) {
+	parts := strings.SplitN(field, ":", 2)
+	if len(parts) != 2 {
+		return fileHash{}, fmt.Errorf("hash= field should be in the type:value format")
+	}
+	h := fileHash{Type: strings.ToLower(parts[0]), Value: strings.ToLower(parts[1])}
+	length, ok := hashLengths[h.Type]
+	if !ok {
+		return fileHash{}, fmt.Errorf("unsupported hash type %s, it should be one of md5, sha-1, sha-256, sha-512", h.Type)
+	}
+	if _, err := hex.DecodeString(h.Value); err != nil || len(h.Value) != length {
+		return fileHash{}, fmt.Errorf("the %s hash should be %d hex characters", h.Type, length)
+	}
+	return h, nil
+}
+
+type metalink struct {
+	XMLName xml.Name     `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	File    metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string         `xml:"name,attr"`
+	Size   int64          `xml:"size,omitempty"`
+	Hashes []metalinkHash `xml:"hash"`
+	URLs   []metalinkURL  `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkURL struct {
+	Location string `xml:"location,attr,omitempty"`
+	Priority int    `xml:"priority,attr"`
+	URL      string `xml:",chardata"`
+}
+
+// wantsMetalink checks if the client asked for the Metalink document
+// with the ?metalink query or the Accept header
+func wantsMetalink(r *http.Request) bool {
+	if _, ok := r.URL.Query()["metalink"]; ok {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), metalinkType)
+}
+
+// wantsMagnet checks if the client asked for the magnet link
+func wantsMagnet(r *http.Request) bool {
+	_, ok := r.URL.Query()["magnet"]
+	return ok
+}
+
+// fileName returns the name of the downloaded file
+func fileName(r *http.Request) string {
+	name := path.Base(r.URL.Path)
+	if name == "/" || name == "." {
+		return r.Host
+	}
+	return name
+}
+
+// serveMetalink responds with the Metalink document listing the
+// usable mirrors in the order of preference and the file's hashes
+func serveMetalink(w http.ResponseWriter, r *http.Request, rec record, mirrors []mirror) {
+	doc := metalink{File: metalinkFile{Name: fileName(r), Size: rec.Size}}
+	for _, h := range rec.Hashes {
+		doc.File.Hashes = append(doc.File.Hashes, metalinkHash{Type: h.Type, Value: h.Value})
+	}
+	for i, m := range mirrors {
+		u := metalinkURL{Priority: i + 1, URL: withoutQuery(m.URL, "metalink")}
+		if len(m.Countries) > 0 {
+			u.Location = strings.ToLower(m.Countries[0])
+		}
+		doc.File.URLs = append(doc.File.URLs, u)
+	}
+
+	w.Header().Set("Content-Type", metalinkType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", doc.File.Name+".meta4"))
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	enc.Encode(doc)
+}
+
+// magnetLink returns the magnet link of the file with the mirrors
+// as its acceptable sources. The SHA-1 hashes are base32 encoded and
+// the other hashes are kept in hex.
+func magnetLink(r *http.Request, rec record, mirrors []mirror) string {
+	params := []string{}
+	for _, h := range rec.Hashes {
+		value := h.Value
+		if h.Type == "sha-1" {
+			raw, _ := hex.DecodeString(h.Value)
+			value = base32.StdEncoding.EncodeToString(raw)
+		}
+		params = append(params, "xt=urn:"+strings.Replace(h.Type, "-", "", -1)+":"+value)
+	}
+	params = append(params, "dn="+url.QueryEscape(fileName(r)))
+	if rec.Size > 0 {
+		params = append(params, "xl="+strconv.FormatInt(rec.Size, 10))
+	}
+	for _, m := range mirrors {
+		params = append(params, "as="+url.QueryEscape(withoutQuery(m.URL, "magnet")))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
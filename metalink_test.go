@@ -0,0 +1,114 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestParseHash(t *testing.T) {
+	tests := []struct {
+		field     string
+		expected  fileHash
+		shouldErr bool
+	}{
+		{"sha-256:D7A8FBB307D7809469CA9ABCB0082E4F8D5651E46D3CDB762D02D0BF37C9E592", fileHash{"sha-256", "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"}, false},
+		{"md5:9e107d9d372bb6826bd81d3542a419d6", fileHash{"md5", "9e107d9d372bb6826bd81d3542a419d6"}, false},
+		{"sha-256:d7a8fbb3", fileHash{}, true},
+		{"md5:9e107d9d372bb6826bd81d3542a419zz", fileHash{}, true},
+		{"crc32:414fa339", fileHash{}, true},
+		{"9e107d9d372bb6826bd81d3542a419d6", fileHash{}, true},
+	}
+	for i, test := range tests {
+		h, err := parseHash(test.field)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if h != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, h)
+		}
+	}
+}
+
+func TestMetalink(t *testing.T) {
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="file.iso">
+    <size>43</size>
+    <hash type="sha-1">2fd4e1c67a2d28fced849ee1bb76e7391b93eb12</hash>
+    <hash type="sha-256">d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592</hash>
+    <url priority="1">https://global.mirror.test/file.iso</url>
+    <url location="de" priority="2">https://de.mirror.test/file.iso</url>
+  </file>
+</metalink>`
+	c := Config{
+		Enable:   []string{"mirror"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+
+	for i, url := range []string{"https://hashes.mirror.test/file.iso?metalink", "https://hashes.mirror.test/file.iso"} {
+		req := httptest.NewRequest("GET", url, nil)
+		if i == 1 {
+			req.Header.Set("Accept", "application/metalink4+xml, */*")
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if w.Header().Get("Content-Type") != metalinkType {
+			t.Errorf("Test %d: Expected the metalink content type, got %s", i, w.Header().Get("Content-Type"))
+		}
+		if w.Body.String() != expected {
+			t.Errorf("Test %d: Expected the metalink:\n%s\ngot:\n%s", i, expected, w.Body.String())
+		}
+	}
+
+	// The records without hashes redirect to the mirrors as usual
+	req := httptest.NewRequest("GET", "https://mirror.test/file.iso?metalink", nil)
+	w := httptest.NewRecorder()
+	if err := Redirect(w, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 302 {
+		t.Errorf("Expected a redirect to a mirror, got %d", w.Code)
+	}
+}
+
+func TestMagnetLink(t *testing.T) {
+	c := Config{
+		Enable:   []string{"mirror"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+	req := httptest.NewRequest("GET", "https://hashes.mirror.test/file.iso?magnet", nil)
+	w := httptest.NewRecorder()
+	if err := Redirect(w, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "magnet:?xt=urn:sha1:F7KODRT2FUUPZ3MET3Q3W5XHHENZH2YS" +
+		"&xt=urn:sha256:d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592" +
+		"&dn=file.iso&xl=43" +
+		"&as=https%3A%2F%2Fglobal.mirror.test%2Ffile.iso&as=https%3A%2F%2Fde.mirror.test%2Ffile.iso"
+	if location := w.Header().Get("Location"); location != expected {
+		t.Errorf("Expected the magnet link %s, got %s", expected, location)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mirror is one of the download mirrors listed in a mirror record
+type mirror struct {
+	URL    string
+	Weight int
+	// Countries are the ISO codes of the countries the mirror serves,
+	// the mirrors without any countries serve everyone
+	Countries []string
+}
+
+// DefaultMirrorWeight is the weight of the mirrors without a weight
+const DefaultMirrorWeight = 1
+
+// parseMirror parses a mirror= field, e.g.
+// mirror=https://de.mirror.example.com{uri} weight=3 country=DE,AT
+func parseMirror(field string, req *http.Request) (mirror, error) {
+	parts := strings.Fields(field)
+	if len(parts) == 0 {
+		return mirror{}, fmt.Errorf("mirror= field should have the mirror's URL")
+	}
+	url, err := parsePlaceholders(parts[0], req, []string{})
+	if err != nil {
+		return mirror{}, err
+	}
+	m := mirror{URL: url, Weight: DefaultMirrorWeight}
+	for _, option := range parts[1:] {
+		switch {
+		case strings.HasPrefix(option, "weight="):
+			weight, err := strconv.Atoi(strings.TrimPrefix(option, "weight="))
+			if err != nil || weight < 1 {
+				return mirror{}, fmt.Errorf("mirror weight should be a positive number: %s", option)
+			}
+			m.Weight = weight
+		case strings.HasPrefix(option, "country="):
+			for _, country := range strings.Split(strings.TrimPrefix(option, "country="), ",") {
+				if country != "" {
+					m.Countries = append(m.Countries, strings.ToUpper(country))
+				}
+			}
+		default:
+			return mirror{}, fmt.Errorf("unknown mirror option %s", option)
+		}
+	}
+	return m, nil
+}
+
+// mirrorsFor returns the mirrors the client can use in the order of
+// preference. The healthy mirrors serving the client's country come
+// first and the heavier mirrors come first in each group. The number
+// of the mirrors serving the client's country is returned too.
+func mirrorsFor(mirrors []mirror, country string, c Config) ([]mirror, int) {
+	var local, global []mirror
+	for _, m := range mirrors {
+		if c.HealthCheck.Enable && !c.HealthCheck.Healthy(m.URL) {
+			continue
+		}
+		if country != "" && contains(m.Countries, country) {
+			local = append(local, m)
+			continue
+		}
+		global = append(global, m)
+	}
+	byWeight := func(ms []mirror) {
+		sort.SliceStable(ms, func(i, j int) bool { return ms[i].Weight > ms[j].Weight })
+	}
+	byWeight(local)
+	byWeight(global)
+	return append(local, global...), len(local)
+}
+
+// pickMirror picks one of the mirrors randomly based on their weights
+func pickMirror(mirrors []mirror, intn func(int) int) mirror {
+	total := 0
+	for _, m := range mirrors {
+		total += m.Weight
+	}
+	n := intn(total)
+	for _, m := range mirrors {
+		if n < m.Weight {
+			return m
+		}
+		n -= m.Weight
+	}
+	return mirrors[len(mirrors)-1]
+}
+
+// serveMirror redirects the request to one of the record's mirrors, the
+// ones serving the client's country are picked when there are any. The
+// ?mirrorlist query lists the mirrors instead, and the records with the
+// file's hashes serve the Metalink document and the magnet link too.
+func serveMirror(w http.ResponseWriter, r *http.Request, rec record, c Config) {
+	fallbackURL := rec.Targets
+	country := getRequestInfo(r.Context()).location(r).Country
+	mirrors, local := mirrorsFor(rec.Mirrors, country, c)
+
+	if _, ok := r.URL.Query()["mirrorlist"]; ok {
+		serveMirrorList(w, rec, mirrors, country)
+		return
+	}
+	if len(rec.Hashes) > 0 && len(mirrors) > 0 {
+		if wantsMagnet(r) {
+			w.Header().Add("Status-Code", strconv.Itoa(http.StatusFound))
+			http.Redirect(w, r, magnetLink(r, rec, mirrors), http.StatusFound)
+			return
+		}
+		if wantsMetalink(r) {
+			serveMetalink(w, r, rec, mirrors)
+			return
+		}
+	}
+	if len(mirrors) == 0 {
+		log.Println("[txtdirect]: There are no usable mirrors, fallback triggered.")
+		fallback(w, r, fallbackURL, rec.Type, "to", rec.Code, c)
+		return
+	}
+	if local > 0 {
+		mirrors = mirrors[:local]
+	}
+
+	to, err := iriToURI(pickMirror(mirrors, rand.Intn).URL)
+	if err != nil {
+		log.Print("Fallback is triggered because an error has occurred: ", err)
+		fallback(w, r, fallbackURL, rec.Type, "to", rec.Code, c)
+		return
+	}
+	log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, to)
+	setCacheControl(w, rec.Code)
+	w.Header().Add("Status-Code", strconv.Itoa(rec.Code))
+	http.Redirect(w, r, to, rec.Code)
+	if c.Prometheus.Enable {
+		RequestsByStatus.WithLabelValues(r.Host, strconv.Itoa(rec.Code)).Add(1)
+	}
+}
+
+// serveMirrorList lists the usable mirrors in the order of preference
+// in plaintext, and the unusable ones as comments
+func serveMirrorList(w http.ResponseWriter, rec record, mirrors []mirror, country string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	if country != "" {
+		fmt.Fprintf(w, "# country = %s\n", country)
+	}
+	usable := make(map[string]bool)
+	for _, m := range mirrors {
+		usable[m.URL] = true
+		fmt.Fprintln(w, withoutQuery(m.URL, "mirrorlist"))
+	}
+	for _, m := range rec.Mirrors {
+		if !usable[m.URL] {
+			fmt.Fprintf(w, "# unhealthy: %s\n", withoutQuery(m.URL, "mirrorlist"))
+		}
+	}
+}
+
+// withoutQuery removes the given query parameter the
+// mirror's URL got from the request's placeholders
+func withoutQuery(mirror, name string) string {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return mirror
+	}
+	query := u.Query()
+	if _, ok := query[name]; !ok {
+		return mirror
+	}
+	query.Del(name)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
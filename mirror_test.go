@@ -0,0 +1,126 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseMirror(t *testing.T) {
+	tests := []struct {
+		field     string
+		expected  mirror
+		shouldErr bool
+	}{
+		{"https://mirror.test{uri}", mirror{URL: "https://mirror.test/file.iso", Weight: 1}, false},
+		{"https://mirror.test weight=3 country=de,AT", mirror{URL: "https://mirror.test", Weight: 3, Countries: []string{"DE", "AT"}}, false},
+		{"", mirror{}, true},
+		{"https://mirror.test weight=-1", mirror{}, true},
+		{"https://mirror.test speed=fast", mirror{}, true},
+	}
+	for i, test := range tests {
+		m, err := parseMirror(test.field, httptest.NewRequest("GET", "https://example.com/file.iso", nil))
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, m)
+		}
+	}
+}
+
+func TestPickMirror(t *testing.T) {
+	mirrors := []mirror{{URL: "a", Weight: 1}, {URL: "b", Weight: 3}, {URL: "c", Weight: 1}}
+	expected := []string{"a", "b", "b", "b", "c"}
+	for n, url := range expected {
+		picked := pickMirror(mirrors, func(total int) int {
+			if total != 5 {
+				t.Fatalf("Expected the total weight to be 5, got %d", total)
+			}
+			return n
+		})
+		if picked.URL != url {
+			t.Errorf("Expected %s for %d, got %s", url, n, picked.URL)
+		}
+	}
+}
+
+func TestMirrorRedirect(t *testing.T) {
+	geoip := GeoIP{Enable: true, Database: "testdata/GeoIP2-City-Test.mmdb"}
+	geoip.SetDefaults()
+	if err := geoip.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer geoip.Close()
+
+	tests := []struct {
+		url      string
+		remote   string
+		status   int
+		location string
+		body     string
+	}{
+		{"https://mirror.test/file.iso", "89.160.20.1:1234", 302, "", ""},
+		{"https://mirror.test/file.iso", "81.2.69.160:1234", 302, "https://gb.mirror.test/file.iso", ""},
+		{"https://mirror.test/file.iso", "[2a02:cf40::1]:1234", 302, "https://de.mirror.test/file.iso", ""},
+		{
+			"https://mirror.test/file.iso?mirrorlist&arch=x86",
+			"81.2.69.160:1234",
+			200,
+			"",
+			"# country = GB\nhttps://gb.mirror.test/file.iso?arch=x86\nhttps://global.mirror.test/file.iso?arch=x86\nhttps://de.mirror.test/file.iso?arch=x86\n",
+		},
+		{"https://invalid.mirror.test/file.iso", "81.2.69.160:1234", 404, "", ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"mirror"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			GeoIP:    geoip,
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.RemoteAddr = test.remote
+		w := httptest.NewRecorder()
+		if err := serve(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		location := w.Header().Get("Location")
+		switch {
+		case test.status == 302 && test.location == "":
+			// The clients without local mirrors get any of the mirrors
+			if location != "https://de.mirror.test/file.iso" && location != "https://gb.mirror.test/file.iso" && location != "https://global.mirror.test/file.iso" {
+				t.Errorf("Test %d: Expected one of the mirrors, got %s", i, location)
+			}
+		case location != test.location:
+			t.Errorf("Test %d: Expected %s, got %s", i, test.location, location)
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected the body %q, got %q", i, test.body, w.Body.String())
+		}
+	}
+}
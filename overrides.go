@@ -0,0 +1,261 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Overrides contains the configuration of the local override file. Its
+// redirects and blocked hosts are served before looking up the records,
+// so operators can push emergency changes without touching DNS. The file
+// is reloaded whenever it changes.
+type Overrides struct {
+	Enable bool
+	File   string
+	// Shadow compares the overridden requests' decisions
+	// with the ones their DNS records would have made
+	Shadow bool
+
+	store *overrideStore
+}
+
+// override is a single entry of the override file
+type override struct {
+	Host string `yaml:"host"`
+	// Path matches the request's path exactly, or as
+	// a prefix if it ends with *. Empty matches all paths.
+	Path string `yaml:"path"`
+	To   string `yaml:"to"`
+	Code int    `yaml:"code"`
+	// Block answers the matching requests with 403 Forbidden
+	Block bool `yaml:"block"`
+}
+
+// overrideFile is the format of the JSON or YAML override file
+type overrideFile struct {
+	Overrides []override `yaml:"overrides"`
+}
+
+// overrideStore holds the entries of the override file by their hosts
+type overrideStore struct {
+	sync.RWMutex
+	hosts   map[string][]override
+	watcher *fsnotify.Watcher
+}
+
+// SetDefaults sets the default values for overrides config
+// if the fields are empty
+func (o *Overrides) SetDefaults() {
+	if o.store == nil {
+		o.store = &overrideStore{hosts: make(map[string][]override)}
+	}
+}
+
+// Load reads the override file and replaces the current entries.
+// The current entries are kept if the file is invalid.
+func (o *Overrides) Load() error {
+	data, err := ioutil.ReadFile(o.File)
+	if err != nil {
+		return fmt.Errorf("couldn't read the override file: %s", err.Error())
+	}
+	var file overrideFile
+	// YAML is a superset of JSON, so both formats are parsed the same way
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return fmt.Errorf("couldn't parse the override file: %s", err.Error())
+	}
+
+	hosts := make(map[string][]override)
+	for i, entry := range file.Overrides {
+		if err := entry.validate(); err != nil {
+			return fmt.Errorf("invalid override %d: %s", i, err.Error())
+		}
+		if entry.Code == 0 {
+			entry.Code = http.StatusFound
+		}
+		host := canonicalHost(entry.Host)
+		hosts[host] = append(hosts[host], entry)
+	}
+
+	o.store.Lock()
+	o.store.hosts = hosts
+	o.store.Unlock()
+	return nil
+}
+
+// validate checks the override file's entry
+func (entry override) validate() error {
+	switch {
+	case entry.Host == "":
+		return fmt.Errorf("the host is required")
+	case entry.Path != "" && !strings.HasPrefix(entry.Path, "/"):
+		return fmt.Errorf("the path %s should start with /", entry.Path)
+	case entry.Block && entry.To != "":
+		return fmt.Errorf("the blocked hosts can't have a target")
+	case !entry.Block && entry.To == "":
+		return fmt.Errorf("either the target or block is required")
+	case entry.Code != 0 && !validRedirectCode(entry.Code):
+		return fmt.Errorf("%d is not a redirect status code", entry.Code)
+	}
+	return nil
+}
+
+// lookup returns the request's override, the entries with
+// a path take precedence over the ones for the whole host
+func (o *Overrides) lookup(r *http.Request) (override, bool) {
+	o.store.RLock()
+	defer o.store.RUnlock()
+
+	var match override
+	found := false
+	for _, entry := range o.store.hosts[canonicalHost(r.Host)] {
+		switch {
+		case entry.Path == r.URL.Path:
+			return entry, true
+		case strings.HasSuffix(entry.Path, "*") && strings.HasPrefix(r.URL.Path, strings.TrimSuffix(entry.Path, "*")):
+			if !found || len(entry.Path) > len(match.Path) {
+				match, found = entry, true
+			}
+		case entry.Path == "" && !found:
+			match, found = entry, true
+		}
+	}
+	return match, found
+}
+
+// serve answers the request using its override if it has one
+func (o *Overrides) serve(w http.ResponseWriter, r *http.Request, c Config) bool {
+	entry, ok := o.lookup(r)
+	if !ok {
+		return false
+	}
+	getRequestInfo(r.Context()).Type = "override"
+
+	if entry.Block {
+		log.Printf("[txtdirect]: %s is blocked by the override file", r.Host+r.URL.Path)
+		w.Header().Set("Status-Code", strconv.Itoa(http.StatusForbidden))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		if c.Prometheus.Enable {
+			RequestsByStatus.WithLabelValues(r.Host, strconv.Itoa(http.StatusForbidden)).Add(1)
+		}
+		if o.Shadow {
+			go o.shadow(r, http.StatusForbidden, "", c)
+		}
+		return true
+	}
+
+	to, err := parsePlaceholders(entry.To, r, []string{})
+	if err != nil {
+		log.Print("Fallback is triggered because an error has occurred: ", err)
+		fallback(w, r, nil, "", "global", 0, c)
+		return true
+	}
+	log.Printf("[txtdirect]: %s > %s (override)", r.Host+r.URL.Path, to)
+	setCacheControl(w, entry.Code)
+	w.Header().Add("Status-Code", strconv.Itoa(entry.Code))
+	http.Redirect(w, r, to, entry.Code)
+	if c.Prometheus.Enable {
+		RequestsByStatus.WithLabelValues(r.Host, strconv.Itoa(entry.Code)).Add(1)
+	}
+	if o.Shadow {
+		go o.shadow(r, entry.Code, to, c)
+	}
+	return true
+}
+
+// Start loads the override file, then watches it and reloads it on changes
+func (o *Overrides) Start() error {
+	if err := o.Load(); err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// The directory is watched since the editors and config
+	// management tools replace the file rather than writing it
+	if err := watcher.Add(filepath.Dir(o.File)); err != nil {
+		watcher.Close()
+		return err
+	}
+	o.store.Lock()
+	o.store.watcher = watcher
+	o.store.Unlock()
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(o.File) || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if err := o.Load(); err != nil {
+					log.Printf("[txtdirect]: Keeping the previous overrides: %s", err.Error())
+					continue
+				}
+				log.Printf("[txtdirect]: Reloaded the override file %s", o.File)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[txtdirect]: Couldn't watch the override file: %s", err.Error())
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops watching the override file
+func (o *Overrides) Stop() error {
+	o.store.Lock()
+	defer o.store.Unlock()
+	if o.store.watcher == nil {
+		return nil
+	}
+	err := o.store.watcher.Close()
+	o.store.watcher = nil
+	return err
+}
+
+// ParseOverrides parses the txtdirect config for the override file
+func (o *Overrides) ParseOverrides(c Dispenser) error {
+	switch c.Val() {
+	case "file":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		o.File = args[0]
+
+	case "shadow":
+		o.Shadow = true
+
+	default:
+		return c.ArgErr() // unhandled option for overrides
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "overrides.yaml")
+	ioutil.WriteFile(file, []byte(`
+overrides:
+  - host: headers.test
+    to: https://emergency.example.com{uri}
+  - host: headers.test
+    path: /docs/*
+    to: https://docs.example.com
+    code: 301
+  - host: headers.test
+    path: /docs/exact
+    to: https://exact.example.com
+  - host: blocked.test
+    block: true
+`), 0644)
+
+	c := Config{
+		Enable:    []string{"host"},
+		Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+		Overrides: Overrides{Enable: true, File: file},
+	}
+	c.Overrides.SetDefaults()
+	if err := c.Overrides.Load(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		url      string
+		status   int
+		location string
+	}{
+		{"https://headers.test/path?q=1", 302, "https://emergency.example.com/path?q=1"},
+		{"https://headers.test/docs/page", 301, "https://docs.example.com"},
+		{"https://headers.test/docs/exact", 302, "https://exact.example.com"},
+		{"https://blocked.test/", 403, ""},
+		// The other hosts are looked up as usual
+		{"https://temporary.headers.test/", 307, "https://example.com"},
+	}
+	for i, test := range tests {
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("Test %d: Expected %d to %s, got %d to %s", i, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// The file is reloaded when it gets replaced
+	if err := c.Overrides.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Overrides.Stop()
+	tmp := filepath.Join(dir, "overrides.tmp")
+	ioutil.WriteFile(tmp, []byte(`{"overrides": [{"host": "headers.test", "to": "https://new.example.com"}]}`), 0644)
+	os.Rename(tmp, file)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		Redirect(w, httptest.NewRequest("GET", "https://headers.test/docs/page", nil), c)
+		if w.Header().Get("Location") == "https://new.example.com" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the override file to be reloaded, got %s", w.Header().Get("Location"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The invalid files don't replace the current overrides
+	ioutil.WriteFile(file, []byte(`{"overrides": [{"host": "headers.test"}]}`), 0644)
+	time.Sleep(100 * time.Millisecond)
+	w := httptest.NewRecorder()
+	Redirect(w, httptest.NewRequest("GET", "https://headers.test/", nil), c)
+	if w.Header().Get("Location") != "https://new.example.com" {
+		t.Errorf("Expected the previous overrides to be kept, got %s", w.Header().Get("Location"))
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	file, err := ioutil.TempFile("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"overrides": [{"host": "example.com", "to": "https://example.org", "code": 200}]}`)
+	file.Close()
+
+	c := caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		overrides {
+			file %s
+		}
+	}
+	`, file.Name()))
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The file gets loaded by the startup hook
+	if err := conf.Overrides.Load(); err == nil {
+		t.Errorf("Expected an error for an invalid override")
+	}
+
+	ioutil.WriteFile(file.Name(), []byte("overrides:\n  - host: example.com\n    to: https://example.org\n"), 0644)
+	conf, err = parse(caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		overrides {
+			file %s
+			shadow
+		}
+	}
+	`, file.Name())))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := conf.Overrides.Load(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if entry, ok := conf.Overrides.lookup(httptest.NewRequest("GET", "https://example.com/", nil)); !ok || entry.Code != 302 {
+		t.Errorf("Expected the override to be loaded, got %+v", entry)
+	}
+	if !conf.Overrides.Shadow {
+		t.Errorf("Expected the overrides to be shadowed")
+	}
+}
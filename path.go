@@ -22,6 +22,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,6 +31,39 @@ var FromRegex = regexp.MustCompile("\\/\\$(\\d+)")
 var GroupRegex = regexp.MustCompile("P<[a-zA-Z]+[a-zA-Z0-9]*>")
 var GroupOrderRegex = regexp.MustCompile("P<([a-zA-Z]+[a-zA-Z0-9]*)>")
 
+// maxCachedRegexes is the max number of compiled re= fields kept in the cache
+const maxCachedRegexes = 1024
+
+// regexCache keeps the compiled re= fields of the records,
+// so they don't get compiled again on every request
+var regexCache = struct {
+	sync.RWMutex
+	regexes map[string]*regexp.Regexp
+}{regexes: make(map[string]*regexp.Regexp)}
+
+// compileRegex compiles the given re= field or returns it from the cache
+func compileRegex(re string) (*regexp.Regexp, error) {
+	regexCache.RLock()
+	regex, ok := regexCache.regexes[re]
+	regexCache.RUnlock()
+	if ok {
+		return regex, nil
+	}
+
+	regex, err := regexp.Compile(re)
+	if err != nil {
+		return nil, fmt.Errorf("the given regex %s doesn't compile: %s", re, err.Error())
+	}
+	regexCache.Lock()
+	// The cache gets dropped when it's full instead of tracking the usage
+	if len(regexCache.regexes) >= maxCachedRegexes {
+		regexCache.regexes = make(map[string]*regexp.Regexp)
+	}
+	regexCache.regexes[re] = regex
+	regexCache.Unlock()
+	return regex, nil
+}
+
 // zoneFromPath generates a DNS zone with the given host and path
 // It will use custom regex to parse the path if it's provided in
 // the given record.
@@ -39,12 +73,18 @@ func zoneFromPath(host string, path string, rec record) (string, int, []string,
 	}
 	pathSubmatchs := PathRegex.FindAllStringSubmatch(path, -1)
 	if rec.Re != "" {
-		CustomRegex, err := regexp.Compile(rec.Re)
+		CustomRegex, err := compileRegex(rec.Re)
 		if err != nil {
-			log.Printf("<%s> [txtdirect]: the given regex doesn't work as expected: %s", time.Now().String(), rec.Re)
+			return "", 0, []string{}, err
+		}
+		if CustomRegex.NumSubexp() < 1 {
+			return "", 0, []string{}, fmt.Errorf("the given regex %s doesn't have any capture groups", rec.Re)
 		}
 		pathSubmatchs = CustomRegex.FindAllStringSubmatch(path, -1)
 		if GroupRegex.MatchString(rec.Re) {
+			if len(pathSubmatchs) < 1 {
+				return "", 0, []string{}, fmt.Errorf("the given regex %s doesn't match %s", rec.Re, path)
+			}
 			pathSlice := []string{}
 			unordered := make(map[string]string)
 			for _, item := range pathSubmatchs[0] {
@@ -124,7 +164,28 @@ func getFinalRecord(zone string, from int, ctx context.Context, c Config, r *htt
 		return record{}, fmt.Errorf("could not get TXT record: %s", err)
 	}
 
-	txts[0], err = parsePlaceholders(txts[0], r, pathSlice)
+	if txts[0], err = joinParts(zone, txts[0], ctx, c); err != nil {
+		return record{}, err
+	}
+	// The path records can't chain other path records,
+	// so they don't inherit the type of the zone's records
+	txts[0] = c.Defaults.merge(zone, txts[0], "type")
+
+	info := getRequestInfo(ctx)
+	info.Records = append(info.Records, usedRecord{Zone: recordZone(zone), TXT: txts[0], captures: pathSlice})
+
+	// The conditions compare the placeholders themselves,
+	// so they're kept for the record's parser
+	fields := strings.Split(txts[0], ";")
+	for i, field := range fields {
+		if strings.HasPrefix(field, "if=") || strings.HasPrefix(field, "unless=") {
+			continue
+		}
+		if fields[i], err = parsePlaceholders(field, r, pathSlice); err != nil {
+			return record{}, err
+		}
+	}
+	txts[0] = strings.Join(fields, ";")
 	rec := record{}
 	if err = rec.Parse(txts[0], r, c); err != nil {
 		return rec, fmt.Errorf("could not parse record: %s", err)
@@ -134,6 +195,7 @@ func getFinalRecord(zone string, from int, ctx context.Context, c Config, r *htt
 		return rec, fmt.Errorf("chaining path is not currently supported")
 	}
 
+	info.setRecord(recordZone(zone), rec.Type)
 	return rec, nil
 }
 
@@ -171,6 +171,30 @@ func Test_zoneFromPath(t *testing.T) {
 			"",
 			fmt.Errorf("length of path doesn't match with length of from= in record"),
 		},
+		{
+			"example.com",
+			"/test",
+			"",
+			"\\/(test",
+			"",
+			fmt.Errorf("the given regex \\/(test doesn't compile: error parsing regexp: missing closing ): `\\/(test`"),
+		},
+		{
+			"example.com",
+			"/test",
+			"",
+			"\\/test",
+			"",
+			fmt.Errorf("the given regex \\/test doesn't have any capture groups"),
+		},
+		{
+			"example.com",
+			"/test",
+			"",
+			"\\?query=(?P<a>[^&]+)",
+			"",
+			fmt.Errorf("the given regex \\?query=(?P<a>[^&]+) doesn't match /test"),
+		},
 	}
 	for _, test := range tests {
 		rec := record{}
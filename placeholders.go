@@ -15,20 +15,30 @@ package txtdirect
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var PlaceholderRegex = regexp.MustCompile("{[~>?]?\\w+}")
+var PlaceholderRegex = regexp.MustCompile("{[~>?]?[\\w-]+}")
 
 // parsePlaceholders gets a string input and looks for placeholders inside
 // the string. it will then replace them with the actual data from the request
 func parsePlaceholders(input string, r *http.Request, pathSlice []string) (string, error) {
+	defer func(start time.Time) {
+		PlaceholderDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
 	placeholders := PlaceholderRegex.FindAllStringSubmatch(input, -1)
+	if len(placeholders) > 0 && r != nil {
+		_, span := startSpan(r.Context(), "txtdirect.placeholders", spanKindInternal)
+		span.setAttribute("txtdirect.placeholders", len(placeholders))
+		defer span.finish(nil)
+	}
 	for _, placeholder := range placeholders {
 		switch placeholder[0] {
 		case "{uri}":
@@ -42,12 +52,7 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 		case "{host}":
 			input = strings.Replace(input, "{host}", r.Host, -1)
 		case "{hostonly}":
-			// Removes port from host
-			host := r.Host
-			if strings.Contains(r.Host, ":") {
-				hostSlice := strings.Split(r.Host, ":")
-				host = hostSlice[0]
-			}
+			host, _ := splitHostPort(r.Host)
 			input = strings.Replace(input, "{hostonly}", host, -1)
 		case "{method}":
 			input = strings.Replace(input, "{method}", r.Method, -1)
@@ -56,13 +61,33 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 		case "{path_escaped}":
 			input = strings.Replace(input, "{path_escaped}", url.QueryEscape(r.URL.Path), -1)
 		case "{port}":
-			input = strings.Replace(input, "{port}", r.URL.Port(), -1)
+			// The server requests only have the port in the Host header
+			_, port := splitHostPort(r.Host)
+			if port == "" {
+				port = r.URL.Port()
+			}
+			input = strings.Replace(input, "{port}", port, -1)
 		case "{query}":
 			input = strings.Replace(input, "{query}", r.URL.RawQuery, -1)
 		case "{query_escaped}":
 			input = strings.Replace(input, "{query_escaped}", url.QueryEscape(r.URL.RawQuery), -1)
 		case "{uri_escaped}":
 			input = strings.Replace(input, "{uri_escaped}", url.QueryEscape(r.URL.RequestURI()), -1)
+		case "{remote}":
+			input = strings.Replace(input, "{remote}", clientIP(r), -1)
+		case "{remote_port}":
+			_, port, _ := net.SplitHostPort(r.RemoteAddr)
+			input = strings.Replace(input, "{remote_port}", port, -1)
+		case "{geo_country}":
+			location := getRequestInfo(r.Context()).location(r)
+			input = strings.Replace(input, "{geo_country}", location.Country, -1)
+		case "{geo_city}":
+			location := getRequestInfo(r.Context()).location(r)
+			input = strings.Replace(input, "{geo_city}", location.City, -1)
+		case "{tls_client_cn}":
+			input = strings.Replace(input, "{tls_client_cn}", clientCertCN(r), -1)
+		case "{tls_client_fingerprint}":
+			input = strings.Replace(input, "{tls_client_fingerprint}", clientCertFingerprint(r), -1)
 		case "{user}":
 			user, _, ok := r.BasicAuth()
 			if !ok {
@@ -81,13 +106,8 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 			if n < 1 {
 				return "", fmt.Errorf("{label0} is not supported")
 			}
-			// Removes port from host
-			host := r.Host
-			if strings.Contains(r.Host, ":") {
-				hostSlice := strings.Split(r.Host, ":")
-				host = hostSlice[0]
-			}
-			labels := strings.Split(host, ".")
+			// The labels match the ones of the record's zone
+			labels := strings.Split(canonicalHost(r.Host), ".")
 			if n > len(labels) {
 				return "", fmt.Errorf("Cannot parse a label greater than %d", len(labels))
 			}
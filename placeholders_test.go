@@ -116,6 +116,12 @@ func TestParsePlaceholders(t *testing.T) {
 			[]string{},
 			"example.com/test/querykey%3Dqueryvalue%26anotherquerykey%3Danothervalue",
 		},
+		{
+			"example.com/{hostonly}/{port}",
+			"https://[2001:db8::1]:8443/test",
+			[]string{},
+			"example.com/2001:db8::1/8443",
+		},
 		{
 			"example.com/{user}",
 			"https://example.com/user1",
@@ -140,6 +146,12 @@ func TestParsePlaceholders(t *testing.T) {
 			[]string{},
 			"about.example.com/com",
 		},
+		{
+			"example.com/{label1}",
+			"https://Bücher.example.com",
+			[]string{},
+			"example.com/xn--bcher-kva",
+		},
 		{
 			"about.example.com/{$1}/{$3}/{$2}",
 			"https://about.example.com/this/is/test",
@@ -152,6 +164,18 @@ func TestParsePlaceholders(t *testing.T) {
 			[]string{"123", "test", "t3st"},
 			"about.example.com/123/t3st/test",
 		},
+		{
+			"example.com/{remote}:{remote_port}",
+			"https://example.com/test",
+			[]string{},
+			"example.com/192.0.2.1:1234",
+		},
+		{
+			"example.com/{geo_country}",
+			"https://example.com/test",
+			[]string{},
+			"example.com/",
+		},
 	}
 	for _, test := range tests {
 		req := httptest.NewRequest("GET", test.requested, nil)
@@ -0,0 +1,343 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Policy restricts the targets the records can redirect and proxy to,
+// protecting against open redirects and server side request forgery
+type Policy struct {
+	Enable      bool
+	Schemes     []string
+	DenyPrivate bool
+	Domains     []string
+	// Networks are the reserved networks which can still be fetched
+	// with deny_private, e.g. the network of an internal upstream
+	Networks []*net.IPNet
+}
+
+// DefaultPolicySchemes are the target schemes allowed by default
+var DefaultPolicySchemes = []string{"http", "https"}
+
+// reservedNetworks are the private, loopback, link-local and other
+// special purpose ranges denied for the fetches by deny_private
+var reservedNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+	"240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// policyLookup resolves the hosts checked by deny_private
+var policyLookup = net.DefaultResolver.LookupIPAddr
+
+// The kinds of the policy violations, they're
+// the reason label of the violations metric
+const (
+	violationInvalid  = "invalid"
+	violationScheme   = "scheme"
+	violationDomain   = "domain"
+	violationResolve  = "resolve"
+	violationReserved = "reserved"
+)
+
+// policyViolation is returned when a target isn't allowed by the policy
+type policyViolation struct {
+	target string
+	reason string
+	kind   string
+}
+
+func (v *policyViolation) Error() string {
+	return fmt.Sprintf("the target %s is not allowed: %s", v.target, v.reason)
+}
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// SetDefaults sets the default values for policy config
+// if the fields are empty
+func (p *Policy) SetDefaults() {
+	if len(p.Schemes) == 0 {
+		p.Schemes = DefaultPolicySchemes
+	}
+}
+
+// ParsePolicy parses the txtdirect config for policy
+func (p *Policy) ParsePolicy(c Dispenser) error {
+	switch c.Val() {
+	case "schemes":
+		schemes := c.RemainingArgs()
+		if len(schemes) == 0 {
+			return c.ArgErr()
+		}
+		for _, scheme := range schemes {
+			p.Schemes = append(p.Schemes, strings.ToLower(scheme))
+		}
+
+	case "deny_private":
+		p.DenyPrivate = true
+
+	case "allow_domains":
+		domains := c.RemainingArgs()
+		if len(domains) == 0 {
+			return c.ArgErr()
+		}
+		for _, domain := range domains {
+			if strings.Contains(strings.TrimPrefix(domain, "*."), "*") {
+				return fmt.Errorf("The given value for allow_domains field is not standard. It should be a domain or a *. wildcard")
+			}
+			p.Domains = append(p.Domains, strings.ToLower(strings.TrimSuffix(domain, ".")))
+		}
+
+	case "allow_networks":
+		networks := c.RemainingArgs()
+		if len(networks) == 0 {
+			return c.ArgErr()
+		}
+		for _, network := range networks {
+			// The single addresses are allowed on their own
+			if !strings.Contains(network, "/") {
+				if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return fmt.Errorf("The given value for allow_networks field is not standard. It should be a CIDR or an IP address")
+			}
+			p.Networks = append(p.Networks, ipNet)
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for policy
+	}
+	return nil
+}
+
+// checkTarget checks the target's scheme and domain against the policy.
+// Relative targets stay on the requested host and are always allowed.
+func (p *Policy) checkTarget(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return &policyViolation{target, "it is not a valid URL", violationInvalid}
+	}
+	if u.Scheme == "" && u.Host == "" {
+		if leavesHost(target) {
+			return &policyViolation{target, "it is a relative URL leaving the requested host", violationInvalid}
+		}
+		return nil
+	}
+	if !contains(p.Schemes, strings.ToLower(u.Scheme)) {
+		return &policyViolation{target, fmt.Sprintf("the %q scheme is not allowed", u.Scheme), violationScheme}
+	}
+	if len(p.Domains) > 0 && !p.allowedDomain(u.Hostname()) {
+		return &policyViolation{target, fmt.Sprintf("%s is not in the allowed domains", u.Hostname()), violationDomain}
+	}
+	return nil
+}
+
+// leavesHost checks if the browsers would read the relative target as
+// a network-path reference, they trim the spaces and read the backslashes
+// before the query as slashes, e.g. /\evil.com is read as //evil.com
+func leavesHost(target string) bool {
+	target = strings.TrimSpace(target)
+	if i := strings.IndexAny(target, "?#"); i >= 0 {
+		target = target[:i]
+	}
+	return strings.HasPrefix(target, "//") || strings.Contains(target, "\\")
+}
+
+// allowedDomain checks if the host matches one of the allowed domains,
+// the *. wildcards match the domain's subdomains but not the domain
+func (p *Policy) allowedDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range p.Domains {
+		if strings.HasPrefix(domain, "*.") {
+			if strings.HasSuffix(host, domain[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFetch checks a target fetched by the server, on top of the target
+// checks it denies the hosts resolving to a reserved address if enabled
+func (p *Policy) checkFetch(ctx context.Context, target string) error {
+	_, err := p.pinFetch(ctx, target)
+	return err
+}
+
+// pinFetch checks a target fetched by the server like checkFetch and
+// returns the checked addresses of its host, so the fetch can be pinned
+// to them. The IP literals and the hosts which aren't resolved without
+// deny_private don't have any.
+func (p *Policy) pinFetch(ctx context.Context, target string) ([]net.IP, error) {
+	if err := p.checkTarget(target); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, &policyViolation{target, "it is not a valid URL", violationInvalid}
+	}
+	return p.resolveHost(ctx, target, u.Hostname())
+}
+
+// checkHost denies the host if deny_private is enabled and
+// any of its addresses are in the reserved ranges
+func (p *Policy) checkHost(ctx context.Context, target, host string) error {
+	_, err := p.resolveHost(ctx, target, host)
+	return err
+}
+
+// resolveHost checks the host like checkHost and returns its addresses
+func (p *Policy) resolveHost(ctx context.Context, target, host string) ([]net.IP, error) {
+	if !p.DenyPrivate {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if p.reserved(ip) {
+			return nil, &policyViolation{target, fmt.Sprintf("%s is a reserved address", host), violationReserved}
+		}
+		return nil, nil
+	}
+	addrs, err := policyLookup(ctx, host)
+	if err != nil {
+		return nil, &policyViolation{target, fmt.Sprintf("couldn't resolve %s: %s", host, err.Error()), violationResolve}
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if p.reserved(addr.IP) {
+			return nil, &policyViolation{target, fmt.Sprintf("%s resolves to the reserved address %s", host, addr.IP), violationReserved}
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// reserved checks if the address is in the reserved
+// ranges and isn't in one of the allowed networks
+func (p *Policy) reserved(ip net.IP) bool {
+	for _, network := range p.Networks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return isReserved(ip)
+}
+
+// control is the dialer's control function refusing the connections to
+// the reserved addresses. The hosts resolving to other addresses after
+// they were checked, e.g. by DNS rebinding, still can't reach them.
+func (p *Policy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && p.reserved(ip) {
+		return &policyViolation{address, fmt.Sprintf("%s is a reserved address", host), violationReserved}
+	}
+	return nil
+}
+
+func isReserved(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// deny logs the violation and responds with 403 Forbidden
+func (p *Policy) deny(w http.ResponseWriter, r *http.Request, err error, c Config) {
+	log.Printf("[txtdirect]: Policy violation for %s: %s", r.Host+r.URL.Path, err.Error())
+	if c.Prometheus.Enable {
+		kind := violationInvalid
+		if violation, ok := err.(*policyViolation); ok {
+			kind = violation.kind
+		}
+		PolicyViolations.WithLabelValues(r.Host, kind).Add(1)
+	}
+	if c.Webhooks.Enable {
+		c.Webhooks.notify(webhookEvent{Event: WebhookPolicyViolation, Status: http.StatusForbidden, Reason: err.Error()}, r)
+	}
+	w.Header().Del("Location")
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusForbidden))
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// policyWriter checks the Location header of the redirects
+// against the policy before they are sent to the client
+type policyWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	c Config
+
+	denied bool
+}
+
+func (p *policyWriter) WriteHeader(status int) {
+	if status >= 300 && status < 400 {
+		if err := p.c.Policy.checkTarget(p.Header().Get("Location")); err != nil {
+			p.denied = true
+			p.c.Policy.deny(p.ResponseWriter, p.r, err, p.c)
+			return
+		}
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *policyWriter) Write(b []byte) (int, error) {
+	// The denied redirect's body is dropped
+	if p.denied {
+		return len(b), nil
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Flush sends the buffered response to the client
+func (p *policyWriter) Flush() {
+	if flusher, ok := p.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
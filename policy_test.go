@@ -0,0 +1,335 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestPolicyCheckTarget(t *testing.T) {
+	policy := Policy{Enable: true, Domains: []string{"example.com", "*.allowed.test"}}
+	policy.SetDefaults()
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"https://example.com/docs", true},
+		{"http://EXAMPLE.com.", true},
+		{"https://docs.allowed.test", true},
+		{"/relative/path", true},
+		{"https://allowed.test", false},
+		{"https://sub.example.com", false},
+		{"https://example.com.evil.test", false},
+		{"javascript://example.com/%0Aalert(1)", false},
+		{"ftp://example.com/file", false},
+		{"//evil.test/path", false},
+		{"/\\evil.test/path", false},
+		{"\\\\evil.test/path", false},
+		{" //evil.test/path", false},
+		{"/path\\..\\evil", false},
+		{"/search?q=a\\b", true},
+	}
+	for i, test := range tests {
+		err := policy.checkTarget(test.target)
+		if test.allowed != (err == nil) {
+			t.Errorf("Test %d: Expected %s to be allowed: %t, got %v", i, test.target, test.allowed, err)
+		}
+	}
+}
+
+func TestPolicyCheckFetch(t *testing.T) {
+	lookup := policyLookup
+	defer func() { policyLookup = lookup }()
+	policyLookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "public.test":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "rebind.test":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.0.0.1")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+
+	policy := Policy{Enable: true, DenyPrivate: true}
+	policy.SetDefaults()
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"https://public.test/", true},
+		{"https://93.184.216.34/", true},
+		{"https://rebind.test/", false},
+		{"http://127.0.0.1:8080/", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://[::1]/", false},
+		{"http://[::ffff:192.168.1.1]/", false},
+		{"http://[fd00::1]/", false},
+		{"https://missing.test/", false},
+	}
+	for i, test := range tests {
+		err := policy.checkFetch(context.Background(), test.target)
+		if test.allowed != (err == nil) {
+			t.Errorf("Test %d: Expected %s to be allowed: %t, got %v", i, test.target, test.allowed, err)
+		}
+	}
+
+	// The reserved addresses are only checked with deny_private
+	policy.DenyPrivate = false
+	if err := policy.checkFetch(context.Background(), "http://127.0.0.1/"); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestPolicyPinnedFetch(t *testing.T) {
+	var conns int32
+	upstream := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal " + r.Proto))
+	}), &http2.Server{}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+	// The system resolver doesn't know the host, so the fetch
+	// only works when it's pinned to the checked address
+	target := strings.Replace(upstream.URL, "127.0.0.1", "pinned.test", 1)
+
+	lookup := policyLookup
+	defer func() { policyLookup = lookup }()
+	policyLookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	tests := []struct {
+		networks []*net.IPNet
+		stream   bool
+		h2c      []string
+		status   int
+	}{
+		{nil, false, nil, http.StatusForbidden},
+		{nil, true, nil, http.StatusForbidden},
+		{nil, false, []string{"*"}, http.StatusForbidden},
+		{[]*net.IPNet{loopback}, false, nil, http.StatusOK},
+		{[]*net.IPNet{loopback}, true, nil, http.StatusOK},
+		{[]*net.IPNet{loopback}, false, []string{"*"}, http.StatusOK},
+		// The guarded h2c connection is reused
+		{[]*net.IPNet{loopback}, false, []string{"*"}, http.StatusOK},
+	}
+	for i, test := range tests {
+		before := atomic.LoadInt32(&conns)
+		c := Config{
+			Proxy:  Proxy{Enable: true, Stream: test.stream, H2C: test.h2c},
+			Policy: Policy{Enable: true, DenyPrivate: true, Networks: test.networks},
+		}
+		c.Proxy.SetDefaults()
+		c.Policy.SetDefaults()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if err := proxyRequest(w, r, record{To: target, Type: "proxy"}, c, nil, 302); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+		}
+		if internal := strings.Contains(w.Body.String(), "internal"); internal != (test.status == http.StatusOK) {
+			t.Errorf("Test %d: Expected the upstream's response to be relayed: %t, got %q", i, test.status == http.StatusOK, w.Body.String())
+		}
+		if test.h2c != nil && test.status == http.StatusOK && !strings.Contains(w.Body.String(), "HTTP/2.0") {
+			t.Errorf("Test %d: Expected the upstream to be spoken to over HTTP/2, got %q", i, w.Body.String())
+		}
+		if i == len(tests)-1 && atomic.LoadInt32(&conns) != before {
+			t.Errorf("Test %d: Expected the guarded h2c connection to be reused", i)
+		}
+	}
+
+	// The guarded dials are canceled with the request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := Config{
+		Proxy:  Proxy{Enable: true, H2C: []string{"*"}},
+		Policy: Policy{Enable: true, DenyPrivate: true, Networks: []*net.IPNet{loopback}},
+	}
+	c.Proxy.SetDefaults()
+	c.Policy.SetDefaults()
+	pool := guardTransport(&http2.Transport{}, &c.Policy).(*http2.Transport).ConnPool
+	host := strings.Replace(upstream.Listener.Addr().String(), "127.0.0.1", "other.pinned.test", 1)
+	r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+	r = r.WithContext(withPinnedAddrs(ctx, "other.pinned.test", []net.IP{net.ParseIP("127.0.0.1")}))
+	if _, err := pool.GetClientConn(r, host); err == nil {
+		t.Error("Expected the canceled request's dial to fail")
+	}
+}
+
+func TestPolicyControl(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	policy := Policy{Enable: true, DenyPrivate: true, Networks: []*net.IPNet{allowed}}
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"93.184.216.34:443", true},
+		{"10.1.2.3:80", true},
+		{"127.0.0.1:80", false},
+		{"[::1]:443", false},
+		{"[::ffff:169.254.169.254]:80", false},
+	}
+	for i, test := range tests {
+		err := policy.control("tcp", test.address, nil)
+		if test.allowed != (err == nil) {
+			t.Errorf("Test %d: Expected %s to be allowed: %t, got %v", i, test.address, test.allowed, err)
+		}
+		if _, ok := policyError(&net.OpError{Op: "dial", Net: "tcp", Err: err}); !test.allowed && !ok {
+			t.Errorf("Test %d: Expected the wrapped violation to be found", i)
+		}
+	}
+}
+
+func TestPolicyAllowNetworks(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		policy {
+			deny_private
+			allow_networks 10.1.0.0/16 192.168.1.5 fd00::1
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"http://10.1.2.3/", true},
+		{"http://10.2.0.1/", false},
+		{"http://192.168.1.5/", true},
+		{"http://192.168.1.6/", false},
+		{"http://[fd00::1]/", true},
+		{"http://[fd00::2]/", false},
+	}
+	for i, test := range tests {
+		err := conf.Policy.checkFetch(context.Background(), test.target)
+		if test.allowed != (err == nil) {
+			t.Errorf("Test %d: Expected %s to be allowed: %t, got %v", i, test.target, test.allowed, err)
+		}
+		if violation, ok := err.(*policyViolation); err != nil && (!ok || violation.kind != violationReserved) {
+			t.Errorf("Test %d: Expected a reserved address violation, got %v", i, err)
+		}
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		policy {
+			allow_networks internal
+		}
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for an invalid network")
+	}
+}
+
+func TestPolicyE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		status   int
+		location string
+	}{
+		{"https://allowed.policy.test/", 302, "https://docs.allowed.test"},
+		{"https://foreign.policy.test/", 403, ""},
+		{"https://scheme.policy.test/", 403, ""},
+		{"https://internal.policy.test/", 403, ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "proxy"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Policy:   Policy{Enable: true, DenyPrivate: true, Domains: []string{"*.allowed.test", "127.0.0.1"}},
+		}
+		c.Policy.SetDefaults()
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("Test %d: Expected %d %q, got %d %q", i, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		policy {
+			schemes https
+			deny_private
+			allow_domains example.com *.example.org.
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !conf.Policy.Enable || !conf.Policy.DenyPrivate || !identical(conf.Policy.Schemes, []string{"https"}) ||
+		!identical(conf.Policy.Domains, []string{"example.com", "*.example.org"}) {
+		t.Errorf("Unexpected policy config %+v", conf.Policy)
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		policy
+	}
+	`)
+	if conf, err = parse(c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !identical(conf.Policy.Schemes, DefaultPolicySchemes) {
+		t.Errorf("Expected the default schemes, got %v", conf.Policy.Schemes)
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		policy {
+			allow_domains ex*ample.com
+		}
+	}
+	`)
+	if _, err := parse(c); err == nil {
+		t.Errorf("Expected an error for a wildcard in the middle of a domain")
+	}
+}
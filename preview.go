@@ -0,0 +1,222 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Preview contains the configuration of the preview mode. The requests
+// sending the preview header or query parameter get a JSON description
+// of the record used and the target instead of being redirected, so the
+// records can be checked before going live.
+type Preview struct {
+	Enable bool
+	Header string
+	Query  string
+	// Token is the value the header or query parameter has to
+	// be set to, any value triggers the preview if it's empty
+	Token string
+}
+
+// usedRecord is a TXT record used for the request
+type usedRecord struct {
+	Zone string
+	TXT  string
+	// captures are the path's parts filled into the {$N} placeholders
+	captures []string
+}
+
+// previewResponse is the preview's JSON body
+type previewResponse struct {
+	Host     string          `json:"host"`
+	Path     string          `json:"path"`
+	Type     string          `json:"type,omitempty"`
+	Records  []previewRecord `json:"records"`
+	Status   int             `json:"status,omitempty"`
+	Target   string          `json:"target,omitempty"`
+	Fallback string          `json:"fallback,omitempty"`
+	Cached   bool            `json:"cached"`
+	Errors   []string        `json:"errors,omitempty"`
+}
+
+type previewRecord struct {
+	Zone         string            `json:"zone"`
+	Record       string            `json:"record"`
+	Fields       map[string]string `json:"fields"`
+	Placeholders map[string]string `json:"placeholders,omitempty"`
+}
+
+const (
+	DefaultPreviewHeader = "X-TXTDirect-Preview"
+	DefaultPreviewQuery  = "txtdirect-preview"
+)
+
+// previewPlaceholderRegex matches the placeholders and the path captures
+var previewPlaceholderRegex = regexp.MustCompile(`{[~>?$]?[\w-]+}`)
+
+// SetDefaults sets the default values for preview config
+// if the fields are empty
+func (p *Preview) SetDefaults() {
+	if p.Header == "" {
+		p.Header = DefaultPreviewHeader
+	}
+	if p.Query == "" {
+		p.Query = DefaultPreviewQuery
+	}
+}
+
+// requested checks if the request asks for a preview
+func (p *Preview) requested(r *http.Request) bool {
+	value := r.Header.Get(p.Header)
+	if value == "" {
+		values, ok := r.URL.Query()[p.Query]
+		if !ok {
+			return false
+		}
+		value = values[0]
+	}
+	return p.Token == "" || subtle.ConstantTimeCompare([]byte(value), []byte(p.Token)) == 1
+}
+
+// withoutQuery returns the request without the preview's query
+// parameter, so it doesn't end up in the target's placeholders
+func (p *Preview) withoutQuery(r *http.Request) *http.Request {
+	if r.URL.RawQuery == "" {
+		return r
+	}
+	var kept []string
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		key, err := url.QueryUnescape(strings.SplitN(param, "=", 2)[0])
+		if err != nil || key != p.Query {
+			kept = append(kept, param)
+		}
+	}
+	u := *r.URL
+	u.RawQuery = strings.Join(kept, "&")
+	req := r.WithContext(r.Context())
+	req.URL = &u
+	req.RequestURI = u.RequestURI()
+	return req
+}
+
+// serve handles the request without redirecting it and describes
+// the records and target used for it
+func (p *Preview) serve(w http.ResponseWriter, r *http.Request, info *requestInfo, c Config) error {
+	r = p.withoutQuery(r)
+	info.preview = true
+	rec := &redirectRecorder{header: make(http.Header)}
+	if err := handle(rec, r, c); err != nil && err.Error() != "option disabled" {
+		return err
+	}
+
+	preview := previewResponse{
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		Type:     info.Type,
+		Records:  []previewRecord{},
+		Status:   rec.status,
+		Target:   rec.header.Get("Location"),
+		Fallback: info.Fallback,
+		Cached:   info.RecordCached,
+		Errors:   info.Errors.lines(),
+	}
+	// The previewed records which fetch from their upstreams
+	// aren't served, their target is the upstream
+	if preview.Target == "" {
+		preview.Target = info.target
+	}
+	for _, used := range info.Records {
+		preview.Records = append(preview.Records, previewRecord{
+			Zone:         used.Zone,
+			Record:       used.TXT,
+			Fields:       recordFields(used.TXT),
+			Placeholders: placeholderValues(used, r),
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	return writeJSON(w, http.StatusOK, preview)
+}
+
+// recordFields splits the TXT record into its fields
+func recordFields(txt string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(txt, ";") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		if previous, ok := fields[key]; ok {
+			fields[key] = previous + ";" + parts[1]
+			continue
+		}
+		fields[key] = parts[1]
+	}
+	return fields
+}
+
+// placeholderValues returns the values the record's placeholders get
+func placeholderValues(used usedRecord, r *http.Request) map[string]string {
+	placeholders := previewPlaceholderRegex.FindAllString(used.TXT, -1)
+	if len(placeholders) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(placeholders))
+	for _, placeholder := range placeholders {
+		value, err := parsePlaceholders(placeholder, r, used.captures)
+		if err != nil {
+			value = fmt.Sprintf("error: %s", err.Error())
+		}
+		values[placeholder] = value
+	}
+	return values
+}
+
+// ParsePreview parses the txtdirect config for the preview mode
+func (p *Preview) ParsePreview(c Dispenser) error {
+	switch c.Val() {
+	case "header":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		p.Header = http.CanonicalHeaderKey(args[0])
+
+	case "query":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		p.Query = args[0]
+
+	case "token":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		p.Token = args[0]
+
+	default:
+		return c.ArgErr() // unhandled option for preview
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestPreview(t *testing.T) {
+	tests := []struct {
+		url      string
+		headers  map[string]string
+		token    string
+		expected previewResponse
+	}{
+		{
+			"https://start.chain.test/docs",
+			map[string]string{"X-TXTDirect-Preview": "1"},
+			"",
+			previewResponse{
+				Host: "start.chain.test",
+				Path: "/docs",
+				Type: "host",
+				Records: []previewRecord{{
+					Zone:         "_redirect.start.chain.test.",
+					Record:       "v=txtv0;to=https://middle.chain.test{path};type=host;code=301",
+					Fields:       map[string]string{"v": "txtv0", "to": "https://middle.chain.test{path}", "type": "host", "code": "301"},
+					Placeholders: map[string]string{"{path}": "/docs"},
+				}},
+				Status: 301,
+				Target: "https://middle.chain.test/docs",
+			},
+		},
+		{
+			// The preview's query parameter isn't passed to the target
+			"https://healthy.health.test/file?txtdirect-preview&a=b",
+			nil,
+			"",
+			previewResponse{
+				Host: "healthy.health.test",
+				Path: "/file",
+				Type: "host",
+				Records: []previewRecord{{
+					Zone:         "_redirect.healthy.health.test.",
+					Record:       "v=txtv0;to=https://healthy.target.test{uri};type=host",
+					Fields:       map[string]string{"v": "txtv0", "to": "https://healthy.target.test{uri}", "type": "host"},
+					Placeholders: map[string]string{"{uri}": "/file?a=b"},
+				}},
+				Status: 302,
+				Target: "https://healthy.target.test/file?a=b",
+			},
+		},
+		{
+			"https://conditions.path.test/app",
+			map[string]string{"X-TXTDirect-Preview": "secret", "User-Agent": "Mobile Safari"},
+			"secret",
+			previewResponse{
+				Host: "conditions.path.test",
+				Path: "/app",
+				Type: "host",
+				Records: []previewRecord{
+					{
+						Zone:   "_redirect.conditions.path.test.",
+						Record: "v=txtv0;type=path",
+						Fields: map[string]string{"v": "txtv0", "type": "path"},
+					},
+					{
+						Zone:   "_redirect.app.conditions.path.test.",
+						Record: "v=txtv0;to=https://m.example.com/{$1};type=host;if={>User-Agent}~(?i)mobile;fallback=https://www.example.com/{$1}",
+						Fields: map[string]string{
+							"v": "txtv0", "to": "https://m.example.com/{$1}", "type": "host",
+							"if": "{>User-Agent}~(?i)mobile", "fallback": "https://www.example.com/{$1}",
+						},
+						Placeholders: map[string]string{"{$1}": "app", "{>User-Agent}": "Mobile Safari"},
+					},
+				},
+				Status: 302,
+				Target: "https://m.example.com/app",
+			},
+		},
+		{
+			// The upstreams of the proxy records aren't fetched
+			"https://internal.policy.test/",
+			map[string]string{"X-TXTDirect-Preview": "1"},
+			"",
+			previewResponse{
+				Host: "internal.policy.test",
+				Path: "/",
+				Type: "proxy",
+				Records: []previewRecord{{
+					Zone:   "_redirect.internal.policy.test.",
+					Record: "v=txtv0;to=http://127.0.0.1:1/;type=proxy",
+					Fields: map[string]string{"v": "txtv0", "to": "http://127.0.0.1:1/", "type": "proxy"},
+				}},
+				Target: "http://127.0.0.1:1/",
+			},
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "path", "proxy"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Preview:  Preview{Enable: true, Token: test.token},
+		}
+		c.Preview.SetDefaults()
+		req := httptest.NewRequest("GET", test.url, nil)
+		for header, value := range test.headers {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		if err := serve(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		var preview previewResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil || w.Code != 200 {
+			t.Errorf("Test %d: Expected the preview as JSON, got %d: %s", i, w.Code, w.Body.String())
+			continue
+		}
+		if !reflect.DeepEqual(preview, test.expected) {
+			t.Errorf("Test %d: Expected the preview\n%+v\ngot\n%+v", i, test.expected, preview)
+		}
+	}
+
+	// The requests without the token get redirected
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Preview:  Preview{Enable: true, Token: "secret"},
+	}
+	c.Preview.SetDefaults()
+	req := httptest.NewRequest("GET", "https://start.chain.test/docs?txtdirect-preview=wrong", nil)
+	w := httptest.NewRecorder()
+	if err := serve(w, req, c); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 301 || w.Header().Get("Location") == "" {
+		t.Errorf("Expected the request without the token to be redirected, got %d", w.Code)
+	}
+
+	// The previews of the records which require a client certificate are denied
+	c = Config{
+		Enable:      []string{"proxy"},
+		Resolver:    "127.0.0.1:" + strconv.Itoa(port),
+		Preview:     Preview{Enable: true},
+		ClientCerts: ClientCerts{Enable: true, Types: []string{"proxy"}},
+	}
+	c.Preview.SetDefaults()
+	req = httptest.NewRequest("GET", "https://internal.policy.test/?txtdirect-preview", nil)
+	w = httptest.NewRecorder()
+	if err := serve(w, req, c); err != nil {
+		t.Fatal(err)
+	}
+	var preview previewResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.Status != 403 || preview.Target != "" {
+		t.Errorf("Expected the preview to be denied without the target, got %d: %s", preview.Status, preview.Target)
+	}
+}
+
+func TestParsePreview(t *testing.T) {
+	tests := []struct {
+		config    string
+		expected  Preview
+		shouldErr bool
+	}{
+		{"preview", Preview{Enable: true, Header: DefaultPreviewHeader, Query: DefaultPreviewQuery}, false},
+		{
+			"preview {\nheader x-debug-target\nquery debug\ntoken secret\n}",
+			Preview{Enable: true, Header: "X-Debug-Target", Query: "debug", Token: "secret"},
+			false,
+		},
+		{"preview {\ntoken\n}", Preview{}, true},
+		{"preview {\nunknown value\n}", Preview{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable host\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.Preview != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.Preview)
+		}
+	}
+}
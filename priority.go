@@ -0,0 +1,222 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Priority contains the configuration of the request priority classes.
+// Interactive redirects and bulk transfers such as gomods and dockerv2
+// get separate concurrency pools and resolver budgets, so bulk clients
+// can't starve the interactive ones.
+type Priority struct {
+	Enable                    bool
+	InteractiveConcurrency    int
+	BulkConcurrency           int
+	InteractiveResolverBudget int
+	BulkResolverBudget        int
+	QueueTimeout              time.Duration
+
+	pools *priorityPools
+}
+
+type priorityPools struct {
+	requests map[string]chan struct{}
+	resolver map[string]chan struct{}
+}
+
+const (
+	classInteractive = "interactive"
+	classBulk        = "bulk"
+
+	DefaultInteractiveConcurrency    = 1024
+	DefaultBulkConcurrency           = 64
+	DefaultInteractiveResolverBudget = 256
+	DefaultBulkResolverBudget        = 16
+	DefaultPriorityQueueTimeout      = 5 * time.Second
+)
+
+type priorityClassKey struct{}
+
+// SetDefaults sets the default values for priority config
+// if the fields are empty
+func (p *Priority) SetDefaults() {
+	if p.InteractiveConcurrency == 0 {
+		p.InteractiveConcurrency = DefaultInteractiveConcurrency
+	}
+	if p.BulkConcurrency == 0 {
+		p.BulkConcurrency = DefaultBulkConcurrency
+	}
+	if p.InteractiveResolverBudget == 0 {
+		p.InteractiveResolverBudget = DefaultInteractiveResolverBudget
+	}
+	if p.BulkResolverBudget == 0 {
+		p.BulkResolverBudget = DefaultBulkResolverBudget
+	}
+	if p.QueueTimeout == 0 {
+		p.QueueTimeout = DefaultPriorityQueueTimeout
+	}
+	if p.pools == nil {
+		p.pools = &priorityPools{
+			requests: map[string]chan struct{}{
+				classInteractive: make(chan struct{}, p.InteractiveConcurrency),
+				classBulk:        make(chan struct{}, p.BulkConcurrency),
+			},
+			resolver: map[string]chan struct{}{
+				classInteractive: make(chan struct{}, p.InteractiveResolverBudget),
+				classBulk:        make(chan struct{}, p.BulkResolverBudget),
+			},
+		}
+	}
+}
+
+// classifyRequest returns the priority class of the given request.
+// Module downloads and container registry requests are bulk transfers.
+func classifyRequest(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.Contains(r.UserAgent(), "Docker-Client"),
+		strings.HasPrefix(path, "/v2/") && registryClient(r),
+		strings.Contains(path, "/@v/"),
+		strings.HasSuffix(path, "/@latest"):
+		return classBulk
+	}
+	return classInteractive
+}
+
+// registryClient checks if the request carries the signature of a
+// container registry client, the other /v2/ paths are usual pages
+func registryClient(r *http.Request) bool {
+	if r.Header.Get("Docker-Distribution-API-Version") != "" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/vnd.docker.") || strings.Contains(accept, "application/vnd.oci.") {
+		return true
+	}
+	agent := r.UserAgent()
+	return strings.HasPrefix(agent, "containerd/") || strings.HasPrefix(agent, "containers/")
+}
+
+// priorityClass returns the priority class stored in the context
+func priorityClass(ctx context.Context) string {
+	if class, ok := ctx.Value(priorityClassKey{}).(string); ok {
+		return class
+	}
+	return classInteractive
+}
+
+// acquire waits for a free slot in the given pool until the
+// queue timeout and returns the function releasing the slot
+func (p *Priority) acquire(ctx context.Context, pool chan struct{}) (func(), error) {
+	select {
+	case pool <- struct{}{}:
+		return func() { <-pool }, nil
+	default:
+	}
+
+	timer := time.NewTimer(p.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case pool <- struct{}{}:
+		return func() { <-pool }, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("no free slot after %s", p.QueueTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// admit reserves a slot in the request's class pool and stores the class
+// in the request's context for the resolver budget
+func (p *Priority) admit(r *http.Request, c Config) (*http.Request, func(), error) {
+	class := classifyRequest(r)
+	release, err := p.acquire(r.Context(), p.pools.requests[class])
+	if err != nil {
+		if c.Prometheus.Enable {
+			PriorityRejected.WithLabelValues(class).Add(1)
+		}
+		return r, nil, fmt.Errorf("%s request rejected: %s", class, err.Error())
+	}
+	if c.Prometheus.Enable {
+		PriorityInFlight.WithLabelValues(class).Inc()
+		release = func(release func()) func() {
+			return func() {
+				PriorityInFlight.WithLabelValues(class).Dec()
+				release()
+			}
+		}(release)
+	}
+	return r.WithContext(context.WithValue(r.Context(), priorityClassKey{}, class)), release, nil
+}
+
+// acquireResolver reserves a concurrent resolver query from
+// the budget of the request's class
+func (p *Priority) acquireResolver(ctx context.Context) (func(), error) {
+	if p.pools == nil {
+		return func() {}, nil
+	}
+	class := priorityClass(ctx)
+	release, err := p.acquire(ctx, p.pools.resolver[class])
+	if err != nil {
+		return nil, fmt.Errorf("%s resolver budget exhausted: %s", class, err.Error())
+	}
+	return release, nil
+}
+
+// reject responds to the requests which couldn't get a slot in their pool
+func (p *Priority) reject(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(p.QueueTimeout.Seconds())+1))
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusServiceUnavailable))
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// ParsePriority parses the txtdirect config for the priority classes
+func (p *Priority) ParsePriority(c Dispenser) error {
+	key := c.Val()
+	switch key {
+	case "interactive_concurrency", "bulk_concurrency", "interactive_resolver_budget", "bulk_resolver_budget":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for %s field is not standard. It should be a positive integer", key)
+		}
+		switch key {
+		case "interactive_concurrency":
+			p.InteractiveConcurrency = value
+		case "bulk_concurrency":
+			p.BulkConcurrency = value
+		case "interactive_resolver_budget":
+			p.InteractiveResolverBudget = value
+		case "bulk_resolver_budget":
+			p.BulkResolverBudget = value
+		}
+
+	case "queue_timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for queue_timeout field is not standard. It should be a duration")
+		}
+		p.QueueTimeout = value
+
+	default:
+		return c.ArgErr() // unhandled option for priority
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_classifyRequest(t *testing.T) {
+	tests := []struct {
+		url       string
+		userAgent string
+		accept    string
+		expected  string
+	}{
+		{"https://example.test/", "Mozilla/5.0", "", classInteractive},
+		{"https://example.test/docs/page", "Mozilla/5.0", "", classInteractive},
+		{"https://pkg.example.test/module/@v/list", "Go-http-client/1.1", "", classBulk},
+		{"https://pkg.example.test/module/@v/v1.0.0.zip", "Go-http-client/1.1", "", classBulk},
+		{"https://pkg.example.test/module/@latest", "Go-http-client/1.1", "", classBulk},
+		{"https://container.example.test/v2/", "docker/18.09.2 Docker-Client/18.09.2 (linux)", "", classBulk},
+		{"https://container.example.test/v2/library/alpine/manifests/latest", "curl/7.64.0", "application/vnd.oci.image.index.v1+json", classBulk},
+		{"https://container.example.test/v2/library/alpine/blobs/sha256:abc", "containerd/1.6.0", "", classBulk},
+		// The /v2/ pages of the usual redirects are interactive
+		{"https://example.test/v2/docs", "Mozilla/5.0", "text/html", classInteractive},
+		{"https://example.test/v2/docs", "curl/7.64.0", "*/*", classInteractive},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("User-Agent", test.userAgent)
+		req.Header.Set("Accept", test.accept)
+		if class := classifyRequest(req); class != test.expected {
+			t.Errorf("Test %d: Expected %s class for %s, got %s", i, test.expected, test.url, class)
+		}
+	}
+}
+
+func TestPriorityPools(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Priority: Priority{
+			Enable:          true,
+			BulkConcurrency: 1,
+			QueueTimeout:    10 * time.Millisecond,
+		},
+	}
+	c.Priority.SetDefaults()
+
+	// Occupy the only bulk slot
+	c.Priority.pools.requests[classBulk] <- struct{}{}
+
+	w := httptest.NewRecorder()
+	if err := handle(w, httptest.NewRequest("GET", "https://host.e2e.test/module/@v/list", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 503 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the bulk request to be rejected, got %d", w.Code)
+	}
+
+	// Interactive requests aren't affected by the full bulk pool
+	w = httptest.NewRecorder()
+	if err := handle(w, httptest.NewRequest("GET", "https://host.e2e.test/", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 302 {
+		t.Errorf("Expected the interactive request to be redirected, got %d", w.Code)
+	}
+	if n := len(c.Priority.pools.requests[classInteractive]); n != 0 {
+		t.Errorf("Expected the interactive slot to be released, %d still in use", n)
+	}
+
+	<-c.Priority.pools.requests[classBulk]
+	w = httptest.NewRecorder()
+	if err := handle(w, httptest.NewRequest("GET", "https://host.e2e.test/module/@v/list", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code == 503 {
+		t.Errorf("Expected the bulk request to be admitted after the slot got released")
+	}
+}
+
+func TestPriorityResolverBudget(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Priority: Priority{
+			Enable:             true,
+			BulkResolverBudget: 1,
+			QueueTimeout:       10 * time.Millisecond,
+		},
+	}
+	c.Priority.SetDefaults()
+	c.Priority.pools.resolver[classBulk] <- struct{}{}
+
+	bulk, release, err := c.Priority.admit(httptest.NewRequest("GET", "https://host.e2e.test/module/@v/list", nil), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer release()
+	if _, err := query("host.e2e.test", bulk.Context(), c); err == nil {
+		t.Errorf("Expected the bulk lookup to fail with an exhausted resolver budget")
+	}
+
+	interactive, release, err := c.Priority.admit(httptest.NewRequest("GET", "https://host.e2e.test/", nil), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer release()
+	if _, err := query("host.e2e.test", interactive.Context(), c); err != nil {
+		t.Errorf("Unexpected error for the interactive lookup: %s", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Probes contains the health and readiness endpoints' configuration.
+// Without any hosts the endpoints are served on every host and shadow
+// the vanity hosts' paths, and anyone can send the readiness checks'
+// DNS queries and Tor probes.
+type Probes struct {
+	Enable bool
+	// Hosts are the only hosts serving the endpoints when there are any,
+	// like the instance's address the orchestrator sends the probes to
+	Hosts      []string
+	HealthPath string
+	ReadyPath  string
+	Timeout    time.Duration
+}
+
+// probeResponse is the JSON body served by the probe endpoints
+type probeResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+const (
+	DefaultHealthPath   = "/health"
+	DefaultReadyPath    = "/ready"
+	DefaultProbeTimeout = 2 * time.Second
+	probeOK             = "ok"
+	probeFail           = "fail"
+)
+
+// SetDefaults sets the default values for probes config
+// if the fields are empty
+func (p *Probes) SetDefaults() {
+	if p.HealthPath == "" {
+		p.HealthPath = DefaultHealthPath
+	}
+	if p.ReadyPath == "" {
+		p.ReadyPath = DefaultReadyPath
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultProbeTimeout
+	}
+	for i, host := range p.Hosts {
+		p.Hosts[i] = canonicalHost(host)
+	}
+}
+
+// ServeHTTP serves the health and readiness endpoints. It returns false
+// if the request's path doesn't belong to any of the endpoints.
+func (p *Probes) ServeHTTP(w http.ResponseWriter, r *http.Request, c Config) (bool, error) {
+	if len(p.Hosts) > 0 && !contains(p.Hosts, canonicalHost(r.Host)) {
+		return false, nil
+	}
+
+	var resp probeResponse
+	switch r.URL.Path {
+	case p.HealthPath:
+		// Liveness only depends on the server being able to respond, so
+		// an unreachable resolver doesn't get the instance restarted
+		resp.Status = probeOK
+	case p.ReadyPath:
+		resp = p.ready(r.Context(), c)
+	default:
+		return false, nil
+	}
+
+	code := http.StatusOK
+	if resp.Status != probeOK {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Status-Code", strconv.Itoa(code))
+	w.WriteHeader(code)
+	return true, json.NewEncoder(w).Encode(resp)
+}
+
+// ready checks the resolver and the enabled subsystems
+func (p *Probes) ready(ctx context.Context, c Config) probeResponse {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	checks := map[string]error{
+		"resolver": probeResolver(ctx, c),
+	}
+	if c.Tor.Enable {
+		checks["tor"] = probeTor(ctx, c.Tor)
+	}
+	if c.Gomods.Enable {
+		checks["gomods"] = probeGomods(c.Gomods)
+	}
+
+	resp := probeResponse{Status: probeOK, Checks: make(map[string]string)}
+	for name, err := range checks {
+		if err != nil {
+			resp.Status = probeFail
+			resp.Checks[name] = err.Error()
+			continue
+		}
+		resp.Checks[name] = probeOK
+	}
+	return resp
+}
+
+// probeResolver checks if the configured resolver answers DNS queries.
+// With multiple resolvers configured, a single healthy resolver is enough.
+func probeResolver(ctx context.Context, c Config) error {
+	if len(c.Resolvers) > 1 {
+		var err error
+		for _, resolver := range c.Resolvers {
+			c.Resolver = resolver
+			if err = probeSingleResolver(ctx, c); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	return probeSingleResolver(ctx, c)
+}
+
+// probeSingleResolver checks if c.Resolver answers DNS queries
+func probeSingleResolver(ctx context.Context, c Config) error {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+
+	switch {
+	case isDoH(c.Resolver):
+		_, err := c.DoH.exchange(ctx, c.Resolver, m)
+		return err
+	case c.Resolver != "":
+		server := c.Resolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		_, err := exchangeContext(ctx, "udp", m, server, c.DNS.dial)
+		return err
+	default:
+		_, err := systemResolver(c).LookupNS(ctx, ".")
+		return err
+	}
+}
+
+// ParseProbes parses the txtdirect config for the probe endpoints
+func (p *Probes) ParseProbes(c Dispenser) error {
+	switch c.Val() {
+	case "hosts":
+		hosts := c.RemainingArgs()
+		if len(hosts) == 0 {
+			return c.ArgErr()
+		}
+		p.Hosts = append(p.Hosts, hosts...)
+
+	case "health_path":
+		p.HealthPath = c.RemainingArgs()[0]
+
+	case "ready_path":
+		p.ReadyPath = c.RemainingArgs()[0]
+
+	case "timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a duration")
+		}
+		p.Timeout = value
+
+	default:
+		return c.ArgErr() // unhandled option for probes
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+//go:build !notor && !nogomods && !nodocker
+// +build !notor,!nogomods,!nodocker
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestProbes(t *testing.T) {
+	// Find a free port to use as an unreachable resolver and Tor socks port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	tests := []struct {
+		path     string
+		config   Config
+		status   int
+		expected probeResponse
+	}{
+		{
+			"/health",
+			Config{Resolver: "127.0.0.1:" + strconv.Itoa(closedPort)},
+			200,
+			probeResponse{Status: "ok"},
+		},
+		{
+			"/ready",
+			Config{Resolver: "127.0.0.1:" + strconv.Itoa(port)},
+			200,
+			probeResponse{Status: "ok", Checks: map[string]string{"resolver": "ok"}},
+		},
+		{
+			"/ready",
+			Config{
+				Resolver: "127.0.0.1:" + strconv.Itoa(port),
+				Tor:      Tor{Enable: true, Port: closedPort},
+				Gomods: Gomods{
+					Enable:   true,
+					GoBinary: "/nonexistent/go",
+				},
+			},
+			503,
+			probeResponse{Status: "fail", Checks: map[string]string{"resolver": "ok", "tor": "", "gomods": ""}},
+		},
+	}
+	for i, test := range tests {
+		test.config.Enable = []string{"host"}
+		test.config.Probes = Probes{Enable: true}
+		test.config.Probes.SetDefaults()
+
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", "http://10.0.0.1"+test.path, nil), test.config); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+
+		var resp probeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("Test %d: Couldn't decode the response %q: %s", i, w.Body.String(), err)
+			continue
+		}
+		if resp.Status != test.expected.Status {
+			t.Errorf("Test %d: Expected status %s, got %s", i, test.expected.Status, resp.Status)
+		}
+		if len(resp.Checks) != len(test.expected.Checks) {
+			t.Errorf("Test %d: Expected checks %v, got %v", i, test.expected.Checks, resp.Checks)
+		}
+		for name, expected := range test.expected.Checks {
+			got, ok := resp.Checks[name]
+			if !ok {
+				t.Errorf("Test %d: Expected the %s check to be reported", i, name)
+				continue
+			}
+			// Failed checks report their error, which depends on the platform
+			if (expected == "ok") != (got == "ok") {
+				t.Errorf("Test %d: Expected the %s check to be %q, got %q", i, name, expected, got)
+			}
+		}
+	}
+}
+
+func TestProbesHosts(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Probes:   Probes{Enable: true, Hosts: []string{"10.0.0.1"}},
+	}
+	c.Probes.SetDefaults()
+
+	w := httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "http://10.0.0.1:8080/ready", nil), c); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected the probe host to be probed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The vanity hosts' paths aren't shadowed by the probes
+	w = httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://host.e2e.test/ready", nil), c); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") == "" {
+		t.Errorf("Expected the vanity host's path to be redirected, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func Test_probeGomods(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	fs.MkdirAll("/cache", 0755)
+	afero.WriteFile(fs, "/go", []byte{}, 0755)
+
+	// The go binary is checked on the real filesystem
+	binary, err := ioutil.TempFile("", "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.Close()
+	defer os.Remove(binary.Name())
+	goBinary := binary.Name()
+
+	tests := []struct {
+		gomods    Gomods
+		shouldErr bool
+	}{
+		{Gomods{GoBinary: goBinary, Fs: fs}, false},
+		{Gomods{GoBinary: "/nonexistent/go", Fs: fs}, true},
+		{Gomods{GoBinary: goBinary, Fs: fs, Cache: Cache{Enable: true, Path: "/cache"}}, false},
+		{Gomods{GoBinary: goBinary, Fs: fs, Cache: Cache{Enable: true, Path: "/missing"}}, true},
+		{Gomods{GoBinary: goBinary, Fs: fs, Cache: Cache{Enable: true, Path: "/go"}}, true},
+	}
+	for i, test := range tests {
+		err := probeGomods(test.gomods)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mholt/caddy/caddyfile"
+)
+
+// maxSnippetDepth limits the nested imports and profiles
+// so an import cycle can't expand forever
+const maxSnippetDepth = 10
+
+// profiles are the named option sets of the txtdirect block. The
+// options following a profile override the ones it sets.
+var profiles = map[string]string{
+	"shortener": `
+		enable host path
+		cache
+		preview
+		qr
+	`,
+	"vanity-go": `
+		enable host path gometa
+		cache
+	`,
+}
+
+// snippetFrame is an imported file or a profile being dispensed
+type snippetFrame struct {
+	d       *caddyfile.Dispenser
+	profile bool
+}
+
+// snippetDispenser dispenses the tokens of the imported snippets
+// and profiles in place of the import and profile options, before
+// continuing with the rest of the txtdirect block
+type snippetDispenser struct {
+	Dispenser
+	frames []snippetFrame
+}
+
+func newSnippetDispenser(c Dispenser) *snippetDispenser {
+	return &snippetDispenser{Dispenser: c}
+}
+
+// current returns the dispenser of the tokens being parsed
+func (s *snippetDispenser) current() Dispenser {
+	if len(s.frames) == 0 {
+		return s.Dispenser
+	}
+	return s.frames[len(s.frames)-1].d
+}
+
+func (s *snippetDispenser) Next() bool {
+	for len(s.frames) > 0 {
+		if s.frames[len(s.frames)-1].d.Next() {
+			return true
+		}
+		s.frames = s.frames[:len(s.frames)-1]
+	}
+	return s.Dispenser.Next()
+}
+
+func (s *snippetDispenser) NextArg() bool {
+	return s.current().NextArg()
+}
+
+func (s *snippetDispenser) Val() string {
+	return s.current().Val()
+}
+
+func (s *snippetDispenser) RemainingArgs() []string {
+	return s.current().RemainingArgs()
+}
+
+func (s *snippetDispenser) ArgErr() error {
+	return s.current().ArgErr()
+}
+
+func (s *snippetDispenser) Errf(format string, args ...interface{}) error {
+	return s.current().Errf(format, args...)
+}
+
+// inProfile reports whether the current token is set by a profile
+func (s *snippetDispenser) inProfile() bool {
+	for _, frame := range s.frames {
+		if frame.profile {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *snippetDispenser) push(d caddyfile.Dispenser, profile bool) error {
+	if len(s.frames) >= maxSnippetDepth {
+		return s.Errf("Too many nested imports and profiles, there might be an import cycle")
+	}
+	s.frames = append(s.frames, snippetFrame{d: &d, profile: profile})
+	return nil
+}
+
+// Profile expands the options of the named profile
+func (s *snippetDispenser) Profile() error {
+	args := s.RemainingArgs()
+	if len(args) != 1 {
+		return s.ArgErr()
+	}
+	body, ok := profiles[args[0]]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return s.Errf("Unknown profile %s, it should be one of %s", args[0], strings.Join(names, ", "))
+	}
+	return s.push(caddyfile.NewDispenser("profile "+args[0], strings.NewReader(body)), true)
+}
+
+// Import expands the options of the files matching the given
+// path or glob pattern
+func (s *snippetDispenser) Import() error {
+	args := s.RemainingArgs()
+	if len(args) != 1 {
+		return s.ArgErr()
+	}
+	matches, err := filepath.Glob(args[0])
+	if err != nil {
+		return s.Errf("Failed to use import pattern %s: %v", args[0], err)
+	}
+	if len(matches) == 0 {
+		return s.Errf("File to import not found: %s", args[0])
+	}
+
+	snippets := make([]caddyfile.Dispenser, 0, len(matches))
+	for _, match := range matches {
+		file, err := os.Open(match)
+		if err != nil {
+			return s.Errf("Could not import %s: %v", match, err)
+		}
+		tokens := caddyfile.NewDispenser(match, file)
+		file.Close()
+		if err := balancedSnippet(tokens); err != nil {
+			return err
+		}
+		snippets = append(snippets, tokens)
+	}
+	// The first file is pushed last, so it's dispensed first
+	for i := len(snippets) - 1; i >= 0; i-- {
+		if err := s.push(snippets[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// balancedSnippet makes sure the blocks opened in a snippet are
+// closed in it, so it can't close the txtdirect block it's imported in
+func balancedSnippet(d caddyfile.Dispenser) error {
+	nesting := 0
+	for d.Next() {
+		switch d.Val() {
+		case "{":
+			nesting++
+		case "}":
+			if nesting == 0 {
+				return d.Err("Unexpected '}' because no matching opening brace")
+			}
+			nesting--
+		}
+	}
+	if nesting > 0 {
+		return d.EOFErr()
+	}
+	return nil
+}
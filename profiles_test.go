@@ -0,0 +1,147 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		config    string
+		enable    []string
+		cache     bool
+		preview   bool
+		qr        bool
+		shouldErr bool
+	}{
+		{"profile shortener", []string{"host", "path"}, true, true, true, false},
+		{"profile vanity-go", []string{"host", "path", "gometa"}, true, false, false, false},
+		{"profile vanity-go\nenable host", []string{"host"}, true, false, false, false},
+		{"profile shortener\ndisable www", []string{"host", "path", "gometa"}, true, true, true, false},
+		{"enable host\nprofile shortener", nil, false, false, false, true},
+		{"profile shortener\nenable host\nenable path", nil, false, false, false, true},
+		{"profile unknown", nil, false, false, false, true},
+		{"profile", nil, false, false, false, true},
+		{"profile shortener vanity-go", nil, false, false, false, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf.Enable, test.enable) {
+			t.Errorf("Test %d: Expected %v to be enabled, got %v", i, test.enable, conf.Enable)
+		}
+		if conf.RecordCache.Enable != test.cache || conf.Preview.Enable != test.preview || conf.QR.Enable != test.qr {
+			t.Errorf("Test %d: Expected cache %t, preview %t and qr %t, got %t, %t and %t", i,
+				test.cache, test.preview, test.qr, conf.RecordCache.Enable, conf.Preview.Enable, conf.QR.Enable)
+		}
+	}
+}
+
+func TestParseImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	snippets := map[string]string{
+		"a.conf":          "cache {\nmax_ttl 1h\n}\n",
+		"b.conf":          "profile vanity-go\n",
+		"unbalanced.snip": "cache {\nmax_ttl 1h\n",
+		"closing.snip":    "}\nenable host\n",
+		"cycle.snip":      "import " + filepath.Join(dir, "cycle.snip") + "\n",
+	}
+	for name, content := range snippets {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		config    string
+		shouldErr bool
+	}{
+		{"import " + filepath.Join(dir, "*.conf") + "\npreview", false},
+		{"import " + filepath.Join(dir, "unbalanced.snip"), true},
+		{"import " + filepath.Join(dir, "closing.snip"), true},
+		{"import " + filepath.Join(dir, "cycle.snip"), true},
+		{"import " + filepath.Join(dir, "missing.conf"), true},
+		{"import", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if !reflect.DeepEqual(conf.Enable, []string{"host", "path", "gometa"}) {
+			t.Errorf("Test %d: Expected the profile of the imported snippet to be enabled, got %v", i, conf.Enable)
+		}
+		if conf.RecordCache.MaxTTL.String() != "1h0m0s" || !conf.Preview.Enable {
+			t.Errorf("Test %d: Expected the imported cache options and preview, got %+v", i, conf.RecordCache)
+		}
+	}
+}
+
+func TestStandaloneProfile(t *testing.T) {
+	var s Standalone
+	if err := s.LoadEnv([]string{"TXTDIRECT_PROFILE=shortener", "TXTDIRECT_REDIRECT=https://example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetDefaults()
+	if !strings.HasPrefix(s.caddyfile(), "txtdirect {\nprofile shortener\n") {
+		t.Fatalf("Expected the profile in the config, got %s", s.caddyfile())
+	}
+	conf, err := s.Config()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(conf.Enable, []string{"host", "path"}) || !conf.QR.Enable || conf.Redirect != "https://example.com" {
+		t.Errorf("Expected the shortener profile options, got %v", conf.Enable)
+	}
+
+	s = Standalone{Profile: "vanity-go", Enable: []string{"host"}}
+	s.SetDefaults()
+	conf, err = s.Config()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(conf.Enable, []string{"host"}) || !conf.RecordCache.Enable {
+		t.Errorf("Expected the enabled types to override the profile's, got %v", conf.Enable)
+	}
+}
@@ -29,11 +29,15 @@ import (
 
 // Prometheus contains Prometheus's configuration
 type Prometheus struct {
-	Enable  bool
-	Address string
-	Path    string
+	Enable    bool
+	Address   string
+	Path      string
+	RulesPath string
+	// SLO is the default availability target used in the generated rules
+	SLO float64
+	// TypeSLOs overrides the availability target per record type
+	TypeSLOs map[string]float64
 
-	once    sync.Once
 	next    httpserver.Handler
 	handler http.Handler
 }
@@ -69,6 +73,249 @@ var (
 		Help:      "Total redirects per path for each host",
 	}, []string{"host", "path"})
 
+	CacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_hits_total",
+		Help:      "Total TXT record lookups served from the cache",
+	})
+
+	CacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_misses_total",
+		Help:      "Total TXT record lookups that missed the cache",
+	})
+
+	DNSTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "dns_timeouts_total",
+		Help:      "Total TXT record lookup attempts that timed out",
+	})
+
+	DNSRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "dns_retries_total",
+		Help:      "Total TXT record lookups retried after a transient failure",
+	})
+
+	RateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "rate_limited_requests_total",
+		Help:      "Total requests rejected for going over the rate limit",
+	}, []string{"host", "key"})
+
+	DNSRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "dns_rate_limited_total",
+		Help:      "Total TXT record lookups that put a zone in backoff because the resolver seemed to rate limit them",
+	}, []string{"reason"})
+
+	DNSBackoffSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "dns_backoff_skipped_total",
+		Help:      "Total TXT record lookups skipped because their zone was backing off",
+	})
+
+	NegativeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_negative_hits_total",
+		Help:      "Total TXT record lookups answered from the negative cache",
+	})
+
+	NegativeCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_negative_entries",
+		Help:      "Zones without TXT records in the negative cache",
+	})
+
+	CacheStaleServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_stale_served_total",
+		Help:      "Total expired TXT records served because the resolver failed to answer",
+	})
+	SnapshotServed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "snapshot_served_total",
+		Help:      "Total last known good TXT records served from the snapshot because the resolver failed to answer",
+	})
+
+	PolicyViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "policy_violations_total",
+		Help:      "Total requests denied because their target wasn't allowed by the policy by the violation's reason",
+	}, []string{"host", "reason"})
+
+	VariantSelections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "variant_selections_total",
+		Help:      "Total selections of the weighted targets by host and target",
+	}, []string{"host", "target"})
+
+	WAFMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "waf_matches_total",
+		Help:      "Total requests matching the WAF rules by rule and action",
+	}, []string{"host", "rule", "action"})
+
+	PriorityInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "priority_in_flight",
+		Help:      "Requests being handled for each priority class",
+	}, []string{"class"})
+
+	PriorityRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "priority_rejected_total",
+		Help:      "Total requests rejected because their priority class pool was full",
+	}, []string{"class"})
+
+	ResolverFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "resolver_failures_total",
+		Help:      "Total TXT record lookups failed over to the next resolver",
+	}, []string{"resolver"})
+
+	AdaptiveLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "adaptive_concurrency_limit",
+		Help:      "Current concurrency limit of each upstream",
+	}, []string{"upstream"})
+
+	AbsentRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "absent_records_total",
+		Help:      "Total requests for hosts without a record by the served action",
+	}, []string{"action"})
+
+	IPHostRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "ip_host_requests_total",
+		Help:      "Total requests addressed to IP literals or localhost by the served action",
+	}, []string{"action"})
+
+	ResponseCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "response_cache_total",
+		Help:      "Total gomods module, dockerv2 blob and proxy responses by cache result",
+	}, []string{"type", "result"})
+
+	RecordSources = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_sources_total",
+		Help:      "Total decisions with both DNS and a local source by the local source, the source which won and whether they differ",
+	}, []string{"host", "local", "winner", "result"})
+
+	ProxyCacheSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "proxy_cache_size_bytes",
+		Help:      "Current size of the bodies in the proxy response cache",
+	})
+
+	AdaptiveRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "adaptive_rejected_total",
+		Help:      "Total upstream calls rejected because the upstream was over its concurrency limit",
+	}, []string{"upstream"})
+
+	DNSLookupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "txtdirect",
+		Name:      "dns_lookup_duration_seconds",
+		Help:      "Latency of the TXT record lookups sent to the resolver",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+
+	PlaceholderDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "txtdirect",
+		Name:      "placeholder_parse_duration_seconds",
+		Help:      "Latency of substituting the placeholders in the records",
+		Buckets:   []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .005},
+	})
+
+	RequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "requests_in_flight",
+		Help:      "Requests being handled for each record type, none until their record is found",
+	}, []string{"type"})
+
+	RequestsExpired = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "requests_expired_total",
+		Help:      "Total requests aborted for going over the max request age by type and whether they got a 504",
+	}, []string{"type", "served"})
+
+	TLSAskRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "tls_ask_requests_total",
+		Help:      "Total on-demand TLS ask requests by result",
+	}, []string{"result"})
+
+	ResolverLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "resolver_lookups_total",
+		Help:      "Total TXT record lookups per resolver address family and result",
+	}, []string{"family", "result"})
+
+	CacheCoalesced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_coalesced_total",
+		Help:      "Total requests answered by another request's lookup of the same zone",
+	})
+
+	CacheWaiters = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_waiters",
+		Help:      "Current requests waiting for another request's lookup of the same zone",
+	})
+
+	CacheShed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "record_cache_shed_total",
+		Help:      "Total requests shed while waiting for another request's lookup",
+	}, []string{"reason"})
+
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "txtdirect",
+		Name:      "handler_duration_seconds",
+		Help:      "Latency of handling the requests for each record type",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	DecisionSinkRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "decision_sink_rows_total",
+		Help:      "Total decisions sent to the decision sink per result",
+	}, []string{"sink", "result"})
+
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "webhook_deliveries_total",
+		Help:      "Total webhook deliveries per event and result",
+	}, []string{"event", "result"})
+
+	GomodsRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "gomods_requests_total",
+		Help:      "Total gomods requests per served module path, file and result",
+	}, []string{"module", "file", "result"})
+
+	GomodsUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "txtdirect",
+		Name:      "gomods_upstream_duration_seconds",
+		Help:      "Latency of fetching the modules and listing their versions from the upstreams",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"operation", "result"})
+
+	GomodsBytesServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "gomods_served_bytes_total",
+		Help:      "Total bytes of the gomods responses per file",
+	}, []string{"file"})
+
+	GeoPolicyActions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "geo_policy_actions_total",
+		Help:      "Total requests blocked or rerouted by the geo policies per host",
+	}, []string{"host", "action"})
+
 	once sync.Once
 )
 
@@ -88,31 +335,78 @@ func (p *Prometheus) SetDefaults() {
 	if p.Path == "" {
 		p.Path = prometheusPath
 	}
+	// Only serve the rules when SLO targets or the rules path are configured
+	if p.SLO != 0 || len(p.TypeSLOs) > 0 || p.RulesPath != "" {
+		if p.SLO == 0 {
+			p.SLO = DefaultSLOTarget
+		}
+		if p.RulesPath == "" {
+			p.RulesPath = prometheusRulesPath
+		}
+	}
 }
 
 func (p *Prometheus) start() error {
-	p.once.Do(func() {
-		prometheus.MustRegister(RequestsCount)
-		prometheus.MustRegister(RequestsByStatus)
-		prometheus.MustRegister(RequestsCountBasedOnType)
-		prometheus.MustRegister(FallbacksCount)
-		prometheus.MustRegister(PathRedirectCount)
-		http.Handle(p.Path, p.handler)
-		go func() {
-			err := http.ListenAndServe(p.Address, nil)
-			if err != nil {
-				log.Printf("[txtdirect]: Couldn't start http handler for prometheus metrics. %s", err.Error())
-			}
-		}()
-	})
+	prometheus.MustRegister(RequestsCount)
+	prometheus.MustRegister(RequestsByStatus)
+	prometheus.MustRegister(RequestsCountBasedOnType)
+	prometheus.MustRegister(FallbacksCount)
+	prometheus.MustRegister(PathRedirectCount)
+	prometheus.MustRegister(CacheHits)
+	prometheus.MustRegister(CacheMisses)
+	prometheus.MustRegister(DNSTimeouts)
+	prometheus.MustRegister(DNSRetries)
+	prometheus.MustRegister(DNSRateLimited)
+	prometheus.MustRegister(DNSBackoffSkipped)
+	prometheus.MustRegister(CacheStaleServed)
+	prometheus.MustRegister(SnapshotServed)
+	prometheus.MustRegister(RecordSources)
+	prometheus.MustRegister(PolicyViolations)
+	prometheus.MustRegister(WAFMatches)
+	prometheus.MustRegister(VariantSelections)
+	prometheus.MustRegister(NegativeCacheHits)
+	prometheus.MustRegister(NegativeCacheSize)
+	prometheus.MustRegister(ProxyCacheSize)
+	prometheus.MustRegister(PriorityInFlight)
+	prometheus.MustRegister(PriorityRejected)
+	prometheus.MustRegister(ResolverFailures)
+	prometheus.MustRegister(AdaptiveLimit)
+	prometheus.MustRegister(AdaptiveRejected)
+	prometheus.MustRegister(ResponseCache)
+	prometheus.MustRegister(AbsentRecords)
+	prometheus.MustRegister(IPHostRequests)
+	prometheus.MustRegister(RateLimitedRequests)
+	prometheus.MustRegister(DNSLookupDuration)
+	prometheus.MustRegister(PlaceholderDuration)
+	prometheus.MustRegister(HandlerDuration)
+	prometheus.MustRegister(RequestsInFlight)
+	prometheus.MustRegister(RequestsExpired)
+	prometheus.MustRegister(TLSAskRequests)
+	prometheus.MustRegister(ResolverLookups)
+	prometheus.MustRegister(CacheCoalesced)
+	prometheus.MustRegister(CacheWaiters)
+	prometheus.MustRegister(CacheShed)
+	prometheus.MustRegister(DecisionSinkRows)
+	prometheus.MustRegister(WebhookDeliveries)
+	prometheus.MustRegister(GomodsRequests)
+	prometheus.MustRegister(GomodsUpstreamDuration)
+	prometheus.MustRegister(GomodsBytesServed)
+	prometheus.MustRegister(GeoPolicyActions)
+	http.Handle(p.Path, p.handler)
+	if p.RulesPath != "" {
+		http.HandleFunc(p.RulesPath, p.rulesHandler)
+	}
+	go func() {
+		err := http.ListenAndServe(p.Address, nil)
+		if err != nil {
+			log.Printf("[txtdirect]: Couldn't start http handler for prometheus metrics. %s", err.Error())
+		}
+	}()
 	return nil
 }
 
 func (p *Prometheus) Setup(c *caddy.Controller) {
-	p.handler = promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
-		ErrorHandling: promhttp.HTTPErrorOnError,
-		ErrorLog:      log.New(os.Stderr, "", log.LstdFlags),
-	})
+	p.handler = metricsHandler()
 
 	once.Do(func() {
 		c.OnStartup(p.start)
@@ -125,6 +419,23 @@ func (p *Prometheus) Setup(c *caddy.Controller) {
 	})
 }
 
+// startStandalone serves the metrics for the standalone server
+func (p *Prometheus) startStandalone() error {
+	p.handler = metricsHandler()
+	var err error
+	once.Do(func() {
+		err = p.start()
+	})
+	return err
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		ErrorHandling: promhttp.HTTPErrorOnError,
+		ErrorLog:      log.New(os.Stderr, "", log.LstdFlags),
+	})
+}
+
 func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	next := p.next
 
@@ -136,7 +447,7 @@ func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, err
 }
 
 // ParsePrometheus parses the txtdirect config for Prometheus
-func (p *Prometheus) ParsePrometheus(c *caddy.Controller, key, value string) error {
+func (p *Prometheus) ParsePrometheus(c Dispenser, key, value string) error {
 	switch key {
 	case "enable":
 		value, err := strconv.ParseBool(value)
@@ -149,6 +460,10 @@ func (p *Prometheus) ParsePrometheus(c *caddy.Controller, key, value string) err
 		p.Address = value
 	case "path":
 		p.Path = value
+	case "rules_path":
+		p.RulesPath = value
+	case "slo":
+		return p.parseSLO(value)
 	default:
 		return c.ArgErr() // unhandled option for prometheus
 	}
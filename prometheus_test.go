@@ -0,0 +1,69 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramCounts returns the sample count of the
+// histograms in the registry by their type label
+func histogramCounts(t *testing.T, registry *prometheus.Registry) map[string]uint64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]uint64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			for _, label := range metric.GetLabel() {
+				key += "/" + label.GetValue()
+			}
+			counts[key] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return counts
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(DNSLookupDuration, PlaceholderDuration, HandlerDuration)
+	before := histogramCounts(t, registry)
+
+	c := Config{
+		Enable:     []string{"host"},
+		Resolver:   "127.0.0.1:" + strconv.Itoa(port),
+		Prometheus: Prometheus{Enable: true},
+	}
+	req := httptest.NewRequest("GET", "https://headers.test/", nil)
+	if err := serve(httptest.NewRecorder(), req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	after := histogramCounts(t, registry)
+
+	for _, key := range []string{
+		"txtdirect_dns_lookup_duration_seconds/success",
+		"txtdirect_placeholder_parse_duration_seconds",
+		"txtdirect_handler_duration_seconds/host",
+	} {
+		if after[key] <= before[key] {
+			t.Errorf("Expected %s to be observed, got %d samples", key, after[key])
+		}
+	}
+}
@@ -16,23 +16,256 @@ package txtdirect
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/mholt/caddy/caddyhttp/proxy"
+	"golang.org/x/net/http2"
 )
 
+// Proxy contains the configuration of the proxy type
+type Proxy struct {
+	Enable bool
+	// Timeout limits the whole exchange with the upstream
+	Timeout time.Duration
+	// MaxBodySize limits the request and response bodies, zero is unlimited
+	MaxBodySize int64
+	// Stream sends the upstream's response to the client as it arrives
+	// instead of buffering it to replace the upstream's URLs in the body
+	Stream bool
+	// H2C are the upstream hosts spoken to over HTTP/2 cleartext with
+	// prior knowledge when they're proxied over http, * matches them all
+	H2C []string
+	// Credentials authenticate the requests to the upstreams,
+	// the first one matching the upstream's host is used
+	Credentials []ProxyCredential
+	// Cache keeps the upstreams' cacheable responses
+	Cache ProxyCache
+}
+
+// ProxyCredential is the header authenticating the
+// requests to the upstreams matching the host pattern
+type ProxyCredential struct {
+	Host string
+	// Type is basic, bearer or header
+	Type   string
+	Header string
+	// Value is the header's value, the placeholders in the
+	// values of the header type are filled from the request
+	Value string
+}
+
 type ProxyResponse struct {
 	headers    http.Header
 	body       []byte
 	bodyReader bytes.Buffer
 	bodyWriter bytes.Buffer
 	status     int
+	// limit is the max body size, zero is unlimited
+	limit    int64
+	exceeded bool
+}
+
+// limitedResponseWriter streams the upstream's response to the
+// client and cuts it off when it exceeds the max body size
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	limit    int64
+	written  int64
+	status   int
+	exceeded bool
+	// capture keeps a copy of the response for the cache when it isn't nil
+	capture *bytes.Buffer
+	// revalidating holds back the upstream's 304 response to the
+	// revalidation of a cached response, notModified is set when it's held
+	revalidating bool
+	notModified  bool
+}
+
+const DefaultProxyMaxBodySize = 10 << 20
+
+// h2cTransport speaks HTTP/2 to the http upstreams without TLS
+var h2cTransport = &http2.Transport{
+	AllowHTTP: true,
+	DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+		dialer := net.Dialer{Timeout: proxyTimeout, KeepAlive: proxyKeepalive * time.Second}
+		return dialer.Dial(network, addr)
+	},
+}
+
+// guardTransport makes the proxy's transport refuse the connections to
+// the reserved addresses denied by the policy when they're dialed. The
+// connections to the upstream's host are pinned to the checked addresses
+// of the request's context, so DNS rebinding can't swap the upstream
+// during the request. The TLS connections still use the host for SNI
+// and the certificate checks.
+func guardTransport(transport http.RoundTripper, p *Policy) http.RoundTripper {
+	switch t := transport.(type) {
+	case *http.Transport:
+		t.Dial = nil
+		t.DialContext = p.guardedDial
+	case *http2.Transport:
+		return guardedH2CTransport(p)
+	}
+	return transport
+}
+
+// pinnedAddrs are the checked addresses of the upstream's host
+type pinnedAddrs struct {
+	host string
+	ips  []net.IP
+}
+
+type pinnedAddrsKey struct{}
+
+// withPinnedAddrs pins the guarded dials of the request to the host's addresses
+func withPinnedAddrs(ctx context.Context, host string, ips []net.IP) context.Context {
+	return context.WithValue(ctx, pinnedAddrsKey{}, pinnedAddrs{host: host, ips: ips})
+}
+
+// guardedDial dials the address with the policy's checks, the dials to
+// the pinned host of the context connect to its checked addresses
+func (p *Policy) guardedDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       proxyTimeout,
+		KeepAlive:     proxyKeepalive * time.Second,
+		FallbackDelay: fallbackDelay,
+		Control:       p.control,
+	}
+	pinned, _ := ctx.Value(pinnedAddrsKey{}).(pinnedAddrs)
+	addrHost, port, err := net.SplitHostPort(addr)
+	// The proxies from the environment aren't pinned
+	if err != nil || len(pinned.ips) == 0 || !strings.EqualFold(addrHost, pinned.host) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	for _, ip := range pinned.ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// guardedH2C are the h2c transports guarded by the policies, keyed by the
+// policy's allowed networks, so their connections are reused between requests
+var guardedH2C = struct {
+	sync.Mutex
+	transports map[string]*http2.Transport
+}{transports: make(map[string]*http2.Transport)}
+
+// guardedH2CTransport returns the h2c transport guarded by the policy
+func guardedH2CTransport(p *Policy) *http2.Transport {
+	networks := make([]string, len(p.Networks))
+	for i, network := range p.Networks {
+		networks[i] = network.String()
+	}
+	key := strings.Join(networks, ",")
+
+	guardedH2C.Lock()
+	defer guardedH2C.Unlock()
+	if t, ok := guardedH2C.transports[key]; ok {
+		return t
+	}
+	policy := *p
+	t := &http2.Transport{AllowHTTP: true}
+	t.ConnPool = &guardedConnPool{
+		transport: t,
+		dial:      policy.guardedDial,
+		conns:     make(map[string]*http2.ClientConn),
+	}
+	guardedH2C.transports[key] = t
+	return t
+}
+
+// guardedConnPool keeps the h2c connections of a guarded transport. The
+// HTTP/2 transport's own dial doesn't get the request, so the pool dials
+// the connections with the request's context.
+type guardedConnPool struct {
+	transport *http2.Transport
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	conns map[string]*http2.ClientConn
+}
+
+func (p *guardedConnPool) GetClientConn(r *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	if cc, ok := p.conns[addr]; ok && cc.CanTakeNewRequest() {
+		p.mu.Unlock()
+		return cc, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.dial(r.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Another request might have dialed the host meanwhile
+	if current, ok := p.conns[addr]; ok && current.CanTakeNewRequest() {
+		cc.Close()
+		return current, nil
+	}
+	p.conns[addr] = cc
+	return cc, nil
 }
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config, fallbackURL string, code int) error {
+func (p *guardedConnPool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conn := range p.conns {
+		if conn == cc {
+			delete(p.conns, addr)
+		}
+	}
+}
+
+// policyError returns the policy violation which refused the
+// connection to the upstream, if that's why the proxy failed
+func policyError(err error) (*policyViolation, bool) {
+	var violation *policyViolation
+	if err != nil && errors.As(err, &violation) {
+		return violation, true
+	}
+	return nil, false
+}
+
+// errBodyTooLarge is returned when the upstream's response exceeds the max body size
+var errBodyTooLarge = fmt.Errorf("upstream response exceeds the max body size")
+
+// SetDefaults sets the default values for the proxy config
+// if the fields are empty
+func (p *Proxy) SetDefaults() {
+	if p.Timeout == 0 {
+		p.Timeout = proxyTimeout
+	}
+	if p.MaxBodySize == 0 {
+		p.MaxBodySize = DefaultProxyMaxBodySize
+	}
+	if p.Cache.Enable {
+		p.Cache.SetDefaults()
+	}
+}
+
+func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config, fallbackURL []string, code int) error {
 	to, _, err := getBaseTarget(rec, r)
 	if err != nil {
 		return err
@@ -41,19 +274,128 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config,
 	if err != nil {
 		return err
 	}
+	var pinned []net.IP
+	if c.Policy.Enable {
+		if pinned, err = c.Policy.pinFetch(r.Context(), to); err != nil {
+			c.Policy.deny(w, r, err, c)
+			return nil
+		}
+	}
+	// cached is the client's request, before the upstream's credentials
+	// get added to it. stale is the cached response being revalidated.
+	var cacheKey string
+	var stale *cachedResponse
+	var staleBody []byte
+	cached := r
+	if c.Proxy.Cache.Enable {
+		cacheKey = proxyCacheKey(r, to)
+		entry, body, fresh := c.Proxy.Cache.lookup(r, cacheKey)
+		if fresh {
+			cacheStatus(w, "proxy", true, true, c)
+			return entry.serve(w, r, body)
+		}
+		cacheStatus(w, "proxy", false, true, c)
+		if entry != nil {
+			stale, staleBody = entry, body
+			r = entry.revalidate(r)
+		}
+	}
+
 	reverseProxy := proxy.NewSingleHostReverseProxy(u, "", proxyKeepalive, proxyTimeout, fallbackDelay)
+	if c.Proxy.usesH2C(u) {
+		reverseProxy.Transport = h2cTransport
+	}
+	if c.Policy.Enable && c.Policy.DenyPrivate {
+		reverseProxy.Transport = guardTransport(reverseProxy.Transport, &c.Policy)
+		r = r.WithContext(withPinnedAddrs(r.Context(), u.Hostname(), pinned))
+	}
 
-	tmpResponse := ProxyResponse{headers: make(http.Header)}
-	reverseProxy.ServeHTTP(&tmpResponse, r, nil)
+	if c.Proxy.Timeout != 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), c.Proxy.Timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if c.Proxy.MaxBodySize > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, c.Proxy.MaxBodySize)
+	}
 
-	// Decompress the body based on "Content-Encoding" header and write to a writer buffer
-	if err := tmpResponse.WriteBody(); err != nil {
-		return fmt.Errorf("[txtdirect]: Couldn't write the response body: %s", err.Error())
+	release, err := c.Adaptive.acquire(r.Context(), "proxy", c)
+	if err != nil {
+		return err
+	}
+	ctx, span := startSpan(r.Context(), "txtdirect.proxy", spanKindClient)
+	span.setAttribute("http.url", to)
+	r = r.WithContext(ctx)
+	done := func(err error) {
+		span.finish(err)
+		release(err)
 	}
+	if credential, ok := c.Proxy.credential(u.Hostname()); ok {
+		if err := credential.apply(r); err != nil {
+			done(err)
+			return err
+		}
+	}
+	injectTrace(ctx, r.Header)
 
-	// Replace the URL hosts with the request's host
-	if err := tmpResponse.ReplaceBody(u.Scheme, u.Host, r.Host); err != nil {
-		return fmt.Errorf("[txtdirect]: Couldn't replace urls inside the response body: %s", err.Error())
+	if c.Proxy.Stream {
+		lw := &limitedResponseWriter{ResponseWriter: w, limit: c.Proxy.MaxBodySize}
+		if cacheKey != "" {
+			lw.capture = &bytes.Buffer{}
+			lw.revalidating = stale != nil
+		}
+		err := reverseProxy.ServeHTTP(lw, r, nil)
+		done(upstreamError(err, lw.status))
+		if violation, ok := policyError(err); ok && lw.status == 0 {
+			c.Policy.deny(w, r, violation, c)
+			return nil
+		}
+		if err == nil && lw.notModified {
+			return c.Proxy.Cache.refresh(stale, w.Header()).serve(w, cached, staleBody)
+		}
+		if err == nil && !lw.exceeded && cacheKey != "" {
+			cacheResponse(cached, cacheKey, lw.status, w.Header(), lw.capture.Bytes(), c)
+		}
+		// The response can't be changed once it has started
+		if err != nil && lw.status == 0 {
+			return err
+		}
+		return nil
+	}
+
+	tmpResponse := ProxyResponse{headers: make(http.Header), limit: c.Proxy.MaxBodySize}
+	err = reverseProxy.ServeHTTP(&tmpResponse, r, nil)
+	done(upstreamError(err, tmpResponse.status))
+	if violation, ok := policyError(err); ok {
+		c.Policy.deny(w, r, violation, c)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if tmpResponse.exceeded {
+		return errBodyTooLarge
+	}
+	if stale != nil && tmpResponse.status == http.StatusNotModified {
+		return c.Proxy.Cache.refresh(stale, tmpResponse.Header()).serve(w, cached, staleBody)
+	}
+
+	// The 304 and 204 responses are relayed without a body
+	hasBody := bodyAllowed(r.Method, tmpResponse.status)
+	if hasBody {
+		// Decompress the body based on "Content-Encoding" header and write to a writer buffer
+		if err := tmpResponse.WriteBody(); err != nil {
+			return fmt.Errorf("[txtdirect]: Couldn't write the response body: %s", err.Error())
+		}
+
+		// Replace the URL hosts with the request's host
+		if err := tmpResponse.ReplaceBody(u.Scheme, u.Host, r.Host); err != nil {
+			return fmt.Errorf("[txtdirect]: Couldn't replace urls inside the response body: %s", err.Error())
+		}
+	}
+
+	if cacheKey != "" {
+		cacheResponse(cached, cacheKey, tmpResponse.status, tmpResponse.Header(), tmpResponse.Body(), c)
 	}
 
 	copyHeader(w.Header(), tmpResponse.Header())
@@ -61,6 +403,10 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config,
 	// Write the status from the temporary ResponseWriter to the main ResponseWriter
 	w.WriteHeader(tmpResponse.status)
 
+	if !hasBody {
+		return nil
+	}
+
 	// Write the final response from the temporary ResponseWriter to the main ResponseWriter
 	if _, err := w.Write(tmpResponse.Body()); err != nil {
 		return fmt.Errorf("[txtdirect]: Couldn't write the temporary response to main response body: %s", err.Error())
@@ -74,6 +420,10 @@ func (p *ProxyResponse) Header() http.Header {
 }
 
 func (p *ProxyResponse) Write(body []byte) (int, error) {
+	if p.limit > 0 && int64(p.bodyReader.Len()+len(body)) > p.limit {
+		p.exceeded = true
+		return 0, errBodyTooLarge
+	}
 	reader := bytes.NewReader(body)
 	pooledIoCopy(&p.bodyReader, reader)
 	p.body = body
@@ -120,3 +470,233 @@ func (p *ProxyResponse) WriteBody() error {
 	}
 	return nil
 }
+
+// WriteHeader rejects the responses which announce a body larger than
+// the max body size before anything gets sent to the client
+func (l *limitedResponseWriter) WriteHeader(status int) {
+	if l.revalidating && status == http.StatusNotModified {
+		l.status = status
+		l.notModified = true
+		return
+	}
+	length, err := strconv.ParseInt(l.Header().Get("Content-Length"), 10, 64)
+	if l.limit > 0 && err == nil && length > l.limit {
+		l.exceeded = true
+		for _, header := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+			l.Header().Del(header)
+		}
+		status = http.StatusBadGateway
+		l.Header().Set("Status-Code", strconv.Itoa(status))
+		http.Error(l.ResponseWriter, http.StatusText(status), status)
+		l.status = status
+		return
+	}
+	l.status = status
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *limitedResponseWriter) Write(body []byte) (int, error) {
+	if l.notModified {
+		return len(body), nil
+	}
+	if l.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if l.limit > 0 && l.written+int64(len(body)) > l.limit {
+		// Send what fits and cut off the rest of the response
+		l.exceeded = true
+		n, _ := l.ResponseWriter.Write(body[:l.limit-l.written])
+		l.written += int64(n)
+		return n, errBodyTooLarge
+	}
+	n, err := l.ResponseWriter.Write(body)
+	l.written += int64(n)
+	if l.capture != nil {
+		l.capture.Write(body[:n])
+	}
+	return n, err
+}
+
+// Flush sends the buffered response to the client
+func (l *limitedResponseWriter) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// usesH2C checks if the upstream is spoken to over HTTP/2 cleartext
+func (p *Proxy) usesH2C(u *url.URL) bool {
+	if u.Scheme != "http" {
+		return false
+	}
+	for _, h2c := range p.H2C {
+		if matchHostPattern(h2c, u.Hostname()) {
+			return true
+		}
+	}
+	return false
+}
+
+// credential returns the credential of the upstream host
+func (p *Proxy) credential(host string) (ProxyCredential, bool) {
+	for _, credential := range p.Credentials {
+		if matchHostPattern(credential.Host, host) {
+			return credential, true
+		}
+	}
+	return ProxyCredential{}, false
+}
+
+// apply sets the credential's header on the request to the upstream.
+// The headers are copied first, since they're shared with the
+// client's request.
+func (credential ProxyCredential) apply(r *http.Request) error {
+	value := credential.Value
+	if credential.Type == "header" {
+		var err error
+		if value, err = parsePlaceholders(value, r, []string{}); err != nil {
+			return err
+		}
+	}
+	header := make(http.Header, len(r.Header)+1)
+	for name, values := range r.Header {
+		header[name] = values
+	}
+	header.Set(credential.Header, value)
+	r.Header = header
+	return nil
+}
+
+// matchHostPattern checks if the host matches the pattern,
+// * matches every host and *. matches the subdomains
+func matchHostPattern(pattern, host string) bool {
+	host = strings.ToLower(host)
+	return pattern == "*" || pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]))
+}
+
+// bodyAllowed checks if the response to the request can have a body
+func bodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status != http.StatusNotModified && status != http.StatusNoContent && status >= http.StatusOK
+}
+
+// upstreamError returns the error reported to the adaptive limiter
+// for the given proxy error and upstream status
+func upstreamError(err error, status int) error {
+	if err != nil {
+		return err
+	}
+	if status >= http.StatusInternalServerError {
+		return fmt.Errorf("upstream responded with %d", status)
+	}
+	return nil
+}
+
+// ParseProxy parses the txtdirect config for the proxy type
+func (p *Proxy) ParseProxy(c Dispenser) error {
+	switch c.Val() {
+	case "timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a positive duration")
+		}
+		p.Timeout = value
+
+	case "max_body_size":
+		value, err := strconv.ParseInt(c.RemainingArgs()[0], 10, 64)
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for max_body_size field is not standard. It should be a positive integer")
+		}
+		p.MaxBodySize = value
+
+	case "stream":
+		p.Stream = true
+
+	case "credentials":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		credential := ProxyCredential{Host: strings.ToLower(args[0]), Type: args[1]}
+		switch {
+		case credential.Type == "basic" && len(args) == 4:
+			credential.Header = "Authorization"
+			credential.Value = "Basic " + base64.StdEncoding.EncodeToString([]byte(args[2]+":"+args[3]))
+		case credential.Type == "bearer" && len(args) == 3:
+			credential.Header = "Authorization"
+			credential.Value = "Bearer " + args[2]
+		case credential.Type == "header" && len(args) == 4:
+			credential.Header = http.CanonicalHeaderKey(args[2])
+			credential.Value = args[3]
+		default:
+			return fmt.Errorf("The given value for credentials field is not standard. It should be a host pattern followed by basic <user> <password>, bearer <token> or header <name> <value>")
+		}
+		p.Credentials = append(p.Credentials, credential)
+
+	case "cache":
+		p.Cache.Enable = true
+		c.NextArg()
+		if c.Val() != "{" {
+			break
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			if err := p.Cache.ParseProxyCache(c); err != nil {
+				return err
+			}
+		}
+
+	case "h2c":
+		hosts := c.RemainingArgs()
+		if len(hosts) == 0 {
+			hosts = []string{"*"}
+		}
+		for _, host := range hosts {
+			p.H2C = append(p.H2C, strings.ToLower(host))
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for proxy
+	}
+	return nil
+}
+
+var bufferPool = sync.Pool{New: createBuffer}
+
+func createBuffer() interface{} {
+	return make([]byte, 0, 32*1024)
+}
+
+var skipHeaders = map[string]struct{}{
+	"Content-Type":        {},
+	"Content-Disposition": {},
+	"Accept-Ranges":       {},
+	"Set-Cookie":          {},
+	"Cache-Control":       {},
+	"Expires":             {},
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		if _, ok := dst[k]; ok {
+			if _, shouldSkip := skipHeaders[k]; shouldSkip {
+				continue
+			}
+			if k != "Server" {
+				dst.Del(k)
+			}
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func pooledIoCopy(dst io.Writer, src io.Reader) {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+
+	bufCap := cap(buf)
+	io.CopyBuffer(dst, src, buf[0:bufCap:bufCap])
+}
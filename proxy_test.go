@@ -0,0 +1,253 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestProxyRequest(t *testing.T) {
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/large":
+			w.Header().Set("Content-Length", "2048")
+			w.Write([]byte(strings.Repeat("a", 2048)))
+			return
+		}
+		w.Header().Set("X-Upstream", "true")
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="%s/page">page</a>`, upstream.URL)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		path      string
+		proxy     Proxy
+		status    int
+		body      string
+		shouldErr bool
+	}{
+		{
+			"/",
+			Proxy{},
+			200,
+			`<a href="http://example.com/page">page</a>`,
+			false,
+		},
+		{
+			// Streamed responses aren't rewritten
+			"/",
+			Proxy{Enable: true, Stream: true},
+			200,
+			fmt.Sprintf(`<a href="%s/page">page</a>`, upstream.URL),
+			false,
+		},
+		{
+			"/large",
+			Proxy{Enable: true, MaxBodySize: 1024},
+			0,
+			"",
+			true,
+		},
+		{
+			"/large",
+			Proxy{Enable: true, MaxBodySize: 1024, Stream: true},
+			502,
+			"Bad Gateway\n",
+			false,
+		},
+		{
+			"/slow",
+			Proxy{Enable: true, Timeout: 50 * time.Millisecond},
+			0,
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		c := Config{Proxy: test.proxy}
+		if c.Proxy.Enable {
+			c.Proxy.SetDefaults()
+		}
+		rec := record{To: upstream.URL, Type: "proxy"}
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com"+test.path, nil)
+		err := proxyRequest(w, r, rec, c, nil, 302)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, w.Body.String())
+		}
+		if test.status == 200 && w.Header().Get("X-Upstream") != "true" {
+			t.Errorf("Test %d: Expected the upstream's headers to be passed through", i)
+		}
+	}
+}
+
+func TestProxyH2C(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer upstream.Close()
+
+	tests := []struct {
+		h2c   []string
+		proto string
+	}{
+		{nil, "HTTP/1.1"},
+		{[]string{"*"}, "HTTP/2.0"},
+		{[]string{"127.0.0.1"}, "HTTP/2.0"},
+		{[]string{"*.mesh.local"}, "HTTP/1.1"},
+	}
+	for i, test := range tests {
+		c := Config{Proxy: Proxy{Enable: true, H2C: test.h2c}}
+		c.Proxy.SetDefaults()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		if err := proxyRequest(w, r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Body.String() != test.proto {
+			t.Errorf("Test %d: Expected the upstream to be spoken to over %s, got %s", i, test.proto, w.Body.String())
+		}
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Api-Key"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		credentials []ProxyCredential
+		body        string
+	}{
+		{nil, "Basic client|"},
+		{
+			[]ProxyCredential{{Host: "*", Type: "bearer", Header: "Authorization", Value: "Bearer secret"}},
+			"Bearer secret|",
+		},
+		{
+			[]ProxyCredential{
+				{Host: "*.internal", Type: "bearer", Header: "Authorization", Value: "Bearer other"},
+				{Host: "127.0.0.1", Type: "header", Header: "X-Api-Key", Value: "key-{host}"},
+			},
+			"Basic client|key-example.com",
+		},
+	}
+	for i, test := range tests {
+		c := Config{Proxy: Proxy{Enable: true, Credentials: test.credentials}}
+		c.Proxy.SetDefaults()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("Authorization", "Basic client")
+		if err := proxyRequest(w, r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected the upstream to get %q, got %q", i, test.body, w.Body.String())
+		}
+		if r.Header.Get("Authorization") != "Basic client" {
+			t.Errorf("Test %d: Expected the client's request to be left unchanged", i)
+		}
+	}
+}
+
+func TestProxyConditionalRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte("content"))
+		gz.Close()
+	}))
+	defer upstream.Close()
+
+	for _, stream := range []bool{false, true} {
+		c := Config{Proxy: Proxy{Enable: true, Stream: stream}}
+		c.Proxy.SetDefaults()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com/", nil)
+		r.Header.Set("If-None-Match", `"v1"`)
+		if err := proxyRequest(w, r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+			t.Fatalf("Unexpected error relaying the 304 response: %s", err)
+		}
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != `"v1"` {
+			t.Errorf("Expected the upstream's 304 response to be relayed, got %d with %q", w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProxyStreamFlush(t *testing.T) {
+	// The responses with trailers get flushed right after their headers
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprint(w, "chunk")
+		w.Header().Set("X-Checksum", "1")
+	}))
+	defer upstream.Close()
+
+	c := Config{Proxy: Proxy{Enable: true, Stream: true}}
+	c.Proxy.SetDefaults()
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	wrappers := map[string]func(http.ResponseWriter) http.ResponseWriter{
+		// The access log, decision log, webhooks and tracing
+		"statusRecorder": func(w http.ResponseWriter) http.ResponseWriter { return &statusRecorder{ResponseWriter: w} },
+		"explainWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &explainWriter{ResponseWriter: w, r: r, info: &requestInfo{}}
+		},
+	}
+	for name, wrap := range wrappers {
+		w := httptest.NewRecorder()
+		if err := proxyRequest(wrap(w), r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+			t.Errorf("%s: Unexpected error: %s", name, err)
+			continue
+		}
+		if !w.Flushed || w.Body.String() != "chunk" {
+			t.Errorf("%s: Expected the streamed response to be flushed through, got %q", name, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,605 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyCache contains the configuration of the proxy type's response
+// cache. It keeps the upstreams' GET responses which allow shared caching
+// and serves them until they go stale, following the rules of RFC 7234.
+type ProxyCache struct {
+	Enable bool
+	// Type is memory or disk, the disk cache keeps the bodies in Path
+	Type string
+	Path string
+	// MaxSize limits the size of the cached bodies in bytes, the least
+	// recently used responses get evicted once it's exceeded
+	MaxSize int64
+
+	store *responseStore
+}
+
+// responseStore keeps the cached responses in LRU order
+type responseStore struct {
+	sync.Mutex
+	// entries holds the variants of the responses by their keys
+	entries map[string][]*list.Element
+	order   *list.List
+	size    int64
+}
+
+// cachedResponse is a stored upstream response
+type cachedResponse struct {
+	key string
+	// url is the client's URL of the response
+	url    string
+	host   string
+	status int
+	header http.Header
+	// vary holds the request's values of the headers the response varies on
+	vary map[string]string
+	// body is kept in memory, or in file for the disk cache
+	body []byte
+	file string
+	size int64
+	// date is when the response was stored, its age
+	// is added to the age it already had upstream
+	date    time.Time
+	age     time.Duration
+	expires time.Time
+}
+
+const (
+	DefaultProxyCacheType    = "memory"
+	DefaultProxyCacheMaxSize = 64 << 20
+	// proxyCacheExt is the extension of the disk cache's body files
+	proxyCacheExt = ".body"
+)
+
+// cacheableStatuses are the status codes cached when the
+// response has an explicit freshness lifetime
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// SetDefaults sets the default values for the proxy cache config
+// if the fields are empty
+func (pc *ProxyCache) SetDefaults() {
+	if pc.Type == "" {
+		pc.Type = DefaultProxyCacheType
+	}
+	if pc.MaxSize == 0 {
+		pc.MaxSize = DefaultProxyCacheMaxSize
+	}
+	if pc.store == nil {
+		pc.store = &responseStore{
+			entries: make(map[string][]*list.Element),
+			order:   list.New(),
+		}
+	}
+}
+
+// Open prepares the disk cache's directory. The cached responses
+// aren't kept between restarts, so the leftover bodies get removed.
+func (pc *ProxyCache) Open() error {
+	if pc.Type != "disk" {
+		return nil
+	}
+	if err := os.MkdirAll(pc.Path, 0700); err != nil {
+		return fmt.Errorf("couldn't create the proxy cache directory: %s", err.Error())
+	}
+	files, err := filepath.Glob(filepath.Join(pc.Path, "*"+proxyCacheExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		os.Remove(file)
+	}
+	return nil
+}
+
+// Size returns the size of the cached bodies in bytes
+func (pc *ProxyCache) Size() int64 {
+	if pc.store == nil {
+		return 0
+	}
+	pc.store.Lock()
+	defer pc.store.Unlock()
+	return pc.store.size
+}
+
+// proxyCacheKey identifies the responses by the requested host, since
+// their URLs get replaced by it, the requested URI and the upstream
+func proxyCacheKey(r *http.Request, upstream string) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI() + " " + upstream
+}
+
+// requestURL returns the URL requested by the client
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// lookup returns the cached response of the request, its body and if it's
+// fresh enough for the request. The stale responses are only returned when
+// they have validators, so they can be revalidated with the upstream.
+func (pc *ProxyCache) lookup(r *http.Request, key string) (*cachedResponse, []byte, bool) {
+	if pc.store == nil || !cacheableRequest(r) {
+		return nil, nil, false
+	}
+	directives := parseCacheControl(r.Header.Get("Cache-Control"))
+
+	pc.store.Lock()
+	var entry *cachedResponse
+	fresh := false
+	for _, elem := range pc.store.entries[key] {
+		candidate := elem.Value.(*cachedResponse)
+		if !candidate.matches(r) {
+			continue
+		}
+		expired := time.Now().After(candidate.expires)
+		if expired && !candidate.validatable() {
+			pc.store.remove(elem)
+			break
+		}
+		fresh = !expired
+		if _, ok := directives["no-cache"]; ok || r.Header.Get("Pragma") == "no-cache" {
+			fresh = false
+		}
+		if maxAge, ok := directives["max-age"]; ok {
+			if seconds, err := strconv.Atoi(maxAge); err == nil && candidate.currentAge() > time.Duration(seconds)*time.Second {
+				fresh = false
+			}
+		}
+		if !fresh && !candidate.validatable() {
+			break
+		}
+		pc.store.order.MoveToFront(elem)
+		entry = candidate
+		break
+	}
+	pc.store.Unlock()
+	if entry == nil {
+		return nil, nil, false
+	}
+
+	if entry.file == "" {
+		return entry, entry.body, fresh
+	}
+	body, err := ioutil.ReadFile(entry.file)
+	if err != nil {
+		pc.purge(func(cached *cachedResponse) bool { return cached == entry })
+		return nil, nil, false
+	}
+	return entry, body, fresh
+}
+
+// refresh updates the cached response with the headers of the upstream's
+// 304 response. The cached responses can be served concurrently, so the
+// refreshed copy replaces the response instead of changing it.
+func (pc *ProxyCache) refresh(entry *cachedResponse, header http.Header) *cachedResponse {
+	refreshed := *entry
+	refreshed.header = cloneHeader(entry.header)
+	for _, name := range []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified"} {
+		if values, ok := header[name]; ok {
+			refreshed.header[name] = append([]string{}, values...)
+		}
+	}
+	refreshed.date = time.Now()
+	refreshed.age = upstreamAge(header)
+	refreshed.expires = refreshed.date.Add(freshness(refreshed.header) - refreshed.age)
+
+	pc.store.Lock()
+	defer pc.store.Unlock()
+	for _, elem := range pc.store.entries[entry.key] {
+		if elem.Value == entry {
+			elem.Value = &refreshed
+			pc.store.order.MoveToFront(elem)
+			break
+		}
+	}
+	return &refreshed
+}
+
+// save caches the upstream's response if it can be stored by
+// a shared cache and the cache has room for its body
+func (pc *ProxyCache) save(r *http.Request, key string, status int, header http.Header, body []byte) error {
+	if pc.store == nil || !cacheableRequest(r) || !storable(r, status, header) {
+		return nil
+	}
+	if int64(len(body)) > pc.MaxSize {
+		return nil
+	}
+
+	entry := &cachedResponse{
+		key:    key,
+		url:    requestURL(r),
+		host:   strings.ToLower(r.Host),
+		status: status,
+		header: cloneHeader(header),
+		vary:   make(map[string]string),
+		size:   int64(len(body)),
+		date:   time.Now(),
+	}
+	for _, name := range varyHeaders(header) {
+		entry.vary[name] = r.Header.Get(name)
+	}
+	entry.age = upstreamAge(header)
+	entry.expires = entry.date.Add(freshness(header) - entry.age)
+	// The stale responses are only kept to be revalidated
+	if !entry.expires.After(entry.date) && !entry.validatable() {
+		return nil
+	}
+	entry.header.Del("Age")
+	entry.header.Del(cacheStatusHeader)
+
+	if pc.Type == "disk" {
+		// Every body gets its own file, so replacing the variant's
+		// previous response doesn't remove the new body
+		entry.file = filepath.Join(pc.Path, entry.fileName()+"-"+strconv.FormatInt(entry.date.UnixNano(), 36)+proxyCacheExt)
+		if err := ioutil.WriteFile(entry.file, body, 0600); err != nil {
+			return fmt.Errorf("couldn't write the cached response: %s", err.Error())
+		}
+	} else {
+		entry.body = append([]byte{}, body...)
+	}
+
+	pc.store.Lock()
+	defer pc.store.Unlock()
+	// The response replaces the same variant's previous response
+	for _, elem := range pc.store.entries[key] {
+		if elem.Value.(*cachedResponse).fileName() == entry.fileName() {
+			pc.store.remove(elem)
+			break
+		}
+	}
+	pc.store.entries[key] = append(pc.store.entries[key], pc.store.order.PushFront(entry))
+	pc.store.size += entry.size
+	for pc.store.size > pc.MaxSize {
+		pc.store.remove(pc.store.order.Back())
+	}
+	return nil
+}
+
+// purge removes the cached responses matching the given function
+// and returns the number of the removed responses
+func (pc *ProxyCache) purge(match func(*cachedResponse) bool) int {
+	if pc.store == nil {
+		return 0
+	}
+	pc.store.Lock()
+	defer pc.store.Unlock()
+	purged := 0
+	for elem := pc.store.order.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*cachedResponse)) {
+			pc.store.remove(elem)
+			purged++
+		}
+		elem = next
+	}
+	return purged
+}
+
+// remove drops the cached response, the caller should hold the lock
+func (s *responseStore) remove(elem *list.Element) {
+	entry := elem.Value.(*cachedResponse)
+	s.order.Remove(elem)
+	s.size -= entry.size
+	variants := s.entries[entry.key]
+	for i, variant := range variants {
+		if variant == elem {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(s.entries, entry.key)
+	} else {
+		s.entries[entry.key] = variants
+	}
+	if entry.file != "" {
+		os.Remove(entry.file)
+	}
+}
+
+// notModifiedHeaders are the headers of the cached response
+// sent with the 304 responses, following RFC 7232. The names are
+// in their canonical form since the headers are indexed directly.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified", "Vary"}
+
+// serve writes the cached response with its current age, or a 304
+// response when the request's conditions show the client has it
+func (entry *cachedResponse) serve(w http.ResponseWriter, r *http.Request, body []byte) error {
+	if entry.status == http.StatusOK && entry.notModified(r) {
+		header := make(http.Header)
+		for _, name := range notModifiedHeaders {
+			if values, ok := entry.header[name]; ok {
+				header[name] = values
+			}
+		}
+		copyHeader(w.Header(), header)
+		w.Header().Set("Age", strconv.Itoa(int(entry.currentAge().Seconds())))
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	copyHeader(w.Header(), entry.header)
+	w.Header().Set("Age", strconv.Itoa(int(entry.currentAge().Seconds())))
+	w.WriteHeader(entry.status)
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("[txtdirect]: Couldn't write the cached response: %s", err.Error())
+	}
+	return nil
+}
+
+// notModified checks the request's conditions against the cached
+// response's validators, If-None-Match takes precedence over
+// If-Modified-Since
+func (entry *cachedResponse) notModified(r *http.Request) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return etagMatches(match, entry.header.Get("ETag"))
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(entry.header.Get("Last-Modified"))
+	return err == nil && !modified.After(since)
+}
+
+// validatable checks if the cached response has validators
+// which the upstream can check the response's freshness with
+func (entry *cachedResponse) validatable() bool {
+	return entry.header.Get("ETag") != "" || entry.header.Get("Last-Modified") != ""
+}
+
+// revalidate returns the request to the upstream asking it if the cached
+// response is still valid. The headers are copied first, since they're
+// shared with the client's request.
+func (entry *cachedResponse) revalidate(r *http.Request) *http.Request {
+	header := cloneHeader(r.Header)
+	header.Del("If-None-Match")
+	header.Del("If-Modified-Since")
+	if etag := entry.header.Get("ETag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if modified := entry.header.Get("Last-Modified"); modified != "" {
+		header.Set("If-Modified-Since", modified)
+	}
+	r = r.WithContext(r.Context())
+	r.Header = header
+	return r
+}
+
+// matches checks if the request has the same values as
+// the cached response's request for the headers it varies on
+func (entry *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range entry.vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// currentAge returns the response's age including its upstream age
+func (entry *cachedResponse) currentAge() time.Duration {
+	return time.Since(entry.date) + entry.age
+}
+
+// fileName identifies the response's variant
+func (entry *cachedResponse) fileName() string {
+	names := make([]string, 0, len(entry.vary))
+	for name := range entry.vary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	id := entry.key
+	for _, name := range names {
+		id += "\n" + name + ": " + entry.vary[name]
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// etagMatches does the weak comparison of the If-None-Match header's tags
+func etagMatches(match, etag string) bool {
+	for _, tag := range strings.Split(match, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || (etag != "" && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamAge returns the age the response already had upstream
+func upstreamAge(header http.Header) time.Duration {
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		return time.Duration(age) * time.Second
+	}
+	return 0
+}
+
+// cacheableRequest checks if the response to the request can be
+// served from the cache, only GET requests are cached
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(r.Header.Get("Cache-Control"))["no-store"]
+	return !noStore
+}
+
+// storable checks if a shared cache can store the response
+func storable(r *http.Request, status int, header http.Header) bool {
+	if !cacheableStatuses[status] || header.Get("Set-Cookie") != "" {
+		return false
+	}
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return false
+		}
+	}
+	for _, name := range varyHeaders(header) {
+		if name == "*" {
+			return false
+		}
+	}
+	// The authorized responses need to be explicitly shareable
+	if r.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		return public || sMaxAge || mustRevalidate
+	}
+	return true
+}
+
+// freshness returns the response's explicit freshness lifetime,
+// s-maxage takes precedence over max-age which takes precedence
+// over the Expires header
+func freshness(header http.Header) time.Duration {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[directive]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if header.Get("Expires") == "" {
+		return 0
+	}
+	expires, err := http.ParseTime(header.Get("Expires"))
+	if err != nil {
+		return 0
+	}
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		date = time.Now()
+	}
+	return expires.Sub(date)
+}
+
+// parseCacheControl returns the Cache-Control header's directives
+// with their values, the directives without values map to ""
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, arg := part, ""
+		if i := strings.Index(part, "="); i != -1 {
+			name, arg = part[:i], strings.Trim(part[i+1:], `"`)
+		}
+		directives[strings.ToLower(name)] = arg
+	}
+	return directives
+}
+
+// varyHeaders returns the canonical names of the headers the response varies on
+func varyHeaders(header http.Header) []string {
+	var names []string
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// cloneHeader returns a copy of the header
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for name, values := range header {
+		clone[name] = append([]string{}, values...)
+	}
+	return clone
+}
+
+// ParseProxyCache parses the txtdirect config for the proxy cache
+func (pc *ProxyCache) ParseProxyCache(c Dispenser) error {
+	switch c.Val() {
+	case "type":
+		args := c.RemainingArgs()
+		if len(args) != 1 || (args[0] != "memory" && args[0] != "disk") {
+			return fmt.Errorf("The given value for type field is not standard. It should be memory or disk")
+		}
+		pc.Type = args[0]
+
+	case "path":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		pc.Path = args[0]
+
+	case "max_size":
+		value, err := strconv.ParseInt(c.RemainingArgs()[0], 10, 64)
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for max_size field is not standard. It should be a positive integer")
+		}
+		pc.MaxSize = value
+
+	default:
+		return c.ArgErr() // unhandled option for proxy cache
+	}
+	return nil
+}
+
+// cacheResponse saves the upstream's response in the proxy cache,
+// failing to cache it doesn't fail the request
+func cacheResponse(r *http.Request, key string, status int, header http.Header, body []byte, c Config) {
+	if err := c.Proxy.Cache.save(r, key, status, header, body); err != nil {
+		log.Printf("[txtdirect]: Couldn't cache the response of %s: %s", key, err.Error())
+	}
+	if c.Prometheus.Enable {
+		ProxyCacheSize.Set(float64(c.Proxy.Cache.Size()))
+	}
+}
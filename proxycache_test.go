@@ -0,0 +1,406 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestProxyCache(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Header().Set("Age", "10")
+		case "/expires":
+			w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+		case "/stale":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "60")
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/cookie":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "session=1")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			fmt.Fprintf(w, "%s ", r.Header.Get("Accept-Language"))
+		case "/error":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		fmt.Fprintf(w, "response %d", n)
+	}))
+	defer upstream.Close()
+
+	dir, err := ioutil.TempDir("", "proxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		path    string
+		method  string
+		headers [2]string
+		cached  bool
+	}{
+		{"/fresh", "GET", [2]string{}, true},
+		{"/expires", "GET", [2]string{}, true},
+		{"/stale", "GET", [2]string{}, false},
+		{"/nostore", "GET", [2]string{}, false},
+		{"/private", "GET", [2]string{}, false},
+		{"/cookie", "GET", [2]string{}, false},
+		{"/error", "GET", [2]string{}, false},
+		{"/fresh", "POST", [2]string{}, false},
+		{"/vary", "GET", [2]string{"en", "en"}, true},
+		{"/vary", "GET", [2]string{"de", "fr"}, false},
+	}
+	for _, cache := range []ProxyCache{{Enable: true}, {Enable: true, Type: "disk", Path: dir}} {
+		for _, stream := range []bool{false, true} {
+			c := Config{Proxy: Proxy{Enable: true, Stream: stream, Cache: cache}}
+			c.Proxy.SetDefaults()
+			if err := c.Proxy.Cache.Open(); err != nil {
+				t.Fatal(err)
+			}
+			for i, test := range tests {
+				var responses [2]*httptest.ResponseRecorder
+				for j := range responses {
+					r := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+					if test.headers[j] != "" {
+						r.Header.Set("Accept-Language", test.headers[j])
+					}
+					responses[j] = httptest.NewRecorder()
+					if err := proxyRequest(responses[j], r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+						t.Fatalf("Test %d: Unexpected error: %s", i, err)
+					}
+				}
+				first, second := responses[0], responses[1]
+				if cached := first.Body.String() == second.Body.String(); cached != test.cached {
+					t.Errorf("Test %d (%s, stream %t): Expected the response to be cached: %t, got %q and %q",
+						i, c.Proxy.Cache.Type, stream, test.cached, first.Body.String(), second.Body.String())
+				}
+				if test.method == "GET" && first.Header().Get(cacheStatusHeader) != "MISS" {
+					t.Errorf("Test %d: Expected the first response to miss the cache, got %q", i, first.Header().Get(cacheStatusHeader))
+				}
+				if test.cached && (second.Header().Get(cacheStatusHeader) != "HIT" || second.Code != first.Code) {
+					t.Errorf("Test %d: Expected the second response to hit the cache, got %q", i, second.Header().Get(cacheStatusHeader))
+				}
+				if test.path == "/fresh" && test.method == "GET" && second.Header().Get("Age") != "10" {
+					t.Errorf("Test %d: Expected the upstream's age to be kept, got %q", i, second.Header().Get("Age"))
+				}
+			}
+			if cache.Type == "disk" {
+				files, _ := filepath.Glob(filepath.Join(dir, "*"+proxyCacheExt))
+				if len(files) != c.Proxy.Cache.store.order.Len() {
+					t.Errorf("Expected a body file per cached response, got %d files for %d responses", len(files), c.Proxy.Cache.store.order.Len())
+				}
+			}
+		}
+	}
+}
+
+func TestProxyCacheControl(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, time.Now().UnixNano())
+	}))
+	defer upstream.Close()
+
+	c := Config{Proxy: Proxy{Enable: true, Cache: ProxyCache{Enable: true}}}
+	c.Proxy.SetDefaults()
+	get := func(path, header, value string) string {
+		r := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		if err := proxyRequest(w, r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return w.Body.String()
+	}
+
+	cached := get("/", "", "")
+	if get("/", "", "") != cached {
+		t.Fatalf("Expected the response to be cached")
+	}
+	if get("/", "Cache-Control", "no-cache") == cached {
+		t.Errorf("Expected no-cache requests to skip the cache")
+	}
+	// The no-cache request's response replaced the cached one
+	cached = get("/", "", "")
+	if get("/", "Cache-Control", "max-age=0") == cached {
+		t.Errorf("Expected the requests with a lower max-age to skip the cache")
+	}
+	if get("/auth", "Authorization", "Bearer token") == get("/auth", "Authorization", "Bearer token") {
+		t.Errorf("Expected the authorized responses without public not to be cached")
+	}
+}
+
+func TestProxyCacheRevalidation(t *testing.T) {
+	var calls, revalidations int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("ETag", `W/"v1"`)
+		w.Header().Set("Last-Modified", "Tue, 01 Jan 2019 00:00:00 GMT")
+		if r.Header.Get("If-None-Match") == `W/"v1"` {
+			atomic.AddInt32(&revalidations, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		// The first response is stale right away
+		w.Header().Set("Cache-Control", "max-age=0")
+		fmt.Fprint(w, "content")
+	}))
+	defer upstream.Close()
+
+	for _, stream := range []bool{false, true} {
+		atomic.StoreInt32(&calls, 0)
+		atomic.StoreInt32(&revalidations, 0)
+		c := Config{Proxy: Proxy{Enable: true, Stream: stream, Cache: ProxyCache{Enable: true}}}
+		c.Proxy.SetDefaults()
+		get := func(header, value string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			if header != "" {
+				r.Header.Set(header, value)
+			}
+			w := httptest.NewRecorder()
+			if err := proxyRequest(w, r, record{To: upstream.URL, Type: "proxy"}, c, nil, 302); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			return w
+		}
+
+		// The max-age=0 response can't be stored without its validators
+		if w := get("", ""); w.Body.String() != "content" {
+			t.Fatalf("Expected the upstream's response, got %q", w.Body.String())
+		}
+		// The stale response gets revalidated and refreshed
+		if w := get("", ""); w.Code != http.StatusOK || w.Body.String() != "content" || revalidations != 1 {
+			t.Errorf("Stream %t: Expected the revalidated response from the cache, got %d %q after %d revalidations", stream, w.Code, w.Body.String(), revalidations)
+		}
+		// The refreshed response is fresh and answers the conditional requests
+		if w := get("If-None-Match", `"v1", "v0"`); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("Stream %t: Expected a 304 response from the cache, got %d %q", stream, w.Code, w.Body.String())
+		}
+		if w := get("If-Modified-Since", "Wed, 02 Jan 2019 00:00:00 GMT"); w.Code != http.StatusNotModified {
+			t.Errorf("Stream %t: Expected a 304 response for an unmodified response, got %d", stream, w.Code)
+		}
+		if w := get("If-Modified-Since", "Mon, 31 Dec 2018 00:00:00 GMT"); w.Code != http.StatusOK || w.Body.String() != "content" {
+			t.Errorf("Stream %t: Expected the cached response for a modified response, got %d", stream, w.Code)
+		}
+		if calls != 2 {
+			t.Errorf("Stream %t: Expected the fresh response to be served from the cache, the upstream got %d calls", stream, calls)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		match   string
+		etag    string
+		matches bool
+	}{
+		{`"a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"b", W/"a"`, `W/"a"`, true},
+		{`*`, ``, true},
+		{`"b"`, `"a"`, false},
+		{`"a"`, ``, false},
+	}
+	for i, test := range tests {
+		if matches := etagMatches(test.match, test.etag); matches != test.matches {
+			t.Errorf("Test %d: Expected %s to match %s: %t, got %t", i, test.match, test.etag, test.matches, matches)
+		}
+	}
+}
+
+func TestProxyCacheEviction(t *testing.T) {
+	c := Config{Proxy: Proxy{Enable: true, Cache: ProxyCache{Enable: true, MaxSize: 10}}}
+	c.Proxy.SetDefaults()
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := c.Proxy.Cache.save(r, key, 200, header, []byte("12345")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok := c.Proxy.Cache.lookup(r, "a"); ok {
+		t.Errorf("Expected the least recently used response to be evicted")
+	}
+	if _, _, ok := c.Proxy.Cache.lookup(r, "c"); !ok || c.Proxy.Cache.Size() != 10 {
+		t.Errorf("Expected the cache to keep the recent responses under its max size, got %d bytes", c.Proxy.Cache.Size())
+	}
+	if err := c.Proxy.Cache.save(r, "large", 200, header, []byte("12345678901")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := c.Proxy.Cache.lookup(r, "large"); ok {
+		t.Errorf("Expected the responses larger than the max size not to be cached")
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	date := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header   http.Header
+		lifetime time.Duration
+	}{
+		{http.Header{"Cache-Control": {"max-age=60"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 2 * time.Minute},
+		{http.Header{"Cache-Control": {`max-age="30"`}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, 30 * time.Second},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{http.Header{"Expires": {"0"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+		{http.Header{}, 0},
+	}
+	for i, test := range tests {
+		if lifetime := freshness(test.header); lifetime != test.lifetime {
+			t.Errorf("Test %d: Expected the lifetime %s, got %s", i, test.lifetime, lifetime)
+		}
+	}
+}
+
+func TestProxyCachePurge(t *testing.T) {
+	c := Config{
+		Proxy: Proxy{Enable: true, Cache: ProxyCache{Enable: true}},
+		Admin: Admin{Enable: true, Token: "secret"},
+	}
+	c.Proxy.SetDefaults()
+	c.Admin.SetDefaults()
+	header := http.Header{"Cache-Control": {"max-age=60"}}
+	for _, u := range []string{"https://a.example.com/one", "https://a.example.com/two", "https://b.example.com/one"} {
+		r := httptest.NewRequest("GET", u, nil)
+		if err := c.Proxy.Cache.save(r, proxyCacheKey(r, "http://upstream"+r.URL.Path), 200, header, []byte("body")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query  string
+		purged int
+	}{
+		{"?url=https://a.example.com/two", 1},
+		{"?host=A.example.com", 1},
+		{"?host=a.example.com", 0},
+		{"", 1},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("POST", "https://example.com"+DefaultAdminPath+"/proxy/purge"+test.query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		if err := c.Admin.ServeHTTP(w, r, c); err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if expected := fmt.Sprintf(`"purged": %d`, test.purged); !strings.Contains(w.Body.String(), expected) {
+			t.Errorf("Test %d: Expected %s, got %s", i, expected, w.Body.String())
+		}
+	}
+
+	c.Proxy.Cache.Enable = false
+	r := httptest.NewRequest("POST", "https://example.com"+DefaultAdminPath+"/proxy/purge", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	c.Admin.ServeHTTP(w, r, c)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without the proxy cache, got %d", w.Code)
+	}
+}
+
+func TestParseProxyCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	leftover := filepath.Join(dir, "old"+proxyCacheExt)
+	ioutil.WriteFile(leftover, []byte("old"), 0600)
+
+	c := caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		enable proxy
+		proxy {
+			cache {
+				type disk
+				path %s
+				max_size 1024
+			}
+		}
+	}
+	`, dir))
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cache := conf.Proxy.Cache
+	if !cache.Enable || cache.Type != "disk" || cache.Path != dir || cache.MaxSize != 1024 || cache.store == nil {
+		t.Errorf("Expected the proxy cache to be configured, got %+v", cache)
+	}
+	// The running instance's bodies are kept until the startup hook
+	if _, err := os.Stat(leftover); err != nil {
+		t.Errorf("Expected the bodies to be kept while parsing, got %s", err)
+	}
+	if err := cache.Open(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Expected the leftover bodies to be removed")
+	}
+
+	c = caddy.NewTestController("http", `
+	txtdirect {
+		enable proxy
+		proxy {
+			cache
+		}
+	}
+	`)
+	if conf, err = parse(c); err != nil || conf.Proxy.Cache.Type != DefaultProxyCacheType || conf.Proxy.Cache.MaxSize != DefaultProxyCacheMaxSize {
+		t.Errorf("Expected the default memory cache, got %+v: %v", conf.Proxy.Cache, err)
+	}
+
+	for _, config := range []string{"type disk", "type redis", "max_size 0", "unknown"} {
+		c := caddy.NewTestController("http", `
+		txtdirect {
+			enable proxy
+			proxy {
+				cache {
+					`+config+`
+				}
+			}
+		}
+		`)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolListener accepts the connections of the L4 load balancers
+// which send the client's address in a PROXY protocol v1 or v2 header.
+// The header is read from the first read on the connection, so a slow
+// client can't block the other connections from being accepted.
+type proxyProtocolListener struct {
+	net.Listener
+	// trusted are the load balancers' networks, the connections from
+	// the other addresses are served without reading a header. All the
+	// connections have to send the header if it's empty.
+	trusted []*net.IPNet
+}
+
+// proxyProtocolConn is a connection which replaces its remote
+// address by the client's address sent in the PROXY header
+type proxyProtocolConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	once    sync.Once
+	err     error
+	trusted bool
+	remote  net.Addr
+}
+
+// proxyProtocolTimeout limits the time spent reading the PROXY header
+const proxyProtocolTimeout = 5 * time.Second
+
+// proxyProtocolV2Signature starts the binary PROXY header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// parseTrustedNetworks parses the CIDR networks, the bare
+// addresses are treated as single address networks
+func parseTrustedNetworks(networks []string) ([]*net.IPNet, error) {
+	var parsed []*net.IPNet
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			if strings.Contains(network, ":") {
+				network += "/128"
+			} else {
+				network += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s", network)
+		}
+		parsed = append(parsed, ipNet)
+	}
+	return parsed, nil
+}
+
+// Accept waits for the next connection
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: l.isTrusted(conn.RemoteAddr()),
+	}, nil
+}
+
+// isTrusted checks if the address is in one of the trusted networks
+func (l *proxyProtocolListener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHeader reads the PROXY header once from the trusted connections
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		if !c.trusted {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("couldn't read the PROXY header from %s: %s", c.Conn.RemoteAddr(), c.err.Error())
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client's address sent in the PROXY header, or
+// the connection's address if the header hasn't sent one
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns
+// the client's address, which is nil for the health checks of the
+// load balancer and the unknown protocols
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	signature, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads the text header, e.g.
+// PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The longest header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY protocol header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is sent by the load balancer itself
+	if header[12]&0x0F == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(data) < 12 {
+			return nil, fmt.Errorf("invalid PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(data) < 36 {
+			return nil, fmt.Errorf("invalid PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}, nil
+	}
+	// The addresses of the other protocols are ignored
+	return nil, nil
+}
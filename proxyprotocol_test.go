@@ -0,0 +1,138 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyHeaderV2 builds a binary PROXY header for a TCP connection
+func proxyHeaderV2(command byte, src, dst net.IP, srcPort, dstPort uint16) []byte {
+	family, length := byte(0x11), 12
+	if src.To4() == nil {
+		family, length = 0x21, 36
+	} else {
+		src, dst = src.To4(), dst.To4()
+	}
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(length))
+	header = append(header, src...)
+	header = append(header, dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports, srcPort)
+	binary.BigEndian.PutUint16(ports[2:], dstPort)
+	return append(header, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		header    []byte
+		addr      string
+		shouldErr bool
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", false},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", false},
+		{[]byte("PROXY UNKNOWN\r\n"), "", false},
+		{proxyHeaderV2(1, net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), 56324, 443), "192.0.2.1:56324", false},
+		{proxyHeaderV2(1, net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443), "[2001:db8::1]:56324", false},
+		// The load balancer's health checks use the LOCAL command
+		{proxyHeaderV2(0, net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), 56324, 443), "", false},
+		{[]byte("PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n"), "", true},
+		{[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n"), "", true},
+		{[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", true},
+		{[]byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", true},
+	}
+	for i, test := range tests {
+		// The request after the header has to be left unread
+		r := bufio.NewReader(bytes.NewReader(append(test.header, "GET /"...)))
+		addr, err := readProxyHeader(r)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if (addr == nil && test.addr != "") || (addr != nil && addr.String() != test.addr) {
+			t.Errorf("Test %d: Expected the address %q, got %v", i, test.addr, addr)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "GET /" {
+			t.Errorf("Test %d: Expected the request to be left unread, got %q", i, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		header  string
+		remote  string
+		status  string
+	}{
+		{nil, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "200"},
+		{[]string{"127.0.0.0/8"}, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "200"},
+		// The headers of the untrusted connections aren't read
+		{[]string{"10.0.0.0/8"}, "", "127.0.0.1", "200"},
+		{[]string{"10.0.0.0/8"}, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", "400"},
+		// The trusted connections have to send the header
+		{nil, "", "", "400"},
+	}
+	for i, test := range tests {
+		trusted, err := parseTrustedNetworks(test.trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Remote", r.RemoteAddr)
+		})}
+		go server.Serve(&proxyProtocolListener{Listener: l, trusted: trusted})
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", test.header)
+		response, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		server.Close()
+
+		if !strings.HasPrefix(string(response), "HTTP/1.1 "+test.status) {
+			t.Errorf("Test %d: Expected status code %s, got %q", i, test.status, response)
+			continue
+		}
+		if test.remote != "" && !strings.Contains(string(response), "X-Remote: "+test.remote) {
+			t.Errorf("Test %d: Expected the remote address %s, got %q", i, test.remote, response)
+		}
+	}
+
+	if _, err := parseTrustedNetworks([]string{"not a network"}); err == nil {
+		t.Errorf("Expected an error for an invalid network")
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// QR is the config of the QR codes rendering the redirect targets, either
+// on the sub-path of the redirected URLs or by the type=qr records
+type QR struct {
+	Enable bool
+	// Path is the suffix of the redirected URL's path
+	// serving the QR code of its target
+	Path string
+	// Scale is the size of a module of the PNG images in pixels
+	Scale  int
+	Format string
+}
+
+const (
+	DefaultQRPath   = "/_qr"
+	DefaultQRScale  = 8
+	DefaultQRFormat = "png"
+	// qrQuietZone is the light border around the symbol in modules
+	qrQuietZone = 4
+)
+
+// SetDefaults sets the default values for QR config
+// if the fields are empty
+func (q *QR) SetDefaults() {
+	if q.Path == "" {
+		q.Path = DefaultQRPath
+	}
+	if q.Scale == 0 {
+		q.Scale = DefaultQRScale
+	}
+	if q.Format == "" {
+		q.Format = DefaultQRFormat
+	}
+}
+
+// ParseQR parses the txtdirect config for QR codes
+func (q *QR) ParseQR(c Dispenser) error {
+	switch c.Val() {
+	case "path":
+		q.Path = c.RemainingArgs()[0]
+		if !strings.HasPrefix(q.Path, "/") || q.Path == "/" {
+			return fmt.Errorf("The given value for path field is not standard. It should be a path starting with /")
+		}
+
+	case "scale":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 || value > 64 {
+			return fmt.Errorf("The given value for scale field is not standard. It should be a number between 1 and 64")
+		}
+		q.Scale = value
+
+	case "format":
+		q.Format = c.RemainingArgs()[0]
+		if q.Format != "png" && q.Format != "svg" {
+			return fmt.Errorf("The given value for format field is not standard. It should be png or svg")
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for qr
+	}
+	return nil
+}
+
+// handles checks if the request asks for the QR code of a redirect
+func (q *QR) handles(r *http.Request) bool {
+	return q.Path != "" && strings.HasSuffix(r.URL.Path, q.Path)
+}
+
+// serveTarget resolves the redirect of the URL without the QR code's
+// sub-path and serves its target as a QR code
+func (q *QR) serveTarget(w http.ResponseWriter, r *http.Request, c Config) error {
+	target := *r.URL
+	target.Path = strings.TrimSuffix(r.URL.Path, q.Path)
+	if target.Path == "" {
+		target.Path = "/"
+	}
+	target.RawPath = ""
+	target.RawQuery = ""
+	req := r.WithContext(r.Context())
+	req.URL = &target
+	req.RequestURI = target.RequestURI()
+
+	// The request has already been rate limited
+	c.RateLimit.Enable = false
+	rec := &redirectRecorder{header: make(http.Header)}
+	if err := Redirect(rec, req, c); err != nil {
+		return err
+	}
+	location := rec.header.Get("Location")
+	if rec.status < 300 || rec.status >= 400 || location == "" {
+		c.Templates.serveNotFound(w, r)
+		return nil
+	}
+	return q.render(w, r, absoluteLocation(r, location))
+}
+
+// render serves the QR code of the target in the requested format,
+// the format= query parameter overrides the configured format
+func (q *QR) render(w http.ResponseWriter, r *http.Request, target string) error {
+	code, err := encodeQR(target)
+	if err != nil {
+		log.Printf("[txtdirect]: Couldn't render the QR code of %s: %s", target, err.Error())
+		http.Error(w, http.StatusText(http.StatusUnprocessableEntity), http.StatusUnprocessableEntity)
+		return nil
+	}
+
+	format := q.Format
+	if requested := r.URL.Query().Get("format"); requested == "png" || requested == "svg" {
+		format = requested
+	}
+	var body []byte
+	switch format {
+	case "svg":
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = code.svg()
+	default:
+		w.Header().Set("Content-Type", "image/png")
+		if body, err = code.png(q.Scale); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusOK))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+	return err
+}
+
+// absoluteLocation resolves the relative redirects against the request
+func absoluteLocation(r *http.Request, location string) string {
+	u, err := url.Parse(location)
+	if err != nil || u.IsAbs() {
+		return location
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path}
+	return base.ResolveReference(u).String()
+}
+
+// redirectRecorder keeps the status and headers of a
+// redirect, dropping its body
+type redirectRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *redirectRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *redirectRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (r *redirectRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// png renders the symbol with a quiet zone as a black and white image
+func (code *qrCode) png(scale int) ([]byte, error) {
+	if scale < 1 {
+		scale = DefaultQRScale
+	}
+	size := (code.size + 2*qrQuietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.White, color.Black})
+	for y, row := range code.modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// svg renders the symbol with a quiet zone, every dark module
+// is a unit square of the path
+func (code *qrCode) svg() []byte {
+	size := code.size + 2*qrQuietZone
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	buf.WriteString(`<rect width="100%" height="100%" fill="#fff"/><path fill="#000" d="`)
+	for y, row := range code.modules {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
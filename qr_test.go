@@ -0,0 +1,137 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"image/png"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestQRE2e(t *testing.T) {
+	tests := []struct {
+		url         string
+		status      int
+		contentType string
+		target      string
+	}{
+		{"https://target.qr.test/_qr", 200, "image/png", "https://example.com/target"},
+		{"https://target.qr.test/_qr?format=svg", 200, "image/svg+xml", "https://example.com/target"},
+		{"https://qr.test/", 200, "image/png", "https://example.com/qr"},
+		{"https://noto.qr.test/", 404, "", ""},
+		// The QR codes are only served for the redirects
+		{"https://127.0.0.1/_qr", 404, "", ""},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "qr"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			QR:       QR{Enable: true, Scale: 2},
+		}
+		c.QR.SetDefaults()
+		req := httptest.NewRequest("GET", test.url, nil)
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.status, w.Code)
+			continue
+		}
+		if test.status != 200 {
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != test.contentType {
+			t.Errorf("Test %d: Expected content type %s, got %s", i, test.contentType, contentType)
+		}
+
+		code, err := encodeQR(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (code.size + 2*qrQuietZone) * 2
+		if test.contentType == "image/svg+xml" {
+			if !bytes.Equal(w.Body.Bytes(), code.svg()) {
+				t.Errorf("Test %d: Expected the QR code of %s, got %s", i, test.target, w.Body.String())
+			}
+			continue
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Errorf("Test %d: Couldn't decode the PNG: %s", i, err)
+			continue
+		}
+		if img.Bounds().Dx() != size {
+			t.Errorf("Test %d: Expected a %dpx wide image, got %d", i, size, img.Bounds().Dx())
+		}
+		// The top left module of the finder pattern is dark
+		if r, _, _, _ := img.At(qrQuietZone*2, qrQuietZone*2).RGBA(); r != 0 {
+			t.Errorf("Test %d: Expected the finder pattern to be dark", i)
+		}
+	}
+}
+
+func TestAbsoluteLocation(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://example.com/a/b/_qr", nil)
+	req.URL.Path = "/a/b"
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{"https://example.org/x", "https://example.org/x"},
+		{"/root", "https://example.com/root"},
+		{"c", "https://example.com/a/c"},
+	}
+	for i, test := range tests {
+		if location := absoluteLocation(req, test.location); location != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, location)
+		}
+	}
+}
+
+func TestParseQR(t *testing.T) {
+	tests := []struct {
+		config    string
+		expected  QR
+		shouldErr bool
+	}{
+		{"qr", QR{Enable: true, Path: DefaultQRPath, Scale: DefaultQRScale, Format: DefaultQRFormat}, false},
+		{"qr {\npath /qr.png\nscale 4\nformat svg\n}", QR{Enable: true, Path: "/qr.png", Scale: 4, Format: "svg"}, false},
+		{"qr {\nscale 0\n}", QR{}, true},
+		{"qr {\nformat gif\n}", QR{}, true},
+		{"qr {\npath qr\n}", QR{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable host\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.QR != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.QR)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+)
+
+// qrCode is a QR code symbol encoding a string in byte mode
+// with the medium error correction level
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool
+}
+
+// qrBlocks describes the error correction blocks of a QR code version
+// with the medium error correction level. The group 2 blocks hold one
+// more data codeword than the group 1 blocks.
+type qrBlocks struct {
+	ecPerBlock int
+	group1     int
+	data1      int
+	group2     int
+}
+
+// qrVersions are the error correction blocks of versions 1 to 10,
+// which fit the targets up to 213 bytes long
+var qrVersions = []qrBlocks{
+	{10, 1, 16, 0},
+	{16, 1, 28, 0},
+	{26, 1, 44, 0},
+	{18, 2, 32, 0},
+	{24, 2, 43, 0},
+	{16, 4, 27, 0},
+	{18, 4, 31, 0},
+	{22, 2, 38, 2},
+	{22, 3, 36, 2},
+	{26, 4, 43, 1},
+}
+
+// qrAlignment are the alignment pattern coordinates of versions 1 to 10
+var qrAlignment = [][]int{
+	{}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// qrFormatM is the format information's error correction level bits
+const qrFormatM = 0
+
+func (b qrBlocks) dataCodewords() int {
+	return b.group1*b.data1 + b.group2*(b.data1+1)
+}
+
+// encodeQR returns the smallest QR code encoding the given text
+func encodeQR(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v <= len(qrVersions); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= qrVersions[v-1].dataCodewords()*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("the text is too long for a QR code, it has %d bytes", len(data))
+	}
+
+	q := &qrCode{size: version*4 + 17}
+	q.modules = make([][]bool, q.size)
+	q.function = make([][]bool, q.size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, q.size)
+		q.function[i] = make([]bool, q.size)
+	}
+	q.drawFunctionPatterns(version)
+	q.drawCodewords(qrCodewords(data, version))
+
+	// The mask with the lowest penalty is kept
+	best, lowest := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); lowest == -1 || penalty < lowest {
+			best, lowest = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+	return q, nil
+}
+
+// qrCodewords encodes the data in byte mode, pads it to the version's
+// capacity and interleaves the blocks with their error correction
+func qrCodewords(data []byte, version int) []byte {
+	blocks := qrVersions[version-1]
+	var bits []bool
+	appendBits := func(value, length int) {
+		for i := length - 1; i >= 0; i-- {
+			bits = append(bits, (value>>uint(i))&1 == 1)
+		}
+	}
+	appendBits(4, 4)
+	if version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+
+	capacity := blocks.dataCodewords() * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	appendBits(0, terminator)
+	appendBits(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		appendBits(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << uint(7-i%8)
+		}
+	}
+
+	divisor := qrDivisor(blocks.ecPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < blocks.group1+blocks.group2; i++ {
+		length := blocks.data1
+		if i >= blocks.group1 {
+			length++
+		}
+		block := codewords[:length]
+		codewords = codewords[length:]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, qrRemainder(block, divisor))
+	}
+
+	var result []byte
+	for i := 0; i <= blocks.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrMultiply multiplies two elements of GF(2^8) modulo x^8+x^4+x^3+x^2+1
+func qrMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrDivisor returns the Reed-Solomon generator polynomial of the given
+// degree, without its leading term, from the highest to lowest power
+func qrDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+// qrRemainder returns the Reed-Solomon error correction codewords of the data
+func qrRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawFunctionPatterns(version int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	q.drawFinder(3, 3)
+	q.drawFinder(q.size-4, 3)
+	q.drawFinder(3, q.size-4)
+
+	positions := qrAlignment[version-1]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			// The corners with the finder patterns are skipped
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(x+dx, y+dy, maxAbs(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format information's modules until the mask is chosen
+	q.drawFormatBits(0)
+	q.drawVersionBits(version)
+}
+
+func (q *qrCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			if x+dx < 0 || x+dx >= q.size || y+dy < 0 || y+dy >= q.size {
+				continue
+			}
+			distance := maxAbs(dx, dy)
+			q.set(x+dx, y+dy, distance != 2 && distance != 4)
+		}
+	}
+}
+
+// qrFormatBits returns the format information of the mask
+// with the medium error correction level
+func qrFormatBits(mask int) int {
+	data := qrFormatM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *qrCode) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool {
+		return (bits>>uint(i))&1 == 1
+	}
+
+	for i := 0; i < 6; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	// The dark module
+	q.set(8, q.size-8, true)
+}
+
+// qrVersionBits returns the version information of the versions from 7 up
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (q *qrCode) drawVersionBits(version int) {
+	if version < 7 {
+		return
+	}
+	bits := qrVersionBits(version)
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 == 1
+		a, b := q.size-11+i%3, i/3
+		q.set(a, b, dark)
+		q.set(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order, going up
+// and down the two module wide columns from the bottom right corner
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		// The vertical timing pattern is skipped
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if q.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+				q.modules[y][x] = (data[i>>3]>>uint(7-i&7))&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules matching the mask's pattern,
+// applying the same mask again removes it
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the patterns which make it harder to scan
+func (q *qrCode) penalty() int {
+	penalty := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return q.modules[x][y]
+		}
+		return q.modules[y][x]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < q.size; y++ {
+			run := 1
+			for x := 1; x < q.size; x++ {
+				if at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					if run == 5 {
+						penalty += 3
+					} else if run > 5 {
+						penalty++
+					}
+				} else {
+					run = 1
+				}
+			}
+
+			// Finder like patterns with four light modules on either side
+			for x := 0; x+len(finderLike) <= q.size; x++ {
+				matches := true
+				for i, dark := range finderLike {
+					if at(x+i, y, vertical) != dark {
+						matches = false
+						break
+					}
+				}
+				if !matches {
+					continue
+				}
+				if q.light(x-4, x, y, vertical) || q.light(x+len(finderLike), x+len(finderLike)+4, y, vertical) {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.modules[y][x] == q.modules[y][x-1] &&
+				q.modules[y][x] == q.modules[y-1][x] && q.modules[y][x] == q.modules[y-1][x-1] {
+				penalty += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	deviation := dark*20 - total*10
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	return penalty + deviation/total*10
+}
+
+// light checks if the modules from start to end are light,
+// the modules outside of the symbol are part of the quiet zone
+func (q *qrCode) light(start, end, y int, vertical bool) bool {
+	for x := start; x < end; x++ {
+		if x < 0 || x >= q.size {
+			continue
+		}
+		if vertical && q.modules[x][y] || !vertical && q.modules[y][x] {
+			return false
+		}
+	}
+	return true
+}
+
+func maxAbs(a, b int) int {
+	if a < 0 {
+		a = -a
+	}
+	if b < 0 {
+		b = -b
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
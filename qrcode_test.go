@@ -0,0 +1,91 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQRRemainder(t *testing.T) {
+	// The 1-M symbol of HELLO WORLD
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if ec := qrRemainder(data, qrDivisor(10)); !bytes.Equal(ec, expected) {
+		t.Errorf("Expected the error correction codewords %v, got %v", expected, ec)
+	}
+}
+
+func TestQRInformationBits(t *testing.T) {
+	if bits := qrFormatBits(5); bits != 0x40CE {
+		t.Errorf("Expected the format bits of M and mask 5 to be 100000011001110, got %015b", bits)
+	}
+	if bits := qrVersionBits(7); bits != 0x07C94 {
+		t.Errorf("Expected the version bits of version 7 to be 000111110010010100, got %018b", bits)
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	tests := []struct {
+		length  int
+		version int
+	}{
+		{0, 1},
+		{14, 1},
+		{15, 2},
+		{122, 7},
+		{213, 10},
+		{214, 0},
+	}
+	for i, test := range tests {
+		code, err := encodeQR(strings.Repeat("a", test.length))
+		if test.version == 0 {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %d bytes", i, test.length)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if code.size != test.version*4+17 {
+			t.Errorf("Test %d: Expected version %d, got the size %d", i, test.version, code.size)
+		}
+
+		// Both copies of the format information should be the same
+		var first, second int
+		for _, m := range []struct{ x, y int }{{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8}, {8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0}} {
+			first <<= 1
+			if code.modules[m.y][m.x] {
+				first |= 1
+			}
+		}
+		for j := 0; j < 15; j++ {
+			x, y := 8, code.size-1-j
+			if j >= 7 {
+				x, y = code.size-15+j, 8
+			}
+			second <<= 1
+			if code.modules[y][x] {
+				second |= 1
+			}
+		}
+		mask := (first ^ 0x5412) >> 10 & 7
+		if first != second || first != qrFormatBits(mask) {
+			t.Errorf("Test %d: Expected matching format information, got %015b and %015b", i, first, second)
+		}
+	}
+}
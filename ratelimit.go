@@ -0,0 +1,133 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// zoneBackoff keeps track of the zones which the resolver refused to
+// answer, so they don't get queried again until their backoff is over
+type zoneBackoff struct {
+	sync.Mutex
+	zones map[string]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	until    time.Time
+}
+
+// backoffError is returned for lookups skipped because of a zone's backoff
+type backoffError struct {
+	Zone      string
+	Remaining time.Duration
+}
+
+func (e *backoffError) Error() string {
+	return fmt.Sprintf("resolver is rate limiting %s, backing off for %s", e.Zone, e.Remaining.Round(time.Millisecond))
+}
+
+const (
+	DefaultRateLimitBackoff    = time.Second
+	DefaultRateLimitMaxBackoff = 5 * time.Minute
+	// maxBackoffZones limits the number of zones kept in backoff
+	maxBackoffZones = 10000
+)
+
+// rateLimitReason returns the reason if the given lookup error
+// looks like the resolver is rate limiting the queries
+func rateLimitReason(err error) (string, bool) {
+	if e, ok := err.(*rcodeError); ok {
+		switch e.Rcode {
+		case dns.RcodeRefused, dns.RcodeServerFailure:
+			return dns.RcodeToString[e.Rcode], true
+		}
+		return "", false
+	}
+	if isTimeout(err) {
+		// Resolvers drop the queries over their rate limit
+		return "timeout", true
+	}
+	return "", false
+}
+
+// remaining returns how long the given zone is still backing off
+func (b *zoneBackoff) remaining(zone string) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	state, ok := b.zones[zone]
+	if !ok {
+		return 0
+	}
+	return time.Until(state.until)
+}
+
+// fail puts the given zone in backoff. The backoff grows exponentially
+// with the consecutive failures and gets a random jitter, so the zones
+// don't hit the resolver again at the same time.
+func (b *zoneBackoff) fail(zone string, base, max time.Duration) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	state, ok := b.zones[zone]
+	if !ok {
+		if len(b.zones) >= maxBackoffZones {
+			b.prune()
+		}
+		if len(b.zones) >= maxBackoffZones {
+			return 0
+		}
+		state = &backoffState{}
+		b.zones[zone] = state
+	}
+	state.failures++
+
+	backoff := max
+	if shift := uint(state.failures - 1); shift < 32 && base<<shift < max {
+		backoff = base << shift
+	}
+	// Equal jitter keeps at least half of the backoff
+	backoff = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	state.until = time.Now().Add(backoff)
+	return backoff
+}
+
+// reset removes the given zone's backoff after a successful lookup
+func (b *zoneBackoff) reset(zone string) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	delete(b.zones, zone)
+}
+
+// prune removes the zones whose backoff is over. It should
+// be called while holding the lock.
+func (b *zoneBackoff) prune() {
+	for zone, state := range b.zones {
+		if time.Now().After(state.until) {
+			delete(b.zones, zone)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimitBackoff(t *testing.T) {
+	var queries int32
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		atomic.StoreInt32(&queries, n)
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Rcode = dns.RcodeRefused
+		w.WriteMsg(r)
+	})
+	defer stop()
+
+	c := Config{
+		Resolver: addr,
+		DNS: DNS{
+			Enable:           true,
+			Timeout:          time.Second,
+			RateLimitBackoff: time.Minute,
+		},
+	}
+	c.DNS.SetDefaults()
+	c.RecordCache.Enable = true
+	c.RecordCache.SetDefaults()
+
+	if _, _, err := c.DNS.lookup(context.Background(), "_redirect.refused.test.", c); err == nil {
+		t.Fatalf("Expected the refused lookup to fail")
+	}
+	_, _, err := c.DNS.lookup(context.Background(), "_redirect.refused.test.", c)
+	if _, ok := err.(*backoffError); !ok {
+		t.Errorf("Expected the zone to be backing off, got %v", err)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected the resolver to be queried once, got %d queries", n)
+	}
+
+	// Other zones aren't affected by the backoff
+	c.DNS.lookup(context.Background(), "_redirect.other.test.", c)
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("Expected the resolver to be queried for other zones, got %d queries", n)
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(r)
+	})
+	defer stop()
+
+	tests := []struct {
+		serveStale time.Duration
+		expiredFor time.Duration
+		shouldErr  bool
+	}{
+		{time.Hour, time.Minute, false},
+		{time.Hour, 2 * time.Hour, true},
+		{0, time.Minute, true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver: addr,
+			DNS:      DNS{Enable: true, Timeout: time.Second},
+			RecordCache: RecordCache{
+				Enable:     true,
+				ServeStale: test.serveStale,
+			},
+		}
+		c.DNS.SetDefaults()
+		c.RecordCache.SetDefaults()
+		c.RecordCache.Set("_redirect.stale.test.", []string{"v=txtv0;to=https://stale.test"}, time.Minute)
+		entry := c.RecordCache.store.entries["_redirect.stale.test."].Value.(*cacheEntry)
+		entry.expires = time.Now().Add(-test.expiredFor)
+
+		txts, err := query("stale.test", context.Background(), c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %v", i, txts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if len(txts) != 1 || txts[0] != "v=txtv0;to=https://stale.test" {
+			t.Errorf("Test %d: Expected the stale record, got %v", i, txts)
+		}
+	}
+}
+
+func TestZoneBackoff_fail(t *testing.T) {
+	b := zoneBackoff{zones: make(map[string]*backoffState)}
+	tests := []struct {
+		min time.Duration
+		max time.Duration
+	}{
+		{500 * time.Millisecond, time.Second},
+		{time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+	}
+	for i, test := range tests {
+		backoff := b.fail("_redirect.example.com.", time.Second, 4*time.Second)
+		if backoff < test.min || backoff > test.max {
+			t.Errorf("Test %d: Expected the backoff to be between %s and %s, got %s", i, test.min, test.max, backoff)
+		}
+	}
+	b.reset("_redirect.example.com.")
+	if remaining := b.remaining("_redirect.example.com."); remaining != 0 {
+		t.Errorf("Expected the backoff to be reset, got %s", remaining)
+	}
+}
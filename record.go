@@ -18,61 +18,262 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
 type record struct {
-	Version string
-	To      string
-	Code    int
-	Type    string
-	Vcs     string
-	Website string
-	From    string
-	Root    string
-	Re      string
+	Version  string
+	To       string
+	Targets  []string
+	Code     int
+	Fallback []string
+	Type     string
+	Vcs      string
+	Website  string
+	// Docs is the documentation of the gometa records' modules,
+	// the browsers are redirected to it
+	Docs string
+	From string
+	Root string
+	Re   string
+	HSTS string
+	// Source, SourceDir and SourceFile form the go-source meta tag
+	Source     string
+	SourceDir  string
+	SourceFile string
+	// Headers are added to the responses using the record
+	Headers http.Header
+	// Query is added to the redirect targets, QueryOverride
+	// replaces the targets' parameters of the same names
+	Query         url.Values
+	QueryOverride bool
+	// NoIndex asks the search engines not to index the redirects,
+	// so the targets don't show up under the vanity URLs
+	NoIndex bool
+	// PreserveMethod overrides the preserve_method option for the
+	// record, nil uses the option
+	PreserveMethod *bool
+	// HTTPSOnly overrides the https_only option for the
+	// record, nil uses the option
+	HTTPSOnly *bool
+	// If and Unless are the conditions of using the record's targets,
+	// the requests not meeting them get redirected to its fallback=
+	If     []condition
+	Unless []condition
+	// Mirrors are the download mirrors of the mirror records
+	Mirrors []mirror
+	// Hashes and Size describe the file served by the mirrors
+	Hashes []fileHash
+	Size   int64
+	// Variants are the weighted targets of the records with several
+	// to= fields, Sticky keeps the clients on the variant they got
+	Variants []variant
+	Sticky   bool
+	// Maintenance serves the maintenance page instead of redirecting,
+	// it's set by status=maintenance or code=503 fields
+	Maintenance bool
+	// Parts is the number of TXT records the record is split into,
+	// the rest of them live at _redirect._1.<host>, _redirect._2.<host>
+	Parts int
+
+	// delegatedHost is the host whose zone holds the record
+	// when it was found by following dns records
+	delegatedHost string
 }
 
 // getRecord uses the given host to find a TXT record
 // and then parses the txt record and returns a TXTDirect record
 // struct instance. It returns an error when it can't find any txt
-// records or if the TXT record is not standard.
+// records or if the TXT record is not standard. The failures of all
+// of the tried zones are returned together as lookupErrors.
 func getRecord(host string, ctx context.Context, c Config, r *http.Request) (record, error) {
-	txts, err := query(host, ctx, c)
-	if err != nil {
-		log.Printf("Initial DNS query failed: %s", err)
+	requested := host
+	host = canonicalHost(host)
+	info := getRequestInfo(ctx)
+	var failures lookupErrors
+	// failed keeps the zone's failure if it has no usable record
+	failed := func(zone string, txts []string, err error) bool {
+		if err == nil && txts[0] == "" {
+			err = fmt.Errorf("empty TXT record")
+		}
+		if err != nil {
+			failures.add(zone, err)
+			return true
+		}
+		return false
 	}
-	// if error present or record empty, jump into wildcards
-	if err != nil || txts[0] == "" {
-		hostSlice := strings.Split(host, ".")
-		hostSlice[0] = "_"
-		host = strings.Join(hostSlice, ".")
+
+	var txts []string
+	var err error
+	zone := host
+	// The records of a nonstandard port take precedence over the
+	// host's ones, the missing ones aren't lookup failures
+	if port := portZone(requested); c.PortZones && port != "" {
+		if portTxts, portErr := query(port, ctx, c); portErr == nil && portTxts[0] != "" {
+			zone, txts = port, portTxts
+		}
+	}
+	portRecord := zone != host
+	if !portRecord {
 		txts, err = query(host, ctx, c)
-		if err != nil {
-			log.Printf("Wildcard DNS query failed: %s", err.Error())
-			return record{}, err
+	}
+	// The rest of the zones aren't tried for the clients which hung up
+	if err != nil && ctx.Err() == context.Canceled {
+		return record{}, ctx.Err()
+	}
+	// if error present or record empty, try the names
+	// DNS providers may have given the apex's record
+	if failed(host, txts, err) {
+		for _, fallback := range apexFallbackZones(host, c.ApexFallback) {
+			fallbackTxts, fallbackErr := query(fallback, ctx, c)
+			if !failed(fallback, fallbackTxts, fallbackErr) {
+				zone, txts, err = fallback, fallbackTxts, nil
+				break
+			}
+		}
+	}
+	// if the record is missing or empty, jump into wildcards and walk
+	// up the domain tree until one of them matches. The other failures
+	// stop the walk, a broader wildcard can't stand in for a zone
+	// which the resolver couldn't answer for.
+	if err != nil || txts[0] == "" {
+		if err == nil || isNotFound(err) {
+			for _, wildcard := range wildcardZones(host) {
+				zone = wildcard
+				txts, err = query(zone, ctx, c)
+				if !failed(zone, txts, err) || (err != nil && !isNotFound(err)) {
+					break
+				}
+			}
+		}
+		if err != nil || txts[0] == "" {
+			info.Errors = failures
+			log.Printf("[txtdirect]: Couldn't find a record for %s: %s", host, failures.Error())
+			return record{}, failures
 		}
 	}
 
 	if len(txts) != 1 {
-		return record{}, fmt.Errorf("could not parse TXT record with %d records", len(txts))
+		err = fmt.Errorf("could not parse TXT record with %d records", len(txts))
+		c.Status.track(host, record{}, err)
+		if c.Admin.Enable {
+			c.Admin.recordError(recordZone(zone), err)
+		}
+		failures.add(zone, err)
+		info.Errors = failures
+		return record{}, failures
+	}
+
+	if txts[0], err = joinParts(zone, txts[0], ctx, c); err != nil {
+		c.Status.track(host, record{}, err)
+		if c.Admin.Enable {
+			c.Admin.recordError(recordZone(zone), err)
+		}
+		failures.add(zone, err)
+		info.Errors = failures
+		log.Printf("[txtdirect]: Couldn't use the record for %s: %s", host, failures.Error())
+		return record{}, failures
 	}
+	txts[0] = c.Defaults.merge(host, txts[0])
 
+	info.Records = append(info.Records, usedRecord{Zone: recordZone(zone), TXT: txts[0]})
 	rec := record{}
 	if err = rec.Parse(txts[0], r, c); err != nil {
-		return rec, fmt.Errorf("could not parse record: %s", err)
+		err = fmt.Errorf("could not parse record: %s", err)
+		c.Status.track(host, record{}, err)
+		if c.Admin.Enable {
+			c.Admin.recordError(recordZone(zone), err)
+		}
+		failures.add(zone, err)
+		info.Errors = failures
+		log.Printf("[txtdirect]: Couldn't use the record for %s: %s", host, failures.Error())
+		return rec, failures
 	}
 
+	if rec.Type == "dns" {
+		if rec, zone, err = delegate(rec, zone, ctx, c, r); err != nil {
+			c.Status.track(host, record{}, err)
+			if c.Admin.Enable {
+				c.Admin.recordError(recordZone(zone), err)
+			}
+			failures.add(zone, err)
+			info.Errors = failures
+			log.Printf("[txtdirect]: Couldn't use the record for %s: %s", host, failures.Error())
+			return record{}, failures
+		}
+	}
+
+	// The paths of the port's records are looked up under its zone
+	if portRecord && rec.delegatedHost == "" {
+		rec.delegatedHost = zone
+	}
+
+	c.Status.track(host, rec, nil)
+	info.setRecord(recordZone(zone), rec.Type)
 	return rec, nil
 }
 
+// DefaultApexFallback are the names DNS providers commonly give the apex's
+// record: a literal @ label, or the zone appended twice when the record's
+// name was entered as a FQDN without the trailing dot. The system resolver
+// refuses names with an @ label, so those need the record cache or DoH.
+var DefaultApexFallback = []string{"_redirect.@.{host}", "_redirect.{host}.{host}"}
+
+// apexFallbackZones fills the host into the apex fallback templates
+func apexFallbackZones(host string, templates []string) []string {
+	host = canonicalHost(host)
+	zones := make([]string, 0, len(templates))
+	for _, template := range templates {
+		zones = append(zones, strings.Replace(template, "{host}", host, -1))
+	}
+	return zones
+}
+
+// portZone returns the zone holding the records of the given host's
+// nonstandard port, e.g. _port8080.example.com for example.com:8080.
+// The default http and https ports don't have zones of their own.
+func portZone(host string) string {
+	hostname, port := splitHostPort(host)
+	if port == "" || port == "80" || port == "443" {
+		return ""
+	}
+	return "_port" + port + "." + canonicalHost(hostname)
+}
+
+// wildcardZones returns the wildcard zones which can cover the given host,
+// from the most specific to the least specific one. For a.b.example.com
+// they're _.b.example.com and _.example.com.
+func wildcardZones(host string) []string {
+	labels := strings.Split(host, ".")
+	var zones []string
+	for i := 1; i < len(labels); i++ {
+		// Only the first wildcard may sit right under the TLD
+		if i > 1 && len(labels)-i < 2 {
+			break
+		}
+		zones = append(zones, strings.Join(append([]string{"_"}, labels[i:]...), "."))
+	}
+	return zones
+}
+
 // Parse takes a string containing the DNS TXT record and returns
 // a TXTDirect record struct instance.
 // It will return an error if the DNS TXT record is not standard or
 // if the record type is not enabled in the TXTDirect's config.
-func (r *record) Parse(str string, req *http.Request, c Config) error {
-	s := strings.Split(str, ";")
+func (r *record) Parse(str string, req *http.Request, c Config) (err error) {
+	if req != nil {
+		_, span := startSpan(req.Context(), "txtdirect.parse", spanKindInternal)
+		defer func() {
+			span.setAttribute("txtdirect.type", r.Type)
+			span.finish(err)
+		}()
+	}
+	s, err := splitRecordFields(str)
+	if err != nil {
+		return err
+	}
 	for _, l := range s {
 		switch {
 		case strings.HasPrefix(l, "code="):
@@ -83,6 +284,22 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 			}
 			r.Code = i
 
+		case strings.HasPrefix(l, "docs="):
+			l = strings.TrimPrefix(l, "docs=")
+			l, err := parsePlaceholders(l, req, []string{})
+			if err != nil {
+				return err
+			}
+			r.Docs = l
+
+		case strings.HasPrefix(l, "fallback="):
+			l = strings.TrimPrefix(l, "fallback=")
+			fallbacks, err := parseTargets(l, req)
+			if err != nil {
+				return err
+			}
+			r.Fallback = fallbacks
+
 		case strings.HasPrefix(l, "from="):
 			l = strings.TrimPrefix(l, "from=")
 			l, err := parsePlaceholders(l, req, []string{})
@@ -91,21 +308,178 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 			}
 			r.From = l
 
+		case strings.HasPrefix(l, headerPrefix):
+			name, value, err := parseHeader(l)
+			if err != nil {
+				return err
+			}
+			if r.Headers == nil {
+				r.Headers = make(http.Header)
+			}
+			r.Headers.Add(name, value)
+
+		case strings.HasPrefix(l, queryPrefix):
+			name, value, err := parseQueryParam(l, req)
+			if err != nil {
+				return err
+			}
+			if r.Query == nil {
+				r.Query = make(url.Values)
+			}
+			r.Query.Add(name, value)
+
+		case strings.HasPrefix(l, "query_override="):
+			l = strings.TrimPrefix(l, "query_override=")
+			override, err := strconv.ParseBool(l)
+			if err != nil {
+				return fmt.Errorf("could not parse query_override: %s", l)
+			}
+			r.QueryOverride = override
+
+		case strings.HasPrefix(l, "referrer="):
+			policy, err := parseReferrerPolicy(strings.TrimPrefix(l, "referrer="))
+			if err != nil {
+				return err
+			}
+			if r.Headers == nil {
+				r.Headers = make(http.Header)
+			}
+			r.Headers.Set("Referrer-Policy", policy)
+
+		case strings.HasPrefix(l, "hsts="):
+			l = strings.TrimPrefix(l, "hsts=")
+			hsts, err := parseHSTS(l)
+			if err != nil {
+				return err
+			}
+			r.HSTS = hsts
+
+		case strings.HasPrefix(l, "if="):
+			l = strings.TrimPrefix(l, "if=")
+			cond, err := parseCondition(l)
+			if err != nil {
+				return err
+			}
+			r.If = append(r.If, cond)
+
+		case strings.HasPrefix(l, "unless="):
+			l = strings.TrimPrefix(l, "unless=")
+			cond, err := parseCondition(l)
+			if err != nil {
+				return err
+			}
+			r.Unless = append(r.Unless, cond)
+
+		case strings.HasPrefix(l, "hash="):
+			l = strings.TrimPrefix(l, "hash=")
+			h, err := parseHash(l)
+			if err != nil {
+				return err
+			}
+			r.Hashes = append(r.Hashes, h)
+
+		case strings.HasPrefix(l, "mirror="):
+			l = strings.TrimPrefix(l, "mirror=")
+			m, err := parseMirror(l, req)
+			if err != nil {
+				return err
+			}
+			r.Mirrors = append(r.Mirrors, m)
+
+		case strings.HasPrefix(l, "noindex="):
+			l = strings.TrimPrefix(l, "noindex=")
+			noindex, err := strconv.ParseBool(l)
+			if err != nil {
+				return fmt.Errorf("could not parse noindex: %s", l)
+			}
+			r.NoIndex = noindex
+
+		case strings.HasPrefix(l, "https_only="):
+			l = strings.TrimPrefix(l, "https_only=")
+			httpsOnly, err := strconv.ParseBool(l)
+			if err != nil {
+				return fmt.Errorf("could not parse https_only: %s", l)
+			}
+			r.HTTPSOnly = &httpsOnly
+
+		case strings.HasPrefix(l, "parts="):
+			parts, err := parseParts(strings.TrimPrefix(l, "parts="))
+			if err != nil {
+				return err
+			}
+			r.Parts = parts
+
+		case strings.HasPrefix(l, "preserve_method="):
+			l = strings.TrimPrefix(l, "preserve_method=")
+			preserve, err := strconv.ParseBool(l)
+			if err != nil {
+				return fmt.Errorf("could not parse preserve_method: %s", l)
+			}
+			r.PreserveMethod = &preserve
+
 		case strings.HasPrefix(l, "re="):
 			l = strings.TrimPrefix(l, "re=")
+			if _, err := compileRegex(l); err != nil {
+				return err
+			}
 			r.Re = l
 
 		case strings.HasPrefix(l, "root="):
 			l = strings.TrimPrefix(l, "root=")
 			r.Root = l
 
+		case strings.HasPrefix(l, "size="):
+			l = strings.TrimPrefix(l, "size=")
+			size, err := strconv.ParseInt(l, 10, 64)
+			if err != nil || size < 0 {
+				return fmt.Errorf("could not parse the file size: %s", l)
+			}
+			r.Size = size
+
+		case strings.HasPrefix(l, "source="):
+			l = strings.TrimPrefix(l, "source=")
+			r.Source = l
+
+		case strings.HasPrefix(l, "sourcedir="):
+			l = strings.TrimPrefix(l, "sourcedir=")
+			r.SourceDir = l
+
+		case strings.HasPrefix(l, "sourcefile="):
+			l = strings.TrimPrefix(l, "sourcefile=")
+			r.SourceFile = l
+
+		case strings.HasPrefix(l, "status="):
+			l = strings.TrimPrefix(l, "status=")
+			if l != "maintenance" {
+				return fmt.Errorf("could not parse status: %s", l)
+			}
+			r.Maintenance = true
+
+		case strings.HasPrefix(l, "sticky="):
+			l = strings.TrimPrefix(l, "sticky=")
+			sticky, err := strconv.ParseBool(l)
+			if err != nil {
+				return fmt.Errorf("could not parse sticky: %s", l)
+			}
+			r.Sticky = sticky
+
 		case strings.HasPrefix(l, "to="):
 			l = strings.TrimPrefix(l, "to=")
-			l, err := parsePlaceholders(l, req, []string{})
+			raw, weight, err := parseVariant(l)
+			if err != nil {
+				return err
+			}
+			// Multiple comma separated targets form a fallback chain
+			targets, err := parseTargets(raw, req)
 			if err != nil {
 				return err
 			}
-			r.To = l
+			r.Variants = append(r.Variants, variant{Targets: targets, Raw: raw, Weight: weight})
+			r.Targets = targets
+			r.To = ""
+			if len(r.Targets) > 0 {
+				r.To = r.Targets[0]
+			}
 
 		case strings.HasPrefix(l, "type="):
 			l = strings.TrimPrefix(l, "type=")
@@ -114,13 +488,23 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 		case strings.HasPrefix(l, "v="):
 			l = strings.TrimPrefix(l, "v=")
 			r.Version = l
-			if r.Version != "txtv0" {
+			switch r.Version {
+			case "txtv0":
+				log.Print("WARN: txtv0 is not suitable for production")
+			case strictVersion:
+				// Only the records starting with the version are split strictly
+				if s[0] != "v="+strictVersion {
+					return fmt.Errorf("%s records should start with v=%s", strictVersion, strictVersion)
+				}
+			default:
 				return fmt.Errorf("unhandled version '%s'", r.Version)
 			}
-			log.Print("WARN: txtv0 is not suitable for production")
 
 		case strings.HasPrefix(l, "vcs="):
 			l = strings.TrimPrefix(l, "vcs=")
+			if !contains(gometaVCS, l) {
+				return fmt.Errorf("unsupported vcs %s, it should be one of %s", l, strings.Join(gometaVCS, ", "))
+			}
 			r.Vcs = l
 
 		case strings.HasPrefix(l, "website="):
@@ -128,23 +512,52 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 			r.Website = l
 
 		default:
+			if r.Version == strictVersion {
+				key := strings.SplitN(l, "=", 2)[0]
+				log.Printf("[txtdirect]: WARN: ignoring the unknown %s= field of the %s record", key, strictVersion)
+				continue
+			}
 			tuple := strings.Split(l, "=")
 			if len(tuple) != 2 {
 				return fmt.Errorf("arbitrary data not allowed")
 			}
 			continue
 		}
-		if len(l) > 255 {
-			return fmt.Errorf("TXT record cannot exceed the maximum of 255 characters")
+		if len(l) > maxFieldLength {
+			return fmt.Errorf("record fields cannot exceed the maximum of %d characters", maxFieldLength)
 		}
 		if r.Type == "dockerv2" && r.To == "" {
 			return fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type")
 		}
 	}
 
-	if r.Code == 0 {
+	// A single to= field isn't picked from
+	if len(r.Variants) < 2 {
+		r.Variants = nil
+	} else if totalWeight(r.Variants) == 0 {
+		return fmt.Errorf("at least one of the targets should have a weight")
+	}
+
+	if r.Type == "mirror" && len(r.Mirrors) == 0 {
+		return fmt.Errorf("mirror records should list at least one mirror= field")
+	}
+	if r.Type == "qr" && r.To == "" {
+		return fmt.Errorf("qr records should have a to= field")
+	}
+	if r.Type == "dns" && (r.To == "" || strings.Contains(r.To, "/")) {
+		return fmt.Errorf("dns records should have the host they delegate to in their to= field")
+	}
+
+	// Sinkhole records fall back to the configured code
+	if r.Code == 0 && r.Type != "sinkhole" {
 		r.Code = http.StatusFound
 	}
+	if r.Code == http.StatusServiceUnavailable && r.Type != "sinkhole" {
+		r.Maintenance = true
+	}
+	if r.Type != "sinkhole" && !r.Maintenance && !validRedirectCode(r.Code) {
+		return fmt.Errorf("%d is not a redirect status code", r.Code)
+	}
 
 	if r.Type == "" {
 		r.Type = "host"
@@ -156,3 +569,18 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 
 	return nil
 }
+
+// parseTargets splits the field's comma separated targets before filling
+// their placeholders, so the commas in the placeholders' values can't
+// add targets to the chain
+func parseTargets(field string, req *http.Request) ([]string, error) {
+	var targets []string
+	for _, target := range splitTargets(field) {
+		target, err := parsePlaceholders(target, req, []string{})
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package record builds, serializes and validates the _redirect TXT
+// records of TXTDirect, so the tools managing the DNS zones can
+// generate the same records the server parses.
+package record
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// V0 records are split on ; and can't have it in their values
+	V0 = "txtv0"
+	// V1 records escape the ; = and % characters of their values
+	V1 = "txtv1"
+)
+
+// Types are the record types served by TXTDirect
+var Types = []string{"host", "path", "gometa", "www", "proxy", "dockerv2", "gomods", "tor", "mirror", "qr", "dns", "sinkhole", "honeypot"}
+
+// VCS are the version control systems of the gometa records
+var VCS = []string{"git", "hg", "svn", "bzr", "fossil"}
+
+// ReferrerPolicies are the values of the referrer= field
+var ReferrerPolicies = []string{
+	"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+	"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url",
+}
+
+const (
+	// MaxFieldLength limits the length of a record's fields
+	MaxFieldLength = 2048
+	// MaxParts limits the number of TXT records a record is split into
+	MaxParts = 10
+)
+
+// redirectCodes are the status codes the records may redirect with
+var redirectCodes = []int{
+	http.StatusMultipleChoices,
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// reservedHeaders can't be set by the records
+var reservedHeaders = []string{"Location", "Status-Code", "Content-Length", "Transfer-Encoding", "Connection"}
+
+// headerNameRegex matches the valid HTTP header names
+var headerNameRegex = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// escapeValue escapes the characters of the V1 records' values
+var escapeValue = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D").Replace
+
+// Record is a _redirect TXT record. The empty fields are left out of
+// the serialized record, so the server uses their defaults. The JSON
+// keys of its fields are named after the record's fields.
+type Record struct {
+	// Version is V1 when it's empty
+	Version string `json:"version,omitempty"`
+	// Type is host when it's empty
+	Type string `json:"type,omitempty"`
+	// To are the record's targets, a record with several of them picks
+	// one by their weights, see Weighted. A target may be a comma
+	// separated fallback chain.
+	To   []string `json:"to,omitempty"`
+	Code int      `json:"code,omitempty"`
+	// Fallback is used when the record's targets can't be used
+	Fallback string `json:"fallback,omitempty"`
+	Website  string `json:"website,omitempty"`
+	Docs     string `json:"docs,omitempty"`
+	From     string `json:"from,omitempty"`
+	Root     string `json:"root,omitempty"`
+	Re       string `json:"re,omitempty"`
+	// HSTS is the max-age of the Strict-Transport-Security header,
+	// followed by the includeSubDomains and preload flags, e.g. 300,preload
+	HSTS string `json:"hsts,omitempty"`
+	// Vcs, Source, SourceDir and SourceFile form the gometa records' meta tags
+	Vcs        string `json:"vcs,omitempty"`
+	Source     string `json:"source,omitempty"`
+	SourceDir  string `json:"sourcedir,omitempty"`
+	SourceFile string `json:"sourcefile,omitempty"`
+	Referrer   string `json:"referrer,omitempty"`
+	// If and Unless are the conditions of using the targets
+	If     []string `json:"if,omitempty"`
+	Unless []string `json:"unless,omitempty"`
+	// Mirrors and Hashes are the mirror= and hash= fields of the mirror records
+	Mirrors []string `json:"mirror,omitempty"`
+	Hashes  []string `json:"hash,omitempty"`
+	Size    int64    `json:"size,omitempty"`
+	// Headers are added to the responses, Query to the targets
+	Headers       http.Header `json:"headers,omitempty"`
+	Query         url.Values  `json:"query,omitempty"`
+	QueryOverride bool        `json:"query_override,omitempty"`
+	NoIndex       bool        `json:"noindex,omitempty"`
+	Sticky        bool        `json:"sticky,omitempty"`
+	// Maintenance serves the maintenance page instead of redirecting
+	Maintenance bool `json:"maintenance,omitempty"`
+	// PreserveMethod and HTTPSOnly override the server's options when they're set
+	PreserveMethod *bool `json:"preserve_method,omitempty"`
+	HTTPSOnly      *bool `json:"https_only,omitempty"`
+	// Parts is the number of TXT records the record is split into
+	Parts int `json:"parts,omitempty"`
+}
+
+// Field is a key=value field of a record
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Zone returns the name of the given host's record
+func Zone(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if !strings.HasPrefix(host, "_redirect.") {
+		host = "_redirect." + host
+	}
+	return host + "."
+}
+
+// Weighted returns the value of a to= field with the given weight
+func Weighted(target string, weight int) string {
+	return target + " weight=" + strconv.Itoa(weight)
+}
+
+// Bool returns a pointer to the given value, for the optional fields
+func Bool(value bool) *bool {
+	return &value
+}
+
+// Fields returns the record's fields in the order they're serialized
+func (r Record) Fields() []Field {
+	fields := []Field{{"v", r.version()}}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, Field{key, value})
+		}
+	}
+	addBool := func(key string, value bool) {
+		if value {
+			add(key, "true")
+		}
+	}
+
+	add("type", r.Type)
+	for _, to := range r.To {
+		fields = append(fields, Field{"to", to})
+	}
+	if r.Code != 0 {
+		add("code", strconv.Itoa(r.Code))
+	}
+	add("fallback", r.Fallback)
+	add("website", r.Website)
+	add("docs", r.Docs)
+	add("from", r.From)
+	add("root", r.Root)
+	add("re", r.Re)
+	add("vcs", r.Vcs)
+	add("source", r.Source)
+	add("sourcedir", r.SourceDir)
+	add("sourcefile", r.SourceFile)
+	for _, cond := range r.If {
+		fields = append(fields, Field{"if", cond})
+	}
+	for _, cond := range r.Unless {
+		fields = append(fields, Field{"unless", cond})
+	}
+	for _, mirror := range r.Mirrors {
+		fields = append(fields, Field{"mirror", mirror})
+	}
+	for _, hash := range r.Hashes {
+		fields = append(fields, Field{"hash", hash})
+	}
+	if r.Size != 0 {
+		add("size", strconv.FormatInt(r.Size, 10))
+	}
+	add("hsts", r.HSTS)
+	add("referrer", r.Referrer)
+	for _, name := range sortedKeys(r.Headers) {
+		for _, value := range r.Headers[name] {
+			fields = append(fields, Field{"header-" + name, value})
+		}
+	}
+	for _, name := range sortedKeys(r.Query) {
+		for _, value := range r.Query[name] {
+			fields = append(fields, Field{"query-" + name, value})
+		}
+	}
+	addBool("query_override", r.QueryOverride)
+	addBool("noindex", r.NoIndex)
+	addBool("sticky", r.Sticky)
+	if r.Maintenance {
+		add("status", "maintenance")
+	}
+	if r.PreserveMethod != nil {
+		add("preserve_method", strconv.FormatBool(*r.PreserveMethod))
+	}
+	if r.HTTPSOnly != nil {
+		add("https_only", strconv.FormatBool(*r.HTTPSOnly))
+	}
+	if r.Parts != 0 {
+		add("parts", strconv.Itoa(r.Parts))
+	}
+	return fields
+}
+
+// String serializes the record into the TXT record's content.
+// Validate should be used to make sure the server can parse it.
+func (r Record) String() string {
+	fields := r.Fields()
+	serialized := make([]string, len(fields))
+	for i, field := range fields {
+		value := field.Value
+		if r.version() == V1 {
+			value = escapeValue(value)
+		}
+		serialized[i] = field.Key + "=" + value
+	}
+	return strings.Join(serialized, ";")
+}
+
+// Validate checks the record is parsed by the server the way it's built
+func (r Record) Validate() error {
+	version := r.version()
+	if version != V0 && version != V1 {
+		return fmt.Errorf("unhandled version '%s'", version)
+	}
+	if r.Type != "" && !contains(Types, r.Type) {
+		return fmt.Errorf("unknown record type %s, it should be one of %s", r.Type, strings.Join(Types, ", "))
+	}
+
+	for _, field := range r.Fields() {
+		if len(field.Value) > MaxFieldLength {
+			return fmt.Errorf("%s= field cannot exceed the maximum of %d characters", field.Key, MaxFieldLength)
+		}
+		if version == V0 && strings.Contains(field.Value, ";") {
+			return fmt.Errorf("%s= field of the %s records can't contain ;, use %s instead", field.Key, V0, V1)
+		}
+		if field.Value == "" {
+			return fmt.Errorf("%s= field is empty", field.Key)
+		}
+	}
+
+	if err := r.validateTargets(); err != nil {
+		return err
+	}
+	if r.Type != "sinkhole" && r.Code != 0 && r.Code != http.StatusServiceUnavailable && !containsInt(redirectCodes, r.Code) {
+		return fmt.Errorf("%d is not a redirect status code", r.Code)
+	}
+	if r.Re != "" {
+		if _, err := regexp.Compile(r.Re); err != nil {
+			return fmt.Errorf("could not compile re: %s", err)
+		}
+	}
+	if r.Vcs != "" && !contains(VCS, r.Vcs) {
+		return fmt.Errorf("unsupported vcs %s, it should be one of %s", r.Vcs, strings.Join(VCS, ", "))
+	}
+	if r.Referrer != "" && !contains(ReferrerPolicies, strings.ToLower(r.Referrer)) {
+		return fmt.Errorf("unknown referrer policy %s, it should be one of %s", r.Referrer, strings.Join(ReferrerPolicies, ", "))
+	}
+	if r.HSTS != "" {
+		maxAge, err := strconv.Atoi(strings.TrimSpace(strings.Split(r.HSTS, ",")[0]))
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("hsts= field should start with the max-age in seconds: %s", r.HSTS)
+		}
+	}
+	for name, values := range r.Headers {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if contains(reservedHeaders, http.CanonicalHeaderKey(name)) {
+			return fmt.Errorf("%s header can't be set by the record", http.CanonicalHeaderKey(name))
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return fmt.Errorf("invalid value for %s header", name)
+			}
+		}
+	}
+	for name := range r.Query {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid query parameter name %q", name)
+		}
+	}
+	if r.Size < 0 {
+		return fmt.Errorf("size= field can't be negative")
+	}
+	if r.Parts < 0 || r.Parts > MaxParts {
+		return fmt.Errorf("parts= field should be between 1 and %d", MaxParts)
+	}
+	return nil
+}
+
+// validateTargets checks the targets the record's type needs
+func (r Record) validateTargets() error {
+	var totalWeight int
+	for _, to := range r.To {
+		parts := strings.Fields(to)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "weight=") {
+			totalWeight++
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimPrefix(parts[1], "weight="))
+		if err != nil || weight < 0 {
+			return fmt.Errorf("target weight should be a number: %s", parts[1])
+		}
+		totalWeight += weight
+	}
+	if len(r.To) > 1 && totalWeight == 0 {
+		return fmt.Errorf("at least one of the targets should have a weight")
+	}
+
+	switch r.Type {
+	case "mirror":
+		if len(r.Mirrors) == 0 {
+			return fmt.Errorf("mirror records should list at least one mirror")
+		}
+	case "qr", "dockerv2":
+		if len(r.To) == 0 {
+			return fmt.Errorf("%s records should have a target", r.Type)
+		}
+	case "dns":
+		if len(r.To) == 0 || strings.Contains(r.To[0], "/") {
+			return fmt.Errorf("dns records should have the host they delegate to as their target")
+		}
+	}
+	return nil
+}
+
+func (r Record) version() string {
+	if r.Version == "" {
+		return V1
+	}
+	return r.Version
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
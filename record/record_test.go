@@ -0,0 +1,119 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package record
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRecordString(t *testing.T) {
+	tests := []struct {
+		record   Record
+		expected string
+	}{
+		{Record{To: []string{"https://example.com"}}, "v=txtv1;to=https://example.com"},
+		{
+			Record{Version: V0, Type: "path", To: []string{"https://example.com/?a=b"}, Code: 301},
+			"v=txtv0;type=path;to=https://example.com/?a=b;code=301",
+		},
+		{
+			Record{Type: "host", To: []string{"https://example.com/?a=b;c", "https://example.org"}},
+			"v=txtv1;type=host;to=https://example.com/?a%3Db%3Bc;to=https://example.org",
+		},
+		{
+			Record{To: []string{Weighted("https://a.example.com", 3), Weighted("https://b.example.com", 1)}, Sticky: true},
+			"v=txtv1;to=https://a.example.com weight%3D3;to=https://b.example.com weight%3D1;sticky=true",
+		},
+		{
+			Record{Type: "gometa", To: []string{"https://github.com/example/pkg"}, Vcs: "git", Website: "https://example.com/%7Epkg"},
+			"v=txtv1;type=gometa;to=https://github.com/example/pkg;website=https://example.com/%257Epkg;vcs=git",
+		},
+		{
+			Record{
+				To:             []string{"https://example.com"},
+				Headers:        http.Header{"X-B": {"2"}, "X-A": {"1"}},
+				Query:          url.Values{"utm_source": {"dns"}},
+				PreserveMethod: Bool(false),
+				Parts:          2,
+			},
+			"v=txtv1;to=https://example.com;header-X-A=1;header-X-B=2;query-utm_source=dns;preserve_method=false;parts=2",
+		},
+		{Record{Maintenance: true, NoIndex: true}, "v=txtv1;noindex=true;status=maintenance"},
+	}
+	for i, test := range tests {
+		if got := test.record.String(); got != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, got)
+		}
+	}
+}
+
+func TestRecordValidate(t *testing.T) {
+	tests := []struct {
+		record    Record
+		shouldErr bool
+	}{
+		{Record{To: []string{"https://example.com"}}, false},
+		{Record{Version: V0, To: []string{"https://example.com/?a=b"}}, false},
+		{Record{Version: V0, To: []string{"https://example.com/;a"}}, true},
+		{Record{Version: "txtv2"}, true},
+		{Record{Type: "unknown"}, true},
+		{Record{To: []string{""}}, true},
+		{Record{To: []string{"https://example.com"}, Code: 200}, true},
+		{Record{To: []string{"https://example.com"}, Code: 503}, false},
+		{Record{Type: "sinkhole", Code: 404}, false},
+		{Record{Type: "qr"}, true},
+		{Record{Type: "dockerv2"}, true},
+		{Record{Type: "mirror", Mirrors: []string{"https://mirror.example.com/file"}}, false},
+		{Record{Type: "mirror"}, true},
+		{Record{Type: "dns", To: []string{"example.org"}}, false},
+		{Record{Type: "dns", To: []string{"https://example.org/"}}, true},
+		{Record{To: []string{Weighted("https://a.example.com", 0), Weighted("https://b.example.com", 0)}}, true},
+		{Record{To: []string{"https://a.example.com weight=x"}}, true},
+		{Record{Re: "("}, true},
+		{Record{Type: "gometa", Vcs: "cvs"}, true},
+		{Record{Referrer: "everywhere"}, true},
+		{Record{HSTS: "300,preload"}, false},
+		{Record{HSTS: "forever"}, true},
+		{Record{Headers: http.Header{"Location": {"https://example.com"}}}, true},
+		{Record{Headers: http.Header{"X-Bad Name": {"1"}}}, true},
+		{Record{Headers: http.Header{"X-Value": {"a\nb"}}}, true},
+		{Record{Query: url.Values{"a=b": {"c"}}}, true},
+		{Record{Size: -1}, true},
+		{Record{Parts: MaxParts + 1}, true},
+		{Record{Fallback: string(make([]byte, MaxFieldLength+1))}, true},
+	}
+	for i, test := range tests {
+		err := test.record.Validate()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error for %s", i, test.record)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+		}
+	}
+}
+
+func TestZone(t *testing.T) {
+	for host, expected := range map[string]string{
+		"example.com":            "_redirect.example.com.",
+		"Example.com.":           "_redirect.example.com.",
+		"_redirect.example.com.": "_redirect.example.com.",
+	} {
+		if got := Zone(host); got != expected {
+			t.Errorf("Expected %s for %s, got %s", expected, host, got)
+		}
+	}
+}
@@ -16,8 +16,12 @@ package txtdirect
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestParse(t *testing.T) {
@@ -84,9 +88,9 @@ func TestParse(t *testing.T) {
 			fmt.Errorf("could not parse status code"),
 		},
 		{
-			"v=txtv1;to=https://example.com/;code=test",
+			"v=txtv2;to=https://example.com/;code=test",
 			record{},
-			fmt.Errorf("unhandled version 'txtv1'"),
+			fmt.Errorf("unhandled version 'txtv2'"),
 		},
 		{
 			"v=txtv0;https://example.com/",
@@ -134,6 +138,39 @@ func TestParse(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"v=txtv0;to=https://example.com/;fallback=https://fallback.example.com{uri}",
+			record{
+				Version:  "txtv0",
+				To:       "https://example.com/",
+				Code:     302,
+				Type:     "host",
+				Fallback: []string{"https://fallback.example.com/?url=https://example.com/testing"},
+			},
+			nil,
+		},
+		{
+			"v=txtv0;to=https://example.com/, https://mirror.example.com/;type=host",
+			record{
+				Version: "txtv0",
+				To:      "https://example.com/",
+				Targets: []string{"https://example.com/", "https://mirror.example.com/"},
+				Code:    302,
+				Type:    "host",
+			},
+			nil,
+		},
+		{
+			"v=txtv0;to=https://example.com/?ids=1,2,https://mirror.example.com/?ids=1,2;type=host",
+			record{
+				Version: "txtv0",
+				To:      "https://example.com/?ids=1,2",
+				Targets: []string{"https://example.com/?ids=1,2", "https://mirror.example.com/?ids=1,2"},
+				Code:    302,
+				Type:    "host",
+			},
+			nil,
+		},
 	}
 
 	for i, test := range tests {
@@ -161,6 +198,9 @@ func TestParse(t *testing.T) {
 		if got, want := r.To, test.expected.To; got != want {
 			t.Errorf("Test %d: Expected To to be '%s', got '%s'", i, want, got)
 		}
+		if test.expected.Targets != nil && !identical(r.Targets, test.expected.Targets) {
+			t.Errorf("Test %d: Expected Targets to be %v, got %v", i, test.expected.Targets, r.Targets)
+		}
 		if got, want := r.Code, test.expected.Code; got != want {
 			t.Errorf("Test %d: Expected Code to be '%d', got '%d'", i, want, got)
 		}
@@ -170,5 +210,238 @@ func TestParse(t *testing.T) {
 		if got, want := r.Vcs, test.expected.Vcs; got != want {
 			t.Errorf("Test %d: Expected Vcs to be '%s', got '%s'", i, want, got)
 		}
+		if got, want := r.Fallback, test.expected.Fallback; !identical(got, want) {
+			t.Errorf("Test %d: Expected Fallback to be %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestParseTargetsPlaceholders(t *testing.T) {
+	// The commas in the placeholders' values don't add targets
+	req := httptest.NewRequest("GET", "http://example.com/a,https://evil.example.com?ids=1,https://evil.example.com", nil)
+	r := record{}
+	txt := "v=txtv0;to=https://example.com{uri},https://mirror.example.com/?{query};fallback=https://fallback.example.com{path};type=host"
+	if err := r.Parse(txt, req, Config{Enable: []string{"host"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"https://example.com/a,https://evil.example.com?ids=1,https://evil.example.com",
+		"https://mirror.example.com/?ids=1,https://evil.example.com",
+	}
+	if !identical(r.Targets, expected) {
+		t.Errorf("Expected the targets to be %v, got %v", expected, r.Targets)
+	}
+	if expected := []string{"https://fallback.example.com/a,https://evil.example.com"}; !identical(r.Fallback, expected) {
+		t.Errorf("Expected the fallback to be %v, got %v", expected, r.Fallback)
+	}
+}
+
+func TestSplitTargets(t *testing.T) {
+	tests := []struct {
+		chain    string
+		expected []string
+	}{
+		{"https://a.example.com,https://b.example.com", []string{"https://a.example.com", "https://b.example.com"}},
+		{" https://a.example.com , http://b.example.com ,", []string{"https://a.example.com", "http://b.example.com"}},
+		{"https://a.example.com/?ids=1,2,3", []string{"https://a.example.com/?ids=1,2,3"}},
+		{"https://a.example.com/a,b,https://b.example.com/c,d", []string{"https://a.example.com/a,b", "https://b.example.com/c,d"}},
+		{"", nil},
+	}
+	for i, test := range tests {
+		if targets := splitTargets(test.chain); !identical(targets, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, targets)
+		}
+	}
+}
+
+func TestWildcardZones(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected []string
+	}{
+		{"a.b.example.com", []string{"_.b.example.com", "_.example.com"}},
+		{"a.b.c.example.com", []string{"_.b.c.example.com", "_.c.example.com", "_.example.com"}},
+		{"www.example.com", []string{"_.example.com"}},
+		{"example.com", []string{"_.com"}},
+		{"localhost", nil},
+	}
+	for i, test := range tests {
+		if zones := wildcardZones(test.host); !identical(zones, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, zones)
+		}
+	}
+}
+
+func TestApexFallbackZones(t *testing.T) {
+	zones := apexFallbackZones("example.com:8080", DefaultApexFallback)
+	expected := []string{"_redirect.@.example.com", "_redirect.example.com.example.com"}
+	if !identical(zones, expected) {
+		t.Errorf("Expected %v, got %v", expected, zones)
+	}
+}
+
+func TestGetRecordApexFallback(t *testing.T) {
+	tests := []struct {
+		host         string
+		apexFallback []string
+		cache        bool
+		expected     string
+		shouldErr    bool
+	}{
+		{"doubled.test", DefaultApexFallback, false, "https://doubled.example.com", false},
+		// The @ label only goes through the resolvers
+		// which don't validate the names
+		{"at.test", DefaultApexFallback, true, "https://at.example.com", false},
+		{"doubled.test", []string{"_redirect.@.{host}"}, false, "", true},
+		{"doubled.test", nil, false, "", true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:       []string{"host"},
+			Resolver:     "127.0.0.1:" + strconv.Itoa(port),
+			ApexFallback: test.apexFallback,
+			RecordCache:  RecordCache{Enable: test.cache},
+		}
+		c.RecordCache.SetDefaults()
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := getRecord(test.host, req.Context(), c, req)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %+v", i, rec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, rec.To)
+		}
+	}
+}
+
+func TestGetRecordWildcard(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"A.Wildcard.TEST.", "https://wildcard.example.com"},
+		{"a.specific.wildcard.test.:8080", "https://specific.example.com"},
+		{"a.wildcard.test", "https://wildcard.example.com"},
+		{"a.b.c.wildcard.test", "https://wildcard.example.com"},
+		{"a.specific.wildcard.test", "https://specific.example.com"},
+		{"a.b.specific.wildcard.test", "https://specific.example.com"},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := getRecord(test.host, req.Context(), c, req)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, rec.To)
+		}
+	}
+}
+
+func TestGetRecordWildcardFailure(t *testing.T) {
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		switch m.Question[0].Name {
+		case "_redirect._.b.failing.test.":
+			r.Rcode = dns.RcodeServerFailure
+		case "_redirect._.failing.test.":
+			r.Answer = append(r.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{"v=txtv0;to=https://broad.example.com;type=host"},
+			})
+		default:
+			r.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(r)
+	})
+	defer stop()
+
+	tests := []struct {
+		host      string
+		shouldErr bool
+	}{
+		// The missing wildcards are skipped
+		{"a.c.failing.test", false},
+		// A broader wildcard doesn't stand in for a failing one
+		{"a.b.failing.test", true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:      []string{"host"},
+			Resolver:    addr,
+			RecordCache: RecordCache{Enable: true},
+		}
+		c.RecordCache.SetDefaults()
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		rec, err := getRecord(test.host, req.Context(), c, req)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %s", i, rec.To)
+			}
+			continue
+		}
+		if err != nil || rec.To != "https://broad.example.com" {
+			t.Errorf("Test %d: Expected the broad wildcard, got %s, %v", i, rec.To, err)
+		}
+	}
+}
+
+func TestPortZone(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com", ""},
+		{"example.com:80", ""},
+		{"Example.com:443", ""},
+		{"Example.com.:8080", "_port8080.example.com"},
+		{"[2001:db8::1]:8443", "_port8443.2001:db8::1"},
+	}
+	for i, test := range tests {
+		if zone := portZone(test.host); zone != test.expected {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, zone)
+		}
+	}
+}
+
+func TestPortZonesE2e(t *testing.T) {
+	tests := []struct {
+		url       string
+		portZones bool
+		location  string
+	}{
+		{"https://ports.test:8080/", true, "https://example.com/8080"},
+		{"https://ports.test:8080/", false, "https://example.com/default"},
+		{"https://ports.test:9090/", true, "https://example.com/default"},
+		{"https://ports.test/", true, "https://example.com/default"},
+		{"https://ports.test:8443/docs", true, "https://docs.example.com/8443"},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:    []string{"host", "path"},
+			Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+			PortZones: test.portZones,
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
 	}
 }
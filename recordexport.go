@@ -0,0 +1,232 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// recordExport is the signed snapshot of the record store moved between
+// environments, e.g. promoted from staging to production. The records are
+// kept as raw JSON, so the signature is checked against the signed bytes.
+type recordExport struct {
+	Signature string          `json:"signature"`
+	Records   json.RawMessage `json:"records"`
+}
+
+// exportedRecords is the signed part of the export
+type exportedRecords struct {
+	Version int                      `json:"version"`
+	Created time.Time                `json:"created"`
+	Records map[string]snapshotEntry `json:"records"`
+}
+
+// importResult is the admin API's response to an import
+type importResult struct {
+	Imported  int      `json:"imported"`
+	Skipped   int      `json:"skipped"`
+	Conflicts []string `json:"conflicts"`
+}
+
+const (
+	recordExportVersion = 1
+	// maxRecordImport is the max size of an imported export
+	maxRecordImport = 64 << 20
+)
+
+// ImportConflicts are the ways of resolving the imported records which
+// differ from the current ones. The newer records win by default.
+var ImportConflicts = []string{"newer", "keep", "replace", "fail"}
+
+// sign returns the hex encoded HMAC-SHA256 of the data
+func (a *Admin) sign(data []byte) string {
+	mac := hmac.New(sha256.New, []byte(a.SigningKey))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportRecords returns the signed export of the given records
+func (a *Admin) exportRecords(entries map[string]snapshotEntry) (recordExport, error) {
+	data, err := json.Marshal(exportedRecords{
+		Version: recordExportVersion,
+		Created: time.Now().UTC(),
+		Records: entries,
+	})
+	if err != nil {
+		return recordExport{}, err
+	}
+	return recordExport{Signature: a.sign(data), Records: data}, nil
+}
+
+// verifyExport checks the export's signature and returns its records
+func (a *Admin) verifyExport(export recordExport) (exportedRecords, error) {
+	var records exportedRecords
+	// The export may have been reindented on its way
+	var data bytes.Buffer
+	if err := json.Compact(&data, export.Records); err != nil {
+		return records, fmt.Errorf("couldn't read the export's records: %s", err.Error())
+	}
+	if !hmac.Equal([]byte(export.Signature), []byte(a.sign(data.Bytes()))) {
+		return records, fmt.Errorf("the export's signature doesn't match the signing key")
+	}
+	if err := json.Unmarshal(data.Bytes(), &records); err != nil {
+		return records, fmt.Errorf("couldn't read the export's records: %s", err.Error())
+	}
+	if records.Version != recordExportVersion {
+		return records, fmt.Errorf("unsupported export version %d", records.Version)
+	}
+	return records, nil
+}
+
+// mergeRecords merges the records into the current ones, resolving the
+// records which differ from the current ones by the conflict mode. It
+// returns the changed zones.
+func mergeRecords(current, records map[string]snapshotEntry, conflict string) (importResult, []string) {
+	result := importResult{Conflicts: []string{}}
+	zones := make([]string, 0, len(records))
+	for zone := range records {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	// The records' strings are joined when they're parsed
+	for _, zone := range zones {
+		if entry, ok := current[zone]; ok && strings.Join(entry.Txts, "") != strings.Join(records[zone].Txts, "") {
+			result.Conflicts = append(result.Conflicts, zone)
+		}
+	}
+	if conflict == "fail" && len(result.Conflicts) > 0 {
+		return result, nil
+	}
+
+	var changed []string
+	for _, zone := range zones {
+		entry := records[zone]
+		existing, exists := current[zone]
+		switch {
+		case len(entry.Txts) == 0:
+			result.Skipped++
+			continue
+		case exists && conflict == "keep":
+			result.Skipped++
+			continue
+		case exists && conflict == "newer" && !entry.Resolved.After(existing.Resolved):
+			result.Skipped++
+			continue
+		}
+		current[zone] = entry
+		changed = append(changed, zone)
+		result.Imported++
+	}
+	return result, changed
+}
+
+// serveExport serves the signed export of the record store
+func (a *Admin) serveExport(w http.ResponseWriter, c Config) error {
+	if !a.signs(w) {
+		return nil
+	}
+	var entries map[string]snapshotEntry
+	switch file, ok := c.Backend.resolver().(*fileResolver); {
+	case ok:
+		entries = file.entries()
+	case c.Snapshot.Enable && c.Snapshot.table != nil:
+		// The environments looking up the records in DNS
+		// export the records of their snapshot
+		entries = c.Snapshot.entries()
+	default:
+		http.Error(w, "The record store needs the file backend or the snapshot to be enabled", http.StatusNotFound)
+		return nil
+	}
+	export, err := a.exportRecords(entries)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="txtdirect-records.json"`)
+	return writeJSON(w, http.StatusOK, export)
+}
+
+// serveImport imports a signed export into the file backend's records,
+// which are served right away
+func (a *Admin) serveImport(w http.ResponseWriter, r *http.Request, c Config) error {
+	if !a.signs(w) {
+		return nil
+	}
+	file, ok := c.Backend.resolver().(*fileResolver)
+	if !ok {
+		http.Error(w, "The records can only be imported into the file backend", http.StatusNotFound)
+		return nil
+	}
+	conflict := r.URL.Query().Get("conflict")
+	if conflict == "" {
+		conflict = "newer"
+	}
+	if !contains(ImportConflicts, conflict) {
+		http.Error(w, fmt.Sprintf("The conflict should be one of %v", ImportConflicts), http.StatusBadRequest)
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRecordImport))
+	if err != nil {
+		http.Error(w, "Couldn't read the export", http.StatusBadRequest)
+		return nil
+	}
+	var export recordExport
+	if err := json.Unmarshal(body, &export); err != nil {
+		http.Error(w, "The body should be an export of the record store", http.StatusBadRequest)
+		return nil
+	}
+	records, err := a.verifyExport(export)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return nil
+	}
+
+	var result importResult
+	err = file.update(func(entries map[string]snapshotEntry) []string {
+		var changed []string
+		result, changed = mergeRecords(entries, records.Records, conflict)
+		return changed
+	})
+	if err != nil {
+		return err
+	}
+	if conflict == "fail" && len(result.Conflicts) > 0 {
+		return writeJSON(w, http.StatusConflict, result)
+	}
+	if result.Imported > 0 && c.RecordCache.Enable {
+		// The cached records of the imported zones are stale
+		c.RecordCache.Flush()
+	}
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// signs checks if the admin API can sign and verify the exports
+func (a *Admin) signs(w http.ResponseWriter) bool {
+	if a.SigningKey == "" {
+		http.Error(w, "The record store needs a signing key for the admin API", http.StatusNotFound)
+		return false
+	}
+	return true
+}
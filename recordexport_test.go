@@ -0,0 +1,170 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordExport(t *testing.T) {
+	newConfig := func(key string) Config {
+		c := Config{
+			Snapshot: Snapshot{Enable: true},
+			Admin:    Admin{Enable: true, Token: "secret", SigningKey: key},
+		}
+		c.Snapshot.SetDefaults()
+		c.Admin.SetDefaults()
+		return c
+	}
+	admin := func(c Config, method, endpoint, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "https://example.com"+DefaultAdminPath+endpoint, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		if err := c.Admin.ServeHTTP(w, req, c); err != nil {
+			t.Fatalf("Unexpected error for %s %s: %s", method, endpoint, err)
+		}
+		return w
+	}
+
+	now := time.Now()
+	staging := newConfig("promotion")
+	staging.Snapshot.table.entries = map[string]snapshotEntry{
+		"_redirect.new.example.com.":     {Txts: []string{"v=txtv0;to=https://new.example.com"}, Resolved: now},
+		"_redirect.changed.example.com.": {Txts: []string{"v=txtv0;to=https://staging.example.com"}, Resolved: now},
+		"_redirect.older.example.com.":   {Txts: []string{"v=txtv0;to=https://staging.example.com"}, Resolved: now.Add(-time.Hour)},
+	}
+	w := admin(staging, "GET", "/records/export", "")
+	if w.Code != 200 {
+		t.Fatalf("Expected the records to be exported, got %d: %s", w.Code, w.Body.String())
+	}
+	export := w.Body.String()
+
+	dir, err := ioutil.TempDir("", "txtdirect-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	zoneFile := filepath.Join(dir, "records.zone")
+	newProduction := func() Config {
+		err := ioutil.WriteFile(zoneFile, []byte(`_redirect.changed.example.com. 60 IN TXT "v=txtv0;to=https://prod.example.com"
+_redirect.older.example.com. 60 IN TXT "v=txtv0;to=https://prod.example.com"
+`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modified := now.Add(-time.Minute)
+		if err := os.Chtimes(zoneFile, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		c := newConfig("promotion")
+		c.Backend = Backend{Enable: true, Type: "file", File: zoneFile}
+		c.Backend.SetDefaults()
+		if err := c.Backend.Open(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		conflict string
+		code     int
+		imported int
+		targets  map[string]string
+	}{
+		{"", 200, 2, map[string]string{"new": "new", "changed": "staging", "older": "prod"}},
+		{"newer", 200, 2, map[string]string{"new": "new", "changed": "staging", "older": "prod"}},
+		{"keep", 200, 1, map[string]string{"new": "new", "changed": "prod", "older": "prod"}},
+		{"replace", 200, 3, map[string]string{"new": "new", "changed": "staging", "older": "staging"}},
+		{"fail", 409, 0, map[string]string{"new": "", "changed": "prod", "older": "prod"}},
+	}
+	for i, test := range tests {
+		production := newProduction()
+		w := admin(production, "POST", "/records/import?conflict="+test.conflict, export)
+		if w.Code != test.code {
+			t.Errorf("Test %d: Expected status code %d, got %d: %s", i, test.code, w.Code, w.Body.String())
+			continue
+		}
+		var result importResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Test %d: Expected the import result as JSON, got %s", i, w.Body.String())
+		}
+		if result.Imported != test.imported || len(result.Conflicts) != 2 {
+			t.Errorf("Test %d: Expected %d imported records and 2 conflicts, got %+v", i, test.imported, result)
+		}
+
+		// The imported records are served and kept in the zone file
+		reloaded, err := loadFileResolver(zoneFile)
+		if err != nil {
+			t.Fatalf("Test %d: Couldn't read the zone file: %s", i, err)
+		}
+		for _, resolver := range []RecordResolver{production.recordResolver(), reloaded} {
+			for name, target := range test.targets {
+				txts, _, err := resolver.LookupTXT(context.Background(), "_redirect."+name+".example.com.")
+				if target == "" {
+					if !isNotFound(err) {
+						t.Errorf("Test %d: Expected %s not to be imported, got %v", i, name, txts)
+					}
+					continue
+				}
+				if expected := "v=txtv0;to=https://" + target + ".example.com"; err != nil || txts[0] != expected {
+					t.Errorf("Test %d: Expected %s to be %s, got %v: %v", i, name, expected, txts, err)
+				}
+			}
+		}
+	}
+
+	// The imported records are redirected to
+	production := newProduction()
+	production.Enable = []string{"host"}
+	admin(production, "POST", "/records/import", export)
+	w = httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://new.example.com/", nil), production); err != nil {
+		t.Fatal(err)
+	}
+	if location := w.Header().Get("Location"); location != "https://new.example.com" {
+		t.Errorf("Expected the imported record to be served, got %d: %s", w.Code, location)
+	}
+
+	// The snapshot only answers the lookups when DNS fails
+	if w := admin(staging, "POST", "/records/import", export); w.Code != 404 {
+		t.Errorf("Expected the import to need the file backend, got %d", w.Code)
+	}
+
+	// The export is rejected by the environments with another key
+	other := newProduction()
+	other.Admin.SigningKey = "other"
+	if w := admin(other, "POST", "/records/import", export); w.Code != 403 {
+		t.Errorf("Expected the export signed with another key to be rejected, got %d", w.Code)
+	}
+	tampered := strings.Replace(export, "https://new.example.com", "https://evil.example.com", 1)
+	if w := admin(newProduction(), "POST", "/records/import", tampered); w.Code != 403 {
+		t.Errorf("Expected the tampered export to be rejected, got %d", w.Code)
+	}
+	if w := admin(newProduction(), "POST", "/records/import?conflict=merge", export); w.Code != 400 {
+		t.Errorf("Expected an unknown conflict mode to be rejected, got %d", w.Code)
+	}
+	if w := admin(newConfig(""), "GET", "/records/export", ""); w.Code != 404 {
+		t.Errorf("Expected the export to need a signing key, got %d", w.Code)
+	}
+	if w := admin(staging, "POST", "/records/export", ""); w.Code != 405 {
+		t.Errorf("Expected the export to only allow GET, got %d", w.Code)
+	}
+}
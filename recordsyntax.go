@@ -0,0 +1,63 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// strictVersion is the version of the records parsed strictly. Their
+// fields are key=value pairs, the ; and = characters of the values are
+// escaped as %3B and %3D and the % character as %25. The other escapes,
+// e.g. the ones of the targets' URLs, are kept as they are.
+const strictVersion = "txtv1"
+
+// repeatableKeys are the keys which may show up more than once in a
+// strict record, the header- and query- fields may repeat too
+var repeatableKeys = []string{"to", "mirror", "hash", "if", "unless"}
+
+// unescapeValue replaces the escaped characters of a strict record's value
+var unescapeValue = strings.NewReplacer("%3B", ";", "%3b", ";", "%3D", "=", "%3d", "=", "%25", "%").Replace
+
+// splitRecordFields splits the record into its fields. The records starting
+// with v=txtv1 are checked strictly and their values are unescaped, the
+// older records are split as they always were.
+func splitRecordFields(str string) ([]string, error) {
+	if str != "v="+strictVersion && !strings.HasPrefix(str, "v="+strictVersion+";") {
+		return strings.Split(str, ";"), nil
+	}
+
+	fields := strings.Split(strings.TrimSuffix(str, ";"), ";")
+	seen := make(map[string]bool, len(fields))
+	for i, field := range fields {
+		if field == "" {
+			return nil, fmt.Errorf("field %d of the %s record is empty", i+1, strictVersion)
+		}
+		keyValue := strings.Split(field, "=")
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("%s fields should be key=value pairs with the = of the values escaped as %%3D: %s", strictVersion, field)
+		}
+		key := keyValue[0]
+		if !headerNameRegex.MatchString(key) {
+			return nil, fmt.Errorf("invalid key in the %s record: %q", strictVersion, key)
+		}
+		if seen[key] && !contains(repeatableKeys, key) && !strings.HasPrefix(key, headerPrefix) && !strings.HasPrefix(key, queryPrefix) {
+			return nil, fmt.Errorf("%s= field can only be set once", key)
+		}
+		seen[key] = true
+		fields[i] = key + "=" + unescapeValue(keyValue[1])
+	}
+	return fields, nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	txtrecord "github.com/txtdirect/txtdirect/record"
+)
+
+func TestSplitRecordFields(t *testing.T) {
+	tests := []struct {
+		txt       string
+		expected  []string
+		shouldErr bool
+	}{
+		// The older records are split as they were
+		{"v=txtv0;to=https://example.com/?a=b;;type=host", []string{"v=txtv0", "to=https://example.com/?a=b", "", "type=host"}, false},
+		{"to=https://example.com;v=txtv1", []string{"to=https://example.com", "v=txtv1"}, false},
+		{
+			"v=txtv1;to=https://example.com/?a%3Db%3Bc%3dd;type=host;",
+			[]string{"v=txtv1", "to=https://example.com/?a=b;c=d", "type=host"},
+			false,
+		},
+		// Only ;, = and % are unescaped
+		{"v=txtv1;to=https://example.com/a%20b%2Fc%253D", []string{"v=txtv1", "to=https://example.com/a%20b%2Fc%3D"}, false},
+		{
+			"v=txtv1;to=https://a.example.com;to=https://b.example.com;header-X-Env=prod;header-X-Env=eu",
+			[]string{"v=txtv1", "to=https://a.example.com", "to=https://b.example.com", "header-X-Env=prod", "header-X-Env=eu"},
+			false,
+		},
+		{"v=txtv1", []string{"v=txtv1"}, false},
+		{"v=txtv1;to=https://example.com/?a=b", nil, true},
+		{"v=txtv1;;type=host", nil, true},
+		{"v=txtv1;type", nil, true},
+		{"v=txtv1;=host", nil, true},
+		{"v=txtv1;t(pe=host", nil, true},
+		{"v=txtv1;type=host;type=path", nil, true},
+	}
+	for i, test := range tests {
+		fields, err := splitRecordFields(test.txt)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.txt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, fields)
+		}
+	}
+}
+
+func TestParseStrictRecord(t *testing.T) {
+	c := Config{Enable: []string{"host", "path"}}
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+
+	tests := []struct {
+		txt       string
+		expected  record
+		shouldErr bool
+	}{
+		{
+			"v=txtv1;to=https://example.com/search?q%3Dtxt%3Bdirect;code=301;vanity=yes",
+			record{Version: "txtv1", To: "https://example.com/search?q=txt;direct", Code: 301, Type: "host"},
+			false,
+		},
+		{
+			"v=txtv1;type=path",
+			record{Version: "txtv1", Code: 302, Type: "path"},
+			false,
+		},
+		{"v=txtv1;to=https://example.com/?a=b", record{}, true},
+		{"type=host;v=txtv1", record{}, true},
+		{"v=txtv1;code=301;code=302", record{}, true},
+		{"v=txtv2;to=https://example.com", record{}, true},
+		// The older records ignore the unknown fields silently
+		{"v=txtv0;to=https://example.com;vanity=yes", record{Version: "txtv0", To: "https://example.com", Code: 302, Type: "host"}, false},
+	}
+	for i, test := range tests {
+		rec := record{}
+		err := rec.Parse(test.txt, req, c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %s", i, test.txt)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.Version != test.expected.Version || rec.To != test.expected.To || rec.Code != test.expected.Code || rec.Type != test.expected.Type {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, rec)
+		}
+	}
+}
+
+// TestRecordPackage makes sure the records built by the record
+// package are parsed by the server the way they're built
+func TestRecordPackage(t *testing.T) {
+	c := Config{Enable: checkRecordTypes}
+	yes, no := true, false
+	tests := []struct {
+		record   txtrecord.Record
+		expected record
+	}{
+		{
+			txtrecord.Record{Type: "path", To: []string{"https://example.com/?a=b;c"}, Code: 301, Root: "https://example.com/root"},
+			record{Version: "txtv1", Type: "path", To: "https://example.com/?a=b;c", Targets: []string{"https://example.com/?a=b;c"},
+				Code: 301, Root: "https://example.com/root"},
+		},
+		{
+			txtrecord.Record{Version: txtrecord.V0, Type: "gometa", To: []string{"https://github.com/example/pkg"}, Vcs: "git",
+				Website: "https://example.com/%7Epkg", Docs: "https://docs.example.com"},
+			record{Version: "txtv0", Type: "gometa", To: "https://github.com/example/pkg", Targets: []string{"https://github.com/example/pkg"},
+				Code: 302, Vcs: "git", Website: "https://example.com/%7Epkg", Docs: "https://docs.example.com"},
+		},
+		{
+			txtrecord.Record{
+				To:             []string{txtrecord.Weighted("https://a.example.com", 3), txtrecord.Weighted("https://b.example.com", 0)},
+				Sticky:         true,
+				Headers:        http.Header{"X-Served-By": {"txtdirect"}},
+				Query:          url.Values{"utm_source": {"dns"}},
+				HTTPSOnly:      txtrecord.Bool(true),
+				PreserveMethod: txtrecord.Bool(false),
+				NoIndex:        true,
+			},
+			record{Version: "txtv1", Type: "host", To: "https://b.example.com", Targets: []string{"https://b.example.com"},
+				Variants: []variant{
+					{Targets: []string{"https://a.example.com"}, Raw: "https://a.example.com", Weight: 3},
+					{Targets: []string{"https://b.example.com"}, Raw: "https://b.example.com", Weight: 0},
+				},
+				Code: 302, Sticky: true, Headers: http.Header{"X-Served-By": {"txtdirect"}}, Query: url.Values{"utm_source": {"dns"}},
+				HTTPSOnly: &yes, PreserveMethod: &no, NoIndex: true},
+		},
+	}
+	for i, test := range tests {
+		if err := test.record.Validate(); err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		var rec record
+		if err := rec.Parse(test.record.String(), nil, c); err != nil {
+			t.Fatalf("Test %d: Couldn't parse %s: %s", i, test.record, err)
+		}
+		if !reflect.DeepEqual(rec, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, rec)
+		}
+	}
+
+	// The records failing the validation aren't parsed by the server
+	invalid := []txtrecord.Record{
+		{To: []string{"https://example.com"}, Code: 200},
+		{Type: "qr"},
+		{Type: "gometa", To: []string{"https://github.com/example/pkg"}, Vcs: "cvs"},
+		{To: []string{txtrecord.Weighted("https://a.example.com", 0), txtrecord.Weighted("https://b.example.com", 0)}},
+		{To: []string{"https://example.com"}, Headers: http.Header{"Location": {"https://example.org"}}},
+	}
+	for i, r := range invalid {
+		if err := r.Validate(); err == nil {
+			t.Errorf("Test %d: Expected %s to be invalid", i, r)
+		}
+		var rec record
+		if err := rec.Parse(r.String(), nil, c); err == nil {
+			t.Errorf("Test %d: Expected the server to refuse %s", i, r)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit contains the configuration of the request rate limiter. Every
+// client IP or hostname gets a token bucket refilled at Rate tokens per
+// second and holding up to Burst tokens.
+type RateLimit struct {
+	Enable bool
+	Rate   float64
+	Burst  int
+	// Key is either ip or host
+	Key string
+
+	buckets *tokenBuckets
+}
+
+type tokenBuckets struct {
+	sync.Mutex
+	keys map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const (
+	DefaultRateLimitRate  = 10
+	DefaultRateLimitBurst = 20
+	DefaultRateLimitKey   = "ip"
+	// maxRateLimitKeys limits the number of tracked buckets
+	// so random clients can't grow them indefinitely
+	maxRateLimitKeys = 100000
+)
+
+// rateLimitKeys are the request attributes the requests can be limited by
+var rateLimitKeys = []string{"ip", "host"}
+
+// SetDefaults sets the default values for rate limit config
+// if the fields are empty
+func (l *RateLimit) SetDefaults() {
+	if l.Rate == 0 {
+		l.Rate = DefaultRateLimitRate
+	}
+	if l.Burst == 0 {
+		l.Burst = DefaultRateLimitBurst
+	}
+	if l.Key == "" {
+		l.Key = DefaultRateLimitKey
+	}
+	if l.buckets == nil {
+		l.buckets = &tokenBuckets{keys: make(map[string]*tokenBucket)}
+	}
+}
+
+// key returns the bucket's key for the given request
+func (l *RateLimit) key(r *http.Request) string {
+	if l.Key == "host" {
+		return canonicalHost(r.Host)
+	}
+	return clientIP(r)
+}
+
+// allow takes a token from the request's bucket. It returns false
+// when the bucket is empty and how long until it gets a token.
+func (l *RateLimit) allow(r *http.Request, now time.Time) (bool, time.Duration) {
+	b := l.buckets
+	b.Lock()
+	defer b.Unlock()
+
+	key := l.key(r)
+	bucket, ok := b.keys[key]
+	if !ok {
+		if len(b.keys) >= maxRateLimitKeys {
+			b.prune(now, l.Rate, l.Burst)
+		}
+		if len(b.keys) >= maxRateLimitKeys {
+			// The requests aren't limited rather than dropping the buckets
+			return true, 0
+		}
+		bucket = &tokenBucket{tokens: float64(l.Burst), last: now}
+		b.keys[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(l.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.Rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.Rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune removes the buckets which are full again. It should
+// be called while holding the lock.
+func (b *tokenBuckets) prune(now time.Time, rate float64, burst int) {
+	refill := time.Duration(float64(burst) / rate * float64(time.Second))
+	for key, bucket := range b.keys {
+		if now.Sub(bucket.last) >= refill {
+			delete(b.keys, key)
+		}
+	}
+}
+
+// limit responds with 429 Too Many Requests when the request
+// is over its rate limit and returns whether it got limited
+func (l *RateLimit) limit(w http.ResponseWriter, r *http.Request, c Config) bool {
+	allowed, retry := l.allow(r, time.Now())
+	if allowed {
+		return false
+	}
+	if c.Prometheus.Enable {
+		RateLimitedRequests.WithLabelValues(r.Host, l.Key).Add(1)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	w.Header().Set("Status-Code", strconv.Itoa(http.StatusTooManyRequests))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	return true
+}
+
+// ParseRateLimit parses the txtdirect config for the rate limiter
+func (l *RateLimit) ParseRateLimit(c Dispenser) error {
+	switch c.Val() {
+	case "rate":
+		value, err := strconv.ParseFloat(c.RemainingArgs()[0], 64)
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for rate field is not standard. It should be a positive number of requests per second")
+		}
+		l.Rate = value
+
+	case "burst":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for burst field is not standard. It should be a positive integer")
+		}
+		l.Burst = value
+
+	case "key":
+		value := c.RemainingArgs()[0]
+		if !contains(rateLimitKeys, value) {
+			return fmt.Errorf("The given value for key field is not standard. It should be ip or host")
+		}
+		l.Key = value
+
+	default:
+		return c.ArgErr() // unhandled option for ratelimit
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitAllow(t *testing.T) {
+	limit := RateLimit{Enable: true, Rate: 2, Burst: 3}
+	limit.SetDefaults()
+	now := time.Now()
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limit.allow(req, now); !allowed {
+			t.Fatalf("Expected request %d to be allowed in the burst", i)
+		}
+	}
+	allowed, retry := limit.allow(req, now)
+	if allowed {
+		t.Fatalf("Expected the request over the burst to be limited")
+	}
+	if retry != 500*time.Millisecond {
+		t.Errorf("Expected to retry after 500ms, got %s", retry)
+	}
+
+	// Other clients have their own buckets
+	other := httptest.NewRequest("GET", "https://example.com/", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	if allowed, _ := limit.allow(other, now); !allowed {
+		t.Errorf("Expected the other client's request to be allowed")
+	}
+
+	// The bucket gets refilled at the rate
+	if allowed, _ := limit.allow(req, now.Add(500*time.Millisecond)); !allowed {
+		t.Errorf("Expected the request to be allowed after the refill")
+	}
+	if allowed, _ := limit.allow(req, now.Add(500*time.Millisecond)); allowed {
+		t.Errorf("Expected the refilled token to be used up")
+	}
+}
+
+func TestRateLimitByHost(t *testing.T) {
+	limit := RateLimit{Enable: true, Rate: 1, Burst: 1, Key: "host"}
+	limit.SetDefaults()
+	c := Config{Enable: []string{"host"}, RateLimit: limit}
+
+	first := httptest.NewRequest("GET", "https://example.com/", nil)
+	first.RemoteAddr = "192.0.2.1:1234"
+	if limit.limit(httptest.NewRecorder(), first, c) {
+		t.Fatalf("Expected the first request to be allowed")
+	}
+
+	// Different clients share the host's bucket
+	second := httptest.NewRequest("GET", "https://EXAMPLE.com:443/", nil)
+	second.RemoteAddr = "192.0.2.2:1234"
+	w := httptest.NewRecorder()
+	if err := Redirect(w, second, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 429 {
+		t.Errorf("Expected the request to be limited, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected to retry after a second, got %s", w.Header().Get("Retry-After"))
+	}
+}
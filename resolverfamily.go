@@ -0,0 +1,203 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Address families of the DNS queries
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// dialFunc dials the DNS resolvers
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// familyNoteKey is the context key of the familyNote
+type familyNoteKey struct{}
+
+// familyNote keeps the address family of the connection
+// which a lookup used to reach its resolver
+type familyNote struct {
+	sync.Mutex
+	family string
+}
+
+// withFamilyNote returns a context which the resolver dials
+// note their connection's address family in
+func withFamilyNote(ctx context.Context) (context.Context, *familyNote) {
+	note := &familyNote{}
+	return context.WithValue(ctx, familyNoteKey{}, note), note
+}
+
+// noteFamily records the family of the given remote address
+// if the context is carrying a familyNote
+func noteFamily(ctx context.Context, addr net.Addr) {
+	note, ok := ctx.Value(familyNoteKey{}).(*familyNote)
+	if !ok || addr == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	if family := ipFamily(net.ParseIP(host)); family != "" {
+		note.Lock()
+		note.family = family
+		note.Unlock()
+	}
+}
+
+// get returns the noted family
+func (n *familyNote) get() string {
+	n.Lock()
+	defer n.Unlock()
+	return n.family
+}
+
+// ipFamily returns the address family of the given IP
+func ipFamily(ip net.IP) string {
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return FamilyIPv4
+	default:
+		return FamilyIPv6
+	}
+}
+
+// resolverFamily returns the address family of the given resolver
+// address if it's an IP literal
+func resolverFamily(resolver string) string {
+	if isDoH(resolver) {
+		return ""
+	}
+	host := resolver
+	if h, _, err := net.SplitHostPort(resolver); err == nil {
+		host = h
+	}
+	return ipFamily(net.ParseIP(strings.Trim(host, "[]")))
+}
+
+// lookupFamily returns the family label of a finished lookup. The family
+// of the dialed connection wins over the configured family and the
+// resolver's address.
+func lookupFamily(note *familyNote, resolver string, c Config) string {
+	if family := note.get(); family != "" {
+		return family
+	}
+	if c.DNS.Family != "" {
+		return c.DNS.Family
+	}
+	if family := resolverFamily(resolver); family != "" {
+		return family
+	}
+	return "unknown"
+}
+
+// pinned checks if the DNS queries are bound to an address family
+// or a source address
+func (d *DNS) pinned() bool {
+	return d.Family != "" || d.Source != nil
+}
+
+// network returns the given network bound to the configured family
+func (d *DNS) network(network string) string {
+	network = strings.TrimRight(network, "46")
+	switch d.Family {
+	case FamilyIPv4:
+		return network + "4"
+	case FamilyIPv6:
+		return network + "6"
+	}
+	return network
+}
+
+// dial connects to the resolver using the configured address family
+// and source address and notes the family of the connection
+func (d *DNS) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	network = d.network(network)
+	if d.Source != nil {
+		if strings.HasPrefix(network, "tcp") {
+			dialer.LocalAddr = &net.TCPAddr{IP: d.Source}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: d.Source}
+		}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	noteFamily(ctx, conn.RemoteAddr())
+	return conn, nil
+}
+
+// httpClient returns a client which reaches the DoH endpoints
+// over the configured address family and source address
+func (d *DNS) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           d.dial,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+// checkFamily makes sure the source address and the resolvers
+// given as IP literals belong to the configured address family
+func (d *DNS) checkFamily(resolvers []string) error {
+	if d.Source != nil && d.Family != "" && ipFamily(d.Source) != d.Family {
+		return fmt.Errorf("dns source %s isn't an %s address", d.Source, d.Family)
+	}
+	family := d.Family
+	if family == "" {
+		family = ipFamily(d.Source)
+	}
+	if family == "" {
+		return nil
+	}
+	for _, resolver := range resolvers {
+		if rf := resolverFamily(resolver); rf != "" && rf != family {
+			return fmt.Errorf("resolver %s can't be reached over %s", resolver, family)
+		}
+	}
+	return nil
+}
+
+// systemResolver returns the resolver of the lookups without a
+// custom resolver. The system's resolvers are dialed directly
+// when the queries are bound to an address family or a source.
+func systemResolver(c Config) *net.Resolver {
+	if !c.DNS.pinned() {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     c.DNS.dial,
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseDNSFamily(t *testing.T) {
+	tests := []struct {
+		config    string
+		family    string
+		source    net.IP
+		shouldErr bool
+	}{
+		{"dns {\nfamily ipv6\n}", FamilyIPv6, nil, false},
+		{"dns {\nsource 127.0.0.1\n}", FamilyIPv4, net.ParseIP("127.0.0.1"), false},
+		{"resolver [::1]:53\ndns {\nsource ::1\nfamily ipv6\n}", FamilyIPv6, net.ParseIP("::1"), false},
+		{"resolver https://dns.example.com/dns-query\ndns {\nfamily ipv6\n}", FamilyIPv6, nil, false},
+		{"resolver 127.0.0.1:53\ndns {\nfamily ipv6\n}", "", nil, true},
+		{"resolver [::1]:53\ndns {\nsource 127.0.0.1\n}", "", nil, true},
+		{"dns {\nsource ::1\nfamily ipv4\n}", "", nil, true},
+		{"dns {\nfamily ipv5\n}", "", nil, true},
+		{"dns {\nsource example.com\n}", "", nil, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable host\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.DNS.Family != test.family || !conf.DNS.Source.Equal(test.source) {
+			t.Errorf("Test %d: Expected %s from %s, got %s from %s", i, test.family, test.source, conf.DNS.Family, conf.DNS.Source)
+		}
+	}
+}
+
+func TestDNS_dial(t *testing.T) {
+	sources := make(chan net.Addr, 1)
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		sources <- w.RemoteAddr()
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"v=txtv0;to=https://example.com"},
+		})
+		w.WriteMsg(r)
+	})
+	defer stop()
+
+	d := DNS{Family: FamilyIPv4, Source: net.ParseIP("127.0.0.1")}
+	ctx, note := withFamilyNote(context.Background())
+	if _, _, err := exchangeTXT(ctx, "_redirect.dial.test.", addr, d.dial); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if source := (<-sources).(*net.UDPAddr); !source.IP.Equal(d.Source) {
+		t.Errorf("Expected the query to come from %s, got %s", d.Source, source.IP)
+	}
+	if note.get() != FamilyIPv4 {
+		t.Errorf("Expected the %s family to be noted, got %q", FamilyIPv4, note.get())
+	}
+
+	// An ipv4 resolver can't be reached on a v6-only path
+	d = DNS{Family: FamilyIPv6}
+	if _, _, err := exchangeTXT(context.Background(), "_redirect.dial.test.", addr, d.dial); err == nil {
+		t.Errorf("Expected an error dialing %s over %s", addr, FamilyIPv6)
+	}
+}
+
+func TestResolverLookups(t *testing.T) {
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Rcode = dns.RcodeNameError
+		w.WriteMsg(r)
+	})
+	defer stop()
+	doh := httptest.NewTLSServer(http.HandlerFunc(dohHandler))
+	defer doh.Close()
+
+	tests := []struct {
+		resolver string
+		family   string
+		label    string
+		result   string
+	}{
+		// NXDOMAIN is an answer, so the resolver didn't fail
+		{addr, "", FamilyIPv4, "success"},
+		{addr, FamilyIPv6, FamilyIPv6, "failure"},
+		{doh.URL, "", FamilyIPv4, "success"},
+	}
+	for i, test := range tests {
+		c := Config{
+			DNS:        DNS{Family: test.family},
+			DoH:        DoH{client: doh.Client()},
+			Prometheus: Prometheus{Enable: true},
+		}
+		before := testutil.ToFloat64(ResolverLookups.WithLabelValues(test.label, test.result))
+		lookupTXTWith(context.Background(), "_redirect.family.test.", test.resolver, c)
+		after := testutil.ToFloat64(ResolverLookups.WithLabelValues(test.label, test.result))
+		if after-before != 1 {
+			t.Errorf("Test %d: Expected a %s lookup over %s to be counted", i, test.result, test.label)
+		}
+	}
+}
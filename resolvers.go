@@ -0,0 +1,199 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolverPool spreads the lookups over multiple resolvers in round-robin
+// order and fails over to the next resolver when one stops answering
+type resolverPool struct {
+	sync.Mutex
+	resolvers []string
+	next      int
+	downUntil map[string]time.Time
+}
+
+// resolverCooldown is how long a failed resolver is skipped
+const resolverCooldown = 30 * time.Second
+
+// anyDoH checks if any of the given resolvers is a DoH endpoint
+func anyDoH(resolvers []string) bool {
+	for _, resolver := range resolvers {
+		if isDoH(resolver) {
+			return true
+		}
+	}
+	return false
+}
+
+func newResolverPool(resolvers []string) *resolverPool {
+	return &resolverPool{
+		resolvers: resolvers,
+		downUntil: make(map[string]time.Time),
+	}
+}
+
+// order returns the resolvers in the order they should be tried. The
+// starting resolver rotates on every call and the resolvers that failed
+// recently are moved to the end, so they're only used as a last resort.
+func (p *resolverPool) order() []string {
+	p.Lock()
+	defer p.Unlock()
+
+	start := p.next
+	p.next = (p.next + 1) % len(p.resolvers)
+
+	now := time.Now()
+	healthy := make([]string, 0, len(p.resolvers))
+	var down []string
+	for i := range p.resolvers {
+		resolver := p.resolvers[(start+i)%len(p.resolvers)]
+		if now.Before(p.downUntil[resolver]) {
+			down = append(down, resolver)
+			continue
+		}
+		healthy = append(healthy, resolver)
+	}
+	return append(healthy, down...)
+}
+
+// fail marks the given resolver as down for the cooldown period
+func (p *resolverPool) fail(resolver string) {
+	p.Lock()
+	defer p.Unlock()
+	p.downUntil[resolver] = time.Now().Add(resolverCooldown)
+}
+
+// succeed marks the given resolver as healthy
+func (p *resolverPool) succeed(resolver string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.downUntil, resolver)
+}
+
+// resolverFailure checks if the given lookup error was caused by the
+// resolver itself instead of the zone not having any TXT records
+func resolverFailure(err error) bool {
+	switch e := err.(type) {
+	case *rcodeError:
+		return e.Rcode == dns.RcodeServerFailure || e.Rcode == dns.RcodeRefused
+	case *net.DNSError:
+		return !e.IsNotFound
+	case net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// lookupTXTPool finds the TXT records of the given zone using the resolver
+// pool. The next resolver is tried when a resolver fails to answer. When
+// the context has a deadline, it's split between the remaining resolvers
+// so a resolver which doesn't answer at all can't use up all of it.
+func lookupTXTPool(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	var err error
+	resolvers := c.resolvers.order()
+	for i, resolver := range resolvers {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attemptCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(resolvers)-i))
+		}
+		var txts []string
+		var ttl time.Duration
+		txts, ttl, err = lookupTXTWith(attemptCtx, zone, resolver, c)
+		cancel()
+		// The resolver isn't to blame when the client hung up
+		if ctx.Err() == context.Canceled {
+			return nil, 0, ctx.Err()
+		}
+		if err == nil || !resolverFailure(err) {
+			c.resolvers.succeed(resolver)
+			return txts, ttl, err
+		}
+
+		log.Printf("[txtdirect]: Resolver %s failed, trying the next one: %s", resolver, err.Error())
+		c.resolvers.fail(resolver)
+		if c.Prometheus.Enable {
+			ResolverFailures.WithLabelValues(resolver).Add(1)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, err
+}
+
+// resolvConf is the resolver config of the system
+const resolvConf = "/etc/resolv.conf"
+
+// resolvConfRefresh is how long the system's resolvers are
+// used before resolvConf is read again
+const resolvConfRefresh = 5 * time.Second
+
+// systemServers returns the addresses of the system's resolvers
+var systemServers = (&resolvConfServers{path: resolvConf}).get
+
+// resolvConfServers keeps the resolvers read from a resolv.conf file
+type resolvConfServers struct {
+	sync.Mutex
+	path    string
+	servers []string
+	read    time.Time
+}
+
+func (r *resolvConfServers) get() []string {
+	r.Lock()
+	defer r.Unlock()
+	if time.Since(r.read) < resolvConfRefresh {
+		return r.servers
+	}
+	r.read = time.Now()
+	r.servers = nil
+	config, err := dns.ClientConfigFromFile(r.path)
+	if err != nil {
+		return nil
+	}
+	for _, server := range config.Servers {
+		r.servers = append(r.servers, net.JoinHostPort(server, config.Port))
+	}
+	return r.servers
+}
+
+// exchangeSystemTXT queries the system's resolvers directly, unlike
+// net.Resolver it returns the TTL of the records which the cache
+// needs. The next resolver is tried when one fails to answer.
+func exchangeSystemTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	servers := systemServers()
+	if len(servers) == 0 {
+		txts, err := systemResolver(c).LookupTXT(ctx, zone)
+		return txts, 0, err
+	}
+	var err error
+	for _, server := range servers {
+		var txts []string
+		var ttl time.Duration
+		txts, ttl, err = exchangeTXT(ctx, zone, server, c.DNS.dial)
+		if err == nil || !resolverFailure(err) || ctx.Err() != nil {
+			return txts, ttl, err
+		}
+	}
+	return nil, 0, err
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolverPool_order(t *testing.T) {
+	p := newResolverPool([]string{"a", "b", "c"})
+
+	tests := []struct {
+		failed   string
+		expected []string
+	}{
+		{"", []string{"a", "b", "c"}},
+		{"", []string{"b", "c", "a"}},
+		{"a", []string{"c", "b", "a"}},
+		{"", []string{"b", "c", "a"}},
+	}
+	for i, test := range tests {
+		if test.failed != "" {
+			p.fail(test.failed)
+		}
+		if order := p.order(); !identical(order, test.expected) {
+			t.Errorf("Test %d: Expected order %v, got %v", i, test.expected, order)
+		}
+	}
+
+	p.succeed("a")
+	if order := p.order(); !identical(order, []string{"c", "a", "b"}) {
+		t.Errorf("Expected the recovered resolver back in rotation, got %v", order)
+	}
+}
+
+func TestLookupTXTPool(t *testing.T) {
+	dead, stopDead := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(r)
+	})
+	defer stopDead()
+	silent, stopSilent := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {})
+	defer stopSilent()
+	healthy, stopHealthy := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		if m.Question[0].Name == "_redirect.missing.test." {
+			r.Rcode = dns.RcodeNameError
+			w.WriteMsg(r)
+			return
+		}
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"v=txtv0;to=https://example.com"},
+		})
+		w.WriteMsg(r)
+	})
+	defer stopHealthy()
+
+	resolvers := []string{dead, silent, healthy}
+	c := Config{
+		Resolver:  dead,
+		Resolvers: resolvers,
+		resolvers: newResolverPool(resolvers),
+	}
+	// The cache makes the lookups go through the DNS client
+	// which exposes the rcodes
+	c.RecordCache.Enable = true
+	c.RecordCache.SetDefaults()
+
+	for i := 0; i < len(resolvers); i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		txts, _, err := lookupTXT(ctx, "_redirect.failover.test.", c)
+		cancel()
+		if err != nil {
+			t.Errorf("Lookup %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if len(txts) != 1 || txts[0] != "v=txtv0;to=https://example.com" {
+			t.Errorf("Lookup %d: Unexpected TXT records %v", i, txts)
+		}
+	}
+
+	// The failed resolvers are only tried after the healthy one
+	if order := c.resolvers.order(); order[0] != healthy {
+		t.Errorf("Expected %s to be tried first, got %v", healthy, order)
+	}
+
+	// NXDOMAIN is a valid answer and doesn't fail over
+	if _, _, err := lookupTXT(context.Background(), "_redirect.missing.test.", c); resolverFailure(err) {
+		t.Errorf("Expected NXDOMAIN not to count as a resolver failure, got %v", err)
+	}
+}
+
+func TestLookupTXTPoolClientGone(t *testing.T) {
+	silent, stopSilent := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {})
+	defer stopSilent()
+
+	resolvers := []string{silent, silent}
+	c := Config{
+		Resolver:  silent,
+		Resolvers: resolvers,
+		resolvers: newResolverPool(resolvers),
+	}
+	c.RecordCache.Enable = true
+	c.RecordCache.SetDefaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := lookupTXT(ctx, "_redirect.gone.test.", c); err != context.Canceled {
+		t.Errorf("Expected the lookup to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the lookup to stop when the client hung up, took %s", elapsed)
+	}
+	// The resolver isn't marked as down for the client's hang up
+	if _, down := c.resolvers.downUntil[silent]; down {
+		t.Errorf("Expected %s not to be marked as down", silent)
+	}
+}
+
+func TestResolvConfServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-resolv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "resolv.conf")
+	if err := ioutil.WriteFile(file, []byte("search example.com\nnameserver 192.0.2.1\nnameserver 2001:db8::1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := &resolvConfServers{path: file}
+	expected := []string{"192.0.2.1:53", "[2001:db8::1]:53"}
+	if got := servers.get(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the servers %v, got %v", expected, got)
+	}
+}
+
+func TestExchangeSystemTXT(t *testing.T) {
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 600},
+			Txt: []string{"v=txtv0;to=https://example.com"},
+		})
+		w.WriteMsg(r)
+	})
+	defer stop()
+	// A resolver which doesn't listen anymore
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := pc.LocalAddr().String()
+	pc.Close()
+
+	defer func(servers func() []string) { systemServers = servers }(systemServers)
+	systemServers = func() []string { return []string{down, addr} }
+
+	c := Config{RecordCache: RecordCache{Enable: true}}
+	c.RecordCache.SetDefaults()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	txts, ttl, err := resolveTXT(ctx, "_redirect.system.test.", c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The system resolvers' TTLs reach the cache
+	if len(txts) != 1 || ttl != 10*time.Minute {
+		t.Errorf("Expected the record with its TTL, got %v for %s", txts, ttl)
+	}
+}
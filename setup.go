@@ -18,7 +18,9 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
@@ -32,8 +34,6 @@ func main() {
 	caddymain.Run()
 }
 
-var torOnce sync.Once
-
 func init() {
 	caddy.RegisterPlugin("txtdirect", caddy.Plugin{
 		ServerType: "http",
@@ -43,51 +43,579 @@ func init() {
 
 var allOptions = []string{"host", "path", "gometa", "www"}
 
+// Dispenser is the subset of the Caddyfile dispenser API that is
+// shared between Caddy v1 and v2. The config parsers only depend on
+// this interface so they aren't tied to a specific Caddy version.
+type Dispenser interface {
+	Next() bool
+	NextArg() bool
+	Val() string
+	RemainingArgs() []string
+	ArgErr() error
+	Errf(format string, args ...interface{}) error
+}
+
 func parse(c *caddy.Controller) (Config, error) {
+	var config Config
+	if err := config.UnmarshalCaddyfile(c); err != nil {
+		return Config{}, err
+	}
+
+	parseLogfile(config.LogOutput)
+
+	return config, nil
+}
+
+// UnmarshalCaddyfile parses the txtdirect directive's block
+// using the given dispenser and fills the config
+func (config *Config) UnmarshalCaddyfile(c Dispenser) error {
 	var enable []string
 	var redirect string
 	var resolver string
+	var resolvers []string
+	var doh DoH
+	var recordCache RecordCache
+	var flatten Flatten
+	var status Status
+	var geoip GeoIP
+	var rateLimit RateLimit
+	var admin Admin
+	var overrides Overrides
+	var policy Policy
+	var qr QR
+	var preview Preview
+	var waf WAF
+	var snapshot Snapshot
+	var tracing Tracing
+	var debug bool
+	var preserveMethod bool
+	var httpsOnly bool
+	var multipleChoices bool
+	var portZones bool
+	var healthCheck HealthCheck
 	var gomods Gomods
 	var prometheus Prometheus
 	var logfile string
 	var tor Tor
+	var accessLog AccessLog
+	var decisionLog DecisionLog
+	var webhooks Webhooks
+	var sinkhole Sinkhole
+	var maintenance Maintenance
+	var templates Templates
+	var probes Probes
+	var honeypot Honeypot
+	var dnsPolicy DNS
+	var priority Priority
+	var adaptive Adaptive
+	var dockerv2 Dockerv2
+	// dockerv2Block is set when the config has a dockerv2 block
+	var dockerv2Block bool
+	var proxy Proxy
+	var apexFallback []string
+	var defaults Defaults
+	var backend Backend
+	var geoPolicy GeoPolicy
+	var clientCerts ClientCerts
+	var ipHosts IPHosts
+	var absent Absent
+	var maxRequestAge time.Duration
+	var tlsAsk TLSAsk
+	// enableProfile is set when the enabled types are set by a profile
+	var enableProfile bool
 
+	snippets := newSnippetDispenser(c)
+	c = snippets
 	c.Next() // skip directive name
-	for c.NextBlock() {
+	// NextBlock isn't used since its signature differs between Caddy versions
+	hasBlock := c.NextArg() && c.Val() == "{"
+	for hasBlock && c.Next() {
 		option := c.Val()
+		if option == "}" {
+			break
+		}
 		switch option {
+		case "import":
+			if err := snippets.Import(); err != nil {
+				return err
+			}
+
+		case "profile":
+			if err := snippets.Profile(); err != nil {
+				return err
+			}
+
 		case "disable":
-			if enable != nil {
-				return Config{}, c.ArgErr()
+			if enable != nil && !enableProfile {
+				return c.ArgErr()
 			}
+			enableProfile = snippets.inProfile()
 			toDisable := c.RemainingArgs()
 			if len(toDisable) == 0 {
-				return Config{}, c.ArgErr()
+				return c.ArgErr()
 			}
 			enable = removeArrayFromArray(allOptions, toDisable)
 
 		case "enable":
-			if enable != nil {
-				return Config{}, c.ArgErr()
+			if enable != nil && !enableProfile {
+				return c.ArgErr()
 			}
+			enableProfile = snippets.inProfile()
 			enable = c.RemainingArgs()
 			if len(enable) == 0 {
-				return Config{}, c.ArgErr()
+				return c.ArgErr()
 			}
 
 		case "redirect":
 			toRedirect := c.RemainingArgs()
-			if len(toRedirect) != 1 {
-				return Config{}, c.ArgErr()
+			if len(toRedirect) == 0 {
+				return c.ArgErr()
+			}
+			// Multiple targets form a fallback chain
+			redirect = strings.Join(toRedirect, ",")
+
+		case "debug":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			debug = true
+
+		case "preserve_method":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			preserveMethod = true
+
+		case "https_only":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			httpsOnly = true
+
+		case "multiple_choices":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			multipleChoices = true
+
+		case "port_zones":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			portZones = true
+
+		case "absent_action":
+			if err := absent.ParseAbsent(c.RemainingArgs()); err != nil {
+				return err
+			}
+
+		case "max_request_age":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			value, err := time.ParseDuration(args[0])
+			if err != nil || value <= 0 {
+				return c.Errf("The given value for max_request_age field is not standard. It should be a positive duration")
+			}
+			maxRequestAge = value
+
+		case "ip_hosts":
+			if err := ipHosts.ParseIPHosts(c.RemainingArgs()); err != nil {
+				return err
+			}
+
+		case "apex_fallback":
+			apexFallback = c.RemainingArgs()
+			if len(apexFallback) == 0 {
+				apexFallback = DefaultApexFallback
+			}
+			for _, template := range apexFallback {
+				if !strings.Contains(template, "{host}") {
+					return c.Errf("apex_fallback names should contain the {host} placeholder")
+				}
+			}
+
+		case "defaults":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			c.NextArg()
+			if c.Val() != "{" {
+				return c.ArgErr()
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := defaults.ParseDefaults(args[0], c); err != nil {
+					return err
+				}
+			}
+
+		case "backend":
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return c.ArgErr()
+			}
+			backend.Enable = true
+			backend.Type = args[0]
+			if len(args) == 2 {
+				backend.File = args[1]
+			}
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := backend.ParseBackend(c); err != nil {
+					return err
+				}
 			}
-			redirect = toRedirect[0]
 
 		case "resolver":
-			resolverAddr := c.RemainingArgs()
-			if len(resolverAddr) != 1 {
-				return Config{}, c.ArgErr()
+			resolvers = c.RemainingArgs()
+			if len(resolvers) == 0 {
+				return c.ArgErr()
+			}
+			// The first resolver is also used for the lookups which
+			// don't go through the resolver pool
+			resolver = resolvers[0]
+
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			if !anyDoH(resolvers) {
+				return c.Errf("resolver options are only supported for DoH endpoints")
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := doh.ParseDoH(c); err != nil {
+					return err
+				}
+			}
+
+		case "dns":
+			dnsPolicy.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := dnsPolicy.ParseDNS(c); err != nil {
+					return err
+				}
+			}
+
+		case "priority":
+			priority.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := priority.ParsePriority(c); err != nil {
+					return err
+				}
+			}
+
+		case "adaptive":
+			adaptive.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := adaptive.ParseAdaptive(c); err != nil {
+					return err
+				}
+			}
+
+		case "cache":
+			recordCache.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := recordCache.ParseRecordCache(c); err != nil {
+					return err
+				}
+			}
+
+		case "flatten":
+			flatten.Enable = true
+			if c.NextArg() {
+				value, err := strconv.Atoi(c.Val())
+				if err != nil || value < 1 {
+					return c.ArgErr()
+				}
+				flatten.MaxDepth = value
+			}
+
+		case "status":
+			status.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := status.ParseStatus(c); err != nil {
+					return err
+				}
+			}
+
+		case "snapshot":
+			snapshot.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := snapshot.ParseSnapshot(c); err != nil {
+					return err
+				}
+			}
+
+		case "overrides":
+			overrides.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := overrides.ParseOverrides(c); err != nil {
+					return err
+				}
+			}
+
+		case "policy":
+			policy.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := policy.ParsePolicy(c); err != nil {
+					return err
+				}
+			}
+
+		case "qr":
+			qr.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := qr.ParseQR(c); err != nil {
+					return err
+				}
+			}
+
+		case "preview":
+			preview.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := preview.ParsePreview(c); err != nil {
+					return err
+				}
+			}
+
+		case "waf":
+			waf.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := waf.ParseWAF(c); err != nil {
+					return err
+				}
+			}
+
+		case "admin":
+			admin.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := admin.ParseAdmin(c); err != nil {
+					return err
+				}
+			}
+
+		case "geoip":
+			geoip.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := geoip.ParseGeoIP(c); err != nil {
+					return err
+				}
+			}
+
+		case "client_certs":
+			clientCerts.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				return c.ArgErr()
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := clientCerts.ParseClientCerts(c); err != nil {
+					return err
+				}
+			}
+
+		case "geo_policy":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			c.NextArg()
+			if c.Val() != "{" {
+				return c.ArgErr()
+			}
+			var rules []string
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				rules = append(rules, c.Val())
+			}
+			if err := geoPolicy.ParseGeoPolicy(args[0], rules); err != nil {
+				return err
+			}
+
+		case "ratelimit":
+			rateLimit.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := rateLimit.ParseRateLimit(c); err != nil {
+					return err
+				}
+			}
+
+		case "tracing":
+			tracing.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := tracing.ParseTracing(c); err != nil {
+					return err
+				}
+			}
+
+		case "tls_ask":
+			tlsAsk.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := tlsAsk.ParseTLSAsk(c); err != nil {
+					return err
+				}
+			}
+
+		case "probes":
+			probes.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := probes.ParseProbes(c); err != nil {
+					return err
+				}
+			}
+
+		case "healthcheck":
+			healthCheck.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := healthCheck.ParseHealthCheck(c); err != nil {
+					return err
+				}
 			}
-			resolver = resolverAddr[0]
 
 		case "logfile":
 			logfile = "stdout"
@@ -95,6 +623,144 @@ func parse(c *caddy.Controller) (Config, error) {
 			if c.NextArg() {
 				logfile = c.Val()
 			}
+		case "accesslog":
+			accessLog.Enable = true
+			if c.NextArg() && c.Val() != "{" {
+				accessLog.Output = c.Val()
+				c.NextArg()
+			}
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := accessLog.ParseAccessLog(c); err != nil {
+					return err
+				}
+			}
+
+		case "webhooks":
+			webhooks.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				return c.ArgErr()
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := webhooks.ParseWebhooks(c); err != nil {
+					return err
+				}
+			}
+
+		case "decisionlog":
+			decisionLog.Enable = true
+			if c.NextArg() && c.Val() != "{" {
+				decisionLog.Output = c.Val()
+				c.NextArg()
+			}
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := decisionLog.ParseDecisionLog(c); err != nil {
+					return err
+				}
+			}
+
+		case "honeypot":
+			honeypot.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := honeypot.ParseHoneypot(c); err != nil {
+					return err
+				}
+			}
+
+		case "sinkhole":
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := sinkhole.ParseSinkhole(c); err != nil {
+					return err
+				}
+			}
+
+		case "templates":
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := templates.ParseTemplates(c); err != nil {
+					return err
+				}
+			}
+
+		case "maintenance":
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := maintenance.ParseMaintenance(c); err != nil {
+					return err
+				}
+			}
+
+		case "proxy":
+			proxy.Enable = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := proxy.ParseProxy(c); err != nil {
+					return err
+				}
+			}
+
+		case "dockerv2":
+			dockerv2Block = true
+			c.NextArg()
+			if c.Val() != "{" {
+				continue
+			}
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := dockerv2.ParseDockerv2(c); err != nil {
+					return err
+				}
+			}
+
 		case "gomods":
 			gomods.Enable = true
 			c.NextArg()
@@ -107,7 +773,7 @@ func parse(c *caddy.Controller) (Config, error) {
 				}
 				err := gomods.ParseGomods(c)
 				if err != nil {
-					return Config{}, err
+					return err
 				}
 			}
 
@@ -123,7 +789,7 @@ func parse(c *caddy.Controller) (Config, error) {
 				}
 				err := prometheus.ParsePrometheus(c, c.Val(), c.RemainingArgs()[0])
 				if err != nil {
-					return Config{}, err
+					return err
 				}
 			}
 
@@ -138,12 +804,12 @@ func parse(c *caddy.Controller) (Config, error) {
 					break
 				}
 				if err := tor.ParseTor(c); err != nil {
-					return Config{}, err
+					return err
 				}
 			}
 
 		default:
-			return Config{}, c.ArgErr() // unhandled option
+			return c.ArgErr() // unhandled option
 		}
 	}
 
@@ -152,29 +818,226 @@ func parse(c *caddy.Controller) (Config, error) {
 		enable = allOptions
 	}
 
+	blocks := map[string]bool{"dockerv2": dockerv2Block, "gomods": gomods.Enable, "tor": tor.Enable}
+	if err := requireCapabilities(enable, blocks); err != nil {
+		return c.Errf("%s", err.Error())
+	}
+
 	if gomods.Enable {
 		gomods.SetDefaults()
+		// The temp directory is shared with the other programs
+		if gomods.Cache.MaxSize > 0 && gomods.Cache.Type != "local" {
+			return c.Errf("gomods cache max_size needs the local cache type")
+		}
 	}
 	if prometheus.Enable {
 		prometheus.SetDefaults()
 	}
 	if tor.Enable {
+		if err := tor.LoadKeys(); err != nil {
+			return c.Errf("%s", err.Error())
+		}
 		tor.SetDefaults()
 	}
-
-	config := Config{
-		Enable:     enable,
-		Redirect:   redirect,
-		Resolver:   resolver,
-		LogOutput:  logfile,
-		Gomods:     gomods,
-		Prometheus: prometheus,
-		Tor:        tor,
+	if anyDoH(resolvers) {
+		doh.SetDefaults()
+	}
+	if dnsPolicy.Enable {
+		if err := dnsPolicy.checkFamily(resolvers); err != nil {
+			return c.Errf("%s", err.Error())
+		}
+		dnsPolicy.SetDefaults()
+		if anyDoH(resolvers) && dnsPolicy.pinned() {
+			doh.client = dnsPolicy.httpClient()
+		}
+	}
+	if priority.Enable {
+		priority.SetDefaults()
+	}
+	if adaptive.Enable {
+		adaptive.SetDefaults()
+		if adaptive.MinLimit > adaptive.MaxLimit {
+			return c.Errf("adaptive min_limit can't be greater than max_limit")
+		}
+	}
+	if proxy.Enable {
+		proxy.SetDefaults()
+		if proxy.Cache.Type == "disk" && proxy.Cache.Path == "" {
+			return c.Errf("proxy disk cache needs a path")
+		}
+	}
+	if flatten.Enable {
+		flatten.SetDefaults()
+	}
+	if status.Enable {
+		status.SetDefaults()
+		if status.Host == "" && !admin.Enable {
+			return c.Errf("status needs a host or the admin API")
+		}
+	}
+	if snapshot.Enable {
+		snapshot.SetDefaults()
+		if snapshot.File == "" {
+			return c.Errf("snapshot needs a file")
+		}
+	}
+	if backend.Enable {
+		backend.SetDefaults()
+		if err := backend.validate(); err != nil {
+			return c.Errf("%s", err.Error())
+		}
+	}
+	if overrides.Enable {
+		overrides.SetDefaults()
+		if overrides.File == "" {
+			return c.Errf("overrides needs a file")
+		}
+	}
+	if policy.Enable {
+		policy.SetDefaults()
+	}
+	if qr.Enable || contains(enable, "qr") {
+		qr.SetDefaults()
+	}
+	if preview.Enable {
+		preview.SetDefaults()
+	}
+	if waf.Enable {
+		waf.SetDefaults()
+	}
+	if admin.Enable {
+		admin.SetDefaults()
+		if admin.Token == "" {
+			return c.Errf("admin needs a token")
+		}
+	}
+	if healthCheck.Enable {
+		healthCheck.SetDefaults()
+	}
+	if rateLimit.Enable {
+		rateLimit.SetDefaults()
+	}
+	if clientCerts.Enable {
+		if len(clientCerts.Hosts) == 0 && len(clientCerts.Types) == 0 {
+			return c.Errf("client_certs needs hosts or types")
+		}
+		clientCerts.SetDefaults()
+	}
+	if len(geoPolicy.Hosts) > 0 && !geoip.Enable {
+		return c.Errf("geo_policy needs the geoip database")
+	}
+	if geoip.Enable {
+		geoip.SetDefaults()
+		if geoip.Database == "" {
+			return c.Errf("geoip needs a MaxMind database")
+		}
+	}
+	if tracing.Enable {
+		tracing.SetDefaults()
+	}
+	if tlsAsk.Enable {
+		tlsAsk.SetDefaults()
+	}
+	if probes.Enable {
+		probes.SetDefaults()
+		if probes.HealthPath == probes.ReadyPath {
+			return c.Errf("probes health_path and ready_path can't be the same")
+		}
+	}
+	if honeypot.Enable || contains(enable, "honeypot") {
+		honeypot.SetDefaults()
+	}
+	if contains(enable, "sinkhole") {
+		sinkhole.SetDefaults()
+	}
+	maintenance.SetDefaults()
+	if accessLog.Enable {
+		accessLog.SetDefaults()
+	}
+	if webhooks.Enable {
+		webhooks.SetDefaults()
+		if len(webhooks.Endpoints) == 0 {
+			return c.Errf("webhooks needs an endpoint")
+		}
+		webhooks.queue.metrics = prometheus.Enable
+	}
+	if decisionLog.Enable {
+		decisionLog.SetDefaults()
+		if decisionLog.Sink.Type == "bigquery" && (decisionLog.Sink.Project == "" || decisionLog.Sink.Database == "") {
+			return c.Errf("decisionlog bigquery sink needs a project and a dataset")
+		}
+		if decisionLog.Sink.Enable {
+			decisionLog.Sink.queue.metrics = prometheus.Enable
+		}
+	}
+	if absent.Action == AbsentRedirect && redirect == "" {
+		return c.Errf("absent_action redirect needs the redirect option")
+	}
+	if recordCache.Enable {
+		recordCache.SetDefaults()
+		if recordCache.MinTTL > recordCache.MaxTTL {
+			return c.Errf("cache min_ttl can't be greater than max_ttl")
+		}
 	}
 
-	parseLogfile(logfile)
+	*config = Config{
+		Enable:      enable,
+		Redirect:    redirect,
+		Resolver:    resolver,
+		DoH:         doh,
+		RecordCache: recordCache,
+		Flatten:     flatten,
+		Status:      status,
+		HealthCheck: healthCheck,
+		LogOutput:   logfile,
+		Gomods:      gomods,
+		Prometheus:  prometheus,
+		Tor:         tor,
+		AccessLog:   accessLog,
+		DecisionLog: decisionLog,
+		Webhooks:    webhooks,
+		Sinkhole:    sinkhole,
+		Maintenance: maintenance,
+		Probes:      probes,
+		Honeypot:    honeypot,
+		DNS:         dnsPolicy,
+		Priority:    priority,
+		Adaptive:    adaptive,
+		Dockerv2:    dockerv2,
+		Proxy:       proxy,
+		GeoIP:       geoip,
+		GeoPolicy:   geoPolicy,
+		ClientCerts: clientCerts,
+		RateLimit:   rateLimit,
+		Admin:       admin,
+		Overrides:   overrides,
+		Snapshot:    snapshot,
+		Tracing:     tracing,
+		Policy:      policy,
+		QR:          qr,
+		Preview:     preview,
+		WAF:         waf,
+		Debug:       debug,
 
-	return config, nil
+		Absent:          absent,
+		Templates:       templates,
+		ApexFallback:    apexFallback,
+		Defaults:        defaults,
+		Backend:         backend,
+		IPHosts:         ipHosts,
+		MultipleChoices: multipleChoices,
+		PortZones:       portZones,
+		PreserveMethod:  preserveMethod,
+		HTTPSOnly:       httpsOnly,
+		MaxRequestAge:   maxRequestAge,
+		TLSAsk:          tlsAsk,
+	}
+	if len(resolvers) > 1 {
+		config.Resolvers = resolvers
+		config.resolvers = newResolverPool(resolvers)
+	}
+
+	return nil
 }
 
 func setup(c *caddy.Controller) error {
@@ -200,14 +1063,26 @@ func setup(c *caddy.Controller) error {
 	cfg.AddMiddleware(mid)
 
 	if config.Tor.Enable {
-		torOnce.Do(func() {
-			go config.Tor.Start(c)
-		})
+		start := func() error {
+			go config.Tor.Start(c, TXTdirect{Next: httpserver.EmptyNext, Config: config})
+			return nil
+		}
+		// The instances share the socks port, so the old instance's Tor is
+		// stopped before a reload starts the new one and started again
+		// when the reload fails
+		c.OnStartup(start)
+		c.OnRestart(config.Tor.Stop)
+		c.OnRestartFailed(start)
+		c.OnShutdown(config.Tor.Stop)
 	}
 
-	c.OnShutdown(func() error {
-		return config.Tor.Stop()
-	})
+	startup, shutdown := config.lifecycle()
+	for _, fn := range startup {
+		c.OnStartup(fn)
+	}
+	for _, fn := range shutdown {
+		c.OnShutdown(fn)
+	}
 
 	return nil
 }
@@ -234,21 +1109,69 @@ type TXTdirect struct {
 }
 
 func (rd TXTdirect) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	if err := Redirect(w, r, rd.Config); err != nil {
+	handled, err := rd.Config.Handle(w, r)
+	if !handled {
+		return rd.Next.ServeHTTP(w, r)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+// Handle redirects the request based on TXT records for the servers
+// embedding TXTDirect, e.g. the Caddy v1 middleware and the Caddy v2
+// module. It returns false when the request should be passed to the
+// next handler and the error when the server should serve its own
+// error page.
+func (config Config) Handle(w http.ResponseWriter, r *http.Request) (bool, error) {
+	if err := serve(w, r, config); err != nil {
 		if err.Error() == "option disabled" {
-			return rd.Next.ServeHTTP(w, r)
+			return false, nil
 		}
-		return http.StatusInternalServerError, err
+		if config.Templates.error == nil {
+			return true, err
+		}
+		log.Printf("[txtdirect]: %s", err.Error())
+		config.Templates.serveError(w, r)
 	}
 
 	// Count total redirects if prometheus is enabled
 	if w.Header().Get("Status-Code") == "301" || w.Header().Get("Status-Code") == "302" {
-		if rd.Config.Prometheus.Enable {
+		if config.Prometheus.Enable {
 			RequestsCount.WithLabelValues(r.Host).Add(1)
 		}
 	}
 
-	return 0, nil
+	return true, nil
+}
+
+// Start starts the background work and the metrics of the config for
+// the servers embedding TXTDirect and returns the function stopping it
+func (config *Config) Start() (func() error, error) {
+	parseLogfile(config.LogOutput)
+
+	startup, shutdown := config.lifecycle()
+	if config.Prometheus.Enable {
+		config.Prometheus.SetDefaults()
+		startup = append(startup, config.Prometheus.startStandalone)
+	}
+	stop := func() error {
+		var err error
+		for _, fn := range shutdown {
+			if e := fn(); e != nil && err == nil {
+				err = e
+			}
+		}
+		return err
+	}
+	for _, fn := range startup {
+		if err := fn(); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+	return stop, nil
 }
 
 func parseLogfile(logfile string) {
@@ -268,3 +1191,78 @@ func parseLogfile(logfile string) {
 		})
 	}
 }
+
+// lifecycle returns the functions starting and stopping the background
+// work of the config, shared by Caddy and the standalone server
+func (config *Config) lifecycle() (startup, shutdown []func() error) {
+	// The backends, databases and files are opened first,
+	// since the background work might already need them
+	if config.Backend.Enable {
+		startup = append(startup, config.Backend.Open)
+		shutdown = append(shutdown, config.Backend.Close)
+	}
+
+	if config.GeoIP.Enable {
+		startup = append(startup, config.GeoIP.Open)
+		shutdown = append(shutdown, config.GeoIP.Close)
+	}
+
+	if config.ClientCerts.Enable {
+		startup = append(startup, config.ClientCerts.Load)
+	}
+
+	if config.Proxy.Enable {
+		startup = append(startup, config.Proxy.Cache.Open)
+	}
+
+	if config.HealthCheck.Enable {
+		startup = append(startup, config.HealthCheck.Start)
+		shutdown = append(shutdown, config.HealthCheck.Stop)
+	}
+
+	if config.Webhooks.Enable {
+		startup = append(startup, config.Webhooks.Start)
+		shutdown = append(shutdown, config.Webhooks.Stop)
+	}
+
+	if config.DecisionLog.Sink.Enable {
+		startup = append(startup, config.DecisionLog.Sink.Start)
+		shutdown = append(shutdown, config.DecisionLog.Sink.Stop)
+	}
+
+	if config.RecordCache.Enable && config.RecordCache.Persist != "" {
+		startup = append(startup, func() error {
+			if err := config.RecordCache.Load(); err != nil {
+				log.Printf("[txtdirect]: %s", err.Error())
+			}
+			return nil
+		})
+		shutdown = append(shutdown, config.RecordCache.Save)
+	}
+
+	if config.Status.Enable {
+		startup = append(startup, config.Status.Start)
+		shutdown = append(shutdown, config.Status.Stop)
+	}
+
+	if config.Snapshot.Enable {
+		startup = append(startup, config.Snapshot.Start)
+		shutdown = append(shutdown, config.Snapshot.Stop)
+	}
+
+	if config.Overrides.Enable {
+		startup = append(startup, config.Overrides.Start)
+		shutdown = append(shutdown, config.Overrides.Stop)
+	}
+
+	if config.Tracing.Enable {
+		startup = append(startup, config.Tracing.Start)
+		shutdown = append(shutdown, config.Tracing.Stop)
+	}
+
+	if config.Gomods.Enable {
+		startup = append(startup, config.Gomods.Cache.Start)
+		shutdown = append(shutdown, config.Gomods.Cache.Stop)
+	}
+	return startup, shutdown
+}
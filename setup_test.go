@@ -1,3 +1,6 @@
+//go:build !notor && !nogomods && !nodocker
+// +build !notor,!nogomods,!nodocker
+
 /*
 Copyright 2017 - The TXTDirect Authors
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -15,10 +18,13 @@ package txtdirect
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 
@@ -310,6 +316,97 @@ func TestCaddyParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			`
+			txtdirect {
+				enable host gomods
+				redirect https://example.com
+				gomods {
+					gobinary /my/go/binary
+					route github.com/corp/* direct
+					route * https://proxy.golang.org direct
+				}
+				resolver 127.0.0.1
+			}
+			`,
+			false,
+			Config{
+				Redirect: "https://example.com",
+				Enable:   []string{"host", "gomods"},
+				Resolver: "127.0.0.1",
+				Gomods: Gomods{
+					Enable:   true,
+					GoBinary: "/my/go/binary",
+					Workers:  1,
+					Routes: []GomodsRoute{
+						{Pattern: "github.com/corp/*", Upstreams: []string{"direct"}},
+						{Pattern: "*", Upstreams: []string{"https://proxy.golang.org", "direct"}},
+					},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host gomods
+				gomods {
+					route * ftp://proxy.example.com
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host gomods
+				redirect https://example.com
+				gomods {
+					gobinary /my/go/binary
+					cache {
+						type local
+						path /my/cache/path
+						max_size 1073741824
+						janitor_interval 1h
+					}
+				}
+				resolver 127.0.0.1
+			}
+			`,
+			false,
+			Config{
+				Redirect: "https://example.com",
+				Enable:   []string{"host", "gomods"},
+				Resolver: "127.0.0.1",
+				Gomods: Gomods{
+					Enable:   true,
+					GoBinary: "/my/go/binary",
+					Workers:  1,
+					Cache: Cache{
+						Enable:          true,
+						Type:            "local",
+						Path:            "/my/cache/path",
+						MaxSize:         1073741824,
+						JanitorInterval: time.Hour,
+					},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host gomods
+				gomods {
+					cache {
+						max_size 1073741824
+					}
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
 		{
 			`
 			txtdirect {
@@ -382,92 +479,1057 @@ func TestCaddyParse(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	for i, test := range tests {
-		log.Println(log.Flags())
-		c := caddy.NewTestController("http", test.input)
-		conf, err := parse(c)
-		if !test.shouldErr && err != nil {
-			t.Errorf("Test %d: Unexpected error %s", i, err)
-			continue
-		}
-		if test.shouldErr {
-			if err == nil {
-				t.Errorf("Test %d: Expected error", i)
+		{
+			`
+			txtdirect {
+				enable host
+				resolver https://cloudflare-dns.com/dns-query
 			}
-			continue
-		}
-
-		// Check configs for each enabled type
-		for _, e := range conf.Enable {
-			switch e {
-			case "gomods":
-				// Fs field gets filled by default when parsing the config
-				test.expected.Gomods.Fs = conf.Gomods.Fs
-				// Set the default cache path for expected config if cache type is tmp
-				if conf.Gomods.Cache.Type == "tmp" {
-					test.expected.Gomods.Cache.Path = afero.GetTempDir(test.expected.Gomods.Fs, "")
+			`,
+			false,
+			Config{
+				Enable:   []string{"host"},
+				Resolver: "https://cloudflare-dns.com/dns-query",
+				DoH: DoH{
+					Timeout: DefaultDoHTimeout,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver https://cloudflare-dns.com/dns-query {
+					timeout 2s
+					fallback true
 				}
-
-				if conf.Gomods != test.expected.Gomods {
-					t.Errorf("Expected %+v for gomods config got %+v", test.expected.Gomods, conf.Gomods)
+			}
+			`,
+			false,
+			Config{
+				Enable:   []string{"host"},
+				Resolver: "https://cloudflare-dns.com/dns-query",
+				DoH: DoH{
+					Timeout:  2 * time.Second,
+					Fallback: true,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1:53 127.0.0.2:53 https://cloudflare-dns.com/dns-query {
+					timeout 2s
 				}
-			case "tor":
-				if conf.Tor.Port != test.expected.Tor.Port {
-					t.Errorf("Expected the onion service port to be %d but got %d", test.expected.Tor.Port, conf.Tor.Port)
+			}
+			`,
+			false,
+			Config{
+				Enable:    []string{"host"},
+				Resolver:  "127.0.0.1:53",
+				Resolvers: []string{"127.0.0.1:53", "127.0.0.2:53", "https://cloudflare-dns.com/dns-query"},
+				DoH: DoH{
+					Timeout: 2 * time.Second,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver 127.0.0.1 {
+					timeout 2s
 				}
 			}
-		}
-
-		if test.expected.Prometheus.Enable == true {
-			if conf.Prometheus != test.expected.Prometheus {
-				t.Errorf("Expected %+v for prometheus config got %+v", test.expected.Prometheus, conf.Prometheus)
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				resolver https://cloudflare-dns.com/dns-query {
+					timeout soon
+				}
 			}
-		}
-
-		if test.expected.Resolver != conf.Resolver {
-			t.Errorf("Expected resolver to be %s, but got %s", test.expected.Resolver, conf.Resolver)
-		}
-
-		if test.expected.LogOutput != conf.LogOutput {
-			t.Errorf("Expected log output to be %s, but got %s", test.expected.LogOutput, conf.LogOutput)
-		}
-
-		if !identical(conf.Enable, test.expected.Enable) {
-			options := fmt.Sprintf("[ %s ]", strings.Join(conf.Enable, ", "))
-			expected := fmt.Sprintf("[ %s ]", strings.Join(test.expected.Enable, ", "))
-			t.Errorf("Test %d: Expected options %s, got %s", i, expected, options)
-		}
-	}
-}
-
-func identical(s1, s2 []string) bool {
-	if s1 == nil {
-		if s2 == nil {
-			return true
-		}
-		return false
-	}
-	if s2 == nil {
-		return false
-	}
-
-	if len(s1) != len(s2) {
-		return false
-	}
-
-	for i := range s1 {
-		found := false
-		for j := range s2 {
-			if s1[i] == s2[j] {
-				found = true
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache
 			}
-		}
-
-		if !found {
-			return false
-		}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				RecordCache: RecordCache{
+					Enable:     true,
+					MinTTL:     DefaultCacheMinTTL,
+					MaxTTL:     DefaultCacheMaxTTL,
+					MaxEntries: DefaultCacheMaxEntries,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache {
+					min_ttl 10s
+					max_ttl 5m
+					max_entries 500
+					serve_stale 1h
+					negative_ttl 30s
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				RecordCache: RecordCache{
+					Enable:      true,
+					MinTTL:      10 * time.Second,
+					MaxTTL:      5 * time.Minute,
+					MaxEntries:  500,
+					ServeStale:  time.Hour,
+					NegativeTTL: 30 * time.Second,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache {
+					min_ttl 10m
+					max_ttl 5m
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				cache {
+					max_entries 0
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				flatten
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Flatten: Flatten{
+					Enable:   true,
+					MaxDepth: DefaultFlattenDepth,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				flatten 5
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Flatten: Flatten{
+					Enable:   true,
+					MaxDepth: 5,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				flatten many
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host path
+				prometheus {
+					slo 0.99
+					slo path=0.95
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host", "path"},
+				Prometheus: Prometheus{
+					Enable:    true,
+					Address:   "localhost:9183",
+					Path:      "/metrics",
+					RulesPath: "/rules",
+					SLO:       0.99,
+					TypeSLOs:  map[string]float64{"path": 0.95},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				prometheus {
+					rules_path /slo-rules
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Prometheus: Prometheus{
+					Enable:    true,
+					Address:   "localhost:9183",
+					Path:      "/metrics",
+					RulesPath: "/slo-rules",
+					SLO:       DefaultSLOTarget,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				prometheus {
+					slo 99.9
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				status {
+					host Status.example.com
+					path /_status
+					hosts example.com example.org
+					check_targets 2s
+					check_interval 5m
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Status: Status{
+					Enable:        true,
+					Host:          "status.example.com",
+					Path:          "/_status",
+					Hosts:         []string{"example.com", "example.org"},
+					CheckTargets:  true,
+					CheckTimeout:  2 * time.Second,
+					CheckInterval: 5 * time.Minute,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				status
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				status {
+					host status.example.com
+					check_interval 0s
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				healthcheck {
+					interval 1m
+					timeout 2s
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				HealthCheck: HealthCheck{
+					Enable:   true,
+					Interval: time.Minute,
+					Timeout:  2 * time.Second,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				healthcheck {
+					interval -1m
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				healthcheck {
+					timeout 0s
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				accesslog stderr {
+					redact client_ip path
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				AccessLog: AccessLog{
+					Enable: true,
+					Output: "stderr",
+					Redact: []string{"client_ip", "path"},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				accesslog
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				AccessLog: AccessLog{
+					Enable: true,
+					Output: "stdout",
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				accesslog {
+					redact password
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host sinkhole
+				sinkhole {
+					code 451
+					body "Unavailable"
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host", "sinkhole"},
+				Sinkhole: Sinkhole{
+					Code:        451,
+					Body:        "Unavailable",
+					ContentType: DefaultSinkholeContentType,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				sinkhole {
+					code 1000
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				probes {
+					hosts Localhost 10.0.0.1:8080
+					health_path /healthz
+					timeout 1s
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Probes: Probes{
+					Enable:     true,
+					Hosts:      []string{"localhost", "10.0.0.1"},
+					HealthPath: "/healthz",
+					ReadyPath:  DefaultReadyPath,
+					Timeout:    time.Second,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				probes {
+					ready_path /health
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host honeypot
+				honeypot {
+					user_agents badbot
+					paths /cgi-bin/ /.aws/
+					delay 3s
+					logfile stderr
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host", "honeypot"},
+				Honeypot: Honeypot{
+					Enable:     true,
+					UserAgents: []string{"badbot"},
+					Paths:      []string{"/cgi-bin/", "/.aws/"},
+					Delay:      3 * time.Second,
+					LogOutput:  "stderr",
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				dns {
+					timeout 2s
+					retries 3
+					zone example.com 500ms
+					zone slow.example.com 10s 1
+					ratelimit_backoff 2s
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				DNS: DNS{
+					Enable:  true,
+					Timeout: 2 * time.Second,
+					Retries: 3,
+					Backoff: DefaultDNSBackoff,
+					Zones: map[string]dnsPolicy{
+						"example.com":      {Timeout: 500 * time.Millisecond, Retries: -1},
+						"slow.example.com": {Timeout: 10 * time.Second, Retries: 1},
+					},
+					RateLimitBackoff:    2 * time.Second,
+					RateLimitMaxBackoff: DefaultRateLimitMaxBackoff,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				dns {
+					retries -1
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				priority {
+					bulk_concurrency 8
+					bulk_resolver_budget 2
+					queue_timeout 1s
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Priority: Priority{
+					Enable:                    true,
+					InteractiveConcurrency:    DefaultInteractiveConcurrency,
+					BulkConcurrency:           8,
+					InteractiveResolverBudget: DefaultInteractiveResolverBudget,
+					BulkResolverBudget:        2,
+					QueueTimeout:              time.Second,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				priority {
+					bulk_concurrency 0
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable proxy
+				proxy {
+					timeout 10s
+					max_body_size 1024
+					stream
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"proxy"},
+				Proxy: Proxy{
+					Enable:      true,
+					Timeout:     10 * time.Second,
+					MaxBodySize: 1024,
+					Stream:      true,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable proxy
+				proxy {
+					h2c grpc.internal *.mesh.local
+					credentials api.internal basic user pass
+					credentials *.Svc.local bearer token
+					credentials grpc.internal header x-api-key key-{host}
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"proxy"},
+				Proxy: Proxy{
+					Enable:      true,
+					Timeout:     proxyTimeout,
+					MaxBodySize: DefaultProxyMaxBodySize,
+					H2C:         []string{"grpc.internal", "*.mesh.local"},
+					Credentials: []ProxyCredential{
+						{Host: "api.internal", Type: "basic", Header: "Authorization", Value: "Basic dXNlcjpwYXNz"},
+						{Host: "*.svc.local", Type: "bearer", Header: "Authorization", Value: "Bearer token"},
+						{Host: "grpc.internal", Type: "header", Header: "X-Api-Key", Value: "key-{host}"},
+					},
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable proxy
+				proxy {
+					max_body_size big
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable proxy
+				proxy {
+					credentials api.internal basic user
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				adaptive {
+					max_limit 64
+					latency_threshold 2s
+					decrease_factor 0.7
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Adaptive: Adaptive{
+					Enable:           true,
+					MinLimit:         DefaultAdaptiveMinLimit,
+					MaxLimit:         64,
+					InitialLimit:     DefaultAdaptiveInitialLimit,
+					LatencyThreshold: 2 * time.Second,
+					DecreaseFactor:   0.7,
+					QueueTimeout:     DefaultAdaptiveQueueTimeout,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				adaptive {
+					decrease_factor 1.5
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				adaptive {
+					min_limit 10
+					max_limit 5
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				ratelimit {
+					rate 0.5
+					key host
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				RateLimit: RateLimit{
+					Enable: true,
+					Rate:   0.5,
+					Burst:  DefaultRateLimitBurst,
+					Key:    "host",
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				ratelimit {
+					key path
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				tracing {
+					endpoint collector:4318
+					insecure
+					sample_ratio 0.25
+				}
+			}
+			`,
+			false,
+			Config{
+				Enable: []string{"host"},
+				Tracing: Tracing{
+					Enable:      true,
+					Endpoint:    "collector:4318",
+					URLPath:     DefaultTracingURLPath,
+					Insecure:    true,
+					ServiceName: DefaultTracingServiceName,
+					SampleRatio: 0.25,
+				},
+			},
+		},
+		{
+			`
+			txtdirect {
+				tracing {
+					sample_ratio 2
+				}
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				preserve_method
+			}
+			`,
+			false,
+			Config{
+				Enable:         []string{"host"},
+				PreserveMethod: true,
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				https_only
+			}
+			`,
+			false,
+			Config{
+				Enable:    []string{"host"},
+				HTTPSOnly: true,
+			},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				https_only always
+			}
+			`,
+			true,
+			Config{},
+		},
+		{
+			`
+			txtdirect {
+				enable host
+				redirect https://example.com https://example.org
+			}
+			`,
+			false,
+			Config{
+				Enable:   []string{"host"},
+				Redirect: "https://example.com,https://example.org",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		log.Println(log.Flags())
+		c := caddy.NewTestController("http", test.input)
+		conf, err := parse(c)
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Unexpected error %s", i, err)
+			continue
+		}
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error", i)
+			}
+			continue
+		}
+
+		// Check configs for each enabled type
+		for _, e := range conf.Enable {
+			switch e {
+			case "gomods":
+				// Fs field gets filled by default when parsing the config
+				test.expected.Gomods.Fs = conf.Gomods.Fs
+				conf.Gomods.Cache.janitor = nil
+				conf.Gomods.home = nil
+				// Set the default cache path for expected config if cache type is tmp
+				if conf.Gomods.Cache.Type == "tmp" {
+					test.expected.Gomods.Cache.Path = afero.GetTempDir(test.expected.Gomods.Fs, "")
+				}
+
+				if !reflect.DeepEqual(conf.Gomods, test.expected.Gomods) {
+					t.Errorf("Expected %+v for gomods config got %+v", test.expected.Gomods, conf.Gomods)
+				}
+			case "tor":
+				if conf.Tor.Port != test.expected.Tor.Port {
+					t.Errorf("Expected the onion service port to be %d but got %d", test.expected.Tor.Port, conf.Tor.Port)
+				}
+			}
+		}
+
+		if test.expected.Prometheus.Enable == true {
+			if !reflect.DeepEqual(conf.Prometheus, test.expected.Prometheus) {
+				t.Errorf("Expected %+v for prometheus config got %+v", test.expected.Prometheus, conf.Prometheus)
+			}
+		}
+
+		if test.expected.Redirect != conf.Redirect {
+			t.Errorf("Expected redirect to be %s, but got %s", test.expected.Redirect, conf.Redirect)
+		}
+
+		if test.expected.Resolver != conf.Resolver {
+			t.Errorf("Expected resolver to be %s, but got %s", test.expected.Resolver, conf.Resolver)
+		}
+
+		if !identical(test.expected.Resolvers, conf.Resolvers) || (len(conf.Resolvers) > 1) != (conf.resolvers != nil) {
+			t.Errorf("Expected resolvers to be %v, but got %v", test.expected.Resolvers, conf.Resolvers)
+		}
+
+		if test.expected.DoH != conf.DoH {
+			t.Errorf("Expected %+v for DoH config, but got %+v", test.expected.DoH, conf.DoH)
+		}
+
+		if test.expected.RecordCache.Enable != conf.RecordCache.Enable ||
+			test.expected.RecordCache.MinTTL != conf.RecordCache.MinTTL ||
+			test.expected.RecordCache.MaxTTL != conf.RecordCache.MaxTTL ||
+			test.expected.RecordCache.MaxEntries != conf.RecordCache.MaxEntries ||
+			test.expected.RecordCache.ServeStale != conf.RecordCache.ServeStale ||
+			test.expected.RecordCache.NegativeTTL != conf.RecordCache.NegativeTTL {
+			t.Errorf("Expected %+v for record cache config, but got %+v", test.expected.RecordCache, conf.RecordCache)
+		}
+
+		if test.expected.Flatten != conf.Flatten {
+			t.Errorf("Expected %+v for flatten config, but got %+v", test.expected.Flatten, conf.Flatten)
+		}
+
+		if test.expected.Status.Enable && (test.expected.Status.Host != conf.Status.Host ||
+			test.expected.Status.Path != conf.Status.Path ||
+			!identical(test.expected.Status.Hosts, conf.Status.Hosts) ||
+			test.expected.Status.CheckTargets != conf.Status.CheckTargets ||
+			test.expected.Status.CheckTimeout != conf.Status.CheckTimeout ||
+			test.expected.Status.CheckInterval != conf.Status.CheckInterval) {
+			t.Errorf("Expected %+v for status config, but got %+v", test.expected.Status, conf.Status)
+		}
+
+		if test.expected.HealthCheck.Enable && (test.expected.HealthCheck.Interval != conf.HealthCheck.Interval ||
+			test.expected.HealthCheck.Timeout != conf.HealthCheck.Timeout) {
+			t.Errorf("Expected %+v for health check config, but got %+v", test.expected.HealthCheck, conf.HealthCheck)
+		}
+
+		if test.expected.AccessLog.Enable != conf.AccessLog.Enable ||
+			test.expected.AccessLog.Output != conf.AccessLog.Output ||
+			!identical(test.expected.AccessLog.Redact, conf.AccessLog.Redact) {
+			t.Errorf("Expected %+v for access log config, but got %+v", test.expected.AccessLog, conf.AccessLog)
+		}
+
+		// The backoff tracker gets created when parsing the config
+		dnsConf := conf.DNS
+		dnsConf.backoff = nil
+		if !reflect.DeepEqual(test.expected.DNS, dnsConf) {
+			t.Errorf("Expected %+v for dns config, but got %+v", test.expected.DNS, dnsConf)
+		}
+
+		priorityConf := conf.Priority
+		priorityConf.pools = nil
+		if test.expected.Priority != priorityConf {
+			t.Errorf("Expected %+v for priority config, but got %+v", test.expected.Priority, priorityConf)
+		}
+
+		adaptiveConf := conf.Adaptive
+		adaptiveConf.limiters = nil
+		if test.expected.Adaptive != adaptiveConf {
+			t.Errorf("Expected %+v for adaptive config, but got %+v", test.expected.Adaptive, adaptiveConf)
+		}
+
+		rateLimitConf := conf.RateLimit
+		rateLimitConf.buckets = nil
+		if test.expected.RateLimit != rateLimitConf {
+			t.Errorf("Expected %+v for rate limit config, but got %+v", test.expected.RateLimit, rateLimitConf)
+		}
+
+		if test.expected.HTTPSOnly != conf.HTTPSOnly {
+			t.Errorf("Expected https_only to be %t, but got %t", test.expected.HTTPSOnly, conf.HTTPSOnly)
+		}
+		if test.expected.PreserveMethod != conf.PreserveMethod {
+			t.Errorf("Expected preserve_method to be %t, but got %t", test.expected.PreserveMethod, conf.PreserveMethod)
+		}
+
+		tracingConf := conf.Tracing
+		tracingConf.exporter = nil
+		if !reflect.DeepEqual(test.expected.Tracing, tracingConf) {
+			t.Errorf("Expected %+v for tracing config, but got %+v", test.expected.Tracing, tracingConf)
+		}
+
+		if !reflect.DeepEqual(test.expected.Proxy, conf.Proxy) {
+			t.Errorf("Expected %+v for proxy config, but got %+v", test.expected.Proxy, conf.Proxy)
+		}
+
+		if !reflect.DeepEqual(test.expected.Probes, conf.Probes) {
+			t.Errorf("Expected %+v for probes config, but got %+v", test.expected.Probes, conf.Probes)
+		}
+
+		if test.expected.Honeypot.Enable && (!identical(test.expected.Honeypot.UserAgents, conf.Honeypot.UserAgents) ||
+			!identical(test.expected.Honeypot.Paths, conf.Honeypot.Paths) ||
+			test.expected.Honeypot.Delay != conf.Honeypot.Delay ||
+			test.expected.Honeypot.LogOutput != conf.Honeypot.LogOutput) {
+			t.Errorf("Expected %+v for honeypot config, but got %+v", test.expected.Honeypot, conf.Honeypot)
+		}
+
+		if test.expected.Sinkhole != conf.Sinkhole {
+			t.Errorf("Expected %+v for sinkhole config, but got %+v", test.expected.Sinkhole, conf.Sinkhole)
+		}
+
+		if test.expected.LogOutput != conf.LogOutput {
+			t.Errorf("Expected log output to be %s, but got %s", test.expected.LogOutput, conf.LogOutput)
+		}
+
+		if !identical(conf.Enable, test.expected.Enable) {
+			options := fmt.Sprintf("[ %s ]", strings.Join(conf.Enable, ", "))
+			expected := fmt.Sprintf("[ %s ]", strings.Join(test.expected.Enable, ", "))
+			t.Errorf("Test %d: Expected options %s, got %s", i, expected, options)
+		}
+	}
+}
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host path
+		redirect https://example.com
+		logfile stderr
+	}
+	`)
+	var config Config
+	if err := config.UnmarshalCaddyfile(c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !identical(config.Enable, []string{"host", "path"}) {
+		t.Errorf("Expected host and path to be enabled, got %v", config.Enable)
+	}
+	if config.Redirect != "https://example.com" {
+		t.Errorf("Expected redirect to be https://example.com, got %s", config.Redirect)
+	}
+	if config.LogOutput != "stderr" {
+		t.Errorf("Expected log output to be stderr, got %s", config.LogOutput)
+	}
+}
+
+func TestParseApexFallback(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  []string
+		shouldErr bool
+	}{
+		{"apex_fallback", DefaultApexFallback, false},
+		{"apex_fallback _redirect.{host}.example.com", []string{"_redirect.{host}.example.com"}, false},
+		{"apex_fallback _redirect.apex.example.com", nil, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !identical(conf.ApexFallback, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, conf.ApexFallback)
+		}
+	}
+}
+
+func TestConfigStartResources(t *testing.T) {
+	zone, err := ioutil.TempFile("", "records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(zone.Name())
+	zone.WriteString(`_redirect.start.test. 300 IN TXT "v=txtv0;to=https://example.com;type=host"` + "\n")
+	zone.Close()
+
+	conf, err := parse(caddy.NewTestController("http", fmt.Sprintf(`
+	txtdirect {
+		enable host
+		backend file %s
+		geoip {
+			database testdata/GeoIP2-City-Test.mmdb
+		}
+	}
+	`, zone.Name())))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.Backend.resolver() != nil || conf.GeoIP.lookup("81.2.69.160").Country != "" {
+		t.Fatalf("Expected the resources to be opened at startup rather than while parsing")
+	}
+
+	// The middleware gets the copy of the config before the startup hooks
+	copied := conf
+	stop, err := conf.Start()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := copied.Backend.resolver().(*fileResolver); !ok {
+		t.Errorf("Expected the copied config to use the opened backend")
+	}
+	if country := copied.GeoIP.lookup("81.2.69.160").Country; country != "GB" {
+		t.Errorf("Expected the copied config to use the opened database, got %q", country)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if copied.GeoIP.lookup("81.2.69.160").Country != "" {
+		t.Errorf("Expected the database to be closed at shutdown")
 	}
-	return true
 }
@@ -0,0 +1,91 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// shadowTimeout limits resolving the DNS decision of an overridden request
+const shadowTimeout = 5 * time.Second
+
+// shadow resolves the decision the DNS records would have made for the
+// overridden request and records whether it differs from the override's,
+// so the drift between DNS and the override file shows up. It runs after
+// the response is served, detached from the request's context.
+func (o *Overrides) shadow(r *http.Request, status int, location string, c Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	r, info := withRequestInfo(r.WithContext(ctx))
+	// The upstreams aren't fetched from for the shadow decision
+	info.preview = true
+	c.Overrides.Enable = false
+	c.RateLimit.Enable = false
+
+	rec := &redirectRecorder{header: make(http.Header)}
+	if err := Redirect(rec, r, c); err != nil && err.Error() != "option disabled" {
+		log.Printf("[txtdirect]: Couldn't resolve the DNS decision of %s: %s", r.Host+r.URL.Path, err.Error())
+		return
+	}
+	dnsLocation := rec.header.Get("Location")
+	if dnsLocation == "" {
+		dnsLocation = info.target
+	}
+
+	result := "same"
+	switch {
+	case len(info.Records) == 0:
+		result = "missing"
+	case rec.status != status || dnsLocation != location:
+		result = "different"
+		log.Printf("[txtdirect]: The override of %s differs from its DNS records: %d %s instead of %d %s",
+			r.Host+r.URL.Path, status, location, rec.status, dnsLocation)
+	}
+	if c.Prometheus.Enable {
+		RecordSources.WithLabelValues(r.Host, "override", "override", result).Add(1)
+	}
+}
+
+// compareSnapshot records whether the resolved records of the zone
+// differ from the ones kept in the snapshot, e.g. the imported ones
+func compareSnapshot(zone string, txts []string, c Config) {
+	previous, ok := c.Snapshot.get(zone)
+	if !ok {
+		return
+	}
+	result := "same"
+	if !sameTXTs(previous, txts) {
+		result = "different"
+		log.Printf("[txtdirect]: The DNS records of %s differ from the snapshot's: %q instead of %q", zone, txts, previous)
+	}
+	if c.Prometheus.Enable {
+		RecordSources.WithLabelValues(zone, "snapshot", "dns", result).Add(1)
+	}
+}
+
+// sameTXTs checks if both lists hold the same records in the same order
+func sameTXTs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOverridesShadow(t *testing.T) {
+	c := Config{
+		Enable:     []string{"host"},
+		Resolver:   "127.0.0.1:" + strconv.Itoa(port),
+		Prometheus: Prometheus{Enable: true},
+	}
+	tests := []struct {
+		url      string
+		status   int
+		location string
+		result   string
+	}{
+		{"https://host.e2e.test/", 302, "https://plain.host.test", "same"},
+		{"https://host.e2e.test/", 302, "https://emergency.example.com", "different"},
+		{"https://host.e2e.test/", 403, "", "different"},
+		{"https://nomatch.shadow.test/", 302, "https://emergency.example.com", "missing"},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", test.url, nil)
+		counter := RecordSources.WithLabelValues(r.Host, "override", "override", test.result)
+		before := testutil.ToFloat64(counter)
+		c.Overrides.shadow(r, test.status, test.location, c)
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("Test %d: Expected the %s decision to be counted", i, test.result)
+		}
+	}
+}
+
+func TestOverridesShadowServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shadow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "overrides.yaml")
+	ioutil.WriteFile(file, []byte(`
+overrides:
+  - host: host.e2e.test
+    to: https://emergency.example.com
+`), 0644)
+
+	c := Config{
+		Enable:     []string{"host"},
+		Resolver:   "127.0.0.1:" + strconv.Itoa(port),
+		Overrides:  Overrides{Enable: true, File: file, Shadow: true},
+		Prometheus: Prometheus{Enable: true},
+	}
+	c.Overrides.SetDefaults()
+	if err := c.Overrides.Load(); err != nil {
+		t.Fatal(err)
+	}
+	counter := RecordSources.WithLabelValues("host.e2e.test", "override", "override", "different")
+	before := testutil.ToFloat64(counter)
+
+	w := httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://host.e2e.test/", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := w.Header().Get("Location"); location != "https://emergency.example.com" {
+		t.Errorf("Expected the override to win, got %s", location)
+	}
+	// The shadow decision is resolved in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(counter) == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if testutil.ToFloat64(counter) != before+1 {
+		t.Errorf("Expected the drift between the override and DNS to be counted")
+	}
+}
+
+func TestCompareSnapshot(t *testing.T) {
+	c := Config{
+		Snapshot:   Snapshot{Enable: true},
+		Prometheus: Prometheus{Enable: true},
+	}
+	c.Snapshot.SetDefaults()
+	zone := "_redirect.compare.shadow.test."
+	same := RecordSources.WithLabelValues(zone, "snapshot", "dns", "same")
+	different := RecordSources.WithLabelValues(zone, "snapshot", "dns", "different")
+	// The counters are global, so only their changes are checked
+	beforeSame, beforeDifferent := testutil.ToFloat64(same), testutil.ToFloat64(different)
+	counted := func() (float64, float64) {
+		return testutil.ToFloat64(same) - beforeSame, testutil.ToFloat64(different) - beforeDifferent
+	}
+
+	// Nothing gets compared without a kept record
+	compareSnapshot(zone, []string{"v=txtv0;to=https://a.example.com"}, c)
+	if sameCount, differentCount := counted(); sameCount+differentCount != 0 {
+		t.Errorf("Expected no comparison without a kept record")
+	}
+	c.Snapshot.set(zone, []string{"v=txtv0;to=https://a.example.com"})
+	compareSnapshot(zone, []string{"v=txtv0;to=https://a.example.com"}, c)
+	compareSnapshot(zone, []string{"v=txtv0;to=https://b.example.com"}, c)
+	if sameCount, differentCount := counted(); sameCount != 1 || differentCount != 1 {
+		t.Errorf("Expected one same and one different comparison, got %v and %v", sameCount, differentCount)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Sinkhole contains the static response served for sinkhole records
+type Sinkhole struct {
+	Code        int
+	Body        string
+	ContentType string
+}
+
+const (
+	DefaultSinkholeCode        = http.StatusNotFound
+	DefaultSinkholeContentType = "text/plain; charset=utf-8"
+)
+
+// SetDefaults sets the default values for sinkhole config
+// if the fields are empty
+func (s *Sinkhole) SetDefaults() {
+	if s.Code == 0 {
+		s.Code = DefaultSinkholeCode
+	}
+	if s.ContentType == "" {
+		s.ContentType = DefaultSinkholeContentType
+	}
+}
+
+// serve answers the request with the static sinkhole response without
+// contacting any upstream. The record's code overrides the configured one.
+func (s *Sinkhole) serve(w http.ResponseWriter, rec record) {
+	code := s.Code
+	if rec.Code != 0 {
+		code = rec.Code
+	}
+	body := s.Body
+	if body == "" {
+		body = http.StatusText(code)
+	}
+	w.Header().Set("Content-Type", s.ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Status-Code", strconv.Itoa(code))
+	w.WriteHeader(code)
+	w.Write([]byte(body))
+}
+
+// ParseSinkhole parses the txtdirect config for the sinkhole type
+func (s *Sinkhole) ParseSinkhole(c Dispenser) error {
+	switch c.Val() {
+	case "code":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 100 || value > 599 {
+			return fmt.Errorf("The given value for code field is not standard. It should be an HTTP status code")
+		}
+		s.Code = value
+
+	case "body":
+		s.Body = c.RemainingArgs()[0]
+
+	case "content_type":
+		s.ContentType = c.RemainingArgs()[0]
+
+	default:
+		return c.ArgErr() // unhandled option for sinkhole
+	}
+	return nil
+}
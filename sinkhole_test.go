@@ -0,0 +1,86 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSinkholeE2e(t *testing.T) {
+	tests := []struct {
+		url      string
+		sinkhole Sinkhole
+		status   int
+		body     string
+	}{
+		{
+			"https://default.sinkhole.test/login",
+			Sinkhole{},
+			404,
+			"Not Found",
+		},
+		{
+			"https://gone.sinkhole.test/login",
+			Sinkhole{},
+			410,
+			"Gone",
+		},
+		{
+			"https://default.sinkhole.test/login",
+			Sinkhole{Code: 451, Body: "This domain has been taken down"},
+			451,
+			"This domain has been taken down",
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   []string{"host", "sinkhole"},
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Sinkhole: test.sinkhole,
+		}
+		c.Sinkhole.SetDefaults()
+
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, w.Body.String())
+		}
+		if location := w.Header().Get("Location"); location != "" {
+			t.Errorf("Test %d: Expected no redirect, got %s", i, location)
+		}
+	}
+}
+
+func TestSinkholeDisabled(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Redirect: "https://fallback.test",
+	}
+	w := httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://default.sinkhole.test/", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := w.Header().Get("Location"); location != "https://fallback.test" {
+		t.Errorf("Expected the global fallback for a disabled sinkhole type, got %q", location)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// DefaultSLOTarget is the availability target used when only the rules endpoint is enabled
+	DefaultSLOTarget = 0.999
+	// prometheusRulesPath is the path where the generated rules are served by default
+	prometheusRulesPath = "/rules"
+)
+
+// sloWindows are the windows used for the recording rules
+var sloWindows = []string{"5m", "30m", "1h", "2h", "6h", "1d", "3d"}
+
+// burnRateAlert is a multiwindow burn rate alert as described in
+// https://landing.google.com/sre/workbook/chapters/alerting-on-slos/
+type burnRateAlert struct {
+	Severity    string
+	LongWindow  string
+	ShortWindow string
+	Factor      float64
+}
+
+var burnRateAlerts = []burnRateAlert{
+	{"page", "1h", "5m", 14.4},
+	{"page", "6h", "30m", 6},
+	{"ticket", "1d", "2h", 3},
+	{"ticket", "3d", "6h", 1},
+}
+
+// sloObjective is an SLO target for a set of record types
+type sloObjective struct {
+	Selector string
+	Target   string
+	Budget   string
+}
+
+var rulesTmpl = template.Must(template.New("").Parse(`groups:
+- name: txtdirect-slo-recording
+  rules:
+{{- range .Windows}}
+  - record: txtdirect:fallback_ratio:rate{{.}}
+    expr: |
+      sum by (host, type) (rate(txtdirect_fallback_type_count_total[{{.}}]))
+      /
+      sum by (host, type) (rate(txtdirect_redirect_type_count_total[{{.}}]))
+{{- end}}
+- name: txtdirect-gomods-recording
+  rules:
+  - record: txtdirect:gomods_cache_hit_ratio:rate5m
+    expr: |
+      sum(rate(txtdirect_response_cache_total{type="gomods",result="hit"}[5m]))
+      /
+      sum(rate(txtdirect_response_cache_total{type="gomods"}[5m]))
+  - record: txtdirect:gomods_upstream_duration_seconds:p95_5m
+    expr: |
+      histogram_quantile(0.95, sum by (operation, le) (rate(txtdirect_gomods_upstream_duration_seconds_bucket[5m])))
+  - record: txtdirect:gomods_error_ratio:rate5m
+    expr: |
+      sum by (result) (rate(txtdirect_gomods_requests_total{result!~"ok|not_found"}[5m]))
+      / ignoring (result) group_left
+      sum(rate(txtdirect_gomods_requests_total[5m]))
+- name: txtdirect-slo-alerts
+  rules:
+{{- range $o := .Objectives}}
+{{- range $.Alerts}}
+  - alert: TXTDirectErrorBudgetBurn
+    expr: |
+      txtdirect:fallback_ratio:rate{{.LongWindow}}{{$o.Selector}} > ({{.Factor}} * {{$o.Budget}})
+      and
+      txtdirect:fallback_ratio:rate{{.ShortWindow}}{{$o.Selector}} > ({{.Factor}} * {{$o.Budget}})
+    labels:
+      severity: {{.Severity}}
+      slo: "{{$o.Target}}"
+    annotations:
+      summary: "{{"{{"}} $labels.host {{"}}"}} ({{"{{"}} $labels.type {{"}}"}}) is burning its error budget {{.Factor}}x faster than allowed"
+{{- end}}
+{{- end}}
+`))
+
+// Rules generates Prometheus recording and alerting rules based
+// on txtdirect's metrics and the configured SLO targets
+func (p *Prometheus) Rules() ([]byte, error) {
+	var types []string
+	for t := range p.TypeSLOs {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	objectives := []sloObjective{}
+	for _, t := range types {
+		objectives = append(objectives, newSLOObjective(fmt.Sprintf("{type=%q}", t), p.TypeSLOs[t]))
+	}
+
+	selector := ""
+	if len(types) > 0 {
+		selector = fmt.Sprintf("{type!~%q}", strings.Join(types, "|"))
+	}
+	objectives = append(objectives, newSLOObjective(selector, p.SLO))
+
+	var buf bytes.Buffer
+	err := rulesTmpl.Execute(&buf, struct {
+		Windows    []string
+		Alerts     []burnRateAlert
+		Objectives []sloObjective
+	}{
+		sloWindows,
+		burnRateAlerts,
+		objectives,
+	})
+	return buf.Bytes(), err
+}
+
+func newSLOObjective(selector string, target float64) sloObjective {
+	// Round the budget to avoid floating point noise such as 0.0010000000000000009
+	budget := math.Round((1-target)*1e9) / 1e9
+	return sloObjective{
+		Selector: selector,
+		Target:   strconv.FormatFloat(target, 'g', -1, 64),
+		Budget:   strconv.FormatFloat(budget, 'g', -1, 64),
+	}
+}
+
+// rulesHandler serves the generated rules
+func (p *Prometheus) rulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := p.Rules()
+	if err != nil {
+		log.Printf("[txtdirect]: Couldn't generate the prometheus rules: %s", err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(rules)
+}
+
+// parseSLO parses an SLO target in "0.999" or "type=0.999" format
+func (p *Prometheus) parseSLO(value string) error {
+	recordType := ""
+	if tuple := strings.SplitN(value, "=", 2); len(tuple) == 2 {
+		recordType, value = tuple[0], tuple[1]
+	}
+	target, err := strconv.ParseFloat(value, 64)
+	if err != nil || target <= 0 || target >= 1 {
+		return fmt.Errorf("The given value for slo field is not standard. It should be a ratio between 0 and 1")
+	}
+	if recordType == "" {
+		p.SLO = target
+		return nil
+	}
+	if p.TypeSLOs == nil {
+		p.TypeSLOs = make(map[string]float64)
+	}
+	p.TypeSLOs[recordType] = target
+	return nil
+}
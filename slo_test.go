@@ -0,0 +1,75 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrometheusRules(t *testing.T) {
+	tests := []struct {
+		prometheus Prometheus
+		expected   []string
+	}{
+		{
+			Prometheus{SLO: 0.999},
+			[]string{
+				"record: txtdirect:fallback_ratio:rate5m",
+				"record: txtdirect:fallback_ratio:rate3d",
+				"txtdirect:fallback_ratio:rate1h > (14.4 * 0.001)",
+				"txtdirect:fallback_ratio:rate5m > (14.4 * 0.001)",
+				"txtdirect:fallback_ratio:rate3d > (1 * 0.001)",
+				`slo: "0.999"`,
+			},
+		},
+		{
+			Prometheus{
+				SLO:      0.99,
+				TypeSLOs: map[string]float64{"path": 0.95, "host": 0.999},
+			},
+			[]string{
+				`txtdirect:fallback_ratio:rate1h{type="host"} > (14.4 * 0.001)`,
+				`txtdirect:fallback_ratio:rate1h{type="path"} > (14.4 * 0.05)`,
+				`txtdirect:fallback_ratio:rate1h{type!~"host|path"} > (14.4 * 0.01)`,
+			},
+		},
+	}
+	for i, test := range tests {
+		rules, err := test.prometheus.Rules()
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		for _, expected := range test.expected {
+			if !strings.Contains(string(rules), expected) {
+				t.Errorf("Test %d: Expected the rules to contain %q:\n%s", i, expected, rules)
+			}
+		}
+	}
+}
+
+func TestPrometheusRulesHandler(t *testing.T) {
+	p := Prometheus{SLO: 0.999}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://localhost:9183/rules", nil)
+	p.rulesHandler(w, r)
+	if w.Code != 200 {
+		t.Errorf("Expected status code 200, got %d", w.Code)
+	}
+	if !strings.HasPrefix(w.Body.String(), "groups:") {
+		t.Errorf("Expected a rules file, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Snapshot contains the configuration of the last known good records.
+// Every resolved record is kept in a table which is flushed to the file
+// periodically, and the records are served from it while the resolver is
+// unavailable, for up to StaleIfError after they were resolved.
+type Snapshot struct {
+	Enable       bool
+	File         string
+	Interval     time.Duration
+	StaleIfError time.Duration
+	MaxEntries   int
+
+	table *snapshotTable
+}
+
+// snapshotTable holds the last known good records by their zones
+type snapshotTable struct {
+	sync.Mutex
+	entries map[string]snapshotEntry
+	// dirty is set when the table has changed since the last flush
+	dirty bool
+
+	stop      chan struct{}
+	done      chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+type snapshotEntry struct {
+	Txts     []string  `json:"txts"`
+	Resolved time.Time `json:"resolved"`
+}
+
+const (
+	DefaultSnapshotInterval     = 5 * time.Minute
+	DefaultSnapshotStaleIfError = 24 * time.Hour
+	DefaultSnapshotMaxEntries   = 10000
+)
+
+// SetDefaults sets the default values for snapshot config
+// if the fields are empty
+func (s *Snapshot) SetDefaults() {
+	if s.Interval == 0 {
+		s.Interval = DefaultSnapshotInterval
+	}
+	if s.StaleIfError == 0 {
+		s.StaleIfError = DefaultSnapshotStaleIfError
+	}
+	if s.MaxEntries == 0 {
+		s.MaxEntries = DefaultSnapshotMaxEntries
+	}
+	if s.table == nil {
+		s.table = &snapshotTable{
+			entries: make(map[string]snapshotEntry),
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+	}
+}
+
+// set keeps the zone's freshly resolved records
+func (s *Snapshot) set(zone string, txts []string) {
+	if s.table == nil {
+		return
+	}
+	s.table.Lock()
+	defer s.table.Unlock()
+
+	if _, ok := s.table.entries[zone]; !ok && len(s.table.entries) >= s.MaxEntries {
+		// Only the records which can't be served anymore make room
+		for cached, entry := range s.table.entries {
+			if time.Since(entry.Resolved) > s.StaleIfError {
+				delete(s.table.entries, cached)
+			}
+		}
+		if len(s.table.entries) >= s.MaxEntries {
+			return
+		}
+	}
+	s.table.entries[zone] = snapshotEntry{Txts: txts, Resolved: time.Now()}
+	s.table.dirty = true
+}
+
+// get returns the zone's last known good records if they
+// were resolved less than StaleIfError ago
+func (s *Snapshot) get(zone string) ([]string, bool) {
+	if s.table == nil {
+		return nil, false
+	}
+	s.table.Lock()
+	defer s.table.Unlock()
+
+	entry, ok := s.table.entries[zone]
+	if !ok || time.Since(entry.Resolved) > s.StaleIfError {
+		return nil, false
+	}
+	return entry.Txts, true
+}
+
+// entries returns a copy of the snapshot's records for the exports
+func (s *Snapshot) entries() map[string]snapshotEntry {
+	s.table.Lock()
+	defer s.table.Unlock()
+	entries := make(map[string]snapshotEntry, len(s.table.entries))
+	for zone, entry := range s.table.entries {
+		entries[zone] = entry
+	}
+	return entries
+}
+
+// Load reads the records of the snapshot file, the
+// missing file is treated as an empty snapshot
+func (s *Snapshot) Load() error {
+	data, err := ioutil.ReadFile(s.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read the snapshot: %s", err.Error())
+	}
+	entries := make(map[string]snapshotEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("couldn't parse the snapshot: %s", err.Error())
+	}
+
+	s.table.Lock()
+	defer s.table.Unlock()
+	for zone, entry := range entries {
+		if len(s.table.entries) >= s.MaxEntries {
+			break
+		}
+		// The records resolved since the start are newer
+		if _, ok := s.table.entries[zone]; !ok && len(entry.Txts) > 0 {
+			s.table.entries[zone] = entry
+		}
+	}
+	return nil
+}
+
+// Flush writes the table to the snapshot file if it has changed
+func (s *Snapshot) Flush() error {
+	s.table.Lock()
+	if !s.table.dirty {
+		s.table.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(s.table.entries)
+	s.table.dirty = false
+	s.table.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The file is replaced at once, so a crash can't leave half of it
+	tmp, err := ioutil.TempFile(filepath.Dir(s.File), ".txtdirect-snapshot")
+	if err != nil {
+		return fmt.Errorf("couldn't write the snapshot: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("couldn't write the snapshot: %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("couldn't write the snapshot: %s", err.Error())
+	}
+	return os.Rename(tmp.Name(), s.File)
+}
+
+// Start loads the snapshot file and flushes the table periodically
+func (s *Snapshot) Start() error {
+	if err := s.Load(); err != nil {
+		log.Printf("[txtdirect]: %s", err.Error())
+	}
+	s.table.startOnce.Do(func() {
+		go s.flushPeriodically()
+	})
+	return nil
+}
+
+func (s *Snapshot) flushPeriodically() {
+	defer close(s.table.done)
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Printf("[txtdirect]: %s", err.Error())
+			}
+		case <-s.table.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the periodic flushes and flushes the table one last time
+func (s *Snapshot) Stop() error {
+	s.table.stopOnce.Do(func() {
+		close(s.table.stop)
+	})
+	// The flushes never started if the startup failed
+	s.table.startOnce.Do(func() {
+		close(s.table.done)
+	})
+	<-s.table.done
+	return s.Flush()
+}
+
+// ParseSnapshot parses the txtdirect config for the snapshot
+func (s *Snapshot) ParseSnapshot(c Dispenser) error {
+	switch c.Val() {
+	case "file":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		s.File = args[0]
+
+	case "interval":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for interval field is not standard. It should be a duration")
+		}
+		s.Interval = value
+
+	case "stale_if_error":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for stale_if_error field is not standard. It should be a duration")
+		}
+		s.StaleIfError = value
+
+	case "max_entries":
+		value, err := strconv.Atoi(c.RemainingArgs()[0])
+		if err != nil || value < 1 {
+			return fmt.Errorf("The given value for max_entries field is not standard. It should be a positive integer")
+		}
+		s.MaxEntries = value
+
+	default:
+		return c.ArgErr() // unhandled option for snapshot
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSnapshot(t *testing.T) {
+	addr, stop := startFlakyDNS(t, func(n int32, w dns.ResponseWriter, m *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(m)
+		switch {
+		case m.Question[0].Name == "_redirect.removed.test.":
+			r.Rcode = dns.RcodeNameError
+		case n <= 2:
+			r.Answer = append(r.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{"v=txtv0;to=https://good.example.com"},
+			})
+		default:
+			// The resolver fails after the first lookups
+			r.Rcode = dns.RcodeServerFailure
+		}
+		w.WriteMsg(r)
+	})
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Config{
+		Resolver: addr,
+		DNS:      DNS{Enable: true, Timeout: time.Second},
+		Snapshot: Snapshot{Enable: true, File: filepath.Join(dir, "snapshot.json")},
+	}
+	c.DNS.SetDefaults()
+	c.Snapshot.SetDefaults()
+
+	for _, zone := range []string{"good.test", "old.test"} {
+		if _, err := query(zone, context.Background(), c); err != nil {
+			t.Fatalf("Unexpected error for %s: %s", zone, err)
+		}
+	}
+	// The records resolved before stale_if_error aren't served
+	entry := c.Snapshot.table.entries["_redirect.old.test."]
+	entry.Resolved = time.Now().Add(-2 * c.Snapshot.StaleIfError)
+	c.Snapshot.table.entries["_redirect.old.test."] = entry
+
+	txts, err := query("good.test", context.Background(), c)
+	if err != nil || txts[0] != "v=txtv0;to=https://good.example.com" {
+		t.Errorf("Expected the last known good record, got %v: %v", txts, err)
+	}
+	if _, err := query("old.test", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for the record older than stale_if_error")
+	}
+	c.Snapshot.set("_redirect.removed.test.", []string{"v=txtv0;to=https://removed.example.com"})
+	if _, err := query("removed.test", context.Background(), c); err == nil {
+		t.Errorf("Expected the removed zone not to be served from the snapshot")
+	}
+
+	// The snapshot survives restarts
+	if err := c.Snapshot.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Snapshot.Stop(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	restarted := Snapshot{Enable: true, File: c.Snapshot.File}
+	restarted.SetDefaults()
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	if txts, ok := restarted.get("_redirect.good.test."); !ok || txts[0] != "v=txtv0;to=https://good.example.com" {
+		t.Errorf("Expected the snapshot to be loaded from the file, got %v", txts)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheMaxWaiters is the max number of requests waiting
+	// for another request's lookup of the same zone
+	DefaultCacheMaxWaiters = 100
+	// DefaultCacheWaitTimeout is how long the requests wait for
+	// another request's lookup before they're shed
+	DefaultCacheWaitTimeout = 5 * time.Second
+)
+
+// lookupGroup coalesces the concurrent lookups of a zone into a
+// single lookup which the other requests wait for in a bounded queue
+type lookupGroup struct {
+	sync.Mutex
+	calls   map[string]*lookupCall
+	waiters int
+}
+
+// lookupCall is a lookup in progress and its result
+type lookupCall struct {
+	done    chan struct{}
+	waiters int
+	txts    []string
+	err     error
+	// abandoned is set when the lookup ended because the
+	// request which started it hung up or ran out of time
+	abandoned bool
+}
+
+// shedError is returned to the requests which didn't get to wait
+// for the lookup of their zone, the reason is either queue_full
+// or timeout
+type shedError struct {
+	Zone   string
+	Reason string
+}
+
+func (e *shedError) Error() string {
+	return fmt.Sprintf("lookup of %s was shed (%s)", e.Zone, e.Reason)
+}
+
+// join returns the lookup in progress of the given zone and adds the
+// caller to its waiters, or starts a new lookup which the caller leads
+func (g *lookupGroup) join(zone string, maxWaiters int) (*lookupCall, bool, error) {
+	g.Lock()
+	defer g.Unlock()
+	if call, ok := g.calls[zone]; ok {
+		if call.waiters >= maxWaiters {
+			return nil, false, &shedError{Zone: zone, Reason: "queue_full"}
+		}
+		call.waiters++
+		g.waiters++
+		return call, false, nil
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	g.calls[zone] = call
+	return call, true, nil
+}
+
+// leave removes a waiter which stopped waiting for the lookup. The
+// waiters of a finished lookup were already removed by finish.
+func (g *lookupGroup) leave(zone string, call *lookupCall) {
+	g.Lock()
+	defer g.Unlock()
+	if g.calls[zone] != call {
+		return
+	}
+	call.waiters--
+	g.waiters--
+}
+
+// finish stores the result of the lookup and wakes up its waiters
+func (g *lookupGroup) finish(zone string, call *lookupCall) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.calls, zone)
+	g.waiters -= call.waiters
+	close(call.done)
+}
+
+// count returns the number of the waiting requests
+func (g *lookupGroup) count() int {
+	g.Lock()
+	defer g.Unlock()
+	return g.waiters
+}
+
+// coalesce runs the given lookup of the zone unless another request is
+// already looking it up, then it waits for that lookup's result. The
+// waiters are shed when the queue is full or the wait times out and
+// get the stale records if there are any.
+func (rc *RecordCache) coalesce(ctx context.Context, zone string, c Config, lookup func() ([]string, error)) ([]string, error) {
+	if rc.flights == nil {
+		return lookup()
+	}
+	for {
+		call, leader, err := rc.flights.join(zone, rc.MaxWaiters)
+		if err != nil {
+			return rc.shed(zone, err.(*shedError), c)
+		}
+		if leader {
+			call.txts, call.err = lookup()
+			call.abandoned = call.err != nil && ctx.Err() != nil
+			rc.flights.finish(zone, call)
+			rc.waitersChanged(c)
+			return call.txts, call.err
+		}
+		rc.waitersChanged(c)
+
+		timer := time.NewTimer(rc.WaitTimeout)
+		select {
+		case <-call.done:
+			timer.Stop()
+			// The lookup of a request which hung up says nothing
+			// about the zone, so it's started again
+			if call.abandoned && ctx.Err() == nil {
+				continue
+			}
+			if c.Prometheus.Enable {
+				CacheCoalesced.Add(1)
+			}
+			return call.txts, call.err
+		case <-timer.C:
+			rc.flights.leave(zone, call)
+			rc.waitersChanged(c)
+			return rc.shed(zone, &shedError{Zone: zone, Reason: "timeout"}, c)
+		case <-ctx.Done():
+			timer.Stop()
+			rc.flights.leave(zone, call)
+			rc.waitersChanged(c)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// shed answers a request which couldn't wait for the lookup
+// of its zone with the stale records if there are any
+func (rc *RecordCache) shed(zone string, err *shedError, c Config) ([]string, error) {
+	if c.Prometheus.Enable {
+		CacheShed.WithLabelValues(err.Reason).Add(1)
+	}
+	if txts, ok := rc.GetStale(zone); ok {
+		if c.Prometheus.Enable {
+			CacheStaleServed.Add(1)
+		}
+		return txts, nil
+	}
+	return nil, err
+}
+
+// waitersChanged updates the gauge of the waiting requests
+func (rc *RecordCache) waitersChanged(c Config) {
+	if c.Prometheus.Enable {
+		CacheWaiters.Set(float64(rc.flights.count()))
+	}
+}
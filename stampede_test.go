@@ -0,0 +1,218 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// waitForWaiters blocks until the given number of requests are
+// waiting for the lookups of the cache
+func waitForWaiters(t *testing.T, rc *RecordCache, n int) {
+	deadline := time.Now().Add(time.Second)
+	for rc.flights.count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d waiters, got %d", n, rc.flights.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRecordCache_coalesce(t *testing.T) {
+	rc := RecordCache{Enable: true}
+	rc.SetDefaults()
+
+	var lookups int32
+	release := make(chan struct{})
+	lookup := func() ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		<-release
+		return []string{"v=txtv0;to=https://example.com"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make(chan []string, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txts, err := rc.coalesce(context.Background(), "_redirect.hot.test.", Config{}, lookup)
+			if err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			results <- txts
+		}()
+	}
+	waitForWaiters(t, &rc, 9)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if lookups != 1 {
+		t.Errorf("Expected a single lookup, got %d", lookups)
+	}
+	for txts := range results {
+		if len(txts) != 1 || txts[0] != "v=txtv0;to=https://example.com" {
+			t.Errorf("Unexpected TXT records %v", txts)
+		}
+	}
+	if rc.flights.count() != 0 {
+		t.Errorf("Expected no waiters left, got %d", rc.flights.count())
+	}
+}
+
+func TestRecordCache_shed(t *testing.T) {
+	tests := []struct {
+		maxWaiters int
+		stale      bool
+		reason     string
+	}{
+		{1, false, "queue_full"},
+		{1, true, "queue_full"},
+		{10, false, "timeout"},
+		{10, true, "timeout"},
+	}
+	for i, test := range tests {
+		rc := RecordCache{
+			Enable:      true,
+			MinTTL:      time.Millisecond,
+			ServeStale:  time.Minute,
+			MaxWaiters:  test.maxWaiters,
+			WaitTimeout: 20 * time.Millisecond,
+		}
+		rc.SetDefaults()
+		zone := "_redirect.slow.test."
+		if test.stale {
+			rc.Set(zone, []string{"stale"}, time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var once sync.Once
+		lookup := func() ([]string, error) {
+			once.Do(func() { close(started) })
+			<-release
+			return []string{"fresh"}, nil
+		}
+		go rc.coalesce(context.Background(), zone, Config{}, lookup)
+		<-started
+		if test.reason == "queue_full" {
+			go rc.coalesce(context.Background(), zone, Config{}, lookup)
+			waitForWaiters(t, &rc, 1)
+		}
+
+		txts, err := rc.coalesce(context.Background(), zone, Config{}, lookup)
+		close(release)
+		if test.stale {
+			if err != nil || len(txts) != 1 || txts[0] != "stale" {
+				t.Errorf("Test %d: Expected the stale records, got %v, %v", i, txts, err)
+			}
+			continue
+		}
+		shed, ok := err.(*shedError)
+		if !ok {
+			t.Errorf("Test %d: Expected the request to be shed, got %v, %v", i, txts, err)
+			continue
+		}
+		if shed.Reason != test.reason {
+			t.Errorf("Test %d: Expected it to be shed for %s, got %s", i, test.reason, shed.Reason)
+		}
+	}
+}
+
+func TestRecordCache_coalesceAbandoned(t *testing.T) {
+	rc := RecordCache{Enable: true}
+	rc.SetDefaults()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rc.coalesce(ctx, "_redirect.gone.test.", Config{}, func() ([]string, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	}()
+	<-started
+
+	result := make(chan []string, 1)
+	go func() {
+		txts, _ := rc.coalesce(context.Background(), "_redirect.gone.test.", Config{}, func() ([]string, error) {
+			return []string{"record"}, nil
+		})
+		result <- txts
+	}()
+	waitForWaiters(t, &rc, 1)
+	// The waiter looks the zone up itself when the request
+	// which started the lookup hangs up
+	cancel()
+	<-done
+	if txts := <-result; len(txts) != 1 || txts[0] != "record" {
+		t.Errorf("Expected the waiter to get the records, got %v", txts)
+	}
+}
+
+func TestParseRecordCacheWaiters(t *testing.T) {
+	tests := []struct {
+		config      string
+		maxWaiters  int
+		waitTimeout time.Duration
+		shouldErr   bool
+	}{
+		{"cache", DefaultCacheMaxWaiters, DefaultCacheWaitTimeout, false},
+		{"cache {\nmax_waiters 10\nwait_timeout 1s\n}", 10, time.Second, false},
+		{"cache {\nmax_waiters 0\n}", 0, 0, true},
+		{"cache {\nwait_timeout -1s\n}", 0, 0, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable host\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.RecordCache.MaxWaiters != test.maxWaiters || conf.RecordCache.WaitTimeout != test.waitTimeout {
+			t.Errorf("Test %d: Expected %d waiters for %s, got %d for %s", i, test.maxWaiters, test.waitTimeout, conf.RecordCache.MaxWaiters, conf.RecordCache.WaitTimeout)
+		}
+	}
+}
+
+func TestLookupGroup_leaveFinished(t *testing.T) {
+	g := &lookupGroup{calls: make(map[string]*lookupCall)}
+	call, _, _ := g.join("_redirect.race.test.", 10)
+	if _, leader, _ := g.join("_redirect.race.test.", 10); leader {
+		t.Fatalf("Expected the second request to wait")
+	}
+	g.finish("_redirect.race.test.", call)
+	// The waiter's timer fired together with the lookup finishing
+	g.leave("_redirect.race.test.", call)
+	if g.count() != 0 {
+		t.Errorf("Expected no waiters, got %d", g.count())
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Standalone contains the configuration of the standalone server
+// which serves TXTDirect without Caddy
+type Standalone struct {
+	Listen  string `yaml:"listen"`
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// TLSClientCA verifies the client certificates sent to the
+	// server against the CAs in the given PEM file
+	TLSClientCA string `yaml:"tls_client_ca"`
+	Resolver    string `yaml:"resolver"`
+	// Resolvers takes precedence over Resolver and
+	// fails over between the given resolvers
+	Resolvers []string `yaml:"resolvers"`
+	Enable    []string `yaml:"enable"`
+	// Profile is a named set of options of the txtdirect block,
+	// the enabled types are set by it if Enable is empty
+	Profile  string `yaml:"profile"`
+	Redirect string `yaml:"redirect"`
+	Logfile  string `yaml:"logfile"`
+	Probes   bool   `yaml:"probes"`
+	// ProxyProtocol reads the client's address from the PROXY protocol
+	// header sent by the L4 load balancers in front of the server
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// ProxyProtocolTrusted limits the PROXY headers to the load balancers'
+	// networks, all the connections have to send one if it's empty
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"`
+
+	// env holds the options set by the environment
+	// which don't have a standalone field
+	env map[string]*envOption
+}
+
+// DefaultStandaloneListen is the default address of the standalone server
+const DefaultStandaloneListen = ":8080"
+
+// LoadStandalone reads the standalone server's YAML config file
+func LoadStandalone(path string) (Standalone, error) {
+	var s Standalone
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, fmt.Errorf("couldn't read the config file: %s", err.Error())
+	}
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return s, fmt.Errorf("couldn't parse the config file: %s", err.Error())
+	}
+	return s, nil
+}
+
+// SetDefaults sets the default values for standalone config
+// if the fields are empty
+func (s *Standalone) SetDefaults() {
+	if s.Listen == "" {
+		s.Listen = DefaultStandaloneListen
+	}
+	if len(s.Enable) == 0 && s.Profile == "" {
+		s.Enable = allOptions
+	}
+}
+
+// Config returns the TXTDirect config based on the standalone config
+func (s *Standalone) Config() (Config, error) {
+	if (s.TLSCert == "") != (s.TLSKey == "") {
+		return Config{}, fmt.Errorf("both tls_cert and tls_key are required to serve over HTTPS")
+	}
+	if s.TLSClientCA != "" && s.TLSCert == "" {
+		return Config{}, fmt.Errorf("tls_client_ca needs tls_cert and tls_key")
+	}
+	if err := requireCapabilities(s.Enable, nil); err != nil {
+		return Config{}, err
+	}
+	if _, err := parseTrustedNetworks(s.ProxyProtocolTrusted); err != nil {
+		return Config{}, fmt.Errorf("proxy_protocol_trusted: %s", err.Error())
+	}
+	// The options without a standalone field and the profile are parsed like a Caddyfile
+	if len(s.env) > 0 || s.Profile != "" {
+		c, err := s.envConfig()
+		if err != nil {
+			return Config{}, err
+		}
+		if c.Tor.Enable {
+			return Config{}, fmt.Errorf("tor isn't supported by the standalone server")
+		}
+		return c, nil
+	}
+	c := Config{
+		Enable:    s.Enable,
+		Redirect:  s.Redirect,
+		Resolver:  s.Resolver,
+		LogOutput: s.Logfile,
+	}
+	if len(s.Resolvers) > 0 {
+		c.Resolver = s.Resolvers[0]
+	}
+	if len(s.Resolvers) > 1 {
+		c.Resolvers = s.Resolvers
+		c.resolvers = newResolverPool(s.Resolvers)
+	}
+	if isDoH(c.Resolver) || anyDoH(c.Resolvers) {
+		c.DoH.SetDefaults()
+	}
+	if contains(c.Enable, "sinkhole") {
+		c.Sinkhole.SetDefaults()
+	}
+	if s.Probes {
+		c.Probes.Enable = true
+		c.Probes.SetDefaults()
+	}
+	return c, nil
+}
+
+// StandaloneHandler is an http.Handler which redirects the
+// requests based on TXT records without Caddy
+type StandaloneHandler struct {
+	Config Config
+}
+
+func (h StandaloneHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handled, err := h.Config.Handle(w, r)
+	if !handled {
+		h.Config.Templates.serveNotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("[txtdirect]: %s", err.Error())
+		h.Config.Templates.serveError(w, r)
+	}
+}
+
+// ListenAndServe starts the standalone server
+func (s *Standalone) ListenAndServe() error {
+	c, err := s.Config()
+	if err != nil {
+		return err
+	}
+	stop, err := c.Start()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := stop(); err != nil {
+			log.Printf("[txtdirect]: %s", err.Error())
+		}
+	}()
+
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	// The connections are queued by the listener until the server serves them
+	if notifier := newSystemdNotifier(os.Getenv); notifier != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		defer notifier.notify("STOPPING=1")
+		if err := notifier.notify("READY=1\nSTATUS=Listening on " + listener.Addr().String()); err != nil {
+			log.Printf("[txtdirect]: %s", err.Error())
+		}
+		addr := listener.Addr()
+		go notifier.watch(stop, func() error {
+			return standaloneAlive(addr, c)
+		})
+	}
+
+	server := &http.Server{
+		Addr:        s.Listen,
+		Handler:     StandaloneHandler{Config: c},
+		ReadTimeout: proxyTimeout,
+		// The responses aren't limited by a write timeout, the
+		// streamed responses and the module and image downloads
+		// can take longer. The upstreams have their own timeouts.
+		IdleTimeout: 2 * time.Minute,
+	}
+	if s.TLSClientCA != "" {
+		if server.TLSConfig, err = s.clientTLSConfig(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	if s.TLSCert != "" {
+		return server.ServeTLS(listener, s.TLSCert, s.TLSKey)
+	}
+	return server.Serve(listener)
+}
+
+// clientTLSConfig asks the clients for their certificates and verifies
+// them, the clients without one are left to the client_certs option
+func (s *Standalone) clientTLSConfig() (*tls.Config, error) {
+	data, err := ioutil.ReadFile(s.TLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the tls_client_ca file: %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("couldn't find any certificates in the tls_client_ca file %s", s.TLSClientCA)
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// listen listens on the standalone server's address and reads
+// the PROXY headers of the connections if they're enabled
+func (s *Standalone) listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", s.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if !s.ProxyProtocol {
+		return listener, nil
+	}
+	trusted, err := parseTrustedNetworks(s.ProxyProtocolTrusted)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &proxyProtocolListener{Listener: listener, trusted: trusted}, nil
+}
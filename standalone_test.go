@@ -0,0 +1,173 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadStandalone(t *testing.T) {
+	tests := []struct {
+		config    string
+		expected  Standalone
+		shouldErr bool
+	}{
+		{
+			`
+listen: ":8443"
+resolver: 127.0.0.1:53
+enable: [host, path]
+logfile: stdout
+probes: true
+`,
+			Standalone{
+				Listen:   ":8443",
+				Resolver: "127.0.0.1:53",
+				Enable:   []string{"host", "path"},
+				Logfile:  "stdout",
+				Probes:   true,
+			},
+			false,
+		},
+		{
+			`redirect: https://example.com`,
+			Standalone{
+				Listen:   DefaultStandaloneListen,
+				Redirect: "https://example.com",
+				Enable:   allOptions,
+			},
+			false,
+		},
+		{
+			`unknown: field`,
+			Standalone{},
+			true,
+		},
+	}
+	for i, test := range tests {
+		file, err := ioutil.TempFile("", "txtdirectd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+		if _, err := file.WriteString(test.config); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		s, err := LoadStandalone(file.Name())
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		s.SetDefaults()
+		if s.Listen != test.expected.Listen || s.Resolver != test.expected.Resolver ||
+			s.Redirect != test.expected.Redirect || s.Logfile != test.expected.Logfile ||
+			s.Probes != test.expected.Probes || !identical(s.Enable, test.expected.Enable) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, s)
+		}
+	}
+}
+
+func TestStandaloneConfig(t *testing.T) {
+	s := Standalone{TLSCert: "/path/to/cert.pem"}
+	if _, err := s.Config(); err == nil {
+		t.Errorf("Expected an error when the TLS key is missing")
+	}
+	s = Standalone{TLSClientCA: "/path/to/ca.pem"}
+	if _, err := s.Config(); err == nil {
+		t.Errorf("Expected an error for the client CA without the TLS certificate")
+	}
+	s = Standalone{ProxyProtocol: true, ProxyProtocolTrusted: []string{"10.0.0.0/33"}}
+	if _, err := s.Config(); err == nil {
+		t.Errorf("Expected an error for an invalid trusted network")
+	}
+}
+
+func TestStandaloneClientTLSConfig(t *testing.T) {
+	_, ca := testClientCert(t, "client.example.com")
+	defer os.Remove(ca)
+
+	s := Standalone{TLSClientCA: ca}
+	config, err := s.clientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.VerifyClientCertIfGiven || config.ClientCAs == nil {
+		t.Errorf("Expected the client certificates to be verified if given, got %+v", config)
+	}
+
+	s = Standalone{TLSClientCA: "testdata/missing.pem"}
+	if _, err := s.clientTLSConfig(); err == nil {
+		t.Errorf("Expected an error for a missing client CA file")
+	}
+}
+
+func TestStandaloneHandler(t *testing.T) {
+	tests := []struct {
+		url      string
+		enable   []string
+		status   int
+		location string
+	}{
+		{
+			"https://host.e2e.test",
+			[]string{"host"},
+			302,
+			"https://plain.host.test",
+		},
+		{
+			"https://host.e2e.test",
+			[]string{"path"},
+			404,
+			"",
+		},
+	}
+	counter := RequestsCount.WithLabelValues("host.e2e.test")
+	for i, test := range tests {
+		h := StandaloneHandler{
+			Config: Config{
+				Enable:     test.enable,
+				Resolver:   "127.0.0.1:" + strconv.Itoa(port),
+				Prometheus: Prometheus{Enable: true},
+			},
+		}
+		before := testutil.ToFloat64(counter)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		// The redirects are counted like the ones served by Caddy
+		if counted := testutil.ToFloat64(counter) - before; test.status == 302 && counted != 1 {
+			t.Errorf("Test %d: Expected the redirect to be counted, got %v", i, counted)
+		}
+	}
+}
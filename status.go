@@ -0,0 +1,333 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status contains the status page's configuration. The page is served on
+// its own host, so it doesn't shadow the vanity hosts' paths, and by the
+// admin API.
+type Status struct {
+	Enable bool
+	// Host is the host serving the status page on its path
+	Host          string
+	Path          string
+	Hosts         []string
+	CheckTargets  bool
+	CheckTimeout  time.Duration
+	CheckInterval time.Duration
+
+	tracker *statusTracker
+}
+
+// hostStatus is the status of a single host shown on the status page
+type hostStatus struct {
+	Host         string    `json:"host"`
+	Type         string    `json:"type,omitempty"`
+	Target       string    `json:"target,omitempty"`
+	LastResolved time.Time `json:"last_resolved,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	Healthy      *bool     `json:"healthy,omitempty"`
+}
+
+// Health returns the target's health in a human readable format
+func (h hostStatus) Health() string {
+	if h.Healthy == nil {
+		return ""
+	}
+	if *h.Healthy {
+		return "yes"
+	}
+	return "no"
+}
+
+type statusTracker struct {
+	sync.RWMutex
+	hosts map[string]*hostStatus
+	stop  chan struct{}
+}
+
+const (
+	DefaultStatusPath          = "/status"
+	DefaultStatusCheckTimeout  = 5 * time.Second
+	DefaultStatusCheckInterval = time.Minute
+	// maxTrackedHosts limits the number of hosts tracked by the status page
+	// so random Host headers can't grow the tracker indefinitely
+	maxTrackedHosts = 1000
+	// maxStatusChecks limits the number of targets checked at once
+	maxStatusChecks = 10
+)
+
+var statusTmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>TXTDirect status</title>
+</head>
+<body>
+<h1>TXTDirect status</h1>
+<table>
+<tr><th>Host</th><th>Type</th><th>Target</th><th>Last resolved</th><th>Last error</th><th>Healthy</th></tr>
+{{- range .}}
+<tr><td>{{.Host}}</td><td>{{.Type}}</td><td>{{.Target}}</td><td>{{if not .LastResolved.IsZero}}{{.LastResolved.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td><td>{{.LastError}}</td><td>{{.Health}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>`))
+
+// SetDefaults sets the default values for status config
+// if the fields are empty
+func (s *Status) SetDefaults() {
+	if s.Path == "" {
+		s.Path = DefaultStatusPath
+	}
+	if s.CheckTimeout == 0 {
+		s.CheckTimeout = DefaultStatusCheckTimeout
+	}
+	if s.CheckInterval == 0 {
+		s.CheckInterval = DefaultStatusCheckInterval
+	}
+	s.Host = canonicalHost(s.Host)
+	if s.tracker == nil {
+		s.tracker = &statusTracker{hosts: make(map[string]*hostStatus)}
+		for _, host := range s.Hosts {
+			host = strings.ToLower(host)
+			s.tracker.hosts[host] = &hostStatus{Host: host}
+		}
+	}
+}
+
+// serves checks if the request is sent to the status page's host and path
+func (s *Status) serves(r *http.Request) bool {
+	return s.Host != "" && r.URL.Path == s.Path && canonicalHost(r.Host) == s.Host
+}
+
+// Start starts checking the tracked hosts' targets periodically
+func (s *Status) Start() error {
+	if !s.CheckTargets || s.tracker == nil || s.tracker.stop != nil {
+		return nil
+	}
+	s.tracker.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		s.checkAll()
+		ticker := time.NewTicker(s.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.checkAll()
+			case <-stop:
+				return
+			}
+		}
+	}(s.tracker.stop)
+	return nil
+}
+
+// Stop stops the periodic target checks
+func (s *Status) Stop() error {
+	if s.tracker == nil || s.tracker.stop == nil {
+		return nil
+	}
+	close(s.tracker.stop)
+	s.tracker.stop = nil
+	return nil
+}
+
+// checkAll checks the tracked hosts' targets and keeps their health
+// for the status page. The targets with placeholders aren't checked.
+func (s *Status) checkAll() {
+	s.tracker.RLock()
+	var targets []string
+	seen := make(map[string]bool)
+	for _, status := range s.tracker.hosts {
+		if status.Target != "" && !strings.ContainsAny(status.Target, "{}") && !seen[status.Target] {
+			seen[status.Target] = true
+			targets = append(targets, status.Target)
+		}
+	}
+	s.tracker.RUnlock()
+
+	// The results are kept apart from the targets being checked
+	// and merged after all the checks are done
+	results := make([]bool, len(targets))
+	var wg sync.WaitGroup
+	checks := make(chan struct{}, maxStatusChecks)
+	for i, target := range targets {
+		wg.Add(1)
+		checks <- struct{}{}
+		go func(i int, target string) {
+			defer func() {
+				<-checks
+				wg.Done()
+			}()
+			results[i] = checkTarget(target, s.CheckTimeout) == nil
+		}(i, target)
+	}
+	wg.Wait()
+
+	healthy := make(map[string]bool, len(targets))
+	for i, target := range targets {
+		healthy[target] = results[i]
+	}
+	s.tracker.Lock()
+	defer s.tracker.Unlock()
+	for _, status := range s.tracker.hosts {
+		if result, ok := healthy[status.Target]; ok {
+			status.Healthy = &result
+		}
+	}
+}
+
+// track updates the status of the given host with the result of a record lookup
+func (s *Status) track(host string, rec record, err error) {
+	if s.tracker == nil {
+		return
+	}
+	host = strings.ToLower(host)
+
+	s.tracker.Lock()
+	defer s.tracker.Unlock()
+
+	status, ok := s.tracker.hosts[host]
+	if !ok {
+		// Only keep track of failures for already known hosts
+		if err != nil || len(s.tracker.hosts) >= maxTrackedHosts {
+			return
+		}
+		status = &hostStatus{Host: host}
+		s.tracker.hosts[host] = status
+	}
+
+	if err != nil {
+		status.LastError = err.Error()
+		return
+	}
+	if status.Target != rec.To {
+		// The new target's health is known after its check
+		status.Healthy = nil
+	}
+	status.Type, status.Target = rec.Type, rec.To
+	status.LastResolved = time.Now()
+	status.LastError = ""
+}
+
+// snapshot returns a sorted copy of the tracked hosts
+func (s *Status) snapshot() []hostStatus {
+	if s.tracker == nil {
+		return nil
+	}
+	s.tracker.RLock()
+	defer s.tracker.RUnlock()
+
+	hosts := make([]hostStatus, 0, len(s.tracker.hosts))
+	for _, status := range s.tracker.hosts {
+		status := *status
+		if status.Healthy != nil {
+			healthy := *status.Healthy
+			status.Healthy = &healthy
+		}
+		hosts = append(hosts, status)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	return hosts
+}
+
+// ServeHTTP serves the status page as JSON or HTML based on the Accept
+// header, the targets' health is the result of their last check
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	hosts := s.snapshot()
+
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(hosts)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return statusTmpl.Execute(w, hosts)
+}
+
+// checkTarget sends a HEAD request to the given target and returns an
+// error if the target is unreachable or responds with a server error
+func checkTarget(target string, timeout time.Duration) error {
+	client := http.Client{
+		Timeout: timeout,
+		// The target's own redirects don't matter for its health
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Head(target)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("target responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ParseStatus parses the txtdirect config for the status page
+func (s *Status) ParseStatus(c Dispenser) error {
+	switch c.Val() {
+	case "host":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		s.Host = c.Val()
+
+	case "path":
+		s.Path = c.RemainingArgs()[0]
+
+	case "hosts":
+		hosts := c.RemainingArgs()
+		if len(hosts) == 0 {
+			return c.ArgErr()
+		}
+		s.Hosts = append(s.Hosts, hosts...)
+
+	case "check_targets":
+		s.CheckTargets = true
+		if c.NextArg() {
+			value, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return fmt.Errorf("The given value for check_targets field is not standard. It should be a duration")
+			}
+			s.CheckTimeout = value
+		}
+
+	case "check_interval":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		value, err := time.ParseDuration(c.Val())
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for check_interval field is not standard. It should be a duration")
+		}
+		s.CheckInterval = value
+
+	default:
+		return c.ArgErr() // unhandled option for status
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusTrack(t *testing.T) {
+	s := Status{Enable: true, Hosts: []string{"Configured.test"}}
+	s.SetDefaults()
+
+	s.track("example.test", record{Type: "host", To: "https://example.com"}, nil)
+	s.track("unknown.test", record{}, fmt.Errorf("could not get TXT record"))
+	s.track("configured.test", record{}, fmt.Errorf("could not get TXT record"))
+
+	hosts := s.snapshot()
+	if len(hosts) != 2 {
+		t.Fatalf("Expected 2 tracked hosts, got %d: %+v", len(hosts), hosts)
+	}
+	if hosts[0].Host != "configured.test" || hosts[0].LastError == "" {
+		t.Errorf("Expected the failure to be tracked for the configured host, got %+v", hosts[0])
+	}
+	if hosts[1].Host != "example.test" || hosts[1].Target != "https://example.com" || hosts[1].LastResolved.IsZero() {
+		t.Errorf("Expected the resolved record to be tracked, got %+v", hosts[1])
+	}
+}
+
+func TestStatusServeHTTP(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	s := Status{Enable: true, CheckTargets: true}
+	s.SetDefaults()
+	s.track("healthy.test", record{Type: "host", To: healthy.URL}, nil)
+	s.track("unhealthy.test", record{Type: "host", To: unhealthy.URL}, nil)
+
+	// The targets are only checked in the background
+	if hosts := s.snapshot(); hosts[0].Healthy != nil || hosts[1].Healthy != nil {
+		t.Fatalf("Expected the targets to be unchecked, got %+v", hosts)
+	}
+	s.checkAll()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "https://txtdirect.test/status", nil)
+	r.Header.Set("Accept", "application/json")
+	if err := s.ServeHTTP(w, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var hosts []hostStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &hosts); err != nil {
+		t.Fatalf("Couldn't parse the JSON response: %s", err)
+	}
+	if len(hosts) != 2 || hosts[0].Healthy == nil || !*hosts[0].Healthy || hosts[1].Healthy == nil || *hosts[1].Healthy {
+		t.Errorf("Expected healthy.test to be healthy and unhealthy.test to be unhealthy, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "https://txtdirect.test/status", nil)
+	if err := s.ServeHTTP(w, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "<td>healthy.test</td>") {
+		t.Errorf("Expected an HTML status page, got %s", w.Body.String())
+	}
+}
+
+func TestStatusE2e(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Status:   Status{Enable: true, Host: "Status.txtdirect.test"},
+		Admin:    Admin{Enable: true, Token: "secret"},
+	}
+	c.Status.SetDefaults()
+	c.Admin.SetDefaults()
+
+	w := httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://host.e2e.test/", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// The vanity hosts' paths aren't shadowed by the status page
+	w = httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://host.e2e.test/status?format=json", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Contains(w.Body.String(), `"host":"host.e2e.test"`) || w.Header().Get("Location") == "" {
+		t.Errorf("Expected the vanity host's status path to be redirected, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	if err := Redirect(w, httptest.NewRequest("GET", "https://status.txtdirect.test:443/status?format=json", nil), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(w.Body.String(), `"host":"host.e2e.test"`) {
+		t.Errorf("Expected host.e2e.test to be listed on the status page, got %s", w.Body.String())
+	}
+
+	// The admin API serves the status page with its token
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "secret": http.StatusOK} {
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "https://host.e2e.test"+DefaultAdminPath+"/status?format=json", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if err := Redirect(w, r, c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if w.Code != status {
+			t.Errorf("Expected %d from the admin API's status page, got %d", status, w.Code)
+		}
+		if status == http.StatusOK && !strings.Contains(w.Body.String(), `"host":"host.e2e.test"`) {
+			t.Errorf("Expected host.e2e.test to be listed on the admin API's status page, got %s", w.Body.String())
+		}
+	}
+}
+
+func TestStatusStart(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	s := Status{Enable: true, CheckTargets: true, CheckInterval: time.Hour}
+	s.SetDefaults()
+	s.track("example.test", record{Type: "host", To: upstream.URL}, nil)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// The first check runs when the checks start
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if hosts := s.snapshot(); hosts[0].Healthy != nil && *hosts[0].Healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the target to be checked, got %+v", s.snapshot())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_checkTarget(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+
+	if err := checkTarget(slow.URL, 50*time.Millisecond); err == nil {
+		t.Errorf("Expected the check to time out")
+	}
+	if err := checkTarget(slow.URL, time.Second); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
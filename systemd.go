@@ -0,0 +1,116 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// systemdNotifier reports the standalone server's state to systemd
+// using the sd_notify protocol, when it's started as a Type=notify
+// service, and pings the watchdog while the server is alive
+type systemdNotifier struct {
+	socket string
+	// watchdog is the interval of the watchdog pings,
+	// zero when the watchdog isn't enabled for the process
+	watchdog time.Duration
+}
+
+// newSystemdNotifier returns the notifier of the systemd service
+// described by the environment, or nil without NOTIFY_SOCKET
+func newSystemdNotifier(getenv func(string) string) *systemdNotifier {
+	socket := getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	n := &systemdNotifier{socket: socket}
+	usec, err := strconv.ParseInt(getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return n
+	}
+	// The watchdog may be meant for another process of the service
+	if pid := getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return n
+	}
+	// systemd recommends pinging twice in each watchdog interval
+	n.watchdog = time.Duration(usec) * time.Microsecond / 2
+	return n
+}
+
+// notify sends the newline separated state assignments to systemd
+func (n *systemdNotifier) notify(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("couldn't connect to the systemd notify socket: %s", err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("couldn't notify systemd: %s", err.Error())
+	}
+	return nil
+}
+
+// watch pings the watchdog until stop is closed. The pings are skipped
+// while the server isn't alive, so systemd restarts the wedged server.
+func (n *systemdNotifier) watch(stop <-chan struct{}, alive func() error) {
+	if n.watchdog == 0 {
+		return
+	}
+	ticker := time.NewTicker(n.watchdog)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := alive(); err != nil {
+			log.Printf("[txtdirect]: Skipping the systemd watchdog ping: %s", err.Error())
+			continue
+		}
+		if err := n.notify("WATCHDOG=1"); err != nil {
+			log.Printf("[txtdirect]: %s", err.Error())
+		}
+	}
+}
+
+// standaloneAlive checks if the resolver answers and the listener
+// accepts connections, the address is the listener's one
+func standaloneAlive(addr net.Addr, c Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultProbeTimeout)
+	defer cancel()
+	if err := probeResolver(ctx, c); err != nil {
+		return fmt.Errorf("the resolver isn't reachable: %s", err.Error())
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return fmt.Errorf("the listener doesn't accept connections: %s", err.Error())
+	}
+	return conn.Close()
+}
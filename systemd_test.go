@@ -0,0 +1,146 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testNotifySocket listens on a systemd notify socket and
+// returns its path, the received states and the stop function
+func testNotifySocket(t *testing.T) (string, <-chan string, func()) {
+	dir, err := ioutil.TempDir("", "txtdirect-systemd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	states := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+	return path, states, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewSystemdNotifier(t *testing.T) {
+	tests := []struct {
+		env      map[string]string
+		enabled  bool
+		watchdog time.Duration
+	}{
+		{map[string]string{}, false, 0},
+		{map[string]string{"NOTIFY_SOCKET": "/run/notify"}, true, 0},
+		{map[string]string{"NOTIFY_SOCKET": "/run/notify", "WATCHDOG_USEC": "30000000"}, true, 15 * time.Second},
+		{map[string]string{"NOTIFY_SOCKET": "/run/notify", "WATCHDOG_USEC": "30000000", "WATCHDOG_PID": strconv.Itoa(os.Getpid())}, true, 15 * time.Second},
+		{map[string]string{"NOTIFY_SOCKET": "/run/notify", "WATCHDOG_USEC": "30000000", "WATCHDOG_PID": "1"}, true, 0},
+		{map[string]string{"NOTIFY_SOCKET": "/run/notify", "WATCHDOG_USEC": "soon"}, true, 0},
+	}
+	for i, test := range tests {
+		n := newSystemdNotifier(func(key string) string { return test.env[key] })
+		if (n != nil) != test.enabled {
+			t.Errorf("Test %d: Expected the notifier to be enabled: %t", i, test.enabled)
+			continue
+		}
+		if n != nil && n.watchdog != test.watchdog {
+			t.Errorf("Test %d: Expected the watchdog interval %s, got %s", i, test.watchdog, n.watchdog)
+		}
+	}
+}
+
+func TestSystemdNotifierWatch(t *testing.T) {
+	socket, states, stopSocket := testNotifySocket(t)
+	defer stopSocket()
+
+	n := &systemdNotifier{socket: socket, watchdog: 10 * time.Millisecond}
+	if err := n.notify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+	if state := <-states; state != "READY=1" {
+		t.Errorf("Expected READY=1, got %q", state)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		n.watch(stop, func() error { return nil })
+		close(done)
+	}()
+	select {
+	case state := <-states:
+		if state != "WATCHDOG=1" {
+			t.Errorf("Expected WATCHDOG=1, got %q", state)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected a watchdog ping")
+	}
+	close(stop)
+	<-done
+
+	// The pings are skipped while the server isn't alive
+	stop = make(chan struct{})
+	go n.watch(stop, func() error { return fmt.Errorf("wedged") })
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	for len(states) > 0 {
+		<-states
+	}
+	select {
+	case state := <-states:
+		t.Errorf("Expected no pings while wedged, got %q", state)
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	n = &systemdNotifier{socket: filepath.Join(os.TempDir(), "txtdirect-missing-notify")}
+	if err := n.notify("READY=1"); err == nil {
+		t.Errorf("Expected an error for a missing notify socket")
+	}
+}
+
+func TestStandaloneAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr()
+	c := Config{Resolver: "127.0.0.1:" + strconv.Itoa(port)}
+	if err := standaloneAlive(addr, c); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	listener.Close()
+	if err := standaloneAlive(addr, c); err == nil {
+		t.Errorf("Expected an error for a closed listener")
+	}
+}
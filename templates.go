@@ -0,0 +1,142 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Templates contains the HTML templates of the pages served instead
+// of the bare 404, 500 and fallback redirect responses
+type Templates struct {
+	NotFound string
+	Error    string
+	// Fallback is the body of the fallback redirects
+	Fallback string
+
+	notFound *template.Template
+	error    *template.Template
+	fallback *template.Template
+}
+
+// templateData is the data the templates are executed with
+type templateData struct {
+	Host       string
+	Path       string
+	Status     int
+	StatusText string
+	// Target is the fallback redirect's location
+	Target string
+
+	r *http.Request
+}
+
+// Placeholder fills the request's placeholders in the given
+// string, e.g. {{.Placeholder "{label1}"}}
+func (d templateData) Placeholder(input string) string {
+	value, err := parsePlaceholders(input, d.r, []string{})
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// serveNotFound serves the not found page
+func (t *Templates) serveNotFound(w http.ResponseWriter, r *http.Request) {
+	if t.notFound == nil {
+		http.NotFound(w, r)
+		return
+	}
+	t.render(w, r, t.notFound, http.StatusNotFound, "")
+}
+
+// serveError serves the error page
+func (t *Templates) serveError(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusInternalServerError
+	if t.error == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	t.render(w, r, t.error, status, "")
+}
+
+// redirect redirects the request to the fallback target
+// with the fallback page as the response's body
+func (t *Templates) redirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	if t.fallback == nil {
+		http.Redirect(w, r, target, code)
+		return
+	}
+	w.Header().Set("Location", absoluteLocation(r, target))
+	t.render(w, r, t.fallback, code, target)
+}
+
+// render executes the template into a buffer first, so
+// a failing template doesn't send a partial page
+func (t *Templates) render(w http.ResponseWriter, r *http.Request, tmpl *template.Template, status int, target string) {
+	var page bytes.Buffer
+	err := tmpl.Execute(&page, templateData{
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Target:     target,
+		r:          r,
+	})
+	if err != nil {
+		log.Printf("[txtdirect]: Couldn't execute the %s template: %s", tmpl.Name(), err.Error())
+		page.Reset()
+		page.WriteString(http.StatusText(status))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(page.Len()))
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
+
+// ParseTemplates parses the txtdirect config for the page templates
+func (t *Templates) ParseTemplates(c Dispenser) error {
+	page := c.Val()
+	if page != "not_found" && page != "error" && page != "fallback" {
+		return c.ArgErr() // unhandled option for templates
+	}
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("couldn't read the %s template: %s", page, err.Error())
+	}
+	tmpl, err := template.New(page).Parse(string(data))
+	if err != nil {
+		return fmt.Errorf("couldn't parse the %s template: %s", page, err.Error())
+	}
+
+	switch page {
+	case "not_found":
+		t.NotFound, t.notFound = args[0], tmpl
+	case "error":
+		t.Error, t.error = args[0], tmpl
+	case "fallback":
+		t.Fallback, t.fallback = args[0], tmpl
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// writeTemplates writes the page templates and returns their config
+func writeTemplates(t *testing.T, dir string) Templates {
+	pages := map[string]string{
+		"not_found": `<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Host}}{{.Path}} ({{.Placeholder "{label1}"}})</p>`,
+		"error":     `<h1>{{.Status}} on {{.Host}}</h1>`,
+		"fallback":  `<a href="{{.Target}}">Moved</a> {{.Placeholder "{uri}"}}`,
+	}
+	var config strings.Builder
+	config.WriteString("txtdirect {\nenable host path\ntemplates {\n")
+	for page, tmpl := range pages {
+		file := filepath.Join(dir, page+".html")
+		if err := ioutil.WriteFile(file, []byte(tmpl), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&config, "%s %s\n", page, file)
+	}
+	config.WriteString("}\n}\n")
+
+	conf, err := parse(caddy.NewTestController("http", config.String()))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return conf.Templates
+}
+
+func TestTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templates := writeTemplates(t, dir)
+
+	tests := []struct {
+		url      string
+		redirect string
+		status   int
+		location string
+		body     string
+	}{
+		{
+			"https://nomatch.e2e.test/missing",
+			"",
+			404,
+			"",
+			"<h1>404 Not Found</h1><p>nomatch.e2e.test/missing (nomatch)</p>",
+		},
+		{
+			"https://nomatch.e2e.test/missing?a=b",
+			"https://fallback.test",
+			301,
+			"https://fallback.test",
+			`<a href="https://fallback.test">Moved</a> /missing?a=b`,
+		},
+		{
+			"https://unsupported.templates.test/",
+			"",
+			500,
+			"",
+			"<h1>500 on unsupported.templates.test</h1>",
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:    []string{"host", "path", "unsupported"},
+			Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+			Redirect:  test.redirect,
+			Templates: templates,
+		}
+		w := httptest.NewRecorder()
+		StandaloneHandler{Config: c}.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("Test %d: Expected body %q, got %q", i, test.body, w.Body.String())
+		}
+	}
+
+	// Caddy's handler serves the error template instead of returning the error
+	c := Config{
+		Enable:    []string{"unsupported"},
+		Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+		Templates: templates,
+	}
+	w := httptest.NewRecorder()
+	status, err := TXTdirect{Config: c, Next: httpserver.EmptyNext}.ServeHTTP(w, httptest.NewRequest("GET", "https://unsupported.templates.test/", nil))
+	if status != 0 || err != nil || w.Code != 500 || w.Body.String() != "<h1>500 on unsupported.templates.test</h1>" {
+		t.Errorf("Expected the error template to be served, got %d %v %q", status, err, w.Body.String())
+	}
+	c.Templates = Templates{}
+	if status, err := (TXTdirect{Config: c, Next: httpserver.EmptyNext}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "https://unsupported.templates.test/", nil)); status != 500 || err == nil {
+		t.Errorf("Expected the error to be returned to Caddy without a template, got %d %v", status, err)
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	broken := filepath.Join(dir, "broken.html")
+	ioutil.WriteFile(broken, []byte("{{.Host"), 0600)
+
+	templates := writeTemplates(t, dir)
+	if templates.NotFound != filepath.Join(dir, "not_found.html") || templates.notFound == nil || templates.error == nil || templates.fallback == nil {
+		t.Errorf("Expected the templates to be parsed, got %+v", templates)
+	}
+
+	for _, config := range []string{"not_found /nonexistent.html", "error " + broken, "fallback", "unknown " + broken} {
+		c := caddy.NewTestController("http", `
+		txtdirect {
+			templates {
+				`+config+`
+			}
+		}
+		`)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TLSAsk answers the ask requests of Caddy's on-demand TLS, so the
+// certificates are only issued for the domains with a usable record
+type TLSAsk struct {
+	Enable bool
+	Path   string
+	// Addresses are the deployment's addresses, the domains have
+	// to resolve to one of them too when they're set
+	Addresses []net.IP
+	Timeout   time.Duration
+}
+
+const (
+	DefaultTLSAskPath    = "/tls-ask"
+	DefaultTLSAskTimeout = 5 * time.Second
+)
+
+// SetDefaults sets the default values for the ask endpoint's
+// config if the fields are empty
+func (a *TLSAsk) SetDefaults() {
+	if a.Path == "" {
+		a.Path = DefaultTLSAskPath
+	}
+	if a.Timeout == 0 {
+		a.Timeout = DefaultTLSAskTimeout
+	}
+}
+
+// ServeHTTP answers the ask request for the domain in its domain query
+// parameter with 200 if a certificate can be issued for it. It returns
+// false if the request's path doesn't belong to the endpoint.
+func (a *TLSAsk) ServeHTTP(w http.ResponseWriter, r *http.Request, c Config) (bool, error) {
+	if r.URL.Path != a.Path {
+		return false, nil
+	}
+	w.Header().Set("Cache-Control", "no-store")
+
+	domain := strings.ToLower(strings.TrimSuffix(r.URL.Query().Get("domain"), "."))
+	if _, ok := dns.IsDomainName(domain); !ok || !strings.Contains(domain, ".") || literalHost(domain) {
+		a.answer(w, http.StatusBadRequest, "invalid", c)
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.Timeout)
+	defer cancel()
+	if err := a.allowed(ctx, domain, c); err != nil {
+		log.Printf("[txtdirect]: Refused the certificate of %s: %s", domain, err.Error())
+		a.answer(w, http.StatusNotFound, "denied", c)
+		return true, nil
+	}
+	a.answer(w, http.StatusOK, "allowed", c)
+	return true, nil
+}
+
+// allowed checks if the domain has a usable record and
+// points at the deployment when its addresses are set
+func (a *TLSAsk) allowed(ctx context.Context, domain string, c Config) error {
+	req, err := http.NewRequest("GET", "https://"+domain+"/", nil)
+	if err != nil {
+		return err
+	}
+	req, _ = withRequestInfo(req.WithContext(ctx))
+	if _, err := getRecord(domain, req.Context(), c, req); err != nil {
+		return err
+	}
+	if len(a.Addresses) == 0 {
+		return nil
+	}
+
+	resolver := systemResolver(c)
+	if c.Resolver != "" && !isDoH(c.Resolver) {
+		custom := customResolver(c)
+		resolver = &custom
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		for _, address := range a.Addresses {
+			if addr.IP.Equal(address) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s doesn't point at the deployment's addresses", domain)
+}
+
+func (a *TLSAsk) answer(w http.ResponseWriter, code int, result string, c Config) {
+	if c.Prometheus.Enable {
+		TLSAskRequests.WithLabelValues(result).Add(1)
+	}
+	w.Header().Set("Status-Code", strconv.Itoa(code))
+	http.Error(w, result, code)
+}
+
+// ParseTLSAsk parses the txtdirect config for the on-demand TLS ask endpoint
+func (a *TLSAsk) ParseTLSAsk(c Dispenser) error {
+	switch c.Val() {
+	case "path":
+		args := c.RemainingArgs()
+		if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+			return fmt.Errorf("The given value for path field is not standard. It should be a path starting with /")
+		}
+		a.Path = args[0]
+
+	case "addresses":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return fmt.Errorf("The given value for addresses field is not standard. It should be a list of IP addresses")
+			}
+			a.Addresses = append(a.Addresses, ip)
+		}
+
+	case "timeout":
+		value, err := time.ParseDuration(c.RemainingArgs()[0])
+		if err != nil {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a duration")
+		}
+		a.Timeout = value
+
+	default:
+		return c.ArgErr() // unhandled option for tls_ask
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+)
+
+func TestTLSAsk(t *testing.T) {
+	tests := []struct {
+		url    string
+		enable []string
+		status int
+	}{
+		{"http://localhost/tls-ask?domain=healthy.health.test", []string{"host"}, http.StatusOK},
+		{"http://localhost/tls-ask?domain=Healthy.Health.Test.", []string{"host"}, http.StatusOK},
+		{"http://localhost/tls-ask?domain=absent.test", []string{"host"}, http.StatusNotFound},
+		{"http://localhost/tls-ask?domain=internal.policy.test", []string{"host"}, http.StatusNotFound},
+		{"http://localhost/tls-ask?domain=internal.policy.test", []string{"host", "proxy"}, http.StatusOK},
+		{"http://localhost/tls-ask", []string{"host"}, http.StatusBadRequest},
+		{"http://localhost/tls-ask?domain=127.0.0.1", []string{"host"}, http.StatusBadRequest},
+		{"http://localhost/tls-ask?domain=localhost", []string{"host"}, http.StatusBadRequest},
+		{"http://localhost/tls-ask?domain=a..test", []string{"host"}, http.StatusBadRequest},
+	}
+	for i, test := range tests {
+		c := Config{
+			Enable:   test.enable,
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			TLSAsk:   TLSAsk{Enable: true},
+		}
+		c.TLSAsk.SetDefaults()
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", test.url, nil), c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if w.Code != test.status {
+			t.Errorf("Test %d: Expected status %d for %s, got %d", i, test.status, test.url, w.Code)
+		}
+	}
+}
+
+func TestTLSAskAddresses(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(m)
+			q := m.Question[0]
+			switch {
+			case q.Qtype == dns.TypeTXT && (q.Name == "_redirect.ours.ask.test." || q.Name == "_redirect.theirs.ask.test."):
+				resp.Answer = append(resp.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+					Txt: []string{"v=txtv1;to=https://example.com"},
+				})
+			case q.Qtype == dns.TypeA && q.Name == "ours.ask.test.":
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("192.0.2.1"),
+				})
+			case q.Qtype == dns.TypeA && q.Name == "theirs.ask.test.":
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("198.51.100.1"),
+				})
+			}
+			w.WriteMsg(resp)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: conn.LocalAddr().String(),
+		TLSAsk:   TLSAsk{Enable: true, Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+	}
+	c.TLSAsk.SetDefaults()
+	for domain, status := range map[string]int{"ours.ask.test": http.StatusOK, "theirs.ask.test": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		if err := Redirect(w, httptest.NewRequest("GET", "http://localhost/tls-ask?domain="+domain, nil), c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if w.Code != status {
+			t.Errorf("Expected status %d for %s, got %d", status, domain, w.Code)
+		}
+	}
+}
+
+func TestParseTLSAsk(t *testing.T) {
+	tests := []struct {
+		config    string
+		expected  TLSAsk
+		shouldErr bool
+	}{
+		{"tls_ask", TLSAsk{Enable: true, Path: DefaultTLSAskPath, Timeout: DefaultTLSAskTimeout}, false},
+		{
+			"tls_ask {\npath /ask\naddresses 192.0.2.1 2001:db8::1\ntimeout 1s\n}",
+			TLSAsk{Enable: true, Path: "/ask", Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, Timeout: time.Second},
+			false,
+		},
+		{"tls_ask {\npath ask\n}", TLSAsk{}, true},
+		{"tls_ask {\naddresses example.com\n}", TLSAsk{}, true},
+		{"tls_ask {\naddresses\n}", TLSAsk{}, true},
+		{"tls_ask {\nunknown value\n}", TLSAsk{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable host\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error for %q", i, test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(conf.TLSAsk, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.TLSAsk)
+		}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build !notor
+// +build !notor
+
 /*
 Copyright 2019 - The TXTDirect Authors
 Licensed under the Apache License, Version 2.0 (the "License");
@@ -17,26 +20,49 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cretz/bine/tor"
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
 	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
 	cproxy "github.com/mholt/caddy/caddyhttp/proxy"
 	"golang.org/x/net/proxy"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
+func init() {
+	capabilities["tor"] = true
+}
+
 // DefaultOnionServicePort is the port used to serve the onion service on
 const DefaultOnionServicePort = 4242
 
+const (
+	// DefaultOnionRemotePort is the port the onion services are published on
+	DefaultOnionRemotePort = 80
+	// onionLocalPort is the local port of the onion service
+	// published when no onion services are configured
+	onionLocalPort = 8868
+)
+
+// onionKeyHeader is the header of Tor's hs_ed25519_secret_key files,
+// which are also written by the vanity address generators
+var onionKeyHeader = []byte("== ed25519v1-secret: type0 ==\x00\x00\x00")
+
 // Tor type config struct
 type Tor struct {
 	Enable bool
@@ -46,10 +72,48 @@ type Tor struct {
 	Torrc     string
 	DebugMode bool
 	LogFile   string
+	// Services are the v3 onion services serving the zones' records
+	Services []OnionService
+
+	state *torState
+}
+
+// OnionService is a v3 onion service serving a zone's records
+type OnionService struct {
+	Zone string
+	// Key is the path of the secret key in Tor's hs_ed25519_secret_key
+	// format, a new key is written to it when the file doesn't exist.
+	// The service gets a new address on each start without a key.
+	Key string
+	// Address is the expected onion address of the key, e.g. a vanity
+	// address, which makes sure the right key is loaded
+	Address string
+	// Port is the port the service is published on
+	Port int
+
+	key ed25519.KeyPair
+}
+
+// torState is the Tor instance's runtime state shared between the config's copies
+type torState struct {
+	sync.RWMutex
+	instance *tor.Tor
+	err      string
+	onions   []*tor.OnionService
+	services []onionStatus
+	// cancel cancels the starting instance
+	cancel context.CancelFunc
+	// generation changes on each start and stop, the
+	// instances started by an old generation are closed
+	generation int
+}
 
-	instance        *tor.Tor
-	contextCanceler context.CancelFunc
-	onion           *tor.OnionService
+// runningTor is the state of the Tor instance running in the process. The
+// Caddy instances and their txtdirect configs share the socks port, so the
+// first config started runs Tor until it's stopped.
+var runningTor struct {
+	sync.Mutex
+	state *torState
 }
 
 type TorResponse struct {
@@ -67,13 +131,9 @@ const (
 	torProxyTimeout   = 30000000 * time.Second
 )
 
-var bufferPool = sync.Pool{New: createBuffer}
-
-func createBuffer() interface{} {
-	return make([]byte, 0, 32*1024)
-}
-
-func (t *Tor) Start(c *caddy.Controller) {
+// Start starts the Tor instance and publishes the onion services, their
+// requests are served by next as the requests of the services' zones
+func (t *Tor) Start(c *caddy.Controller, next httpserver.Handler) {
 	var debugger io.Writer
 	if t.DebugMode {
 		if t.LogFile != "" {
@@ -87,7 +147,27 @@ func (t *Tor) Start(c *caddy.Controller) {
 		debugger = os.Stdout
 	}
 
-	torInstance, err := tor.Start(nil, &tor.StartConf{
+	runningTor.Lock()
+	if runningTor.state != nil && runningTor.state != t.state {
+		runningTor.Unlock()
+		log.Printf("[txtdirect]: Tor is already running, ignoring the other tor config")
+		return
+	}
+	runningTor.state = t.state
+	runningTor.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.state.Lock()
+	t.state.generation++
+	generation := t.state.generation
+	t.state.cancel = cancel
+	t.state.err = ""
+	for i := range t.state.services {
+		t.state.services[i].Error = ""
+	}
+	t.state.Unlock()
+
+	torInstance, err := tor.Start(ctx, &tor.StartConf{
 		NoAutoSocksPort: true,
 		ExtraArgs:       []string{"--SocksPort", strconv.Itoa(t.Port)},
 		TempDataDirBase: t.DataDir,
@@ -95,29 +175,184 @@ func (t *Tor) Start(c *caddy.Controller) {
 		DebugWriter:     debugger,
 	})
 	if err != nil {
-		log.Panicf("Unable to start Tor: %v", err)
+		t.state.Lock()
+		if t.state.generation == generation {
+			t.state.err = err.Error()
+		}
+		t.state.Unlock()
+		log.Printf("[txtdirect]: Unable to start Tor: %v", err)
+		t.release()
+		return
 	}
 
-	listenCtx := context.Background()
+	t.state.Lock()
+	if t.state.generation != generation {
+		// Stopped while starting
+		t.state.Unlock()
+		torInstance.Close()
+		return
+	}
+	t.state.instance = torInstance
+	t.state.Unlock()
 
-	onion, err := torInstance.Listen(listenCtx, &tor.ListenConf{LocalPort: 8868, RemotePorts: []int{80}})
-	if err != nil {
-		log.Panicf("Unable to start onion service: %v", err)
+	services := t.Services
+	if len(services) == 0 {
+		services = []OnionService{{Port: DefaultOnionRemotePort}}
+	}
+	for i, service := range services {
+		onion, err := torInstance.Listen(ctx, service.listenConf())
+		t.state.Lock()
+		if t.state.generation != generation {
+			t.state.Unlock()
+			if onion != nil {
+				onion.Close()
+			}
+			return
+		}
+		if err != nil {
+			t.state.services[i].Error = err.Error()
+			t.state.Unlock()
+			log.Printf("[txtdirect]: Unable to start the onion service of %q: %v", service.Zone, err)
+			continue
+		}
+		t.state.onions = append(t.state.onions, onion)
+		t.state.services[i].Address = onion.ID + ".onion"
+		t.state.services[i].Published = true
+		t.state.Unlock()
+		log.Printf("[txtdirect]: Serving %q on %s", service.Zone, onion.String())
+
+		if service.Zone != "" {
+			go http.Serve(onion, onionHandler(service.Zone, next))
+		}
 	}
+}
 
-	t.onion = onion
-	t.instance = torInstance
+// release lets the other tor configs start Tor
+func (t *Tor) release() {
+	runningTor.Lock()
+	defer runningTor.Unlock()
+	if runningTor.state == t.state {
+		runningTor.state = nil
+	}
+}
+
+// listenConf returns the config publishing the onion service
+func (o OnionService) listenConf() *tor.ListenConf {
+	conf := &tor.ListenConf{RemotePorts: []int{o.Port}, Version3: true}
+	if o.key != nil {
+		conf.Key = o.key
+	}
+	if o.Zone == "" {
+		conf.LocalPort = onionLocalPort
+	}
+	return conf
+}
+
+// onionHandler serves the onion service's requests as the zone's requests
+func onionHandler(zone string, next httpserver.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Host = zone
+		status, err := next.ServeHTTP(w, r)
+		if err != nil {
+			log.Printf("[txtdirect]: Couldn't serve the onion service request for %s: %s", zone, err.Error())
+		}
+		if status >= 400 {
+			http.Error(w, http.StatusText(status), status)
+		}
+	})
 }
 
-// Stop stops the tor instance, context listener and the onion service
+// Stop stops the tor instance, context listener and the onion services,
+// the starting instance is closed once it's started
 func (t *Tor) Stop() error {
-	if err := t.instance.Close(); err != nil {
+	if t.state == nil {
+		return nil
+	}
+	defer t.release()
+	t.state.Lock()
+	defer t.state.Unlock()
+	t.state.generation++
+	if t.state.cancel != nil {
+		t.state.cancel()
+		t.state.cancel = nil
+	}
+	for _, onion := range t.state.onions {
+		onion.Close()
+	}
+	t.state.onions = nil
+	for i := range t.state.services {
+		t.state.services[i].Published = false
+	}
+	if t.state.instance == nil {
+		return nil
+	}
+	err := t.state.instance.Close()
+	t.state.instance = nil
+	if err != nil {
 		return fmt.Errorf("[txtdirect]: Couldn't close the tor instance. %s", err.Error())
 	}
-	t.onion.Close()
 	return nil
 }
 
+// LoadKeys loads the onion services' keys, or generates and writes new
+// ones when the key files don't exist, and checks the expected addresses
+func (t *Tor) LoadKeys() error {
+	for i, service := range t.Services {
+		if service.Key == "" {
+			continue
+		}
+		key, err := loadOnionKey(service.Key)
+		if err != nil {
+			return err
+		}
+		address := torutil.OnionServiceIDFromPrivateKey(key) + ".onion"
+		if service.Address != "" && service.Address != address {
+			return fmt.Errorf("the onion key %s is for %s, not %s", service.Key, address, service.Address)
+		}
+		t.Services[i].key = key
+		t.Services[i].Address = address
+	}
+	return nil
+}
+
+// loadOnionKey reads the v3 onion service's secret key, or generates
+// and writes a new one when the file doesn't exist
+func loadOnionKey(path string) (ed25519.KeyPair, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't generate the onion key: %s", err.Error())
+		}
+		data = append(append([]byte{}, onionKeyHeader...), key.PrivateKey()...)
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("couldn't write the onion key: %s", err.Error())
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the onion key: %s", err.Error())
+	}
+	if len(data) != len(onionKeyHeader)+ed25519.PrivateKeySize || !bytes.Equal(data[:len(onionKeyHeader)], onionKeyHeader) {
+		return nil, fmt.Errorf("%s isn't a v3 onion service secret key", path)
+	}
+	return ed25519.PrivateKey(data[len(onionKeyHeader):]).KeyPair(), nil
+}
+
+// status returns the Tor instance's and the onion services' status
+func (t *Tor) status() torStatus {
+	status := torStatus{Port: t.Port, Services: []onionStatus{}}
+	if t.state == nil {
+		return status
+	}
+	t.state.RLock()
+	defer t.state.RUnlock()
+	status.Running = t.state.instance != nil
+	status.Error = t.state.err
+	status.Services = append(status.Services, t.state.services...)
+	return status
+}
+
 // Proxy redirects the request to the local onion serivce and the actual proxying
 // happens inside onion service's http handler
 func (t *Tor) Proxy(w http.ResponseWriter, r *http.Request, rec record, c Config) error {
@@ -176,7 +411,7 @@ func (t *Tor) Proxy(w http.ResponseWriter, r *http.Request, rec record, c Config
 }
 
 // ParseTor parses the txtdirect config for Tor proxy
-func (t *Tor) ParseTor(c *caddy.Controller) error {
+func (t *Tor) ParseTor(c Dispenser) error {
 	switch c.Val() {
 	case "port":
 		value, err := strconv.Atoi(c.RemainingArgs()[0])
@@ -201,18 +436,102 @@ func (t *Tor) ParseTor(c *caddy.Controller) error {
 	case "logfile":
 		t.LogFile = c.RemainingArgs()[0]
 
+	case "onion":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		zone := strings.ToLower(strings.TrimSuffix(args[0], "."))
+		for _, service := range t.Services {
+			if service.Zone == zone {
+				return fmt.Errorf("The onion service of %s is already configured", zone)
+			}
+		}
+		service := OnionService{Zone: zone}
+		c.NextArg()
+		if c.Val() == "{" {
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := service.ParseOnionService(c); err != nil {
+					return err
+				}
+			}
+		}
+		if service.Address != "" && service.Key == "" {
+			return fmt.Errorf("The onion service of %s needs a key for its address", zone)
+		}
+		t.Services = append(t.Services, service)
+
 	default:
 		return c.ArgErr() // unhandled option for tor
 	}
 	return nil
 }
 
+// ParseOnionService parses the txtdirect config for an onion service
+func (o *OnionService) ParseOnionService(c Dispenser) error {
+	switch c.Val() {
+	case "key":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		o.Key = args[0]
+
+	case "address":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		address := strings.ToLower(strings.TrimSuffix(args[0], "."))
+		if !strings.HasSuffix(address, ".onion") || len(address) != 62 {
+			return fmt.Errorf("The given value for address field is not standard. It should be a v3 onion address")
+		}
+		o.Address = address
+
+	case "port":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value < 1 || value > 65535 {
+			return fmt.Errorf("The given value for port field is not standard. It should be a port number")
+		}
+		o.Port = value
+
+	default:
+		return c.ArgErr() // unhandled option for onion
+	}
+	return nil
+}
+
 // SetDefaults sets the default values for prometheus config
 // if the fields are empty
 func (t *Tor) SetDefaults() {
 	if t.Port == 0 {
 		t.Port = DefaultOnionServicePort
 	}
+	for i := range t.Services {
+		if t.Services[i].Port == 0 {
+			t.Services[i].Port = DefaultOnionRemotePort
+		}
+	}
+	if t.state == nil {
+		t.state = &torState{}
+		for _, service := range t.Services {
+			t.state.services = append(t.state.services, onionStatus{
+				Zone:    service.Zone,
+				Address: service.Address,
+				Port:    service.Port,
+			})
+		}
+		if len(t.Services) == 0 {
+			t.state.services = []onionStatus{{Port: DefaultOnionRemotePort}}
+		}
+	}
 }
 
 // Header returns response headers
@@ -268,35 +587,12 @@ func (t *TorResponse) WriteBody() error {
 	return nil
 }
 
-var skipHeaders = map[string]struct{}{
-	"Content-Type":        {},
-	"Content-Disposition": {},
-	"Accept-Ranges":       {},
-	"Set-Cookie":          {},
-	"Cache-Control":       {},
-	"Expires":             {},
-}
-
-func copyHeader(dst, src http.Header) {
-	for k, vv := range src {
-		if _, ok := dst[k]; ok {
-			if _, shouldSkip := skipHeaders[k]; shouldSkip {
-				continue
-			}
-			if k != "Server" {
-				dst.Del(k)
-			}
-		}
-		for _, v := range vv {
-			dst.Add(k, v)
-		}
+// probeTor checks if the Tor instance accepts connections on its socks port
+func probeTor(ctx context.Context, t Tor) error {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(t.Port)))
+	if err != nil {
+		return fmt.Errorf("tor socks port isn't reachable: %s", err.Error())
 	}
-}
-
-func pooledIoCopy(dst io.Writer, src io.Reader) {
-	buf := bufferPool.Get().([]byte)
-	defer bufferPool.Put(buf)
-
-	bufCap := cap(buf)
-	io.CopyBuffer(dst, src, buf[0:bufCap:bufCap])
+	return conn.Close()
 }
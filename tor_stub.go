@@ -0,0 +1,60 @@
+//go:build notor
+// +build notor
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+// Tor is the config of the Tor onion service, which
+// isn't compiled into the binaries built with notor
+type Tor struct {
+	Enable bool
+}
+
+func (t *Tor) Start(c *caddy.Controller, next httpserver.Handler) {}
+
+func (t *Tor) Stop() error {
+	return nil
+}
+
+func (t *Tor) Proxy(w http.ResponseWriter, r *http.Request, rec record, c Config) error {
+	return errNotCompiled("tor")
+}
+
+// ParseTor fails since the Tor onion service isn't compiled in
+func (t *Tor) ParseTor(c Dispenser) error {
+	return errNotCompiled("tor")
+}
+
+func (t *Tor) SetDefaults() {}
+
+func (t *Tor) LoadKeys() error {
+	return nil
+}
+
+func (t *Tor) status() torStatus {
+	return torStatus{Services: []onionStatus{}}
+}
+
+func probeTor(ctx context.Context, t Tor) error {
+	return errNotCompiled("tor")
+}
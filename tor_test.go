@@ -0,0 +1,286 @@
+//go:build !notor
+// +build !notor
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cretz/bine/torutil"
+	"github.com/cretz/bine/torutil/ed25519"
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+)
+
+func TestLoadOnionKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A new key is written when the file doesn't exist
+	path := filepath.Join(dir, "hs_ed25519_secret_key")
+	key, err := loadOnionKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 96 || !bytes.HasPrefix(data, []byte("== ed25519v1-secret: type0 ==")) {
+		t.Errorf("Expected the key in Tor's format, got %q", data)
+	}
+
+	loaded, err := loadOnionKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PrivateKey(), key.PrivateKey()) || !bytes.Equal(loaded.PublicKey(), key.PublicKey()) {
+		t.Errorf("Expected the written key to be loaded")
+	}
+
+	invalid := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(invalid, data[:64], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadOnionKey(invalid); err == nil {
+		t.Errorf("Expected an error for a truncated key")
+	}
+	if _, err := loadOnionKey(filepath.Join(dir, "missing", "key")); err == nil {
+		t.Errorf("Expected an error when the key can't be written")
+	}
+}
+
+func TestTorLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "example.com")
+	if err := ioutil.WriteFile(path, append(append([]byte{}, onionKeyHeader...), key.PrivateKey()...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	address := torutil.OnionServiceIDFromPrivateKey(key) + ".onion"
+
+	tor := Tor{Enable: true, Services: []OnionService{
+		{Zone: "example.com", Key: path, Address: address},
+		{Zone: "example.org"},
+	}}
+	if err := tor.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	tor.SetDefaults()
+	if tor.Services[0].key == nil || tor.Services[1].key != nil {
+		t.Errorf("Expected the key to be loaded only for the service with a key file")
+	}
+	expected := torStatus{Port: DefaultOnionServicePort, Services: []onionStatus{
+		{Zone: "example.com", Address: address, Port: 80},
+		{Zone: "example.org", Port: 80},
+	}}
+	if status := tor.status(); !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, status)
+	}
+
+	tor = Tor{Enable: true, Services: []OnionService{
+		{Zone: "example.com", Key: path, Address: strings.Repeat("a", 56) + ".onion"},
+	}}
+	if err := tor.LoadKeys(); err == nil {
+		t.Errorf("Expected an error when the key isn't for the expected address")
+	}
+}
+
+func TestParseTor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtdirect-onion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	address := strings.Repeat("a", 56) + ".onion"
+
+	tests := []struct {
+		input     string
+		expected  []OnionService
+		shouldErr bool
+	}{
+		{
+			`tor {
+				onion Example.com. {
+					port 8080
+				}
+				onion example.org
+			}`,
+			[]OnionService{{Zone: "example.com", Port: 8080}, {Zone: "example.org", Port: 80}},
+			false,
+		},
+		{
+			fmt.Sprintf(`tor {
+				onion example.com {
+					key %s
+				}
+			}`, filepath.Join(dir, "example.com")),
+			[]OnionService{{Zone: "example.com", Key: filepath.Join(dir, "example.com"), Port: 80}},
+			false,
+		},
+		{"tor {\nonion\n}", nil, true},
+		{"tor {\nonion example.com\nonion example.com\n}", nil, true},
+		{"tor {\nonion example.com {\naddress " + address + "\n}\n}", nil, true},
+		{"tor {\nonion example.com {\naddress example.onion\n}\n}", nil, true},
+		{"tor {\nonion example.com {\nport 0\n}\n}", nil, true},
+		{"tor {\nonion example.com {\nkey\n}\n}", nil, true},
+		{"tor {\nonion example.com {\nvanity yes\n}\n}", nil, true},
+		{fmt.Sprintf("tor {\nonion example.com {\nkey %s\n}\n}", filepath.Join(dir, "missing", "key")), nil, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host tor
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		for j := range conf.Tor.Services {
+			conf.Tor.Services[j].key = nil
+			conf.Tor.Services[j].Address = ""
+		}
+		if !reflect.DeepEqual(conf.Tor.Services, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.Tor.Services)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com")); err != nil {
+		t.Errorf("Expected the onion key to be written: %s", err)
+	}
+}
+
+func TestOnionHandler(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+	handler := onionHandler("healthy.health.test", TXTdirect{Next: httpserver.EmptyNext, Config: c})
+
+	req := httptest.NewRequest("GET", "http://"+strings.Repeat("a", 56)+".onion/path", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://healthy.target.test/path" {
+		t.Errorf("Expected the zone's redirect, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestAdminTorStatus(t *testing.T) {
+	c := Config{
+		Admin: Admin{Enable: true, Token: "secret"},
+		Tor:   Tor{Enable: true, Services: []OnionService{{Zone: "example.com"}}},
+	}
+	c.Admin.SetDefaults()
+	c.Tor.SetDefaults()
+	c.Tor.state.services[0].Address = strings.Repeat("a", 56) + ".onion"
+	c.Tor.state.services[0].Published = true
+
+	req := httptest.NewRequest("GET", "https://example.com"+DefaultAdminPath+"/tor", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	if err := Redirect(w, req, c); err != nil {
+		t.Fatal(err)
+	}
+	var status torStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || w.Code != 200 {
+		t.Fatalf("Expected the status as JSON, got %d: %s", w.Code, w.Body.String())
+	}
+	expected := torStatus{Port: DefaultOnionServicePort, Services: []onionStatus{
+		{Zone: "example.com", Address: strings.Repeat("a", 56) + ".onion", Port: 80, Published: true},
+	}}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestTorRestart(t *testing.T) {
+	first := Tor{Enable: true}
+	first.SetDefaults()
+	second := Tor{Enable: true, Port: 4243}
+	second.SetDefaults()
+
+	// The first config started runs Tor, the others are ignored
+	runningTor.Lock()
+	runningTor.state = first.state
+	runningTor.Unlock()
+	second.Start(nil, nil)
+	if status := second.status(); status.Running || status.Error != "" {
+		t.Errorf("Expected the second config to be ignored, got %+v", status)
+	}
+
+	// Stopping cancels the starting instance and lets the next config start
+	ctx, cancel := context.WithCancel(context.Background())
+	first.state.cancel = cancel
+	generation := first.state.generation
+	if err := first.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() == nil || first.state.generation == generation {
+		t.Errorf("Expected the starting instance to be canceled")
+	}
+	runningTor.Lock()
+	running := runningTor.state
+	runningTor.Unlock()
+	if running != nil {
+		t.Errorf("Expected the stopped config to release the running Tor")
+	}
+
+	// Stopping an ignored config keeps the running Tor
+	runningTor.Lock()
+	runningTor.state = first.state
+	runningTor.Unlock()
+	if err := second.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	runningTor.Lock()
+	running = runningTor.state
+	runningTor.state = nil
+	runningTor.Unlock()
+	if running != first.state {
+		t.Errorf("Expected the running Tor to be kept")
+	}
+}
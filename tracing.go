@@ -0,0 +1,496 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing contains the configuration of the OpenTelemetry tracing. The
+// spans are exported in the OTLP/HTTP JSON encoding, e.g. to an
+// OpenTelemetry collector, and the W3C trace context headers are read
+// from the requests and passed to the upstreams.
+type Tracing struct {
+	Enable      bool
+	Endpoint    string
+	URLPath     string
+	Insecure    bool
+	ServiceName string
+	SampleRatio float64
+	// TrustedNetworks are the callers whose sampling decisions are
+	// followed, the other callers' requests are sampled by the ratio
+	TrustedNetworks []*net.IPNet
+
+	exporter *spanExporter
+}
+
+// traceSpan is a single operation of a traced request. The nil spans
+// belong to the requests which aren't traced, so their methods are no-ops.
+type traceSpan struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	end        time.Time
+	attributes map[string]interface{}
+	err        error
+
+	exporter *spanExporter
+}
+
+// spanExporter sends the ended spans to the OTLP endpoint in batches
+type spanExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	spans   chan *traceSpan
+	stop    chan struct{}
+	done    chan struct{}
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+}
+
+type spanKey struct{}
+
+// traceparentKey keeps the caller's traceparent header of the
+// untraced requests, so it's passed on to the upstreams as is
+type traceparentKey struct{}
+
+// The span kinds of OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	DefaultTracingEndpoint    = "localhost:4318"
+	DefaultTracingURLPath     = "/v1/traces"
+	DefaultTracingServiceName = "txtdirect"
+	DefaultTracingSampleRatio = 1.0
+	// tracerName is the instrumentation scope of the spans
+	tracerName = "github.com/txtdirect/txtdirect"
+	// spanBatchSize is the max number of spans sent in one export
+	spanBatchSize = 512
+	// spanQueueSize is the max number of spans waiting for the export,
+	// the spans ended while the queue is full get dropped
+	spanQueueSize      = 4096
+	spanExportInterval = 5 * time.Second
+	spanExportTimeout  = 10 * time.Second
+)
+
+// SetDefaults sets the default values for tracing config
+// if the fields are empty
+func (t *Tracing) SetDefaults() {
+	if t.Endpoint == "" {
+		t.Endpoint = DefaultTracingEndpoint
+	}
+	if t.URLPath == "" {
+		t.URLPath = DefaultTracingURLPath
+	}
+	if t.ServiceName == "" {
+		t.ServiceName = DefaultTracingServiceName
+	}
+	if t.SampleRatio == 0 {
+		t.SampleRatio = DefaultTracingSampleRatio
+	}
+	if t.exporter == nil {
+		scheme := "https"
+		if t.Insecure {
+			scheme = "http"
+		}
+		t.exporter = &spanExporter{
+			url:     scheme + "://" + t.Endpoint + t.URLPath,
+			service: t.ServiceName,
+			client:  &http.Client{Timeout: spanExportTimeout},
+			spans:   make(chan *traceSpan, spanQueueSize),
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+	}
+}
+
+// Start starts exporting the spans
+func (t *Tracing) Start() error {
+	t.exporter.startOnce.Do(func() {
+		go t.exporter.run()
+	})
+	return nil
+}
+
+// Stop exports the remaining spans and stops the exporter
+func (t *Tracing) Stop() error {
+	// The exporter is started in case the startup failed,
+	// so the spans queued so far still get exported
+	t.Start()
+	t.exporter.stopOnce.Do(func() {
+		close(t.exporter.stop)
+	})
+	<-t.exporter.done
+	return nil
+}
+
+// startRequest starts the request's span. The request joins the caller's
+// trace if it has a traceparent header. The trusted callers' sampling
+// decision is followed, the other requests get sampled by the ratio.
+func (t *Tracing) startRequest(r *http.Request) (*http.Request, *traceSpan) {
+	span := &traceSpan{
+		name:     "txtdirect.request",
+		kind:     spanKindServer,
+		start:    time.Now(),
+		exporter: t.exporter,
+		attributes: map[string]interface{}{
+			"http.method": r.Method,
+			"http.host":   r.Host,
+			"http.target": r.URL.RequestURI(),
+		},
+	}
+	traceID, parentID, sampled, ok := parseTraceparent(r.Header.Get("traceparent"))
+	switch {
+	case ok && t.trusted(r):
+		if !sampled {
+			return withTraceparent(r), nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	case ok:
+		// The untrusted callers choose their trace IDs, so
+		// the ratio is compared to a new random number
+		var random [8]byte
+		rand.Read(random[:])
+		if !t.sampled(random) {
+			return withTraceparent(r), nil
+		}
+		span.traceID, span.parentID = traceID, parentID
+	default:
+		rand.Read(span.traceID[:])
+		// The ratio is compared to the random part of the trace ID
+		var random [8]byte
+		copy(random[:], span.traceID[8:])
+		if !t.sampled(random) {
+			return r, nil
+		}
+	}
+	rand.Read(span.spanID[:])
+	return r.WithContext(context.WithValue(r.Context(), spanKey{}, span)), span
+}
+
+// sampled compares the sample ratio to the given random bytes
+func (t *Tracing) sampled(random [8]byte) bool {
+	return float64(binary.BigEndian.Uint64(random[:])>>11) < t.SampleRatio*(1<<53)
+}
+
+// trusted checks if the request comes from one of the trusted networks
+func (t *Tracing) trusted(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	for _, network := range t.TrustedNetworks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withTraceparent keeps the caller's traceparent of the untraced request
+func withTraceparent(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), traceparentKey{}, r.Header.Get("traceparent")))
+}
+
+// startSpan starts a child span of the context's span. The returned
+// span is nil when the request isn't traced.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *traceSpan) {
+	parent, ok := ctx.Value(spanKey{}).(*traceSpan)
+	if !ok || parent == nil {
+		return ctx, nil
+	}
+	span := &traceSpan{
+		traceID:    parent.traceID,
+		parentID:   parent.spanID,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+		exporter:   parent.exporter,
+	}
+	rand.Read(span.spanID[:])
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// setAttribute sets one of the span's attributes
+func (s *traceSpan) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// finish records the operation's error, if it has any, and queues the span
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	select {
+	case s.exporter.spans <- s:
+	default:
+		// The span is dropped rather than blocking the request
+	}
+}
+
+// finishRequest records the decision made for the request and queues its span
+func (s *traceSpan) finishRequest(info *requestInfo, status int, err error) {
+	if s == nil {
+		return
+	}
+	s.setAttribute("http.status_code", status)
+	s.setAttribute("txtdirect.zone", info.Zone)
+	s.setAttribute("txtdirect.type", info.Type)
+	s.setAttribute("txtdirect.record_cached", info.RecordCached)
+	if info.Fallback != "" {
+		s.setAttribute("txtdirect.fallback", info.Fallback)
+	}
+	if err == nil && status >= http.StatusInternalServerError {
+		err = fmt.Errorf("%d %s", status, http.StatusText(status))
+	}
+	s.finish(err)
+}
+
+// traceparent returns the W3C trace context header of the span
+func (s *traceSpan) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+// injectTrace adds the trace context header of the context's span to the
+// upstream request, so the upstream's spans join the request's trace. The
+// untraced requests pass the caller's trace context on unchanged.
+func injectTrace(ctx context.Context, header http.Header) {
+	if span, ok := ctx.Value(spanKey{}).(*traceSpan); ok && span != nil {
+		header.Set("traceparent", span.traceparent())
+		return
+	}
+	if traceparent, ok := ctx.Value(traceparentKey{}).(string); ok {
+		header.Set("traceparent", traceparent)
+	}
+}
+
+// parseTraceparent parses the W3C trace context header
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// run exports the queued spans periodically and whenever a batch
+// fills up, until the exporter gets stopped
+func (e *spanExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+
+	var batch []*traceSpan
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.export(batch); err != nil {
+			log.Printf("[txtdirect]: Couldn't export %d spans: %s", len(batch), err.Error())
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= spanBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends the spans to the OTLP endpoint
+func (e *spanExporter) export(spans []*traceSpan) error {
+	var otlpSpans []map[string]interface{}
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": e.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": tracerName},
+				"spans": otlpSpans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %d", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// otlp returns the span in the OTLP JSON encoding
+func (s *traceSpan) otlp() map[string]interface{} {
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != nil {
+		span["status"] = map[string]interface{}{"code": 2, "message": s.err.Error()}
+	}
+	return span
+}
+
+// otlpAttributes returns the attributes in the OTLP JSON encoding
+func otlpAttributes(attributes map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var encoded []interface{}
+	for _, key := range keys {
+		var value map[string]interface{}
+		switch v := attributes[key].(type) {
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		encoded = append(encoded, map[string]interface{}{"key": key, "value": value})
+	}
+	return encoded
+}
+
+// ParseTracing parses the txtdirect config for tracing
+func (t *Tracing) ParseTracing(c Dispenser) error {
+	switch c.Val() {
+	case "endpoint":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		t.Endpoint = args[0]
+
+	case "url_path":
+		args := c.RemainingArgs()
+		if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+			return fmt.Errorf("The given value for url_path field is not standard. It should be a path starting with /")
+		}
+		t.URLPath = args[0]
+
+	case "insecure":
+		t.Insecure = true
+
+	case "service_name":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		t.ServiceName = args[0]
+
+	case "sample_ratio":
+		value, err := strconv.ParseFloat(c.RemainingArgs()[0], 64)
+		if err != nil || value <= 0 || value > 1 {
+			return fmt.Errorf("The given value for sample_ratio field is not standard. It should be a number between 0 and 1")
+		}
+		t.SampleRatio = value
+
+	case "trusted_networks":
+		networks := c.RemainingArgs()
+		if len(networks) == 0 {
+			return c.ArgErr()
+		}
+		for _, network := range networks {
+			// The single addresses are trusted on their own
+			if !strings.Contains(network, "/") {
+				if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return fmt.Errorf("The given value for trusted_networks field is not standard. It should be a CIDR or an IP address")
+			}
+			t.TrustedNetworks = append(t.TrustedNetworks, ipNet)
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for tracing
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+// otlpCollector keeps the spans exported to it
+type otlpCollector struct {
+	sync.Mutex
+	service string
+	spans   []map[string]interface{}
+}
+
+func (o *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value map[string]interface{}
+				}
+			}
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if r.URL.Path != DefaultTracingURLPath || json.NewDecoder(r.Body).Decode(&payload) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	for _, resource := range payload.ResourceSpans {
+		for _, attribute := range resource.Resource.Attributes {
+			if attribute.Key == "service.name" {
+				o.service, _ = attribute.Value["stringValue"].(string)
+			}
+		}
+		for _, scope := range resource.ScopeSpans {
+			o.spans = append(o.spans, scope.Spans...)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	collector := &otlpCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Tracing: Tracing{
+			Enable:   true,
+			Endpoint: strings.TrimPrefix(server.URL, "http://"),
+			Insecure: true,
+			// The test requests come from 192.0.2.1
+			TrustedNetworks: parseNetworks("192.0.2.0/24"),
+		},
+	}
+	c.Tracing.SetDefaults()
+	c.Tracing.Start()
+
+	traceID := "0af7651916cd43dd8448eb211c80319c"
+	req := httptest.NewRequest("GET", "https://headers.test/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-b7ad6b7169203331-01")
+	if err := serve(httptest.NewRecorder(), req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// The callers which didn't sample the request aren't traced
+	req = httptest.NewRequest("GET", "https://headers.test/", nil)
+	req.Header.Set("traceparent", "00-11111111111111111111111111111111-b7ad6b7169203331-00")
+	if err := serve(httptest.NewRecorder(), req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.Tracing.Stop()
+
+	collector.Lock()
+	defer collector.Unlock()
+	if collector.service != DefaultTracingServiceName {
+		t.Errorf("Expected the service name %s, got %q", DefaultTracingServiceName, collector.service)
+	}
+	spans := make(map[string]map[string]interface{})
+	for _, span := range collector.spans {
+		if span["traceId"] != traceID {
+			t.Errorf("Expected only the spans of the sampled trace, got %v", span)
+		}
+		spans[span["name"].(string)] = span
+	}
+	root, ok := spans["txtdirect.request"]
+	if !ok {
+		t.Fatalf("Expected the request's span, got %v", collector.spans)
+	}
+	if root["parentSpanId"] != "b7ad6b7169203331" {
+		t.Errorf("Expected the request's span to be the caller's child, got %v", root["parentSpanId"])
+	}
+	attributes := make(map[string]interface{})
+	for _, attribute := range root["attributes"].([]interface{}) {
+		attribute := attribute.(map[string]interface{})
+		for _, value := range attribute["value"].(map[string]interface{}) {
+			attributes[attribute["key"].(string)] = value
+		}
+	}
+	if attributes["http.status_code"] != "301" || attributes["txtdirect.type"] != "host" {
+		t.Errorf("Expected the request's decision in the span's attributes, got %v", attributes)
+	}
+	for _, name := range []string{"txtdirect.lookup", "txtdirect.parse"} {
+		if span, ok := spans[name]; !ok || span["parentSpanId"] != root["spanId"] {
+			t.Errorf("Expected the %s span to be the request's child, got %v", name, span)
+		}
+	}
+}
+
+func TestTracingPropagation(t *testing.T) {
+	tracing := Tracing{Enable: true}
+	tracing.SetDefaults()
+	req, span := tracing.startRequest(httptest.NewRequest("GET", "https://example.com/", nil))
+	if span == nil {
+		t.Fatalf("Expected the request to be sampled")
+	}
+	header := make(http.Header)
+	injectTrace(req.Context(), header)
+	traceID, parentID, sampled, ok := parseTraceparent(header.Get("traceparent"))
+	if !ok || !sampled || traceID != span.traceID || parentID != span.spanID {
+		t.Errorf("Expected the outgoing request to carry the trace, got %q", header.Get("traceparent"))
+	}
+
+	// Nothing gets injected for the requests which aren't traced
+	header = make(http.Header)
+	injectTrace(context.Background(), header)
+	if header.Get("traceparent") != "" {
+		t.Errorf("Expected no traceparent header, got %s", header.Get("traceparent"))
+	}
+}
+
+func TestTracingUntrusted(t *testing.T) {
+	tracing := Tracing{Enable: true, SampleRatio: 1e-12, TrustedNetworks: parseNetworks("10.0.0.0/8")}
+	tracing.SetDefaults()
+	tests := []struct {
+		remoteAddr  string
+		traceparent string
+		traced      bool
+	}{
+		// The untrusted callers can't force the sampling
+		{"192.0.2.1:1234", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false},
+		{"10.0.0.1:1234", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true},
+		{"10.0.0.1:1234", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.Header.Set("traceparent", test.traceparent)
+		req, span := tracing.startRequest(req)
+		if (span != nil) != test.traced {
+			t.Errorf("Test %d: Expected traced to be %t", i, test.traced)
+			continue
+		}
+		if span != nil {
+			continue
+		}
+		// The untraced requests pass the caller's trace context on
+		header := make(http.Header)
+		injectTrace(req.Context(), header)
+		if header.Get("traceparent") != test.traceparent {
+			t.Errorf("Test %d: Expected the caller's traceparent to be passed on, got %q", i, header.Get("traceparent"))
+		}
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		sampled bool
+		ok      bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", false, true},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd-b7ad6b7169203331-01", false, false},
+		{"", false, false},
+	}
+	for i, test := range tests {
+		_, _, sampled, ok := parseTraceparent(test.value)
+		if sampled != test.sampled || ok != test.ok {
+			t.Errorf("Test %d: Expected sampled %t and ok %t, got %t and %t", i, test.sampled, test.ok, sampled, ok)
+		}
+	}
+}
+
+func TestParseTracing(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host
+		tracing {
+			service_name redirector
+			url_path /otlp/v1/traces
+			trusted_networks 10.0.0.0/8 192.0.2.1
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if conf.Tracing.ServiceName != "redirector" || conf.Tracing.exporter.url != "https://localhost:4318/otlp/v1/traces" ||
+		!reflect.DeepEqual(conf.Tracing.TrustedNetworks, parseNetworks("10.0.0.0/8", "192.0.2.1/32")) {
+		t.Errorf("Expected the tracing to be configured, got %+v", conf.Tracing)
+	}
+}
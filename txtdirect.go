@@ -19,9 +19,13 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
 const (
@@ -36,13 +40,83 @@ const (
 
 // Config contains the middleware's configuration
 type Config struct {
-	Enable     []string
-	Redirect   string
-	Resolver   string
-	LogOutput  string
-	Gomods     Gomods
-	Prometheus Prometheus
-	Tor        Tor
+	Enable      []string
+	Redirect    string
+	Resolver    string
+	Resolvers   []string
+	DoH         DoH
+	RecordCache RecordCache
+	Flatten     Flatten
+	Status      Status
+	HealthCheck HealthCheck
+	LogOutput   string
+	Gomods      Gomods
+	Prometheus  Prometheus
+	Tor         Tor
+	AccessLog   AccessLog
+	DecisionLog DecisionLog
+	Webhooks    Webhooks
+	Sinkhole    Sinkhole
+	Maintenance Maintenance
+	Probes      Probes
+	Honeypot    Honeypot
+	DNS         DNS
+	Priority    Priority
+	Adaptive    Adaptive
+	Dockerv2    Dockerv2
+	Proxy       Proxy
+	GeoIP       GeoIP
+	GeoPolicy   GeoPolicy
+	ClientCerts ClientCerts
+	RateLimit   RateLimit
+	Admin       Admin
+	Overrides   Overrides
+	Snapshot    Snapshot
+	Tracing     Tracing
+	Policy      Policy
+	QR          QR
+	Preview     Preview
+	WAF         WAF
+	// PreserveMethod redirects the requests with other methods than
+	// GET and HEAD with 308 instead of 301, so the clients keep their
+	// methods and bodies
+	PreserveMethod bool
+	// HTTPSOnly upgrades the plain http targets of the records to https
+	// and attaches an HSTS policy to the redirects served over HTTPS
+	HTTPSOnly bool
+	// Debug explains the decisions in plaintext
+	// to the clients asking for text/plain
+	Debug bool
+	// MultipleChoices lists all of the targets of the records
+	// with multiple targets to every client, not only the ones
+	// asking for text/uri-list
+	MultipleChoices bool
+	// Absent is the response served to the hosts without a record
+	Absent Absent
+	// Templates are the pages served instead of the bare responses
+	Templates Templates
+	// ApexFallback holds the templates of the zones checked when the
+	// host has no record, for the DNS providers mangling apex names
+	ApexFallback []string
+	// PortZones looks up the records of the requests on nonstandard
+	// ports under _port<N>.<host> before the host's own records
+	PortZones bool
+	// IPHosts handles the requests addressed to IP literals or localhost
+	IPHosts IPHosts
+	// Defaults are the record fields merged into the records
+	// under the configured zones
+	Defaults Defaults
+	// Backend serves the records from a file, Redis or etcd instead of DNS
+	Backend Backend
+	// MaxRequestAge is the wall-clock budget of the requests, the ones
+	// going over it are aborted with 504. Zero doesn't limit them.
+	MaxRequestAge time.Duration
+	// TLSAsk allows the on-demand TLS certificates of the domains with records
+	TLSAsk TLSAsk
+
+	// resolvers fails over between the resolvers
+	// when more than one is configured
+	resolvers *resolverPool
 }
 
 // getBaseTarget parses the placeholder in the given record's To= field
@@ -55,7 +129,92 @@ func getBaseTarget(rec record, r *http.Request) (string, int, error) {
 		}
 		rec.To = to
 	}
-	return rec.To, rec.Code, nil
+	to, err := iriToURI(rec.To)
+	if err != nil {
+		return "", 0, err
+	}
+	return to, rec.Code, nil
+}
+
+// fetchesUpstream checks if the record type serves the responses of its
+// upstream instead of redirecting the requests to its target
+func fetchesUpstream(recordType string) bool {
+	return recordType == "proxy" || recordType == "dockerv2" || recordType == "gomods" || recordType == "tor"
+}
+
+// errNoHealthyTarget is returned when every target of a record is unhealthy
+var errNoHealthyTarget = fmt.Errorf("no healthy target found")
+
+// selectTarget returns the first target of the record's to= chain
+// which can be used and isn't known to be unhealthy
+func selectTarget(rec record, r *http.Request, c Config) (string, int, error) {
+	targets := rec.Targets
+	if len(targets) == 0 {
+		targets = []string{rec.To}
+	}
+
+	var err error
+	var to string
+	code := rec.Code
+	for _, target := range targets {
+		rec.To = target
+		to, code, err = getBaseTarget(rec, r)
+		if err != nil {
+			log.Printf("[txtdirect]: Skipping the %s target: %s", target, err.Error())
+			continue
+		}
+		if c.Flatten.Enable {
+			to, code = flattenTarget(to, code, r, c)
+		}
+		if !c.HealthCheck.Enable || c.HealthCheck.Healthy(to) {
+			return to, code, nil
+		}
+		log.Printf("[txtdirect]: %s is unhealthy", to)
+	}
+	if err != nil {
+		return "", code, err
+	}
+	return "", code, errNoHealthyTarget
+}
+
+// reachableTarget returns the first target of the given fallback
+// chain which isn't known to be unhealthy. An empty string is
+// returned if there are no usable targets.
+func reachableTarget(chain []string, c Config) string {
+	for _, target := range chain {
+		uri, err := iriToURI(target)
+		if err != nil {
+			log.Printf("[txtdirect]: Couldn't convert the fallback to a valid URI: %s", err.Error())
+			continue
+		}
+		if c.HealthCheck.Enable && !c.HealthCheck.Healthy(uri) {
+			log.Printf("[txtdirect]: Skipping the unhealthy fallback %s", uri)
+			continue
+		}
+		return uri
+	}
+	return ""
+}
+
+// targetSchemeRegex matches the targets starting with a URL's scheme
+var targetSchemeRegex = regexp.MustCompile("^[A-Za-z][A-Za-z0-9+.-]*://")
+
+// splitTargets splits the given comma separated targets. Only the commas
+// followed by a URL's scheme start a new target, the other ones are a
+// part of the previous target like in https://example.com/?ids=1,2
+func splitTargets(chain string) []string {
+	var targets []string
+	for _, part := range strings.Split(chain, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+		case len(targets) > 0 && !targetSchemeRegex.MatchString(part):
+			targets[len(targets)-1] += "," + part
+		default:
+			targets = append(targets, part)
+		}
+	}
+	return targets
 }
 
 // contains checks the given slice to see if an item exists
@@ -72,36 +231,43 @@ func contains(array []string, word string) bool {
 // fallback redirects the request to the given fallback address
 // and if it's not provided it will check txtdirect config for
 // default fallback address
-func fallback(w http.ResponseWriter, r *http.Request, fallback, recordType, fallbackType string, code int, c Config) {
-	if code == http.StatusMovedPermanently {
-		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
-	}
+func fallback(w http.ResponseWriter, r *http.Request, targets []string, recordType, fallbackType string, code int, c Config) {
+	setCacheControl(w, code)
 	w.Header().Add("Status-Code", strconv.Itoa(code))
 
+	var fallback string
+	if fallbackType != "global" {
+		fallback = reachableTarget(targets, c)
+	}
+
+	info := getRequestInfo(r.Context())
 	if fallback != "" && fallbackType != "global" {
-		http.Redirect(w, r, fallback, code)
+		info.Fallback = fallbackType
+		c.Templates.redirect(w, r, fallback, code)
 		if c.Prometheus.Enable {
 			FallbacksCount.WithLabelValues(r.Host, recordType, fallbackType).Add(1)
 			RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(code)).Add(1)
 		}
 	} else if contains(c.Enable, "www") {
 		s := strings.Join([]string{defaultProtocol, "://", defaultSub, ".", r.URL.Host}, "")
-		http.Redirect(w, r, s, code)
+		info.Fallback = "subdomain"
+		c.Templates.redirect(w, r, s, code)
 		if c.Prometheus.Enable {
 			FallbacksCount.WithLabelValues(r.Host, recordType, "subdomain").Add(1)
 			RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(code)).Add(1)
 		}
-	} else if c.Redirect != "" {
+	} else if redirect := reachableTarget(splitTargets(c.Redirect), c); redirect != "" {
+		info.Fallback = "redirect"
 		w.Header().Set("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
-
-		http.Redirect(w, r, c.Redirect, http.StatusMovedPermanently)
+		c.Templates.redirect(w, r, redirect, http.StatusMovedPermanently)
 
 		if c.Prometheus.Enable {
 			FallbacksCount.WithLabelValues(r.Host, recordType, "redirect").Add(1)
-			RequestsByStatus.WithLabelValues(r.URL.Host, string(http.StatusMovedPermanently)).Add(1)
+			RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(http.StatusMovedPermanently)).Add(1)
 		}
 	} else {
-		http.NotFound(w, r)
+		info.Fallback = "notfound"
+		c.Templates.serveNotFound(w, r)
 	}
 	log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, w.Header().Get("Location"))
 }
@@ -112,8 +278,7 @@ func customResolver(c Config) net.Resolver {
 	return net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{}
-			return d.DialContext(ctx, network, c.Resolver)
+			return c.DNS.dial(ctx, network, c.Resolver)
 		},
 	}
 }
@@ -121,36 +286,322 @@ func customResolver(c Config) net.Resolver {
 // query checks the given zone using net.LookupTXT to
 // find TXT records in that zone
 func query(zone string, ctx context.Context, c Config) ([]string, error) {
-	// Removes port from zone
-	if strings.Contains(zone, ":") {
-		zoneSlice := strings.Split(zone, ":")
-		zone = zoneSlice[0]
+	absoluteZone := recordZone(zone)
+	info := getRequestInfo(ctx)
+	info.RecordCached = false
+
+	if c.RecordCache.Enable {
+		if txts, ok := c.RecordCache.Get(absoluteZone); ok {
+			if c.Prometheus.Enable {
+				CacheHits.Add(1)
+			}
+			info.RecordCached = true
+			return txts, nil
+		}
+		if c.RecordCache.GetNegative(absoluteZone) {
+			// Lookups of the hosts without records skip the resolver
+			// until the negative TTL is over
+			if c.Prometheus.Enable {
+				NegativeCacheHits.Add(1)
+			}
+			return nil, &queryError{Err: &noRecordsError{Zone: absoluteZone}}
+		}
+		if c.Prometheus.Enable {
+			CacheMisses.Add(1)
+		}
+		// Only one of the concurrent requests of an uncached
+		// zone looks it up, the others wait for its result
+		return c.RecordCache.coalesce(ctx, absoluteZone, c, func() ([]string, error) {
+			return lookupZone(ctx, absoluteZone, c)
+		})
+	}
+	return lookupZone(ctx, absoluteZone, c)
+}
+
+// lookupZone finds the TXT records of the given absolute zone and
+// falls back to the stale and last known good records on failures
+func lookupZone(ctx context.Context, absoluteZone string, c Config) ([]string, error) {
+	if c.Priority.Enable {
+		release, err := c.Priority.acquireResolver(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	var txts []string
+	var ttl time.Duration
+	var err error
+	lookupCtx, span := startSpan(ctx, "txtdirect.lookup", spanKindClient)
+	span.setAttribute("dns.zone", absoluteZone)
+	start := time.Now()
+	if c.DNS.Enable {
+		txts, ttl, err = c.DNS.lookup(lookupCtx, absoluteZone, c)
+	} else {
+		txts, ttl, err = lookupTXT(lookupCtx, absoluteZone, c)
+	}
+	span.setAttribute("dns.records", len(txts))
+	span.finish(err)
+	// The lookups of the requests whose clients hung up
+	// aren't failures of the zone, nobody waits for them
+	if err != nil && ctx.Err() == context.Canceled {
+		return nil, ctx.Err()
+	}
+	if c.Prometheus.Enable {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		DNSLookupDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		if c.Admin.Enable {
+			c.Admin.recordError(absoluteZone, err)
+		}
+		if txts, ok := c.RecordCache.GetStale(absoluteZone); ok {
+			log.Printf("[txtdirect]: Serving stale records for %s: %s", absoluteZone, err.Error())
+			if c.Prometheus.Enable {
+				CacheStaleServed.Add(1)
+			}
+			return txts, nil
+		}
+		// The zones which don't exist anymore aren't served from the snapshot
+		if c.Snapshot.Enable && !isNotFound(err) {
+			if txts, ok := c.Snapshot.get(absoluteZone); ok {
+				log.Printf("[txtdirect]: Serving the last known good records for %s: %s", absoluteZone, err.Error())
+				if c.Prometheus.Enable {
+					SnapshotServed.Add(1)
+				}
+				return txts, nil
+			}
+		}
+		if c.RecordCache.Enable && isNotFound(err) {
+			c.RecordCache.SetNegative(absoluteZone)
+			if c.Prometheus.Enable {
+				NegativeCacheSize.Set(float64(c.RecordCache.NegativeLen()))
+			}
+		}
+		return nil, &queryError{Err: err}
+	}
+
+	if c.RecordCache.Enable {
+		c.RecordCache.Set(absoluteZone, txts, ttl)
+	}
+	if c.Snapshot.Enable && len(txts) > 0 && txts[0] != "" {
+		compareSnapshot(absoluteZone, txts, c)
+		c.Snapshot.set(absoluteZone, txts)
 	}
+	return txts, nil
+}
+
+// recordZone returns the absolute zone which holds
+// the TXT record of the given host
+func recordZone(zone string) string {
+	zone = canonicalHost(zone)
 
 	if !strings.HasPrefix(zone, basezone) {
 		zone = strings.Join([]string{basezone, zone}, ".")
 	}
 
 	// Use absolute zone
-	var absoluteZone string
-	if strings.HasSuffix(zone, ".") {
-		absoluteZone = zone
-	} else {
-		absoluteZone = strings.Join([]string{zone, "."}, "")
+	return strings.Join([]string{zone, "."}, "")
+}
+
+// canonicalHost lowercases the given host and removes its port and
+// trailing dots, so all the forms of a host share their lookups and
+// cache entries. Internationalized hosts are converted to punycode
+// using IDNA2008, since their records are published under it.
+func canonicalHost(host string) string {
+	host, _ = splitHostPort(host)
+	host = strings.ToLower(host)
+	if !isASCII(host) {
+		if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+			host = ascii
+		}
 	}
+	return strings.TrimRight(host, ".")
+}
 
-	var txts []string
-	var err error
-	if c.Resolver != "" {
+// splitHostPort splits the given Host header into the host and the port.
+// The hosts without a port and the IPv6 literals with or without the
+// brackets are supported, the brackets are removed.
+func splitHostPort(host string) (string, string) {
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		return hostname, port
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ""
+}
+
+// lookupTXT finds the TXT records of the given absolute zone using the
+// configured backend or DNS resolver. The returned TTL is zero when the
+// resolver doesn't expose it.
+func lookupTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	return c.recordResolver().LookupTXT(ctx, zone)
+}
+
+// lookupTXTWith finds the TXT records of the given
+// absolute zone using the given resolver
+func lookupTXTWith(ctx context.Context, zone, resolver string, c Config) ([]string, time.Duration, error) {
+	c.Resolver = resolver
+	ctx, note := withFamilyNote(ctx)
+	txts, ttl, err := resolveTXT(ctx, zone, c)
+	if c.Prometheus.Enable {
+		result := "success"
+		if err != nil && resolverFailure(err) {
+			result = "failure"
+		}
+		ResolverLookups.WithLabelValues(lookupFamily(note, resolver, c), result).Add(1)
+	}
+	return txts, ttl, err
+}
+
+// resolveTXT sends the TXT query of the given zone to c.Resolver
+func resolveTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	switch {
+	case isDoH(c.Resolver):
+		txts, ttl, err := c.DoH.LookupTXT(ctx, c.Resolver, zone)
+		if err != nil && c.DoH.Fallback {
+			log.Printf("[txtdirect]: DoH query failed, falling back to the system resolver: %s", err.Error())
+			txts, err = systemResolver(c).LookupTXT(ctx, zone)
+			return txts, 0, err
+		}
+		return txts, ttl, err
+	case c.Resolver != "" && c.RecordCache.Enable:
+		// net.Resolver doesn't expose the TTLs which the cache needs
+		return exchangeTXT(ctx, zone, c.Resolver, c.DNS.dial)
+	case c.Resolver != "":
 		net := customResolver(c)
-		txts, err = net.LookupTXT(ctx, absoluteZone)
-	} else {
-		txts, err = net.LookupTXT(absoluteZone)
+		txts, err := net.LookupTXT(ctx, zone)
+		return txts, 0, err
+	case c.RecordCache.Enable:
+		return exchangeSystemTXT(ctx, zone, c)
+	default:
+		txts, err := systemResolver(c).LookupTXT(ctx, zone)
+		return txts, 0, err
+	}
+}
+
+// exchangeTXT queries the given DNS server for the zone's TXT records
+// and retries over TCP if the UDP response gets truncated
+func exchangeTXT(ctx context.Context, zone, server string, dial dialFunc) ([]string, time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeTXT)
+
+	resp, err := exchangeContext(ctx, "udp", m, server, dial)
+	if err == nil && resp.Truncated {
+		resp, err = exchangeContext(ctx, "tcp", m, server, dial)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("could not get TXT record: %s", err)
+		return nil, 0, err
 	}
-	return txts, nil
+	return txtsFromMsg(resp, zone)
+}
+
+// dnsExchangeTimeout limits the DNS exchanges without a deadline
+const dnsExchangeTimeout = 2 * time.Second
+
+// exchangeContext sends the DNS query to the server and waits for its
+// answer until the context is done. The DNS client only uses the
+// context's deadline to dial, so the clients hanging up didn't stop
+// the exchanges waiting for slow resolvers.
+func exchangeContext(ctx context.Context, network string, m *dns.Msg, server string, dial dialFunc) (*dns.Msg, error) {
+	conn, err := dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsExchangeTimeout)
+	}
+	co.SetDeadline(deadline)
+	// Canceling the context interrupts the pending read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			co.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	resp, err := co.ReadMsg()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err == nil && resp.Id != m.Id {
+		err = dns.ErrId
+	}
+	return resp, err
+}
+
+// txtsFromMsg extracts the TXT records from the given DNS response
+// and returns them alongside the lowest TTL among them
+func txtsFromMsg(m *dns.Msg, zone string) ([]string, time.Duration, error) {
+	if m.Rcode != dns.RcodeSuccess {
+		return nil, 0, &rcodeError{Rcode: m.Rcode, Zone: zone}
+	}
+
+	var txts []string
+	var ttl uint32
+	for _, rr := range m.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		txts = append(txts, strings.Join(txt.Txt, ""))
+		if len(txts) == 1 || txt.Hdr.Ttl < ttl {
+			ttl = txt.Hdr.Ttl
+		}
+	}
+	if len(txts) == 0 {
+		return nil, 0, &noRecordsError{Zone: zone}
+	}
+	return txts, time.Duration(ttl) * time.Second, nil
+}
+
+// noRecordsError is returned when the zone exists but has no TXT records
+type noRecordsError struct {
+	Zone string
+}
+
+func (e *noRecordsError) Error() string {
+	return fmt.Sprintf("no TXT records found for %s", e.Zone)
+}
+
+// queryError is returned when the records of a zone couldn't be
+// found, it keeps the lookup's error for isNotFound
+type queryError struct {
+	Err error
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("could not get TXT record: %s", e.Err)
+}
+
+// isNotFound checks if the given lookup error means that the
+// zone doesn't have any TXT records
+func isNotFound(err error) bool {
+	switch e := err.(type) {
+	case *queryError:
+		return isNotFound(e.Err)
+	case *noRecordsError:
+		return true
+	case *rcodeError:
+		return e.Rcode == dns.RcodeNameError
+	case *net.DNSError:
+		return e.IsNotFound
+	}
+	return false
 }
 
 func isIP(host string) bool {
@@ -162,6 +613,39 @@ func isIP(host string) bool {
 	return err == nil
 }
 
+// StatusClientClosedRequest is the status logged for the requests
+// whose clients hung up before they were served, like in nginx
+const StatusClientClosedRequest = 499
+
+// clientGone checks if the request's client hung up
+func clientGone(r *http.Request) bool {
+	return r.Context().Err() == context.Canceled
+}
+
+// handle limits the request's age if enabled and then admits it
+func handle(w http.ResponseWriter, r *http.Request, c Config) error {
+	if c.MaxRequestAge > 0 {
+		return limitRequestAge(w, r, c, admit)
+	}
+	return admit(w, r, c)
+}
+
+// admit admits the request into its priority class
+// pool if enabled and then redirects the request
+func admit(w http.ResponseWriter, r *http.Request, c Config) error {
+	if c.Priority.Enable {
+		admitted, release, err := c.Priority.admit(r, c)
+		if err != nil {
+			log.Printf("[txtdirect]: %s", err.Error())
+			c.Priority.reject(w)
+			return nil
+		}
+		defer release()
+		r = admitted
+	}
+	return Redirect(w, r, c)
+}
+
 // Redirect the request depending on the redirect record found
 func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	w.Header().Set("Server", "TXTDirect")
@@ -169,6 +653,61 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	host := r.Host
 	path := r.URL.Path
 
+	if c.Admin.Enable {
+		if c.Admin.handles(r) {
+			return c.Admin.ServeHTTP(w, r, c)
+		}
+		c.Enable = c.Admin.enabled(c.Enable)
+	}
+
+	if c.Status.Enable && c.Status.serves(r) {
+		return c.Status.ServeHTTP(w, r)
+	}
+
+	if c.Probes.Enable {
+		if served, err := c.Probes.ServeHTTP(w, r, c); served {
+			return err
+		}
+	}
+
+	if c.TLSAsk.Enable {
+		if served, err := c.TLSAsk.ServeHTTP(w, r, c); served {
+			return err
+		}
+	}
+
+	// The probes, ask endpoint and status page aren't rate limited
+	if c.RateLimit.Enable && c.RateLimit.limit(w, r, c) {
+		return nil
+	}
+
+	if c.Honeypot.Enable {
+		if reason, ok := c.Honeypot.suspicious(r); ok {
+			c.Honeypot.serve(w, r, reason)
+			return nil
+		}
+	}
+
+	if c.Overrides.Enable && c.Overrides.serve(w, r, c) {
+		return nil
+	}
+
+	if c.Policy.Enable {
+		w = &policyWriter{ResponseWriter: w, r: r, c: c}
+	}
+
+	if len(c.GeoPolicy.Hosts) > 0 && c.GeoPolicy.serve(w, r, c) {
+		return nil
+	}
+
+	if c.ClientCerts.Enable && c.ClientCerts.deny(w, r, "", c) {
+		return nil
+	}
+
+	if c.QR.Enable && c.QR.handles(r) {
+		return c.QR.serveTarget(w, r, c)
+	}
+
 	bl := make(map[string]bool)
 	bl["/favicon.ico"] = true
 
@@ -185,23 +724,55 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		return nil
 	}
 
-	if isIP(host) {
-		log.Println("[txtdirect]: Trying to access 127.0.0.1, fallback triggered.")
-		fallback(w, r, "", "", "global", 0, c)
-		return nil
+	// The IP literals and localhost can't have records, so they
+	// skip the lookups unless they're mapped to a default host
+	if literalHost(host) {
+		if c.IPHosts.Action != IPHostsHost {
+			return c.IPHosts.serve(w, r, c)
+		}
+		r = r.WithContext(r.Context())
+		r.Host = c.IPHosts.Host
+		host = r.Host
 	}
 
 	rec, err := getRecord(host, r.Context(), c, r)
 	if err != nil {
-		fallback(w, r, "", "", "global", http.StatusFound, c)
-		return nil
+		if clientGone(r) {
+			return err
+		}
+		return c.Absent.serve(w, r, c)
 	}
 
 	if !contains(c.Enable, rec.Type) {
 		return fmt.Errorf("option disabled")
 	}
 
-	fallbackURL, code := rec.To, rec.Code
+	if rec.Type == "sinkhole" {
+		RequestsCountBasedOnType.WithLabelValues(host, "sinkhole").Add(1)
+		c.Sinkhole.serve(w, rec)
+		if c.Prometheus.Enable {
+			RequestsByStatus.WithLabelValues(host, w.Header().Get("Status-Code")).Add(1)
+		}
+		return nil
+	}
+
+	if rec.Type == "honeypot" {
+		RequestsCountBasedOnType.WithLabelValues(host, "honeypot").Add(1)
+		c.Honeypot.serve(w, r, "record")
+		return nil
+	}
+
+	if rec.Maintenance {
+		serveMaintenance(w, host, c)
+		return nil
+	}
+
+	upgradeHTTPS(&rec, c)
+	setHSTS(w, r, rec)
+	setHeaders(w, rec)
+	rec.Code = methodPreservingCode(r, rec, c)
+
+	fallbackURL, code := rec.Targets, rec.Code
 
 	if rec.Re != "" && rec.From != "" {
 		log.Println("[txtdirect]: It's not allowed to use both re= and from= in a record.")
@@ -217,12 +788,17 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 				fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 				return nil
 			}
-			log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, rec.Root)
-			if rec.Code == http.StatusMovedPermanently {
-				w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+			root, err := iriToURI(rec.Root)
+			if err != nil {
+				log.Print("Fallback is triggered because an error has occurred: ", err)
+				fallback(w, r, fallbackURL, rec.Type, "to", code, c)
+				return nil
 			}
+			root = addQuery(root, rec)
+			log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, root)
+			setCacheControl(w, rec.Code)
 			w.Header().Add("Status-Code", strconv.Itoa(rec.Code))
-			http.Redirect(w, r, rec.Root, rec.Code)
+			http.Redirect(w, r, root, rec.Code)
 			if c.Prometheus.Enable {
 				RequestsByStatus.WithLabelValues(host, strconv.Itoa(rec.Code)).Add(1)
 			}
@@ -230,16 +806,62 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		}
 
 		if path != "" {
-			zone, from, pathSlice, err := zoneFromPath(host, path, rec)
+			pathHost := canonicalHost(host)
+			if rec.delegatedHost != "" {
+				pathHost = rec.delegatedHost
+			}
+			zone, from, pathSlice, err := zoneFromPath(pathHost, path, rec)
+			if err != nil {
+				log.Print("Fallback is triggered because an error has occurred: ", err)
+				fallback(w, r, fallbackURL, rec.Type, "to", code, c)
+				return nil
+			}
 			rec, err = getFinalRecord(zone, from, r.Context(), c, r, pathSlice)
 			if err != nil {
 				log.Print("Fallback is triggered because an error has occurred: ", err)
 				fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 				return nil
 			}
+			if rec.Maintenance {
+				serveMaintenance(w, host, c)
+				return nil
+			}
+			if upgradeHTTPS(&rec, c) {
+				setHSTS(w, r, rec)
+			}
+			setHeaders(w, rec)
+			rec.Code = methodPreservingCode(r, rec, c)
 		}
 	}
 
+	if met, err := rec.conditionsMet(r); !met {
+		if err != nil {
+			log.Print("Fallback is triggered because an error has occurred: ", err)
+		}
+		fallback(w, r, rec.Fallback, rec.Type, "condition", rec.Code, c)
+		return nil
+	}
+
+	if len(rec.Variants) > 0 {
+		rec = selectVariant(w, r, rec, c)
+	}
+
+	// The previews are held to the record type's client
+	// certificate and WAF rules like the usual requests
+	if c.ClientCerts.Enable && c.ClientCerts.deny(w, r, rec.Type, c) {
+		return nil
+	}
+
+	if c.WAF.Enable && c.WAF.filter(w, r, rec.Type, c) {
+		return nil
+	}
+
+	// The previews don't fetch anything from the upstreams
+	if info := getRequestInfo(r.Context()); info.preview && fetchesUpstream(rec.Type) {
+		info.target, _, err = getBaseTarget(rec, r)
+		return err
+	}
+
 	if rec.Type == "proxy" {
 		RequestsCountBasedOnType.WithLabelValues(host, "proxy").Add(1)
 		log.Printf("[txtdirect]: %s > %s", rec.From, rec.To)
@@ -252,36 +874,51 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		return nil
 	}
 
-	if rec.Type == "dockerv2" {
-		RequestsCountBasedOnType.WithLabelValues(host, "dockerv2").Add(1)
-
-		if !strings.Contains(r.Header.Get("User-Agent"), "Docker-Client") {
-			log.Println("[txtdirect]: The request is not from docker client, fallback triggered.")
-			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
-			return nil
-		}
-
-		err := redirectDockerv2(w, r, rec)
+	if rec.Type == "qr" {
+		RequestsCountBasedOnType.WithLabelValues(host, "qr").Add(1)
+		to, _, err := getBaseTarget(rec, r)
 		if err != nil {
-			log.Printf("[txtdirect]: couldn't redirect to the requested container: %s", err.Error())
+			log.Print("Fallback is triggered because an error has occurred: ", err)
 			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 			return nil
 		}
-		return nil
+		return c.QR.render(w, r, to)
+	}
+
+	if rec.Type == "dockerv2" {
+		RequestsCountBasedOnType.WithLabelValues(host, "dockerv2").Add(1)
+		return serveDockerv2(w, r, rec, c, fallbackURL, code)
 	}
 
 	if rec.Type == "host" {
 		RequestsCountBasedOnType.WithLabelValues(host, "host").Add(1)
-		to, code, err := getBaseTarget(rec, r)
+		if len(rec.Targets) > 1 && wantsChoices(r, c) {
+			if choices := targetChoices(rec, r, c); len(choices) > 0 {
+				log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, strings.Join(choices, ", "))
+				serveChoices(w, r, choices)
+				if c.Prometheus.Enable {
+					RequestsByStatus.WithLabelValues(host, strconv.Itoa(http.StatusMultipleChoices)).Add(1)
+				}
+				return nil
+			}
+		}
+		to, code, err := selectTarget(rec, r, c)
+		if err == errNoHealthyTarget {
+			if len(rec.Fallback) > 0 {
+				fallback(w, r, rec.Fallback, rec.Type, "health", code, c)
+				return nil
+			}
+			c.Maintenance.serve(w, c.HealthCheck.Interval)
+			return nil
+		}
 		if err != nil {
 			log.Print("Fallback is triggered because an error has occurred: ", err)
 			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 			return nil
 		}
+		to = addQuery(to, rec)
 		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, to)
-		if code == http.StatusMovedPermanently {
-			w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
-		}
+		setCacheControl(w, code)
 		w.Header().Add("Status-Code", strconv.Itoa(code))
 		http.Redirect(w, r, to, code)
 		if c.Prometheus.Enable {
@@ -290,12 +927,28 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		return nil
 	}
 
+	if rec.Type == "mirror" {
+		RequestsCountBasedOnType.WithLabelValues(host, "mirror").Add(1)
+		serveMirror(w, r, rec, c)
+		return nil
+	}
+
 	if rec.Type == "gometa" {
 		RequestsCountBasedOnType.WithLabelValues(host, "gometa").Add(1)
 
-		// Trigger fallback when request isn't from `go get`
+		// The visitors, which aren't the go command, are redirected to the
+		// record's docs or website when they're set or get the module's info
 		if r.URL.Query().Get("go-get") != "1" {
-			fallback(w, r, rec.Website, rec.Type, "website", http.StatusFound, c)
+			switch {
+			case strings.Contains(r.Header.Get("Accept"), "application/json"):
+				return gometaPage(w, r, rec, host, path)
+			case rec.Docs != "":
+				fallback(w, r, []string{rec.Docs}, rec.Type, "docs", http.StatusFound, c)
+			case rec.Website != "":
+				fallback(w, r, []string{rec.Website}, rec.Type, "website", http.StatusFound, c)
+			default:
+				return gometaPage(w, r, rec, host, path)
+			}
 			return nil
 		}
 
@@ -303,10 +956,12 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	}
 
 	if rec.Type == "gomods" {
+		RequestsCountBasedOnType.WithLabelValues(host, "gomods").Add(1)
 		return gomods(w, r, path, c)
 	}
 
 	if rec.Type == "tor" {
+		RequestsCountBasedOnType.WithLabelValues(host, "tor").Add(1)
 		return c.Tor.Proxy(w, r, rec, c)
 	}
 
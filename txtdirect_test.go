@@ -48,6 +48,7 @@ var txts = map[string]string{
 	// type=gometa
 	"_redirect.pkg.txtdirect.test.":           "v=txtv0;to=https://github.com/txtdirect/txtdirect;type=gometa;vcs=git",
 	"_redirect.pkgweb.metapath.e2e.test.":     "v=txtv0;to=https://github.com/txtdirect/txtdirect;type=gometa;website=https://godoc.org/go.txtdirect.org/txtdirect",
+	"_redirect.pkgdocs.metapath.e2e.test.":    "v=txtv0;to=https://github.com/txtdirect/txtdirect;type=gometa;website=https://txtdirect.org;docs=https://docs.internal.test/{host}{path}",
 	"_redirect.pkg.metapath.e2e.test.":        "v=txtv0;to=https://github.com/okkur/reposeed-server;type=gometa",
 	"_redirect.second.pkg.metapath.e2e.test.": "v=txtv0;to=https://github.com/okkur/reposeed;type=gometa",
 	// type=""
@@ -69,11 +70,185 @@ var txts = map[string]string{
 	"_redirect.fallbackdockerv2.test.":         "v=txtv0;type=path",
 	"_redirect.correct.fallbackdockerv2.test.": "v=txtv0;to=https://gcr.io/;type=dockerv2",
 	"_redirect.wrong.fallbackdockerv2.test.":   "v=txtv0;to=://gcr.io/;type=dockerv2",
+	"_redirect.container.dockerv2.test.":       "v=txtv0;to=https://gcr.io/testing/container;type=dockerv2;website=https://about.dockerv2.test",
 
 	// type=gometa
 	"_redirect.fallbackgometa.test.":          "v=txtv0;type=path",
 	"_redirect.website.fallbackgometa.test.":  "v=txtv0;to=https://github.com/okkur/reposeed-server/;website=https://about.okkur.io/;type=gometa",
 	"_redirect.redirect.fallbackgometa.test.": "v=txtv0;to=https://github.com/okkur/reposeed-server/;type=gometa",
+
+	//
+	//	Chained records
+	//
+	"_redirect.start.chain.test.":  "v=txtv0;to=https://middle.chain.test{path};type=host;code=301",
+	"_redirect.middle.chain.test.": "v=txtv0;to=https://end.chain.test{path};type=host;code=302",
+	"_redirect.loop.chain.test.":   "v=txtv0;to=https://pool.chain.test;type=host;code=301",
+	"_redirect.pool.chain.test.":   "v=txtv0;to=https://loop.chain.test;type=host;code=301",
+
+	//
+	//	Health checked records
+	//
+	"_redirect.fallback.health.test.":    "v=txtv0;to=https://unhealthy.target.test{uri};fallback=https://fallback.target.test;type=host",
+	"_redirect.maintenance.health.test.": "v=txtv0;to=https://unhealthy.target.test{uri};type=host",
+	"_redirect.healthy.health.test.":     "v=txtv0;to=https://healthy.target.test{uri};type=host",
+	"_redirect.chain.health.test.":       "v=txtv0;to=https://unhealthy.target.test{uri},https://healthy.target.test{uri};type=host",
+	"_redirect.fallbacks.health.test.":   "v=txtv0;to=https://unhealthy.target.test{uri};fallback=https://unhealthy.target.test/down,https://fallback.target.test;type=host",
+	"_redirect.error.health.test.":       "v=txtv0;to=https://unhealthy.target.test,https://healthy.target.test;from=/a;re=b;type=host",
+
+	//
+	//	Sinkhole records
+	//
+	"_redirect.default.sinkhole.test.": "v=txtv0;type=sinkhole",
+	"_redirect.gone.sinkhole.test.":    "v=txtv0;type=sinkhole;code=410",
+
+	//
+	//	Maintenance records
+	//
+	"_redirect.status.maintenance.test.":    "v=txtv0;to=https://example.com;status=maintenance;type=host",
+	"_redirect.code.maintenance.test.":      "v=txtv0;to=https://example.com;code=503;type=host",
+	"_redirect.path.maintenance.test.":      "v=txtv0;type=path",
+	"_redirect.down.path.maintenance.test.": "v=txtv0;to=https://example.com/down;status=maintenance",
+	"_redirect.up.path.maintenance.test.":   "v=txtv0;to=https://example.com/up",
+
+	//
+	//	Templates records
+	//
+	"_redirect.unsupported.templates.test.": "v=txtv0;to=https://example.com;type=unsupported",
+
+	//
+	//	Attribution records
+	//
+	"_redirect.utm.attribution.test.":      "v=txtv0;to=https://example.com/landing?ref=ad;query-utm_source={host};query-ref=short;referrer=Origin",
+	"_redirect.override.attribution.test.": "v=txtv0;to=https://example.com/landing?ref=ad;query-ref=short;query_override=true",
+
+	//
+	//	Records split into parts
+	//
+	"_redirect.parts.test.":              "v=txtv0;type=path;parts=2",
+	"_redirect._1.parts.test.":           "root=https://root.parts.test;code=302",
+	"_redirect.long.parts.test.":         "v=txtv0;to=https://long.parts.test/" + strings.Repeat("a", 300) + ";parts=2",
+	"_redirect._1.long.parts.test.":      "code=302",
+	"_redirect.host.parts.test.":         "v=txtv0;type=host;parts=3",
+	"_redirect._1.host.parts.test.":      "to=https://example.com/split",
+	"_redirect._2.host.parts.test.":      "code=302",
+	"_redirect.missing.host.parts.test.": "v=txtv0;to=https://example.com;parts=2",
+
+	//
+	//	Records using the zone defaults
+	//
+	"_redirect.defaults.test.":            "v=txtv0;to=https://example.com/defaults",
+	"_redirect.own.defaults.test.":        "v=txtv0;to=https://example.com/own;code=301",
+	"_redirect.paths.defaults.test.":      "v=txtv0",
+	"_redirect.docs.paths.defaults.test.": "v=txtv0;to=https://docs.example.com",
+
+	//
+	//	Default host of the IP literals
+	//
+	"_redirect.default.iphosts.test.": "v=txtv0;to=https://example.com/{host};code=302",
+
+	//
+	//	Internationalized domain records
+	//
+	"_redirect.xn--mnchen-3ya.idn.test.": "v=txtv0;to=https://example.com/{label1};code=302",
+
+	//
+	//	Records of the nonstandard ports
+	//
+	"_redirect.ports.test.":                "v=txtv0;to=https://example.com/default",
+	"_redirect._port8080.ports.test.":      "v=txtv0;to=https://example.com/8080",
+	"_redirect._port8443.ports.test.":      "v=txtv0;type=path",
+	"_redirect.docs._port8443.ports.test.": "v=txtv0;to=https://docs.example.com/8443",
+
+	//
+	//	Honeypot records
+	//
+	"_redirect.trap.honeypot.test.": "v=txtv0;type=honeypot",
+	"_redirect.real.honeypot.test.": "v=txtv0;to=https://real.target.test;type=host",
+
+	//
+	//	QR records
+	//
+	"_redirect.qr.test.":        "v=txtv0;to=https://example.com/{label1};type=qr",
+	"_redirect.noto.qr.test.":   "v=txtv0;type=qr",
+	"_redirect.target.qr.test.": "v=txtv0;to=https://example.com/target;type=host;code=302",
+
+	//
+	//	Policy records
+	//
+	"_redirect.allowed.policy.test.":  "v=txtv0;to=https://docs.allowed.test;type=host;code=302",
+	"_redirect.foreign.policy.test.":  "v=txtv0;to=https://evil.example.com;type=host;code=302",
+	"_redirect.scheme.policy.test.":   "v=txtv0;to=javascript://allowed.test/%0Aalert(1);type=host;code=302",
+	"_redirect.internal.policy.test.": "v=txtv0;to=http://127.0.0.1:1/;type=proxy",
+
+	//
+	//	Variant records
+	//
+	"_redirect.ab.variants.test.":     "v=txtv0;to=https://a.example.com{uri} weight=3;to=https://b.example.com{uri} weight=1;sticky=true;type=host;code=302",
+	"_redirect.canary.variants.test.": "v=txtv0;to=https://stable.example.com weight=1;to=https://canary.example.com weight=0;type=host;code=302",
+
+	//
+	//	Delegation records
+	//
+	"_redirect.a.delegation.test.":          "v=txtv0;type=dns;to=links.delegation.test",
+	"_redirect.twice.delegation.test.":      "v=txtv0;type=dns;to=_redirect.a.delegation.test",
+	"_redirect.links.delegation.test.":      "v=txtv0;to=https://central.example.com{uri};type=host;code=302",
+	"_redirect.path.delegation.test.":       "v=txtv0;type=dns;to=paths.delegation.test",
+	"_redirect.paths.delegation.test.":      "v=txtv0;type=path",
+	"_redirect.docs.paths.delegation.test.": "v=txtv0;to=https://docs.example.com;type=host;code=302",
+	"_redirect.loop1.delegation.test.":      "v=txtv0;type=dns;to=loop2.delegation.test",
+	"_redirect.loop2.delegation.test.":      "v=txtv0;type=dns;to=loop1.delegation.test",
+	"_redirect.deep1.delegation.test.":      "v=txtv0;type=dns;to=deep2.delegation.test",
+	"_redirect.deep2.delegation.test.":      "v=txtv0;type=dns;to=deep3.delegation.test",
+	"_redirect.deep3.delegation.test.":      "v=txtv0;type=dns;to=deep4.delegation.test",
+	"_redirect.deep4.delegation.test.":      "v=txtv0;type=dns;to=deep5.delegation.test",
+	"_redirect.deep5.delegation.test.":      "v=txtv0;type=dns;to=deep6.delegation.test",
+	"_redirect.deep6.delegation.test.":      "v=txtv0;type=dns;to=links.delegation.test",
+	"_redirect.missing.delegation.test.":    "v=txtv0;type=dns;to=nowhere.delegation.test",
+	"_redirect.noto.delegation.test.":       "v=txtv0;type=dns",
+
+	//
+	//	Wildcard records
+	//
+	"_redirect._.wildcard.test.":          "v=txtv0;to=https://wildcard.example.com;type=host",
+	"_redirect._.specific.wildcard.test.": "v=txtv0;to=https://specific.example.com;type=host",
+
+	//
+	//	Apex fallback records
+	//
+	"_redirect.doubled.test.doubled.test.": "v=txtv0;to=https://doubled.example.com;type=host",
+	"_redirect.\\@.at.test.":               "v=txtv0;to=https://at.example.com;type=host",
+
+	//
+	//	HSTS records
+	//
+	"_redirect.hsts.test.":         "v=txtv0;to=https://example.com;type=host;hsts=31536000,includesubdomains,preload",
+	"_redirect.invalid.hsts.test.": "v=txtv0;to=https://example.com;type=host;hsts=forever",
+	"_redirect.plain.hsts.test.":   "v=txtv0;to=http://plain.example.com/docs,HTTP://second.example.com;type=host;code=302",
+	"_redirect.kept.hsts.test.":    "v=txtv0;to=http://kept.example.com;type=host;code=302;https_only=false",
+	"_redirect.forced.hsts.test.":  "v=txtv0;to=http://forced.example.com;type=host;code=302;https_only=true;hsts=300",
+
+	//
+	//	Header records
+	//
+	"_redirect.headers.test.":           "v=txtv0;to=https://example.com;type=host;code=301;header-Cache-Control=no-store;header-x-frame-options=DENY",
+	"_redirect.temporary.headers.test.": "v=txtv0;to=https://example.com;type=host;code=307",
+	"_redirect.invalid.headers.test.":   "v=txtv0;to=https://example.com;type=host;header-Location=https://evil.test",
+	"_redirect.noindex.headers.test.":   "v=txtv0;to=https://example.com;type=host;noindex=true;header-X-Robots-Tag=nofollow",
+	"_redirect.badindex.headers.test.":  "v=txtv0;to=https://example.com;type=host;noindex=maybe",
+
+	//
+	//	Conditional records
+	//
+	"_redirect.conditions.test.":          "v=txtv0;to=https://m.example.com;type=host;if={>User-Agent}~(?i)mobile;unless={?desktop}==1;fallback=https://www.example.com",
+	"_redirect.conditions.path.test.":     "v=txtv0;type=path",
+	"_redirect.app.conditions.path.test.": "v=txtv0;to=https://m.example.com/{$1};type=host;if={>User-Agent}~(?i)mobile;fallback=https://www.example.com/{$1}",
+
+	//
+	//	Mirror records
+	//
+	"_redirect.mirror.test.":         "v=txtv0;type=mirror;to=https://fallback.mirror.test;mirror=https://de.mirror.test{uri} country=DE;mirror=https://gb.mirror.test{uri} weight=2 country=gb,IE;mirror=https://global.mirror.test{uri} weight=3",
+	"_redirect.invalid.mirror.test.": "v=txtv0;type=mirror;to=https://fallback.mirror.test;mirror=https://a.mirror.test weight=0",
+	"_redirect.hashes.mirror.test.":  "v=txtv0;type=mirror;mirror=https://de.mirror.test{uri} country=DE;mirror=https://global.mirror.test{uri} weight=2;hash=sha-1:2fd4e1c67a2d28fced849ee1bb76e7391b93eb12;hash=sha-256:d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592;size=43",
 }
 
 // Testing DNS server port
@@ -83,7 +258,15 @@ const port = 6000
 var server = &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
 
 func TestMain(m *testing.M) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
 	go RunDNSServer()
+	// Wait for the DNS server before running the tests which depend on it
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		log.Println("DNS server didn't start in time")
+	}
 	os.Exit(m.Run())
 }
 
@@ -100,6 +283,27 @@ func TestRedirectBlacklist(t *testing.T) {
 	}
 }
 
+func TestRecordZone(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com", "_redirect.example.com."},
+		{"Example.COM", "_redirect.example.com."},
+		{"example.com.", "_redirect.example.com."},
+		{"Example.COM.", "_redirect.example.com."},
+		{"example.com..", "_redirect.example.com."},
+		{"example.com:8080", "_redirect.example.com."},
+		{"EXAMPLE.com.:8080", "_redirect.example.com."},
+		{"_redirect.Example.com.", "_redirect.example.com."},
+	}
+	for i, test := range tests {
+		if zone := recordZone(test.host); zone != test.expected {
+			t.Errorf("Test %d: Expected %s for %s, got %s", i, test.expected, test.host, zone)
+		}
+	}
+}
+
 func Test_query(t *testing.T) {
 	tests := []struct {
 		zone string
@@ -136,7 +340,7 @@ func parseDNSQuery(m *dns.Msg) {
 			log.Printf("Query for %s\n", q.Name)
 			m.Answer = append(m.Answer, &dns.TXT{
 				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
-				Txt: []string{txts[q.Name]},
+				Txt: splitTXT(txts[q.Name]),
 			})
 		}
 	}
@@ -305,22 +509,22 @@ func TestConfigE2e(t *testing.T) {
 
 func Test_fallback(t *testing.T) {
 	tests := []struct {
-		url      string
+		url      []string
 		code     int
 		redirect string
 	}{
 		{
-			"https://goto.fallback.test",
+			[]string{"https://goto.fallback.test"},
 			301,
 			"",
 		},
 		{
-			"",
+			nil,
 			403,
 			"https://goto.redirect.test",
 		},
 		{
-			"https://goto.fallback.test",
+			[]string{"https://goto.fallback.test"},
 			404,
 			"https://dontgoto.redirect.test",
 		},
@@ -339,6 +543,43 @@ func Test_fallback(t *testing.T) {
 	}
 }
 
+func Test_fallbackChain(t *testing.T) {
+	tests := []struct {
+		redirect string
+		code     int
+		location string
+	}{
+		{
+			"https://down.redirect.test,https://up.redirect.test",
+			301,
+			"https://up.redirect.test",
+		},
+		{
+			"https://down.redirect.test",
+			404,
+			"",
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Redirect:    test.redirect,
+			Enable:      []string{"host"},
+			HealthCheck: HealthCheck{Enable: true},
+		}
+		c.HealthCheck.SetDefaults()
+		c.HealthCheck.store.targets["https://down.redirect.test/"] = &targetHealth{healthy: false, lastSeen: time.Now()}
+
+		resp := httptest.NewRecorder()
+		fallback(resp, httptest.NewRequest("GET", "https://testing.test", nil), nil, "", "global", http.StatusFound, c)
+		if resp.Code != test.code {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.code, resp.Code)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+	}
+}
+
 func TestFallbackE2e(t *testing.T) {
 	tests := []struct {
 		url         string
@@ -426,6 +667,9 @@ func TestFallbackE2e(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
+		if contains(test.enable, "dockerv2") && !capabilities["dockerv2"] {
+			continue
+		}
 		req := httptest.NewRequest("GET", test.url, nil)
 		req.Header = test.headers
 		resp := httptest.NewRecorder()
@@ -715,3 +959,54 @@ func (u *fakeUpstream) Select(r *http.Request) *proxy.UpstreamHost {
 	}
 	return u.host
 }
+
+func identical(s1, s2 []string) bool {
+	if s1 == nil {
+		if s2 == nil {
+			return true
+		}
+		return false
+	}
+	if s2 == nil {
+		return false
+	}
+
+	if len(s1) != len(s2) {
+		return false
+	}
+
+	for i := range s1 {
+		found := false
+		for j := range s2 {
+			if s1[i] == s2[j] {
+				found = true
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		host     string
+		hostname string
+		port     string
+	}{
+		{"example.com", "example.com", ""},
+		{"example.com:8080", "example.com", "8080"},
+		{"[2001:db8::1]:8443", "2001:db8::1", "8443"},
+		{"[2001:db8::1]", "2001:db8::1", ""},
+		{"2001:db8::1", "2001:db8::1", ""},
+		{"example.com.:65535", "example.com.", "65535"},
+	}
+	for i, test := range tests {
+		hostname, port := splitHostPort(test.host)
+		if hostname != test.hostname || port != test.port {
+			t.Errorf("Test %d: Expected %s and %s, got %s and %s", i, test.hostname, test.port, hostname, port)
+		}
+	}
+}
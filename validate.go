@@ -0,0 +1,91 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// PathValidation is the outcome of running a path record against a sample path
+type PathValidation struct {
+	Path     string
+	Zone     string
+	Captures []string
+	Target   string
+	Err      error
+}
+
+// ValidateRecord parses the given path record and runs it against the
+// sample paths on the host. The captured parts of every path get
+// substituted into the target record, which is the record that would be
+// found on the path's zone.
+func ValidateRecord(host, pathRecord, targetRecord string, paths []string) ([]PathValidation, error) {
+	req, err := http.NewRequest("GET", "http://"+host, nil)
+	if err != nil {
+		return nil, err
+	}
+	rec := record{}
+	if err := rec.Parse(pathRecord, req, Config{Enable: allOptions}); err != nil {
+		return nil, fmt.Errorf("could not parse the path record: %s", err.Error())
+	}
+	if rec.Type != "path" {
+		return nil, fmt.Errorf("the record's type should be path, got %q", rec.Type)
+	}
+	if rec.Re != "" && rec.From != "" {
+		return nil, fmt.Errorf("it's not allowed to use both re= and from= in a record")
+	}
+
+	results := make([]PathValidation, 0, len(paths))
+	for _, path := range paths {
+		result := PathValidation{Path: path}
+		results = append(results, result.run(host, rec, targetRecord))
+	}
+	return results, nil
+}
+
+// run finds the path's zone and substitutes its captures into the target record
+func (v PathValidation) run(host string, rec record, targetRecord string) PathValidation {
+	req, err := http.NewRequest("GET", "http://"+host+v.Path, nil)
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	zone, _, captures, err := zoneFromPath(canonicalHost(host), req.URL.Path, rec)
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	if rec.Re != "" && len(captures) == 0 {
+		v.Err = fmt.Errorf("the given regex %s doesn't match %s", rec.Re, v.Path)
+		return v
+	}
+	v.Zone, v.Captures = zone, captures
+	if targetRecord == "" {
+		return v
+	}
+
+	target, err := parsePlaceholders(targetRecord, req, captures)
+	if err != nil {
+		v.Err = err
+		return v
+	}
+	final := record{}
+	if err := final.Parse(target, req, Config{Enable: allOptions}); err != nil {
+		v.Err = fmt.Errorf("could not parse the target record: %s", err.Error())
+		return v
+	}
+	v.Target = final.To
+	return v
+}
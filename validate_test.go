@@ -0,0 +1,59 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"testing"
+)
+
+func TestValidateRecord(t *testing.T) {
+	results, err := ValidateRecord(
+		"example.com",
+		"v=txtv0;type=path;re=\\/(\\d+)",
+		"v=txtv0;to=https://example.test/{$1}/{$2};type=host",
+		[]string{"/12/34", "/docs"},
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected 2 results, got %d", len(results))
+	}
+
+	first := results[0]
+	if first.Err != nil {
+		t.Fatalf("Unexpected error for %s: %s", first.Path, first.Err)
+	}
+	if first.Zone != "_redirect.34.12.example.com" || !identical(first.Captures, []string{"34", "12"}) {
+		t.Errorf("Unexpected zone %s and captures %v", first.Zone, first.Captures)
+	}
+	// The captures are numbered from the end of the path
+	if first.Target != "https://example.test/34/12" {
+		t.Errorf("Expected the captures to be substituted in the target, got %s", first.Target)
+	}
+	if results[1].Err == nil {
+		t.Errorf("Expected an error for %s, got the zone %s", results[1].Path, results[1].Zone)
+	}
+
+	invalid := []string{
+		"v=txtv0;type=path;re=\\/(\\d+",
+		"v=txtv0;type=host;to=https://example.test",
+		"v=txtv0;type=path;re=\\/(\\d+);from=/$1",
+	}
+	for i, rec := range invalid {
+		if _, err := ValidateRecord("example.com", rec, "", []string{"/"}); err == nil {
+			t.Errorf("Test %d: Expected an error for %s", i, rec)
+		}
+	}
+}
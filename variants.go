@@ -0,0 +1,140 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// variant is one of the weighted targets of the records with several
+// to= fields, which pick one of them per request for A/B tests and
+// canary releases, e.g.
+// to=https://v1.example.com{uri} weight=9;to=https://v2.example.com{uri} weight=1
+type variant struct {
+	// Targets is the to= field's fallback chain with its placeholders filled
+	Targets []string
+	// Raw is the to= field as it's written in the record, which
+	// identifies the variant in the sticky cookies and the metrics
+	Raw    string
+	Weight int
+}
+
+const (
+	// DefaultVariantWeight is the weight of the targets without a weight
+	DefaultVariantWeight = 1
+	// variantCookiePrefix starts the name of the sticky variant cookies
+	variantCookiePrefix = "txtdirect_variant_"
+	variantCookieMaxAge = 30 * 24 * time.Hour
+)
+
+// parseVariant splits the weight off the to= field's value
+func parseVariant(field string) (string, int, error) {
+	parts := strings.Fields(field)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "weight=") {
+		return field, DefaultVariantWeight, nil
+	}
+	weight, err := strconv.Atoi(strings.TrimPrefix(parts[1], "weight="))
+	if err != nil || weight < 0 {
+		return "", 0, fmt.Errorf("target weight should be a number: %s", parts[1])
+	}
+	return parts[0], weight, nil
+}
+
+// id identifies the variant in the sticky cookie
+func (v variant) id() string {
+	sum := sha256.Sum256([]byte(v.Raw))
+	return hex.EncodeToString(sum[:8])
+}
+
+// variantCookie returns the name of the record's sticky cookie,
+// which changes with its targets so the experiments don't mix
+func variantCookie(variants []variant) string {
+	raws := make([]string, 0, len(variants))
+	for _, v := range variants {
+		raws = append(raws, v.Raw)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(raws, ";")))
+	return variantCookiePrefix + hex.EncodeToString(sum[:4])
+}
+
+// totalWeight sums the weights of the variants
+func totalWeight(variants []variant) int {
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	return total
+}
+
+// pickVariant picks one of the variants randomly based on their weights,
+// the variants without weight are never picked
+func pickVariant(variants []variant, intn func(int) int) variant {
+	n := intn(totalWeight(variants))
+	for _, v := range variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return variants[len(variants)-1]
+}
+
+// selectVariant replaces the record's targets by one of its variants.
+// The sticky records keep sending the client to the variant it got
+// first, as long as the variant is in the record.
+func selectVariant(w http.ResponseWriter, r *http.Request, rec record, c Config) record {
+	name := variantCookie(rec.Variants)
+	var picked *variant
+	if rec.Sticky {
+		if cookie, err := r.Cookie(name); err == nil {
+			for i, v := range rec.Variants {
+				if v.id() == cookie.Value && v.Weight > 0 {
+					picked = &rec.Variants[i]
+					break
+				}
+			}
+		}
+	}
+	if picked == nil {
+		v := pickVariant(rec.Variants, rand.Intn)
+		picked = &v
+		if rec.Sticky {
+			http.SetCookie(w, &http.Cookie{
+				Name:     name,
+				Value:    v.id(),
+				Path:     "/",
+				MaxAge:   int(variantCookieMaxAge.Seconds()),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+	}
+
+	if c.Prometheus.Enable {
+		VariantSelections.WithLabelValues(r.Host, picked.Raw).Add(1)
+	}
+	rec.Targets = append([]string(nil), picked.Targets...)
+	rec.To = ""
+	if len(rec.Targets) > 0 {
+		rec.To = rec.Targets[0]
+	}
+	return rec
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseVariants(t *testing.T) {
+	tests := []struct {
+		txt       string
+		variants  []variant
+		shouldErr bool
+	}{
+		{"v=txtv0;to=https://example.com;type=host", nil, false},
+		{
+			"v=txtv0;to=https://a.example.com weight=9;to=https://b.example.com,https://c.example.com;type=host",
+			[]variant{
+				{Targets: []string{"https://a.example.com"}, Raw: "https://a.example.com", Weight: 9},
+				{Targets: []string{"https://b.example.com", "https://c.example.com"}, Raw: "https://b.example.com,https://c.example.com", Weight: DefaultVariantWeight},
+			},
+			false,
+		},
+		{"v=txtv0;to=https://a.example.com weight=x;to=https://b.example.com;type=host", nil, true},
+		{"v=txtv0;to=https://a.example.com weight=0;to=https://b.example.com weight=0;type=host", nil, true},
+		{"v=txtv0;to=https://a.example.com;sticky=maybe;type=host", nil, true},
+	}
+	for i, test := range tests {
+		rec := record{}
+		err := rec.Parse(test.txt, nil, Config{Enable: []string{"host"}})
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if len(rec.Variants) != len(test.variants) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.variants, rec.Variants)
+			continue
+		}
+		for j, v := range test.variants {
+			if !reflect.DeepEqual(rec.Variants[j], v) {
+				t.Errorf("Test %d: Expected %+v, got %+v", i, v, rec.Variants[j])
+			}
+		}
+	}
+}
+
+func TestPickVariant(t *testing.T) {
+	variants := []variant{{Raw: "a", Weight: 3}, {Raw: "off", Weight: 0}, {Raw: "b", Weight: 1}}
+	expected := []string{"a", "a", "a", "b"}
+	for n, raw := range expected {
+		if v := pickVariant(variants, func(int) int { return n }); v.Raw != raw {
+			t.Errorf("Expected %d to pick %s, got %s", n, raw, v.Raw)
+		}
+	}
+}
+
+func TestSelectVariant(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+	redirect := func(url string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", url, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		if err := Redirect(w, req, c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return w
+	}
+
+	seen := make(map[string]*http.Cookie)
+	for i := 0; i < 100; i++ {
+		w := redirect("https://ab.variants.test/page", nil)
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("Expected the sticky record to set a cookie, got %v", cookies)
+		}
+		seen[w.Header().Get("Location")] = cookies[0]
+	}
+	if len(seen) != 2 || seen["https://a.example.com/page"] == nil || seen["https://b.example.com/page"] == nil {
+		t.Fatalf("Expected both variants to be picked, got %v", seen)
+	}
+
+	// The clients keep getting their variant
+	cookie := seen["https://b.example.com/page"]
+	for i := 0; i < 20; i++ {
+		w := redirect("https://ab.variants.test/other", cookie)
+		if location := w.Header().Get("Location"); location != "https://b.example.com/other" {
+			t.Fatalf("Expected the sticky variant, got %s", location)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("Expected the sticky cookie not to be set again")
+		}
+	}
+
+	// The variants without weight don't get any traffic
+	for i := 0; i < 20; i++ {
+		w := redirect("https://canary.variants.test/", nil)
+		if location := w.Header().Get("Location"); location != "https://stable.example.com" {
+			t.Fatalf("Expected the weighted variant, got %s", location)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("Expected the record without sticky not to set a cookie")
+		}
+	}
+}
@@ -0,0 +1,153 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// serveVendor builds a vendor-style zip of the requested module version
+// from the gomods cache, so it can be served without running go on the
+// host. The module's files are placed under vendor/<module>/ next to a
+// vendor/modules.txt. The subdir query parameter limits the zip to a
+// subtree of the module.
+func serveVendor(w http.ResponseWriter, r *http.Request, m Module, c Config) error {
+	s, err := m.storage(c)
+	if err != nil {
+		return err
+	}
+	cached, err := s.Zip(r.Context(), m.Name, m.Version)
+	if err != nil {
+		return fmt.Errorf("%s@%s isn't in the cache: %s", m.Name, m.Version, err.Error())
+	}
+	defer cached.Close()
+
+	// archive/zip needs random access to the module's zip
+	data, err := ioutil.ReadAll(cached)
+	if err != nil {
+		return err
+	}
+	src, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("couldn't read the cached zip of %s@%s: %s", m.Name, m.Version, err.Error())
+	}
+
+	var buf bytes.Buffer
+	subdir := vendorSubdir(r.URL.Query().Get("subdir"))
+	if err := buildVendorZip(&buf, src, m, subdir); err != nil {
+		return err
+	}
+
+	// Vendor zips are only built from the cache, so they're always hits
+	cacheStatus(w, "gomods", true, c.Gomods.CacheHeader, c)
+	filename := fmt.Sprintf("%s-%s-vendor.zip", path.Base(m.Name), m.Version)
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	_, err = io.Copy(w, &buf)
+	return err
+}
+
+// vendorSubdir cleans the requested subtree of the module,
+// so it can't point outside of the module
+func vendorSubdir(subdir string) string {
+	return path.Clean("/" + subdir)[1:]
+}
+
+// buildVendorZip writes the vendor-style zip of the given module zip. The
+// entries of module zips are prefixed with <module>@<version>/.
+func buildVendorZip(dst io.Writer, src *zip.Reader, m Module, subdir string) error {
+	prefix := m.Name + "@" + m.Version + "/"
+	vendorDir := path.Join("vendor", m.Name)
+
+	zw := zip.NewWriter(dst)
+	packages := make(map[string]bool)
+	for _, f := range src.File {
+		if !strings.HasPrefix(f.Name, prefix) || strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		name := strings.TrimPrefix(f.Name, prefix)
+		if subdir != "" && !strings.HasPrefix(name, subdir+"/") {
+			continue
+		}
+
+		if err := copyZipFile(zw, f, path.Join(vendorDir, name)); err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, ".go") && !strings.HasSuffix(name, "_test.go") {
+			packages[path.Join(m.Name, path.Dir(name))] = true
+		}
+	}
+	if len(packages) == 0 && subdir != "" {
+		return fmt.Errorf("%s@%s has no packages under %s", m.Name, m.Version, subdir)
+	}
+
+	modules, err := zw.Create("vendor/modules.txt")
+	if err != nil {
+		return err
+	}
+	if _, err := modules.Write(vendorModules(m, packages)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// vendorModules returns the content of vendor/modules.txt
+// listing the given packages of the module
+func vendorModules(m Module, packages map[string]bool) []byte {
+	list := make([]string, 0, len(packages))
+	for pkg := range packages {
+		list = append(list, pkg)
+	}
+	sort.Strings(list)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s %s\n## explicit\n", m.Name, m.Version)
+	for _, pkg := range list {
+		fmt.Fprintln(&buf, pkg)
+	}
+	return buf.Bytes()
+}
+
+// copyZipFile copies the given file into the zip writer under the given name
+func copyZipFile(zw *zip.Writer, f *zip.File, name string) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   f.Method,
+		Modified: f.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, rc)
+	return err
+}
@@ -0,0 +1,171 @@
+//go:build !nogomods
+// +build !nogomods
+
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/gomods/athens/pkg/storage/fs"
+	"github.com/spf13/afero"
+)
+
+func TestServeVendor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomods-vendor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Cache a module zip in the layout of the module proxies
+	var moduleZip bytes.Buffer
+	zw := zip.NewWriter(&moduleZip)
+	for _, name := range []string{"go.mod", "lib.go", "lib_test.go", "sub/pkg/pkg.go", "sub/pkg/README.md", "other/other.go"} {
+		f, err := zw.Create("example.com/mod@v1.0.0/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("package x"))
+	}
+	zw.Close()
+	s, err := fs.NewStorage(dir, afero.NewOsFs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(context.Background(), "example.com/mod", "v1.0.0", []byte("module example.com/mod"), &moduleZip, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path      string
+		query     string
+		files     []string
+		modules   string
+		shouldErr bool
+	}{
+		{
+			"/example.com/mod/@v/v1.0.0.vendor",
+			"",
+			[]string{
+				"vendor/example.com/mod/go.mod",
+				"vendor/example.com/mod/lib.go",
+				"vendor/example.com/mod/lib_test.go",
+				"vendor/example.com/mod/other/other.go",
+				"vendor/example.com/mod/sub/pkg/README.md",
+				"vendor/example.com/mod/sub/pkg/pkg.go",
+				"vendor/modules.txt",
+			},
+			"# example.com/mod v1.0.0\n## explicit\nexample.com/mod\nexample.com/mod/other\nexample.com/mod/sub/pkg\n",
+			false,
+		},
+		{
+			"/example.com/mod/@v/v1.0.0.vendor",
+			"?subdir=sub",
+			[]string{
+				"vendor/example.com/mod/sub/pkg/README.md",
+				"vendor/example.com/mod/sub/pkg/pkg.go",
+				"vendor/modules.txt",
+			},
+			"# example.com/mod v1.0.0\n## explicit\nexample.com/mod/sub/pkg\n",
+			false,
+		},
+		{
+			// The subdir can't escape the module
+			"/example.com/mod/@v/v1.0.0.vendor",
+			"?subdir=../../other",
+			[]string{
+				"vendor/example.com/mod/other/other.go",
+				"vendor/modules.txt",
+			},
+			"# example.com/mod v1.0.0\n## explicit\nexample.com/mod/other\n",
+			false,
+		},
+		{
+			"/example.com/mod/@v/v1.0.0.vendor",
+			"?subdir=missing",
+			nil,
+			"",
+			true,
+		},
+		{
+			// Only the cached versions are served
+			"/example.com/mod/@v/v2.0.0.vendor",
+			"",
+			nil,
+			"",
+			true,
+		},
+	}
+	for i, test := range tests {
+		c := Config{
+			Gomods: Gomods{
+				Enable: true,
+				Cache: Cache{
+					Enable: true,
+					Type:   "local",
+					Path:   dir,
+				},
+			},
+		}
+		c.Gomods.SetDefaults()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "https://example.com"+test.path+test.query, nil)
+		err := gomods(w, r, test.path, c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+
+		body := w.Body.Bytes()
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Errorf("Test %d: Couldn't read the vendor zip: %s", i, err)
+			continue
+		}
+		var files []string
+		modules := ""
+		for _, f := range zr.File {
+			files = append(files, f.Name)
+			if f.Name == "vendor/modules.txt" {
+				rc, _ := f.Open()
+				content, _ := ioutil.ReadAll(rc)
+				rc.Close()
+				modules = string(content)
+			}
+		}
+		sort.Strings(files)
+		if !identical(files, test.files) {
+			t.Errorf("Test %d: Expected files %v, got %v", i, test.files, files)
+		}
+		if modules != test.modules {
+			t.Errorf("Test %d: Expected modules.txt %q, got %q", i, test.modules, modules)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WAF contains the configuration of the rules protecting the upstreams
+// served through the vanity domains. The rules are checked in order before
+// the records of the given types are served, the first block or ratelimit
+// rule matching the request decides and the log rules only log it.
+type WAF struct {
+	Enable bool
+	// Types are the record types the rules are applied to
+	Types []string
+	Rules []WAFRule
+}
+
+// WAFRule matches the requests whose path, user agent and method
+// all match its patterns, the empty patterns match every request
+type WAFRule struct {
+	Name      string
+	Path      string
+	UserAgent string
+	Methods   []string
+	// Action is block, ratelimit or log
+	Action string
+	// Rate and Burst limit the matching requests of each
+	// client for the ratelimit action
+	Rate  float64
+	Burst int
+
+	path      *regexp.Regexp
+	userAgent *regexp.Regexp
+	limiter   *RateLimit
+}
+
+// DefaultWAFTypes are the record types serving their upstreams' responses
+var DefaultWAFTypes = []string{"proxy", "gomods", "dockerv2", "tor"}
+
+// wafActions are the actions the rules can take
+var wafActions = []string{"block", "ratelimit", "log"}
+
+// SetDefaults sets the default values for waf config
+// if the fields are empty
+func (waf *WAF) SetDefaults() {
+	if len(waf.Types) == 0 {
+		waf.Types = DefaultWAFTypes
+	}
+	for i := range waf.Rules {
+		rule := &waf.Rules[i]
+		if rule.Action == "ratelimit" && rule.limiter == nil {
+			rule.limiter = &RateLimit{Enable: true, Rate: rule.Rate, Burst: rule.Burst}
+			rule.limiter.SetDefaults()
+			rule.Rate, rule.Burst = rule.limiter.Rate, rule.limiter.Burst
+		}
+	}
+}
+
+// matches checks if the request matches the rule's patterns
+func (rule *WAFRule) matches(r *http.Request) bool {
+	if len(rule.Methods) > 0 && !contains(rule.Methods, r.Method) {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if rule.userAgent != nil && !rule.userAgent.MatchString(r.UserAgent()) {
+		return false
+	}
+	return true
+}
+
+// filter applies the rules to the request of the given record type.
+// It returns true when the request got blocked or rate limited.
+func (waf *WAF) filter(w http.ResponseWriter, r *http.Request, recordType string, c Config) bool {
+	if !contains(waf.Types, recordType) {
+		return false
+	}
+	for i := range waf.Rules {
+		rule := &waf.Rules[i]
+		if !rule.matches(r) {
+			continue
+		}
+		switch rule.Action {
+		case "log":
+			rule.record(r, c)
+		case "ratelimit":
+			if rule.limiter.limit(w, r, c) {
+				rule.record(r, c)
+				return true
+			}
+		case "block":
+			rule.record(r, c)
+			w.Header().Set("Status-Code", strconv.Itoa(http.StatusForbidden))
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return true
+		}
+	}
+	return false
+}
+
+// record logs and counts the request matching the rule
+func (rule *WAFRule) record(r *http.Request, c Config) {
+	log.Printf("[txtdirect]: WAF rule %s (%s) matched %s %s from %s, user agent %q",
+		rule.Name, rule.Action, r.Method, r.Host+r.URL.Path, clientIP(r), r.UserAgent())
+	if c.Prometheus.Enable {
+		WAFMatches.WithLabelValues(r.Host, rule.Name, rule.Action).Add(1)
+	}
+}
+
+// ParseWAF parses the txtdirect config for the waf
+func (waf *WAF) ParseWAF(c Dispenser) error {
+	switch c.Val() {
+	case "types":
+		types := c.RemainingArgs()
+		if len(types) == 0 {
+			return c.ArgErr()
+		}
+		waf.Types = types
+
+	case "rule":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		rule := WAFRule{Name: c.Val()}
+		if !c.NextArg() || c.Val() != "{" {
+			return c.ArgErr()
+		}
+		for c.Next() {
+			if c.Val() == "}" {
+				break
+			}
+			if err := rule.ParseWAFRule(c); err != nil {
+				return err
+			}
+		}
+		if rule.Action == "" {
+			return fmt.Errorf("The waf rule %s needs an action", rule.Name)
+		}
+		waf.Rules = append(waf.Rules, rule)
+
+	default:
+		return c.ArgErr() // unhandled option for waf
+	}
+	return nil
+}
+
+// ParseWAFRule parses the txtdirect config for a waf rule
+func (rule *WAFRule) ParseWAFRule(c Dispenser) error {
+	switch c.Val() {
+	case "path", "user_agent":
+		field := c.Val()
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		regex, err := regexp.Compile(args[0])
+		if err != nil {
+			return fmt.Errorf("The given value for %s field is not standard. It should be a regular expression", field)
+		}
+		if field == "path" {
+			rule.Path, rule.path = args[0], regex
+		} else {
+			rule.UserAgent, rule.userAgent = args[0], regex
+		}
+
+	case "method":
+		methods := c.RemainingArgs()
+		if len(methods) == 0 {
+			return c.ArgErr()
+		}
+		for _, method := range methods {
+			rule.Methods = append(rule.Methods, strings.ToUpper(method))
+		}
+
+	case "action":
+		args := c.RemainingArgs()
+		if len(args) == 0 || !contains(wafActions, args[0]) {
+			return fmt.Errorf("The given value for action field is not standard. It should be block, ratelimit or log")
+		}
+		rule.Action = args[0]
+		if len(args) == 1 {
+			break
+		}
+		if rule.Action != "ratelimit" || len(args) > 3 {
+			return c.ArgErr()
+		}
+		// The rate limit takes the rate and the optional burst
+		rate, err := strconv.ParseFloat(args[1], 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("The given value for the rate of the ratelimit action is not standard. It should be a positive number of requests per second")
+		}
+		rule.Rate = rate
+		if len(args) == 3 {
+			burst, err := strconv.Atoi(args[2])
+			if err != nil || burst < 1 {
+				return fmt.Errorf("The given value for the burst of the ratelimit action is not standard. It should be a positive integer")
+			}
+			rule.Burst = burst
+		}
+
+	default:
+		return c.ArgErr() // unhandled option for waf rule
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestWAF(t *testing.T) {
+	c := caddy.NewTestController("http", `
+	txtdirect {
+		enable host proxy
+		waf {
+			rule scanners {
+				user_agent (?i)(sqlmap|nikto)
+				action block
+			}
+			rule admin {
+				path ^/admin
+				method post put
+				action block
+			}
+			rule api {
+				path ^/api/
+				action ratelimit 1 2
+			}
+			rule everything {
+				action log
+			}
+		}
+	}
+	`)
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	conf.Resolver = "127.0.0.1:" + strconv.Itoa(port)
+
+	tests := []struct {
+		method    string
+		url       string
+		userAgent string
+		blocked   bool
+		status    int
+	}{
+		{"GET", "https://internal.policy.test/", "sqlmap/1.4", true, 403},
+		{"GET", "https://internal.policy.test/admin", "curl/7.64", false, 0},
+		{"POST", "https://internal.policy.test/admin/users", "curl/7.64", true, 403},
+		{"GET", "https://internal.policy.test/api/1", "curl/7.64", false, 0},
+		{"GET", "https://internal.policy.test/api/2", "curl/7.64", false, 0},
+		{"GET", "https://internal.policy.test/api/3", "curl/7.64", true, 429},
+		// The rules only protect the types serving their upstreams
+		{"GET", "https://host.e2e.test/", "sqlmap/1.4", false, 0},
+	}
+	for i, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		r.Header.Set("User-Agent", test.userAgent)
+		w := httptest.NewRecorder()
+		rec, err := getRecord(r.Host, r.Context(), conf, r)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if blocked := conf.WAF.filter(w, r, rec.Type, conf); blocked != test.blocked {
+			t.Errorf("Test %d: Expected the request to be blocked: %t, got %t", i, test.blocked, blocked)
+			continue
+		}
+		if test.blocked && w.Code != test.status {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Code)
+		}
+	}
+
+	// The blocked requests don't reach the upstream
+	r := httptest.NewRequest("GET", "https://internal.policy.test/", nil)
+	r.Header.Set("User-Agent", "Nikto")
+	w := httptest.NewRecorder()
+	if err := Redirect(w, r, conf); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if w.Code != 403 {
+		t.Errorf("Expected the request to be blocked before the proxy, got %d", w.Code)
+	}
+}
+
+func TestParseWAF(t *testing.T) {
+	tests := []struct {
+		config    string
+		shouldErr bool
+	}{
+		{"waf {\ntypes proxy gomods\nrule r {\npath ^/\naction log\n}\n}", false},
+		{"waf {\nrule r {\npath ^/\n}\n}", true},
+		{"waf {\nrule r {\npath (\naction block\n}\n}", true},
+		{"waf {\nrule r {\naction drop\n}\n}", true},
+		{"waf {\nrule r {\naction block 10\n}\n}", true},
+		{"waf {\nrule r {\naction ratelimit 0\n}\n}", true},
+		{"waf {\nrule {\naction block\n}\n}", true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", "txtdirect {\nenable proxy\n"+test.config+"\n}")
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !identical(conf.WAF.Types, []string{"proxy", "gomods"}) || len(conf.WAF.Rules) != 1 {
+			t.Errorf("Test %d: Unexpected waf config %+v", i, conf.WAF)
+		}
+	}
+
+	c := caddy.NewTestController("http", "txtdirect {\nwaf {\nrule api {\naction ratelimit 5\n}\n}\n}")
+	conf, err := parse(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	rule := conf.WAF.Rules[0]
+	if !identical(conf.WAF.Types, DefaultWAFTypes) || rule.Rate != 5 || rule.Burst != DefaultRateLimitBurst || rule.limiter == nil {
+		t.Errorf("Expected the default types and burst, got %+v", conf.WAF)
+	}
+}
@@ -0,0 +1,362 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks contains the configuration of the webhook notifications. The
+// events are posted as JSON to the endpoints subscribed to them in the
+// background, so the slow endpoints can't hold up the requests.
+type Webhooks struct {
+	Enable    bool
+	Endpoints []WebhookEndpoint
+	Retries   int
+	Timeout   time.Duration
+	QueueSize int
+
+	queue *webhookQueue
+}
+
+// WebhookEndpoint is an endpoint receiving the webhook events
+type WebhookEndpoint struct {
+	URL string
+	// Secret signs the bodies with HMAC-SHA256 in the
+	// X-TXTDirect-Signature header when it's set
+	Secret string
+	// Events are the events posted to the endpoint, all of them if empty
+	Events []string
+}
+
+// webhookQueue holds the events waiting to be delivered
+type webhookQueue struct {
+	sync.Mutex
+	events  chan webhookEvent
+	stop    chan struct{}
+	done    chan struct{}
+	client  *http.Client
+	metrics bool
+}
+
+// webhookEvent is the JSON body of the webhook requests
+type webhookEvent struct {
+	ID       string `json:"id"`
+	Event    string `json:"event"`
+	Time     string `json:"time"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Zone     string `json:"zone,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Fallback string `json:"fallback,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+const (
+	WebhookResolved        = "resolved"
+	WebhookFallback        = "fallback"
+	WebhookPolicyViolation = "policy_violation"
+)
+
+// webhookEvents are the events the endpoints can subscribe to
+var webhookEvents = []string{WebhookResolved, WebhookFallback, WebhookPolicyViolation}
+
+const (
+	DefaultWebhookRetries   = 3
+	DefaultWebhookTimeout   = 5 * time.Second
+	DefaultWebhookQueueSize = 1000
+)
+
+// webhookBackoff is the delay before the first retry of a delivery
+var webhookBackoff = time.Second
+
+// SetDefaults sets the default values for webhooks config
+// if the fields are empty
+func (wh *Webhooks) SetDefaults() {
+	if wh.Retries == 0 {
+		wh.Retries = DefaultWebhookRetries
+	}
+	if wh.Timeout == 0 {
+		wh.Timeout = DefaultWebhookTimeout
+	}
+	if wh.QueueSize == 0 {
+		wh.QueueSize = DefaultWebhookQueueSize
+	}
+	if wh.queue == nil {
+		wh.queue = &webhookQueue{
+			events: make(chan webhookEvent, wh.QueueSize),
+			client: &http.Client{Timeout: wh.Timeout},
+		}
+	}
+}
+
+// notify queues the event for the subscribed endpoints,
+// the event is dropped if the queue is full
+func (wh *Webhooks) notify(event webhookEvent, r *http.Request) {
+	if wh.queue == nil {
+		return
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	event.ID = hex.EncodeToString(id)
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	event.Host = r.Host
+	event.Path = r.URL.Path
+
+	select {
+	case wh.queue.events <- event:
+	default:
+		log.Printf("[txtdirect]: Dropped the %s webhook event of %s, the queue is full", event.Event, event.Host)
+		if wh.queue.metrics {
+			WebhookDeliveries.WithLabelValues(event.Event, "dropped").Add(1)
+		}
+	}
+}
+
+// notifyRequest queues the resolved or fallback event of the handled request
+func (wh *Webhooks) notifyRequest(r *http.Request, info *requestInfo, target string, status int) {
+	event := webhookEvent{Zone: info.Zone, Type: info.Type, Target: target, Status: status}
+	switch {
+	case info.Fallback != "":
+		event.Event = WebhookFallback
+		event.Fallback = info.Fallback
+	case info.Zone != "" && status < 400:
+		event.Event = WebhookResolved
+	default:
+		return
+	}
+	wh.notify(event, r)
+}
+
+// Start delivers the queued events in the background
+func (wh *Webhooks) Start() error {
+	wh.queue.Lock()
+	defer wh.queue.Unlock()
+	if wh.queue.stop != nil {
+		return nil
+	}
+	wh.queue.stop = make(chan struct{})
+	wh.queue.done = make(chan struct{})
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		for {
+			select {
+			case event := <-wh.queue.events:
+				wh.deliver(event)
+			case <-stop:
+				// Deliver the queued events before stopping
+				for {
+					select {
+					case event := <-wh.queue.events:
+						wh.deliver(event)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}(wh.queue.stop, wh.queue.done)
+	return nil
+}
+
+// Stop delivers the queued events and stops
+func (wh *Webhooks) Stop() error {
+	wh.queue.Lock()
+	stop, done := wh.queue.stop, wh.queue.done
+	wh.queue.stop = nil
+	wh.queue.Unlock()
+	if stop == nil {
+		return nil
+	}
+	close(stop)
+	<-done
+	return nil
+}
+
+// deliver posts the event to its subscribed endpoints
+func (wh *Webhooks) deliver(event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, endpoint := range wh.Endpoints {
+		if len(endpoint.Events) > 0 && !contains(endpoint.Events, event.Event) {
+			continue
+		}
+		result := "delivered"
+		if err := wh.post(endpoint, event, body); err != nil {
+			result = "failed"
+			log.Printf("[txtdirect]: Couldn't deliver the %s webhook event to %s: %s", event.Event, endpoint.URL, err.Error())
+		}
+		if wh.queue.metrics {
+			WebhookDeliveries.WithLabelValues(event.Event, result).Add(1)
+		}
+	}
+}
+
+// post sends the event to the endpoint, retrying the failures with a backoff
+func (wh *Webhooks) post(endpoint WebhookEndpoint, event webhookEvent, body []byte) error {
+	var err error
+	backoff := webhookBackoff
+	for attempt := 0; attempt <= wh.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		if retry, err = wh.postOnce(endpoint, event, body); err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postOnce sends the event to the endpoint once and
+// reports if the failed delivery is worth retrying
+func (wh *Webhooks) postOnce(endpoint WebhookEndpoint, event webhookEvent, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "TXTDirect-Webhooks")
+	req.Header.Set("X-TXTDirect-Event", event.Event)
+	req.Header.Set("X-TXTDirect-Delivery", event.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set("X-TXTDirect-Signature", "sha256="+webhookSignature(endpoint.Secret, body))
+	}
+	resp, err := wh.queue.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("the endpoint returned %d", resp.StatusCode)
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of the body
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ParseWebhooks parses the txtdirect config for the webhooks
+func (wh *Webhooks) ParseWebhooks(c Dispenser) error {
+	switch c.Val() {
+	case "endpoint":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		if !strings.HasPrefix(args[0], "http://") && !strings.HasPrefix(args[0], "https://") {
+			return fmt.Errorf("The given value for endpoint field is not standard. It should be an http or https URL")
+		}
+		endpoint := WebhookEndpoint{URL: args[0]}
+		c.NextArg()
+		if c.Val() == "{" {
+			for c.Next() {
+				if c.Val() == "}" {
+					break
+				}
+				if err := endpoint.parse(c); err != nil {
+					return err
+				}
+			}
+		}
+		wh.Endpoints = append(wh.Endpoints, endpoint)
+
+	case "retries":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for retries field is not standard. It should be a positive integer")
+		}
+		wh.Retries = value
+
+	case "timeout":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := time.ParseDuration(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for timeout field is not standard. It should be a positive duration")
+		}
+		wh.Timeout = value
+
+	case "queue_size":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		value, err := strconv.Atoi(args[0])
+		if err != nil || value <= 0 {
+			return fmt.Errorf("The given value for queue_size field is not standard. It should be a positive integer")
+		}
+		wh.QueueSize = value
+
+	default:
+		return c.ArgErr() // unhandled option for webhooks
+	}
+	return nil
+}
+
+// parse parses the options of the webhook endpoint's block
+func (endpoint *WebhookEndpoint) parse(c Dispenser) error {
+	switch c.Val() {
+	case "secret":
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		endpoint.Secret = args[0]
+
+	case "events":
+		events := c.RemainingArgs()
+		if len(events) == 0 {
+			return c.ArgErr()
+		}
+		for _, event := range events {
+			if !contains(webhookEvents, event) {
+				return fmt.Errorf("The given value for events field is not standard. It should be %s", strings.Join(webhookEvents, ", "))
+			}
+		}
+		endpoint.Events = append(endpoint.Events, events...)
+
+	default:
+		return c.ArgErr() // unhandled option for webhook endpoint
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// webhookReceiver records the events posted to the webhook endpoint
+type webhookReceiver struct {
+	sync.Mutex
+	events     []webhookEvent
+	signatures []string
+	attempts   int
+	// failures is the number of deliveries answered with failStatus
+	failures   int
+	failStatus int
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.Lock()
+	defer wr.Unlock()
+	wr.attempts++
+	if wr.failures > 0 {
+		wr.failures--
+		w.WriteHeader(wr.failStatus)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var event webhookEvent
+	json.Unmarshal(body, &event)
+	if r.Header.Get("X-TXTDirect-Event") != event.Event || r.Header.Get("X-TXTDirect-Delivery") != event.ID {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	wr.events = append(wr.events, event)
+	if signature := r.Header.Get("X-TXTDirect-Signature"); signature != "" {
+		valid := signature == "sha256="+webhookSignature("secret", body)
+		wr.signatures = append(wr.signatures, strconv.FormatBool(valid))
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	all := &webhookReceiver{}
+	allServer := httptest.NewServer(all)
+	defer allServer.Close()
+	fallbacks := &webhookReceiver{}
+	fallbacksServer := httptest.NewServer(fallbacks)
+	defer fallbacksServer.Close()
+
+	c := Config{
+		Enable:   []string{"host"},
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Redirect: "https://fallback.example.com",
+		Policy:   Policy{Enable: true, Domains: []string{"*.allowed.test", "fallback.example.com"}},
+		Webhooks: Webhooks{
+			Enable: true,
+			Endpoints: []WebhookEndpoint{
+				{URL: allServer.URL, Secret: "secret"},
+				{URL: fallbacksServer.URL, Events: []string{WebhookFallback}},
+			},
+		},
+	}
+	c.Policy.SetDefaults()
+	c.Webhooks.SetDefaults()
+	c.Webhooks.Start()
+	for _, url := range []string{"https://allowed.policy.test/", "https://nonexistent.webhooks.test/", "https://foreign.policy.test/"} {
+		if err := serve(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil), c); err != nil {
+			t.Errorf("Unexpected error for %s: %s", url, err)
+		}
+	}
+	c.Webhooks.Stop()
+
+	expected := []webhookEvent{
+		{Event: WebhookResolved, Host: "allowed.policy.test", Path: "/", Zone: "_redirect.allowed.policy.test.", Type: "host", Target: "https://docs.allowed.test", Status: 302},
+		{Event: WebhookFallback, Host: "nonexistent.webhooks.test", Path: "/", Target: "https://fallback.example.com", Status: 301, Fallback: "redirect"},
+		{Event: WebhookPolicyViolation, Host: "foreign.policy.test", Path: "/", Status: 403},
+	}
+	if len(all.events) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), all.events)
+	}
+	for i, event := range all.events {
+		if event.ID == "" || event.Time == "" {
+			t.Errorf("Event %d: Expected the id and time to be set, got %+v", i, event)
+		}
+		event.ID, event.Time = "", ""
+		if event.Event == WebhookPolicyViolation {
+			if event.Reason == "" {
+				t.Errorf("Event %d: Expected the violation's reason", i)
+			}
+			event.Reason = ""
+		}
+		if !reflect.DeepEqual(event, expected[i]) {
+			t.Errorf("Event %d: Expected %+v, got %+v", i, expected[i], event)
+		}
+	}
+	if !reflect.DeepEqual(all.signatures, []string{"true", "true", "true"}) {
+		t.Errorf("Expected the events to be signed, got %v", all.signatures)
+	}
+	if len(fallbacks.events) != 1 || fallbacks.events[0].Event != WebhookFallback || len(fallbacks.signatures) != 0 {
+		t.Errorf("Expected only the unsigned fallback event, got %+v", fallbacks.events)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	tests := []struct {
+		failures   int
+		failStatus int
+		delivered  bool
+		attempts   int
+	}{
+		{0, 0, true, 1},
+		{2, http.StatusServiceUnavailable, true, 3},
+		{5, http.StatusBadGateway, false, 4},
+		{1, http.StatusBadRequest, false, 1},
+	}
+	for i, test := range tests {
+		receiver := &webhookReceiver{failures: test.failures, failStatus: test.failStatus}
+		server := httptest.NewServer(receiver)
+
+		wh := Webhooks{Enable: true, Endpoints: []WebhookEndpoint{{URL: server.URL}}}
+		wh.SetDefaults()
+		wh.notify(webhookEvent{Event: WebhookResolved}, httptest.NewRequest("GET", "https://example.com/", nil))
+		wh.Start()
+		wh.Stop()
+		server.Close()
+
+		if delivered := len(receiver.events) == 1; delivered != test.delivered {
+			t.Errorf("Test %d: Expected the delivery to be %t, got %t", i, test.delivered, delivered)
+		}
+		if receiver.attempts != test.attempts {
+			t.Errorf("Test %d: Expected %d attempts, got %d", i, test.attempts, receiver.attempts)
+		}
+	}
+}
+
+func TestWebhooksQueueFull(t *testing.T) {
+	wh := Webhooks{Enable: true, QueueSize: 1, Endpoints: []WebhookEndpoint{{URL: "http://127.0.0.1:1"}}}
+	wh.SetDefaults()
+	for i := 0; i < 3; i++ {
+		wh.notify(webhookEvent{Event: WebhookResolved}, httptest.NewRequest("GET", "https://example.com/", nil))
+	}
+	if len(wh.queue.events) != 1 {
+		t.Errorf("Expected the events over the queue size to be dropped, got %d queued", len(wh.queue.events))
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  Webhooks
+		shouldErr bool
+	}{
+		{
+			`webhooks {
+				endpoint https://hooks.example.com/txtdirect
+			}`,
+			Webhooks{
+				Enable:    true,
+				Endpoints: []WebhookEndpoint{{URL: "https://hooks.example.com/txtdirect"}},
+				Retries:   DefaultWebhookRetries,
+				Timeout:   DefaultWebhookTimeout,
+				QueueSize: DefaultWebhookQueueSize,
+			},
+			false,
+		},
+		{
+			`webhooks {
+				endpoint https://hooks.example.com/txtdirect {
+					secret s3cret
+					events resolved fallback
+				}
+				endpoint http://analytics.internal/events
+				retries 5
+				timeout 2s
+				queue_size 100
+			}`,
+			Webhooks{
+				Enable: true,
+				Endpoints: []WebhookEndpoint{
+					{URL: "https://hooks.example.com/txtdirect", Secret: "s3cret", Events: []string{"resolved", "fallback"}},
+					{URL: "http://analytics.internal/events"},
+				},
+				Retries:   5,
+				Timeout:   2 * time.Second,
+				QueueSize: 100,
+			},
+			false,
+		},
+		{"webhooks", Webhooks{}, true},
+		{"webhooks {\nretries 2\n}", Webhooks{}, true},
+		{"webhooks {\nendpoint hooks.example.com\n}", Webhooks{}, true},
+		{"webhooks {\nendpoint https://hooks.example.com {\nevents clicked\n}\n}", Webhooks{}, true},
+		{"webhooks {\nendpoint https://hooks.example.com\nretries 0\n}", Webhooks{}, true},
+		{"webhooks {\nendpoint https://hooks.example.com\nformat xml\n}", Webhooks{}, true},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", fmt.Sprintf(`
+		txtdirect {
+			enable host
+			%s
+		}
+		`, test.input))
+		conf, err := parse(c)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if conf.Webhooks.queue == nil {
+			t.Errorf("Test %d: Expected the queue to be created", i)
+		}
+		conf.Webhooks.queue = nil
+		if !reflect.DeepEqual(conf.Webhooks, test.expected) {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, conf.Webhooks)
+		}
+	}
+}